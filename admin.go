@@ -0,0 +1,672 @@
+package slidingsync
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// AdminPrefix is the path prefix the admin API is served under on the sync API listener, when it
+// is protected with RequireAdminToken. The dedicated admin listener serves it without a prefix.
+const AdminPrefix = "/_syncv3"
+
+// NewAdminHandler returns the handler for the admin API. The admin API is unauthenticated, so
+// it must only be served on a listener which is not reachable by clients, or be wrapped in
+// RequireAdminToken.
+func NewAdminHandler(h2 *handler2.Handler, h3 *handler.SyncLiveHandler) http.Handler {
+	a := &admin{h2: h2, h3: h3}
+	r := mux.NewRouter()
+	r.Handle("/admin/log_levels", http.HandlerFunc(handleGetLogLevels)).Methods("GET")
+	r.Handle("/admin/log_levels", http.HandlerFunc(handleSetLogLevels)).Methods("PUT")
+	r.Handle("/admin/users/{userID}", http.HandlerFunc(a.handleDumpUser)).Methods("GET")
+	r.Handle("/admin/users/{userID}", http.HandlerFunc(a.handleEraseUser)).Methods("DELETE")
+	r.Handle("/admin/users/{userID}/export", http.HandlerFunc(a.handleExportUser)).Methods("GET")
+	r.Handle("/admin/users/{userID}/rooms/{roomID}/forget", http.HandlerFunc(a.handleForgetRoom)).Methods("POST")
+	r.Handle("/admin/account_data/usage", http.HandlerFunc(a.handleAccountDataUsage)).Methods("GET")
+	r.Handle("/admin/malformed_events", http.HandlerFunc(a.handleListMalformedEvents)).Methods("GET")
+	r.Handle("/admin/rooms/{roomID}/members/{userID}/history", http.HandlerFunc(a.handleMembershipHistory)).Methods("GET")
+	r.Handle("/admin/conns", http.HandlerFunc(a.handleListConns)).Methods("GET")
+	r.Handle("/admin/conns/{userID}/{deviceID}", http.HandlerFunc(a.handleCloseConn)).Methods("DELETE")
+	r.Handle("/admin/pollers", http.HandlerFunc(a.handleListPollers)).Methods("GET")
+	r.Handle("/admin/pollers/startup", http.HandlerFunc(a.handleStartupProgress)).Methods("GET")
+	r.Handle("/admin/pollers/{userID}/{deviceID}", http.HandlerFunc(a.handleStopPoller)).Methods("DELETE")
+	r.Handle("/admin/pollers/{userID}/{deviceID}/resync", http.HandlerFunc(a.handleResyncPoller)).Methods("POST")
+	r.Handle("/admin/pollers/{userID}/{deviceID}/since", http.HandlerFunc(a.handleResetSince)).Methods("DELETE")
+	r.Handle("/health/pollers", http.HandlerFunc(a.handlePollerHealth)).Methods("GET")
+	r.Handle("/health/startup", http.HandlerFunc(a.handleStartupHealth)).Methods("GET")
+	return r
+}
+
+// RequireAdminToken only passes on requests with this bearer token, so that the admin API can be
+// served on a listener which clients can reach.
+func RequireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || given == "" {
+			writeAdminError(w, &internal.HandlerError{
+				StatusCode: 401,
+				ErrCode:    "M_MISSING_TOKEN",
+				Err:        fmt.Errorf("missing admin token"),
+			})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Warn().Str("path", req.URL.Path).Str("ip", req.RemoteAddr).Msg("admin: rejected request with wrong token")
+			writeAdminError(w, &internal.HandlerError{
+				StatusCode: 401,
+				ErrCode:    "M_UNKNOWN_TOKEN",
+				Err:        fmt.Errorf("unknown admin token"),
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type admin struct {
+	h2 *handler2.Handler
+	h3 *handler.SyncLiveHandler
+}
+
+// userDump is everything the proxy believes about a user. The in-memory view is what
+// connections are served from, and can be compared against the stored view to find
+// where they diverge.
+type userDump struct {
+	UserID string `json:"user_id"`
+	// false if no connection has loaded this user since the proxy started, in which case
+	// Rooms is empty.
+	CacheLoaded bool                 `json:"cache_loaded"`
+	Rooms       map[string]roomDump  `json:"rooms"`
+	Invites     []string             `json:"invites"`
+	StoredRooms map[string]roomDump  `json:"stored_rooms"`
+	Devices     []deviceDump         `json:"devices"`
+	Pollers     []sync2.PollerStatus `json:"pollers"`
+	Conns       []connDump           `json:"conns"`
+	Errors      map[string]string    `json:"errors,omitempty"`
+}
+
+type roomDump struct {
+	IsDM              bool               `json:"is_dm,omitempty"`
+	IsInvite          bool               `json:"is_invite,omitempty"`
+	HasLeft           bool               `json:"has_left,omitempty"`
+	Joined            bool               `json:"joined"`
+	JoinNID           int64              `json:"join_nid,omitempty"`
+	JoinTS            uint64             `json:"join_ts,omitempty"`
+	NotificationCount int                `json:"notification_count"`
+	HighlightCount    int                `json:"highlight_count"`
+	UnreadCount       int                `json:"unread_count"`
+	Spaces            []string           `json:"spaces,omitempty"`
+	Tags              map[string]float64 `json:"tags,omitempty"`
+}
+
+type deviceDump struct {
+	DeviceID          string         `json:"device_id"`
+	HasSince          bool           `json:"has_since"`
+	SoftLoggedOut     bool           `json:"soft_logged_out,omitempty"`
+	OTKCounts         map[string]int `json:"otk_counts,omitempty"`
+	FallbackKeyTypes  []string       `json:"fallback_key_types,omitempty"`
+	DeviceListChanged int            `json:"device_list_changed"`
+	DeviceListLeft    int            `json:"device_list_left"`
+}
+
+type connDump struct {
+	DeviceID      string `json:"device_id"`
+	ConnID        string `json:"conn_id"`
+	Alive         bool   `json:"alive"`
+	CreatedTS     int64  `json:"created_ts"`
+	LastRequestTS int64  `json:"last_request_ts"`
+}
+
+func newConnDump(conn *sync3.Conn) connDump {
+	return connDump{
+		DeviceID:      conn.DeviceID,
+		ConnID:        conn.CID,
+		Alive:         conn.Alive(),
+		CreatedTS:     conn.CreatedAt().UnixMilli(),
+		LastRequestTS: conn.LastRequest().UnixMilli(),
+	}
+}
+
+// handleDumpUser returns a JSON dump of the proxy's view of a user, for debugging reports where
+// a client disagrees with the homeserver. Failing to load one section does not fail the request,
+// instead the error is reported in the dump.
+func (a *admin) handleDumpUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	if userID == "" || userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("userID", "invalid user ID '%s'", userID))
+		return
+	}
+	dump := userDump{
+		UserID:      userID,
+		Rooms:       make(map[string]roomDump),
+		Invites:     []string{},
+		StoredRooms: make(map[string]roomDump),
+		Devices:     []deviceDump{},
+		Pollers:     a.h2.PollerStatuses(userID),
+		Conns:       []connDump{},
+		Errors:      make(map[string]string),
+	}
+	if dump.Pollers == nil {
+		dump.Pollers = []sync2.PollerStatus{}
+	}
+	sort.Slice(dump.Pollers, func(i, j int) bool {
+		return dump.Pollers[i].DeviceID < dump.Pollers[j].DeviceID
+	})
+
+	if uc := a.h3.CacheForUser(userID); uc != nil {
+		dump.CacheLoaded = true
+		for roomID, urd := range uc.AllRooms() {
+			rd := roomDump{
+				IsDM:              urd.IsDM,
+				IsInvite:          urd.IsInvite,
+				HasLeft:           urd.HasLeft,
+				Joined:            !urd.IsInvite && !urd.HasLeft,
+				JoinNID:           urd.JoinTiming.NID,
+				JoinTS:            urd.JoinTiming.Timestamp,
+				NotificationCount: urd.NotificationCount,
+				HighlightCount:    urd.HighlightCount,
+				UnreadCount:       urd.UnreadCount,
+				Tags:              urd.Tags,
+			}
+			for spaceID := range urd.Spaces {
+				rd.Spaces = append(rd.Spaces, spaceID)
+			}
+			sort.Strings(rd.Spaces)
+			dump.Rooms[roomID] = rd
+		}
+		for roomID := range uc.Invites() {
+			dump.Invites = append(dump.Invites, roomID)
+		}
+		sort.Strings(dump.Invites)
+	}
+
+	a.dumpStoredRooms(userID, &dump)
+	a.dumpDevices(userID, &dump)
+
+	for _, conn := range a.h3.ConnMap.ConnsForUser(userID) {
+		dump.Conns = append(dump.Conns, newConnDump(conn))
+	}
+	sort.Slice(dump.Conns, func(i, j int) bool {
+		if dump.Conns[i].DeviceID != dump.Conns[j].DeviceID {
+			return dump.Conns[i].DeviceID < dump.Conns[j].DeviceID
+		}
+		return dump.Conns[i].ConnID < dump.Conns[j].ConnID
+	})
+	writeAdminJSON(w, 200, dump)
+}
+
+// dumpStoredRooms loads the user's joined rooms and unread counts from the database.
+func (a *admin) dumpStoredRooms(userID string, dump *userDump) {
+	latestNID, err := a.h3.Storage.LatestEventNID()
+	if err != nil {
+		dump.Errors["stored_rooms"] = err.Error()
+		return
+	}
+	joinTimings, err := a.h3.Storage.JoinedRoomsAfterPosition(userID, latestNID)
+	if err != nil {
+		dump.Errors["stored_rooms"] = err.Error()
+		return
+	}
+	for roomID, timing := range joinTimings {
+		dump.StoredRooms[roomID] = roomDump{
+			Joined:  true,
+			JoinNID: timing.NID,
+			JoinTS:  timing.Timestamp,
+		}
+	}
+	err = a.h3.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount, unreadCount int) {
+		rd := dump.StoredRooms[roomID]
+		rd.HighlightCount = highlightCount
+		rd.NotificationCount = notificationCount
+		rd.UnreadCount = unreadCount
+		dump.StoredRooms[roomID] = rd
+	})
+	if err != nil {
+		dump.Errors["stored_unread_counts"] = err.Error()
+	}
+}
+
+// dumpDevices summarises the stored device data for each of the user's devices. Device list
+// changes are counted rather than listed, as they can be very large.
+func (a *admin) dumpDevices(userID string, dump *userDump) {
+	devices, err := a.h3.V2Store.DevicesTable.DevicesForUser(userID)
+	if err != nil {
+		dump.Errors["devices"] = err.Error()
+		return
+	}
+	for _, device := range devices {
+		dd := deviceDump{
+			DeviceID:      device.DeviceID,
+			HasSince:      device.Since != "",
+			SoftLoggedOut: device.SoftLogoutTS != 0,
+		}
+		data, err := a.h3.Storage.DeviceDataTable.Select(userID, device.DeviceID, false)
+		if err != nil {
+			dump.Errors["device_data."+device.DeviceID] = err.Error()
+		} else if data != nil {
+			dd.OTKCounts = data.OTKCounts
+			dd.FallbackKeyTypes = data.FallbackKeyTypes
+			dd.DeviceListChanged = len(data.DeviceListChanged)
+			dd.DeviceListLeft = len(data.DeviceListLeft)
+		}
+		dump.Devices = append(dump.Devices, dd)
+	}
+}
+
+// handleExportUser returns every row the proxy stores about a user, by table name, for data
+// export requests.
+func (a *admin) handleExportUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	if userID == "" || userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("userID", "invalid user ID '%s'", userID))
+		return
+	}
+	tables, err := a.h2.ExportUser(userID)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	writeAdminJSON(w, 200, struct {
+		UserID string                       `json:"user_id"`
+		Tables map[string][]json.RawMessage `json:"tables"`
+	}{userID, tables})
+}
+
+// handleEraseUser deletes every row the proxy stores about a user, for erasure requests. The
+// user's pollers are stopped and their connections closed. Erasing an unknown user succeeds, as
+// there is nothing to erase.
+func (a *admin) handleEraseUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	if userID == "" || userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("userID", "invalid user ID '%s'", userID))
+		return
+	}
+	devices, err := a.h2.EraseUser(userID)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	conns := a.h3.EvictUser(userID)
+	logger.Info().Str("user", userID).Int("devices", devices).Int("conns", conns).Msg("admin: erased user")
+	writeAdminJSON(w, 200, struct {
+		Devices int `json:"devices"`
+		Conns   int `json:"conns"`
+	}{devices, conns})
+}
+
+// handleForgetRoom hides a room the user has left from them, as homeservers do not tell the proxy
+// when a user forgets a room.
+func (a *admin) handleForgetRoom(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	roomID := vars["roomID"]
+	userID := vars["userID"]
+	if roomID == "" || roomID[0] != '!' {
+		writeAdminError(w, internal.InvalidParamError("roomID", "invalid room ID '%s'", roomID))
+		return
+	}
+	if userID == "" || userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("userID", "invalid user ID '%s'", userID))
+		return
+	}
+	if a.h3.Dispatcher.IsUserJoined(userID, roomID) {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    "M_UNKNOWN",
+			Err:        fmt.Errorf("user %s must leave room %s before forgetting it", userID, roomID),
+		})
+		return
+	}
+	if err := a.h2.ForgetRoom(userID, roomID); err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	logger.Info().Str("user", userID).Str("room", roomID).Msg("admin: forgot room")
+	writeAdminJSON(w, 200, struct{}{})
+}
+
+// handleAccountDataUsage lists the users with the most account data, to find the users who are
+// nearest to or over the account data quotas. The number of users is set with ?limit=, up to 100.
+func (a *admin) handleAccountDataUsage(w http.ResponseWriter, req *http.Request) {
+	limit := 20
+	if l := req.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > 100 {
+			writeAdminError(w, internal.InvalidParamError("limit", "must be between 1 and 100: '%s'", l))
+			return
+		}
+		limit = n
+	}
+	usages, err := a.h3.Storage.LargestAccountDataUsers(limit)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	if usages == nil {
+		usages = []state.AccountDataUsage{}
+	}
+	writeAdminJSON(w, 200, struct {
+		Users []state.AccountDataUsage `json:"users"`
+	}{usages})
+}
+
+// handleListMalformedEvents lists the most recent events quarantined in strict validation mode,
+// optionally only those in ?room_id=. The number of events is set with ?limit=, up to 1000.
+func (a *admin) handleListMalformedEvents(w http.ResponseWriter, req *http.Request) {
+	roomID := req.URL.Query().Get("room_id")
+	if roomID != "" && roomID[0] != '!' {
+		writeAdminError(w, internal.InvalidParamError("room_id", "invalid room ID '%s'", roomID))
+		return
+	}
+	limit := 100
+	if l := req.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > 1000 {
+			writeAdminError(w, internal.InvalidParamError("limit", "must be between 1 and 1000: '%s'", l))
+			return
+		}
+		limit = n
+	}
+	events, err := a.h2.Store.MalformedEventsTable.Select(roomID, limit)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	if events == nil {
+		events = []state.MalformedEvent{}
+	}
+	writeAdminJSON(w, 200, struct {
+		Events []state.MalformedEvent `json:"events"`
+	}{events})
+}
+
+// handleMembershipHistory returns every stored membership event of a user in a room, along with the
+// snapshots which include them, to debug users seeing rooms they have left or missing rooms they
+// are in.
+func (a *admin) handleMembershipHistory(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	roomID := vars["roomID"]
+	userID := vars["userID"]
+	if roomID == "" || roomID[0] != '!' {
+		writeAdminError(w, internal.InvalidParamError("roomID", "invalid room ID '%s'", roomID))
+		return
+	}
+	if userID == "" || userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("userID", "invalid user ID '%s'", userID))
+		return
+	}
+	history, err := a.h3.Storage.MembershipHistory(roomID, userID)
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	writeAdminJSON(w, 200, history)
+}
+
+// handleListConns lists every connection, or only the connections of ?user_id=.
+func (a *admin) handleListConns(w http.ResponseWriter, req *http.Request) {
+	userID := req.URL.Query().Get("user_id")
+	if userID != "" && userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("user_id", "invalid user ID '%s'", userID))
+		return
+	}
+	var conns []*sync3.Conn
+	if userID != "" {
+		conns = a.h3.ConnMap.ConnsForUser(userID)
+	} else {
+		conns = a.h3.ConnMap.AllConns()
+	}
+	type connStatus struct {
+		UserID string `json:"user_id"`
+		connDump
+	}
+	statuses := make([]connStatus, 0, len(conns))
+	for _, conn := range conns {
+		statuses = append(statuses, connStatus{UserID: conn.UserID, connDump: newConnDump(conn)})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].UserID != statuses[j].UserID {
+			return statuses[i].UserID < statuses[j].UserID
+		}
+		if statuses[i].DeviceID != statuses[j].DeviceID {
+			return statuses[i].DeviceID < statuses[j].DeviceID
+		}
+		return statuses[i].ConnID < statuses[j].ConnID
+	})
+	writeAdminJSON(w, 200, struct {
+		Conns []connStatus `json:"conns"`
+	}{statuses})
+}
+
+// handleCloseConn closes the connection ?conn_id= of a device, which is the device's default
+// connection if unset. The client gets M_UNKNOWN_POS on its next request.
+func (a *admin) handleCloseConn(w http.ResponseWriter, req *http.Request) {
+	userID, deviceID, herr := pollerVars(req)
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	cid := sync3.ConnID{UserID: userID, DeviceID: deviceID, CID: req.URL.Query().Get("conn_id")}
+	if !a.h3.ConnMap.CloseConn(cid, sync3.EvictionAdmin) {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_NOT_FOUND",
+			Err:        fmt.Errorf("no connection %s", cid.String()),
+		})
+		return
+	}
+	writeAdminJSON(w, 200, struct{}{})
+}
+
+// handleListPollers lists every poller, or only the pollers of ?user_id=, including terminated
+// pollers which have not been replaced yet.
+func (a *admin) handleListPollers(w http.ResponseWriter, req *http.Request) {
+	userID := req.URL.Query().Get("user_id")
+	if userID != "" && userID[0] != '@' {
+		writeAdminError(w, internal.InvalidParamError("user_id", "invalid user ID '%s'", userID))
+		return
+	}
+	pollers := a.h2.PollerStatuses(userID)
+	if pollers == nil {
+		pollers = []sync2.PollerStatus{}
+	}
+	sort.Slice(pollers, func(i, j int) bool {
+		if pollers[i].UserID != pollers[j].UserID {
+			return pollers[i].UserID < pollers[j].UserID
+		}
+		return pollers[i].DeviceID < pollers[j].DeviceID
+	})
+	writeAdminJSON(w, 200, struct {
+		Pollers []sync2.PollerStatus `json:"pollers"`
+	}{pollers})
+}
+
+// handleStartupProgress returns how many of the stored devices have been polled since startup.
+func (a *admin) handleStartupProgress(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, 200, a.h2.StartupProgress())
+}
+
+// handlePollerHealth returns the health of every active poller, with a 503 if too many are
+// failing so that orchestrators can alert on it.
+func (a *admin) handlePollerHealth(w http.ResponseWriter, req *http.Request) {
+	health := a.h2.PollerHealth()
+	statusCode := 200
+	if !health.Healthy {
+		statusCode = 503
+	}
+	writeAdminJSON(w, statusCode, health)
+}
+
+// NewHealthHandler returns a health check for a process running this role, which is safe to serve
+// without authentication as it only says whether the process is healthy. The pollers are unhealthy
+// if too many of them are failing, see /health/pollers, and the sync API is unhealthy once it starts
+// draining for a shutdown. An empty role checks both.
+func NewHealthHandler(role string, h2 *handler2.Handler, h3 *handler.SyncLiveHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
+		res := struct {
+			Role    string `json:"role"`
+			Healthy bool   `json:"healthy"`
+		}{
+			Role:    role,
+			Healthy: true,
+		}
+		if role == "" {
+			res.Role = "all"
+		}
+		if role != RoleAPI && !h2.PollerHealth().Healthy {
+			res.Healthy = false
+		}
+		if role != RolePoller && h3.IsDraining() {
+			res.Healthy = false
+		}
+		statusCode := 200
+		if !res.Healthy {
+			statusCode = 503
+		}
+		writeAdminJSON(w, statusCode, res)
+	})
+}
+
+// handleStartupHealth returns how many rooms have had their metadata loaded since a lazy startup.
+// The sync API is already serving requests, so this is always a 200.
+func (a *admin) handleStartupHealth(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, 200, a.h3.GlobalCache.HydrationProgress())
+}
+
+// handleStopPoller stops a poller without expiring its token. It is restarted by the device's
+// next request, from the stored since token.
+func (a *admin) handleStopPoller(w http.ResponseWriter, req *http.Request) {
+	userID, deviceID, herr := pollerVars(req)
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	if !a.h2.StopPoller(userID, deviceID) {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_NOT_FOUND",
+			Err:        fmt.Errorf("no running poller for %s %s", userID, deviceID),
+		})
+		return
+	}
+	writeAdminJSON(w, 200, struct{}{})
+}
+
+// handleResyncPoller restarts a poller with an initial sync. The initial sync runs in the
+// background, so this returns before it completes.
+func (a *admin) handleResyncPoller(w http.ResponseWriter, req *http.Request) {
+	a.resetSince(w, req, true)
+}
+
+// handleResetSince forgets the stored since token of a device and stops its poller, so the
+// device's next request starts a poller with an initial sync.
+func (a *admin) handleResetSince(w http.ResponseWriter, req *http.Request) {
+	a.resetSince(w, req, false)
+}
+
+func (a *admin) resetSince(w http.ResponseWriter, req *http.Request, restart bool) {
+	userID, deviceID, herr := pollerVars(req)
+	if herr != nil {
+		writeAdminError(w, herr)
+		return
+	}
+	err := a.h2.ResetDeviceSince(userID, deviceID, restart)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_NOT_FOUND",
+			Err:        fmt.Errorf("unknown device %s %s", userID, deviceID),
+		})
+		return
+	}
+	if err != nil {
+		writeAdminError(w, &internal.HandlerError{StatusCode: 500, Err: err})
+		return
+	}
+	code := 200
+	if restart {
+		code = 202
+	}
+	writeAdminJSON(w, code, struct{}{})
+}
+
+func pollerVars(req *http.Request) (userID, deviceID string, herr *internal.HandlerError) {
+	vars := mux.Vars(req)
+	userID = vars["userID"]
+	deviceID = vars["deviceID"]
+	if userID == "" || userID[0] != '@' {
+		return "", "", internal.InvalidParamError("userID", "invalid user ID '%s'", userID)
+	}
+	if deviceID == "" {
+		return "", "", internal.InvalidParamError("deviceID", "missing device ID")
+	}
+	return userID, deviceID, nil
+}
+
+// handleGetLogLevels returns the log level of every module e.g {"default":"info","poller":"debug"}
+func handleGetLogLevels(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, 200, internal.ModuleLogLevels())
+}
+
+// handleSetLogLevels changes the log level of the modules in the request body. Modules which
+// are not in the request body keep their current level.
+func handleSetLogLevels(w http.ResponseWriter, req *http.Request) {
+	var levels map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&levels); err != nil {
+		writeAdminError(w, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("failed to decode request body: %s", err),
+		})
+		return
+	}
+	// validate everything first so we don't partially apply a bad request
+	current := internal.ModuleLogLevels()
+	for module, levelStr := range levels {
+		if _, exists := current[module]; !exists {
+			writeAdminError(w, internal.InvalidParamError(module, "unknown log module '%s'", module))
+			return
+		}
+		if _, err := internal.ParseLogLevel(levelStr); err != nil {
+			writeAdminError(w, internal.InvalidParamError(module, "%s", err))
+			return
+		}
+	}
+	for module, levelStr := range levels {
+		level, _ := internal.ParseLogLevel(levelStr)
+		if err := internal.SetModuleLogLevel(module, level); err != nil {
+			writeAdminError(w, internal.InvalidParamError(module, "%s", err))
+			return
+		}
+		logger.Info().Str("module", module).Str("level", level.String()).Msg("admin: changed log level")
+	}
+	writeAdminJSON(w, 200, internal.ModuleLogLevels())
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAdminError(w http.ResponseWriter, herr *internal.HandlerError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.StatusCode)
+	w.Write(herr.JSON())
+}
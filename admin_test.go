@@ -0,0 +1,61 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	})
+	router := newSyncRouter(http.NotFoundHandler(), RequireAdminToken("0123456789abcdef", admin), "http://localhost")
+	testCases := []struct {
+		name     string
+		path     string
+		auth     string
+		wantCode int
+		wantErr  string
+		wantPath string
+	}{
+		{name: "no token", path: "/_syncv3/admin/pollers", wantCode: 401, wantErr: "M_MISSING_TOKEN"},
+		{name: "not bearer", path: "/_syncv3/admin/pollers", auth: "Basic 0123456789abcdef", wantCode: 401, wantErr: "M_MISSING_TOKEN"},
+		{name: "wrong token", path: "/_syncv3/admin/pollers", auth: "Bearer 0123456789abcdeg", wantCode: 401, wantErr: "M_UNKNOWN_TOKEN"},
+		{name: "token prefix", path: "/_syncv3/admin/pollers", auth: "Bearer 0123", wantCode: 401, wantErr: "M_UNKNOWN_TOKEN"},
+		{name: "right token", path: "/_syncv3/admin/pollers", auth: "Bearer 0123456789abcdef", wantCode: 200, wantPath: "/admin/pollers"},
+		{name: "outside the admin API", path: "/_syncv3/pollers", auth: "Bearer 0123456789abcdef", wantCode: 404},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got status %d want %d", tc.name, w.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantErr != "" {
+			if errcode := gjson.Get(w.Body.String(), "errcode").Str; errcode != tc.wantErr {
+				t.Errorf("%s: got errcode %s want %s", tc.name, errcode, tc.wantErr)
+			}
+		}
+		if tc.wantPath != "" && w.Body.String() != tc.wantPath {
+			t.Errorf("%s: admin API got path %s want %s", tc.name, w.Body.String(), tc.wantPath)
+		}
+	}
+
+	// without a token the admin API is not served on the sync API at all
+	router = newSyncRouter(http.NotFoundHandler(), nil, "http://localhost")
+	req := httptest.NewRequest("GET", "/_syncv3/admin/pollers", nil)
+	req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("no admin API: got status %d want 404", w.Code)
+	}
+}
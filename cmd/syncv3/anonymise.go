@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+)
+
+// anonymiseBatchSize is the number of rows inserted per statement when copying tables.
+const anonymiseBatchSize = 500
+
+// columnKind describes how a column is anonymised.
+type columnKind int
+
+const (
+	columnKeep           columnKind = iota // copied verbatim e.g nids, timestamps, counts
+	columnID                               // a matrix ID e.g user, room or event ID
+	columnStateKey                         // a state key, which is usually but not always a matrix ID
+	columnDeviceID                         // a device ID
+	columnStrip                            // free text: replaced with a string of the same length
+	columnHash                             // opaque token: replaced with a hash
+	columnEvent                            // a JSON event
+	columnEventArray                       // a JSON array of events
+	columnIDArray                          // a postgres TEXT[] of matrix IDs
+	columnThreadID                         // a receipt thread ID: "main", "" or an event ID
+	columnClear                            // secrets: replaced with the empty string
+	columnMalformedEvent                   // a rejected event, which may not be JSON: stripped if it isn't
+)
+
+// anonymiseTables lists every proxy table and how each of its columns is anonymised.
+// Columns which are not listed are copied verbatim. TestAnonymiseTablesCoverSchema checks that
+// new tables are added here.
+var anonymiseTables = []struct {
+	table   string
+	columns map[string]columnKind
+}{
+	{"syncv3_events", map[string]columnKind{
+		"event_id": columnID, "room_id": columnID, "state_key": columnStateKey, "prev_batch": columnHash, "event": columnEvent,
+	}},
+	{"syncv3_snapshots", map[string]columnKind{"room_id": columnID}},
+	{"syncv3_rooms", map[string]columnKind{
+		"room_id": columnID, "upgraded_room_id": columnID, "predecessor_room_id": columnID,
+	}},
+	{"syncv3_spaces", map[string]columnKind{"parent": columnID, "child": columnID, "ordering": columnStrip}},
+	{"syncv3_invites", map[string]columnKind{"room_id": columnID, "user_id": columnID, "invite_state": columnEventArray}},
+	{"syncv3_retired_invites", map[string]columnKind{"room_id": columnID, "user_id": columnID}},
+	{"syncv3_room_summaries", map[string]columnKind{"room_id": columnID, "summary": columnEvent}},
+	{"syncv3_unread", map[string]columnKind{"room_id": columnID, "user_id": columnID}},
+	{"syncv3_unread_threads", map[string]columnKind{"room_id": columnID, "user_id": columnID, "thread_id": columnID}},
+	{"syncv3_forgotten_rooms", map[string]columnKind{"user_id": columnID, "room_id": columnID}},
+	{"syncv3_typing", map[string]columnKind{"room_id": columnID, "user_ids": columnIDArray}},
+	{"syncv3_receipts", map[string]columnKind{
+		"room_id": columnID, "user_id": columnID, "event_id": columnID, "thread_id": columnThreadID,
+	}},
+	{"syncv3_receipts_private", map[string]columnKind{
+		"room_id": columnID, "user_id": columnID, "event_id": columnID, "thread_id": columnThreadID,
+	}},
+	{"syncv3_account_data", map[string]columnKind{"user_id": columnID, "room_id": columnID, "data": columnEvent}},
+	{"syncv3_txns", map[string]columnKind{
+		"user_id": columnID, "device_id": columnDeviceID, "event_id": columnID, "txn_id": columnHash,
+	}},
+	{"syncv3_to_device_messages", map[string]columnKind{
+		"user_id": columnID, "device_id": columnDeviceID, "sender": columnID, "message": columnEvent, "unique_key": columnHash,
+	}},
+	{"syncv3_to_device_ack_pos", map[string]columnKind{"user_id": columnID, "device_id": columnDeviceID}},
+	// device data only contains OTK counts and fallback key types, which are safe to share.
+	{"syncv3_device_data", map[string]columnKind{"user_id": columnID, "device_id": columnDeviceID}},
+	{"syncv3_device_list_updates", map[string]columnKind{
+		"user_id": columnID, "device_id": columnDeviceID, "target_user_id": columnID,
+	}},
+	{"syncv3_sync2_devices", map[string]columnKind{"user_id": columnID, "device_id": columnDeviceID, "since": columnHash}},
+	{"syncv3_sync2_tokens", map[string]columnKind{
+		"token_hash": columnHash, "token_encrypted": columnClear, "user_id": columnID, "device_id": columnDeviceID,
+	}},
+	{"syncv3_presence", map[string]columnKind{"user_id": columnID, "status_msg": columnStrip}},
+	// the stored request is JSON, so it is anonymised like an event: room IDs are hashed and
+	// free text such as room name filters is stripped.
+	{"syncv3_conn_requests", map[string]columnKind{
+		"user_id": columnID, "device_id": columnDeviceID, "conn_id": columnHash, "request": columnEvent,
+	}},
+	{"syncv3_malformed_events", map[string]columnKind{
+		"room_id": columnID, "reason": columnStrip, "event": columnMalformedEvent,
+	}},
+}
+
+// anonymiseSkippedTables are tables which exist in the proxy database but are deliberately not
+// copied, as the destination database creates them itself.
+var anonymiseSkippedTables = map[string]bool{
+	syncv3.MigrationsTable: true,
+	// older proxies recorded migrations here, until it is renamed to syncv3.MigrationsTable
+	"goose_db_version": true,
+}
+
+// anonymiseSequences are reset after copying so the destination database can be run by a proxy.
+var anonymiseSequences = []struct {
+	sequence, table, column string
+}{
+	{"syncv3_event_nids_seq", "syncv3_events", "event_nid"},
+	{"syncv3_snapshots_seq", "syncv3_snapshots", "snapshot_id"},
+	{"syncv3_to_device_messages_seq", "syncv3_to_device_messages", "position"},
+	{"syncv3_account_data_seq", "syncv3_account_data", "id"},
+	{"syncv3_typing_seq", "syncv3_typing", "stream_id"},
+	{"syncv3_malformed_events_id_seq", "syncv3_malformed_events", "id"},
+}
+
+// preservedContentKeys are event keys whose string values are kept as-is because they affect
+// how the proxy processes the event, and don't contain personal data.
+var preservedContentKeys = map[string]bool{
+	"type":               true,
+	"membership":         true,
+	"join_rule":          true,
+	"history_visibility": true,
+	"guest_access":       true,
+	"msgtype":            true,
+	"rel_type":           true,
+	"algorithm":          true,
+	"room_version":       true,
+}
+
+// anonymiser consistently replaces identifiers with salted hashes. The salt is random and never
+// written out, so hashes can't be reversed by hashing known user IDs, but the same ID always
+// maps to the same hash within one dump.
+type anonymiser struct {
+	salt []byte
+}
+
+func newAnonymiser() (*anonymiser, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &anonymiser{salt: salt}, nil
+}
+
+func (a *anonymiser) hash(s string, n int) string {
+	h := sha256.New()
+	h.Write(a.salt)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:n]
+}
+
+func isMatrixID(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	switch s[0] {
+	case '$':
+		return true // event IDs in newer room versions have no server name
+	case '@', '!', '#':
+		return strings.Contains(s, ":")
+	}
+	return false
+}
+
+// ID anonymises a matrix ID, preserving its sigil and server name structure so that e.g
+// users on the same server still share a server name.
+func (a *anonymiser) ID(id string) string {
+	if !isMatrixID(id) {
+		return a.Strip(id)
+	}
+	sigil, rest := id[:1], id[1:]
+	localpart, server, hasServer := strings.Cut(rest, ":")
+	if !hasServer {
+		return sigil + a.hash(localpart, 16)
+	}
+	return sigil + a.hash(localpart, 16) + ":s" + a.hash(server, 8) + ".invalid"
+}
+
+// StateKey anonymises a state key. State keys which aren't IDs are hashed rather than stripped
+// so that different state keys for the same event type don't collapse into one.
+func (a *anonymiser) StateKey(stateKey string) string {
+	if isMatrixID(stateKey) {
+		return a.ID(stateKey)
+	}
+	return a.Hash(stateKey)
+}
+
+func (a *anonymiser) DeviceID(deviceID string) string {
+	if deviceID == "" {
+		return ""
+	}
+	return "D" + strings.ToUpper(a.hash(deviceID, 9))
+}
+
+// Strip replaces free text with a string of the same length, so sizes are preserved.
+func (a *anonymiser) Strip(s string) string {
+	return strings.Repeat("x", len(s))
+}
+
+func (a *anonymiser) Hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	return a.hash(s, 32)
+}
+
+// Event anonymises a JSON event: IDs are hashed wherever they appear, including in object keys
+// (e.g m.direct), free text is stripped and numbers and booleans are kept.
+func (a *anonymiser) Event(event []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(event, &v); err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return json.Marshal(a.value("", v))
+	}
+	// the empty state key is meaningful, so it can't be stripped like other strings
+	stateKey, isState := obj["state_key"].(string)
+	delete(obj, "state_key")
+	out := a.value("", obj).(map[string]interface{})
+	if isState {
+		out["state_key"] = a.StateKey(stateKey)
+	}
+	return json.Marshal(out)
+}
+
+func (a *anonymiser) EventArray(events []byte) ([]byte, error) {
+	var evs []json.RawMessage
+	if err := json.Unmarshal(events, &evs); err != nil {
+		return nil, err
+	}
+	for i := range evs {
+		ev, err := a.Event(evs[i])
+		if err != nil {
+			return nil, err
+		}
+		evs[i] = ev
+	}
+	return json.Marshal(evs)
+}
+
+func (a *anonymiser) value(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		if preservedContentKeys[key] {
+			return val
+		}
+		if isMatrixID(val) {
+			return a.ID(val)
+		}
+		return a.Strip(val)
+	case []interface{}:
+		for i := range val {
+			val[i] = a.value(key, val[i])
+		}
+		return val
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			newKey := k
+			if isMatrixID(k) {
+				newKey = a.ID(k)
+			}
+			out[newKey] = a.value(k, child)
+		}
+		return out
+	}
+	return v
+}
+
+func (a *anonymiser) column(kind columnKind, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch kind {
+	case columnIDArray:
+		var ids pq.StringArray
+		if err := ids.Scan(v); err != nil {
+			return nil, err
+		}
+		for i := range ids {
+			ids[i] = a.ID(ids[i])
+		}
+		return ids, nil
+	case columnEvent, columnEventArray, columnMalformedEvent:
+		var b []byte
+		switch val := v.(type) {
+		case []byte:
+			b = val
+		case string:
+			b = []byte(val)
+		}
+		var out []byte
+		var err error
+		if kind == columnEventArray {
+			out, err = a.EventArray(b)
+		} else {
+			out, err = a.Event(b)
+		}
+		if err != nil && kind == columnMalformedEvent {
+			out, err = []byte(a.Strip(string(b))), nil
+		}
+		if _, isString := v.(string); isString {
+			return string(out), err
+		}
+		return out, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot anonymise %T", v)
+	}
+	switch kind {
+	case columnID:
+		return a.ID(s), nil
+	case columnStateKey:
+		return a.StateKey(s), nil
+	case columnDeviceID:
+		return a.DeviceID(s), nil
+	case columnStrip:
+		return a.Strip(s), nil
+	case columnHash:
+		return a.Hash(s), nil
+	case columnThreadID:
+		if s == "" || s == "main" {
+			return s, nil
+		}
+		return a.ID(s), nil
+	case columnClear:
+		return "", nil
+	}
+	return s, nil
+}
+
+// runAnonymise copies the database in SYNCV3_DB to an empty destination database, anonymising
+// it as it goes. Usage: syncv3 anonymise DEST_DB
+func runAnonymise(srcURI string, args []string) int {
+	if srcURI == "" || len(args) != 1 {
+		fmt.Printf("Usage: %s=<source db> syncv3 anonymise <empty destination db>\n", EnvDB)
+		fmt.Println("Copies the proxy database with IDs hashed and message contents stripped, preserving its structure")
+		fmt.Println("and sizes, so the copy can be shared when reporting bugs.")
+		return 1
+	}
+	if err := anonymiseDatabase(srcURI, args[0]); err != nil {
+		fmt.Printf("Failed to anonymise database: %s\n", err)
+		return 1
+	}
+	fmt.Println("Done. Check the destination database before sharing it.")
+	return 0
+}
+
+func anonymiseDatabase(srcURI, dstURI string) error {
+	ctx := context.Background()
+	src, err := sqlx.Open("postgres", srcURI)
+	if err != nil {
+		return fmt.Errorf("failed to open source database: %w", err)
+	}
+	defer src.Close()
+	dst, err := sqlx.Open("postgres", dstURI)
+	if err != nil {
+		return fmt.Errorf("failed to open destination database: %w", err)
+	}
+	defer dst.Close()
+
+	if err = syncv3.Migrate(dst.DB); err != nil {
+		return fmt.Errorf("failed to migrate destination database: %w", err)
+	}
+	var existing int
+	if err = dst.Get(&existing, `SELECT count(*) FROM syncv3_events`); err != nil {
+		return err
+	}
+	if existing > 0 {
+		return fmt.Errorf("destination database is not empty")
+	}
+
+	a, err := newAnonymiser()
+	if err != nil {
+		return err
+	}
+	for _, t := range anonymiseTables {
+		start := time.Now()
+		n, err := anonymiseTable(ctx, src, dst, a, t.table, t.columns)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.table, err)
+		}
+		fmt.Printf("%s: copied %d rows in %v\n", t.table, n, time.Since(start))
+	}
+	for _, s := range anonymiseSequences {
+		_, err = dst.Exec(fmt.Sprintf(
+			`SELECT setval('%s', GREATEST((SELECT COALESCE(MAX(%s), 0) FROM %s), 1))`, s.sequence, s.column, s.table,
+		))
+		if err != nil {
+			return fmt.Errorf("failed to reset sequence %s: %w", s.sequence, err)
+		}
+	}
+	return nil
+}
+
+func anonymiseTable(ctx context.Context, src, dst *sqlx.DB, a *anonymiser, table string, kinds map[string]columnKind) (int, error) {
+	var exists sql.NullString
+	if err := src.Get(&exists, `SELECT to_regclass($1)::text`, table); err != nil {
+		return 0, err
+	}
+	if !exists.Valid {
+		fmt.Fprintf(os.Stderr, "%s: does not exist in the source database, skipping\n", table)
+		return 0, nil
+	}
+	rows, err := src.QueryContext(ctx, `SELECT * FROM `+table)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	txn, err := dst.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	total := 0
+	var batch [][]interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		placeholders := make([]string, len(batch))
+		params := make([]interface{}, 0, len(batch)*len(cols))
+		for i, row := range batch {
+			p := make([]string, len(row))
+			for j := range row {
+				p[j] = fmt.Sprintf("$%d", len(params)+j+1)
+			}
+			placeholders[i] = "(" + strings.Join(p, ",") + ")"
+			params = append(params, row...)
+		}
+		_, err := txn.ExecContext(ctx, fmt.Sprintf(
+			`INSERT INTO %s (%s) VALUES %s`, table, strings.Join(cols, ","), strings.Join(placeholders, ","),
+		), params...)
+		total += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	for rows.Next() {
+		row := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return 0, err
+		}
+		for i, col := range cols {
+			// lib/pq returns arrays as []byte, which it would send back as BYTEA
+			if b, ok := row[i].([]byte); ok && colTypes[i].DatabaseTypeName() != "BYTEA" {
+				row[i] = string(b)
+			}
+			if kind := kinds[col]; kind != columnKeep {
+				if row[i], err = a.column(kind, row[i]); err != nil {
+					return 0, fmt.Errorf("column %s: %w", col, err)
+				}
+			}
+		}
+		batch = append(batch, row)
+		if len(batch) >= anonymiseBatchSize {
+			if err = flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if err = flush(); err != nil {
+		return 0, err
+	}
+	return total, txn.Commit()
+}
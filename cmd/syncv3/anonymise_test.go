@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestAnonymiseEvent(t *testing.T) {
+	a, err := newAnonymiser()
+	if err != nil {
+		t.Fatalf("newAnonymiser: %s", err)
+	}
+	event := `{"type":"m.room.member","event_id":"$abc","room_id":"!room:example.org","sender":"@alice:example.org",
+		"state_key":"@alice:example.org","origin_server_ts":1234,
+		"content":{"membership":"join","displayname":"Alice Smith","is_direct":true}}`
+	out, err := a.Event([]byte(event))
+	if err != nil {
+		t.Fatalf("Event: %s", err)
+	}
+	got := gjson.ParseBytes(out)
+	if got.Get("type").Str != "m.room.member" || got.Get("content.membership").Str != "join" {
+		t.Errorf("structural fields were modified: %s", out)
+	}
+	if got.Get("origin_server_ts").Int() != 1234 || !got.Get("content.is_direct").Bool() {
+		t.Errorf("numbers and booleans were modified: %s", out)
+	}
+	if dn := got.Get("content.displayname").Str; dn != strings.Repeat("x", len("Alice Smith")) {
+		t.Errorf("displayname not stripped to the same length: %s", dn)
+	}
+	if strings.Contains(string(out), "alice") || strings.Contains(string(out), "example.org") {
+		t.Errorf("event still contains identifying data: %s", out)
+	}
+	// IDs are consistent, so the sender and state key still match
+	if got.Get("sender").Str != got.Get("state_key").Str {
+		t.Errorf("sender %s != state_key %s", got.Get("sender").Str, got.Get("state_key").Str)
+	}
+	if got.Get("sender").Str != a.ID("@alice:example.org") || got.Get("room_id").Str != a.ID("!room:example.org") {
+		t.Errorf("IDs in the event don't match column IDs: %s", out)
+	}
+	if !strings.HasPrefix(got.Get("event_id").Str, "$") || !strings.HasPrefix(got.Get("room_id").Str, "!") {
+		t.Errorf("sigils were not preserved: %s", out)
+	}
+	// users on the same server keep sharing a server name
+	_, bobServer, _ := strings.Cut(a.ID("@bob:example.org"), ":")
+	_, aliceServer, _ := strings.Cut(got.Get("sender").Str, ":")
+	if bobServer != aliceServer {
+		t.Errorf("server names differ: %s %s", bobServer, aliceServer)
+	}
+
+	// empty state keys stay empty, other state keys remain distinct
+	for _, sk := range []string{"", "a", "b"} {
+		ev, err := a.Event([]byte(`{"type":"m.widget","state_key":"` + sk + `","content":{}}`))
+		if err != nil {
+			t.Fatalf("Event: %s", err)
+		}
+		if got := gjson.GetBytes(ev, "state_key").Str; got != a.StateKey(sk) || (sk == "") != (got == "") {
+			t.Errorf("state key %q anonymised to %q", sk, got)
+		}
+	}
+	if a.StateKey("a") == a.StateKey("b") {
+		t.Errorf("different state keys were anonymised to the same value")
+	}
+
+	// IDs used as object keys are anonymised e.g m.direct
+	out, err = a.Event([]byte(`{"type":"m.direct","content":{"@bob:example.org":["!dm:example.org"]}}`))
+	if err != nil {
+		t.Fatalf("Event: %s", err)
+	}
+	if strings.Contains(string(out), "example.org") {
+		t.Errorf("m.direct still contains identifying data: %s", out)
+	}
+	if _, ok := gjson.GetBytes(out, "content").Map()[a.ID("@bob:example.org")]; !ok {
+		t.Errorf("m.direct key not anonymised consistently: %s", out)
+	}
+}
+
+func TestAnonymiseMalformedEvent(t *testing.T) {
+	a, err := newAnonymiser()
+	if err != nil {
+		t.Fatalf("newAnonymiser: %s", err)
+	}
+	// malformed events which are still JSON are anonymised like any other event
+	out, err := a.column(columnMalformedEvent, []byte(`{"type":"m.room.message","sender":"@alice:example.org","content":{"body":5}}`))
+	if err != nil {
+		t.Fatalf("column: %s", err)
+	}
+	if got := gjson.GetBytes(out.([]byte), "sender").Str; got != a.ID("@alice:example.org") {
+		t.Errorf("sender not anonymised: %s", out)
+	}
+	// and ones which aren't are stripped rather than failing the whole dump
+	notJSON := []byte(`{"sender":"@alice:example.org",`)
+	out, err = a.column(columnMalformedEvent, notJSON)
+	if err != nil {
+		t.Fatalf("column: %s", err)
+	}
+	if got := string(out.([]byte)); got != strings.Repeat("x", len(notJSON)) {
+		t.Errorf("malformed event not stripped: %s", got)
+	}
+}
+
+// Test that every table in a proxy database is either anonymised or deliberately skipped, and that
+// every anonymised column exists, so new tables are not silently left out of dumps.
+func TestAnonymiseTablesCoverSchema(t *testing.T) {
+	db := sqlx.MustOpen("postgres", testutils.PrepareDBConnectionString())
+	defer db.Close()
+	if err := syncv3.Migrate(db.DB); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	var tables []string
+	if err := db.Select(&tables, `SELECT tablename FROM pg_tables WHERE schemaname = current_schema()`); err != nil {
+		t.Fatalf("failed to list tables: %s", err)
+	}
+	exists := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		exists[table] = true
+	}
+	listed := make(map[string]bool, len(anonymiseTables))
+	for _, at := range anonymiseTables {
+		if listed[at.table] {
+			t.Errorf("anonymiseTables lists %s more than once", at.table)
+		}
+		listed[at.table] = true
+		if !exists[at.table] {
+			t.Errorf("anonymiseTables lists %s, which does not exist", at.table)
+			continue
+		}
+		for col := range at.columns {
+			var found bool
+			err := db.Get(&found, `SELECT EXISTS(
+				SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+			)`, at.table, col)
+			if err != nil {
+				t.Fatalf("failed to check column %s.%s: %s", at.table, col, err)
+			}
+			if !found {
+				t.Errorf("anonymiseTables lists column %s.%s, which does not exist", at.table, col)
+			}
+		}
+	}
+	for _, table := range tables {
+		if !listed[table] && !anonymiseSkippedTables[table] {
+			t.Errorf("table %s is neither in anonymiseTables nor in anonymiseSkippedTables", table)
+		}
+	}
+}
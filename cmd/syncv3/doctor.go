@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+type severity int
+
+const (
+	severityOK severity = iota
+	severityWarn
+	severityError
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityWarn:
+		return "WARN"
+	case severityError:
+		return "ERROR"
+	}
+	return "OK"
+}
+
+// finding is the result of a single doctor check. Fix is an actionable suggestion which is
+// printed for warnings and errors.
+type finding struct {
+	Severity severity
+	Check    string
+	Message  string
+	Fix      string
+}
+
+// doctorRequiredIndexes are the indexes the proxy relies on for acceptable performance.
+// They are created on startup, so a missing index usually means it was dropped by hand or
+// the proxy failed part way through creating its tables.
+var doctorRequiredIndexes = []string{
+	"syncv3_events_type_sk_idx",
+	"syncv3_events_type_room_nid_idx",
+	"syncv3_events_room_event_nid_type_skey_idx",
+	"syncv3_nid_room_state_idx",
+	"syncv3_to_device_messages_device_idx",
+	"syncv3_to_device_messages_pos_device_idx",
+	"syncv3_to_device_messages_ukey_idx",
+	"syncv3_device_list_updates_bucket_idx",
+}
+
+// runDoctor runs all diagnostic checks against the current configuration and prints the
+// findings. Returns the process exit code: non-zero if any check failed.
+func runDoctor(args map[string]string) int {
+	findings := checkConfig(args)
+	if args[EnvDB] != "" {
+		findings = append(findings, checkDatabase(args[EnvDB])...)
+	}
+	if args[EnvServer] != "" {
+		findings = append(findings, checkUpstream(args[EnvServer]))
+	}
+
+	return printFindings(findings)
+}
+
+// printFindings prints findings and returns the process exit code: non-zero if there are errors.
+func printFindings(findings []finding) int {
+	exitCode := 0
+	for _, f := range findings {
+		fmt.Printf("[%-5s] %-8s %s\n", f.Severity, f.Check, f.Message)
+		if f.Severity != severityOK && f.Fix != "" {
+			fmt.Printf("                 -> %s\n", f.Fix)
+		}
+		if f.Severity == severityError {
+			exitCode = 1
+		}
+	}
+	if exitCode == 0 {
+		fmt.Println("No problems found.")
+	}
+	return exitCode
+}
+
+// checkConfig validates the configuration without connecting to anything.
+func checkConfig(args map[string]string) []finding {
+	var findings []finding
+	for _, env := range []string{EnvServer, EnvDB, EnvSecret} {
+		if args[env] == "" {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s is not set", env),
+				Fix:      fmt.Sprintf("set %s, running syncv3 without it set describes each variable", env),
+			})
+		}
+	}
+	if (args[EnvTLSCert] == "") != (args[EnvTLSKey] == "") {
+		findings = append(findings, finding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("only one of %s and %s is set", EnvTLSCert, EnvTLSKey),
+			Fix:      "set both the certificate and the key, or neither",
+		})
+	}
+	addrs := splitList(args[EnvBindAddr])
+	if len(addrs) == 0 {
+		findings = append(findings, finding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s has no addresses", EnvBindAddr),
+			Fix:      fmt.Sprintf("set %s to a host:port or unix socket path", EnvBindAddr),
+		})
+	}
+	allUnix := len(addrs) > 0
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		allUnix = allUnix && internal.IsUnixSocket(addr)
+		if seen[addr] {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s contains %s more than once", EnvBindAddr, addr),
+				Fix:      "remove the duplicate address",
+			})
+		}
+		seen[addr] = true
+	}
+	if args[EnvACMEDomains] != "" {
+		if args[EnvTLSCert] != "" {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("both %s and %s are set", EnvACMEDomains, EnvTLSCert),
+				Fix:      "use either ACME or your own certificate, not both",
+			})
+		}
+		if args[EnvACMECacheDir] == "" {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s is set but %s is not", EnvACMEDomains, EnvACMECacheDir),
+				Fix:      fmt.Sprintf("set %s to a persistent directory, or certificates will be requested on every restart and hit rate limits", EnvACMECacheDir),
+			})
+		}
+	}
+	if (args[EnvTLSCert] != "" || args[EnvACMEDomains] != "") && allUnix {
+		findings = append(findings, finding{
+			Severity: severityWarn,
+			Check:    "config",
+			Message:  "TLS is configured but the proxy is only listening on unix sockets, so TLS will not be used",
+			Fix:      fmt.Sprintf("unset %s and %s", EnvTLSCert, EnvTLSKey),
+		})
+	}
+	for _, env := range []string{EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs} {
+		if n, err := strconv.Atoi(args[env]); err != nil || n < 0 {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s is not a non-negative integer: '%s'", env, args[env]),
+				Fix:      fmt.Sprintf("set %s to a number", env),
+			})
+		}
+	}
+	if httpTimeout, err := strconv.Atoi(args[EnvHTTPTimeoutSecs]); err == nil {
+		if initialTimeout, err := strconv.Atoi(args[EnvHTTPInitialTimeoutSecs]); err == nil && initialTimeout < httpTimeout {
+			findings = append(findings, finding{
+				Severity: severityWarn,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s is shorter than %s, so initial syncs will time out sooner than normal requests", EnvHTTPInitialTimeoutSecs, EnvHTTPTimeoutSecs),
+				Fix:      fmt.Sprintf("increase %s", EnvHTTPInitialTimeoutSecs),
+			})
+		}
+	}
+	if args[EnvLogLevel] != "" {
+		if err := internal.ValidateLogLevels(args[EnvLogLevel]); err != nil {
+			findings = append(findings, finding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s is invalid: %s", EnvLogLevel, err),
+				Fix:      "use a level like 'info' or per-module levels like 'info,poller=debug'",
+			})
+		}
+	}
+	if args[EnvDebug] == "1" {
+		findings = append(findings, finding{
+			Severity: severityWarn,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s is enabled: failed assertions will crash the proxy and logs will be very verbose", EnvDebug),
+			Fix:      fmt.Sprintf("unset %s in production", EnvDebug),
+		})
+	}
+	if args[EnvRecordV2Dir] != "" {
+		findings = append(findings, finding{
+			Severity: severityWarn,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s is set: upstream /sync responses are being written to disk", EnvRecordV2Dir),
+			Fix:      fmt.Sprintf("unset %s once you have captured enough traffic", EnvRecordV2Dir),
+		})
+	}
+	if args[EnvH2C] == "1" && args[EnvTLSCert] == "" && args[EnvACMEDomains] == "" {
+		for _, addr := range addrs {
+			if isPublicBindAddr(addr) {
+				findings = append(findings, finding{
+					Severity: severityWarn,
+					Check:    "config",
+					Message:  fmt.Sprintf("%s is enabled and the proxy listens on all interfaces (%s) without TLS", EnvH2C, addr),
+					Fix:      "only enable h2c behind a trusted reverse proxy, and bind to localhost or a unix socket",
+				})
+			}
+		}
+	}
+	if _, err := proxyProtocolTrusted(args[EnvProxyProtocol]); err != nil {
+		findings = append(findings, finding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s is invalid: %s", EnvProxyProtocol, err),
+			Fix:      fmt.Sprintf("set %s to 1 or a comma-separated list of load balancer IPs or CIDRs", EnvProxyProtocol),
+		})
+	} else if args[EnvProxyProtocol] == "1" {
+		for _, addr := range addrs {
+			if isPublicBindAddr(addr) {
+				findings = append(findings, finding{
+					Severity: severityWarn,
+					Check:    "config",
+					Message:  fmt.Sprintf("%s trusts every connection and the proxy listens on all interfaces (%s), so clients can spoof their IP", EnvProxyProtocol, addr),
+					Fix:      fmt.Sprintf("set %s to the IPs of your load balancers", EnvProxyProtocol),
+				})
+			}
+		}
+	}
+	for _, env := range []string{EnvPPROF, EnvAdmin} {
+		if isPublicBindAddr(args[env]) {
+			findings = append(findings, finding{
+				Severity: severityWarn,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s listens on all interfaces (%s) and is unauthenticated", env, args[env]),
+				Fix:      fmt.Sprintf("bind %s to localhost e.g 'localhost%s'", env, args[env][strings.LastIndex(args[env], ":"):]),
+			})
+		}
+	}
+	if len(findings) == 0 {
+		findings = append(findings, finding{
+			Severity: severityOK,
+			Check:    "config",
+			Message:  "configuration is valid",
+		})
+	}
+	return findings
+}
+
+// isPublicBindAddr returns true if the bind address listens on all interfaces.
+func isPublicBindAddr(addr string) bool {
+	if addr == "" || internal.IsUnixSocket(addr) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// checkDatabase checks that the database is reachable, that its schema version matches this
+// binary and that the indexes the proxy relies on exist.
+func checkDatabase(postgresURI string) []finding {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err == nil {
+		defer db.Close()
+		err = db.PingContext(ctx)
+	}
+	if err != nil {
+		return []finding{{
+			Severity: severityError,
+			Check:    "db",
+			Message:  fmt.Sprintf("cannot connect to the database: %s", err),
+			Fix:      fmt.Sprintf("check %s and that postgres is running and reachable", EnvDB),
+		}}
+	}
+	findings := []finding{{
+		Severity: severityOK,
+		Check:    "db",
+		Message:  "connected to the database",
+	}}
+
+	var eventsTable sql.NullString
+	if err = db.GetContext(ctx, &eventsTable, `SELECT to_regclass('syncv3_events')::text`); err != nil {
+		return append(findings, finding{
+			Severity: severityError,
+			Check:    "db",
+			Message:  fmt.Sprintf("failed to query tables: %s", err),
+		})
+	}
+	if !eventsTable.Valid {
+		return append(findings, finding{
+			Severity: severityOK,
+			Check:    "db",
+			Message:  "database is empty, tables will be created when the proxy first starts",
+		})
+	}
+
+	findings = append(findings, checkSchemaVersion(db))
+
+	var indexes []string
+	if err = db.SelectContext(ctx, &indexes, `SELECT indexname FROM pg_indexes WHERE schemaname = current_schema()`); err != nil {
+		return append(findings, finding{
+			Severity: severityError,
+			Check:    "indexes",
+			Message:  fmt.Sprintf("failed to query indexes: %s", err),
+		})
+	}
+	existing := make(map[string]bool, len(indexes))
+	for _, index := range indexes {
+		existing[index] = true
+	}
+	var missing []string
+	for _, index := range doctorRequiredIndexes {
+		if !existing[index] {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		findings = append(findings, finding{
+			Severity: severityError,
+			Check:    "indexes",
+			Message:  fmt.Sprintf("missing indexes: %s", strings.Join(missing, ", ")),
+			Fix:      "restart the proxy to recreate them, this may take a while on large databases",
+		})
+	} else {
+		findings = append(findings, finding{
+			Severity: severityOK,
+			Check:    "indexes",
+			Message:  fmt.Sprintf("all %d required indexes exist", len(doctorRequiredIndexes)),
+		})
+	}
+	return findings
+}
+
+func checkSchemaVersion(db *sqlx.DB) finding {
+	latest, err := syncv3.LatestSchemaVersion()
+	if err != nil {
+		return finding{
+			Severity: severityError,
+			Check:    "schema",
+			Message:  err.Error(),
+		}
+	}
+	current, err := syncv3.CurrentSchemaVersion(db.DB)
+	if err != nil {
+		return finding{
+			Severity: severityError,
+			Check:    "schema",
+			Message:  err.Error(),
+		}
+	}
+	switch {
+	case current < latest:
+		return finding{
+			Severity: severityWarn,
+			Check:    "schema",
+			Message:  fmt.Sprintf("schema version %d is behind this binary (%d)", current, latest),
+			Fix:      "migrations are applied when the proxy starts, or run 'syncv3 migrate up'",
+		}
+	case current > latest:
+		return finding{
+			Severity: severityError,
+			Check:    "schema",
+			Message:  fmt.Sprintf("schema version %d is newer than this binary (%d)", current, latest),
+			Fix:      "upgrade the proxy, or downgrade the database with 'syncv3 migrate down-to'",
+		}
+	}
+	return finding{
+		Severity: severityOK,
+		Check:    "schema",
+		Message:  fmt.Sprintf("schema is up to date (version %d)", current),
+	}
+}
+
+// checkUpstream checks that the upstream homeserver is reachable and speaks the client-server API.
+func checkUpstream(destHomeserver string) finding {
+	client := sync2.NewHTTPClient(10*time.Second, 10*time.Second, destHomeserver)
+	versions, err := client.Versions(context.Background())
+	if err != nil {
+		return finding{
+			Severity: severityError,
+			Check:    "upstream",
+			Message:  fmt.Sprintf("cannot contact the homeserver at %s: %s", destHomeserver, err),
+			Fix:      fmt.Sprintf("check %s is the client-server API URL of your homeserver and is reachable from the proxy", EnvServer),
+		}
+	}
+	if len(versions) == 0 {
+		return finding{
+			Severity: severityWarn,
+			Check:    "upstream",
+			Message:  fmt.Sprintf("%s returned no supported spec versions", destHomeserver),
+			Fix:      fmt.Sprintf("check %s points at the homeserver and not a different service", EnvServer),
+		}
+	}
+	return finding{
+		Severity: severityOK,
+		Check:    "upstream",
+		Message:  fmt.Sprintf("homeserver is reachable, supports %s", strings.Join(versions, ", ")),
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func validDoctorArgs() map[string]string {
+	return map[string]string{
+		EnvServer:                 "https://localhost",
+		EnvDB:                     "user=postgres dbname=syncv3 sslmode=disable",
+		EnvSecret:                 "secret",
+		EnvBindAddr:               "0.0.0.0:8008",
+		EnvMaxConns:               "0",
+		EnvIdleTimeoutSecs:        "3600",
+		EnvHTTPTimeoutSecs:        "300",
+		EnvHTTPInitialTimeoutSecs: "1800",
+	}
+}
+
+func TestDoctorCheckConfig(t *testing.T) {
+	testCases := []struct {
+		name         string
+		modify       func(args map[string]string)
+		wantSeverity severity
+		wantMessage  string
+	}{
+		{
+			name:         "valid",
+			modify:       func(args map[string]string) {},
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+		{
+			name:         "missing secret",
+			modify:       func(args map[string]string) { delete(args, EnvSecret) },
+			wantSeverity: severityError,
+			wantMessage:  EnvSecret + " is not set",
+		},
+		{
+			name:         "tls cert without key",
+			modify:       func(args map[string]string) { args[EnvTLSCert] = "/cert.pem" },
+			wantSeverity: severityError,
+			wantMessage:  "only one of",
+		},
+		{
+			name:         "bad number",
+			modify:       func(args map[string]string) { args[EnvMaxConns] = "lots" },
+			wantSeverity: severityError,
+			wantMessage:  EnvMaxConns + " is not a non-negative integer",
+		},
+		{
+			name:         "bad log level",
+			modify:       func(args map[string]string) { args[EnvLogLevel] = "poller=loud" },
+			wantSeverity: severityError,
+			wantMessage:  EnvLogLevel + " is invalid",
+		},
+		{
+			name:         "initial timeout shorter than normal timeout",
+			modify:       func(args map[string]string) { args[EnvHTTPInitialTimeoutSecs] = "10" },
+			wantSeverity: severityWarn,
+			wantMessage:  "initial syncs will time out sooner",
+		},
+		{
+			name:         "multiple bind addresses",
+			modify:       func(args map[string]string) { args[EnvBindAddr] = "127.0.0.1:8008, /run/syncv3.sock" },
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+		{
+			name:         "duplicate bind address",
+			modify:       func(args map[string]string) { args[EnvBindAddr] = "/run/syncv3.sock,/run/syncv3.sock" },
+			wantSeverity: severityError,
+			wantMessage:  "more than once",
+		},
+		{
+			name: "tls on unix sockets only",
+			modify: func(args map[string]string) {
+				args[EnvBindAddr] = "/run/syncv3.sock"
+				args[EnvTLSCert] = "/cert.pem"
+				args[EnvTLSKey] = "/key.pem"
+			},
+			wantSeverity: severityWarn,
+			wantMessage:  "TLS will not be used",
+		},
+		{
+			name:         "acme without cache dir",
+			modify:       func(args map[string]string) { args[EnvACMEDomains] = "syncv3.example.com" },
+			wantSeverity: severityError,
+			wantMessage:  EnvACMECacheDir + " is not",
+		},
+		{
+			name: "acme",
+			modify: func(args map[string]string) {
+				args[EnvACMEDomains] = "syncv3.example.com"
+				args[EnvACMECacheDir] = "/var/lib/syncv3/acme"
+			},
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+		{
+			name:         "public h2c listener",
+			modify:       func(args map[string]string) { args[EnvH2C] = "1" },
+			wantSeverity: severityWarn,
+			wantMessage:  EnvH2C + " is enabled",
+		},
+		{
+			name: "local h2c listener",
+			modify: func(args map[string]string) {
+				args[EnvH2C] = "1"
+				args[EnvBindAddr] = "127.0.0.1:8008,/run/syncv3.sock"
+			},
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+		{
+			name:         "invalid proxy protocol networks",
+			modify:       func(args map[string]string) { args[EnvProxyProtocol] = "10.0.0.0/8,lb.internal" },
+			wantSeverity: severityError,
+			wantMessage:  EnvProxyProtocol + " is invalid",
+		},
+		{
+			name:         "proxy protocol trusting everyone",
+			modify:       func(args map[string]string) { args[EnvProxyProtocol] = "1" },
+			wantSeverity: severityWarn,
+			wantMessage:  EnvProxyProtocol + " trusts every connection",
+		},
+		{
+			name:         "proxy protocol from load balancers",
+			modify:       func(args map[string]string) { args[EnvProxyProtocol] = "10.0.0.0/8, 192.0.2.1" },
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+		{
+			name:         "public admin listener",
+			modify:       func(args map[string]string) { args[EnvAdmin] = ":6061" },
+			wantSeverity: severityWarn,
+			wantMessage:  EnvAdmin + " listens on all interfaces",
+		},
+		{
+			name:         "localhost admin listener",
+			modify:       func(args map[string]string) { args[EnvAdmin] = "localhost:6061" },
+			wantSeverity: severityOK,
+			wantMessage:  "configuration is valid",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := validDoctorArgs()
+			tc.modify(args)
+			findings := checkConfig(args)
+			for _, f := range findings {
+				if f.Severity == tc.wantSeverity && strings.Contains(f.Message, tc.wantMessage) {
+					return
+				}
+			}
+			t.Errorf("no %v finding containing '%s', got %+v", tc.wantSeverity, tc.wantMessage, findings)
+		})
+	}
+}
+
+func TestDoctorCheckConfigDoesNotApplyLogLevels(t *testing.T) {
+	before := internal.ModuleLogLevels()
+	args := validDoctorArgs()
+	args[EnvLogLevel] = "trace,poller=error"
+	checkConfig(args)
+	if after := internal.ModuleLogLevels(); !reflect.DeepEqual(before, after) {
+		t.Errorf("checkConfig changed the log levels from %v to %v", before, after)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// importRoomAccountDataTypes are the room account data types imported for each room. There is no
+// endpoint to list a room's account data, so only the types clients rely on are fetched.
+var importRoomAccountDataTypes = []string{"m.tag", "m.fully_read"}
+
+// importer seeds the proxy database with an account's joined rooms from the homeserver, then stores
+// a since token for the device so that its poller does an incremental sync rather than an initial
+// sync, which can take minutes for huge accounts.
+type importer struct {
+	client        *http.Client
+	v2            *sync2.HTTPClient
+	baseURL       string
+	token         string
+	userID        string
+	deviceID      string
+	timelineLimit int
+}
+
+// importedRoom is everything fetched from the homeserver for one room.
+type importedRoom struct {
+	roomID string
+	// state is the current state of the room
+	state []json.RawMessage
+	// timeline is the most recent message events in chronological order. State events are left
+	// out, as they would be applied on top of the current state.
+	timeline    []json.RawMessage
+	prevBatch   string
+	accountData []json.RawMessage
+}
+
+// runImport imports an account's rooms into the database before the proxy polls for it.
+// Usage: syncv3 import --token TOKEN
+func runImport(args map[string]string, cmdArgs []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	server := flags.String("server", args[EnvServer], "The homeserver CS API URL. Defaults to "+EnvServer)
+	token := flags.String("token", "", "An access token for the account to import e.g from the homeserver's admin API. "+
+		"The proxy will poll for this device from where the import started.")
+	timelineLimit := flags.Int("timeline-limit", 20, "The number of recent messages to import in each room.")
+	concurrency := flags.Int("concurrency", 4, "The number of rooms to import at once.")
+	if err := flags.Parse(cmdArgs); err != nil {
+		return 1
+	}
+	if *server == "" || *token == "" || args[EnvDB] == "" || args[EnvSecret] == "" || *concurrency < 1 {
+		fmt.Printf("Usage: %s=<db> %s=<secret> syncv3 import --token TOKEN\n", EnvDB, EnvSecret)
+		flags.PrintDefaults()
+		return 1
+	}
+	transport := http.DefaultTransport
+	if internal.IsUnixSocket(*server) {
+		transport = internal.UnixTransport(*server)
+	}
+	imp := &importer{
+		client:        &http.Client{Timeout: time.Minute, Transport: transport},
+		v2:            sync2.NewHTTPClient(time.Minute, 5*time.Minute, *server),
+		baseURL:       internal.GetBaseURL(*server),
+		token:         *token,
+		timelineLimit: *timelineLimit,
+	}
+	db, err := sqlx.Open("postgres", args[EnvDB])
+	if err != nil {
+		fmt.Printf("Failed to open database: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+	// the import may be run before the proxy has ever started on this database
+	if err = syncv3.Migrate(db.DB); err != nil {
+		fmt.Printf("Failed to migrate database: %s\n", err)
+		return 1
+	}
+	store := state.NewStorageWithDB(db, false)
+	v2Store := sync2.NewStoreWithDB(db, args[EnvSecret])
+	if err = imp.run(context.Background(), store, v2Store, *concurrency); err != nil {
+		fmt.Printf("Failed to import: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (imp *importer) run(ctx context.Context, store *state.Storage, v2Store *sync2.Storage, concurrency int) error {
+	var err error
+	imp.userID, imp.deviceID, err = imp.v2.WhoAmI(ctx, imp.token)
+	if err != nil {
+		return fmt.Errorf("/whoami failed: %w", err)
+	}
+	since, err := v2Store.DevicesTable.SelectSince(imp.userID, imp.deviceID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if since != "" {
+		return fmt.Errorf("the proxy is already polling %s device %s", imp.userID, imp.deviceID)
+	}
+
+	// Sync without any rooms first, so that anything which happens during the import is picked up
+	// by the device's first poll. This also gets the account data and to-device messages which
+	// the initial sync would have returned.
+	res, code, err := imp.v2.DoSyncV2(ctx, imp.token, "", true, true, true)
+	if err != nil {
+		return fmt.Errorf("initial /sync failed (HTTP %d): %w", code, err)
+	}
+	roomIDs, err := imp.joinedRooms(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Importing %d rooms for %s\n", len(roomIDs), imp.userID)
+
+	start := time.Now()
+	var done atomic.Int64
+	var firstErr error
+	var errMu sync.Mutex
+	roomCh := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for roomID := range roomCh {
+				room, err := imp.fetchRoom(ctx, roomID)
+				if err == nil {
+					err = imp.storeRoom(store, room)
+				}
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s: %w", roomID, err)
+					}
+					errMu.Unlock()
+					continue
+				}
+				if n := done.Add(1); n%100 == 0 {
+					fmt.Printf("Imported %d/%d rooms\n", n, len(roomIDs))
+				}
+			}
+		}()
+	}
+	for _, roomID := range roomIDs {
+		roomCh <- roomID
+	}
+	close(roomCh)
+	wg.Wait()
+	if firstErr != nil {
+		// don't store the since token, so the device does a normal initial sync instead
+		return firstErr
+	}
+
+	if len(res.AccountData.Events) > 0 {
+		if _, err = store.InsertAccountData(imp.userID, sync2.AccountDataGlobalRoom, res.AccountData.Events); err != nil {
+			return fmt.Errorf("failed to store account data: %w", err)
+		}
+	}
+	if len(res.ToDevice.Events) > 0 {
+		if _, err = store.ToDeviceTable.InsertMessages(imp.userID, imp.deviceID, res.ToDevice.Events); err != nil {
+			return fmt.Errorf("failed to store to-device messages: %w", err)
+		}
+	}
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		if _, err := v2Store.TokensTable.Insert(txn, imp.token, imp.userID, imp.deviceID, time.Now()); err != nil {
+			return err
+		}
+		return v2Store.DevicesTable.InsertDevice(txn, imp.userID, imp.deviceID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store device: %w", err)
+	}
+	if err = v2Store.DevicesTable.UpdateDeviceSince(imp.userID, imp.deviceID, res.NextBatch); err != nil {
+		return fmt.Errorf("failed to store since token: %w", err)
+	}
+	fmt.Printf("Imported %d rooms in %v. The proxy will poll device %s from where the import started.\n",
+		done.Load(), time.Since(start).Round(time.Second), imp.deviceID)
+	return nil
+}
+
+func (imp *importer) joinedRooms(ctx context.Context) ([]string, error) {
+	code, body, err := imp.get(ctx, "/_matrix/client/v3/joined_rooms")
+	if err != nil || code != 200 {
+		return nil, fmt.Errorf("/joined_rooms failed: HTTP %d %v", code, err)
+	}
+	var roomIDs []string
+	for _, roomID := range body.Get("joined_rooms").Array() {
+		roomIDs = append(roomIDs, roomID.Str)
+	}
+	return roomIDs, nil
+}
+
+// fetchRoom fetches the current state, recent messages and account data of a room.
+func (imp *importer) fetchRoom(ctx context.Context, roomID string) (*importedRoom, error) {
+	room := &importedRoom{roomID: roomID}
+	code, body, err := imp.get(ctx, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/state")
+	if err != nil || code != 200 {
+		return nil, fmt.Errorf("/state failed: HTTP %d %v", code, err)
+	}
+	for _, ev := range body.Array() {
+		room.state = append(room.state, json.RawMessage(ev.Raw))
+	}
+
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages?dir=b&limit=%d", url.PathEscape(roomID), imp.timelineLimit)
+	code, body, err = imp.get(ctx, path)
+	if err != nil || code != 200 {
+		return nil, fmt.Errorf("/messages failed: HTTP %d %v", code, err)
+	}
+	chunk := body.Get("chunk").Array()
+	// the chunk is newest first
+	for i := len(chunk) - 1; i >= 0; i-- {
+		if chunk[i].Get("state_key").Exists() {
+			continue
+		}
+		room.timeline = append(room.timeline, json.RawMessage(chunk[i].Raw))
+	}
+	room.prevBatch = body.Get("end").Str
+
+	for _, evType := range importRoomAccountDataTypes {
+		path = fmt.Sprintf("/_matrix/client/v3/user/%s/rooms/%s/account_data/%s",
+			url.PathEscape(imp.userID), url.PathEscape(roomID), url.PathEscape(evType))
+		code, body, err = imp.get(ctx, path)
+		if code == 404 {
+			continue
+		}
+		if err != nil || code != 200 {
+			return nil, fmt.Errorf("%s account data failed: HTTP %d %v", evType, code, err)
+		}
+		ev, err := json.Marshal(map[string]interface{}{
+			"type":    evType,
+			"content": json.RawMessage(body.Raw),
+		})
+		if err != nil {
+			return nil, err
+		}
+		room.accountData = append(room.accountData, ev)
+	}
+	return room, nil
+}
+
+// storeRoom stores a room in the same way as a room in an initial sync: the state first, then the
+// timeline.
+func (imp *importer) storeRoom(store *state.Storage, room *importedRoom) error {
+	if _, err := store.Initialise(room.roomID, room.state); err != nil {
+		return fmt.Errorf("failed to store state: %w", err)
+	}
+	if len(room.timeline) > 0 {
+		_, err := store.Accumulate(imp.userID, room.roomID, sync2.TimelineResponse{
+			Events:    room.timeline,
+			Limited:   room.prevBatch != "",
+			PrevBatch: room.prevBatch,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to store timeline: %w", err)
+		}
+	}
+	if len(room.accountData) > 0 {
+		if _, err := store.InsertAccountData(imp.userID, room.roomID, room.accountData); err != nil {
+			return fmt.Errorf("failed to store account data: %w", err)
+		}
+	}
+	return nil
+}
+
+func (imp *importer) get(ctx context.Context, path string) (int, gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imp.baseURL+path, nil)
+	if err != nil {
+		return 0, gjson.Result{}, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-import-"+sync2.ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+imp.token)
+	res, err := imp.client.Do(req)
+	if err != nil {
+		return 0, gjson.Result{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, gjson.Result{}, err
+	}
+	return res.StatusCode, gjson.ParseBytes(body), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestImportFetchRoom(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/client/v3/rooms/!a:localhost/state", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[
+			{"type":"m.room.create","state_key":"","event_id":"$create","content":{}},
+			{"type":"m.room.name","state_key":"","event_id":"$name2","content":{"name":"new"}}
+		]`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/rooms/!a:localhost/messages", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("limit") != "3" || req.URL.Query().Get("dir") != "b" {
+			t.Errorf("/messages: got query %s", req.URL.RawQuery)
+		}
+		w.Write([]byte(`{"end":"t1","chunk":[
+			{"type":"m.room.message","event_id":"$msg2","content":{}},
+			{"type":"m.room.name","state_key":"","event_id":"$name1","content":{"name":"old"}},
+			{"type":"m.room.message","event_id":"$msg1","content":{}}
+		]}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/user/@alice:localhost/rooms/!a:localhost/account_data/m.tag", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"tags":{"m.favourite":{}}}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/user/@alice:localhost/rooms/!a:localhost/account_data/m.fully_read", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	imp := &importer{
+		client:        srv.Client(),
+		v2:            sync2.NewHTTPClient(time.Second, time.Second, srv.URL),
+		baseURL:       srv.URL,
+		token:         "TOKEN",
+		userID:        "@alice:localhost",
+		timelineLimit: 3,
+	}
+	room, err := imp.fetchRoom(context.Background(), "!a:localhost")
+	if err != nil {
+		t.Fatalf("fetchRoom: %s", err)
+	}
+	if len(room.state) != 2 {
+		t.Errorf("got %d state events, want 2", len(room.state))
+	}
+	// chronological, without the old state event which would overwrite the current state
+	var gotTimeline []string
+	for _, ev := range room.timeline {
+		gotTimeline = append(gotTimeline, gjson.GetBytes(ev, "event_id").Str)
+	}
+	if len(gotTimeline) != 2 || gotTimeline[0] != "$msg1" || gotTimeline[1] != "$msg2" {
+		t.Errorf("got timeline %v, want [$msg1 $msg2]", gotTimeline)
+	}
+	if room.prevBatch != "t1" {
+		t.Errorf("got prev_batch %q, want t1", room.prevBatch)
+	}
+	if len(room.accountData) != 1 || gjson.GetBytes(room.accountData[0], "type").Str != "m.tag" ||
+		!gjson.GetBytes(room.accountData[0], "content.tags.m\\.favourite").Exists() {
+		t.Errorf("got account data %s, want only m.tag", room.accountData)
+	}
+}
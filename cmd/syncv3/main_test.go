@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseMode(t *testing.T) {
+	testCases := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: nil, want: ""},
+		{args: []string{"--mode=poller"}, want: "poller"},
+		{args: []string{"--mode", "api"}, want: "api"},
+		{args: []string{"-mode=all"}, want: "all"},
+		{args: []string{"--mode=both"}, wantErr: true},
+		{args: []string{"--unknown"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseMode(tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: got err %v want err %v", tc.args, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%v: got mode %q want %q", tc.args, got, tc.want)
+		}
+	}
+}
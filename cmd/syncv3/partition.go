@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// runPartitionEvents hash partitions the events table by room. The proxy must be stopped whilst
+// this runs, as it copies every event in a single transaction.
+// Usage: syncv3 partition-events --partitions N
+func runPartitionEvents(args map[string]string, cmdArgs []string) int {
+	flags := flag.NewFlagSet("partition-events", flag.ContinueOnError)
+	partitions := flags.Int("partitions", 16, "The number of partitions to split the events table into.")
+	if err := flags.Parse(cmdArgs); err != nil {
+		return 1
+	}
+	if args[EnvDB] == "" || *partitions < 1 {
+		fmt.Printf("Usage: %s=<db> syncv3 partition-events --partitions N\n", EnvDB)
+		flags.PrintDefaults()
+		return 1
+	}
+	db, err := sqlx.Open("postgres", args[EnvDB])
+	if err != nil {
+		fmt.Printf("Failed to open database: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	start := time.Now()
+	copied, err := state.PartitionEventsTable(db, *partitions)
+	if err != nil {
+		fmt.Printf("Failed to partition the events table: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Copied %d events into %d partitions in %v.\n", copied, *partitions, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("Once the proxy works, the old table can be dropped with: DROP TABLE %s;\n", state.UnpartitionedEventsTable)
+	return 0
+}
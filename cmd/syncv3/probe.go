@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// prober exercises the upstream endpoints the proxy depends on with a real access token.
+type prober struct {
+	client     *http.Client
+	v2         *sync2.HTTPClient
+	server     string
+	baseURL    string
+	token      string
+	nextBatch  string
+	joinedRoom string
+}
+
+// runProbe checks which proxy features will work against a homeserver.
+// Usage: syncv3 probe --server URL --token TOKEN
+func runProbe(args []string) int {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	server := flags.String("server", os.Getenv(EnvServer), "The homeserver CS API URL to probe. Defaults to "+EnvServer)
+	token := flags.String("token", "", "An access token for an account on the homeserver. Use a dedicated device: "+
+		"the probe makes /sync requests which may interfere with a device the proxy is polling.")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *server == "" || *token == "" {
+		flags.Usage()
+		return 1
+	}
+	transport := http.DefaultTransport
+	if internal.IsUnixSocket(*server) {
+		transport = internal.UnixTransport(*server)
+	}
+	p := &prober{
+		client:  &http.Client{Timeout: time.Minute, Transport: transport},
+		v2:      sync2.NewHTTPClient(time.Minute, 5*time.Minute, *server),
+		server:  *server,
+		baseURL: internal.GetBaseURL(*server),
+		token:   *token,
+	}
+	return printFindings(p.run(context.Background()))
+}
+
+func (p *prober) run(ctx context.Context) []finding {
+	findings := []finding{checkUpstream(p.server), p.serverSoftware(ctx)}
+	if findings[0].Severity == severityError {
+		return findings
+	}
+	whoami := p.whoami(ctx)
+	findings = append(findings, whoami)
+	if whoami.Severity == severityError {
+		return findings
+	}
+	findings = append(findings, p.initialSync(ctx)...)
+	findings = append(findings, p.toDeviceFilter(ctx), p.lazyLoading(ctx), p.messages(ctx))
+	return findings
+}
+
+// serverSoftware reports the homeserver implementation, which explains most compatibility problems,
+// and the quirks the proxy will enable for it.
+func (p *prober) serverSoftware(ctx context.Context) finding {
+	name, version, err := p.v2.ServerVersion(ctx)
+	if err != nil {
+		return finding{
+			Severity: severityOK,
+			Check:    "software",
+			Message:  "unknown homeserver implementation (federation version endpoint is not exposed)",
+		}
+	}
+	f := finding{
+		Severity: severityOK,
+		Check:    "software",
+		Message:  fmt.Sprintf("homeserver is %s %s", name, version),
+	}
+	if quirks := sync2.QuirksForServer(name).Names(); len(quirks) > 0 {
+		f.Severity = severityWarn
+		f.Message += fmt.Sprintf(": the proxy will enable the quirks %s", strings.Join(quirks, ", "))
+		f.Fix = "the proxy will work, but expect more expired connections when room state changes. Override with " + EnvQuirks
+	}
+	return f
+}
+
+func (p *prober) whoami(ctx context.Context) finding {
+	userID, deviceID, err := p.v2.WhoAmI(ctx, p.token)
+	if err != nil {
+		f := finding{
+			Severity: severityError,
+			Check:    "whoami",
+			Message:  fmt.Sprintf("/whoami failed: %s", err),
+			Fix:      "the proxy cannot authenticate any clients, check the homeserver's client API is reachable",
+		}
+		if errors.Is(err, sync2.HTTP401) {
+			f.Fix = "the access token is invalid, log in again and use the new token"
+		}
+		return f
+	}
+	f := finding{
+		Severity: severityOK,
+		Check:    "whoami",
+		Message:  fmt.Sprintf("authenticated as %s device %s", userID, deviceID),
+	}
+	if deviceID == "" {
+		f.Severity = severityError
+		f.Message = fmt.Sprintf("/whoami did not return a device_id for %s", userID)
+		f.Fix = "the proxy requires device_id in /whoami responses (Matrix v1.1), upgrade the homeserver"
+	}
+	return f
+}
+
+// initialSync makes the same initial /sync request as the proxy's pollers, and checks the
+// filter was applied.
+func (p *prober) initialSync(ctx context.Context) []finding {
+	start := time.Now()
+	res, code, err := p.v2.DoSyncV2(ctx, p.token, "", true, false, false)
+	if err != nil {
+		return []finding{{
+			Severity: severityError,
+			Check:    "sync",
+			Message:  fmt.Sprintf("initial /sync failed (HTTP %d): %s", code, err),
+			Fix:      "the proxy cannot poll for this account",
+		}}
+	}
+	p.nextBatch = res.NextBatch
+	findings := []finding{{
+		Severity: severityOK,
+		Check:    "sync",
+		Message:  fmt.Sprintf("initial /sync returned %d joined rooms in %v", len(res.Rooms.Join), time.Since(start).Round(time.Millisecond)),
+	}}
+	ignoredFilter := false
+	overlap := 0
+	for roomID, room := range res.Rooms.Join {
+		if p.joinedRoom == "" {
+			p.joinedRoom = roomID
+		}
+		if len(room.Timeline.Events) > 1 {
+			ignoredFilter = true
+		}
+		stateIDs := make(map[string]bool, len(room.State.Events))
+		for _, ev := range room.State.Events {
+			stateIDs[gjson.GetBytes(ev, "event_id").Str] = true
+		}
+		for _, ev := range room.Timeline.Events {
+			if stateIDs[gjson.GetBytes(ev, "event_id").Str] {
+				overlap++
+			}
+		}
+	}
+	if ignoredFilter || len(res.Presence.Events) > 0 {
+		findings = append(findings, finding{
+			Severity: severityWarn,
+			Check:    "sync",
+			Message:  "the /sync filter was not applied (timeline limit or presence filter ignored)",
+			Fix:      "the proxy will work, but initial polls will be slower and use more memory",
+		})
+	}
+	if overlap > 0 {
+		findings = append(findings, finding{
+			Severity: severityWarn,
+			Check:    "sync",
+			Message:  fmt.Sprintf("%d events appeared in both the state and timeline sections of /sync", overlap),
+			Fix:      "the proxy tolerates this, but clients will see more expired connections when room state changes",
+		})
+	}
+	return findings
+}
+
+// toDeviceFilter checks that the filter used by to-device only pollers excludes rooms.
+// The request is made without a since token so no to-device messages are acknowledged.
+func (p *prober) toDeviceFilter(ctx context.Context) finding {
+	res, code, err := p.v2.DoSyncV2(ctx, p.token, "", true, true, false)
+	if err != nil {
+		return finding{
+			Severity: severityWarn,
+			Check:    "to-device",
+			Message:  fmt.Sprintf("to-device only /sync failed (HTTP %d): %s", code, err),
+			Fix:      "the proxy cannot poll for to-device messages on behalf of devices which aren't syncing",
+		}
+	}
+	if len(res.Rooms.Join) > 0 {
+		return finding{
+			Severity: severityWarn,
+			Check:    "to-device",
+			Message:  "the room filter `rooms: []` was ignored, so to-device only polls return room data",
+			Fix:      "the proxy will work, but polling for inactive devices is much more expensive",
+		}
+	}
+	return finding{
+		Severity: severityOK,
+		Check:    "to-device",
+		Message:  "to-device only /sync works",
+	}
+}
+
+func (p *prober) lazyLoading(ctx context.Context) finding {
+	filter, _ := json.Marshal(map[string]interface{}{
+		"room": map[string]interface{}{
+			"timeline": map[string]interface{}{"limit": 1},
+			"state":    map[string]interface{}{"lazy_load_members": true},
+		},
+	})
+	code, _, err := p.get(ctx, "/_matrix/client/r0/sync?timeout=0&filter="+url.QueryEscape(string(filter)), true)
+	if err != nil || code != 200 {
+		return finding{
+			Severity: severityWarn,
+			Check:    "lazy-load",
+			Message:  fmt.Sprintf("/sync with lazy_load_members failed: HTTP %d %v", code, err),
+			Fix:      "features which lazy load members from the homeserver will not work",
+		}
+	}
+	return finding{
+		Severity: severityOK,
+		Check:    "lazy-load",
+		Message:  "/sync with lazy_load_members works",
+	}
+}
+
+func (p *prober) messages(ctx context.Context) finding {
+	if p.joinedRoom == "" {
+		return finding{
+			Severity: severityOK,
+			Check:    "messages",
+			Message:  "skipped /messages: the account is not joined to any rooms",
+		}
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages?dir=b&limit=1", url.PathEscape(p.joinedRoom))
+	if p.nextBatch != "" {
+		path += "&from=" + url.QueryEscape(p.nextBatch)
+	}
+	code, body, err := p.get(ctx, path, true)
+	if err != nil || code != 200 {
+		return finding{
+			Severity: severityWarn,
+			Check:    "messages",
+			Message:  fmt.Sprintf("/messages failed: HTTP %d %v", code, err),
+			Fix:      "timeline gaps cannot be backfilled from the homeserver",
+		}
+	}
+	if !body.Get("chunk").IsArray() {
+		return finding{
+			Severity: severityWarn,
+			Check:    "messages",
+			Message:  "/messages response has no chunk",
+			Fix:      "timeline gaps cannot be backfilled from the homeserver",
+		}
+	}
+	return finding{
+		Severity: severityOK,
+		Check:    "messages",
+		Message:  "/messages works",
+	}
+}
+
+func (p *prober) get(ctx context.Context, path string, authed bool) (int, gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+path, nil)
+	if err != nil {
+		return 0, gjson.Result{}, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-probe-"+sync2.ProxyVersion)
+	if authed {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, gjson.Result{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, gjson.Result{}, err
+	}
+	return res.StatusCode, gjson.ParseBytes(body), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestProbe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"versions":["v1.1"]}`))
+	})
+	mux.HandleFunc("/_matrix/federation/v1/version", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"server":{"name":"Conduit","version":"0.6.0"}}`))
+	})
+	mux.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"user_id":"@alice:localhost","device_id":"DEVICE"}`))
+	})
+	mux.HandleFunc("/_matrix/client/r0/sync", func(w http.ResponseWriter, req *http.Request) {
+		// ignores filters and duplicates state in the timeline
+		w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!a:localhost":{
+			"state":{"events":[{"type":"m.room.create","state_key":"","event_id":"$create","content":{}}]},
+			"timeline":{"events":[
+				{"type":"m.room.create","state_key":"","event_id":"$create","content":{}},
+				{"type":"m.room.message","event_id":"$msg","content":{}}
+			]}
+		}}}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	newProber := func(token string) *prober {
+		return &prober{
+			client:  srv.Client(),
+			v2:      sync2.NewHTTPClient(time.Second, time.Second, srv.URL),
+			server:  srv.URL,
+			baseURL: srv.URL,
+			token:   token,
+		}
+	}
+	findings := newProber("TOKEN").run(context.Background())
+	want := map[string]severity{
+		"upstream":  severityOK,
+		"software":  severityWarn,
+		"whoami":    severityOK,
+		"to-device": severityWarn,
+		"lazy-load": severityOK,
+		"messages":  severityWarn, // no /messages handler
+	}
+	for check, wantSeverity := range want {
+		found := false
+		for _, f := range findings {
+			if f.Check == check {
+				found = true
+				if f.Severity != wantSeverity {
+					t.Errorf("%s: got %v want %v: %s", check, f.Severity, wantSeverity, f.Message)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: no finding", check)
+		}
+	}
+	var syncWarnings []string
+	for _, f := range findings {
+		if f.Check == "sync" && f.Severity == severityWarn {
+			syncWarnings = append(syncWarnings, f.Message)
+		}
+	}
+	if len(syncWarnings) != 2 || !strings.Contains(syncWarnings[0], "filter") || !strings.Contains(syncWarnings[1], "both the state and timeline") {
+		t.Errorf("got sync warnings %v, want ignored filter and state/timeline overlap", syncWarnings)
+	}
+
+	// invalid tokens stop the probe early
+	findings = newProber("WRONG").run(context.Background())
+	last := findings[len(findings)-1]
+	if last.Check != "whoami" || last.Severity != severityError || !strings.Contains(last.Fix, "access token is invalid") {
+		t.Errorf("got %+v want whoami error", last)
+	}
+}
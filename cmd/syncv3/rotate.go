@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// parseOldSecrets parses the comma-separated value of SYNCV3_OLD_SECRETS.
+func parseOldSecrets(val string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(val, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// runRotateSecret re-encrypts every access token encrypted with one of SYNCV3_OLD_SECRETS with
+// SYNCV3_SECRET. The proxy does the same in the background on startup, but this can be run to
+// know when it is safe to remove the old secrets. Returns a non-zero exit code if any token
+// could not be decrypted with any of the secrets.
+// Usage: SYNCV3_SECRET=new SYNCV3_OLD_SECRETS=old syncv3 rotate-secret
+func runRotateSecret(args map[string]string) int {
+	oldSecrets := parseOldSecrets(args[EnvOldSecrets])
+	if args[EnvDB] == "" || args[EnvSecret] == "" || len(oldSecrets) == 0 {
+		fmt.Printf("Usage: %s=<db> %s=<new secret> %s=<old secrets> syncv3 rotate-secret\n", EnvDB, EnvSecret, EnvOldSecrets)
+		return 1
+	}
+	db, err := sqlx.Open("postgres", args[EnvDB])
+	if err != nil {
+		fmt.Printf("Failed to open database: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+	tokens := sync2.NewTokensTable(db, args[EnvSecret])
+	tokens.SetOldSecrets(oldSecrets)
+
+	start := time.Now()
+	res, err := tokens.Reencrypt(1000)
+	if err != nil {
+		fmt.Printf("Failed to re-encrypt access tokens after re-encrypting %d: %s\n", res.Reencrypted, err)
+		return 1
+	}
+	fmt.Printf("Re-encrypted %d access tokens in %v.\n", res.Reencrypted, time.Since(start).Round(time.Millisecond))
+	if res.Undecryptable > 0 {
+		fmt.Printf("%d access tokens could not be decrypted with %s or %s. Their devices will not be polled until "+
+			"their clients use them again.\n", res.Undecryptable, EnvSecret, EnvOldSecrets)
+		return 1
+	}
+	fmt.Printf("%s can now be removed.\n", EnvOldSecrets)
+	return 0
+}
@@ -0,0 +1,119 @@
+package slidingsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+)
+
+// Config is the contents of the config file: tunables which can be changed without restarting
+// the proxy, by sending it SIGHUP. Settings which are not set keep their current value, which is
+// the value from the environment variables unless an earlier config file changed it.
+type Config struct {
+	// LogLevel is a log level spec like SYNCV3_LOG_LEVEL e.g "info,poller=debug".
+	LogLevel string `json:"log_level,omitempty"`
+	// PollerExpiry is how long a device can go without using the proxy before its poller is
+	// stopped, as a duration e.g "720h".
+	PollerExpiry string `json:"poller_expiry,omitempty"`
+	// MaxTimelineLimit is the most timeline events loaded for a room.
+	MaxTimelineLimit int `json:"max_timeline_limit,omitempty"`
+	// DBMaxConns is the most open database connections, like SYNCV3_MAX_DB_CONN.
+	DBMaxConns int `json:"db_max_conns,omitempty"`
+	// DBConnMaxIdleTime is the longest a database connection may be idle, as a duration e.g "1h".
+	DBConnMaxIdleTime string `json:"db_conn_max_idle_time,omitempty"`
+
+	pollerExpiry      time.Duration
+	dbConnMaxIdleTime time.Duration
+}
+
+// LoadConfig reads and validates a JSON config file.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a JSON config. Unknown settings are rejected, so typos are not
+// silently ignored.
+func ParseConfig(data []byte) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg.LogLevel != "" {
+		if err := internal.ValidateLogLevels(cfg.LogLevel); err != nil {
+			return Config{}, fmt.Errorf("invalid log_level: %w", err)
+		}
+	}
+	var err error
+	if cfg.pollerExpiry, err = parsePositiveDuration(cfg.PollerExpiry); err != nil {
+		return Config{}, fmt.Errorf("invalid poller_expiry: %w", err)
+	}
+	if cfg.dbConnMaxIdleTime, err = parsePositiveDuration(cfg.DBConnMaxIdleTime); err != nil {
+		return Config{}, fmt.Errorf("invalid db_conn_max_idle_time: %w", err)
+	}
+	if cfg.MaxTimelineLimit < 0 {
+		return Config{}, fmt.Errorf("invalid max_timeline_limit: must be positive")
+	}
+	if cfg.DBMaxConns < 0 {
+		return Config{}, fmt.Errorf("invalid db_max_conns: must be positive")
+	}
+	return cfg, nil
+}
+
+// parsePositiveDuration parses a duration which must be positive if set. Returns 0 if unset.
+func parsePositiveDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// ReloadConfig applies a config to a proxy set up with Setup, swapping the settings used by its
+// running pollers, requests and database pool. Safe to call while serving requests. Log levels
+// are process-wide, so apply to every tenant.
+func ReloadConfig(h2 *handler2.Handler, cfg Config) error {
+	if cfg.LogLevel != "" {
+		if err := internal.SetLogLevels(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	if cfg.pollerExpiry > 0 {
+		h2.SetPollerExpiry(cfg.pollerExpiry)
+	}
+	if cfg.MaxTimelineLimit > 0 {
+		h2.Store.SetMaxTimelineLimit(cfg.MaxTimelineLimit)
+	}
+	if cfg.DBMaxConns > 0 {
+		// keep idle connections equal to open connections, as in Setup
+		h2.Store.DB.SetMaxOpenConns(cfg.DBMaxConns)
+		h2.Store.DB.SetMaxIdleConns(cfg.DBMaxConns)
+	}
+	if cfg.dbConnMaxIdleTime > 0 {
+		h2.Store.DB.SetConnMaxIdleTime(cfg.dbConnMaxIdleTime)
+	}
+	logger.Info().
+		Str("log_level", cfg.LogLevel).
+		Str("poller_expiry", cfg.PollerExpiry).
+		Int("max_timeline_limit", cfg.MaxTimelineLimit).
+		Int("db_max_conns", cfg.DBMaxConns).
+		Str("db_conn_max_idle_time", cfg.DBConnMaxIdleTime).
+		Msg("applied config")
+	return nil
+}
@@ -0,0 +1,36 @@
+package slidingsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{"log_level":"info,poller=debug","poller_expiry":"720h","max_timeline_limit":20,"db_max_conns":10,"db_conn_max_idle_time":"1h"}`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %s", err)
+	}
+	if cfg.pollerExpiry != 720*time.Hour || cfg.dbConnMaxIdleTime != time.Hour || cfg.MaxTimelineLimit != 20 || cfg.DBMaxConns != 10 {
+		t.Errorf("ParseConfig: got %+v", cfg)
+	}
+	if _, err = ParseConfig([]byte(`{}`)); err != nil {
+		t.Errorf("ParseConfig with no settings: %s", err)
+	}
+
+	invalid := []string{
+		`{"log_level":"verbose"}`,
+		`{"log_level":"nosuchmodule=debug"}`,
+		`{"poller_expiry":"30d"}`,
+		`{"poller_expiry":"-1h"}`,
+		`{"db_conn_max_idle_time":"0s"}`,
+		`{"max_timeline_limit":-1}`,
+		`{"db_max_conns":-1}`,
+		`{"max_db_conns":10}`,
+		`[]`,
+	}
+	for _, data := range invalid {
+		if _, err = ParseConfig([]byte(data)); err == nil {
+			t.Errorf("ParseConfig(%s): got no error", data)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// DehydratedDevicePrefix is the MSC3814 API, which clients use to upload a dehydrated device and to
+// fetch the to-device messages which were sent to it when they rehydrate it.
+const DehydratedDevicePrefix = "/_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device"
+
+// NewDehydratedDeviceHandler passes MSC3814 requests through to the upstream homeserver unmodified,
+// so clients which send all their requests to the proxy can use device dehydration.
+//
+// Dehydrated devices have no access token, so the proxy never polls for them. The to-device messages
+// sent to a dehydrated device stay on the upstream until a client fetches them with
+// /dehydrated_device/{device_id}/events, and are never stored by the proxy: the proxy only stores
+// to-device messages for devices it polls, which are delivered by the to_device extension as normal.
+func NewDehydratedDeviceHandler(destHomeserver string) http.Handler {
+	target, err := url.Parse(internal.GetBaseURL(destHomeserver))
+	if err != nil {
+		logger.Panic().Err(err).Str("server", destHomeserver).Msg("invalid homeserver URL")
+	}
+	rp := httputil.NewSingleHostReverseProxy(target)
+	director := rp.Director
+	rp.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+	}
+	if internal.IsUnixSocket(destHomeserver) {
+		rp.Transport = internal.UnixTransport(destHomeserver)
+	}
+	rp.ModifyResponse = func(res *http.Response) error {
+		// allowCORS sets these already, and duplicate headers are rejected by browsers
+		for key := range res.Header {
+			if strings.HasPrefix(key, "Access-Control-") {
+				res.Header.Del(key)
+			}
+		}
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		logger.Warn().Err(err).Str("path", req.URL.Path).Msg("failed to pass dehydrated device request to upstream")
+		herr := &internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        err,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+	}
+	return rp
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a TLS certificate from disk, reloading it when the certificate or key
+// file changes. This allows certificates to be renewed without restarting the proxy.
+type CertReloader struct {
+	// CheckInterval is the minimum time between checks for changed files.
+	CheckInterval time.Duration
+
+	certFile  string
+	keyFile   string
+	mu        *sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // the latest modification time of the files when cert was loaded
+	lastCheck time.Time
+}
+
+// NewCertReloader loads the certificate and key. Returns an error if they cannot be loaded.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		CheckInterval: 10 * time.Second,
+		certFile:      certFile,
+		keyFile:       keyFile,
+		mu:            &sync.Mutex{},
+		lastCheck:     time.Now(),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate. If the
+// files have changed but the new certificate cannot be loaded, the previous certificate is
+// returned and loading is retried on a later call. This handles renewals which write the
+// certificate and key non-atomically.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) >= r.CheckInterval {
+		r.lastCheck = time.Now()
+		if err := r.reload(); err != nil {
+			logger.Warn().Err(err).Msg("failed to reload TLS certificate, using previous certificate")
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the certificate if the files have changed since it was last loaded. Must be
+// called with mu held, or before the reloader is shared.
+func (r *CertReloader) reload() error {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	if r.cert != nil {
+		logger.Info().Str("cert", r.certFile).Msg("reloaded TLS certificate")
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("failed to set mtime of %s: %s", file, err)
+		}
+	}
+}
+
+func certCommonName(t *testing.T, r *CertReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %s", err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Fatalf("NewCertReloader succeeded without any files")
+	}
+
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", start)
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+	r.CheckInterval = 0
+	if cn := certCommonName(t, r); cn != "first" {
+		t.Errorf("got certificate %s want first", cn)
+	}
+
+	// a half-written renewal keeps serving the old certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write cert: %s", err)
+	}
+	if cn := certCommonName(t, r); cn != "first" {
+		t.Errorf("got certificate %s after bad renewal, want first", cn)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if cn := certCommonName(t, r); cn != "second" {
+		t.Errorf("got certificate %s after renewal, want second", cn)
+	}
+
+	// changes are not noticed until the check interval has passed
+	r.CheckInterval = time.Hour
+	writeTestCert(t, certFile, keyFile, "third", start.Add(2*time.Minute))
+	if cn := certCommonName(t, r); cn != "second" {
+		t.Errorf("got certificate %s within check interval, want second", cn)
+	}
+}
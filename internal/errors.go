@@ -6,21 +6,21 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/getsentry/sentry-go"
-
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = NewLogger(LogModuleDefault)
 
 type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// Param is the name of the request field which caused this error, if any.
+	Param string
+	// RetryAfter is how long the client should wait before retrying, for M_LIMIT_EXCEEDED errors.
+	RetryAfter time.Duration
 }
 
 func (e *HandlerError) Error() string {
@@ -32,14 +32,18 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	Param        string `json:"param,omitempty"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		Param:        e.Param,
+		RetryAfterMS: e.RetryAfter.Milliseconds(),
 	}
 	b, _ := json.Marshal(je)
 	return b
@@ -53,6 +57,17 @@ func ExpiredSessionError() *HandlerError {
 	}
 }
 
+// InvalidParamError returns an HTTP 400 M_INVALID_PARAM error which names the request
+// field `param` that was invalid.
+func InvalidParamError(param string, format string, args ...interface{}) *HandlerError {
+	return &HandlerError{
+		StatusCode: 400,
+		Err:        fmt.Errorf("%s: %s", param, fmt.Sprintf(format, args...)),
+		ErrCode:    "M_INVALID_PARAM",
+		Param:      param,
+	}
+}
+
 // Assert that the expression is true, similar to assert() in C. If expr is false, print or panic.
 //
 // If expr is false and SYNCV3_DEBUG=1 then the program panics.
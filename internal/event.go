@@ -17,3 +17,38 @@ func IsMembershipChange(eventJSON gjson.Result) bool {
 	}
 	return prevMembership != currMembership // membership was changed
 }
+
+// UnreadEventTypes are the types of the events which can count towards MSC2654 unread counts.
+var UnreadEventTypes = []string{
+	"m.room.message", "m.room.encrypted", "m.sticker",
+	"m.room.name", "m.room.topic", "m.room.avatar", "m.room.tombstone",
+}
+
+// CountsAsUnread returns true if the event counts towards the MSC2654 unread count of room members
+// other than its sender. Messages, encrypted events and stickers count, unless they are notices,
+// edits or redacted, as do changes to the room's name, topic, avatar and tombstone.
+func CountsAsUnread(eventJSON gjson.Result) bool {
+	if eventJSON.Get("unsigned.redacted_because").Exists() {
+		return false
+	}
+	content := eventJSON.Get("content")
+	if !content.IsObject() || len(content.Map()) == 0 {
+		return false
+	}
+	isState := eventJSON.Get("state_key").Exists()
+	switch eventJSON.Get("type").Str {
+	case "m.room.message":
+		if isState || content.Get("msgtype").Str == "m.notice" {
+			return false
+		}
+	case "m.room.encrypted", "m.sticker":
+		if isState {
+			return false
+		}
+	case "m.room.name", "m.room.topic", "m.room.avatar", "m.room.tombstone":
+		return isState
+	default:
+		return false
+	}
+	return content.Get(`m\.relates_to.rel_type`).Str != "m.replace"
+}
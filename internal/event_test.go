@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestCountsAsUnread(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event string
+		want  bool
+	}{
+		{name: "message", event: `{"type":"m.room.message","content":{"msgtype":"m.text","body":"hi"}}`, want: true},
+		{name: "encrypted", event: `{"type":"m.room.encrypted","content":{"algorithm":"m.megolm.v1.aes-sha2"}}`, want: true},
+		{name: "sticker", event: `{"type":"m.sticker","content":{"body":"cat"}}`, want: true},
+		{name: "room name", event: `{"type":"m.room.name","state_key":"","content":{"name":"Room"}}`, want: true},
+		{name: "notice", event: `{"type":"m.room.message","content":{"msgtype":"m.notice","body":"beep"}}`},
+		{name: "edit", event: `{"type":"m.room.message","content":{"msgtype":"m.text","body":"* hi","m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}}`},
+		{name: "encrypted edit", event: `{"type":"m.room.encrypted","content":{"algorithm":"m.megolm.v1.aes-sha2","m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}}`},
+		{name: "reply", event: `{"type":"m.room.message","content":{"msgtype":"m.text","body":"hi","m.relates_to":{"m.in_reply_to":{"event_id":"$a"}}}}`, want: true},
+		{name: "redacted", event: `{"type":"m.room.message","content":{},"unsigned":{"redacted_because":{}}}`},
+		{name: "empty content", event: `{"type":"m.room.message","content":{}}`},
+		{name: "reaction", event: `{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$a","key":"👍"}}}`},
+		{name: "member", event: `{"type":"m.room.member","state_key":"@a:b","content":{"membership":"join"}}`},
+		{name: "room name without state key", event: `{"type":"m.room.name","content":{"name":"Room"}}`},
+		{name: "message with state key", event: `{"type":"m.room.message","state_key":"","content":{"msgtype":"m.text","body":"hi"}}`},
+	}
+	for _, tc := range testCases {
+		if got := CountsAsUnread(gjson.Parse(tc.event)); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Log modules which can have their log level changed independently of each other.
+// Loggers which don't belong to a module use the level of LogModuleDefault.
+const (
+	LogModuleDefault     = "default"
+	LogModulePoller      = "poller"
+	LogModuleAccumulator = "accumulator"
+	LogModuleConn        = "conn"
+	LogModuleExtensions  = "extensions"
+	LogModuleCaches      = "caches"
+)
+
+var LogModules = []string{
+	LogModuleDefault, LogModulePoller, LogModuleAccumulator, LogModuleConn, LogModuleExtensions, LogModuleCaches,
+}
+
+var (
+	logLevelsMu = &sync.RWMutex{}
+	logLevels   = map[string]zerolog.Level{}
+)
+
+// moduleLevelHook drops log events which are below the configured level for its module.
+// The zerolog global level is always set to the most verbose module level, so this hook
+// is what stops the other modules becoming just as verbose.
+type moduleLevelHook struct {
+	module string
+}
+
+func (h moduleLevelHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < ModuleLogLevel(h.module) {
+		e.Discard()
+	}
+}
+
+// NewLogger creates a logger whose level is controlled by the given module. Use
+// LogModuleDefault for loggers which don't belong to a specific module.
+func NewLogger(module string) zerolog.Logger {
+	return zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: "15:04:05",
+	}).Hook(moduleLevelHook{module: module})
+}
+
+// ModuleLogHook returns a hook which applies the level of `module` to any logger, e.g the
+// zerolog global logger.
+func ModuleLogHook(module string) zerolog.Hook {
+	return moduleLevelHook{module: module}
+}
+
+// ModuleLogLevel returns the log level of a module. Modules without an explicit level
+// use the default level.
+func ModuleLogLevel(module string) zerolog.Level {
+	logLevelsMu.RLock()
+	defer logLevelsMu.RUnlock()
+	if lvl, ok := logLevels[module]; ok {
+		return lvl
+	}
+	if lvl, ok := logLevels[LogModuleDefault]; ok {
+		return lvl
+	}
+	return zerolog.InfoLevel
+}
+
+// SetModuleLogLevel changes the log level of a module at runtime.
+func SetModuleLogLevel(module string, level zerolog.Level) error {
+	if !isLogModule(module) {
+		return fmt.Errorf("unknown log module '%s', valid modules are %s", module, strings.Join(LogModules, ", "))
+	}
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+	logLevels[module] = level
+	// the global level acts as a floor for all loggers, so it needs to be the most verbose
+	// level of any module.
+	globalLevel := zerolog.PanicLevel
+	for _, lvl := range logLevels {
+		if lvl < globalLevel {
+			globalLevel = lvl
+		}
+	}
+	if _, ok := logLevels[LogModuleDefault]; !ok && zerolog.InfoLevel < globalLevel {
+		globalLevel = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(globalLevel)
+	return nil
+}
+
+// ModuleLogLevels returns the current log level of every module.
+func ModuleLogLevels() map[string]string {
+	result := make(map[string]string, len(LogModules))
+	for _, module := range LogModules {
+		result[module] = ModuleLogLevel(module).String()
+	}
+	return result
+}
+
+// SetLogLevels parses and applies a log level spec of the form "info,poller=debug,conn=trace".
+// A level without a module sets the default level. All modules are validated before any
+// levels are changed.
+func SetLogLevels(spec string) error {
+	levels, err := parseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	// apply in a stable order
+	modules := make([]string, 0, len(levels))
+	for module := range levels {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	for _, module := range modules {
+		if err := SetModuleLogLevel(module, levels[module]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateLogLevels checks a log level spec as accepted by SetLogLevels, without applying it.
+func ValidateLogLevels(spec string) error {
+	_, err := parseLogLevels(spec)
+	return err
+}
+
+func parseLogLevels(spec string) (map[string]zerolog.Level, error) {
+	levels := make(map[string]zerolog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		module, levelStr, found := strings.Cut(part, "=")
+		if !found {
+			module, levelStr = LogModuleDefault, part
+		}
+		module = strings.TrimSpace(module)
+		if !isLogModule(module) {
+			return nil, fmt.Errorf("unknown log module '%s', valid modules are %s", module, strings.Join(LogModules, ", "))
+		}
+		level, err := ParseLogLevel(levelStr)
+		if err != nil {
+			return nil, err
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+// ParseLogLevel parses a log level name as used in SYNCV3_LOG_LEVEL.
+func ParseLogLevel(s string) (zerolog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return zerolog.TraceLevel, nil
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "err", "error":
+		return zerolog.ErrorLevel, nil
+	case "fatal":
+		return zerolog.FatalLevel, nil
+	}
+	return zerolog.NoLevel, fmt.Errorf("unknown log level '%s'", s)
+}
+
+func isLogModule(module string) bool {
+	for _, m := range LogModules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func resetLogLevels(t *testing.T) {
+	t.Helper()
+	globalLevel := zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		logLevelsMu.Lock()
+		logLevels = map[string]zerolog.Level{}
+		logLevelsMu.Unlock()
+		zerolog.SetGlobalLevel(globalLevel)
+	})
+}
+
+func TestModuleLogLevels(t *testing.T) {
+	resetLogLevels(t)
+	if err := SetLogLevels("warn, poller=debug,conn=trace"); err != nil {
+		t.Fatalf("SetLogLevels: %s", err)
+	}
+	want := map[string]zerolog.Level{
+		LogModuleDefault:     zerolog.WarnLevel,
+		LogModulePoller:      zerolog.DebugLevel,
+		LogModuleConn:        zerolog.TraceLevel,
+		LogModuleAccumulator: zerolog.WarnLevel, // inherits the default
+	}
+	for module, wantLevel := range want {
+		if got := ModuleLogLevel(module); got != wantLevel {
+			t.Errorf("module %s: got level %v want %v", module, got, wantLevel)
+		}
+	}
+	if zerolog.GlobalLevel() != zerolog.TraceLevel {
+		t.Errorf("global level should be the most verbose module level, got %v", zerolog.GlobalLevel())
+	}
+	if err := SetModuleLogLevel(LogModuleConn, zerolog.ErrorLevel); err != nil {
+		t.Fatalf("SetModuleLogLevel: %s", err)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("global level was not lowered, got %v", zerolog.GlobalLevel())
+	}
+
+	// invalid specs don't change anything
+	for _, spec := range []string{"poller=verbose", "unknown=debug", "poller=info,nope"} {
+		if err := SetLogLevels(spec); err == nil {
+			t.Errorf("SetLogLevels(%s): expected error", spec)
+		}
+	}
+	if got := ModuleLogLevel(LogModulePoller); got != zerolog.DebugLevel {
+		t.Errorf("invalid spec changed the poller level to %v", got)
+	}
+}
+
+func TestModuleLogHook(t *testing.T) {
+	resetLogLevels(t)
+	if err := SetLogLevels("info,caches=debug"); err != nil {
+		t.Fatalf("SetLogLevels: %s", err)
+	}
+	var buf bytes.Buffer
+	cachesLogger := zerolog.New(&buf).Hook(ModuleLogHook(LogModuleCaches))
+	connLogger := zerolog.New(&buf).Hook(ModuleLogHook(LogModuleConn))
+	cachesLogger.Debug().Msg("caches debug")
+	connLogger.Debug().Msg("conn debug")
+	connLogger.Info().Msg("conn info")
+	got := buf.String()
+	if !strings.Contains(got, "caches debug") {
+		t.Errorf("caches debug log was dropped: %s", got)
+	}
+	if strings.Contains(got, "conn debug") {
+		t.Errorf("conn debug log was not dropped: %s", got)
+	}
+	if !strings.Contains(got, "conn info") {
+		t.Errorf("conn info log was dropped: %s", got)
+	}
+}
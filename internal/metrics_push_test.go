@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsPusher(t *testing.T) {
+	var gotMethod, gotPath, gotBody, gotUser, gotPass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotMethod = req.Method
+		gotPath = req.URL.Path
+		gotUser, gotPass, _ = req.BasicAuth()
+		body, _ := io.ReadAll(req.Body)
+		gotBody = string(body)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Name:      "test_pushes",
+	})
+	reg.MustRegister(counter)
+	counter.Add(3)
+
+	pushURL := strings.Replace(srv.URL, "http://", "http://alice:secret@", 1)
+	p, err := NewMetricsPusher(pushURL, "sliding_sync", "proxy-1", reg)
+	if err != nil {
+		t.Fatalf("NewMetricsPusher: %s", err)
+	}
+	if err = p.Push(); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if gotMethod != "PUT" || gotPath != "/metrics/job/sliding_sync/instance/proxy-1" {
+		t.Errorf("got %s %s want PUT /metrics/job/sliding_sync/instance/proxy-1", gotMethod, gotPath)
+	}
+	if gotUser != "alice" || gotPass != "secret" {
+		t.Errorf("got basic auth %s:%s want alice:secret", gotUser, gotPass)
+	}
+	if !strings.Contains(gotBody, "sliding_sync_test_pushes") {
+		t.Errorf("pushed body does not contain the metric: %q", gotBody)
+	}
+
+	if _, err = NewMetricsPusher("localhost:9091", "sliding_sync", "proxy-1", reg); err == nil {
+		t.Errorf("NewMetricsPusher: accepted a URL without a scheme")
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// presenceActivityThreshold is how far a user's last activity has to move before it counts as a
+// change in presence, so every poller seeing the same presence update doesn't notify clients.
+const presenceActivityThreshold = time.Minute
+
+// Presence is the latest presence of a user, from an m.presence event.
+type Presence struct {
+	UserID          string  `db:"user_id"`
+	Presence        string  `db:"presence"`
+	StatusMsg       *string `db:"status_msg"`
+	CurrentlyActive bool    `db:"currently_active"`
+	// LastActiveTS is when the user was last active in unix milliseconds, or 0 if unknown. The
+	// event's last_active_ago is relative to when it was received, so it is stored as a timestamp.
+	LastActiveTS int64 `db:"last_active_ts"`
+}
+
+// PresenceFromEvent parses an m.presence event which was received at this time. Returns false if
+// the event is not a valid presence event.
+func PresenceFromEvent(ev json.RawMessage, receivedAt time.Time) (Presence, bool) {
+	parsed := gjson.ParseBytes(ev)
+	p := Presence{
+		UserID:          parsed.Get("sender").Str,
+		Presence:        parsed.Get("content.presence").Str,
+		CurrentlyActive: parsed.Get("content.currently_active").Bool(),
+	}
+	if parsed.Get("type").Str != "m.presence" || p.UserID == "" || p.Presence == "" {
+		return p, false
+	}
+	if statusMsg := parsed.Get("content.status_msg"); statusMsg.Type == gjson.String {
+		p.StatusMsg = &statusMsg.Str
+	}
+	if lastActiveAgo := parsed.Get("content.last_active_ago"); lastActiveAgo.Exists() {
+		p.LastActiveTS = receivedAt.UnixMilli() - lastActiveAgo.Int()
+	}
+	return p, true
+}
+
+// Event returns the m.presence event for this presence, with last_active_ago relative to now.
+func (p Presence) Event(now time.Time) json.RawMessage {
+	content := map[string]interface{}{
+		"presence": p.Presence,
+	}
+	if p.CurrentlyActive {
+		content["currently_active"] = true
+	}
+	if p.StatusMsg != nil {
+		content["status_msg"] = *p.StatusMsg
+	}
+	if p.LastActiveTS > 0 {
+		ago := now.UnixMilli() - p.LastActiveTS
+		if ago < 0 {
+			ago = 0
+		}
+		content["last_active_ago"] = ago
+	}
+	ev, _ := json.Marshal(map[string]interface{}{
+		"type":    "m.presence",
+		"sender":  p.UserID,
+		"content": content,
+	})
+	return ev
+}
+
+// ChangedFrom returns true if this presence is meaningfully different to the previous presence of
+// the same user: either the presence or status changed, or the user was active again since.
+func (p Presence) ChangedFrom(prev Presence) bool {
+	if p.Presence != prev.Presence || p.CurrentlyActive != prev.CurrentlyActive {
+		return true
+	}
+	if (p.StatusMsg == nil) != (prev.StatusMsg == nil) || (p.StatusMsg != nil && *p.StatusMsg != *prev.StatusMsg) {
+		return true
+	}
+	return p.LastActiveTS-prev.LastActiveTS > presenceActivityThreshold.Milliseconds()
+}
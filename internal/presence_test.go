@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestPresenceFromEvent(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	p, ok := PresenceFromEvent(json.RawMessage(`{
+		"type": "m.presence",
+		"sender": "@alice:localhost",
+		"content": {"presence": "online", "currently_active": true, "status_msg": "hi", "last_active_ago": 5000}
+	}`), now)
+	if !ok {
+		t.Fatalf("PresenceFromEvent: valid event was rejected")
+	}
+	if p.UserID != "@alice:localhost" || p.Presence != "online" || !p.CurrentlyActive || p.StatusMsg == nil || *p.StatusMsg != "hi" {
+		t.Errorf("PresenceFromEvent: got %+v", p)
+	}
+	if p.LastActiveTS != now.UnixMilli()-5000 {
+		t.Errorf("LastActiveTS: got %d want %d", p.LastActiveTS, now.UnixMilli()-5000)
+	}
+
+	// last_active_ago is relative to when the event is served
+	ev := gjson.ParseBytes(p.Event(now.Add(time.Second)))
+	if ev.Get("content.last_active_ago").Int() != 6000 || ev.Get("content.status_msg").Str != "hi" || ev.Get("sender").Str != "@alice:localhost" {
+		t.Errorf("Event: got %s", ev.Raw)
+	}
+
+	for _, invalid := range []string{
+		`{"type":"m.typing","sender":"@alice:localhost","content":{"presence":"online"}}`,
+		`{"type":"m.presence","content":{"presence":"online"}}`,
+		`{"type":"m.presence","sender":"@alice:localhost","content":{}}`,
+	} {
+		if _, ok = PresenceFromEvent(json.RawMessage(invalid), now); ok {
+			t.Errorf("PresenceFromEvent: accepted %s", invalid)
+		}
+	}
+}
+
+func TestPresenceChangedFrom(t *testing.T) {
+	status := "busy"
+	otherStatus := "free"
+	prev := Presence{UserID: "@alice:localhost", Presence: "online", StatusMsg: &status, LastActiveTS: 100000}
+	testCases := []struct {
+		name string
+		next Presence
+		want bool
+	}{
+		{name: "same", next: prev, want: false},
+		{name: "slightly later activity", next: Presence{UserID: prev.UserID, Presence: "online", StatusMsg: &status, LastActiveTS: 130000}, want: false},
+		{name: "older activity", next: Presence{UserID: prev.UserID, Presence: "online", StatusMsg: &status, LastActiveTS: 10000}, want: false},
+		{name: "much later activity", next: Presence{UserID: prev.UserID, Presence: "online", StatusMsg: &status, LastActiveTS: 200000}, want: true},
+		{name: "presence", next: Presence{UserID: prev.UserID, Presence: "unavailable", StatusMsg: &status, LastActiveTS: 100000}, want: true},
+		{name: "status", next: Presence{UserID: prev.UserID, Presence: "online", StatusMsg: &otherStatus, LastActiveTS: 100000}, want: true},
+		{name: "status cleared", next: Presence{UserID: prev.UserID, Presence: "online", LastActiveTS: 100000}, want: true},
+		{name: "currently active", next: Presence{UserID: prev.UserID, Presence: "online", StatusMsg: &status, CurrentlyActive: true, LastActiveTS: 100000}, want: true},
+	}
+	for _, tc := range testCases {
+		if got := tc.next.ChangedFrom(prev); got != tc.want {
+			t.Errorf("%s: got changed=%v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoV2Sig is the signature which starts every PROXY protocol v2 header.
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtoListener accepts connections which start with a HAProxy PROXY protocol v1 or v2
+// header, and reports the client address from the header as the connection's RemoteAddr. Use
+// this behind L4 load balancers which cannot add X-Forwarded-For headers.
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+type ProxyProtoListener struct {
+	net.Listener
+	// Trusted are the networks which are allowed to send PROXY headers. Connections from other
+	// addresses are passed through unmodified. If empty, every connection must send a header.
+	// Connections without an IP address e.g over unix sockets are always trusted.
+	Trusted []*net.IPNet
+	// HeaderTimeout is how long to wait for the header before closing the connection.
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// The header is read lazily, so a slow client can't block Accept for other clients.
+	return &proxyProtoConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.HeaderTimeout,
+		once:    &sync.Once{},
+	}, nil
+}
+
+func (l *ProxyProtoListener) isTrusted(addr net.Addr) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, ipnet := range l.Trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedNetworks parses a list of CIDRs or IP addresses.
+func ParseTrustedNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       *sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.remoteAddr, c.err = readProxyProtoHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("PROXY protocol: %w", c.err)
+		logger.Warn().Err(c.err).Str("addr", c.Conn.RemoteAddr().String()).Msg("rejecting connection")
+		c.Conn.Close()
+	}
+}
+
+// readProxyProtoHeader reads a v1 or v2 header. Returns a nil address if the header does not
+// contain one e.g for health checks from the load balancer itself.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil && !bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if bytes.Equal(peek, proxyProtoV2Sig) {
+		return readProxyProtoV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyProtoV1(r)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	// the longest v1 header is 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read v2 addresses: %w", err)
+	}
+	if verCmd&0xF == 0 {
+		// LOCAL: the connection was made by the load balancer itself
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("v2 IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("v2 IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// AF_UNSPEC or AF_UNIX: no usable client address
+	return nil, nil
+}
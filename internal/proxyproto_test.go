@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyProtoV2Header(ip net.IP, port uint16) []byte {
+	header := append([]byte{}, proxyProtoV2Sig...)
+	header = append(header, 0x21, 0x11) // v2 PROXY, AF_INET STREAM
+	header = binary.BigEndian.AppendUint16(header, 12)
+	header = append(header, ip.To4()...)
+	header = append(header, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, port)
+	header = binary.BigEndian.AppendUint16(header, 8008)
+	return header
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	testCases := []struct {
+		name       string
+		trusted    []string
+		send       []byte
+		wantAddr   string // empty for the real address
+		wantReject bool
+	}{
+		{
+			name:     "v1 tcp4",
+			send:     []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8008\r\nhello"),
+			wantAddr: "203.0.113.7:51234",
+		},
+		{
+			name:     "v1 tcp6",
+			send:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 8008\r\nhello"),
+			wantAddr: "[2001:db8::1]:51234",
+		},
+		{
+			name: "v1 unknown",
+			send: []byte("PROXY UNKNOWN\r\nhello"),
+		},
+		{
+			name:     "v2 ipv4",
+			send:     append(proxyProtoV2Header(net.ParseIP("198.51.100.9"), 4242), []byte("hello")...),
+			wantAddr: "198.51.100.9:4242",
+		},
+		{
+			name:       "missing header",
+			send:       []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantReject: true,
+		},
+		{
+			name:       "malformed v1",
+			send:       []byte("PROXY TCP4 nope\r\nhello"),
+			wantReject: true,
+		},
+		{
+			name:    "untrusted source is passed through",
+			trusted: []string{"10.0.0.0/8"},
+			send:    []byte("hello"),
+		},
+		{
+			name:     "trusted source",
+			trusted:  []string{"10.0.0.0/8", "127.0.0.1"},
+			send:     []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 8008\r\nhello"),
+			wantAddr: "203.0.113.7:51234",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trusted, err := ParseTrustedNetworks(tc.trusted)
+			if err != nil {
+				t.Fatalf("ParseTrustedNetworks: %s", err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %s", err)
+			}
+			ln := &ProxyProtoListener{Listener: inner, Trusted: trusted, HeaderTimeout: time.Second}
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %s", err)
+			}
+			defer client.Close()
+			if _, err := client.Write(tc.send); err != nil {
+				t.Fatalf("failed to write: %s", err)
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %s", err)
+			}
+			defer conn.Close()
+			wantAddr := tc.wantAddr
+			if wantAddr == "" {
+				wantAddr = client.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantAddr {
+				t.Errorf("RemoteAddr: got %s want %s", got, wantAddr)
+			}
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			if tc.wantReject {
+				if err == nil {
+					t.Errorf("Read succeeded, want the connection to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read: %s", err)
+			}
+			if string(buf) != "hello" {
+				t.Errorf("Read: got %q want hello", buf)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListenerTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	ln := &ProxyProtoListener{Listener: inner, HeaderTimeout: 50 * time.Millisecond}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer conn.Close()
+	// the client never sends a header
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Read succeeded without a header")
+	}
+}
+
+func TestParseTrustedNetworks(t *testing.T) {
+	nets, err := ParseTrustedNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParseTrustedNetworks: %s", err)
+	}
+	if len(nets) != 3 || !nets[1].Contains(net.ParseIP("192.0.2.1")) || nets[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("ParseTrustedNetworks: got %v", nets)
+	}
+	if _, err := ParseTrustedNetworks([]string{"not-an-ip"}); err == nil {
+		t.Errorf("ParseTrustedNetworks accepted an invalid address")
+	}
+}
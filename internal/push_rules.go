@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// pushRuleKinds are the kinds of push rule, in the order they are evaluated.
+var pushRuleKinds = []string{"override", "content", "room", "sender", "underride"}
+
+// PushRules is a user's parsed m.push_rules account data, which decides whether events notify
+// or highlight for them.
+type PushRules struct {
+	// rules in evaluation order, excluding disabled rules
+	rules []pushRule
+}
+
+type pushRule struct {
+	kind       string
+	ruleID     string
+	conditions []pushCondition
+	// pattern matches content.body for content rules
+	pattern   *regexp.Regexp
+	notify    bool
+	highlight bool
+}
+
+type pushCondition struct {
+	kind    string
+	key     []string
+	pattern *regexp.Regexp
+	value   gjson.Result
+	is      string
+}
+
+// PushRuleContext is what push rules are evaluated against besides the event itself.
+type PushRuleContext struct {
+	// RoomID is the room the event was sent in, as sync v2 timeline events lack a room_id.
+	RoomID string
+	// DisplayName is the user's display name in the room, if any.
+	DisplayName string
+	// MemberCount is the number of joined members in the room.
+	MemberCount int
+	// SenderPowerLevel is the power level of the event's sender.
+	SenderPowerLevel int
+	// NotificationPowerLevels is the power level needed for each kind of notification, from the
+	// m.room.power_levels notifications key.
+	NotificationPowerLevels map[string]int
+}
+
+// ParsePushRules parses the content of an m.push_rules account data event. Returns nil if the
+// content has no global rules.
+func ParsePushRules(content json.RawMessage) *PushRules {
+	global := gjson.GetBytes(content, "global")
+	if !global.IsObject() {
+		return nil
+	}
+	var pr PushRules
+	for _, kind := range pushRuleKinds {
+		for _, r := range global.Get(kind).Array() {
+			if enabled := r.Get("enabled"); enabled.Exists() && !enabled.Bool() {
+				continue
+			}
+			rule := pushRule{
+				kind:   kind,
+				ruleID: r.Get("rule_id").Str,
+			}
+			switch kind {
+			case "override", "underride":
+				for _, c := range r.Get("conditions").Array() {
+					rule.conditions = append(rule.conditions, parsePushCondition(c))
+				}
+			case "content":
+				rule.pattern = globToRegexp(r.Get("pattern").Str, true)
+			}
+			for _, action := range r.Get("actions").Array() {
+				switch {
+				case action.Str == "notify":
+					rule.notify = true
+				case action.Get("set_tweak").Str == "highlight":
+					value := action.Get("value")
+					rule.highlight = !value.Exists() || value.Bool()
+				}
+			}
+			pr.rules = append(pr.rules, rule)
+		}
+	}
+	return &pr
+}
+
+func parsePushCondition(c gjson.Result) pushCondition {
+	cond := pushCondition{
+		kind:  c.Get("kind").Str,
+		key:   splitPushRuleKey(c.Get("key").Str),
+		value: c.Get("value"),
+		is:    c.Get("is").Str,
+	}
+	if cond.kind == "event_match" {
+		// content.body is matched by words, everything else has to match the whole value
+		cond.pattern = globToRegexp(c.Get("pattern").Str, c.Get("key").Str == "content.body")
+	}
+	if cond.kind == "sender_notification_permission" {
+		cond.is = c.Get("key").Str
+	}
+	return cond
+}
+
+// Evaluate returns whether the event notifies or highlights, according to the first matching rule.
+func (pr *PushRules) Evaluate(ev json.RawMessage, pctx PushRuleContext) (notify, highlight bool) {
+	if pr == nil {
+		return false, false
+	}
+	parsed := gjson.ParseBytes(ev)
+	if !parsed.Get("room_id").Exists() && pctx.RoomID != "" {
+		if withRoomID, err := sjson.SetBytes(ev, "room_id", pctx.RoomID); err == nil {
+			parsed = gjson.ParseBytes(withRoomID)
+		}
+	}
+	for _, rule := range pr.rules {
+		if rule.matches(parsed, pctx) {
+			return rule.notify, rule.highlight
+		}
+	}
+	return false, false
+}
+
+func (r *pushRule) matches(ev gjson.Result, pctx PushRuleContext) bool {
+	switch r.kind {
+	case "content":
+		return r.pattern != nil && r.pattern.MatchString(ev.Get("content.body").Str)
+	case "room":
+		return r.ruleID == ev.Get("room_id").Str
+	case "sender":
+		return r.ruleID == ev.Get("sender").Str
+	}
+	for _, c := range r.conditions {
+		if !c.matches(ev, pctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *pushCondition) matches(ev gjson.Result, pctx PushRuleContext) bool {
+	switch c.kind {
+	case "event_match":
+		val := pushRuleKeyValue(ev, c.key)
+		return c.pattern != nil && val.Type == gjson.String && c.pattern.MatchString(val.Str)
+	case "event_property_is":
+		return pushRuleValuesEqual(pushRuleKeyValue(ev, c.key), c.value)
+	case "event_property_contains":
+		val := pushRuleKeyValue(ev, c.key)
+		if !val.IsArray() {
+			return false
+		}
+		for _, elem := range val.Array() {
+			if pushRuleValuesEqual(elem, c.value) {
+				return true
+			}
+		}
+		return false
+	case "contains_display_name":
+		if pctx.DisplayName == "" {
+			return false
+		}
+		re, err := regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(pctx.DisplayName) + `(\W|$)`)
+		return err == nil && re.MatchString(ev.Get("content.body").Str)
+	case "room_member_count":
+		return memberCountMatches(c.is, pctx.MemberCount)
+	case "sender_notification_permission":
+		required, ok := pctx.NotificationPowerLevels[c.is]
+		if !ok {
+			required = 50
+		}
+		return pctx.SenderPowerLevel >= required
+	}
+	// unknown conditions never match
+	return false
+}
+
+// memberCountMatches evaluates a room_member_count condition like "2" or ">=10".
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	want, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == want
+	case "<":
+		return count < want
+	case ">":
+		return count > want
+	case "<=":
+		return count <= want
+	case ">=":
+		return count >= want
+	}
+	return false
+}
+
+// pushRuleValuesEqual compares scalar values for event_property_is and event_property_contains.
+func pushRuleValuesEqual(a, b gjson.Result) bool {
+	if !a.Exists() || !b.Exists() || a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case gjson.String:
+		return a.Str == b.Str
+	case gjson.Number:
+		return a.Raw == b.Raw || a.Num == b.Num
+	case gjson.True, gjson.False, gjson.Null:
+		return true
+	}
+	return false
+}
+
+// splitPushRuleKey splits a dotted key like content.m\.relates_to into its unescaped parts.
+func splitPushRuleKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key) && (key[i+1] == '.' || key[i+1] == '\\'):
+			part.WriteByte(key[i+1])
+			i++
+		case key[i] == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(key[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// pushRuleKeyValue walks the event by the parts of a key.
+func pushRuleKeyValue(ev gjson.Result, key []string) gjson.Result {
+	val := ev
+	for _, part := range key {
+		if !val.IsObject() {
+			return gjson.Result{}
+		}
+		val = val.Get(escapeGJSONPath(part))
+	}
+	return val
+}
+
+// escapeGJSONPath escapes a single key so gjson doesn't treat any of it as path syntax.
+func escapeGJSONPath(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		switch r {
+		case '.', '*', '?', '|', '#', '@', '\\', '!', '=', '<', '>', '%':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// globToRegexp compiles a push rule glob, where * matches any characters and ? matches one
+// character, case-insensitively. If words is set the glob matches whole words anywhere in the
+// value, else it must match the entire value.
+func globToRegexp(glob string, words bool) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, `.*?`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	if words {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = `^` + expr + `$`
+	}
+	re, err := regexp.Compile(`(?is)` + expr)
+	if err != nil {
+		return nil
+	}
+	return re
+}
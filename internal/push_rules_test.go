@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testPushRules = `{
+	"global": {
+		"override": [
+			{"rule_id": ".m.rule.master", "default": true, "enabled": false, "conditions": [], "actions": []},
+			{"rule_id": ".m.rule.suppress_notices", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "content.msgtype", "pattern": "m.notice"}
+			], "actions": []},
+			{"rule_id": ".m.rule.is_user_mention", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_property_contains", "key": "content.m\\.mentions.user_ids", "value": "@alice:localhost"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]},
+			{"rule_id": ".m.rule.contains_display_name", "default": true, "enabled": true, "conditions": [
+				{"kind": "contains_display_name"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]},
+			{"rule_id": ".m.rule.roomnotif", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "content.body", "pattern": "@room"},
+				{"kind": "sender_notification_permission", "key": "room"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]},
+			{"rule_id": ".m.rule.reaction", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "type", "pattern": "m.reaction"}
+			], "actions": []}
+		],
+		"content": [
+			{"rule_id": "cake", "default": false, "enabled": true, "pattern": "cake*", "actions": ["notify", {"set_tweak": "highlight", "value": false}]}
+		],
+		"room": [
+			{"rule_id": "!muted:localhost", "default": false, "enabled": true, "actions": []}
+		],
+		"sender": [
+			{"rule_id": "@bob:localhost", "default": false, "enabled": true, "actions": ["notify", {"set_tweak": "highlight"}]}
+		],
+		"underride": [
+			{"rule_id": ".m.rule.room_one_to_one", "default": true, "enabled": true, "conditions": [
+				{"kind": "room_member_count", "is": "2"},
+				{"kind": "event_match", "key": "type", "pattern": "m.room.message"}
+			], "actions": ["notify", {"set_tweak": "highlight", "value": false}]},
+			{"rule_id": ".m.rule.message", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "type", "pattern": "m.room.message"}
+			], "actions": ["notify"]}
+		]
+	}
+}`
+
+func TestPushRulesEvaluate(t *testing.T) {
+	rules := ParsePushRules(json.RawMessage(testPushRules))
+	if rules == nil {
+		t.Fatalf("ParsePushRules returned nil")
+	}
+	pctx := PushRuleContext{
+		RoomID:           "!room:localhost",
+		DisplayName:      "Alice",
+		MemberCount:      5,
+		SenderPowerLevel: 0,
+	}
+	testCases := []struct {
+		name          string
+		ev            string
+		pctx          *PushRuleContext
+		wantNotify    bool
+		wantHighlight bool
+	}{
+		{
+			name:       "plain message notifies",
+			ev:         `{"type":"m.room.message","sender":"@charlie:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			wantNotify: true,
+		},
+		{
+			name: "notice does not notify",
+			ev:   `{"type":"m.room.message","sender":"@charlie:localhost","content":{"msgtype":"m.notice","body":"hello"}}`,
+		},
+		{
+			name: "reaction does not notify",
+			ev:   `{"type":"m.reaction","sender":"@charlie:localhost","content":{}}`,
+		},
+		{
+			name:          "mention highlights",
+			ev:            `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"hi","m.mentions":{"user_ids":["@alice:localhost"]}}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:          "display name highlights",
+			ev:            `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"hey alice!"}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "display name must be a whole word",
+			ev:         `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"malice"}}`,
+			wantNotify: true,
+		},
+		{
+			name:       "@room needs permission",
+			ev:         `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"@room look"}}`,
+			wantNotify: true,
+		},
+		{
+			name: "@room with permission highlights",
+			ev:   `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"@room look"}}`,
+			pctx: &PushRuleContext{
+				RoomID:                  "!room:localhost",
+				MemberCount:             5,
+				SenderPowerLevel:        10,
+				NotificationPowerLevels: map[string]int{"room": 10},
+			},
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "content rule glob",
+			ev:         `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"I like CAKES"}}`,
+			wantNotify: true,
+		},
+		{
+			name: "muted room",
+			ev:   `{"type":"m.room.message","room_id":"!muted:localhost","sender":"@charlie:localhost","content":{"body":"hello"}}`,
+		},
+		{
+			name: "muted room from the context",
+			ev:   `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"hello"}}`,
+			pctx: &PushRuleContext{
+				RoomID:      "!muted:localhost",
+				MemberCount: 5,
+			},
+		},
+		{
+			name:          "sender rule",
+			ev:            `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hello"}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name: "state events do not notify",
+			ev:   `{"type":"m.room.topic","state_key":"","sender":"@charlie:localhost","content":{"topic":"hello"}}`,
+		},
+		{
+			name: "DM underride",
+			ev:   `{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"hello"}}`,
+			pctx: &PushRuleContext{
+				RoomID:      "!dm:localhost",
+				MemberCount: 2,
+			},
+			wantNotify: true,
+		},
+	}
+	for _, tc := range testCases {
+		evalCtx := pctx
+		if tc.pctx != nil {
+			evalCtx = *tc.pctx
+		}
+		notify, highlight := rules.Evaluate(json.RawMessage(tc.ev), evalCtx)
+		if notify != tc.wantNotify || highlight != tc.wantHighlight {
+			t.Errorf("%s: got notify=%v highlight=%v, want notify=%v highlight=%v", tc.name, notify, highlight, tc.wantNotify, tc.wantHighlight)
+		}
+	}
+}
+
+func TestParsePushRulesInvalid(t *testing.T) {
+	if rules := ParsePushRules(json.RawMessage(`{"device":{}}`)); rules != nil {
+		t.Errorf("ParsePushRules: got rules without global rules")
+	}
+	var rules *PushRules
+	if notify, highlight := rules.Evaluate(json.RawMessage(`{"type":"m.room.message"}`), PushRuleContext{}); notify || highlight {
+		t.Errorf("nil PushRules: got notify=%v highlight=%v", notify, highlight)
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	testCases := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"==2", 2, true},
+		{"<2", 1, true},
+		{"<2", 2, false},
+		{">2", 3, true},
+		{">=2", 2, true},
+		{"<=2", 3, false},
+		{"~2", 2, false},
+		{"", 0, false},
+	}
+	for _, tc := range testCases {
+		if got := memberCountMatches(tc.is, tc.count); got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d): got %v want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket which allows bursts of up to burst calls, refilling at perSecond
+// calls a second. It is safe to use from multiple goroutines.
+type RateLimiter struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &RateLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+		now:       time.Now,
+	}
+	rl.last = rl.now()
+	return rl
+}
+
+// Allow returns true and uses up a token if one is available.
+func (rl *RateLimiter) Allow() bool {
+	ok, _ := rl.Reserve()
+	return ok
+}
+
+// Reserve is like Allow, but if no token is available it also returns how long until one will be.
+func (rl *RateLimiter) Reserve() (ok bool, retryAfter time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.perSecond
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		return false, time.Duration((1 - rl.tokens) / rl.perSecond * float64(time.Second))
+	}
+	rl.tokens--
+	return true, 0
+}
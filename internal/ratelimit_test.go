@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	rl := NewRateLimiter(2, 3)
+	rl.now = func() time.Time { return now }
+	rl.last = now
+
+	// the burst is available straight away
+	for i := 0; i < 3; i++ {
+		if !rl.Allow() {
+			t.Fatalf("call %d: not allowed within the burst", i)
+		}
+	}
+	ok, retryAfter := rl.Reserve()
+	if ok {
+		t.Fatalf("allowed a call over the burst")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("got retry after %v, want 500ms", retryAfter)
+	}
+
+	// tokens refill at 2 a second
+	now = now.Add(500 * time.Millisecond)
+	if !rl.Allow() {
+		t.Fatalf("not allowed after refilling a token")
+	}
+	if rl.Allow() {
+		t.Fatalf("allowed a second call after refilling one token")
+	}
+
+	// refilling never exceeds the burst
+	now = now.Add(time.Hour)
+	allowed := 0
+	for rl.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d calls after a long wait, want 3", allowed)
+	}
+}
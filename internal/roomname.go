@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// TypingTTL is how long a typing notification is shown for if the homeserver never clears it, e.g.
+// because the poller which would have received the cleared notification stopped.
+const TypingTTL = 30 * time.Second
+
 // EventMetadata holds timing information about an event, to be used when sorting room
 // lists by recency.
 type EventMetadata struct {
@@ -27,13 +32,15 @@ type EventMetadata struct {
 // Roughly speaking, the sync3.RoomConnMetadata is constantly catching up with changes
 // in the caches.GlobalCache.
 type RoomMetadata struct {
-	RoomID         string
-	Heroes         []Hero
-	NameEvent      string // the content of m.room.name, NOT the calculated name
-	AvatarEvent    string // the content of m.room.avatar, NOT the resolved avatar
-	CanonicalAlias string
-	JoinCount      int
-	InviteCount    int
+	RoomID            string
+	Heroes            []Hero
+	NameEvent         string // the content of m.room.name, NOT the calculated name
+	AvatarEvent       string // the content of m.room.avatar, NOT the resolved avatar
+	CanonicalAlias    string
+	JoinRule          string // the join_rule of m.room.join_rules e.g "public" or "invite"
+	HistoryVisibility string // the history_visibility of m.room.history_visibility e.g "shared"
+	JoinCount         int
+	InviteCount       int
 	// LastMessageTimestamp is the origin_server_ts of the event most recently seen in
 	// this room. Because events arrive at the upstream homeserver out-of-order (and
 	// because origin_server_ts is an untrusted event field), this timestamp can
@@ -50,6 +57,8 @@ type RoomMetadata struct {
 	ChildSpaceRooms map[string]struct{}
 	// The latest m.typing ephemeral event for this room.
 	TypingEvent json.RawMessage
+	// TypingTS is when TypingEvent was received, in unix millis.
+	TypingTS int64
 }
 
 func NewRoomMetadata(roomID string) *RoomMetadata {
@@ -98,6 +107,15 @@ func (m *RoomMetadata) DeepCopy() *RoomMetadata {
 	return &newMetadata
 }
 
+// CurrentTypingEvent returns TypingEvent, or nil if it is older than TypingTTL as the users are
+// unlikely to still be typing.
+func (m *RoomMetadata) CurrentTypingEvent(now time.Time) json.RawMessage {
+	if m.TypingEvent == nil || now.Sub(time.UnixMilli(m.TypingTS)) > TypingTTL {
+		return nil
+	}
+	return m.TypingEvent
+}
+
 // SameRoomName checks if the fields relevant for room names have changed between the two metadatas.
 // Returns true if there are no changes.
 func (m *RoomMetadata) SameRoomName(other *RoomMetadata) bool {
@@ -109,6 +127,11 @@ func (m *RoomMetadata) SameRoomName(other *RoomMetadata) bool {
 		sameHeroNames(m.Heroes, other.Heroes))
 }
 
+// SameRoomInfo returns true if the join rule and history visibility are the same.
+func (m *RoomMetadata) SameRoomInfo(other *RoomMetadata) bool {
+	return m.JoinRule == other.JoinRule && m.HistoryVisibility == other.HistoryVisibility
+}
+
 func (m *RoomMetadata) SameJoinCount(other *RoomMetadata) bool {
 	return m.JoinCount == other.JoinCount
 }
@@ -262,6 +262,30 @@ func TestCalculateRoomName(t *testing.T) {
 	}
 }
 
+func TestCalculateAvatar(t *testing.T) {
+	bob := Hero{ID: "@bob:localhost", Avatar: "mxc://localhost/bob"}
+	chris := Hero{ID: "@chris:localhost", Avatar: "mxc://localhost/chris"}
+	testCases := []struct {
+		name        string
+		avatarEvent string
+		heroes      []Hero
+		isDM        bool
+		want        string
+	}{
+		{name: "m.room.avatar takes precedence", avatarEvent: "mxc://localhost/room", heroes: []Hero{bob}, isDM: true, want: "mxc://localhost/room"},
+		{name: "DM with one hero uses their avatar", heroes: []Hero{bob}, isDM: true, want: bob.Avatar},
+		{name: "DM with several heroes has no avatar", heroes: []Hero{bob, chris}, isDM: true, want: ""},
+		{name: "two person room which is not a DM has no avatar", heroes: []Hero{bob}, want: ""},
+		{name: "DM hero without an avatar has no avatar", heroes: []Hero{{ID: "@bob:localhost"}}, isDM: true, want: ""},
+	}
+	for _, tc := range testCases {
+		got := CalculateAvatar(&RoomMetadata{AvatarEvent: tc.avatarEvent, Heroes: tc.heroes}, tc.isDM)
+		if got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
 func TestCopyHeroes(t *testing.T) {
 	const alice = "@alice:test"
 	const bob = "@bob:test"
@@ -8,3 +8,22 @@ type Receipt struct {
 	ThreadID  string `db:"thread_id"`
 	IsPrivate bool
 }
+
+// RoomSummary is a summary of a room the user isn't joined to, as returned by the upstream
+// homeserver's MSC3266 room summary endpoint.
+type RoomSummary struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	AvatarURL        string `json:"avatar_url,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	RoomType         string `json:"room_type,omitempty"`
+	JoinRule         string `json:"join_rule,omitempty"`
+}
+
+// ThreadUnreadCounts are the notification counts for a single thread in a room (MSC3773).
+type ThreadUnreadCounts struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+}
@@ -0,0 +1,155 @@
+package slidingsync
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+)
+
+// migrationsDir is the directory of EmbedMigrations which holds the migrations.
+const migrationsDir = "state/migrations"
+
+// MigrationsTable records which migrations have been applied to the database.
+const MigrationsTable = "syncv3_migrations"
+
+// legacyMigrationsTable is goose's default table, which older proxies recorded migrations in.
+const legacyMigrationsTable = "goose_db_version"
+
+func init() {
+	goose.SetTableName(MigrationsTable)
+}
+
+// LatestSchemaVersion returns the version of the newest migration in this binary.
+func LatestSchemaVersion() (int64, error) {
+	goose.SetBaseFS(EmbedMigrations)
+	migrations, err := goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// CurrentSchemaVersion returns the version of the newest migration applied to the database, or 0
+// if no migrations have been applied.
+func CurrentSchemaVersion(db *sql.DB) (int64, error) {
+	var table, legacyTable sql.NullString
+	err := db.QueryRow(`SELECT to_regclass($1)::text, to_regclass($2)::text`, MigrationsTable, legacyMigrationsTable).Scan(&table, &legacyTable)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query tables: %w", err)
+	}
+	if !table.Valid {
+		// the proxy which applied the migrations may not have renamed the legacy table yet
+		table = legacyTable
+	}
+	if !table.Valid {
+		return 0, nil
+	}
+	var current int64
+	err = db.QueryRow(`SELECT COALESCE(MAX(version_id), 0) FROM ` + table.String + ` WHERE is_applied`).Scan(&current)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query schema version: %w", err)
+	}
+	return current, nil
+}
+
+// CheckSchemaVersion returns an error if the database has migrations applied which are newer than
+// this binary knows about, e.g after downgrading the proxy. An older proxy would write data in a
+// shape the newer schema no longer expects, so it must not run until the database is downgraded
+// with 'syncv3 migrate down-to' using the newer binary.
+func CheckSchemaVersion(db *sql.DB) error {
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	current, err := CurrentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this proxy's latest migration %d", current, latest)
+	}
+	return nil
+}
+
+// renameLegacyMigrationsTable renames the table older proxies recorded migrations in to
+// MigrationsTable, so the migrations they applied aren't applied again.
+func renameLegacyMigrationsTable(db *sql.DB) error {
+	var table, legacyTable sql.NullString
+	err := db.QueryRow(`SELECT to_regclass($1)::text, to_regclass($2)::text`, MigrationsTable, legacyMigrationsTable).Scan(&table, &legacyTable)
+	if err != nil {
+		return fmt.Errorf("failed to query tables: %w", err)
+	}
+	if table.Valid || !legacyTable.Valid {
+		return nil
+	}
+	_, err = db.Exec(`
+	ALTER TABLE ` + legacyMigrationsTable + ` RENAME TO ` + MigrationsTable + `;
+	ALTER SEQUENCE IF EXISTS ` + legacyMigrationsTable + `_id_seq RENAME TO ` + MigrationsTable + `_id_seq;`)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s: %w", legacyMigrationsTable, err)
+	}
+	logger.Info().Str("from", legacyMigrationsTable).Str("to", MigrationsTable).Msg("renamed the migrations table")
+	return nil
+}
+
+// Migrate checks the schema version, then applies any migrations the database is missing. This
+// creates every table on a new database, so must be called before using the database.
+func Migrate(db *sql.DB) error {
+	return RunMigrations(db, "up")
+}
+
+// RunMigrations runs a goose command, e.g 'up', 'down-to 20231231153055' or 'status', against the
+// database. Commands other than 'status' and 'version' are refused if the database has migrations
+// applied which are newer than this binary knows about.
+func RunMigrations(db *sql.DB, command string, args ...string) error {
+	if err := renameLegacyMigrationsTable(db); err != nil {
+		return err
+	}
+	// only inspecting the schema is safe if it is newer than this binary
+	if command != "status" && command != "version" {
+		if err := CheckSchemaVersion(db); err != nil {
+			return fmt.Errorf("%w, refusing to run '%s'. Use the newer proxy's migrate command instead", err, command)
+		}
+	}
+	goose.SetBaseFS(EmbedMigrations)
+	// The initial schema migration is older than migrations which existed before it, so it is
+	// missing on databases which were created by older proxies.
+	return goose.RunWithOptions(command, db, migrationsDir, args, goose.WithAllowMissing())
+}
+
+// MigrateDatabase applies any migrations the database is missing. If schema is set, migrations
+// are applied in that postgres schema, which is created if it does not exist.
+func MigrateDatabase(postgresURI, schema string) error {
+	var err error
+	if schema != "" {
+		postgresURI, err = withSearchPath(postgresURI, schema)
+		if err != nil {
+			return fmt.Errorf("invalid DB schema: %w", err)
+		}
+	}
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err != nil {
+		return fmt.Errorf("failed to open DB: %w", err)
+	}
+	defer db.Close()
+	return prepareDB(db, schema)
+}
+
+// prepareDB creates the schema if it is set, then applies any migrations the database is missing.
+func prepareDB(db *sqlx.DB, schema string) error {
+	if schema != "" {
+		// the search_path already points at the schema, so everything is created in it
+		if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + schema); err != nil {
+			return fmt.Errorf("failed to create DB schema %s: %w", schema, err)
+		}
+	}
+	if err := Migrate(db.DB); err != nil {
+		return fmt.Errorf("failed to execute migrations: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package slidingsync
+
+import (
+	"database/sql"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestLatestSchemaVersion(t *testing.T) {
+	entries, err := os.ReadDir(migrationsDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	var versions []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, "_test.go") || (!strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, ".sql")) {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) == 0 {
+		t.Fatalf("found no migrations in %s", migrationsDir)
+	}
+
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatalf("LatestSchemaVersion: %s", err)
+	}
+	if want := versions[len(versions)-1]; latest != want {
+		t.Errorf("LatestSchemaVersion: got %d want %d", latest, want)
+	}
+}
+
+// Test that migrating a new database creates every table, and records the migrations.
+func TestMigrateCreatesSchema(t *testing.T) {
+	db, err := sql.Open("postgres", testutils.PrepareDBConnectionString())
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	defer db.Close()
+	if err = Migrate(db); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	for _, table := range []string{MigrationsTable, "syncv3_events", "syncv3_snapshots", "syncv3_sync2_devices", "syncv3_sync2_tokens"} {
+		var exists sql.NullString
+		if err = db.QueryRow(`SELECT to_regclass($1)::text`, table).Scan(&exists); err != nil {
+			t.Fatalf("failed to query tables: %s", err)
+		}
+		if !exists.Valid {
+			t.Errorf("table %s was not created", table)
+		}
+	}
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatalf("LatestSchemaVersion: %s", err)
+	}
+	current, err := CurrentSchemaVersion(db)
+	if err != nil {
+		t.Fatalf("CurrentSchemaVersion: %s", err)
+	}
+	if current != latest {
+		t.Errorf("CurrentSchemaVersion: got %d want %d", current, latest)
+	}
+}
+
+// Test that the migrations recorded by older proxies, which predate the initial schema migration
+// and recorded them in goose's default table, are kept.
+func TestMigrateRenamesLegacyMigrationsTable(t *testing.T) {
+	db, err := sql.Open("postgres", testutils.PrepareDBConnectionString())
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	defer db.Close()
+	if err = Migrate(db); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	// make the database look like an older proxy made it
+	_, err = db.Exec(`ALTER TABLE ` + MigrationsTable + ` RENAME TO ` + legacyMigrationsTable + `;
+	DELETE FROM ` + legacyMigrationsTable + ` WHERE version_id = 20230101000000;`)
+	if err != nil {
+		t.Fatalf("failed to fake an older database: %s", err)
+	}
+	var applied int
+	if err = db.QueryRow(`SELECT count(*) FROM ` + legacyMigrationsTable).Scan(&applied); err != nil {
+		t.Fatalf("failed to count migrations: %s", err)
+	}
+
+	if err = Migrate(db); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	var legacyTable sql.NullString
+	if err = db.QueryRow(`SELECT to_regclass($1)::text`, legacyMigrationsTable).Scan(&legacyTable); err != nil {
+		t.Fatalf("failed to query tables: %s", err)
+	}
+	if legacyTable.Valid {
+		t.Errorf("%s was not renamed", legacyMigrationsTable)
+	}
+	// every migration is kept, and only the initial schema migration is applied
+	var gotApplied int
+	if err = db.QueryRow(`SELECT count(*) FROM ` + MigrationsTable).Scan(&gotApplied); err != nil {
+		t.Fatalf("failed to count migrations: %s", err)
+	}
+	if gotApplied != applied+1 {
+		t.Errorf("got %d migrations recorded, want %d", gotApplied, applied+1)
+	}
+}
@@ -0,0 +1,271 @@
+package pubsub
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxQueuedPayloads is the most payloads a QueuedNotifier holds before Notify blocks.
+const DefaultMaxQueuedPayloads = 10000
+
+// UserPayload is a payload about a single user whose contents the consumer can reload from the
+// database. A QueuedNotifier may drop these in favour of a V2ResyncUser payload.
+type UserPayload interface {
+	Payload
+	QueueUserID() string
+}
+
+// CoalescablePayload is a payload which only matters for its latest value, so a QueuedNotifier
+// replaces a queued payload with the same key rather than queueing another.
+type CoalescablePayload interface {
+	Payload
+	CoalesceKey() string
+	// Coalesce merges anything from the older payload which this payload does not replace.
+	Coalesce(older Payload)
+}
+
+type queuedPayload struct {
+	chanName string
+	payload  Payload
+	// userID is set if the payload is a UserPayload
+	userID string
+	// coalesceKey is set if the payload is a CoalescablePayload
+	coalesceKey string
+}
+
+// QueuedNotifier is a Notifier which queues payloads so that publishers are not held up by a slow
+// consumer, whilst bounding how many payloads can be queued for each user. When a user has too
+// many payloads queued, e.g. because a spammy room keeps changing their unread counts, the user's
+// queued payloads are dropped and replaced with a single V2ResyncUser payload, which makes the
+// consumer reload the user from the database. Payloads which only matter for their latest value
+// replace each other whilst queued. Payloads are sent to the wrapped Notifier in order by a
+// single goroutine, so the order of payloads which are not dropped is kept.
+type QueuedNotifier struct {
+	Notifier
+	maxQueued  int
+	maxPerUser int
+
+	mu *sync.Mutex
+	// cond is signalled when payloads are queued or the notifier is closed
+	cond *sync.Cond
+	// space is closed and replaced when a payload is taken from a full queue
+	space     chan struct{}
+	queue     []*queuedPayload
+	userCount map[string]int
+	coalesce  map[string]*queuedPayload
+	// resyncing are the users with a V2ResyncUser payload queued
+	resyncing map[string]bool
+	closed    bool
+	done      chan struct{}
+
+	depth     prometheus.Gauge
+	overflows *prometheus.CounterVec
+}
+
+// NewQueuedNotifier wraps a notifier in a queue which holds at most maxPerUser UserPayloads for
+// each user, and starts sending the queued payloads to it.
+func NewQueuedNotifier(n Notifier, maxQueued, maxPerUser int, enablePrometheus bool) *QueuedNotifier {
+	q := &QueuedNotifier{
+		Notifier:   n,
+		maxQueued:  maxQueued,
+		maxPerUser: maxPerUser,
+		mu:         &sync.Mutex{},
+		space:      make(chan struct{}),
+		userCount:  make(map[string]int),
+		coalesce:   make(map[string]*queuedPayload),
+		resyncing:  make(map[string]bool),
+		done:       make(chan struct{}),
+	}
+	q.cond = sync.NewCond(q.mu)
+	if enablePrometheus {
+		q.depth = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "pubsub_queue_depth",
+			Help:      "Number of payloads waiting to be sent to the sync API",
+		})
+		q.overflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "pubsub_queue_overflows_total",
+			Help:      "Number of payloads which were not queued, by what happened instead: coalesced with a queued payload, or dropped as a user's queue overflowed",
+		}, []string{"action"})
+		prometheus.MustRegister(q.depth, q.overflows)
+	}
+	go q.run()
+	return q
+}
+
+// Notify queues the payload. If the queue is full, this blocks until there is space for it.
+func (q *QueuedNotifier) Notify(chanName string, p Payload) error {
+	timeout := time.After(5 * time.Second)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queue) >= q.maxQueued && !q.closed {
+		space := q.space
+		q.mu.Unlock()
+		select {
+		case <-space:
+		case <-timeout:
+			q.mu.Lock()
+			return fmt.Errorf("notify with payload %v timed out: %d payloads queued", p.Type(), len(q.queue))
+		}
+		q.mu.Lock()
+	}
+	if q.closed {
+		return fmt.Errorf("notify with payload %v: notifier is closed", p.Type())
+	}
+	qp := &queuedPayload{
+		chanName: chanName,
+		payload:  p,
+	}
+	if up, ok := p.(UserPayload); ok {
+		qp.userID = up.QueueUserID()
+		if q.resyncing[qp.userID] {
+			// the resync loads this payload's changes from the database
+			q.countOverflow("dropped")
+			return nil
+		}
+	}
+	if cp, ok := p.(CoalescablePayload); ok {
+		qp.coalesceKey = chanName + " " + p.Type() + " " + cp.CoalesceKey()
+		if older := q.coalesce[qp.coalesceKey]; older != nil {
+			cp.Coalesce(older.payload)
+			older.payload = p
+			q.countOverflow("coalesced")
+			return nil
+		}
+	}
+	if qp.userID != "" && q.userCount[qp.userID] >= q.maxPerUser {
+		q.resync(chanName, qp.userID)
+		return nil
+	}
+	q.push(qp)
+	return nil
+}
+
+// resync replaces the user's queued payloads with a V2ResyncUser payload. Must be called with the
+// lock held.
+func (q *QueuedNotifier) resync(chanName, userID string) {
+	// the payload which overflowed is dropped as well
+	dropped := 1
+	kept := q.queue[:0]
+	for _, qp := range q.queue {
+		if qp.userID != userID {
+			kept = append(kept, qp)
+			continue
+		}
+		if qp.coalesceKey != "" {
+			delete(q.coalesce, qp.coalesceKey)
+		}
+		dropped++
+	}
+	for i := len(kept); i < len(q.queue); i++ {
+		q.queue[i] = nil
+	}
+	q.queue = kept
+	delete(q.userCount, userID)
+	q.resyncing[userID] = true
+	if q.overflows != nil {
+		q.overflows.WithLabelValues("dropped").Add(float64(dropped))
+	}
+	logger.Warn().Str("user", userID).Int("dropped", dropped).Msg("too many payloads queued for user, resyncing user")
+	q.push(&queuedPayload{
+		chanName: chanName,
+		payload:  &V2ResyncUser{UserID: userID},
+	})
+}
+
+// push adds a payload to the end of the queue. Must be called with the lock held.
+func (q *QueuedNotifier) push(qp *queuedPayload) {
+	q.queue = append(q.queue, qp)
+	if qp.userID != "" {
+		q.userCount[qp.userID]++
+	}
+	if qp.coalesceKey != "" {
+		q.coalesce[qp.coalesceKey] = qp
+	}
+	if q.depth != nil {
+		q.depth.Set(float64(len(q.queue)))
+	}
+	q.cond.Signal()
+}
+
+// pop takes the first payload from the queue, blocking until there is one. Returns nil when the
+// notifier is closed.
+func (q *QueuedNotifier) pop() *queuedPayload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queue) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	if len(q.queue) >= q.maxQueued {
+		close(q.space)
+		q.space = make(chan struct{})
+	}
+	qp := q.queue[0]
+	q.queue[0] = nil
+	q.queue = q.queue[1:]
+	if qp.userID != "" {
+		q.userCount[qp.userID]--
+		if q.userCount[qp.userID] <= 0 {
+			delete(q.userCount, qp.userID)
+		}
+	}
+	if qp.coalesceKey != "" {
+		delete(q.coalesce, qp.coalesceKey)
+	}
+	if resync, ok := qp.payload.(*V2ResyncUser); ok {
+		// payloads queued from now on are sent after the resync, so must not be dropped
+		delete(q.resyncing, resync.UserID)
+	}
+	if q.depth != nil {
+		q.depth.Set(float64(len(q.queue)))
+	}
+	return qp
+}
+
+func (q *QueuedNotifier) run() {
+	defer close(q.done)
+	for {
+		qp := q.pop()
+		if qp == nil {
+			return
+		}
+		if err := q.Notifier.Notify(qp.chanName, qp.payload); err != nil {
+			logger.Err(err).Str("type", qp.payload.Type()).Msg("QueuedNotifier: failed to send payload")
+		}
+	}
+}
+
+func (q *QueuedNotifier) countOverflow(action string) {
+	if q.overflows != nil {
+		q.overflows.WithLabelValues(action).Inc()
+	}
+}
+
+// Close stops sending payloads, dropping any which are still queued, then closes the wrapped
+// notifier.
+func (q *QueuedNotifier) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	close(q.space)
+	q.mu.Unlock()
+	<-q.done
+	if q.depth != nil {
+		prometheus.Unregister(q.depth)
+		prometheus.Unregister(q.overflows)
+	}
+	return q.Notifier.Close()
+}
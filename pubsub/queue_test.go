@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// gatedNotifier records payloads, but blocks until it is opened so payloads pile up in a queue.
+type gatedNotifier struct {
+	entered  chan struct{}
+	gate     chan struct{}
+	received chan Payload
+}
+
+func newGatedNotifier() *gatedNotifier {
+	return &gatedNotifier{
+		entered:  make(chan struct{}, 1),
+		gate:     make(chan struct{}),
+		received: make(chan Payload, 100),
+	}
+}
+
+func (n *gatedNotifier) Notify(chanName string, p Payload) error {
+	select {
+	case n.entered <- struct{}{}:
+	default:
+	}
+	<-n.gate
+	n.received <- p
+	return nil
+}
+
+func (n *gatedNotifier) Close() error { return nil }
+
+func (n *gatedNotifier) waitFor(t *testing.T, count int) []Payload {
+	t.Helper()
+	var got []Payload
+	for len(got) < count {
+		select {
+		case p := <-n.received:
+			got = append(got, p)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d payloads, want %d", len(got), count)
+		}
+	}
+	select {
+	case p := <-n.received:
+		t.Fatalf("got unexpected payload %+v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return got
+}
+
+func TestQueuedNotifier(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	one, two, three := 1, 2, 3
+	testCases := []struct {
+		name     string
+		payloads []Payload
+		want     []Payload
+	}{
+		{
+			name: "unread counts for the same room are coalesced",
+			payloads: []Payload{
+				&V2UnreadCounts{UserID: alice, RoomID: "!a", HighlightCount: &one, NotificationCount: &one},
+				&V2UnreadCounts{UserID: alice, RoomID: "!b", NotificationCount: &three},
+				&V2UnreadCounts{UserID: alice, RoomID: "!a", NotificationCount: &two},
+			},
+			want: []Payload{
+				&V2UnreadCounts{UserID: alice, RoomID: "!a", HighlightCount: &one, NotificationCount: &two},
+				&V2UnreadCounts{UserID: alice, RoomID: "!b", NotificationCount: &three},
+			},
+		},
+		{
+			name: "overflowing user is resynced, other payloads are kept in order",
+			payloads: []Payload{
+				&V2AccountData{UserID: alice, Types: []string{"a"}},
+				&V2Accumulate{RoomID: "!a"},
+				&V2AccountData{UserID: bob, Types: []string{"b"}},
+				&V2AccountData{UserID: alice, Types: []string{"b"}},
+				&V2AccountData{UserID: alice, Types: []string{"c"}},
+				// dropped as the resync is queued
+				&V2AccountData{UserID: alice, Types: []string{"d"}},
+				&V2InviteRoom{UserID: alice, RoomID: "!b"},
+			},
+			want: []Payload{
+				&V2Accumulate{RoomID: "!a"},
+				&V2AccountData{UserID: bob, Types: []string{"b"}},
+				&V2ResyncUser{UserID: alice},
+				&V2InviteRoom{UserID: alice, RoomID: "!b"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		n := newGatedNotifier()
+		q := NewQueuedNotifier(n, 100, 2, false)
+		// block the queue on its first payload
+		blocker := &V2Initialise{RoomID: "!blocker"}
+		if err := q.Notify(ChanV2, blocker); err != nil {
+			t.Fatalf("%s: Notify: %s", tc.name, err)
+		}
+		<-n.entered
+		for _, p := range tc.payloads {
+			if err := q.Notify(ChanV2, p); err != nil {
+				t.Fatalf("%s: Notify: %s", tc.name, err)
+			}
+		}
+		close(n.gate)
+		got := n.waitFor(t, len(tc.want)+1)
+		if !reflect.DeepEqual(got[1:], tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got[1:], tc.want)
+		}
+		q.Close()
+	}
+}
+
+func TestQueuedNotifierSendsAfterResync(t *testing.T) {
+	n := newGatedNotifier()
+	q := NewQueuedNotifier(n, 100, 1, false)
+	alice := "@alice:localhost"
+	q.Notify(ChanV2, &V2Initialise{RoomID: "!blocker"})
+	<-n.entered
+	q.Notify(ChanV2, &V2AccountData{UserID: alice, Types: []string{"a"}})
+	q.Notify(ChanV2, &V2AccountData{UserID: alice, Types: []string{"b"}})
+	close(n.gate)
+	n.waitFor(t, 2)
+
+	// the resync has been sent, so new payloads for the user must be sent too
+	q.Notify(ChanV2, &V2AccountData{UserID: alice, Types: []string{"c"}})
+	got := n.waitFor(t, 1)
+	want := &V2AccountData{UserID: alice, Types: []string{"c"}}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %+v want %+v", got[0], want)
+	}
+	q.Close()
+}
+
+func TestQueuedNotifierBlocksWhenFull(t *testing.T) {
+	n := newGatedNotifier()
+	q := NewQueuedNotifier(n, 1, 10, false)
+	q.Notify(ChanV2, &V2Initialise{RoomID: "!blocker"})
+	<-n.entered
+	q.Notify(ChanV2, &V2Accumulate{RoomID: "!a"})
+	done := make(chan error)
+	go func() {
+		done <- q.Notify(ChanV2, &V2Accumulate{RoomID: "!b"})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Notify returned whilst the queue was full: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(n.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	n.waitFor(t, 3)
+	q.Close()
+}
@@ -0,0 +1,225 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisStreamMaxLen is roughly how many payloads are kept in each stream. Listeners which
+	// fall further behind than this lose payloads, so it should cover a few minutes of traffic.
+	redisStreamMaxLen = 100000
+	// redisReadCount is the most payloads read from a stream in one request.
+	redisReadCount = 100
+	// redisBlockTime is how long a listener waits for new payloads before asking again.
+	redisBlockTime = 5 * time.Second
+)
+
+// payloadTypes maps the Type() of every payload to its struct type, so payloads can be decoded
+// after being sent between processes.
+var payloadTypes = make(map[string]reflect.Type)
+
+func init() {
+	for _, p := range []Payload{
+		&V2Initialise{}, &V2Accumulate{}, &V2TransactionID{}, &V2UnreadCounts{}, &V2ThreadUnreadCounts{},
+		&V2AccountData{}, &V2LeaveRoom{}, &V2InviteRoom{}, &V2InitialSyncComplete{}, &V2DeviceData{},
+		&V2Typing{}, &V2Receipt{}, &V2Presence{}, &V2DeviceMessages{}, &V2ExpiredToken{},
+		&V2StateRedaction{}, &V2PollerStopped{}, &V2InvalidateRoom{}, &V2UpstreamStatus{},
+		&V2ResyncUser{}, &V2ForgetRoom{},
+		&V3EnsurePolling{}, &V3EphemeralDemand{},
+	} {
+		payloadTypes[p.Type()] = reflect.TypeOf(p).Elem()
+	}
+}
+
+// encodePayload serialises a payload so it can be sent to another process.
+func encodePayload(p Payload) ([]byte, error) {
+	if _, ok := payloadTypes[p.Type()]; !ok {
+		return nil, fmt.Errorf("cannot encode unknown payload type %s", p.Type())
+	}
+	return json.Marshal(p)
+}
+
+// decodePayload deserialises a payload encoded with encodePayload.
+func decodePayload(payloadType string, data []byte) (Payload, error) {
+	t, ok := payloadTypes[payloadType]
+	if !ok {
+		return nil, fmt.Errorf("cannot decode unknown payload type %s", payloadType)
+	}
+	p := reflect.New(t).Interface().(Payload)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to decode %s payload: %w", payloadType, err)
+	}
+	return p, nil
+}
+
+// RedisPubSub sends payloads between processes through Redis streams, so the pollers and the
+// sync API can run in separate processes on separate machines. Each channel is one stream, so
+// every listener sees the payloads of a channel in the order they were sent, which keeps the
+// updates to each room in order.
+//
+// Listeners get every payload sent after the RedisPubSub was created, so it should be created
+// before loading anything from the database which the payloads update.
+type RedisPubSub struct {
+	client    *redis.Client
+	keyPrefix string
+
+	// startIDs are the IDs of the last payload in each channel's stream when this was created.
+	startIDs map[string]string
+
+	// payloads are sent one at a time, so they are added in the order Notify was called
+	notifyMu sync.Mutex
+
+	// ctx is cancelled by Close
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// NewRedisPubSub connects to the Redis server at this address, which is either host:port or a
+// URL like redis://:password@host:port/db. Channels are stored in streams named with this prefix,
+// so several deployments can share a Redis server.
+func NewRedisPubSub(redisURL, keyPrefix string) (*RedisPubSub, error) {
+	opts, err := parseRedisURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &RedisPubSub{
+		client:    redis.NewClient(opts),
+		keyPrefix: keyPrefix,
+		startIDs:  make(map[string]string),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	for _, chanName := range []string{ChanV2, ChanV3} {
+		if ps.startIDs[chanName], err = ps.lastID(chanName); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// parseRedisURL parses a redis:// or rediss:// URL, or a host with an optional port.
+func parseRedisURL(redisURL string) (*redis.Options, error) {
+	if strings.Contains(redisURL, "://") {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis URL: %w", err)
+		}
+		return opts, nil
+	}
+	addr := redisURL
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "6379")
+	}
+	return &redis.Options{Addr: addr}, nil
+}
+
+func (ps *RedisPubSub) streamKey(chanName string) string {
+	return ps.keyPrefix + chanName
+}
+
+// lastID returns the ID of the last payload in the channel's stream, or 0-0 if it is empty.
+func (ps *RedisPubSub) lastID(chanName string) (string, error) {
+	msgs, err := ps.client.XRevRangeN(ps.ctx, ps.streamKey(chanName), "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the last payload of %s: %w", chanName, err)
+	}
+	if len(msgs) == 0 {
+		return "0-0", nil
+	}
+	return msgs[0].ID, nil
+}
+
+// Notify adds the payload to the channel's stream. Older payloads are trimmed so the stream
+// doesn't grow forever.
+func (ps *RedisPubSub) Notify(chanName string, p Payload) error {
+	data, err := encodePayload(p)
+	if err != nil {
+		return err
+	}
+	ps.notifyMu.Lock()
+	defer ps.notifyMu.Unlock()
+	err = ps.client.XAdd(ps.ctx, &redis.XAddArgs{
+		Stream: ps.streamKey(chanName),
+		MaxLen: redisStreamMaxLen,
+		Approx: true,
+		Values: []interface{}{"type", p.Type(), "payload", string(data)},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("notify with payload %v failed: %w", p.Type(), err)
+	}
+	return nil
+}
+
+// Listen calls fn with each payload in the channel's stream, in order, retrying if the
+// connection to Redis is lost. Blocks until Close is called.
+func (ps *RedisPubSub) Listen(chanName string, fn func(p Payload)) error {
+	lastID := ps.startIDs[chanName]
+	backoff := time.Second
+	for ps.ctx.Err() == nil {
+		var err error
+		if lastID == "" {
+			lastID, err = ps.lastID(chanName)
+		}
+		var streams []redis.XStream
+		if err == nil {
+			streams, err = ps.client.XRead(ps.ctx, &redis.XReadArgs{
+				Streams: []string{ps.streamKey(chanName), lastID},
+				Count:   redisReadCount,
+				Block:   redisBlockTime,
+			}).Result()
+		}
+		if errors.Is(err, redis.Nil) {
+			// no payloads were sent while blocking
+			continue
+		}
+		if err != nil {
+			if ps.ctx.Err() != nil {
+				break
+			}
+			logger.Warn().Err(err).Str("chan", chanName).Dur("retry_in", backoff).Msg("RedisPubSub: failed to read payloads")
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				lastID = msg.ID
+				payloadType, _ := msg.Values["type"].(string)
+				data, _ := msg.Values["payload"].(string)
+				p, err := decodePayload(payloadType, []byte(data))
+				if err != nil {
+					logger.Error().Err(err).Str("chan", chanName).Str("id", msg.ID).Msg("RedisPubSub: skipping payload")
+					continue
+				}
+				fn(p)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops all listeners and closes every connection.
+func (ps *RedisPubSub) Close() error {
+	var err error
+	ps.closeOnce.Do(func() {
+		ps.cancel()
+		err = ps.client.Close()
+	})
+	return err
+}
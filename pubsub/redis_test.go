@@ -0,0 +1,140 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestRedisPubSub(t *testing.T) {
+	server := miniredis.RunT(t)
+	pub, err := NewRedisPubSub(server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisPubSub: %s", err)
+	}
+	defer pub.Close()
+	// sent before the listener was created, so it should not be received
+	if err = pub.Notify(ChanV2, &V2Initialise{RoomID: "!old:localhost"}); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	sub, err := NewRedisPubSub("redis://"+server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisPubSub: %s", err)
+	}
+	received := make(chan Payload, 10)
+	done := make(chan error)
+	go func() {
+		done <- sub.Listen(ChanV2, func(p Payload) { received <- p })
+	}()
+
+	count := 5
+	want := []Payload{
+		&V2Accumulate{RoomID: "!a:localhost", PrevBatch: "pb", EventNIDs: []int64{1, 2, 3}},
+		&V2UnreadCounts{UserID: "@alice:localhost", RoomID: "!a:localhost", NotificationCount: &count},
+		&V2LeaveRoom{UserID: "@alice:localhost", RoomID: "!a:localhost", LeaveEvent: json.RawMessage(`{"type":"m.room.member"}`)},
+		&V2Receipt{RoomID: "!a:localhost", Receipts: []internal.Receipt{{RoomID: "!a:localhost", EventID: "$a", UserID: "@alice:localhost", TS: 123}}},
+	}
+	for _, p := range want {
+		if err = pub.Notify(ChanV2, p); err != nil {
+			t.Fatalf("Notify: %s", err)
+		}
+	}
+	// other channels are separate streams
+	if err = pub.Notify(ChanV3, &V3EnsurePolling{UserID: "@alice:localhost"}); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	for i := range want {
+		select {
+		case got := <-received:
+			if !reflect.DeepEqual(got, want[i]) {
+				t.Errorf("payload %d: got %+v want %+v", i, got, want[i])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for payload %d", i)
+		}
+	}
+
+	sub.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Listen returned an error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Listen did not return after Close")
+	}
+	select {
+	case p := <-received:
+		t.Errorf("received unexpected payload %+v", p)
+	default:
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	testCases := []struct {
+		url      string
+		wantAddr string
+		wantDB   int
+		wantErr  bool
+	}{
+		{url: "redis", wantAddr: "redis:6379"},
+		{url: "redis:6380", wantAddr: "redis:6380"},
+		{url: "redis://:secret@redis:6380/2", wantAddr: "redis:6380", wantDB: 2},
+		{url: "http://redis:6379", wantErr: true},
+	}
+	for _, tc := range testCases {
+		opts, err := parseRedisURL(tc.url)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got no error", tc.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.url, err)
+			continue
+		}
+		if opts.Addr != tc.wantAddr || opts.DB != tc.wantDB {
+			t.Errorf("%s: got addr %s db %d want %s %d", tc.url, opts.Addr, opts.DB, tc.wantAddr, tc.wantDB)
+		}
+	}
+}
+
+func TestPayloadEncoding(t *testing.T) {
+	// every payload sent to a listener must be decodable
+	for _, listener := range []reflect.Type{reflect.TypeOf((*V2Listener)(nil)).Elem(), reflect.TypeOf((*V3Listener)(nil)).Elem()} {
+		for i := 0; i < listener.NumMethod(); i++ {
+			payloadType := listener.Method(i).Type.In(0).Elem()
+			if payloadTypes[payloadType.Name()] != payloadType {
+				t.Errorf("%s is not registered in payloadTypes", payloadType.Name())
+			}
+		}
+	}
+	p := &V2ThreadUnreadCounts{
+		UserID:  "@alice:localhost",
+		RoomID:  "!a:localhost",
+		Threads: map[string]internal.ThreadUnreadCounts{"$thread": {NotificationCount: 2, HighlightCount: 1}},
+	}
+	data, err := encodePayload(p)
+	if err != nil {
+		t.Fatalf("encodePayload: %s", err)
+	}
+	got, err := decodePayload(p.Type(), data)
+	if err != nil {
+		t.Fatalf("decodePayload: %s", err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("decodePayload: got %+v want %+v", got, p)
+	}
+	if _, err = encodePayload(&emptyPayload{}); err == nil {
+		t.Errorf("encodePayload: encoded an unknown payload type")
+	}
+	if _, err = decodePayload("V2Unknown", data); err == nil {
+		t.Errorf("decodePayload: decoded an unknown payload type")
+	}
+}
@@ -17,15 +17,21 @@ type V2Listener interface {
 	OnAccountData(p *V2AccountData)
 	OnInvite(p *V2InviteRoom)
 	OnLeftRoom(p *V2LeaveRoom)
+	OnForgetRoom(p *V2ForgetRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
+	OnThreadUnreadCounts(p *V2ThreadUnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
 	OnReceipt(p *V2Receipt)
+	OnPresence(p *V2Presence)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
+	OnPollerStopped(p *V2PollerStopped)
 	OnInvalidateRoom(p *V2InvalidateRoom)
 	OnStateRedaction(p *V2StateRedaction)
+	OnUpstreamStatus(p *V2UpstreamStatus)
+	OnResyncUser(p *V2ResyncUser)
 }
 
 type V2Initialise struct {
@@ -65,7 +71,36 @@ type V2UnreadCounts struct {
 	UnreadCount       *int
 }
 
-func (*V2UnreadCounts) Type() string { return "V2UnreadCounts" }
+func (*V2UnreadCounts) Type() string          { return "V2UnreadCounts" }
+func (p *V2UnreadCounts) QueueUserID() string { return p.UserID }
+func (p *V2UnreadCounts) CoalesceKey() string { return p.UserID + " " + p.RoomID }
+
+// Coalesce keeps the counts of the older payload which this payload does not change.
+func (p *V2UnreadCounts) Coalesce(older Payload) {
+	o := older.(*V2UnreadCounts)
+	if p.HighlightCount == nil {
+		p.HighlightCount = o.HighlightCount
+	}
+	if p.NotificationCount == nil {
+		p.NotificationCount = o.NotificationCount
+	}
+	if p.UnreadCount == nil {
+		p.UnreadCount = o.UnreadCount
+	}
+}
+
+// V2ThreadUnreadCounts is emitted when the per-thread unread counts of a room change for a user.
+// Threads contains every thread with unread notifications; other threads have none.
+type V2ThreadUnreadCounts struct {
+	UserID  string
+	RoomID  string
+	Threads map[string]internal.ThreadUnreadCounts
+}
+
+func (*V2ThreadUnreadCounts) Type() string             { return "V2ThreadUnreadCounts" }
+func (p *V2ThreadUnreadCounts) QueueUserID() string    { return p.UserID }
+func (p *V2ThreadUnreadCounts) CoalesceKey() string    { return p.UserID + " " + p.RoomID }
+func (p *V2ThreadUnreadCounts) Coalesce(older Payload) {}
 
 type V2AccountData struct {
 	UserID string
@@ -73,7 +108,8 @@ type V2AccountData struct {
 	Types  []string
 }
 
-func (*V2AccountData) Type() string { return "V2AccountData" }
+func (*V2AccountData) Type() string          { return "V2AccountData" }
+func (p *V2AccountData) QueueUserID() string { return p.UserID }
 
 type V2LeaveRoom struct {
 	UserID     string
@@ -83,6 +119,15 @@ type V2LeaveRoom struct {
 
 func (*V2LeaveRoom) Type() string { return "V2LeaveRoom" }
 
+// V2ForgetRoom is emitted when a user forgets a room, so consumers must drop what they hold about
+// the user in the room.
+type V2ForgetRoom struct {
+	UserID string
+	RoomID string
+}
+
+func (*V2ForgetRoom) Type() string { return "V2ForgetRoom" }
+
 type V2InviteRoom struct {
 	UserID string
 	RoomID string
@@ -109,7 +154,9 @@ type V2Typing struct {
 	EphemeralEvent json.RawMessage
 }
 
-func (*V2Typing) Type() string { return "V2Typing" }
+func (*V2Typing) Type() string             { return "V2Typing" }
+func (p *V2Typing) CoalesceKey() string    { return p.RoomID }
+func (p *V2Typing) Coalesce(older Payload) {}
 
 type V2Receipt struct {
 	RoomID   string
@@ -118,12 +165,21 @@ type V2Receipt struct {
 
 func (*V2Receipt) Type() string { return "V2Receipt" }
 
+type V2Presence struct {
+	Presence []internal.Presence
+}
+
+func (*V2Presence) Type() string { return "V2Presence" }
+
 type V2DeviceMessages struct {
 	UserID   string
 	DeviceID string
 }
 
-func (*V2DeviceMessages) Type() string { return "V2DeviceMessages" }
+func (*V2DeviceMessages) Type() string             { return "V2DeviceMessages" }
+func (p *V2DeviceMessages) QueueUserID() string    { return p.UserID }
+func (p *V2DeviceMessages) CoalesceKey() string    { return p.UserID + " " + p.DeviceID }
+func (p *V2DeviceMessages) Coalesce(older Payload) {}
 
 type V2ExpiredToken struct {
 	UserID   string
@@ -141,6 +197,15 @@ type V2StateRedaction struct {
 
 func (*V2StateRedaction) Type() string { return "V2StateRedaction" }
 
+// V2PollerStopped is sent when a poller is stopped by an admin, so the next request from the
+// device starts a new poller.
+type V2PollerStopped struct {
+	UserID   string
+	DeviceID string
+}
+
+func (*V2PollerStopped) Type() string { return "V2PollerStopped" }
+
 // V2InvalidateRoom is emitted after a non-incremental state change to a room, in place
 // of a V2Initialise payload.
 type V2InvalidateRoom struct {
@@ -149,6 +214,25 @@ type V2InvalidateRoom struct {
 
 func (*V2InvalidateRoom) Type() string { return "V2InvalidateRoom" }
 
+// V2UpstreamStatus is emitted when the pollers' circuit breaker for a homeserver trips or closes.
+type V2UpstreamStatus struct {
+	// ServerName is the server name of the homeserver's users.
+	ServerName string
+	// UnavailableSince is the unix timestamp in milliseconds when the upstream homeserver became
+	// unavailable, or 0 if it is available.
+	UnavailableSince int64
+}
+
+func (*V2UpstreamStatus) Type() string { return "V2UpstreamStatus" }
+
+// V2ResyncUser is emitted by a QueuedNotifier in place of a user's queued payloads when too many
+// were queued for the user. Consumers must reload everything they hold about the user.
+type V2ResyncUser struct {
+	UserID string
+}
+
+func (*V2ResyncUser) Type() string { return "V2ResyncUser" }
+
 type V2Sub struct {
 	listener Listener
 	receiver V2Listener
@@ -169,6 +253,8 @@ func (v *V2Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V2Receipt:
 		v.receiver.OnReceipt(pl)
+	case *V2Presence:
+		v.receiver.OnPresence(pl)
 	case *V2Initialise:
 		v.receiver.Initialise(pl)
 	case *V2Accumulate:
@@ -181,8 +267,12 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnInvite(pl)
 	case *V2LeaveRoom:
 		v.receiver.OnLeftRoom(pl)
+	case *V2ForgetRoom:
+		v.receiver.OnForgetRoom(pl)
 	case *V2UnreadCounts:
 		v.receiver.OnUnreadCounts(pl)
+	case *V2ThreadUnreadCounts:
+		v.receiver.OnThreadUnreadCounts(pl)
 	case *V2InitialSyncComplete:
 		v.receiver.OnInitialSyncComplete(pl)
 	case *V2DeviceData:
@@ -193,10 +283,16 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
 		v.receiver.OnExpiredToken(pl)
+	case *V2PollerStopped:
+		v.receiver.OnPollerStopped(pl)
 	case *V2InvalidateRoom:
 		v.receiver.OnInvalidateRoom(pl)
 	case *V2StateRedaction:
 		v.receiver.OnStateRedaction(pl)
+	case *V2UpstreamStatus:
+		v.receiver.OnUpstreamStatus(pl)
+	case *V2ResyncUser:
+		v.receiver.OnResyncUser(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V2Sub: unhandled payload type")
 	}
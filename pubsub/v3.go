@@ -6,6 +6,7 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	OnEphemeralDemand(p *V3EphemeralDemand)
 }
 
 type V3EnsurePolling struct {
@@ -18,6 +19,16 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3EphemeralDemand is sent when the first connection for a device enables the typing or receipts
+// extensions, or the last connection which had them enabled disables them or goes away.
+type V3EphemeralDemand struct {
+	UserID   string
+	DeviceID string
+	Wanted   bool
+}
+
+func (*V3EphemeralDemand) Type() string { return "V3EphemeralDemand" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -38,6 +49,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3EphemeralDemand:
+		v.receiver.OnEphemeralDemand(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
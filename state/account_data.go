@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -16,28 +17,103 @@ type AccountData struct {
 	RoomID string `db:"room_id"`
 	Type   string `db:"type"`
 	Data   []byte `db:"data"`
+	// Version counts the changes to this user's account data of this type in this room, starting
+	// at 1. Unlike ID, it is only meaningful for comparing data with the same key.
+	Version int64 `db:"version"`
+}
+
+// AccountDataFilter restricts account data to some types. Types and NotTypes may contain * which
+// matches any characters. Every type is included if Types is empty, and NotTypes take priority.
+type AccountDataFilter struct {
+	Types    []string
+	NotTypes []string
+}
+
+// Include returns true if account data of this type passes the filter. A nil filter includes
+// every type.
+func (f *AccountDataFilter) Include(evType string) bool {
+	if f == nil {
+		return true
+	}
+	for _, notType := range f.NotTypes {
+		if globMatches(notType, evType) {
+			return false
+		}
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if globMatches(t, evType) {
+			return true
+		}
+	}
+	return false
+}
+
+// likePatterns returns Types and NotTypes as SQL LIKE patterns. Never returns NULL arrays.
+func (f *AccountDataFilter) likePatterns() (types, notTypes pq.StringArray) {
+	types, notTypes = pq.StringArray{}, pq.StringArray{}
+	if f == nil {
+		return
+	}
+	for _, t := range f.Types {
+		types = append(types, globToLike(t))
+	}
+	for _, t := range f.NotTypes {
+		notTypes = append(notTypes, globToLike(t))
+	}
+	return
+}
+
+// globToLike converts a glob where * matches any characters to a LIKE pattern.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '\\', '%', '_':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '*':
+			b.WriteByte('%')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// globMatches returns true if s matches the glob, where * matches any characters.
+func globMatches(glob, s string) bool {
+	parts := strings.Split(glob, "*")
+	if len(parts) == 1 {
+		return glob == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
 }
 
 // AccountDataTable stores the account data for users.
 type AccountDataTable struct{}
 
 func NewAccountDataTable(db *sqlx.DB) *AccountDataTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_account_data_seq;
-	CREATE TABLE IF NOT EXISTS syncv3_account_data (
-		id BIGINT NOT NULL DEFAULT nextval('syncv3_account_data_seq'),
-		user_id TEXT NOT NULL,
-		room_id TEXT NOT NULL, -- optional if global
-		type TEXT NOT NULL,
-		data BYTEA NOT NULL,
-		UNIQUE(user_id, room_id, type)
-	);
-	`)
 	return &AccountDataTable{}
 }
 
-// Insert account data.
+// Insert account data. Each change gives the data a new ID from a sequence, so IDs order changes to
+// all account data, and increments its version. Writing the same data again is not a change, so
+// pollers for several of a user's devices seeing the same account data do not make new versions.
 func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]AccountData, error) {
 	// fold duplicates into one as we A: don't care about historical data, B: cannot use EXCLUDED if the
 	// accDatas list has the same unique key twice in the same transaction.
@@ -57,7 +133,9 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
 		INSERT INTO syncv3_account_data (user_id, room_id, type, data)
-        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id=nextval('syncv3_account_data_seq')`, chunk)
+        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id=nextval('syncv3_account_data_seq'),
+			version = syncv3_account_data.version + 1
+		WHERE syncv3_account_data.data != EXCLUDED.data`, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -66,25 +144,67 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 }
 
 func (t *AccountDataTable) Select(txn *sqlx.Tx, userID string, eventTypes []string, roomID string) (datas []AccountData, err error) {
-	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data, version FROM syncv3_account_data
 	WHERE user_id=$1 AND type=ANY($2) AND room_id=$3`, userID, pq.StringArray(eventTypes), roomID)
 	return
 }
 
 func (t *AccountDataTable) SelectWithType(txn *sqlx.Tx, userID, evType string) (datas []AccountData, err error) {
-	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data, version FROM syncv3_account_data
 	WHERE user_id=$1 AND type=$2 AND room_id != ''`, userID, evType)
 	return
 }
 
-func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...string) (datas []AccountData, err error) {
+// SelectMany returns the user's global account data if roomIDs is empty, else their account data
+// in these rooms. Only types which pass the filter are returned, which may be nil.
+func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, filter *AccountDataFilter, roomIDs ...string) (datas []AccountData, err error) {
+	types, notTypes := filter.likePatterns()
 	if len(roomIDs) == 0 {
-		err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-		WHERE user_id=$1 AND room_id = $2`, userID, AccountDataGlobalRoom)
-		return
+		roomIDs = []string{AccountDataGlobalRoom}
 	}
-	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND room_id=ANY($2)`, userID, pq.StringArray(roomIDs))
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data, version FROM syncv3_account_data
+	WHERE user_id=$1 AND room_id=ANY($2) AND (cardinality($3::text[]) = 0 OR type LIKE ANY($3)) AND NOT (type LIKE ANY($4))`,
+		userID, pq.StringArray(roomIDs), types, notTypes)
+	return
+}
+
+// SelectChangedSince returns the user's account data which has changed since the account data with
+// ID `since` was stored, in the order it changed. Like SelectMany, this is global account data if
+// roomIDs is empty, else account data in these rooms, and only types which pass the filter.
+func (t *AccountDataTable) SelectChangedSince(txn *sqlx.Tx, userID string, filter *AccountDataFilter, since int64, roomIDs ...string) (datas []AccountData, err error) {
+	types, notTypes := filter.likePatterns()
+	if len(roomIDs) == 0 {
+		roomIDs = []string{AccountDataGlobalRoom}
+	}
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data, version FROM syncv3_account_data
+	WHERE user_id=$1 AND id > $2 AND room_id=ANY($3) AND (cardinality($4::text[]) = 0 OR type LIKE ANY($4)) AND NOT (type LIKE ANY($5))
+	ORDER BY id`,
+		userID, since, pq.StringArray(roomIDs), types, notTypes)
+	return
+}
+
+// AccountDataUsage is the amount of account data stored for a user.
+type AccountDataUsage struct {
+	UserID    string `db:"user_id" json:"user_id"`
+	Bytes     int64  `db:"bytes" json:"bytes"`
+	NumEvents int64  `db:"num_events" json:"num_events"`
+}
+
+// SelectSizeForUser returns the total size in bytes of the user's account data, excluding the
+// given types in the given room e.g because they are about to be replaced.
+func (t *AccountDataTable) SelectSizeForUser(txn *sqlx.Tx, userID, roomID string, excludeTypes []string) (size int64, err error) {
+	if excludeTypes == nil {
+		excludeTypes = []string{} // a NULL array would exclude the whole room
+	}
+	err = txn.QueryRow(`SELECT COALESCE(SUM(octet_length(data)), 0) FROM syncv3_account_data
+	WHERE user_id=$1 AND NOT (room_id=$2 AND type=ANY($3))`, userID, roomID, pq.StringArray(excludeTypes)).Scan(&size)
+	return
+}
+
+// SelectLargestUsers returns the `limit` users with the most account data, largest first.
+func (t *AccountDataTable) SelectLargestUsers(txn *sqlx.Tx, limit int) (usages []AccountDataUsage, err error) {
+	err = txn.Select(&usages, `SELECT user_id, SUM(octet_length(data)) AS bytes, COUNT(*) AS num_events
+	FROM syncv3_account_data GROUP BY user_id ORDER BY bytes DESC, user_id LIMIT $1`, limit)
 	return
 }
 
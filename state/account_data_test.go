@@ -2,6 +2,7 @@ package state
 
 import (
 	"bytes"
+	"reflect"
 	"sort"
 	"testing"
 
@@ -38,6 +39,9 @@ func assertAccountDatasEqual(t *testing.T, msg string, gots, wants []AccountData
 		if wants[i].ID > 0 && gots[i].ID != wants[i].ID {
 			t.Errorf("%s[%d]: got id %v want %v", msg, i, gots[i].ID, wants[i].ID)
 		}
+		if wants[i].Version > 0 && gots[i].Version != wants[i].Version {
+			t.Errorf("%s[%d]: got version %v want %v", msg, i, gots[i].Version, wants[i].Version)
+		}
 	}
 }
 
@@ -124,7 +128,7 @@ func TestAccountData(t *testing.T) {
 	wantDatas := []AccountData{
 		accountData[4], accountData[5],
 	}
-	gotDatas, err := table.SelectMany(txn, alice)
+	gotDatas, err := table.SelectMany(txn, alice, nil)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -134,14 +138,14 @@ func TestAccountData(t *testing.T) {
 	wantDatas = []AccountData{
 		accountData[6],
 	}
-	gotDatas, err = table.SelectMany(txn, alice, roomA)
+	gotDatas, err = table.SelectMany(txn, alice, nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
 	assertAccountDatasEqual(t, "SelectMany", gotDatas, wantDatas)
 
 	// Select all room events for unknown user
-	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", roomA)
+	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -171,6 +175,121 @@ func TestAccountData(t *testing.T) {
 
 }
 
+func TestAccountDataSelectManyFiltered(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	alice := "@alice_TestAccountDataSelectManyFiltered:localhost"
+	roomA := "!TestAccountDataSelectManyFiltered_A:localhost"
+	table := NewAccountDataTable(db)
+	var accountData []AccountData
+	for _, evType := range []string{"m.direct", "m.push_rules", "im.vector.setting.breadcrumbs", "im.vector.web.settings", "my_app%data"} {
+		accountData = append(accountData, AccountData{
+			UserID: alice,
+			RoomID: AccountDataGlobalRoom,
+			Type:   evType,
+			Data:   []byte(`{"type":"` + evType + `"}`),
+		})
+	}
+	accountData = append(accountData, AccountData{
+		UserID: alice,
+		RoomID: roomA,
+		Type:   "m.fully_read",
+		Data:   []byte(`{"type":"m.fully_read"}`),
+	})
+	_, err = table.Insert(txn, accountData)
+	assertNoError(t, err)
+
+	testCases := []struct {
+		name    string
+		filter  *AccountDataFilter
+		roomIDs []string
+		want    []string
+	}{
+		{
+			name: "nil filter",
+			want: []string{"m.direct", "m.push_rules", "im.vector.setting.breadcrumbs", "im.vector.web.settings", "my_app%data"},
+		},
+		{
+			name:   "exact types",
+			filter: &AccountDataFilter{Types: []string{"m.direct", "m.push_rules"}},
+			want:   []string{"m.direct", "m.push_rules"},
+		},
+		{
+			name:   "wildcard",
+			filter: &AccountDataFilter{Types: []string{"m.*"}},
+			want:   []string{"m.direct", "m.push_rules"},
+		},
+		{
+			name:   "not types",
+			filter: &AccountDataFilter{NotTypes: []string{"im.vector.*"}},
+			want:   []string{"m.direct", "m.push_rules", "my_app%data"},
+		},
+		{
+			name:   "not types take priority",
+			filter: &AccountDataFilter{Types: []string{"*"}, NotTypes: []string{"m.push_rules"}},
+			want:   []string{"m.direct", "im.vector.setting.breadcrumbs", "im.vector.web.settings", "my_app%data"},
+		},
+		{
+			name:   "LIKE characters are literal",
+			filter: &AccountDataFilter{Types: []string{"my_app%data", "m_direct"}},
+			want:   []string{"my_app%data"},
+		},
+		{
+			name:    "rooms",
+			filter:  &AccountDataFilter{Types: []string{"m.fully_read"}},
+			roomIDs: []string{roomA},
+			want:    []string{"m.fully_read"},
+		},
+	}
+	for _, tc := range testCases {
+		gotDatas, err := table.SelectMany(txn, alice, tc.filter, tc.roomIDs...)
+		if err != nil {
+			t.Fatalf("%s: SelectMany: %s", tc.name, err)
+		}
+		got := make([]string, 0, len(gotDatas))
+		for _, ad := range gotDatas {
+			got = append(got, ad.Type)
+		}
+		sort.Strings(got)
+		want := append([]string{}, tc.want...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: SelectMany: got types %v want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestAccountDataFilterInclude(t *testing.T) {
+	testCases := []struct {
+		filter *AccountDataFilter
+		evType string
+		want   bool
+	}{
+		{filter: nil, evType: "m.direct", want: true},
+		{filter: &AccountDataFilter{}, evType: "m.direct", want: true},
+		{filter: &AccountDataFilter{Types: []string{"m.direct"}}, evType: "m.direct", want: true},
+		{filter: &AccountDataFilter{Types: []string{"m.direct"}}, evType: "m.direct2", want: false},
+		{filter: &AccountDataFilter{Types: []string{"m.*"}}, evType: "m.push_rules", want: true},
+		{filter: &AccountDataFilter{Types: []string{"m.*"}}, evType: "im.vector.setting", want: false},
+		{filter: &AccountDataFilter{Types: []string{"*.setting.*"}}, evType: "im.vector.setting.breadcrumbs", want: true},
+		{filter: &AccountDataFilter{Types: []string{"a*a"}}, evType: "a", want: false},
+		{filter: &AccountDataFilter{Types: []string{"a*a"}}, evType: "aa", want: true},
+		{filter: &AccountDataFilter{NotTypes: []string{"im.*"}}, evType: "im.vector.setting", want: false},
+		{filter: &AccountDataFilter{NotTypes: []string{"im.*"}}, evType: "m.direct", want: true},
+		{filter: &AccountDataFilter{Types: []string{"*"}, NotTypes: []string{"m.direct"}}, evType: "m.direct", want: false},
+	}
+	for _, tc := range testCases {
+		if got := tc.filter.Include(tc.evType); got != tc.want {
+			t.Errorf("%+v Include(%s): got %v want %v", tc.filter, tc.evType, got, tc.want)
+		}
+	}
+}
+
 func TestAccountDataIDIncrements(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -204,7 +323,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	gots, err = table.Select(txn, alice, []string{eventType}, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	// now replace the data, which should update the id
@@ -220,10 +339,126 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	}
 	data.ID = gots[0].ID
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	gots, err = table.SelectWithType(txn, alice, eventType)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectWithType", gots, []AccountData{data})
 }
+
+func TestAccountDataSelectChangedSince(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	alice := "@alice_TestAccountDataSelectChangedSince:localhost"
+	roomA := "!TestAccountDataSelectChangedSince_A:localhost"
+	table := NewAccountDataTable(db)
+	direct := AccountData{UserID: alice, RoomID: sync2.AccountDataGlobalRoom, Type: "m.direct", Data: []byte(`{"a":1}`)}
+	push := AccountData{UserID: alice, RoomID: sync2.AccountDataGlobalRoom, Type: "m.push_rules", Data: []byte(`{"b":1}`)}
+	tag := AccountData{UserID: alice, RoomID: roomA, Type: "m.tag", Data: []byte(`{"c":1}`)}
+	_, err = table.Insert(txn, []AccountData{direct, push, tag})
+	assertNoError(t, err)
+	gots, err := table.SelectMany(txn, alice, nil)
+	assertNoError(t, err)
+	var since int64
+	for _, got := range gots {
+		if got.ID > since {
+			since = got.ID
+		}
+	}
+	direct.Version = 1
+	push.Version = 1
+	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{direct, push})
+
+	// writing the same data again is not a change
+	_, err = table.Insert(txn, []AccountData{direct})
+	assertNoError(t, err)
+	gots, err = table.SelectChangedSince(txn, alice, nil, since)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectChangedSince after no change", gots, nil)
+
+	direct.Data = []byte(`{"a":2}`)
+	tag.Data = []byte(`{"c":2}`)
+	_, err = table.Insert(txn, []AccountData{direct, tag})
+	assertNoError(t, err)
+	direct.Version = 2
+	gots, err = table.SelectChangedSince(txn, alice, nil, since)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectChangedSince global", gots, []AccountData{direct})
+	tag.Version = 2
+	gots, err = table.SelectChangedSince(txn, alice, nil, since, roomA)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectChangedSince room", gots, []AccountData{tag})
+	gots, err = table.SelectChangedSince(txn, alice, &AccountDataFilter{NotTypes: []string{"m.direct"}}, since)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectChangedSince filtered", gots, nil)
+}
+
+func TestAccountDataSizes(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	alice := "@alice_TestAccountDataSizes:localhost"
+	bob := "@bob_TestAccountDataSizes:localhost"
+	roomA := "!TestAccountDataSizes_A:localhost"
+	table := NewAccountDataTable(db)
+	_, err = table.Insert(txn, []AccountData{
+		{UserID: alice, RoomID: sync2.AccountDataGlobalRoom, Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)},                              // 19 bytes
+		{UserID: alice, RoomID: roomA, Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)},                                                          // 16 bytes
+		{UserID: bob, RoomID: sync2.AccountDataGlobalRoom, Type: "com.example.bridge", Data: []byte(`{"type":"com.example.bridge","a":"bbbb"}`)}, // 39 bytes
+	})
+	assertNoError(t, err)
+
+	size, err := table.SelectSizeForUser(txn, alice, roomA, nil)
+	assertNoError(t, err)
+	if size != 35 {
+		t.Errorf("SelectSizeForUser: got %d want 35", size)
+	}
+	// replacing m.tag in room A shouldn't count the existing m.tag
+	size, err = table.SelectSizeForUser(txn, alice, roomA, []string{"m.tag"})
+	assertNoError(t, err)
+	if size != 19 {
+		t.Errorf("SelectSizeForUser(excluding m.tag): got %d want 19", size)
+	}
+	// but m.tag in another room doesn't replace anything
+	size, err = table.SelectSizeForUser(txn, alice, sync2.AccountDataGlobalRoom, []string{"m.tag"})
+	assertNoError(t, err)
+	if size != 35 {
+		t.Errorf("SelectSizeForUser(other room): got %d want 35", size)
+	}
+	size, err = table.SelectSizeForUser(txn, "@unknown_TestAccountDataSizes:localhost", roomA, nil)
+	assertNoError(t, err)
+	if size != 0 {
+		t.Errorf("SelectSizeForUser(unknown user): got %d want 0", size)
+	}
+
+	usages, err := table.SelectLargestUsers(txn, 1000)
+	assertNoError(t, err)
+	var gotBob, gotAlice *AccountDataUsage
+	for i := range usages {
+		switch usages[i].UserID {
+		case alice:
+			gotAlice = &usages[i]
+		case bob:
+			gotBob = &usages[i]
+			if gotAlice != nil {
+				t.Errorf("SelectLargestUsers: alice was returned before bob")
+			}
+		}
+	}
+	if gotAlice == nil || gotAlice.Bytes != 35 || gotAlice.NumEvents != 2 {
+		t.Errorf("SelectLargestUsers: got alice %+v want 35 bytes in 2 events", gotAlice)
+	}
+	if gotBob == nil || gotBob.Bytes != 39 || gotBob.NumEvents != 1 {
+		t.Errorf("SelectLargestUsers: got bob %+v want 39 bytes in 1 event", gotBob)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
@@ -30,6 +31,11 @@ type Accumulator struct {
 	spacesTable   *SpacesTable
 	invitesTable  *InvitesTable
 	entityName    string
+	metrics       *AccumulatorMetrics
+	// strictValidation rejects events without the fields every event should have, and quarantines
+	// rejected events in malformedTable rather than only logging them.
+	strictValidation bool
+	malformedTable   *MalformedEventsTable
 }
 
 func NewAccumulator(db *sqlx.DB) *Accumulator {
@@ -53,6 +59,27 @@ func (a *Accumulator) strippedEventsForSnapshot(txn *sqlx.Tx, snapID int64) (Str
 	return a.eventsTable.SelectStrippedEventsByNIDs(txn, true, append(snapshot.MembershipEvents, snapshot.OtherEvents...))
 }
 
+// leftEncryptedRoom returns the user who left the room if `ev` is a leave or ban of a joined user
+// in an encrypted room, given the stripped state of the room before `ev`. Else returns "".
+func leftEncryptedRoom(before StrippedEvents, ev Event) string {
+	if ev.Type != "m.room.member" || (ev.Membership != "leave" && ev.Membership != "ban") {
+		return ""
+	}
+	encrypted, wasJoined := false, false
+	for _, e := range before {
+		switch {
+		case e.Type == "m.room.encryption" && e.StateKey == "":
+			encrypted = true
+		case e.Type == "m.room.member" && e.StateKey == ev.StateKey:
+			wasJoined = e.Membership == "join" || e.Membership == "_join"
+		}
+	}
+	if !encrypted || !wasJoined {
+		return ""
+	}
+	return ev.StateKey
+}
+
 // calculateNewSnapshot works out the new snapshot by combining an old snapshot and a new state event. Events get replaced
 // if the tuple of event type/state_key match. A new slice is returned (the inputs are not modified) along with the NID
 // that got replaced.
@@ -182,6 +209,7 @@ type InitialiseResult struct {
 func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
 	var res InitialiseResult
 	var startingSnapshotID int64
+	var numNew int
 
 	// 0. Ensure the state block is not empty.
 	if len(state) == 0 {
@@ -205,7 +233,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 				IsState: true,
 			}
 		}
-		events = filterAndEnsureFieldsSet(events)
+		events = a.filterEvents(roomID, "state", events)
 		if len(events) == 0 {
 			return fmt.Errorf("failed to parse state block, all events were filtered out: %w", err)
 		}
@@ -245,6 +273,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 				newEvents = append(newEvents, event)
 			}
 		}
+		numNew = len(newEvents)
 
 		// 3. Fetch the current state of the room.
 		var currentState stateMap
@@ -317,6 +346,9 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		res.ReplacedExistingSnapshot = startingSnapshotID > 0
 		return nil
 	})
+	if err == nil && res.AddedEvents {
+		a.metrics.accumulated("state", numNew, 1, res.ReplacedExistingSnapshot)
+	}
 	return res, err
 }
 
@@ -330,6 +362,14 @@ type AccumulateResult struct {
 	// IncludesStateRedaction is set to true when we have accumulated a redaction to a
 	// piece of room state.
 	IncludesStateRedaction bool
+	// LeftEncryptedRoom is the users who were joined to this encrypted room and have now left
+	// or been banned from it, in timeline order.
+	LeftEncryptedRoom []string
+	// numSnapshots is the number of state snapshots created, for metrics. They are only
+	// recorded once the transaction commits.
+	numSnapshots int
+	// replacedSnapshot is true if the room had a current snapshot which was replaced.
+	replacedSnapshot bool
 }
 
 // Accumulate internal state from a user's sync response. The timeline order MUST be in the order
@@ -349,7 +389,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	// - there to be no duplicate events
 	// - if there are new events, they are always new.
 	// Both of these assumptions can be false for different reasons
-	incomingEvents := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	incomingEvents := a.parseAndDeduplicateTimelineEvents(roomID, timeline)
 	newEvents, err := a.filterToNewTimelineEvents(txn, incomingEvents)
 	if err != nil {
 		err = fmt.Errorf("filterTimelineEvents: %w", err)
@@ -508,10 +548,15 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 					return AccumulateResult{}, fmt.Errorf("failed to load stripped state events for snapshot %d: %s", snapID, err)
 				}
 			}
+			start := time.Now()
+			if leftUserID := leftEncryptedRoom(oldStripped, ev); leftUserID != "" {
+				result.LeftEncryptedRoom = append(result.LeftEncryptedRoom, leftUserID)
+			}
 			newStripped, replacedNID, err := a.calculateNewSnapshot(oldStripped, ev)
 			if err != nil {
 				return AccumulateResult{}, fmt.Errorf("failed to calculateNewSnapshot: %s", err)
 			}
+			a.metrics.observeSnapshotDuration(start)
 			replacesNID = replacedNID
 			memNIDs, otherNIDs := newStripped.NIDs()
 			newSnapshot := &SnapshotRow{
@@ -522,6 +567,8 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 			if err = a.snapshotTable.Insert(txn, newSnapshot); err != nil {
 				return AccumulateResult{}, fmt.Errorf("failed to insert new snapshot: %w", err)
 			}
+			result.replacedSnapshot = result.replacedSnapshot || snapID != 0
+			result.numSnapshots++
 			snapID = newSnapshot.SnapshotID
 		}
 		if err := a.eventsTable.UpdateBeforeSnapshotID(txn, ev.NID, beforeSnapID, replacesNID); err != nil {
@@ -565,20 +612,22 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	return result, nil
 }
 
-// - parses it and returns Event structs.
+// - parses it and returns Event structs, dropping events which fail validation.
 // - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org
-func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) []Event {
+func (a *Accumulator) parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) []Event {
 	dedupedEvents := make([]Event, 0, len(timeline.Events))
 	seenEvents := make(map[string]struct{})
+	var rejected []rejectedEvent
 	for i, rawEvent := range timeline.Events {
 		e := Event{
 			JSON:   rawEvent,
 			RoomID: roomID,
 		}
-		if err := e.ensureFieldsSetOnEvent(); err != nil {
+		if err := a.checkEvent(&e); err != nil {
 			logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Err(err).Msg(
 				"Accumulator.filterToNewTimelineEvents: failed to parse event, ignoring",
 			)
+			rejected = append(rejected, rejectedEvent{json: rawEvent, err: err})
 			continue
 		}
 		if _, ok := seenEvents[e.ID]; ok {
@@ -597,9 +646,58 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 		dedupedEvents = append(dedupedEvents, e)
 		seenEvents[e.ID] = struct{}{}
 	}
+	a.reject(roomID, "timeline", rejected)
 	return dedupedEvents
 }
 
+// filterEvents is like filterAndEnsureFieldsSet, but validates events with checkEvent and
+// quarantines rejected events in strict mode.
+func (a *Accumulator) filterEvents(roomID, source string, events []Event) []Event {
+	result := make([]Event, 0, len(events))
+	var rejected []rejectedEvent
+	for i := range events {
+		ev := &events[i]
+		if err := a.checkEvent(ev); err != nil {
+			logger.Warn().Str("event_id", ev.ID).Str("room_id", roomID).Err(err).Msg(
+				"filterEvents: failed to parse event, ignoring",
+			)
+			rejected = append(rejected, rejectedEvent{json: ev.JSON, err: err})
+			continue
+		}
+		result = append(result, *ev)
+	}
+	a.reject(roomID, source, rejected)
+	return result
+}
+
+// checkEvent sets the fields of the event from its JSON. In strict mode, it also checks that the
+// event has every field which events from /sync must have.
+func (a *Accumulator) checkEvent(ev *Event) error {
+	if err := ev.ensureFieldsSetOnEvent(); err != nil {
+		return err
+	}
+	if a.strictValidation {
+		return validateEventShape(gjson.ParseBytes(ev.JSON))
+	}
+	return nil
+}
+
+// reject counts events which failed validation and, in strict mode, quarantines them. Events are
+// quarantined outside of any transaction, so they are kept even if accumulating the rest fails.
+func (a *Accumulator) reject(roomID, source string, rejected []rejectedEvent) {
+	if len(rejected) == 0 {
+		return
+	}
+	a.metrics.rejectedEvents(source, len(rejected))
+	if !a.strictValidation || a.malformedTable == nil {
+		return
+	}
+	if err := a.malformedTable.Insert(roomID, source, rejected, time.Now()); err != nil {
+		logger.Err(err).Str("room_id", roomID).Int("num_events", len(rejected)).Msg("failed to quarantine malformed events")
+		sentry.CaptureException(err)
+	}
+}
+
 // filterToNewTimelineEvents takes a raw timeline array from sync v2 and applies sanity to it:
 // - removes old events: this is an edge case when joining rooms over federation, see https://github.com/matrix-org/sliding-sync/issues/192
 // - check which events are unknown. If all events are known, filter them all out.
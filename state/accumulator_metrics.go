@@ -0,0 +1,207 @@
+package state
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AccumulatorMetrics instruments how much the accumulator writes, so operators can see which
+// rooms' state churn is filling the database. A nil *AccumulatorMetrics records nothing.
+type AccumulatorMetrics struct {
+	eventsAccumulated   *prometheus.CounterVec
+	snapshotsCreated    *prometheus.CounterVec
+	snapshotsReplaced   prometheus.Counter
+	snapshotDuration    prometheus.Histogram
+	snapshotsRemoved    prometheus.Counter
+	snapshotsCompressed prometheus.Counter
+	prunableEvents      prometheus.Gauge
+	eventsPruned        prometheus.Counter
+	prevBatchesPruned   prometheus.Counter
+	receiptsDeleted     prometheus.Counter
+	eventsRejected      *prometheus.CounterVec
+	receiptRows         *prometheus.GaugeVec
+	receiptBytes        *prometheus.GaugeVec
+}
+
+func NewAccumulatorMetrics() *AccumulatorMetrics {
+	m := &AccumulatorMetrics{
+		eventsAccumulated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "events_total",
+			Help:      "Number of new events stored, by whether they came from a state block or a timeline.",
+		}, []string{"source"}),
+		snapshotsCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "snapshots_created_total",
+			Help:      "Number of room state snapshots created, by whether they came from a state block or a timeline.",
+		}, []string{"source"}),
+		snapshotsReplaced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "snapshots_replaced_total",
+			Help:      "Number of times the current state snapshot of a room was replaced by a new snapshot.",
+		}),
+		snapshotDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "calculate_snapshot_duration_secs",
+			Help:      "Time taken in seconds to calculate a new state snapshot for a state event in a timeline.",
+			Buckets:   []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25},
+		}),
+		snapshotsRemoved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "snapshots_removed_total",
+			Help:      "Number of inaccessible room state snapshots deleted by the cleaner.",
+		}),
+		snapshotsCompressed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "snapshots_compressed_total",
+			Help:      "Number of room state snapshots stored as a delta from an older snapshot by the cleaner.",
+		}),
+		prunableEvents: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "prunable_events",
+			Help:      "Number of timeline events outside the retention found by the last cleaner run, including in dry run mode.",
+		}),
+		eventsPruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "events_pruned_total",
+			Help:      "Number of timeline events outside the retention deleted by the cleaner.",
+		}),
+		prevBatchesPruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "prev_batches_pruned_total",
+			Help:      "Number of prev_batch tokens deleted by the cleaner along with their timeline events.",
+		}),
+		receiptsDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "receipts_compacted_total",
+			Help:      "Number of private receipts superseded by a newer public receipt deleted by the cleaner.",
+		}),
+		eventsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "malformed_events_total",
+			Help:      "Number of events from the upstream which failed validation and were not stored, by whether they came from a state block or a timeline.",
+		}, []string{"source"}),
+		receiptRows: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "receipts_rows",
+			Help:      "Estimated number of stored receipts, by whether they are public or private, as of the last cleaner run.",
+		}, []string{"type"}),
+		receiptBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "accumulator",
+			Name:      "receipts_table_bytes",
+			Help:      "Size on disk of the receipt tables including indexes, by whether they are public or private, as of the last cleaner run.",
+		}, []string{"type"}),
+	}
+	prometheus.MustRegister(
+		m.eventsAccumulated, m.snapshotsCreated, m.snapshotsReplaced, m.snapshotDuration, m.snapshotsRemoved,
+		m.prunableEvents, m.eventsPruned, m.prevBatchesPruned, m.receiptsDeleted, m.receiptRows, m.receiptBytes,
+		m.eventsRejected, m.snapshotsCompressed,
+	)
+	return m
+}
+
+// accumulated records a successful Initialise or Accumulate, where source is "state" or
+// "timeline". replaced is true if the room's current snapshot was replaced.
+func (m *AccumulatorMetrics) accumulated(source string, numEvents, numSnapshots int, replaced bool) {
+	if m == nil {
+		return
+	}
+	m.eventsAccumulated.WithLabelValues(source).Add(float64(numEvents))
+	m.snapshotsCreated.WithLabelValues(source).Add(float64(numSnapshots))
+	if replaced {
+		m.snapshotsReplaced.Inc()
+	}
+}
+
+func (m *AccumulatorMetrics) observeSnapshotDuration(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.snapshotDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *AccumulatorMetrics) removedSnapshots(n int64) {
+	if m == nil {
+		return
+	}
+	m.snapshotsRemoved.Add(float64(n))
+}
+
+func (m *AccumulatorMetrics) compressedSnapshots(n int) {
+	if m == nil {
+		return
+	}
+	m.snapshotsCompressed.Add(float64(n))
+}
+
+// prunedEvents records a run of the event retention. In dry run mode nothing was deleted, so only
+// the number of prunable events is recorded.
+func (m *AccumulatorMetrics) prunedEvents(events, prevBatches int64, dryRun bool) {
+	if m == nil {
+		return
+	}
+	m.prunableEvents.Set(float64(events))
+	if dryRun {
+		return
+	}
+	m.eventsPruned.Add(float64(events))
+	m.prevBatchesPruned.Add(float64(prevBatches))
+}
+
+func (m *AccumulatorMetrics) rejectedEvents(source string, n int) {
+	if m == nil {
+		return
+	}
+	m.eventsRejected.WithLabelValues(source).Add(float64(n))
+}
+
+func (m *AccumulatorMetrics) compactedReceipts(n int64) {
+	if m == nil {
+		return
+	}
+	m.receiptsDeleted.Add(float64(n))
+}
+
+func (m *AccumulatorMetrics) receiptTableStats(public, private ReceiptTableStats) {
+	if m == nil {
+		return
+	}
+	m.receiptRows.WithLabelValues("public").Set(float64(public.Rows))
+	m.receiptRows.WithLabelValues("private").Set(float64(private.Rows))
+	m.receiptBytes.WithLabelValues("public").Set(float64(public.Bytes))
+	m.receiptBytes.WithLabelValues("private").Set(float64(private.Bytes))
+}
+
+// Teardown unregisters metrics. Useful in tests.
+func (m *AccumulatorMetrics) Teardown() {
+	if m == nil {
+		return
+	}
+	prometheus.Unregister(m.eventsAccumulated)
+	prometheus.Unregister(m.snapshotsCreated)
+	prometheus.Unregister(m.snapshotsReplaced)
+	prometheus.Unregister(m.snapshotDuration)
+	prometheus.Unregister(m.snapshotsRemoved)
+	prometheus.Unregister(m.prunableEvents)
+	prometheus.Unregister(m.eventsPruned)
+	prometheus.Unregister(m.prevBatchesPruned)
+	prometheus.Unregister(m.receiptsDeleted)
+	prometheus.Unregister(m.receiptRows)
+	prometheus.Unregister(m.receiptBytes)
+	prometheus.Unregister(m.eventsRejected)
+	prometheus.Unregister(m.snapshotsCompressed)
+}
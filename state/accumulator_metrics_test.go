@@ -0,0 +1,63 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestAccumulatorMetrics(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := NewStorageWithDB(db, true)
+	m := store.Accumulator.metrics
+	defer m.Teardown()
+
+	roomID := "!TestAccumulatorMetrics:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$metrics-create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"$metrics-member", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	_, err = store.Accumulate(userID, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		[]byte(`{"event_id":"$metrics-name", "type":"m.room.name", "state_key":"", "content":{"name":"Metrics"}}`),
+		[]byte(`{"event_id":"$metrics-msg", "type":"m.room.message", "content":{"body":"hello"}}`),
+		[]byte(`{"event_id":"$metrics-topic", "type":"m.room.topic", "state_key":"", "content":{"topic":"Counting"}}`),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	// nothing new, so nothing is counted
+	_, err = store.Accumulate(userID, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		[]byte(`{"event_id":"$metrics-topic", "type":"m.room.topic", "state_key":"", "content":{"topic":"Counting"}}`),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+
+	check := func(name string, got, want float64) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s: got %v want %v", name, got, want)
+		}
+	}
+	check("state events", testutil.ToFloat64(m.eventsAccumulated.WithLabelValues("state")), 2)
+	check("timeline events", testutil.ToFloat64(m.eventsAccumulated.WithLabelValues("timeline")), 3)
+	check("state snapshots", testutil.ToFloat64(m.snapshotsCreated.WithLabelValues("state")), 1)
+	check("timeline snapshots", testutil.ToFloat64(m.snapshotsCreated.WithLabelValues("timeline")), 2)
+	check("replaced snapshots", testutil.ToFloat64(m.snapshotsReplaced), 1)
+	if count := testutil.CollectAndCount(m.snapshotDuration); count != 1 {
+		t.Errorf("snapshot duration: got %d series want 1", count)
+	}
+
+	// a nil *AccumulatorMetrics records nothing
+	var nilMetrics *AccumulatorMetrics
+	nilMetrics.accumulated("state", 1, 1, true)
+	nilMetrics.removedSnapshots(1)
+	nilMetrics.Teardown()
+}
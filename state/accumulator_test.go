@@ -880,3 +880,57 @@ func currentSnapshotNIDs(t *testing.T, snapshotTable *SnapshotTable, roomID stri
 	})
 	return events
 }
+
+func TestAccumulatorLeftEncryptedRoom(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	testCases := []struct {
+		name      string
+		encrypted bool
+		want      []string
+	}{
+		{name: "encrypted", encrypted: true, want: []string{"@alice:localhost", "@bob:localhost"}},
+		{name: "unencrypted", encrypted: false, want: nil},
+	}
+	for _, tc := range testCases {
+		roomID := "!TestAccumulatorLeftEncryptedRoom-" + tc.name + ":localhost"
+		eventID := func(name string) string {
+			return "$TestAccumulatorLeftEncryptedRoom-" + tc.name + "-" + name
+		}
+		state := []json.RawMessage{
+			[]byte(`{"event_id":"` + eventID("create") + `", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+			[]byte(`{"event_id":"` + eventID("me") + `", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+			[]byte(`{"event_id":"` + eventID("alice") + `", "type":"m.room.member", "state_key":"@alice:localhost", "content":{"membership":"join"}}`),
+			[]byte(`{"event_id":"` + eventID("bob") + `", "type":"m.room.member", "state_key":"@bob:localhost", "content":{"membership":"join"}}`),
+			[]byte(`{"event_id":"` + eventID("charlie") + `", "type":"m.room.member", "state_key":"@charlie:localhost", "content":{"membership":"invite"}}`),
+		}
+		if tc.encrypted {
+			state = append(state, []byte(`{"event_id":"`+eventID("encryption")+`", "type":"m.room.encryption", "state_key":"", "content":{"algorithm":"m.megolm.v1.aes-sha2"}}`))
+		}
+		if _, err := accumulator.Initialise(roomID, state); err != nil {
+			t.Fatalf("failed to Initialise accumulator: %s", err)
+		}
+		timeline := []json.RawMessage{
+			// @me changes display name: not a leave
+			[]byte(`{"event_id":"` + eventID("me-name") + `", "type":"m.room.member", "state_key":"@me:localhost", "unsigned":{"prev_content":{"membership":"join"}}, "content":{"membership":"join", "displayname":"Me"}}`),
+			// @alice leaves
+			[]byte(`{"event_id":"` + eventID("alice-leave") + `", "type":"m.room.member", "state_key":"@alice:localhost", "unsigned":{"prev_content":{"membership":"join"}}, "content":{"membership":"leave"}}`),
+			// @charlie rejects their invite: they were never joined
+			[]byte(`{"event_id":"` + eventID("charlie-leave") + `", "type":"m.room.member", "state_key":"@charlie:localhost", "unsigned":{"prev_content":{"membership":"invite"}}, "content":{"membership":"leave"}}`),
+			// @bob is banned
+			[]byte(`{"event_id":"` + eventID("bob-ban") + `", "type":"m.room.member", "state_key":"@bob:localhost", "unsigned":{"prev_content":{"membership":"join"}}, "content":{"membership":"ban"}}`),
+		}
+		var result AccumulateResult
+		err := sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) (err error) {
+			result, err = accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: timeline})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to Accumulate: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(result.LeftEncryptedRoom, tc.want) {
+			t.Errorf("%s: got LeftEncryptedRoom %v want %v", tc.name, result.LeftEncryptedRoom, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnRequestsTable stores the sticky request of each sliding sync connection, so connections can
+// be rehydrated after the proxy restarts rather than clients having to start again.
+type ConnRequestsTable struct {
+	db *sqlx.DB
+}
+
+// ConnRequest is the last sticky request stored for a connection.
+type ConnRequest struct {
+	Request   json.RawMessage
+	UpdatedAt time.Time
+}
+
+func NewConnRequestsTable(db *sqlx.DB) *ConnRequestsTable {
+	return &ConnRequestsTable{db}
+}
+
+func (t *ConnRequestsTable) Upsert(userID, deviceID, connID string, req json.RawMessage, updatedAt time.Time) error {
+	_, err := t.db.Exec(
+		`INSERT INTO syncv3_conn_requests(user_id, device_id, conn_id, request, updated_at) VALUES($1,$2,$3,$4,$5)
+		ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET request = $4, updated_at = $5`,
+		userID, deviceID, connID, []byte(req), updatedAt.UnixMilli(),
+	)
+	return err
+}
+
+// Select the stored request for this connection. Returns nil if there is none.
+func (t *ConnRequestsTable) Select(userID, deviceID, connID string) (*ConnRequest, error) {
+	var blob []byte
+	var updatedAt int64
+	err := t.db.QueryRow(
+		`SELECT request, updated_at FROM syncv3_conn_requests WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`,
+		userID, deviceID, connID,
+	).Scan(&blob, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ConnRequest{
+		Request:   blob,
+		UpdatedAt: time.UnixMilli(updatedAt),
+	}, nil
+}
+
+// DeleteDevice deletes the stored requests of every connection of this device.
+func (t *ConnRequestsTable) DeleteDevice(userID, deviceID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_requests WHERE user_id=$1 AND device_id=$2`, userID, deviceID)
+	return err
+}
+
+// DeleteOlderThan deletes requests which haven't been updated since this time, whose connections
+// would have expired anyway. Returns the number of requests deleted.
+func (t *ConnRequestsTable) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_conn_requests WHERE updated_at < $1`, cutoff.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,52 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConnRequestsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewConnRequestsTable(db)
+	alice := "@alice_TestConnRequestsTable:localhost"
+	bob := "@bob_TestConnRequestsTable:localhost"
+	updatedAt := time.UnixMilli(1700000000000)
+
+	assertNoError(t, table.Upsert(alice, "A", "conn", json.RawMessage(`{"lists":{}}`), updatedAt))
+	assertNoError(t, table.Upsert(alice, "A", "conn", json.RawMessage(`{"lists":{"a":{}}}`), updatedAt.Add(time.Hour)))
+	assertNoError(t, table.Upsert(alice, "A", "other", json.RawMessage(`{}`), updatedAt))
+	assertNoError(t, table.Upsert(bob, "B", "conn", json.RawMessage(`{}`), updatedAt))
+
+	got, err := table.Select(alice, "A", "conn")
+	assertNoError(t, err)
+	if got == nil || string(got.Request) != `{"lists":{"a":{}}}` || !got.UpdatedAt.Equal(updatedAt.Add(time.Hour)) {
+		t.Fatalf("Select: got %+v", got)
+	}
+	got, err = table.Select(alice, "A", "unknown")
+	assertNoError(t, err)
+	if got != nil {
+		t.Errorf("Select unknown conn: got %+v want nil", got)
+	}
+
+	assertNoError(t, table.DeleteDevice(alice, "A"))
+	for _, connID := range []string{"conn", "other"} {
+		got, err = table.Select(alice, "A", connID)
+		assertNoError(t, err)
+		if got != nil {
+			t.Errorf("Select %s after DeleteDevice: got %+v want nil", connID, got)
+		}
+	}
+
+	deleted, err := table.DeleteOlderThan(updatedAt.Add(time.Minute))
+	assertNoError(t, err)
+	if deleted != 1 {
+		t.Errorf("DeleteOlderThan: deleted %d want 1", deleted)
+	}
+	got, err = table.Select(bob, "B", "conn")
+	assertNoError(t, err)
+	if got != nil {
+		t.Errorf("Select after DeleteOlderThan: got %+v want nil", got)
+	}
+}
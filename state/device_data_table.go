@@ -26,17 +26,6 @@ type DeviceDataTable struct {
 }
 
 func NewDeviceDataTable(db *sqlx.DB) *DeviceDataTable {
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_device_data (
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		data BYTEA NOT NULL,
-		UNIQUE(user_id, device_id)
-	);
-	-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
-	-- change the data, not anything indexed like the id)
-	ALTER TABLE syncv3_device_data SET (fillfactor = 90);
-	`)
 	return &DeviceDataTable{
 		db:              db,
 		deviceListTable: NewDeviceListTable(db),
@@ -27,21 +27,6 @@ type DeviceListTable struct {
 }
 
 func NewDeviceListTable(db *sqlx.DB) *DeviceListTable {
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_device_list_updates (
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		target_user_id TEXT NOT NULL,
-		target_state SMALLINT NOT NULL,
-		bucket SMALLINT NOT NULL,
-		UNIQUE(user_id, device_id, target_user_id, bucket)
-	);
-	-- make an index so selecting all the rows is faster
-	CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_bucket_idx ON syncv3_device_list_updates(user_id, device_id, bucket);
-	-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
-	-- change the data, not anything indexed like the id)
-	ALTER TABLE syncv3_device_list_updates SET (fillfactor = 90);
-	`)
 	return &DeviceListTable{
 		db: db,
 	}
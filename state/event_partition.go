@@ -0,0 +1,131 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// UnpartitionedEventsTable is what PartitionEventsTable renames the original events table to. It
+// is kept so that the admin can check the partitioned table before dropping it.
+const UnpartitionedEventsTable = "syncv3_events_unpartitioned"
+
+// eventsTableIndexes are the indexes on syncv3_events, which must be renamed out of the way
+// before the partitioned table can create indexes with the same names.
+var eventsTableIndexes = []string{
+	"syncv3_events_type_sk_idx",
+	"syncv3_events_type_room_nid_idx",
+	"syncv3_nid_room_state_idx",
+	"syncv3_events_room_event_nid_type_skey_idx",
+	"syncv3_events_room_ts_idx",
+	"syncv3_events_unset_ts_idx",
+}
+
+// IsEventsTablePartitioned returns true if syncv3_events has been partitioned by PartitionEventsTable.
+func IsEventsTablePartitioned(db *sqlx.DB) (bool, error) {
+	var partitioned bool
+	err := db.QueryRow(`SELECT EXISTS(
+		SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('syncv3_events')
+	)`).Scan(&partitioned)
+	return partitioned, err
+}
+
+// PartitionEventsTable replaces syncv3_events with a table hash partitioned on room_id into
+// numPartitions partitions, and copies every event into it. Each room's events then live in a
+// single, smaller partition, which vacuums independently of the others and keeps a room's
+// events together on disk. The original table is renamed to UnpartitionedEventsTable rather
+// than dropped. Returns the number of events copied.
+//
+// Postgres requires unique constraints on a partitioned table to include the partition key, so
+// event IDs are only unique within a room afterwards. As event IDs are hashes of the event, this
+// makes no difference in practice.
+//
+// This rewrites the whole table in a single transaction, so it must not be run whilst the proxy
+// is running.
+func PartitionEventsTable(db *sqlx.DB, numPartitions int) (copied int64, err error) {
+	if numPartitions < 1 {
+		return 0, fmt.Errorf("number of partitions must be at least 1, got %d", numPartitions)
+	}
+	partitioned, err := IsEventsTablePartitioned(db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check if the events table is partitioned: %w", err)
+	}
+	if partitioned {
+		return 0, fmt.Errorf("the events table is already partitioned")
+	}
+	var exists bool
+	if err = db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, UnpartitionedEventsTable).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check for %s: %w", UnpartitionedEventsTable, err)
+	}
+	if exists {
+		return 0, fmt.Errorf("%s already exists: drop it before partitioning again", UnpartitionedEventsTable)
+	}
+
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		// move the original table, its constraints and its indexes out of the way
+		_, err := txn.Exec(fmt.Sprintf(`
+		ALTER TABLE syncv3_events RENAME TO %[1]s;
+		ALTER TABLE %[1]s RENAME CONSTRAINT syncv3_events_pkey TO %[1]s_pkey;
+		ALTER TABLE %[1]s RENAME CONSTRAINT syncv3_events_event_id_key TO %[1]s_event_id_key;`,
+			UnpartitionedEventsTable,
+		))
+		if err != nil {
+			return fmt.Errorf("failed to rename the events table: %w", err)
+		}
+		for _, index := range eventsTableIndexes {
+			if _, err = txn.Exec(fmt.Sprintf(`ALTER INDEX IF EXISTS %s RENAME TO %s_old`, index, index)); err != nil {
+				return fmt.Errorf("failed to rename index %s: %w", index, err)
+			}
+		}
+
+		// LIKE keeps the columns in the same order, so rows can be copied with SELECT *. The
+		// event_nid default still uses syncv3_event_nids_seq, so new NIDs carry on from the old ones.
+		_, err = txn.Exec(fmt.Sprintf(`
+		CREATE TABLE syncv3_events (
+			LIKE %s INCLUDING DEFAULTS,
+			CONSTRAINT syncv3_events_pkey PRIMARY KEY (event_nid, room_id),
+			CONSTRAINT syncv3_events_event_id_key UNIQUE (event_id, room_id)
+		) PARTITION BY HASH (room_id);`, UnpartitionedEventsTable))
+		if err != nil {
+			return fmt.Errorf("failed to create the partitioned events table: %w", err)
+		}
+		for i := 0; i < numPartitions; i++ {
+			_, err = txn.Exec(fmt.Sprintf(
+				`CREATE TABLE syncv3_events_p%d PARTITION OF syncv3_events FOR VALUES WITH (MODULUS %d, REMAINDER %d)`,
+				i, numPartitions, i,
+			))
+			if err != nil {
+				return fmt.Errorf("failed to create partition %d: %w", i, err)
+			}
+		}
+		// the same indexes as NewEventTable and the migrations create, except that the unique
+		// index must include room_id
+		_, err = txn.Exec(`
+		CREATE INDEX syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
+		CREATE INDEX syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid);
+		CREATE INDEX syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
+		CREATE UNIQUE INDEX syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key, room_id);
+		CREATE INDEX syncv3_events_room_ts_idx ON syncv3_events(room_id, origin_server_ts);
+		CREATE INDEX syncv3_events_unset_ts_idx ON syncv3_events(event_nid) WHERE origin_server_ts = 0;`)
+		if err != nil {
+			return fmt.Errorf("failed to create indexes on the partitioned events table: %w", err)
+		}
+
+		res, err := txn.Exec(fmt.Sprintf(`INSERT INTO syncv3_events SELECT * FROM %s`, UnpartitionedEventsTable))
+		if err != nil {
+			return fmt.Errorf("failed to copy events into the partitioned events table: %w", err)
+		}
+		copied, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	// the planner has no statistics for the new partitions until they are analysed
+	if _, err = db.Exec(`ANALYZE syncv3_events`); err != nil {
+		return copied, fmt.Errorf("failed to analyze the partitioned events table: %w", err)
+	}
+	return copied, nil
+}
@@ -0,0 +1,113 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// eventRetentionBatchSize is how many timeline events are deleted in each statement.
+const eventRetentionBatchSize = 5000
+
+// EventRetention configures pruning old timeline events, along with the prev_batch tokens
+// stored on them. Without this, every event the proxy has seen is stored forever. Only message
+// events are pruned: state events, events in the v2 state block and the latest event in each
+// room are always kept, so room state, memberships and room sorting are unaffected.
+type EventRetention struct {
+	// MaxAge prunes timeline events whose origin_server_ts is older than this. Disabled if 0.
+	MaxAge time.Duration
+	// MaxEventsPerRoom prunes timeline events beyond this many of the most recent in each room.
+	// Disabled if 0.
+	MaxEventsPerRoom int
+	// DryRun logs and counts prunable events without deleting them.
+	DryRun bool
+}
+
+func (r EventRetention) enabled() bool {
+	return r.MaxAge > 0 || r.MaxEventsPerRoom > 0
+}
+
+// SetEventRetention configures pruning old timeline events, which the Cleaner does on each
+// run. Must be called before Cleaner.
+func (s *Storage) SetEventRetention(cfg EventRetention) {
+	s.eventRetention = cfg
+}
+
+// PruneTimelineEvents deletes timeline events outside the retention configured with
+// SetEventRetention, or only counts them in dry run mode. Returns the number of events and
+// prev_batch tokens which were (or in dry run mode would be) deleted. This function does not
+// normally need to be called manually (the Cleaner calls it); we expose it publicly only for
+// testing purposes.
+func (s *Storage) PruneTimelineEvents() (events, prevBatches int64, err error) {
+	cfg := s.eventRetention
+	if !cfg.enabled() {
+		return 0, 0, nil
+	}
+	events, prevBatches, err = s.pruneTimelineEvents(cfg, "", time.Now())
+	// earlier batches may have been deleted before an error, so always count them
+	s.Accumulator.metrics.prunedEvents(events, prevBatches, cfg.DryRun)
+	if err != nil {
+		return events, prevBatches, err
+	}
+	if events > 0 {
+		logger.Info().Int64("events", events).Int64("prev_batches", prevBatches).Bool("dry_run", cfg.DryRun).
+			Dur("max_age", cfg.MaxAge).Int("max_events_per_room", cfg.MaxEventsPerRoom).Msg("pruned timeline events")
+	}
+	return events, prevBatches, nil
+}
+
+// pruneTimelineEvents prunes events older than `now` minus the max age. If roomID is set, only
+// that room is pruned.
+func (s *Storage) pruneTimelineEvents(cfg EventRetention, roomID string, now time.Time) (events, prevBatches int64, err error) {
+	var cutoffTS int64
+	if cfg.MaxAge > 0 {
+		cutoffTS = int64(spec.AsTimestamp(now.Add(-cfg.MaxAge)))
+	}
+	// Rank the timeline events in each room from newest to oldest, so the newest event (rank 1)
+	// is always kept and events beyond the max are pruned. Events with a state_key are state
+	// events, which may be needed to rewind room state, so they are never pruned. Pruning older
+	// events never changes the rank of newer events, so deleting in batches is safe. Deleting by
+	// room_id as well as event_nid lets Postgres skip the other partitions of a partitioned table.
+	prunable := `WITH ranked AS (
+		SELECT event_nid, room_id, event, prev_batch,
+		  ROW_NUMBER() OVER (PARTITION BY room_id ORDER BY event_nid DESC) AS row_num
+		FROM syncv3_events
+		WHERE is_state = FALSE AND ($3 = '' OR room_id = $3)
+	  ), prunable AS (
+		SELECT event_nid, room_id, prev_batch IS NOT NULL AS has_prev_batch FROM ranked
+		WHERE row_num > 1
+		AND (($1 > 0 AND row_num > $1) OR ($2 > 0 AND (convert_from(event, 'UTF8')::jsonb->>'origin_server_ts')::BIGINT < $2))
+		AND (convert_from(event, 'UTF8')::jsonb->'state_key') IS NULL
+		%s
+	  )`
+	if cfg.DryRun {
+		err = s.DB.QueryRow(
+			fmt.Sprintf(prunable, "")+` SELECT COUNT(*), COUNT(*) FILTER (WHERE has_prev_batch) FROM prunable`,
+			cfg.MaxEventsPerRoom, cutoffTS, roomID,
+		).Scan(&events, &prevBatches)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to count prunable timeline events: %w", err)
+		}
+		return events, prevBatches, nil
+	}
+	deleteQuery := fmt.Sprintf(prunable, fmt.Sprintf("LIMIT %d", eventRetentionBatchSize)) + `
+	  , deleted AS (
+		DELETE FROM syncv3_events USING prunable
+		WHERE syncv3_events.event_nid = prunable.event_nid AND syncv3_events.room_id = prunable.room_id
+		RETURNING prunable.has_prev_batch
+	  )
+	  SELECT COUNT(*), COUNT(*) FILTER (WHERE has_prev_batch) FROM deleted`
+	for {
+		var batchEvents, batchPrevBatches int64
+		err = s.DB.QueryRow(deleteQuery, cfg.MaxEventsPerRoom, cutoffTS, roomID).Scan(&batchEvents, &batchPrevBatches)
+		if err != nil {
+			return events, prevBatches, fmt.Errorf("failed to delete prunable timeline events: %w", err)
+		}
+		events += batchEvents
+		prevBatches += batchPrevBatches
+		if batchEvents < eventRetentionBatchSize {
+			return events, prevBatches, nil
+		}
+	}
+}
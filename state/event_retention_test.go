@@ -0,0 +1,109 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestPruneTimelineEvents(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := NewStorageWithDB(db, false)
+	roomID := "!TestPruneTimelineEvents:localhost"
+	alice := "@alice:localhost"
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}, testutils.WithTimestamp(old)),
+		testutils.NewJoinEvent(t, alice, testutils.WithTimestamp(old)),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	timeline := []json.RawMessage{
+		testutils.NewMessageEvent(t, alice, "old 1", testutils.WithTimestamp(old)),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "old"}, testutils.WithTimestamp(old)),
+		testutils.NewMessageEvent(t, alice, "old 2", testutils.WithTimestamp(old)),
+		testutils.NewMessageEvent(t, alice, "new 1", testutils.WithTimestamp(now)),
+		testutils.NewMessageEvent(t, alice, "new 2", testutils.WithTimestamp(now)),
+		testutils.NewMessageEvent(t, alice, "new 3", testutils.WithTimestamp(now)),
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: timeline, PrevBatch: "prev"})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	eventIDs := make([]string, len(timeline))
+	for i := range timeline {
+		var ev struct {
+			EventID string `json:"event_id"`
+		}
+		if err = json.Unmarshal(timeline[i], &ev); err != nil {
+			t.Fatalf("Unmarshal: %s", err)
+		}
+		eventIDs[i] = ev.EventID
+	}
+	assertStored := func(want []bool) {
+		t.Helper()
+		var stored []string
+		if err := db.Select(&stored, `SELECT event_id FROM syncv3_events WHERE room_id=$1`, roomID); err != nil {
+			t.Fatalf("Select: %s", err)
+		}
+		isStored := make(map[string]bool)
+		for _, id := range stored {
+			isStored[id] = true
+		}
+		for i, eventID := range eventIDs {
+			if isStored[eventID] != want[i] {
+				t.Errorf("event %d: got stored=%v want %v", i, isStored[eventID], want[i])
+			}
+		}
+		if len(stored) != 2+countTrue(want) {
+			t.Errorf("got %d stored events, want the 2 state block events and %d timeline events", len(stored), countTrue(want))
+		}
+	}
+	prune := func(cfg EventRetention, wantEvents, wantPrevBatches int64) {
+		t.Helper()
+		events, prevBatches, err := store.pruneTimelineEvents(cfg, roomID, now)
+		if err != nil {
+			t.Fatalf("pruneTimelineEvents: %s", err)
+		}
+		if events != wantEvents || prevBatches != wantPrevBatches {
+			t.Errorf("pruneTimelineEvents: got %d events %d prev batches, want %d events %d prev batches", events, prevBatches, wantEvents, wantPrevBatches)
+		}
+	}
+
+	// dry run deletes nothing
+	prune(EventRetention{MaxAge: 24 * time.Hour, DryRun: true}, 2, 1)
+	assertStored([]bool{true, true, true, true, true, true})
+
+	// old messages are deleted, including the one with the prev_batch, but not the old state event
+	prune(EventRetention{MaxAge: 24 * time.Hour}, 2, 1)
+	assertStored([]bool{false, true, false, true, true, true})
+
+	// keep the most recent 2 timeline events
+	prune(EventRetention{MaxEventsPerRoom: 2}, 1, 0)
+	assertStored([]bool{false, true, false, false, true, true})
+
+	// the latest event is always kept, however old
+	prune(EventRetention{MaxAge: time.Nanosecond, MaxEventsPerRoom: 1}, 1, 0)
+	assertStored([]bool{false, true, false, false, false, true})
+
+	// retention is disabled by default
+	events, prevBatches, err := store.PruneTimelineEvents()
+	if err != nil || events != 0 || prevBatches != 0 {
+		t.Errorf("PruneTimelineEvents: got %d %d %v want 0 0 nil", events, prevBatches, err)
+	}
+}
+
+func countTrue(bs []bool) (n int) {
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -41,6 +41,8 @@ type Event struct {
 	JSON []byte `db:"event"`
 	// MissingPrevious is true iff the previous timeline event is not known to the proxy.
 	MissingPrevious bool `db:"missing_previous"`
+	// OriginServerTS is the origin_server_ts of the event, or 0 for stripped events. Set on insert.
+	OriginServerTS int64 `db:"origin_server_ts"`
 }
 
 func (ev *Event) ensureFieldsSetOnEvent() error {
@@ -108,41 +110,25 @@ type membershipEvent struct {
 // EventTable stores events. A unique numeric ID is associated with each event.
 type EventTable struct {
 	db *sqlx.DB
+	// conflictTarget is the unique constraint which duplicate events conflict on. This is
+	// (event_id, room_id) on a partitioned events table: see PartitionEventsTable.
+	conflictTarget string
 }
 
 // NewEventTable makes a new EventTable
 func NewEventTable(db *sqlx.DB) *EventTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_event_nids_seq;
-	CREATE TABLE IF NOT EXISTS syncv3_events (
-		event_nid BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_nids_seq'),
-		event_id TEXT NOT NULL UNIQUE,
-		before_state_snapshot_id BIGINT NOT NULL DEFAULT 0,
-		-- which nid gets replaced in the snapshot with event_nid
-		event_replaces_nid BIGINT NOT NULL DEFAULT 0,
-		room_id TEXT NOT NULL,
-		event_type TEXT NOT NULL,
-		state_key TEXT NOT NULL,
-		prev_batch TEXT,
-		membership TEXT,
-		is_state BOOLEAN NOT NULL, -- is this event part of the v2 state response?
-		event BYTEA NOT NULL,
-		-- True iff this event was seen at the start of the timeline in a limited sync
-		-- (i.e. the preceding timeline event was not known to the proxy).
-		missing_previous BOOLEAN NOT NULL DEFAULT FALSE
-	);
-
-	-- index for querying all joined rooms for a given user
-	CREATE INDEX IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
-	-- index for querying membership deltas in particular rooms
-	CREATE INDEX IF NOT EXISTS syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid);
-	-- index for querying events in a given room
-	CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
-
-	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
-	`)
-	return &EventTable{db}
+	partitioned, err := IsEventsTablePartitioned(db)
+	if err != nil {
+		logger.Panic().Err(err).Msg("failed to check if the events table is partitioned")
+	}
+	conflictTarget := "(event_id)"
+	if partitioned {
+		conflictTarget = "(event_id, room_id)"
+	}
+	return &EventTable{
+		db:             db,
+		conflictTarget: conflictTarget,
+	}
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
@@ -165,6 +151,7 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 	}
 	result := make(map[string]int64)
 	for i := range events {
+		events[i].OriginServerTS = gjson.GetBytes(events[i].JSON, "origin_server_ts").Int()
 		if !gjson.GetBytes(events[i].JSON, "unsigned.txn_id").Exists() {
 			continue
 		}
@@ -174,14 +161,14 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	chunks := sqlutil.Chunkify(10, MaxPostgresParameters, EventChunker(events))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
-		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous)
-        ON CONFLICT (event_id) DO NOTHING
+		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous, origin_server_ts)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous, :origin_server_ts)
+        ON CONFLICT `+t.conflictTarget+` DO NOTHING
         RETURNING event_id, event_nid`, chunk)
 		if err != nil {
 			return nil, err
@@ -265,7 +252,7 @@ func (t *EventTable) SelectStrippedEventsByNIDs(txn *sqlx.Tx, verifyAll bool, ni
 	}
 	// don't include the 'event' column
 	return t.selectAny(txn, wanted, `
-	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
+	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id, membership FROM syncv3_events
 	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
 }
 
@@ -276,7 +263,7 @@ func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids
 	}
 	// don't include the 'event' column
 	return t.selectAny(txn, wanted, `
-	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
+	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id, membership FROM syncv3_events
 	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
 
 }
@@ -348,6 +335,54 @@ FROM room_ids,
 	return
 }
 
+// SelectLatestActivityBefore returns the origin_server_ts of the latest timeline event at or before
+// the timestamp `ts` in each of the rooms, by room ID. Rooms without a timeline event at or before
+// `ts` are not in the map.
+func (t *EventTable) SelectLatestActivityBefore(txn *sqlx.Tx, roomIDs []string, ts int64) (map[string]int64, error) {
+	// the LATERAL walks the (room_id, origin_server_ts) index backwards from `ts` in each room
+	rows, err := txn.Query(`
+	SELECT room_ids.room_id, e.origin_server_ts
+	FROM unnest($1::text[]) AS room_ids(room_id),
+	LATERAL (
+		SELECT origin_server_ts FROM syncv3_events
+		WHERE room_id = room_ids.room_id AND origin_server_ts > 0 AND origin_server_ts <= $2 AND NOT is_state
+		ORDER BY origin_server_ts DESC LIMIT 1
+	) AS e`, pq.StringArray(roomIDs), ts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int64, len(roomIDs))
+	for rows.Next() {
+		var roomID string
+		var activity int64
+		if err := rows.Scan(&roomID, &activity); err != nil {
+			return nil, err
+		}
+		result[roomID] = activity
+	}
+	return result, rows.Err()
+}
+
+// SelectUnsetOriginServerTS returns up to `limit` events after `afterNID` whose origin_server_ts
+// is 0, in NID order. Only the NID and JSON of each event are set.
+func (t *EventTable) SelectUnsetOriginServerTS(afterNID int64, limit int) (events []Event, err error) {
+	err = t.db.Select(&events, `
+	SELECT event_nid, event FROM syncv3_events WHERE origin_server_ts = 0 AND event_nid > $1
+	ORDER BY event_nid ASC LIMIT $2`, afterNID, limit)
+	return
+}
+
+// UpdateOriginServerTS sets the origin_server_ts of the events with these NIDs to the timestamp at
+// the same index.
+func (t *EventTable) UpdateOriginServerTS(nids, timestamps []int64) error {
+	_, err := t.db.Exec(`
+	UPDATE syncv3_events SET origin_server_ts = u.ts
+	FROM unnest($1::BIGINT[], $2::BIGINT[]) AS u(nid, ts) WHERE syncv3_events.event_nid = u.nid`,
+		pq.Int64Array(nids), pq.Int64Array(timestamps))
+	return err
+}
+
 // LatestEventNIDInRooms queries the latest events in each of the room IDs given, using highestNID as the highest event.
 //
 // The following query does:
@@ -439,11 +474,31 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	return events, err
 }
 
+// SelectLatestTimelineEventsOfTypes returns up to limit timeline events in the room after this
+// NID with one of these types, newest first.
+func (t *EventTable) SelectLatestTimelineEventsOfTypes(txn *sqlx.Tx, roomID string, lowerExclusive int64, eventTypes []string, limit int) (events []Event, err error) {
+	err = txn.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE event_nid > $1 AND room_id = $2
+	AND event_type = ANY($3) AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
+		lowerExclusive, roomID, pq.StringArray(eventTypes), limit,
+	)
+	return
+}
+
 func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, error) {
+	return t.selectLatestEventByType(txn, `SELECT DISTINCT room_id FROM syncv3_rooms`)
+}
+
+// selectLatestEventByTypeInRooms is like selectLatestEventByTypeInAllRooms, but only for the given rooms.
+func (t *EventTable) selectLatestEventByTypeInRooms(txn *sqlx.Tx, roomIDs []string) ([]Event, error) {
+	return t.selectLatestEventByType(txn, `SELECT UNNEST($1::text[]) AS room_id`, pq.StringArray(roomIDs))
+}
+
+// selectLatestEventByType returns the latest event of each type in each room selected by roomIDsQuery.
+func (t *EventTable) selectLatestEventByType(txn *sqlx.Tx, roomIDsQuery string, args ...interface{}) ([]Event, error) {
 	result := []Event{}
 	// What the following query does:
 	//	1. Gets all event types from a recursive CTE as the `event_types` CTE
-	//	2. Gets all rooms as the `room_ids` CTE
+	//	2. Gets the rooms from roomIDsQuery as the `room_ids` CTE
 	// 	3. Gets the latest event_nid for each event_type and room as the `max_by_ev_type` CTE
 	//	4. Queries the required data using the event_nids provided by the `max_by_ev_type` CTE
 	rows, err := txn.Query(`
@@ -457,13 +512,13 @@ WITH event_types AS (
     )
     SELECT event_type FROM t WHERE event_type IS NOT NULL
 ), room_ids AS (
-    SELECT DISTINCT room_id FROM syncv3_rooms
+    `+roomIDsQuery+`
 ), max_by_ev_type AS (
     SELECT m.max FROM event_types, room_ids,
     LATERAL ( SELECT max(event_nid) as max FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND e.event_type = event_types.event_type ) AS m
 )
 SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_nid = max_by_ev_type.max
-`,
+`, args...,
 	)
 	if err != nil {
 		return nil, err
@@ -484,7 +539,7 @@ SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_
 func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
 	err := t.db.Select(&events,
-		`SELECT event_nid, room_id, event FROM syncv3_events
+		`SELECT event_nid, room_id, event_id, is_state, missing_previous, before_state_snapshot_id, event FROM syncv3_events
 		WHERE event_nid > $1 AND event_nid <= $2 AND event_type = $3 AND state_key = $4
 		ORDER BY event_nid ASC`,
 		lowerExclusive, upperInclusive, eventType, stateKey,
@@ -497,7 +552,7 @@ func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lo
 func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
 	query, args, err := sqlx.In(
-		`SELECT event_nid, room_id, event FROM syncv3_events
+		`SELECT event_nid, room_id, event_id, is_state, missing_previous, before_state_snapshot_id, event FROM syncv3_events
 		WHERE event_nid > ? AND event_nid <= ? AND event_type = ? AND state_key = ? AND room_id IN (?)
 		ORDER BY event_nid ASC`, lowerExclusive, upperInclusive, eventType, stateKey, roomIDs,
 	)
@@ -1227,3 +1227,48 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		assertValue(t, "fetchedIDs "+idRange+" limit 10", fetchedIDs, tc.ExpectIDs)
 	}
 }
+
+func TestEventTableSelectLatestActivityBefore(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	table := NewEventTable(db)
+	const roomA = "!a-SelectLatestActivityBefore:localhost"
+	const roomB = "!b-SelectLatestActivityBefore:localhost"
+	const roomC = "!c-SelectLatestActivityBefore:localhost"
+	_, err = table.Insert(txn, []Event{
+		// state events are not activity
+		{ID: "$create-A-SelectLatestActivityBefore", Type: "m.room.create", IsState: true, RoomID: roomA, JSON: []byte(`{"origin_server_ts":50}`)},
+		{ID: "$1-A-SelectLatestActivityBefore", Type: "m.room.message", RoomID: roomA, JSON: []byte(`{"origin_server_ts":100}`)},
+		{ID: "$2-A-SelectLatestActivityBefore", Type: "m.room.message", RoomID: roomA, JSON: []byte(`{"origin_server_ts":1000}`)},
+		{ID: "$3-A-SelectLatestActivityBefore", Type: "m.room.message", RoomID: roomA, JSON: []byte(`{"origin_server_ts":2000}`)},
+		{ID: "$1-B-SelectLatestActivityBefore", Type: "m.room.message", RoomID: roomB, JSON: []byte(`{"origin_server_ts":3000}`)},
+		{ID: "$create-C-SelectLatestActivityBefore", Type: "m.room.create", IsState: true, RoomID: roomC, JSON: []byte(`{"origin_server_ts":10}`)},
+	}, false)
+	if err != nil {
+		t.Fatalf("failed to insert events: %s", err)
+	}
+
+	testCases := []struct {
+		ts   int64
+		want map[string]int64
+	}{
+		{ts: 99, want: map[string]int64{}},
+		{ts: 100, want: map[string]int64{roomA: 100}},
+		{ts: 1500, want: map[string]int64{roomA: 1000}},
+		{ts: 5000, want: map[string]int64{roomA: 2000, roomB: 3000}},
+	}
+	for _, tc := range testCases {
+		got, err := table.SelectLatestActivityBefore(txn, []string{roomA, roomB, roomC}, tc.ts)
+		if err != nil {
+			t.Fatalf("SelectLatestActivityBefore(%d): %s", tc.ts, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SelectLatestActivityBefore(%d): got %v want %v", tc.ts, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// ForgottenRoomsTable stores the rooms which each user has forgotten. A forgotten room is hidden
+// from the user as if they had never been in it, until they are joined or invited to it again.
+// Rather than removing rows when that happens, each row remembers the latest event in the room
+// when it was forgotten, so newer memberships and invites for the user supersede it.
+type ForgottenRoomsTable struct {
+	db *sqlx.DB
+}
+
+func NewForgottenRoomsTable(db *sqlx.DB) *ForgottenRoomsTable {
+	return &ForgottenRoomsTable{db}
+}
+
+// Insert marks the room as forgotten by the user as of the room's latest event.
+func (t *ForgottenRoomsTable) Insert(txn *sqlx.Tx, userID, roomID string) error {
+	_, err := txn.Exec(`
+	INSERT INTO syncv3_forgotten_rooms(user_id, room_id, forgotten_nid)
+	VALUES($1, $2, COALESCE((SELECT latest_nid FROM syncv3_rooms WHERE room_id = $2), 0))
+	ON CONFLICT (user_id, room_id) DO UPDATE SET forgotten_nid = excluded.forgotten_nid`, userID, roomID)
+	return err
+}
+
+// IsForgotten returns true if the user has forgotten the room, and has not been joined or invited
+// to it since.
+func (t *ForgottenRoomsTable) IsForgotten(userID, roomID string) (forgotten bool, err error) {
+	err = t.db.QueryRow(`
+	SELECT EXISTS(
+		SELECT 1 FROM syncv3_forgotten_rooms f WHERE f.user_id = $1 AND f.room_id = $2 AND NOT EXISTS(
+			SELECT 1 FROM syncv3_events e
+			WHERE e.room_id = $2 AND e.event_type = 'm.room.member' AND e.state_key = $1
+			AND e.event_nid > f.forgotten_nid AND e.membership IN ('join', '_join', 'invite', '_invite')
+		) AND NOT EXISTS(
+			-- forgetting deletes the invite, so an invite is a new one
+			SELECT 1 FROM syncv3_invites i WHERE i.user_id = $1 AND i.room_id = $2
+		)
+	)`, userID, roomID).Scan(&forgotten)
+	return
+}
@@ -3,11 +3,25 @@ package state
 import (
 	"database/sql"
 	"encoding/json"
+	"time"
+
 	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
+// RetiredInviteRetention is how long retired invites are remembered. Pollers for different devices
+// of the same user can only be this far out of step with each other before a stale invite can be
+// stored again.
+const RetiredInviteRetention = 24 * time.Hour
+
+// retiredInviteUnknownWindow is how long a retired invite makes invites stale when it is not known
+// which was sent first. A new invite shortly after rejecting one is unlikely, so a lagging poller
+// is the likelier source.
+const retiredInviteUnknownWindow = 5 * time.Minute
+
 // InvitesTable stores invites for each user.
 // Originally, invites were stored with the main events in a room. We ignored stripped state and
 // just kept the m.room.member invite event. This had many problems though:
@@ -28,21 +42,16 @@ import (
 //
 // When an invite is rejected, it appears in the `leave` section which then causes the invite to be
 // removed from this table.
+//
+// Each device of a user is polled separately, so a device whose poll started before the invite was
+// rejected or accepted can still return the invite after another device's poll has removed it. To
+// stop the stale invite coming back, removed invites are "retired": the proxy remembers when the
+// membership event which superseded the invite was sent, and ignores invites sent before then.
 type InvitesTable struct {
 	db *sqlx.DB
 }
 
 func NewInvitesTable(db *sqlx.DB) *InvitesTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_invites (
-		room_id TEXT NOT NULL,
-		user_id TEXT NOT NULL,
-		-- JSON array. The contents of 'rooms.invite.$room_id.invite_state.events'
-		invite_state BYTEA NOT NULL,
-		UNIQUE(user_id, room_id)
-	);
-	`)
 	return &InvitesTable{db}
 }
 
@@ -51,6 +60,55 @@ func (t *InvitesTable) RemoveInvite(userID, roomID string) error {
 	return err
 }
 
+// RetireInvite removes the user's invite to the room, if they have one, and remembers that invites
+// sent before retiredTS are stale. retiredTS is the origin_server_ts of the membership event which
+// superseded the invite, or 0 if unknown.
+func (t *InvitesTable) RetireInvite(userID, roomID string, retiredTS int64) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		if _, err := txn.Exec(`DELETE FROM syncv3_invites WHERE user_id = $1 AND room_id = $2`, userID, roomID); err != nil {
+			return err
+		}
+		return t.retire(txn, []string{userID}, roomID, []int64{retiredTS})
+	})
+}
+
+// retire remembers when invites were superseded. userIDs and retiredTSs are parallel slices.
+func (t *InvitesTable) retire(txn *sqlx.Tx, userIDs []string, roomID string, retiredTSs []int64) error {
+	_, err := txn.Exec(`
+	INSERT INTO syncv3_retired_invites(user_id, room_id, retired_ts, created_at)
+	SELECT user_id, $2, retired_ts, $4 FROM unnest($1::TEXT[], $3::BIGINT[]) AS x(user_id, retired_ts)
+	ON CONFLICT (user_id, room_id) DO UPDATE SET
+		retired_ts = GREATEST(syncv3_retired_invites.retired_ts, excluded.retired_ts), created_at = excluded.created_at`,
+		pq.StringArray(userIDs), roomID, pq.Int64Array(retiredTSs), time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// IsRetired returns true if an invite for this user to the room which was sent at inviteTS is
+// stale, as it was rejected or accepted on another device. An inviteTS of 0 means the time is
+// unknown, in which case the invite is stale if an invite was retired in the last few minutes.
+func (t *InvitesTable) IsRetired(userID, roomID string, inviteTS int64, now time.Time) (retired bool, err error) {
+	err = t.db.QueryRow(`
+	SELECT EXISTS(
+		SELECT 1 FROM syncv3_retired_invites WHERE user_id = $1 AND room_id = $2 AND created_at > $4 AND (
+			($3 > 0 AND retired_ts > 0 AND $3 <= retired_ts) OR (($3 = 0 OR retired_ts = 0) AND created_at > $5)
+		)
+	)`, userID, roomID, inviteTS, now.Add(-RetiredInviteRetention).UnixMilli(),
+		now.Add(-retiredInviteUnknownWindow).UnixMilli(),
+	).Scan(&retired)
+	return
+}
+
+// DeleteRetiredOlderThan forgets invites which were retired before this time. Returns the number
+// of retired invites which were deleted.
+func (t *InvitesTable) DeleteRetiredOlderThan(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_retired_invites WHERE created_at < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // RemoveSupersededInvites accepts a list of events in the given room. The events should
 // either
 //   - contain at most one membership event per user, or else
@@ -62,17 +120,17 @@ func (t *InvitesTable) RemoveInvite(userID, roomID string) error {
 // memberships. Users who final membership is not "invite" have their outstanding
 // invites to this room deleted.
 func (t *InvitesTable) RemoveSupersededInvites(txn *sqlx.Tx, roomID string, newEvents []Event) error {
-	memberships := map[string]string{} // user ID -> memberships
+	memberships := map[string]Event{} // user ID -> latest membership event
 	for _, ev := range newEvents {
 		if ev.Type != "m.room.member" {
 			continue
 		}
-		memberships[ev.StateKey] = ev.Membership
+		memberships[ev.StateKey] = ev
 	}
 
 	var usersToRemove []string
-	for userID, membership := range memberships {
-		if membership != "invite" && membership != "_invite" {
+	for userID, ev := range memberships {
+		if ev.Membership != "invite" && ev.Membership != "_invite" {
 			usersToRemove = append(usersToRemove, userID)
 		}
 	}
@@ -81,12 +139,21 @@ func (t *InvitesTable) RemoveSupersededInvites(txn *sqlx.Tx, roomID string, newE
 		return nil
 	}
 
-	_, err := txn.Exec(`
+	var removed []string
+	err := txn.Select(&removed, `
 		DELETE FROM syncv3_invites
 		WHERE user_id = ANY($1) AND room_id = $2
+		RETURNING user_id
 	`, pq.StringArray(usersToRemove), roomID)
-
-	return err
+	if err != nil || len(removed) == 0 {
+		return err
+	}
+	// only retire invites which existed, rather than remembering every membership change
+	retiredTSs := make([]int64, len(removed))
+	for i, userID := range removed {
+		retiredTSs[i] = gjson.GetBytes(memberships[userID].JSON, "origin_server_ts").Int()
+	}
+	return t.retire(txn, removed, roomID, retiredTSs)
 }
 
 func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []json.RawMessage) error {
@@ -6,6 +6,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestInviteTable(t *testing.T) {
@@ -269,6 +270,75 @@ func TestInviteTable_RemoveSupersededInvites(t *testing.T) {
 	assertInvites(t, table, bob, map[string][]json.RawMessage{})
 }
 
+func TestInviteTable_RetiredInvites(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewInvitesTable(db)
+	alice := "@TestInviteTable_RetiredInvites_alice:localhost"
+	bob := "@TestInviteTable_RetiredInvites_bob:localhost"
+	room := "!TestInviteTable_RetiredInvites:localhost"
+	inviteState := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	now := time.Now()
+
+	if err := table.InsertInvite(alice, room, inviteState); err != nil {
+		t.Fatalf("failed to InsertInvite: %s", err)
+	}
+	assertRetired := func(userID string, inviteTS int64, now time.Time, want bool) {
+		t.Helper()
+		retired, err := table.IsRetired(userID, room, inviteTS, now)
+		if err != nil {
+			t.Fatalf("IsRetired: %s", err)
+		}
+		if retired != want {
+			t.Errorf("IsRetired(%s, %d): got %v want %v", userID, inviteTS, retired, want)
+		}
+	}
+	assertRetired(alice, 1000, now, false)
+
+	t.Log("Alice rejects the invite at ts 2000.")
+	if err := table.RetireInvite(alice, room, 2000); err != nil {
+		t.Fatalf("RetireInvite: %s", err)
+	}
+	assertInvites(t, table, alice, map[string][]json.RawMessage{})
+	t.Log("The invite from before the rejection is stale, a new invite is not.")
+	assertRetired(alice, 1000, now, true)
+	assertRetired(alice, 3000, now, false)
+	t.Log("An invite with an unknown timestamp is only stale shortly after the rejection.")
+	assertRetired(alice, 0, now, true)
+	assertRetired(alice, 0, now.Add(time.Hour), false)
+	t.Log("Retired invites are forgotten eventually.")
+	assertRetired(alice, 1000, now.Add(RetiredInviteRetention+time.Minute), false)
+	assertRetired(bob, 1000, now, false)
+
+	t.Log("Bob accepts his invite, which retires it.")
+	if err := table.InsertInvite(bob, room, inviteState); err != nil {
+		t.Fatalf("failed to InsertInvite: %s", err)
+	}
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return table.RemoveSupersededInvites(txn, room, []Event{{
+			Type:       "m.room.member",
+			StateKey:   bob,
+			Membership: "join",
+			RoomID:     room,
+			JSON:       []byte(`{"origin_server_ts":5000}`),
+		}})
+	})
+	if err != nil {
+		t.Fatalf("failed to RemoveSupersededInvites: %s", err)
+	}
+	assertRetired(bob, 4000, now, true)
+
+	deleted, err := table.DeleteRetiredOlderThan(now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("DeleteRetiredOlderThan: %s", err)
+	}
+	// other tests may have retired invites too
+	if deleted < 2 {
+		t.Errorf("DeleteRetiredOlderThan: deleted %d want at least 2", deleted)
+	}
+	assertRetired(alice, 1000, now, false)
+}
+
 func assertInvites(t *testing.T, table *InvitesTable, user string, expected map[string][]json.RawMessage) {
 	invites, err := table.SelectAllInvitesForUser(user)
 	if err != nil {
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+)
+
+// MalformedEventRetention is how long quarantined events are kept before the cleaner deletes them.
+const MalformedEventRetention = 30 * 24 * time.Hour
+
+// MalformedEventsTable quarantines events from the upstream which failed validation, so that
+// operators can see what the homeserver sent rather than the events silently disappearing.
+type MalformedEventsTable struct {
+	db *sqlx.DB
+}
+
+// MalformedEvent is an event which the accumulator rejected.
+type MalformedEvent struct {
+	ID     int64           `db:"id" json:"id"`
+	RoomID string          `db:"room_id" json:"room_id"`
+	Source string          `db:"source" json:"source"` // "state" or "timeline"
+	Reason string          `db:"reason" json:"reason"`
+	Event  json.RawMessage `db:"event" json:"event"`
+	SeenTS int64           `db:"seen_ts" json:"seen_ts"` // unix millis
+}
+
+func NewMalformedEventsTable(db *sqlx.DB) *MalformedEventsTable {
+	return &MalformedEventsTable{db}
+}
+
+// Insert quarantines the rejected events from the state block or timeline of a room.
+func (t *MalformedEventsTable) Insert(roomID, source string, rejected []rejectedEvent, seenAt time.Time) error {
+	for _, r := range rejected {
+		_, err := t.db.Exec(
+			`INSERT INTO syncv3_malformed_events(room_id, source, reason, event, seen_ts) VALUES($1,$2,$3,$4,$5)`,
+			roomID, source, r.err.Error(), []byte(r.json), seenAt.UnixMilli(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select returns up to limit quarantined events, newest first. If roomID is set, only returns
+// events in that room.
+func (t *MalformedEventsTable) Select(roomID string, limit int) (events []MalformedEvent, err error) {
+	err = t.db.Select(&events, `SELECT id, room_id, source, reason, event, seen_ts FROM syncv3_malformed_events
+	WHERE $1 = '' OR room_id = $1 ORDER BY id DESC LIMIT $2`, roomID, limit)
+	return
+}
+
+// DeleteOlderThan deletes events quarantined before this time, so the table doesn't grow forever.
+func (t *MalformedEventsTable) DeleteOlderThan(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_malformed_events WHERE seen_ts < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// rejectedEvent is an event which failed validation, and why.
+type rejectedEvent struct {
+	json json.RawMessage
+	err  error
+}
+
+// validateEventShape checks the fields which every event from /sync must have, beyond the fields
+// needed to store the event which ensureFieldsSetOnEvent checks. Events without them would
+// otherwise be stored and sent to clients, which may fail to handle them.
+func validateEventShape(evJSON gjson.Result) error {
+	if !evJSON.IsObject() {
+		return fmt.Errorf("event is not a JSON object")
+	}
+	if sender := evJSON.Get("sender"); sender.Type != gjson.String || sender.Str == "" {
+		return fmt.Errorf("event JSON missing sender key")
+	}
+	if ts := evJSON.Get("origin_server_ts"); ts.Type != gjson.Number {
+		return fmt.Errorf("event JSON missing origin_server_ts key")
+	}
+	if content := evJSON.Get("content"); !content.IsObject() {
+		return fmt.Errorf("event content is not a JSON object")
+	}
+	if stateKey := evJSON.Get("state_key"); stateKey.Exists() && stateKey.Type != gjson.String {
+		return fmt.Errorf("event state_key is not a string")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/tidwall/gjson"
+)
+
+func TestValidateEventShape(t *testing.T) {
+	testCases := []struct {
+		name    string
+		event   string
+		wantErr bool
+	}{
+		{name: "valid message", event: `{"event_id":"$a","type":"m.room.message","sender":"@a:b","origin_server_ts":1,"content":{}}`},
+		{name: "valid state", event: `{"event_id":"$a","type":"m.room.name","state_key":"","sender":"@a:b","origin_server_ts":1,"content":{}}`},
+		{name: "not an object", event: `"$a"`, wantErr: true},
+		{name: "missing sender", event: `{"event_id":"$a","type":"m.room.message","origin_server_ts":1,"content":{}}`, wantErr: true},
+		{name: "non-string sender", event: `{"event_id":"$a","type":"m.room.message","sender":1,"origin_server_ts":1,"content":{}}`, wantErr: true},
+		{name: "missing origin_server_ts", event: `{"event_id":"$a","type":"m.room.message","sender":"@a:b","content":{}}`, wantErr: true},
+		{name: "string origin_server_ts", event: `{"event_id":"$a","type":"m.room.message","sender":"@a:b","origin_server_ts":"1","content":{}}`, wantErr: true},
+		{name: "missing content", event: `{"event_id":"$a","type":"m.room.message","sender":"@a:b","origin_server_ts":1}`, wantErr: true},
+		{name: "non-object content", event: `{"event_id":"$a","type":"m.room.message","sender":"@a:b","origin_server_ts":1,"content":[]}`, wantErr: true},
+		{name: "non-string state_key", event: `{"event_id":"$a","type":"m.room.name","state_key":1,"sender":"@a:b","origin_server_ts":1,"content":{}}`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		err := validateEventShape(gjson.Parse(tc.event))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAccumulatorStrictValidationQuarantinesEvents(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	roomID := "!TestAccumulatorStrictValidationQuarantinesEvents:localhost"
+	accumulator := NewAccumulator(db)
+	accumulator.malformedTable = NewMalformedEventsTable(db)
+	accumulator.strictValidation = true
+	_, err := accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$create", "type":"m.room.create", "state_key":"", "sender":"@me:localhost", "origin_server_ts":1, "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"$member", "type":"m.room.member", "state_key":"@me:localhost", "sender":"@me:localhost", "origin_server_ts":2, "content":{"membership":"join"}}`),
+		[]byte(`{"event_id":"$nosender", "type":"m.room.topic", "state_key":"", "origin_server_ts":3, "content":{"topic":"oops"}}`),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	var res AccumulateResult
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		res, err = accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+			[]byte(`{"event_id":"$nocontent", "type":"m.room.message", "sender":"@me:localhost", "origin_server_ts":4}`),
+			[]byte(`{"event_id":"$ok", "type":"m.room.message", "sender":"@me:localhost", "origin_server_ts":5, "content":{"body":"hi"}}`),
+		}})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	if len(res.TimelineNIDs) != 1 {
+		t.Fatalf("Accumulate: stored %d events, want 1", len(res.TimelineNIDs))
+	}
+
+	quarantined, err := accumulator.malformedTable.Select(roomID, 10)
+	if err != nil {
+		t.Fatalf("Select: %s", err)
+	}
+	if len(quarantined) != 2 {
+		t.Fatalf("got %d quarantined events, want 2: %+v", len(quarantined), quarantined)
+	}
+	// newest first
+	wantEventIDs := []string{"$nocontent", "$nosender"}
+	wantSources := []string{"timeline", "state"}
+	for i, ev := range quarantined {
+		if got := gjson.GetBytes(ev.Event, "event_id").Str; got != wantEventIDs[i] {
+			t.Errorf("quarantined event %d: got %s want %s", i, got, wantEventIDs[i])
+		}
+		if ev.Source != wantSources[i] {
+			t.Errorf("quarantined event %d: got source %s want %s", i, ev.Source, wantSources[i])
+		}
+		if ev.Reason == "" {
+			t.Errorf("quarantined event %d has no reason", i)
+		}
+	}
+}
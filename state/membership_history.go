@@ -0,0 +1,103 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// MembershipHistory is every stored membership event of a user in a room, for debugging rooms
+// which the proxy thinks a user is in when they are not, or vice versa.
+type MembershipHistory struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// CurrentSnapshotID is the snapshot of the room's current state, or 0 if the room is unknown.
+	CurrentSnapshotID int64                    `json:"current_snapshot_id"`
+	Events            []MembershipHistoryEvent `json:"events"`
+}
+
+// MembershipHistoryEvent is a membership event, along with the snapshots of room state which
+// include it.
+type MembershipHistoryEvent struct {
+	NID             int64  `json:"nid"`
+	EventID         string `json:"event_id"`
+	Membership      string `json:"membership"`
+	Sender          string `json:"sender"`
+	OriginServerTS  int64  `json:"origin_server_ts"`
+	IsState         bool   `json:"is_state"`
+	MissingPrevious bool   `json:"missing_previous"`
+	// BeforeStateSnapshotID is the snapshot of the room state before this event.
+	BeforeStateSnapshotID int64 `json:"before_state_snapshot_id"`
+	// Snapshots are the IDs of the snapshots which include this event.
+	Snapshots []int64 `json:"snapshots"`
+	// InCurrentState is true if the room's current state includes this event.
+	InCurrentState bool `json:"in_current_state"`
+}
+
+// MembershipHistory loads the membership events of the user in the room, oldest first. This scans
+// the room's snapshots, so is only suitable for debugging.
+func (s *Storage) MembershipHistory(roomID, userID string) (*MembershipHistory, error) {
+	latestNID, err := s.LatestEventNID()
+	if err != nil {
+		return nil, fmt.Errorf("MembershipHistory.LatestEventNID: %w", err)
+	}
+	events, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms([]string{roomID}, "m.room.member", userID, 0, latestNID)
+	if err != nil {
+		return nil, fmt.Errorf("MembershipHistory.SelectEventsWithTypeStateKeyInRooms: %w", err)
+	}
+	history := &MembershipHistory{
+		RoomID: roomID,
+		UserID: userID,
+		Events: make([]MembershipHistoryEvent, 0, len(events)),
+	}
+	nids := make([]int64, len(events))
+	// snapshots from before the first event cannot include any of them
+	var fromSnapshotID int64
+	for i, ev := range events {
+		parsed := gjson.ParseBytes(ev.JSON)
+		history.Events = append(history.Events, MembershipHistoryEvent{
+			NID:                   ev.NID,
+			EventID:               ev.ID,
+			Membership:            parsed.Get("content.membership").Str,
+			Sender:                parsed.Get("sender").Str,
+			OriginServerTS:        parsed.Get("origin_server_ts").Int(),
+			IsState:               ev.IsState,
+			MissingPrevious:       ev.MissingPrevious,
+			BeforeStateSnapshotID: ev.BeforeStateSnapshotID,
+			Snapshots:             []int64{},
+		})
+		nids[i] = ev.NID
+		if i == 0 {
+			fromSnapshotID = ev.BeforeStateSnapshotID
+		}
+	}
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		history.CurrentSnapshotID, err = s.Accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+		if err != nil || len(nids) == 0 {
+			return err
+		}
+		snapshots, err := s.Accumulator.snapshotTable.SelectWithMembershipNIDs(txn, roomID, fromSnapshotID, nids)
+		if err != nil {
+			return err
+		}
+		for i := range history.Events {
+			ev := &history.Events[i]
+			if snapshotIDs, ok := snapshots[ev.NID]; ok {
+				ev.Snapshots = snapshotIDs
+			}
+			for _, snapshotID := range ev.Snapshots {
+				if snapshotID == history.CurrentSnapshotID {
+					ev.InCurrentState = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MembershipHistory: failed to load snapshots: %w", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,292 @@
+-- The tables the proxy used to create on startup, before its schema was managed by migrations.
+-- This is the schema as of the latest migration which existed then, as later migrations to
+-- these tables only alter what is missing. Existing databases already have these tables, so this
+-- is applied to them as a missing migration, which creates nothing. New tables and changes to these
+-- ones must go in new migrations.
+
+-- +goose Up
+CREATE SEQUENCE IF NOT EXISTS syncv3_event_nids_seq;
+CREATE TABLE IF NOT EXISTS syncv3_events (
+    event_nid BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_nids_seq'),
+    event_id TEXT NOT NULL UNIQUE,
+    before_state_snapshot_id BIGINT NOT NULL DEFAULT 0,
+    -- which nid gets replaced in the snapshot with event_nid
+    event_replaces_nid BIGINT NOT NULL DEFAULT 0,
+    room_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    state_key TEXT NOT NULL,
+    prev_batch TEXT,
+    membership TEXT,
+    is_state BOOLEAN NOT NULL, -- is this event part of the v2 state response?
+    event BYTEA NOT NULL,
+    -- True iff this event was seen at the start of the timeline in a limited sync
+    -- (i.e. the preceding timeline event was not known to the proxy).
+    missing_previous BOOLEAN NOT NULL DEFAULT FALSE,
+    origin_server_ts BIGINT NOT NULL DEFAULT 0
+);
+-- index for querying all joined rooms for a given user
+CREATE INDEX IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
+-- index for querying membership deltas in particular rooms
+CREATE INDEX IF NOT EXISTS syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid);
+-- index for querying events in a given room
+CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
+CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
+
+CREATE SEQUENCE IF NOT EXISTS syncv3_snapshots_seq;
+CREATE TABLE IF NOT EXISTS syncv3_snapshots (
+    snapshot_id BIGINT PRIMARY KEY DEFAULT nextval('syncv3_snapshots_seq'),
+    room_id TEXT NOT NULL,
+    events BIGINT[] NOT NULL,
+    membership_events BIGINT[] NOT NULL,
+    base_snapshot_id BIGINT NOT NULL DEFAULT 0,
+    removed_events BIGINT[] NOT NULL DEFAULT '{}',
+    compacted BOOLEAN NOT NULL DEFAULT FALSE,
+    UNIQUE(snapshot_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_rooms (
+    room_id TEXT NOT NULL PRIMARY KEY,
+    current_snapshot_id BIGINT NOT NULL,
+    is_encrypted BOOL NOT NULL DEFAULT FALSE,
+    upgraded_room_id TEXT,
+    predecessor_room_id TEXT,
+    latest_nid BIGINT NOT NULL DEFAULT 0,
+    type TEXT -- nullable
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_spaces (
+    parent TEXT NOT NULL,
+    child TEXT NOT NULL,
+    relation SMALLINT NOT NULL,
+    suggested BOOL NOT NULL,
+    ordering TEXT NOT NULL, -- "" for unset
+    UNIQUE(parent, child, relation)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_invites (
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    -- JSON array. The contents of 'rooms.invite.$room_id.invite_state.events'
+    invite_state BYTEA NOT NULL,
+    UNIQUE(user_id, room_id)
+);
+CREATE TABLE IF NOT EXISTS syncv3_retired_invites (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    -- the origin_server_ts of the membership event which superseded the invite, or 0 if unknown
+    retired_ts BIGINT NOT NULL,
+    -- when the invite was retired, in unix milliseconds
+    created_at BIGINT NOT NULL,
+    UNIQUE(user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_malformed_events (
+    id BIGSERIAL PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    event BYTEA NOT NULL,
+    seen_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncv3_malformed_events_room_idx ON syncv3_malformed_events(room_id, id);
+
+CREATE SEQUENCE IF NOT EXISTS syncv3_to_device_messages_seq;
+CREATE TABLE IF NOT EXISTS syncv3_to_device_messages (
+    position BIGINT NOT NULL PRIMARY KEY DEFAULT nextval('syncv3_to_device_messages_seq'),
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    message TEXT NOT NULL,
+    -- nullable as these fields are not on all to-device events
+    unique_key TEXT,
+    action SMALLINT DEFAULT 0, -- 0 means unknown
+    received_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id),
+    unack_pos BIGINT NOT NULL,
+    -- the number of undelivered messages dropped by the quota since the device last synced
+    dropped BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
+
+CREATE TABLE IF NOT EXISTS syncv3_unread (
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    notification_count BIGINT NOT NULL DEFAULT 0,
+    highlight_count BIGINT NOT NULL DEFAULT 0,
+    unread_count BIGINT NOT NULL DEFAULT 0,
+    UNIQUE(user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_unread_threads (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    thread_id TEXT NOT NULL,
+    notification_count BIGINT NOT NULL DEFAULT 0,
+    highlight_count BIGINT NOT NULL DEFAULT 0,
+    UNIQUE(user_id, room_id, thread_id)
+);
+
+CREATE SEQUENCE IF NOT EXISTS syncv3_account_data_seq;
+CREATE TABLE IF NOT EXISTS syncv3_account_data (
+    id BIGINT NOT NULL DEFAULT nextval('syncv3_account_data_seq'),
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL, -- optional if global
+    type TEXT NOT NULL,
+    data BYTEA NOT NULL,
+    version BIGINT NOT NULL DEFAULT 1,
+    UNIQUE(user_id, room_id, type)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_room_summaries (
+    room_id TEXT NOT NULL PRIMARY KEY,
+    summary BYTEA NOT NULL,
+    fetched_at BIGINT NOT NULL -- unix millis
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_txns (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    txn_id TEXT NOT NULL,
+    ts BIGINT NOT NULL,
+    UNIQUE(user_id, device_id, event_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_device_data (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    data BYTEA NOT NULL,
+    UNIQUE(user_id, device_id)
+);
+-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
+-- change the data, not anything indexed like the id)
+ALTER TABLE syncv3_device_data SET (fillfactor = 90);
+
+CREATE TABLE IF NOT EXISTS syncv3_device_list_updates (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    target_user_id TEXT NOT NULL,
+    target_state SMALLINT NOT NULL,
+    bucket SMALLINT NOT NULL,
+    UNIQUE(user_id, device_id, target_user_id, bucket)
+);
+-- make an index so selecting all the rows is faster
+CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_bucket_idx ON syncv3_device_list_updates(user_id, device_id, bucket);
+-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
+-- change the data, not anything indexed like the id)
+ALTER TABLE syncv3_device_list_updates SET (fillfactor = 90);
+
+-- we make 2 receipt tables to reduce the compound key size to be just room/user/thread and not
+-- room/user/thread/receipt_type. This should help performance somewhat when querying. Other than
+-- that, the tables are identical.
+CREATE TABLE IF NOT EXISTS syncv3_receipts (
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    thread_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    ts BIGINT NOT NULL,
+    UNIQUE(room_id, user_id, thread_id)
+);
+-- for querying by events in the timeline, need to search by event id
+CREATE INDEX IF NOT EXISTS syncv3_receipts_by_event_idx ON syncv3_receipts(room_id, event_id);
+-- for querying all receipts for a user in a room, need to search by user id
+CREATE INDEX IF NOT EXISTS syncv3_receipts_by_user_idx ON syncv3_receipts(room_id, user_id);
+CREATE TABLE IF NOT EXISTS syncv3_receipts_private (
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    thread_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    ts BIGINT NOT NULL,
+    UNIQUE(room_id, user_id, thread_id)
+);
+CREATE INDEX IF NOT EXISTS syncv3_receipts_private_by_event_idx ON syncv3_receipts_private(room_id, event_id);
+CREATE INDEX IF NOT EXISTS syncv3_receipts_private_by_user_idx ON syncv3_receipts_private(room_id, user_id);
+
+CREATE TABLE IF NOT EXISTS syncv3_presence (
+    user_id TEXT NOT NULL PRIMARY KEY,
+    presence TEXT NOT NULL,
+    status_msg TEXT,
+    currently_active BOOLEAN NOT NULL,
+    last_active_ts BIGINT NOT NULL -- unix millis
+);
+
+CREATE SEQUENCE IF NOT EXISTS syncv3_typing_seq;
+CREATE TABLE IF NOT EXISTS syncv3_typing (
+    stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_typing_seq'),
+    room_id TEXT NOT NULL PRIMARY KEY,
+    user_ids TEXT[] NOT NULL,
+    expires_ts BIGINT NOT NULL DEFAULT 0 -- unix millis after which nobody is typing
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_conn_requests (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    conn_id TEXT NOT NULL,
+    request BYTEA NOT NULL,
+    updated_at BIGINT NOT NULL, -- unix millis
+    UNIQUE(user_id, device_id, conn_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_forgotten_rooms (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    -- the latest event NID in the room when it was forgotten
+    forgotten_nid BIGINT NOT NULL,
+    UNIQUE(user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_sync2_devices (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id),
+    since TEXT NOT NULL,
+    last_poll_ts BIGINT NOT NULL DEFAULT 0, -- unix millis of the last poll which stored a since token
+    soft_logout_ts BIGINT NOT NULL DEFAULT 0 -- unix millis of the last soft logout, 0 if polled since
+);
+
+CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
+    token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
+    token_encrypted TEXT NOT NULL,
+    -- TODO: FK constraints to devices table?
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    last_seen TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS syncv3_sync2_tokens;
+DROP TABLE IF EXISTS syncv3_sync2_devices;
+DROP TABLE IF EXISTS syncv3_forgotten_rooms;
+DROP TABLE IF EXISTS syncv3_conn_requests;
+DROP TABLE IF EXISTS syncv3_typing;
+DROP SEQUENCE IF EXISTS syncv3_typing_seq;
+DROP TABLE IF EXISTS syncv3_presence;
+DROP TABLE IF EXISTS syncv3_receipts_private;
+DROP TABLE IF EXISTS syncv3_receipts;
+DROP TABLE IF EXISTS syncv3_device_list_updates;
+DROP TABLE IF EXISTS syncv3_device_data;
+DROP TABLE IF EXISTS syncv3_txns;
+DROP TABLE IF EXISTS syncv3_room_summaries;
+DROP TABLE IF EXISTS syncv3_account_data;
+DROP SEQUENCE IF EXISTS syncv3_account_data_seq;
+DROP TABLE IF EXISTS syncv3_unread_threads;
+DROP TABLE IF EXISTS syncv3_unread;
+DROP TABLE IF EXISTS syncv3_to_device_ack_pos;
+DROP TABLE IF EXISTS syncv3_to_device_messages;
+DROP SEQUENCE IF EXISTS syncv3_to_device_messages_seq;
+DROP TABLE IF EXISTS syncv3_malformed_events;
+DROP TABLE IF EXISTS syncv3_retired_invites;
+DROP TABLE IF EXISTS syncv3_invites;
+DROP TABLE IF EXISTS syncv3_spaces;
+DROP TABLE IF EXISTS syncv3_rooms;
+DROP TABLE IF EXISTS syncv3_snapshots;
+DROP SEQUENCE IF EXISTS syncv3_snapshots_seq;
+DROP TABLE IF EXISTS syncv3_events;
+DROP SEQUENCE IF EXISTS syncv3_event_nids_seq;
@@ -23,6 +23,18 @@ func connectToDB(t *testing.T) (*sqlx.DB, func()) {
 	}
 }
 
+// connectToDBWithSchema is like connectToDB, but the database has every table in the latest schema.
+func connectToDBWithSchema(t *testing.T) (*sqlx.DB, func()) {
+	postgresConnectionString = testutils.PrepareDBWithSchema()
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	return db, func() {
+		db.Close()
+	}
+}
+
 func TestJSONBMigration(t *testing.T) {
 	ctx := context.Background()
 	db, close := connectToDB(t)
@@ -20,7 +20,7 @@ func init() {
 func upCborDeviceData(ctx context.Context, tx *sql.Tx) error {
 	// check if we even need to do anything
 	var dataType string
-	err := tx.QueryRow("select data_type from information_schema.columns where table_name = 'syncv3_device_data' AND column_name = 'data'").Scan(&dataType)
+	err := tx.QueryRow("select data_type from information_schema.columns where table_schema = current_schema() AND table_name = 'syncv3_device_data' AND column_name = 'data'").Scan(&dataType)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			// The table/column doesn't exist in is likely going to be created soon with the
@@ -15,7 +15,7 @@ import (
 var deadInviteMigration embed.FS
 
 func TestDeadInviteCleanup(t *testing.T) {
-	db, close := connectToDB(t)
+	db, close := connectToDBWithSchema(t)
 	defer close()
 	store := state.NewStorageWithDB(db, false)
 
@@ -14,7 +14,7 @@ import (
 )
 
 func TestClearStuckInvites(t *testing.T) {
-	db, close := connectToDB(t)
+	db, close := connectToDBWithSchema(t)
 	defer close()
 	roomsTable := state.NewRoomsTable(db)
 	inviteTable := state.NewInvitesTable(db)
@@ -102,7 +102,7 @@ func TestClearStuckInvites(t *testing.T) {
 				}
 			}
 			if info.unreadUser != "" {
-				err := unreadTable.UpdateUnreadCounters(info.unreadUser, roomID, &zero, &zero)
+				err := unreadTable.UpdateUnreadCounters(info.unreadUser, roomID, &zero, &zero, nil)
 				if err != nil {
 					return fmt.Errorf("UpdateUnreadCounters: %s", err)
 				}
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ADD COLUMN IF NOT EXISTS received_at BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    DROP COLUMN IF EXISTS received_at;
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_sync2_devices
+    ADD COLUMN IF NOT EXISTS last_poll_ts BIGINT NOT NULL DEFAULT 0;
+-- existing devices have an unknown last poll, so count them as polled now rather than removing
+-- them as stale straight away
+UPDATE syncv3_sync2_devices SET last_poll_ts = (EXTRACT(EPOCH FROM now()) * 1000)::BIGINT WHERE last_poll_ts = 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_sync2_devices
+    DROP COLUMN IF EXISTS last_poll_ts;
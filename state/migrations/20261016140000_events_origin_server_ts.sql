@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_events
+    ADD COLUMN IF NOT EXISTS origin_server_ts BIGINT NOT NULL DEFAULT 0;
+
+-- index for finding the latest activity in a room before a timestamp
+CREATE INDEX IF NOT EXISTS syncv3_events_room_ts_idx ON syncv3_events(room_id, origin_server_ts);
+-- index for finding the events which existed before the column, which Storage.BackfillOriginServerTS
+-- sets in batches in the background rather than rewriting the whole table here
+CREATE INDEX IF NOT EXISTS syncv3_events_unset_ts_idx ON syncv3_events(event_nid) WHERE origin_server_ts = 0;
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_events_unset_ts_idx;
+DROP INDEX IF EXISTS syncv3_events_room_ts_idx;
+ALTER TABLE IF EXISTS syncv3_events
+    DROP COLUMN IF EXISTS origin_server_ts;
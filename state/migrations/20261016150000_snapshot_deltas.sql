@@ -0,0 +1,23 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_snapshots
+    ADD COLUMN IF NOT EXISTS base_snapshot_id BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS removed_events BIGINT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS compacted BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- index for finding the snapshots of a room which have not been compacted, and its latest full snapshot
+CREATE INDEX IF NOT EXISTS syncv3_snapshots_room_compacted_idx ON syncv3_snapshots(room_id, compacted, snapshot_id);
+-- index for finding whether a snapshot is the base of a delta
+CREATE INDEX IF NOT EXISTS syncv3_snapshots_base_idx ON syncv3_snapshots(base_snapshot_id) WHERE base_snapshot_id != 0;
+
+-- +goose Down
+-- expand the deltas back into full snapshots
+UPDATE syncv3_snapshots AS snap SET
+    events = ARRAY(SELECT unnest(base.events || snap.events) EXCEPT SELECT unnest(snap.removed_events)),
+    membership_events = ARRAY(SELECT unnest(base.membership_events || snap.membership_events) EXCEPT SELECT unnest(snap.removed_events))
+    FROM syncv3_snapshots AS base WHERE base.snapshot_id = snap.base_snapshot_id;
+DROP INDEX IF EXISTS syncv3_snapshots_base_idx;
+DROP INDEX IF EXISTS syncv3_snapshots_room_compacted_idx;
+ALTER TABLE IF EXISTS syncv3_snapshots
+    DROP COLUMN IF EXISTS compacted,
+    DROP COLUMN IF EXISTS removed_events,
+    DROP COLUMN IF EXISTS base_snapshot_id;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_sync2_devices
+    ADD COLUMN IF NOT EXISTS soft_logout_ts BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_sync2_devices
+    DROP COLUMN IF EXISTS soft_logout_ts;
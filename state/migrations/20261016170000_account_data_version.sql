@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_account_data
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- index for finding the account data which changed since an ID
+CREATE INDEX IF NOT EXISTS syncv3_account_data_user_id_idx ON syncv3_account_data(user_id, id);
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_account_data_user_id_idx;
+ALTER TABLE IF EXISTS syncv3_account_data
+    DROP COLUMN IF EXISTS version;
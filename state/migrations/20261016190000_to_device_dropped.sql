@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_to_device_ack_pos
+    ADD COLUMN IF NOT EXISTS dropped BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_to_device_ack_pos
+    DROP COLUMN IF EXISTS dropped;
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// PresenceTable stores the latest presence of each user seen by any poller, so initial presence
+// extension responses can include users who haven't changed presence since the client connected.
+type PresenceTable struct {
+	db *sqlx.DB
+}
+
+func NewPresenceTable(db *sqlx.DB) *PresenceTable {
+	return &PresenceTable{db}
+}
+
+// Upsert the presence of these users, returning the presences which changed from the stored ones.
+// The same presence is seen by every poller whose user shares a room with the user, so most
+// calls change nothing. If several pollers race to store the same change, it may be returned more
+// than once.
+func (t *PresenceTable) Upsert(presences []internal.Presence) (changed []internal.Presence, err error) {
+	if len(presences) == 0 {
+		return nil, nil
+	}
+	userIDs := make([]string, len(presences))
+	for i := range presences {
+		userIDs[i] = presences[i].UserID
+	}
+	existing, err := t.Select(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range presences {
+		prev, ok := existing[p.UserID]
+		if ok && !p.ChangedFrom(prev) {
+			continue
+		}
+		if ok && p.LastActiveTS < prev.LastActiveTS {
+			// keep the more recent activity if this poller is behind
+			p.LastActiveTS = prev.LastActiveTS
+		}
+		_, err = t.db.NamedExec(
+			`INSERT INTO syncv3_presence(user_id, presence, status_msg, currently_active, last_active_ts)
+			VALUES(:user_id, :presence, :status_msg, :currently_active, :last_active_ts)
+			ON CONFLICT (user_id) DO UPDATE SET presence = :presence, status_msg = :status_msg,
+			currently_active = :currently_active, last_active_ts = :last_active_ts`, p,
+		)
+		if err != nil {
+			return nil, err
+		}
+		existing[p.UserID] = p
+		changed = append(changed, p)
+	}
+	return changed, nil
+}
+
+// Select the stored presence for these users. Users without a stored presence are not in the map.
+func (t *PresenceTable) Select(userIDs []string) (map[string]internal.Presence, error) {
+	var rows []internal.Presence
+	err := t.db.Select(&rows,
+		`SELECT user_id, presence, status_msg, currently_active, last_active_ts FROM syncv3_presence WHERE user_id = ANY($1)`,
+		pq.StringArray(userIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]internal.Presence, len(rows))
+	for _, p := range rows {
+		result[p.UserID] = p
+	}
+	return result, nil
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestPresenceTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewPresenceTable(db)
+	alice := "@alice_TestPresenceTable:localhost"
+	bob := "@bob_TestPresenceTable:localhost"
+	status := "lunch"
+
+	changed, err := table.Upsert([]internal.Presence{
+		{UserID: alice, Presence: "online", CurrentlyActive: true, LastActiveTS: 1000000},
+		{UserID: bob, Presence: "unavailable", StatusMsg: &status, LastActiveTS: 500000},
+	})
+	assertNoError(t, err)
+	if len(changed) != 2 {
+		t.Fatalf("Upsert: got %d changed want 2", len(changed))
+	}
+
+	// same presence seen by another poller, with slightly newer activity: no change
+	changed, err = table.Upsert([]internal.Presence{
+		{UserID: alice, Presence: "online", CurrentlyActive: true, LastActiveTS: 1001000},
+	})
+	assertNoError(t, err)
+	if len(changed) != 0 {
+		t.Fatalf("Upsert: got %d changed want 0: %+v", len(changed), changed)
+	}
+
+	// bob comes back online, from a poller which is behind on bob's activity
+	changed, err = table.Upsert([]internal.Presence{
+		{UserID: bob, Presence: "online", LastActiveTS: 400000},
+	})
+	assertNoError(t, err)
+	if len(changed) != 1 || changed[0].UserID != bob || changed[0].LastActiveTS != 500000 {
+		t.Fatalf("Upsert: got changed %+v want bob with last active 500000", changed)
+	}
+
+	got, err := table.Select([]string{alice, bob, "@unknown:localhost"})
+	assertNoError(t, err)
+	if len(got) != 2 {
+		t.Fatalf("Select: got %d presences want 2", len(got))
+	}
+	if p := got[alice]; p.Presence != "online" || !p.CurrentlyActive || p.StatusMsg != nil || p.LastActiveTS != 1000000 {
+		t.Errorf("Select: alice got %+v", p)
+	}
+	if p := got[bob]; p.Presence != "online" || p.StatusMsg != nil || p.LastActiveTS != 500000 {
+		t.Errorf("Select: bob got %+v", p)
+	}
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SetReadReplica sends the heaviest reads, which are room state snapshots, timelines and the
+// startup GlobalSnapshot, to a read-only replica of the database so they don't load the primary.
+// Writes always go to the primary. As the replica lags behind the primary, reads at an event
+// position the replica hasn't replicated yet go to the primary instead. Disabled if nil. Must be
+// called before serving requests.
+func (s *Storage) SetReadReplica(db *sqlx.DB) {
+	s.replicaDB = db
+}
+
+// readDB returns the database to read data at event NID `pos` from, which is the read replica if
+// it has replicated that far, else the primary. onReplica is true if the replica was returned.
+func (s *Storage) readDB(pos int64) (db *sqlx.DB, onReplica bool) {
+	if s.replicaDB == nil {
+		return s.Accumulator.db, false
+	}
+	// the replica only moves forwards, so if it was far enough along before it still is
+	if s.replicaPos.Load() >= pos {
+		return s.replicaDB, true
+	}
+	var replicaPos sql.NullInt64
+	if err := s.replicaDB.QueryRow(`SELECT MAX(event_nid) FROM syncv3_events`).Scan(&replicaPos); err != nil {
+		logger.Warn().Err(err).Int64("pos", pos).Msg("failed to query read replica position, reading from the primary")
+		return s.Accumulator.db, false
+	}
+	if replicaPos.Int64 > s.replicaPos.Load() {
+		s.replicaPos.Store(replicaPos.Int64)
+	}
+	if replicaPos.Int64 < pos {
+		logger.Trace().Int64("pos", pos).Int64("replica_pos", replicaPos.Int64).Msg("read replica is behind, reading from the primary")
+		return s.Accumulator.db, false
+	}
+	return s.replicaDB, true
+}
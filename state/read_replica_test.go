@@ -0,0 +1,50 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestStorageReadReplica(t *testing.T) {
+	assertNoError(t, cleanDB(t))
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	// the test database is its own replica, which is always caught up
+	replica, close := connectToDB(t)
+	defer close()
+
+	roomID := "!replica:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", "@alice:localhost", map[string]interface{}{"creator": "@alice:localhost"}),
+		testutils.NewJoinEvent(t, "@alice:localhost"),
+	})
+	assertNoError(t, err)
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+
+	if db, onReplica := store.readDB(latestNID); onReplica || db != store.Accumulator.db {
+		t.Errorf("readDB without a replica: got the replica")
+	}
+	store.SetReadReplica(replica)
+	if db, onReplica := store.readDB(latestNID); !onReplica || db != replica {
+		t.Errorf("readDB(%d): got the primary, want the replica which has caught up", latestNID)
+	}
+	if db, onReplica := store.readDB(latestNID + 1); onReplica || db != store.Accumulator.db {
+		t.Errorf("readDB(%d): got the replica, want the primary as the replica is behind", latestNID+1)
+	}
+
+	// reads from the replica return the same data
+	roomToEvents, err := store.RoomStateAfterEventPosition(context.Background(), []string{roomID}, latestNID, nil)
+	assertNoError(t, err)
+	if len(roomToEvents[roomID]) != 2 {
+		t.Errorf("RoomStateAfterEventPosition: got %d events want 2", len(roomToEvents[roomID]))
+	}
+	snapshot, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+	if joined := snapshot.AllJoinedMembers[roomID]; len(joined) != 1 || joined[0] != "@alice:localhost" {
+		t.Errorf("GlobalSnapshot: got joined members %v want [@alice:localhost]", joined)
+	}
+}
@@ -30,29 +30,6 @@ type ReceiptTable struct {
 }
 
 func NewReceiptTable(db *sqlx.DB) *ReceiptTable {
-	// we make 2 tables here to reduce the compound key size to be just room/user/thread and not
-	// room/user/thread/receipt_type. This should help performance somewhat when querying. Other than
-	// that, the tables are identical.
-	tableNames := []string{
-		"syncv3_receipts", "syncv3_receipts_private",
-	}
-	schema := `
-	CREATE TABLE IF NOT EXISTS %s (
-		room_id TEXT NOT NULL,
-		user_id TEXT NOT NULL,
-		thread_id TEXT NOT NULL,
-		event_id TEXT NOT NULL,
-		ts BIGINT NOT NULL,
-		UNIQUE(room_id, user_id, thread_id)
-	);
-	-- for querying by events in the timeline, need to search by event id
-	CREATE INDEX IF NOT EXISTS %s_by_event_idx ON %s(room_id, event_id);
-	-- for querying all receipts for a user in a room, need to search by user id
-	CREATE INDEX IF NOT EXISTS %s_by_user_idx ON %s(room_id, user_id);
-	`
-	for _, tableName := range tableNames {
-		db.MustExec(fmt.Sprintf(schema, tableName, tableName, tableName, tableName, tableName))
-	}
 	return &ReceiptTable{db}
 }
 
@@ -261,3 +238,44 @@ func (c ReceiptChunker) Len() int {
 func (c ReceiptChunker) Subslice(i, j int) sqlutil.Chunker {
 	return c[i:j]
 }
+
+// Compact deletes private receipts which are older than the user's public receipt for the same
+// room and thread. Each table already only holds the latest receipt of its type for each room,
+// user and thread, but clients use whichever of a user's public and private receipts is most
+// recent, so an older private receipt has no effect. Returns the number of receipts deleted.
+func (t *ReceiptTable) Compact() (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_receipts_private AS priv USING syncv3_receipts AS pub
+		WHERE priv.room_id = pub.room_id AND priv.user_id = pub.user_id AND priv.thread_id = pub.thread_id
+		AND priv.ts <= pub.ts`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Vacuum vacuums and analyzes the receipt tables, to reclaim the space used by receipts which
+// have been updated or deleted. Receipts are updated far more often than most rows, which can
+// leave the tables bloated if autovacuum falls behind.
+func (t *ReceiptTable) Vacuum() error {
+	// VACUUM cannot run inside a transaction, so this must use the DB directly
+	_, err := t.db.Exec(`VACUUM (ANALYZE) syncv3_receipts, syncv3_receipts_private`)
+	return err
+}
+
+// ReceiptTableStats is the size of one of the receipt tables.
+type ReceiptTableStats struct {
+	// Rows is postgres' estimate of the number of rows, as counting them would be slow.
+	Rows int64
+	// Bytes is the size on disk, including indexes.
+	Bytes int64
+}
+
+// Stats returns the size of the public and private receipt tables.
+func (t *ReceiptTable) Stats() (public, private ReceiptTableStats, err error) {
+	query := `SELECT GREATEST(reltuples, 0)::BIGINT, pg_total_relation_size(oid) FROM pg_class WHERE oid = $1::regclass`
+	if err = t.db.QueryRow(query, "syncv3_receipts").Scan(&public.Rows, &public.Bytes); err != nil {
+		return
+	}
+	err = t.db.QueryRow(query, "syncv3_receipts_private").Scan(&private.Rows, &private.Bytes)
+	return
+}
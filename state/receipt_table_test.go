@@ -388,3 +388,55 @@ func TestReceiptTable(t *testing.T) {
 		},
 	})
 }
+
+func TestReceiptTableCompact(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewReceiptTable(db)
+	roomID := "!compact:ReceiptTableCompact"
+	alice := "@alice:ReceiptTableCompact"
+	bob := "@bob:ReceiptTableCompact"
+	// alice's private receipt is older than her public one, bob's is newer
+	_, err := table.Insert(roomID, json.RawMessage(`{
+		"type": "m.receipt",
+		"content": {
+			"$old": {
+				"m.read.private": {"@alice:ReceiptTableCompact": {"ts": 1000}}
+			},
+			"$new": {
+				"m.read": {"@alice:ReceiptTableCompact": {"ts": 2000}, "@bob:ReceiptTableCompact": {"ts": 2000}},
+				"m.read.private": {"@alice:ReceiptTableCompact": {"ts": 1500, "thread_id": "$thread"}}
+			},
+			"$newest": {
+				"m.read.private": {"@bob:ReceiptTableCompact": {"ts": 3000}}
+			}
+		}
+	}`))
+	assertNoError(t, err)
+
+	deleted, err := table.Compact()
+	assertNoError(t, err)
+	if deleted != 1 {
+		t.Errorf("Compact: deleted %d receipts, want 1", deleted)
+	}
+	got, err := table.SelectReceiptsForUser([]string{roomID}, alice)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got[roomID], []internal.Receipt{
+		{RoomID: roomID, EventID: "$new", UserID: alice, TS: 2000},
+		// threaded receipts are only superseded by public receipts in the same thread
+		{RoomID: roomID, EventID: "$new", UserID: alice, TS: 1500, ThreadID: "$thread", IsPrivate: true},
+	})
+	got, err = table.SelectReceiptsForUser([]string{roomID}, bob)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got[roomID], []internal.Receipt{
+		{RoomID: roomID, EventID: "$new", UserID: bob, TS: 2000},
+		{RoomID: roomID, EventID: "$newest", UserID: bob, TS: 3000, IsPrivate: true},
+	})
+
+	assertNoError(t, table.Vacuum())
+	public, private, err := table.Stats()
+	assertNoError(t, err)
+	if public.Bytes == 0 || private.Bytes == 0 {
+		t.Errorf("Stats: got sizes %+v %+v, want non-zero", public, private)
+	}
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// RoomSummariesTable caches MSC3266 room summaries fetched from the upstream, for rooms the proxy
+// has been invited to but knows nothing else about.
+type RoomSummariesTable struct {
+	db *sqlx.DB
+}
+
+// CachedRoomSummary is a room summary along with when it was fetched from the upstream.
+type CachedRoomSummary struct {
+	internal.RoomSummary
+	FetchedAt time.Time
+}
+
+func NewRoomSummariesTable(db *sqlx.DB) *RoomSummariesTable {
+	return &RoomSummariesTable{db}
+}
+
+func (t *RoomSummariesTable) Upsert(roomID string, summary internal.RoomSummary, fetchedAt time.Time) error {
+	blob, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.Exec(
+		`INSERT INTO syncv3_room_summaries(room_id, summary, fetched_at) VALUES($1,$2,$3)
+		ON CONFLICT (room_id) DO UPDATE SET summary = $2, fetched_at = $3`,
+		roomID, blob, fetchedAt.UnixMilli(),
+	)
+	return err
+}
+
+// Select the cached summaries for these rooms. Rooms without a summary are not in the map.
+func (t *RoomSummariesTable) Select(roomIDs []string) (map[string]CachedRoomSummary, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, summary, fetched_at FROM syncv3_room_summaries WHERE room_id = ANY($1)`, pq.StringArray(roomIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]CachedRoomSummary)
+	var roomID string
+	var blob json.RawMessage
+	var fetchedAt int64
+	for rows.Next() {
+		if err := rows.Scan(&roomID, &blob, &fetchedAt); err != nil {
+			return nil, err
+		}
+		var summary internal.RoomSummary
+		if err := json.Unmarshal(blob, &summary); err != nil {
+			return nil, err
+		}
+		result[roomID] = CachedRoomSummary{
+			RoomSummary: summary,
+			FetchedAt:   time.UnixMilli(fetchedAt),
+		}
+	}
+	return result, rows.Err()
+}
+
+// DeleteUnused deletes summaries for rooms which nobody has an outstanding invite for.
+func (t *RoomSummariesTable) DeleteUnused() (int64, error) {
+	res, err := t.db.Exec(
+		`DELETE FROM syncv3_room_summaries WHERE room_id NOT IN (SELECT room_id FROM syncv3_invites)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,51 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestRoomSummariesTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewRoomSummariesTable(db)
+	invites := NewInvitesTable(db)
+	alice := "@alice_TestRoomSummariesTable:localhost"
+	roomA := "!a_TestRoomSummariesTable:localhost"
+	roomB := "!b_TestRoomSummariesTable:localhost"
+	fetchedAt := time.UnixMilli(1700000000000)
+
+	summaryA := internal.RoomSummary{RoomID: roomA, Name: "A", NumJoinedMembers: 3}
+	assertNoError(t, table.Upsert(roomA, summaryA, fetchedAt))
+	assertNoError(t, table.Upsert(roomB, internal.RoomSummary{RoomID: roomB, Name: "old"}, fetchedAt))
+	summaryB := internal.RoomSummary{RoomID: roomB, Name: "B", Topic: "topic"}
+	assertNoError(t, table.Upsert(roomB, summaryB, fetchedAt.Add(time.Hour)))
+
+	got, err := table.Select([]string{roomA, roomB, "!unknown:localhost"})
+	assertNoError(t, err)
+	want := map[string]CachedRoomSummary{
+		roomA: {RoomSummary: summaryA, FetchedAt: fetchedAt},
+		roomB: {RoomSummary: summaryB, FetchedAt: fetchedAt.Add(time.Hour)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Select: got %d summaries want %d", len(got), len(want))
+	}
+	for roomID, w := range want {
+		if g := got[roomID]; g.RoomSummary != w.RoomSummary || !g.FetchedAt.Equal(w.FetchedAt) {
+			t.Errorf("Select: room %s got %+v want %+v", roomID, g, w)
+		}
+	}
+
+	// only summaries for rooms with outstanding invites are kept
+	assertNoError(t, invites.InsertInvite(alice, roomA, []json.RawMessage{[]byte(`{}`)}))
+	_, err = table.DeleteUnused()
+	assertNoError(t, err)
+	got, err = table.Select([]string{roomA, roomB})
+	assertNoError(t, err)
+	if _, ok := got[roomA]; !ok || len(got) != 1 {
+		t.Errorf("DeleteUnused: got summaries %+v want only %s", got, roomA)
+	}
+}
@@ -20,18 +20,6 @@ type RoomInfo struct {
 type RoomsTable struct{}
 
 func NewRoomsTable(db *sqlx.DB) *RoomsTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_rooms (
-		room_id TEXT NOT NULL PRIMARY KEY,
-		current_snapshot_id BIGINT NOT NULL,
-		is_encrypted BOOL NOT NULL DEFAULT FALSE,
-		upgraded_room_id TEXT,
-		predecessor_room_id TEXT,
-		latest_nid BIGINT NOT NULL DEFAULT 0,
-		type TEXT -- nullable
-	);
-	`)
 	return &RoomsTable{}
 }
 
@@ -40,6 +28,19 @@ func (t *RoomsTable) SelectRoomInfos(txn *sqlx.Tx) (infos []RoomInfo, err error)
 	return
 }
 
+// SelectRoomIDs returns the IDs of every room, sorted.
+func (t *RoomsTable) SelectRoomIDs(txn *sqlx.Tx) (roomIDs []string, err error) {
+	err = txn.Select(&roomIDs, `SELECT room_id FROM syncv3_rooms ORDER BY room_id`)
+	return
+}
+
+// SelectRoomInfosForRooms is like SelectRoomInfos, but only for the given rooms.
+func (t *RoomsTable) SelectRoomInfosForRooms(txn *sqlx.Tx, roomIDs []string) (infos []RoomInfo, err error) {
+	err = txn.Select(&infos, `SELECT room_id, is_encrypted, upgraded_room_id, predecessor_room_id, type FROM syncv3_rooms
+	WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	return
+}
+
 func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID int64) (err error) {
 	// This is a bit of a wonky query to ensure that you cannot set is_encrypted=false after it has been
 	// set to true.
@@ -108,6 +109,29 @@ func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string
 	return
 }
 
+// CurrentSnapshotIDs returns the current snapshot ID of each of these rooms whose latest event is
+// at or before pos. Other rooms are omitted.
+func (t *RoomsTable) CurrentSnapshotIDs(txn *sqlx.Tx, roomIDs []string, pos int64) (snapshotIDs map[string]int64, err error) {
+	snapshotIDs = make(map[string]int64, len(roomIDs))
+	rows, err := txn.Query(
+		`SELECT room_id, current_snapshot_id FROM syncv3_rooms WHERE room_id = ANY($1) AND latest_nid <= $2`,
+		pq.StringArray(roomIDs), pos,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roomID string
+	var snapshotID int64
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &snapshotID); err != nil {
+			return nil, err
+		}
+		snapshotIDs[roomID] = snapshotID
+	}
+	return snapshotIDs, rows.Err()
+}
+
 // Return the snapshot for this room AFTER the latest event has been applied.
 func (t *RoomsTable) CurrentAfterSnapshotID(txn *sqlx.Tx, roomID string) (snapshotID int64, err error) {
 	err = txn.QueryRow(`SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id=$1`, roomID).Scan(&snapshotID)
@@ -9,9 +9,9 @@ import (
 func TestRoomsTable(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
-	_, err := db.Exec(`DROP TABLE IF EXISTS syncv3_rooms`)
+	_, err := db.Exec(`TRUNCATE syncv3_rooms`)
 	if err != nil {
-		t.Fatalf("failed to drop rooms table: %s", err)
+		t.Fatalf("failed to truncate rooms table: %s", err)
 	}
 	txn, err := db.Beginx()
 	if err != nil {
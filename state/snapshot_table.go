@@ -1,37 +1,43 @@
 package state
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
+// minCompressedSnapshotSize is the fewest events a snapshot must have to be stored as a delta, as
+// storing small snapshots in full costs little.
+const minCompressedSnapshotSize = 100
+
 type SnapshotRow struct {
 	SnapshotID       int64         `db:"snapshot_id"`
 	RoomID           string        `db:"room_id"`
 	OtherEvents      pq.Int64Array `db:"events"`
 	MembershipEvents pq.Int64Array `db:"membership_events"`
+	// BaseSnapshotID is 0 for a snapshot stored in full. Otherwise the snapshot is stored as a delta
+	// from this snapshot, which is stored in full: OtherEvents and MembershipEvents are the events
+	// added to the base snapshot, and RemovedEvents are the events removed from it.
+	BaseSnapshotID int64         `db:"base_snapshot_id"`
+	RemovedEvents  pq.Int64Array `db:"removed_events"`
+	// Compacted is true once the snapshot has been considered for storing as a delta.
+	Compacted bool `db:"compacted"`
 }
 
 // SnapshotTable stores room state snapshots. Each snapshot has a unique numeric ID.
 // Not every event will be associated with a snapshot.
+//
+// The events in the snapshots of large rooms are mostly the same, so snapshots other than the
+// current state of a room are compacted into deltas from an older snapshot, see CompactRoom.
+// The current state snapshots are always stored in full, so they can be queried directly.
 type SnapshotTable struct {
 	db *sqlx.DB
 }
 
 func NewSnapshotsTable(db *sqlx.DB) *SnapshotTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_snapshots_seq;
-	CREATE TABLE IF NOT EXISTS syncv3_snapshots (
-		snapshot_id BIGINT PRIMARY KEY DEFAULT nextval('syncv3_snapshots_seq'),
-		room_id TEXT NOT NULL,
-		events BIGINT[] NOT NULL,
-		membership_events BIGINT[] NOT NULL,
-		UNIQUE(snapshot_id, room_id)
-	);
-	`)
 	return &SnapshotTable{db}
 }
 
@@ -56,16 +62,109 @@ func (t *SnapshotTable) CurrentSnapshots(txn *sqlx.Tx) (map[string][]int64, erro
 	return result, nil
 }
 
-// Select a row based on its snapshot ID.
+// Select a row based on its snapshot ID. Snapshots stored as deltas are returned in full.
 func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow, err error) {
 	if snapshotID == 0 {
 		err = fmt.Errorf("SnapshotTable.Select: snapshot ID requested is 0")
 		return
 	}
 	err = txn.Get(&row, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = $1`, snapshotID)
+	if err != nil || row.BaseSnapshotID == 0 {
+		return
+	}
+	var base SnapshotRow
+	if err = txn.Get(&base, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = $1`, row.BaseSnapshotID); err != nil {
+		err = fmt.Errorf("SnapshotTable.Select: failed to select base snapshot %d of snapshot %d: %w", row.BaseSnapshotID, snapshotID, err)
+		return
+	}
+	return row.expand(base), nil
+}
+
+// expand returns the full snapshot of a delta row, given its base snapshot.
+func (row SnapshotRow) expand(base SnapshotRow) SnapshotRow {
+	removed := make(map[int64]bool, len(row.RemovedEvents))
+	for _, nid := range row.RemovedEvents {
+		removed[nid] = true
+	}
+	apply := func(baseNIDs, added []int64) pq.Int64Array {
+		nids := make(pq.Int64Array, 0, len(baseNIDs)+len(added))
+		for _, nid := range baseNIDs {
+			if !removed[nid] {
+				nids = append(nids, nid)
+			}
+		}
+		return append(nids, added...)
+	}
+	return SnapshotRow{
+		SnapshotID:       row.SnapshotID,
+		RoomID:           row.RoomID,
+		OtherEvents:      apply(base.OtherEvents, row.OtherEvents),
+		MembershipEvents: apply(base.MembershipEvents, row.MembershipEvents),
+		RemovedEvents:    pq.Int64Array{},
+		Compacted:        row.Compacted,
+	}
+}
+
+// snapshotDelta returns the NIDs which are in nids but not base, and those in base but not nids.
+func snapshotDelta(base, nids []int64) (added, removed []int64) {
+	inBase := make(map[int64]bool, len(base))
+	for _, nid := range base {
+		inBase[nid] = true
+	}
+	inNIDs := make(map[int64]bool, len(nids))
+	for _, nid := range nids {
+		inNIDs[nid] = true
+		if !inBase[nid] {
+			added = append(added, nid)
+		}
+	}
+	for _, nid := range base {
+		if !inNIDs[nid] {
+			removed = append(removed, nid)
+		}
+	}
 	return
 }
 
+// SelectWithMembershipNIDs returns the IDs of the room's snapshots from fromSnapshotID onwards which
+// include each of the membership event NIDs, in ascending order. Used for debugging only, as the
+// snapshots are not indexed by the events in them.
+func (s *SnapshotTable) SelectWithMembershipNIDs(txn *sqlx.Tx, roomID string, fromSnapshotID int64, nids []int64) (map[int64][]int64, error) {
+	rows, err := txn.Query(
+		`SELECT snap.snapshot_id, COALESCE(base.membership_events, '{}') || snap.membership_events, snap.removed_events
+		FROM syncv3_snapshots AS snap LEFT JOIN syncv3_snapshots AS base ON base.snapshot_id = snap.base_snapshot_id
+		WHERE snap.snapshot_id >= $1 AND snap.room_id = $2 AND (COALESCE(base.membership_events, '{}') || snap.membership_events) && $3
+		ORDER BY snap.snapshot_id ASC`,
+		fromSnapshotID, roomID, pq.Int64Array(nids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	want := make(map[int64]bool, len(nids))
+	for _, nid := range nids {
+		want[nid] = true
+	}
+	result := make(map[int64][]int64)
+	for rows.Next() {
+		var snapshotID int64
+		var membershipNIDs, removedNIDs pq.Int64Array
+		if err = rows.Scan(&snapshotID, &membershipNIDs, &removedNIDs); err != nil {
+			return nil, err
+		}
+		removed := make(map[int64]bool, len(removedNIDs))
+		for _, nid := range removedNIDs {
+			removed[nid] = true
+		}
+		for _, nid := range membershipNIDs {
+			if want[nid] && !removed[nid] {
+				result[nid] = append(result[nid], snapshotID)
+			}
+		}
+	}
+	return result, rows.Err()
+}
+
 // Insert the row. Modifies SnapshotID to be the inserted primary key.
 func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 	var id int64
@@ -83,6 +182,95 @@ func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 	return err
 }
 
+// UncompactedRooms returns the current snapshot ID of each room which has snapshots from before its
+// current snapshot which have not been compacted.
+func (s *SnapshotTable) UncompactedRooms() (map[string]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT room_id, current_snapshot_id FROM syncv3_rooms WHERE EXISTS(
+			SELECT 1 FROM syncv3_snapshots
+			WHERE syncv3_snapshots.room_id = syncv3_rooms.room_id AND NOT compacted AND snapshot_id < current_snapshot_id
+		)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int64)
+	for rows.Next() {
+		var roomID string
+		var snapshotID int64
+		if err = rows.Scan(&roomID, &snapshotID); err != nil {
+			return nil, err
+		}
+		result[roomID] = snapshotID
+	}
+	return result, rows.Err()
+}
+
+// CompactRoom compacts the room's snapshots from before beforeSnapshotID, which must not include
+// the room's current snapshot, in the order they were created. Each snapshot is stored as a delta
+// from the latest snapshot which is stored in full, unless the delta would be more than half the
+// size of the snapshot, in which case the snapshot is kept in full and becomes the base of the
+// following snapshots. Returns the number of snapshots stored as deltas.
+func (s *SnapshotTable) CompactRoom(txn *sqlx.Tx, roomID string, beforeSnapshotID int64) (int, error) {
+	var base *SnapshotRow
+	var latestFull SnapshotRow
+	err := txn.Get(&latestFull, `SELECT * FROM syncv3_snapshots
+		WHERE room_id = $1 AND compacted AND base_snapshot_id = 0 AND snapshot_id < $2
+		ORDER BY snapshot_id DESC LIMIT 1`, roomID, beforeSnapshotID)
+	if err == nil {
+		base = &latestFull
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to select base snapshot: %w", err)
+	}
+	var snapshotIDs []int64
+	err = txn.Select(&snapshotIDs, `SELECT snapshot_id FROM syncv3_snapshots
+		WHERE room_id = $1 AND NOT compacted AND snapshot_id < $2
+		ORDER BY snapshot_id ASC`, roomID, beforeSnapshotID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select snapshots to compact: %w", err)
+	}
+	compressed := 0
+	for _, snapshotID := range snapshotIDs {
+		var row SnapshotRow
+		if err = txn.Get(&row, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = $1`, snapshotID); err != nil {
+			return compressed, fmt.Errorf("failed to select snapshot %d: %w", snapshotID, err)
+		}
+		size := len(row.OtherEvents) + len(row.MembershipEvents)
+		if base != nil && size >= minCompressedSnapshotSize {
+			addedOther, removedOther := snapshotDelta(base.OtherEvents, row.OtherEvents)
+			addedMembership, removedMembership := snapshotDelta(base.MembershipEvents, row.MembershipEvents)
+			removed := append(removedOther, removedMembership...)
+			if 2*(len(addedOther)+len(addedMembership)+len(removed)) <= size {
+				_, err = txn.Exec(`UPDATE syncv3_snapshots
+					SET events = $1, membership_events = $2, removed_events = $3, base_snapshot_id = $4, compacted = TRUE
+					WHERE snapshot_id = $5`,
+					pq.Int64Array(nonNil(addedOther)), pq.Int64Array(nonNil(addedMembership)), pq.Int64Array(nonNil(removed)),
+					base.SnapshotID, snapshotID,
+				)
+				if err != nil {
+					return compressed, fmt.Errorf("failed to store snapshot %d as a delta: %w", snapshotID, err)
+				}
+				compressed++
+				continue
+			}
+		}
+		if _, err = txn.Exec(`UPDATE syncv3_snapshots SET compacted = TRUE WHERE snapshot_id = $1`, snapshotID); err != nil {
+			return compressed, fmt.Errorf("failed to mark snapshot %d as compacted: %w", snapshotID, err)
+		}
+		base = &row
+	}
+	return compressed, nil
+}
+
+// nonNil returns an empty slice rather than nil, as the array columns are NOT NULL.
+func nonNil(nids []int64) []int64 {
+	if nids == nil {
+		return []int64{}
+	}
+	return nids
+}
+
 // Delete the snapshot IDs given
 func (s *SnapshotTable) Delete(txn *sqlx.Tx, snapshotIDs []int64) error {
 	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE snapshot_id = ANY(?)`, pq.Int64Array(snapshotIDs))
@@ -55,3 +55,90 @@ func TestSnapshotTable(t *testing.T) {
 		t.Fatalf("failed to delete snapshot: %s", err)
 	}
 }
+
+func TestSnapshotTableCompactRoom(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	table := NewSnapshotsTable(db)
+	roomID := "!TestSnapshotTableCompactRoom"
+
+	nids := func(from, to int64) pq.Int64Array {
+		var result pq.Int64Array
+		for nid := from; nid <= to; nid++ {
+			result = append(result, nid)
+		}
+		return result
+	}
+	snapshots := []*SnapshotRow{
+		{RoomID: roomID, MembershipEvents: nids(1, 150), OtherEvents: pq.Int64Array{1000, 1001}},
+		// replaces a member and an other event
+		{RoomID: roomID, MembershipEvents: append(nids(2, 150), 151), OtherEvents: pq.Int64Array{1000, 1002}},
+		// most of the room changed, so this is stored in full
+		{RoomID: roomID, MembershipEvents: nids(200, 350), OtherEvents: pq.Int64Array{1000, 1002}},
+		{RoomID: roomID, MembershipEvents: nids(200, 351), OtherEvents: pq.Int64Array{1000, 1002}},
+		// too small to store as a delta
+		{RoomID: roomID, MembershipEvents: nids(200, 210), OtherEvents: pq.Int64Array{1000}},
+		// the current snapshot
+		{RoomID: roomID, MembershipEvents: nids(200, 211), OtherEvents: pq.Int64Array{1000}},
+	}
+	for _, snapshot := range snapshots {
+		if err = table.Insert(txn, snapshot); err != nil {
+			t.Fatalf("Failed to insert: %s", err)
+		}
+	}
+	current := snapshots[len(snapshots)-1].SnapshotID
+
+	compressed, err := table.CompactRoom(txn, roomID, current)
+	if err != nil {
+		t.Fatalf("CompactRoom: %s", err)
+	}
+	if compressed != 2 {
+		t.Errorf("CompactRoom: compressed %d snapshots, want 2", compressed)
+	}
+	wantBases := []int64{0, snapshots[0].SnapshotID, 0, snapshots[2].SnapshotID, 0, 0}
+	for i, snapshot := range snapshots {
+		var row SnapshotRow
+		if err = txn.Get(&row, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = $1`, snapshot.SnapshotID); err != nil {
+			t.Fatalf("failed to select raw snapshot: %s", err)
+		}
+		if row.BaseSnapshotID != wantBases[i] {
+			t.Errorf("snapshot %d: got base %d want %d", i, row.BaseSnapshotID, wantBases[i])
+		}
+		if row.Compacted != (snapshot.SnapshotID != current) {
+			t.Errorf("snapshot %d: got compacted %v", i, row.Compacted)
+		}
+		got, err := table.Select(txn, snapshot.SnapshotID)
+		if err != nil {
+			t.Fatalf("Failed to select: %s", err)
+		}
+		if !reflect.DeepEqual(got.MembershipEvents, snapshot.MembershipEvents) {
+			t.Errorf("snapshot %d: got membership events %v want %v", i, got.MembershipEvents, snapshot.MembershipEvents)
+		}
+		if !reflect.DeepEqual(got.OtherEvents, snapshot.OtherEvents) {
+			t.Errorf("snapshot %d: got other events %v want %v", i, got.OtherEvents, snapshot.OtherEvents)
+		}
+	}
+
+	// membership NID 1 was removed by the delta of the second snapshot
+	withNIDs, err := table.SelectWithMembershipNIDs(txn, roomID, 0, []int64{1, 151})
+	if err != nil {
+		t.Fatalf("SelectWithMembershipNIDs: %s", err)
+	}
+	want := map[int64][]int64{1: {snapshots[0].SnapshotID}, 151: {snapshots[1].SnapshotID}}
+	if !reflect.DeepEqual(withNIDs, want) {
+		t.Errorf("SelectWithMembershipNIDs: got %v want %v", withNIDs, want)
+	}
+
+	compressed, err = table.CompactRoom(txn, roomID, current)
+	if err != nil {
+		t.Fatalf("CompactRoom: %s", err)
+	}
+	if compressed != 0 {
+		t.Errorf("CompactRoom: compressed %d snapshots again", compressed)
+	}
+}
@@ -57,17 +57,6 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 type SpacesTable struct{}
 
 func NewSpacesTable(db *sqlx.DB) *SpacesTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_spaces (
-		parent TEXT NOT NULL,
-		child TEXT NOT NULL,
-		relation SMALLINT NOT NULL,
-		suggested BOOL NOT NULL,
-		ordering TEXT NOT NULL, -- "" for unset
-		UNIQUE(parent, child, relation)
-	);
-	`)
 	return &SpacesTable{}
 }
 
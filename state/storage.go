@@ -4,8 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -18,22 +18,25 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleAccumulator)
 
 // Max number of parameters in a single SQL command
 const MaxPostgresParameters = 65535
 
+// MaxUnreadCount is the most events CountUnread looks at, so rooms which the user never read
+// don't load their whole timeline.
+const MaxUnreadCount = 1000
+
 // StartupSnapshot represents a snapshot of startup data for the sliding sync HTTP API instances
 type StartupSnapshot struct {
 	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
 	AllJoinedMembers map[string][]string              // room_id -> [user_id]
+	// UnhydratedRoomIDs are the rooms whose metadata was not loaded by a lazy snapshot. Their
+	// metadata only has join counts and heroes, if it exists at all.
+	UnhydratedRoomIDs []string
 }
 
 type LatestEvents struct {
@@ -59,19 +62,36 @@ func (e *LatestEvents) DiscardIgnoredMessages(shouldIgnore func(sender string) b
 }
 
 type Storage struct {
-	Accumulator       *Accumulator
-	EventsTable       *EventTable
-	ToDeviceTable     *ToDeviceTable
-	UnreadTable       *UnreadTable
-	AccountDataTable  *AccountDataTable
-	InvitesTable      *InvitesTable
-	TransactionsTable *TransactionsTable
-	DeviceDataTable   *DeviceDataTable
-	ReceiptTable      *ReceiptTable
-	DB                *sqlx.DB
-	MaxTimelineLimit  int
-	shutdownCh        chan struct{}
-	shutdown          bool
+	Accumulator        *Accumulator
+	EventsTable        *EventTable
+	ToDeviceTable      *ToDeviceTable
+	UnreadTable        *UnreadTable
+	ThreadUnreadTable  *ThreadUnreadTable
+	AccountDataTable   *AccountDataTable
+	InvitesTable       *InvitesTable
+	RoomSummariesTable *RoomSummariesTable
+	TransactionsTable  *TransactionsTable
+	DeviceDataTable    *DeviceDataTable
+	ReceiptTable       *ReceiptTable
+	PresenceTable      *PresenceTable
+	ConnRequestsTable  *ConnRequestsTable
+	// ForgottenRoomsTable holds the rooms users have forgotten, see ForgetRoom.
+	ForgottenRoomsTable *ForgottenRoomsTable
+	// MalformedEventsTable holds events rejected in strict validation mode, see SetStrictValidation.
+	MalformedEventsTable *MalformedEventsTable
+	DB                   *sqlx.DB
+	shutdownCh           chan struct{}
+	shutdown             bool
+
+	// replicaDB is a read-only replica for heavy reads, or nil. See SetReadReplica.
+	replicaDB *sqlx.DB
+	// replicaPos is the latest event NID seen on the replica.
+	replicaPos atomic.Int64
+
+	// maxTimelineLimit is read by requests and the cleaner while it may be changed by a config reload.
+	maxTimelineLimit atomic.Int64
+
+	eventRetention EventRetention
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -86,29 +106,60 @@ func NewStorage(postgresURI string) *Storage {
 
 func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 	acc := &Accumulator{
-		db:            db,
-		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
-		snapshotTable: NewSnapshotsTable(db),
-		spacesTable:   NewSpacesTable(db),
-		invitesTable:  NewInvitesTable(db),
-		entityName:    "server",
-	}
-
-	return &Storage{
-		Accumulator:       acc,
-		ToDeviceTable:     NewToDeviceTable(db),
-		UnreadTable:       NewUnreadTable(db),
-		EventsTable:       acc.eventsTable,
-		AccountDataTable:  NewAccountDataTable(db),
-		InvitesTable:      acc.invitesTable,
-		TransactionsTable: NewTransactionsTable(db),
-		DeviceDataTable:   NewDeviceDataTable(db),
-		ReceiptTable:      NewReceiptTable(db),
-		DB:                db,
-		MaxTimelineLimit:  50,
-		shutdownCh:        make(chan struct{}),
+		db:             db,
+		roomsTable:     NewRoomsTable(db),
+		eventsTable:    NewEventTable(db),
+		snapshotTable:  NewSnapshotsTable(db),
+		spacesTable:    NewSpacesTable(db),
+		invitesTable:   NewInvitesTable(db),
+		entityName:     "server",
+		malformedTable: NewMalformedEventsTable(db),
+	}
+	if addPrometheusMetrics {
+		acc.metrics = NewAccumulatorMetrics()
+	}
+
+	s := &Storage{
+		Accumulator:          acc,
+		ToDeviceTable:        NewToDeviceTable(db),
+		UnreadTable:          NewUnreadTable(db),
+		ThreadUnreadTable:    NewThreadUnreadTable(db),
+		EventsTable:          acc.eventsTable,
+		AccountDataTable:     NewAccountDataTable(db),
+		InvitesTable:         acc.invitesTable,
+		RoomSummariesTable:   NewRoomSummariesTable(db),
+		TransactionsTable:    NewTransactionsTable(db),
+		DeviceDataTable:      NewDeviceDataTable(db),
+		ReceiptTable:         NewReceiptTable(db),
+		PresenceTable:        NewPresenceTable(db),
+		ConnRequestsTable:    NewConnRequestsTable(db),
+		ForgottenRoomsTable:  NewForgottenRoomsTable(db),
+		MalformedEventsTable: acc.malformedTable,
+		DB:                   db,
+		shutdownCh:           make(chan struct{}),
 	}
+	s.SetMaxTimelineLimit(50)
+	return s
+}
+
+// SetStrictValidation rejects events from the upstream which lack any field every event should
+// have, e.g a sender or content, and quarantines every rejected event in MalformedEventsTable.
+// Without this, only events which cannot be stored at all are rejected, and they are only logged.
+// Must be called before accumulating events.
+func (s *Storage) SetStrictValidation(strict bool) {
+	s.Accumulator.strictValidation = strict
+}
+
+// MaxTimelineLimit is the most timeline events loaded for a room. 0 means no limit.
+func (s *Storage) MaxTimelineLimit() int {
+	return int(s.maxTimelineLimit.Load())
+}
+
+// SetMaxTimelineLimit changes the most timeline events loaded for a room. Safe to call while
+// serving requests. The cleaner keeps this many state snapshots for each room, so snapshots
+// deleted under a lower limit cannot be loaded after raising it again.
+func (s *Storage) SetMaxTimelineLimit(limit int) {
+	s.maxTimelineLimit.Store(int64(limit))
 }
 
 func (s *Storage) LatestEventNID() (int64, error) {
@@ -134,8 +185,42 @@ func (s *Storage) RoomAccountDatasWithType(userID, eventType string) (data []Acc
 // Pull out all account data for this user. If roomIDs is empty, global account data is returned.
 // If roomIDs is non-empty, all account data for these rooms are extracted.
 func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []AccountData, err error) {
+	return s.FilteredAccountDatas(userID, nil, roomIDs...)
+}
+
+// FilteredAccountDatas is like AccountDatas but only returns the types which pass the filter.
+func (s *Storage) FilteredAccountDatas(userID string, filter *AccountDataFilter, roomIDs ...string) (datas []AccountData, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		datas, err = s.AccountDataTable.SelectMany(txn, userID, filter, roomIDs...)
+		return err
+	})
+	return
+}
+
+// AccountDataChangedSince is like FilteredAccountDatas but only returns account data which changed
+// after the account data with ID `since` was stored.
+func (s *Storage) AccountDataChangedSince(userID string, filter *AccountDataFilter, since int64, roomIDs ...string) (datas []AccountData, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		datas, err = s.AccountDataTable.SelectChangedSince(txn, userID, filter, since, roomIDs...)
+		return err
+	})
+	return
+}
+
+// AccountDataSizeForUser returns the total size in bytes of the user's account data, excluding
+// the given types in the given room.
+func (s *Storage) AccountDataSizeForUser(userID, roomID string, excludeTypes []string) (size int64, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		size, err = s.AccountDataTable.SelectSizeForUser(txn, userID, roomID, excludeTypes)
+		return err
+	})
+	return
+}
+
+// LargestAccountDataUsers returns the `limit` users with the most account data, largest first.
+func (s *Storage) LargestAccountDataUsers(limit int) (usages []AccountDataUsage, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
-		datas, err = s.AccountDataTable.SelectMany(txn, userID, roomIDs...)
+		usages, err = s.AccountDataTable.SelectLargestUsers(txn, limit)
 		return err
 	})
 	return
@@ -167,23 +252,48 @@ func (s *Storage) PrepareSnapshot(txn *sqlx.Tx) (tableName string, err error) {
 	// each event NID is queried using a btree index, rather than doing a seq scan as this query will pull
 	// out ~50% of the rows in syncv3_events.
 	tempTableName := "temp_snapshot"
-	_, err = txn.Exec(
-		`SELECT UNNEST(membership_events) AS membership_nid INTO TEMP ` + tempTableName + ` FROM syncv3_snapshots
-		JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id`,
-	)
+	_, err = txn.Exec(`CREATE TEMP TABLE ` + tempTableName + ` AS ` + currentMembershipNIDsQuery)
 	return tempTableName, err
 }
 
+// currentMembershipNIDsQuery selects the membership event NIDs in the current snapshot of every room.
+const currentMembershipNIDsQuery = `SELECT UNNEST(membership_events) AS membership_nid FROM syncv3_snapshots
+	JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id`
+
 // GlobalSnapshot snapshots the entire database for the purposes of initialising
 // a sliding sync instance. It will atomically grab metadata for all rooms and all joined members
 // in a single transaction.
 func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
-		tempTableName, err := s.PrepareSnapshot(txn)
-		if err != nil {
-			err = fmt.Errorf("GlobalSnapshot: failed to call PrepareSnapshot: %w", err)
-			sentry.CaptureException(err)
-			return err
+	return s.globalSnapshot(false)
+}
+
+// LazyGlobalSnapshot is like GlobalSnapshot, but only loads the joined members, join counts and
+// heroes of each room. The rest of the metadata of every room must be loaded later with
+// MetadataForRooms. This is much faster than GlobalSnapshot on large databases.
+func (s *Storage) LazyGlobalSnapshot() (ss StartupSnapshot, err error) {
+	return s.globalSnapshot(true)
+}
+
+func (s *Storage) globalSnapshot(lazy bool) (ss StartupSnapshot, err error) {
+	latestNID, err := s.LatestEventNID()
+	if err != nil {
+		return ss, fmt.Errorf("GlobalSnapshot: failed to load latest event NID: %w", err)
+	}
+	db, onReplica := s.readDB(latestNID)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		var tempTableName string
+		var err error
+		if onReplica {
+			// hot standbys cannot create temporary tables, so select from a subquery instead.
+			// This is slower, but it is the replica which does the work.
+			tempTableName = "(" + currentMembershipNIDsQuery + ") AS temp_snapshot"
+		} else {
+			tempTableName, err = s.PrepareSnapshot(txn)
+			if err != nil {
+				err = fmt.Errorf("GlobalSnapshot: failed to call PrepareSnapshot: %w", err)
+				sentry.CaptureException(err)
+				return err
+			}
 		}
 		var metadata map[string]internal.RoomMetadata
 		ss.AllJoinedMembers, metadata, err = s.AllJoinedMembers(txn, tempTableName)
@@ -192,6 +302,15 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 			sentry.CaptureException(err)
 			return err
 		}
+		if lazy {
+			ss.GlobalMetadata = metadata
+			ss.UnhydratedRoomIDs, err = s.Accumulator.roomsTable.SelectRoomIDs(txn)
+			if err != nil {
+				err = fmt.Errorf("GlobalSnapshot: failed to select room IDs: %w", err)
+				sentry.CaptureException(err)
+			}
+			return err
+		}
 		err = s.MetadataForAllRooms(txn, tempTableName, metadata)
 		if err != nil {
 			err = fmt.Errorf("GlobalSnapshot: failed to call MetadataForAllRooms: %w", err)
@@ -204,8 +323,59 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 	return
 }
 
+// metadataStateEventTypes are the state events which are held in room metadata, apart from memberships.
+var metadataStateEventTypes = []string{
+	"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.join_rules", "m.room.history_visibility",
+}
+
 // Extract hero info for all rooms. Requires a prepared snapshot in order to be called.
 func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result map[string]internal.RoomMetadata) error {
+	// work out latest timestamps
+	events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInAllRooms(txn)
+	if err != nil {
+		return err
+	}
+	// Select the name / canonical alias / join rule / history visibility for all rooms
+	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, metadataStateEventTypes)
+	if err != nil {
+		return fmt.Errorf("failed to load state events for all rooms: %s", err)
+	}
+	roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfos(txn)
+	if err != nil {
+		return fmt.Errorf("failed to select room infos: %s", err)
+	}
+	return s.applyMetadata(txn, result, events, roomIDToStateEvents, roomInfos)
+}
+
+// MetadataForRooms is like MetadataForAllRooms, but only loads the given rooms and does not need a
+// prepared snapshot. Metadata already in the result map, e.g the join counts and heroes from
+// AllJoinedMembers, is kept.
+func (s *Storage) MetadataForRooms(roomIDs []string, result map[string]internal.RoomMetadata) error {
+	if len(roomIDs) == 0 {
+		return nil
+	}
+	return sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInRooms(txn, roomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select latest events: %s", err)
+		}
+		roomIDToStateEvents, err := s.currentNotMembershipStateEventsInRooms(txn, roomIDs, metadataStateEventTypes)
+		if err != nil {
+			return fmt.Errorf("failed to load state events: %s", err)
+		}
+		roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfosForRooms(txn, roomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select room infos: %s", err)
+		}
+		return s.applyMetadata(txn, result, events, roomIDToStateEvents, roomInfos)
+	})
+}
+
+// applyMetadata updates the metadata in result with the latest events of each type, the current
+// state events and the room infos of some rooms, then loads the children of any spaces.
+func (s *Storage) applyMetadata(
+	txn *sqlx.Tx, result map[string]internal.RoomMetadata, events []Event, roomIDToStateEvents map[string][]Event, roomInfos []RoomInfo,
+) error {
 	loadMetadata := func(roomID string) internal.RoomMetadata {
 		metadata, ok := result[roomID]
 		if !ok {
@@ -214,11 +384,6 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		return metadata
 	}
 
-	// work out latest timestamps
-	events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInAllRooms(txn)
-	if err != nil {
-		return err
-	}
 	for _, ev := range events {
 		metadata := loadMetadata(ev.RoomID)
 
@@ -242,13 +407,6 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		result[ev.RoomID] = metadata
 	}
 
-	// Select the name / canonical alias for all rooms
-	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
-		"m.room.name", "m.room.canonical_alias", "m.room.avatar",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to load state events for all rooms: %s", err)
-	}
 	for roomID, stateEvents := range roomIDToStateEvents {
 		metadata := loadMetadata(roomID)
 		for _, ev := range stateEvents {
@@ -258,15 +416,15 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
 			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
 				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.join_rules" && ev.StateKey == "" {
+				metadata.JoinRule = gjson.ParseBytes(ev.JSON).Get("content.join_rule").Str
+			} else if ev.Type == "m.room.history_visibility" && ev.StateKey == "" {
+				metadata.HistoryVisibility = gjson.ParseBytes(ev.JSON).Get("content.history_visibility").Str
 			}
 		}
 		result[roomID] = metadata
 	}
 
-	roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfos(txn)
-	if err != nil {
-		return fmt.Errorf("failed to select room infos: %s", err)
-	}
 	var spaceRoomIDs []string
 	for _, info := range roomInfos {
 		metadata := loadMetadata(info.ID)
@@ -322,7 +480,7 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	FROM syncv3_events JOIN snapshot ON (
 		event_nid = ANY (ARRAY_CAT(events, membership_events))
 	)
-	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption') AND state_key = '')
+	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption', 'm.room.join_rules', 'm.room.history_visibility') AND state_key = '')
 	   OR (event_type = 'm.room.member' AND membership IN ('join', '_join', 'invite', '_invite'))
 	ORDER BY event_nid ASC
 	;`, metadata.RoomID)
@@ -345,6 +503,10 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 			metadata.CanonicalAlias = gjson.GetBytes(ev.JSON, "content.alias").Str
 		case "m.room.encryption":
 			metadata.Encrypted = true
+		case "m.room.join_rules":
+			metadata.JoinRule = gjson.GetBytes(ev.JSON, "content.join_rule").Str
+		case "m.room.history_visibility":
+			metadata.HistoryVisibility = gjson.GetBytes(ev.JSON, "content.history_visibility").Str
 		case "m.room.member":
 			heroMemberships.append(&events[i])
 			switch ev.Membership {
@@ -380,6 +542,12 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	return nil
 }
 
+// IsRoomKnown returns true if the proxy has stored state for this room.
+func (s *Storage) IsRoomKnown(roomID string) (known bool, err error) {
+	err = s.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM syncv3_rooms WHERE room_id = $1)`, roomID).Scan(&known)
+	return
+}
+
 // FetchMemberships looks up the latest snapshot for the given room and determines the
 // latest membership events in the room. Returns
 //   - the list of joined members,
@@ -431,6 +599,29 @@ func (s *Storage) FetchMemberships(roomID string) (joins, invites, leaves []stri
 	return
 }
 
+// UsersSharingEncryptedRooms returns which of `otherUserIDs` are currently joined to an encrypted
+// room which `userID` is also joined to.
+func (s *Storage) UsersSharingEncryptedRooms(userID string, otherUserIDs []string) (map[string]bool, error) {
+	var sharing []string
+	err := s.DB.Select(&sharing, `
+	SELECT DISTINCT other.state_key
+	FROM syncv3_events AS me
+		JOIN syncv3_rooms ON syncv3_rooms.room_id = me.room_id
+		JOIN syncv3_snapshots ON snapshot_id = current_snapshot_id AND me.event_nid = ANY(membership_events)
+		JOIN syncv3_events AS other ON other.event_nid = ANY(membership_events)
+	WHERE me.event_type = 'm.room.member' AND me.state_key = $1 AND me.membership IN ('join', '_join')
+		AND is_encrypted AND other.state_key = ANY($2) AND other.membership IN ('join', '_join')
+	`, userID, pq.StringArray(otherUserIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(sharing))
+	for _, otherUserID := range sharing {
+		result[otherUserID] = true
+	}
+	return result, nil
+}
+
 // Returns all current NOT MEMBERSHIP state events matching the event types given in all rooms. Returns a map of
 // room ID to events in that room.
 func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventTypes []string) (map[string][]Event, error) {
@@ -445,7 +636,32 @@ func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventT
 	if err != nil {
 		return nil, err
 	}
-	rows, err := txn.Query(txn.Rebind(query), args...)
+	return s.selectStateEventsByRoom(txn, txn.Rebind(query), args...)
+}
+
+// currentNotMembershipStateEventsInRooms is like currentNotMembershipStateEventsInAllRooms, but only
+// for the given rooms.
+func (s *Storage) currentNotMembershipStateEventsInRooms(txn *sqlx.Tx, roomIDs, eventTypes []string) (map[string][]Event, error) {
+	query, args, err := sqlx.In(
+		`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+		WHERE syncv3_events.event_type IN (?)
+		AND syncv3_events.event_nid IN (
+			SELECT UNNEST(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id IN (?)
+			)
+		)`,
+		eventTypes, roomIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.selectStateEventsByRoom(txn, txn.Rebind(query), args...)
+}
+
+// selectStateEventsByRoom runs a query selecting the room ID, type, state key and JSON of state
+// events, and returns them as a map of room ID to events in that room.
+func (s *Storage) selectStateEventsByRoom(txn *sqlx.Tx, query string, args ...interface{}) (map[string][]Event, error) {
+	rows, err := txn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -469,6 +685,9 @@ func (s *Storage) Accumulate(userID, roomID string, timeline sync2.TimelineRespo
 		result, err = s.Accumulator.Accumulate(txn, userID, roomID, timeline)
 		return err
 	})
+	if err == nil && result.NumNew > 0 {
+		s.Accumulator.metrics.accumulated("timeline", result.NumNew, result.numSnapshots, result.replacedSnapshot)
+	}
 	return result, err
 }
 
@@ -492,6 +711,51 @@ func (s *Storage) EventNIDs(eventNIDs []int64) ([]json.RawMessage, error) {
 	return e, nil
 }
 
+// CountUnread calculates the user's MSC2654 unread count in the room: the number of events which
+// count as unread after the user's latest unthreaded or main thread read receipt, public or
+// private, and after the user's own latest event. Counts stop at MaxUnreadCount.
+func (s *Storage) CountUnread(userID, roomID string) (count int, err error) {
+	receiptsByRoom, err := s.ReceiptTable.SelectReceiptsForUser([]string{roomID}, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select receipts: %w", err)
+	}
+	var readEventIDs []string
+	for _, r := range receiptsByRoom[roomID] {
+		if r.ThreadID == "" || r.ThreadID == "main" {
+			readEventIDs = append(readEventIDs, r.EventID)
+		}
+	}
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		var readNID int64
+		if len(readEventIDs) > 0 {
+			nids, err := s.EventsTable.SelectNIDsByIDs(txn, readEventIDs)
+			if err != nil {
+				return fmt.Errorf("failed to select receipt NIDs: %w", err)
+			}
+			for _, nid := range nids {
+				if nid > readNID {
+					readNID = nid
+				}
+			}
+		}
+		events, err := s.EventsTable.SelectLatestTimelineEventsOfTypes(txn, roomID, readNID, internal.UnreadEventTypes, MaxUnreadCount)
+		if err != nil {
+			return fmt.Errorf("failed to select events: %w", err)
+		}
+		for _, ev := range events {
+			evJSON := gjson.ParseBytes(ev.JSON)
+			if evJSON.Get("sender").Str == userID {
+				break // the user has read everything before their own event
+			}
+			if internal.CountsAsUnread(evJSON) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
 func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, snapID)
@@ -511,6 +775,19 @@ func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err erro
 	return
 }
 
+// StateSnapshotIDsAtPosition returns the ID of the snapshot of each room's state after the event
+// position pos. The state after pos never changes, so callers can use these IDs to cache what
+// RoomStateAfterEventPosition returns. Rooms which have had events since pos are omitted, as their
+// snapshot at pos is not known without the slower events table query.
+func (s *Storage) StateSnapshotIDsAtPosition(roomIDs []string, pos int64) (snapshotIDs map[string]int64, err error) {
+	db, _ := s.readDB(pos)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		snapshotIDs, err = s.Accumulator.roomsTable.CurrentSnapshotIDs(txn, roomIDs, pos)
+		return err
+	})
+	return
+}
+
 // Look up room state after the given event position and no further. eventTypesToStateKeys is a map of event type to a list of state keys for that event type.
 // If the list of state keys is empty then all events matching that event type will be returned. If the map is empty entirely, then all room state
 // will be returned.
@@ -519,7 +796,8 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	defer span.End()
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	db, _ := s.readDB(pos)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
 		// we have 2 ways to pull the latest events:
 		//  - superfast rooms table (which races as it can be updated before the new state hits the dispatcher)
 		//  - slower events table query
@@ -635,11 +913,14 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			}
 
 			// figure out which state events to look at - if there is no m.room.member filter we can be super fast
-			nidcols := "array_cat(events, membership_events)"
+			// snapshots stored as deltas add their events to those of their base snapshot
+			otherNIDs := "(COALESCE(base.events, '{}') || snap.events)"
+			membershipNIDs := "(COALESCE(base.membership_events, '{}') || snap.membership_events)"
+			nidcols := "array_cat(" + otherNIDs + ", " + membershipNIDs + ")"
 			if hasMembershipFilter && !hasOtherFilter {
-				nidcols = "membership_events"
+				nidcols = membershipNIDs
 			} else if !hasMembershipFilter && hasOtherFilter {
-				nidcols = "events"
+				nidcols = otherNIDs
 			}
 			// it's not possible for there to be no membership filter and no other filter, we wouldn't be executing this code
 			// it is possible to have both, so neither if will execute.
@@ -651,11 +932,14 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			query, args, err := sqlx.In(
 				`
 				WITH nids AS (
-    				SELECT `+nidcols+` AS allNids FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id = ANY(?)
+    				SELECT `+nidcols+` AS allNids, snap.removed_events AS removedNids
+    				FROM syncv3_snapshots AS snap LEFT JOIN syncv3_snapshots AS base ON base.snapshot_id = snap.base_snapshot_id
+    				WHERE snap.snapshot_id = ANY(?)
 				)
 				SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event 
 				FROM syncv3_events, nids
 				WHERE (`+strings.Join(wheres, " OR ")+`) AND syncv3_events.event_nid = ANY(nids.allNids)
+				AND NOT syncv3_events.event_nid = ANY(nids.removedNids)
 				ORDER BY syncv3_events.event_nid ASC`,
 				args...,
 			)
@@ -717,11 +1001,12 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	if err != nil {
 		return nil, err
 	}
-	if s.MaxTimelineLimit != 0 && limit > s.MaxTimelineLimit {
-		limit = s.MaxTimelineLimit
+	if maxLimit := s.MaxTimelineLimit(); maxLimit != 0 && limit > maxLimit {
+		limit = maxLimit
 	}
 	result := make(map[string]*LatestEvents, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	db, _ := s.readDB(to)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
 		for roomID, r := range roomIDToRange {
 			var earliestEventNID int64
 			var latestEventNID int64
@@ -762,13 +1047,31 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	return result, err
 }
 
+// RemoveDevices deletes everything stored for these devices: their to-device messages, device
+// data, device list changes and connection requests. userIDs and deviceIDs are parallel slices.
+func (s *Storage) RemoveDevices(txn *sqlx.Tx, userIDs, deviceIDs []string) error {
+	for _, table := range []string{
+		"syncv3_to_device_messages", "syncv3_to_device_ack_pos", "syncv3_device_data", "syncv3_device_list_updates",
+		"syncv3_conn_requests",
+	} {
+		_, err := txn.Exec(`DELETE FROM `+table+` t USING unnest($1::text[], $2::text[]) AS x(user_id, device_id)
+			WHERE t.user_id = x.user_id AND t.device_id = x.device_id`,
+			pq.StringArray(userIDs), pq.StringArray(deviceIDs),
+		)
+		if err != nil {
+			return fmt.Errorf("RemoveDevices: failed to delete from %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
 // Remove state snapshots which cannot be accessed by clients. The latest MaxTimelineEvents
 // snapshots must be kept, +1 for the current state. This handles the worst case where all
 // MaxTimelineEvents are state events and hence each event makes a new snapshot. We can safely
 // delete all snapshots older than this, as it's not possible to reach this snapshot as the proxy
 // does not handle historical state (deferring to the homeserver for that).
 func (s *Storage) RemoveInaccessibleStateSnapshots() error {
-	numToKeep := s.MaxTimelineLimit + 1
+	numToKeep := s.MaxTimelineLimit() + 1
 	// Create a CTE which ranks each snapshot so we can figure out which snapshots to delete
 	// then execute the delete using the CTE.
 	//
@@ -793,7 +1096,8 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	  )
 	  DELETE FROM syncv3_snapshots USING ranked_snapshots
 	  WHERE syncv3_snapshots.snapshot_id = ranked_snapshots.snapshot_id
-	  AND ranked_snapshots.row_num > %d;`, numToKeep)
+	  AND ranked_snapshots.row_num > %d
+	  AND NOT EXISTS(SELECT 1 FROM syncv3_snapshots AS delta WHERE delta.base_snapshot_id = syncv3_snapshots.snapshot_id);`, numToKeep)
 
 	result, err := s.DB.Exec(awfulQuery)
 	if err != nil {
@@ -802,10 +1106,60 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	rowsAffected, err := result.RowsAffected()
 	if err == nil {
 		logger.Info().Int64("rows_affected", rowsAffected).Msg("RemoveInaccessibleStateSnapshots: deleted rows")
+		s.Accumulator.metrics.removedSnapshots(rowsAffected)
 	}
 	return nil
 }
 
+// CompactStateSnapshots stores the snapshots of each room which are no longer its current state as
+// deltas from an older snapshot where that is smaller, see SnapshotTable.CompactRoom. This function
+// does not normally need to be called manually (the Cleaner calls it); we expose it publicly only
+// for testing purposes.
+func (s *Storage) CompactStateSnapshots() error {
+	rooms, err := s.Accumulator.snapshotTable.UncompactedRooms()
+	if err != nil {
+		return fmt.Errorf("failed to select rooms to compact: %w", err)
+	}
+	var compressed int
+	for roomID, currentSnapshotID := range rooms {
+		err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+			n, err := s.Accumulator.snapshotTable.CompactRoom(txn, roomID, currentSnapshotID)
+			compressed += n
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to compact snapshots in %s: %w", roomID, err)
+		}
+	}
+	logger.Info().Int("rooms", len(rooms)).Int("compressed", compressed).Msg("CompactStateSnapshots: compacted rooms")
+	s.Accumulator.metrics.compressedSnapshots(compressed)
+	return nil
+}
+
+// CompactReceipts deletes redundant receipts, vacuums the receipt tables if any were deleted and
+// records the size of the tables. This function does not normally need to be called manually (the
+// Cleaner calls it); we expose it publicly only for testing purposes.
+func (s *Storage) CompactReceipts() error {
+	deleted, err := s.ReceiptTable.Compact()
+	if err != nil {
+		return fmt.Errorf("failed to compact receipts: %w", err)
+	}
+	s.Accumulator.metrics.compactedReceipts(deleted)
+	if deleted > 0 {
+		logger.Info().Int64("receipts", deleted).Msg("CompactReceipts: deleted superseded private receipts")
+		if err = s.ReceiptTable.Vacuum(); err != nil {
+			// not fatal, autovacuum will get to it eventually
+			logger.Warn().Err(err).Msg("CompactReceipts: failed to vacuum receipt tables")
+		}
+	}
+	public, private, err := s.ReceiptTable.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to load receipt table stats: %w", err)
+	}
+	s.Accumulator.metrics.receiptTableStats(public, private)
+	return nil
+}
+
 func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	var err error
 	sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
@@ -1094,12 +1448,88 @@ Loop:
 				logger.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
 				sentry.CaptureException(err)
 			}
+			if err = s.CompactStateSnapshots(); err != nil {
+				logger.Warn().Err(err).Msg("failed to compact state snapshots")
+				sentry.CaptureException(err)
+			}
+			if _, err = s.RoomSummariesTable.DeleteUnused(); err != nil {
+				logger.Warn().Err(err).Msg("failed to remove unused room summaries")
+				sentry.CaptureException(err)
+			}
+			if _, _, err = s.PruneTimelineEvents(); err != nil {
+				logger.Warn().Err(err).Msg("failed to prune timeline events")
+				sentry.CaptureException(err)
+			}
+			if err = s.CompactReceipts(); err != nil {
+				logger.Warn().Err(err).Msg("failed to compact receipts")
+				sentry.CaptureException(err)
+			}
+			if _, err = s.MalformedEventsTable.DeleteOlderThan(now.Add(-MalformedEventRetention)); err != nil {
+				logger.Warn().Err(err).Msg("failed to delete old malformed events")
+				sentry.CaptureException(err)
+			}
+			if _, err = s.InvitesTable.DeleteRetiredOlderThan(now.Add(-RetiredInviteRetention)); err != nil {
+				logger.Warn().Err(err).Msg("failed to delete old retired invites")
+				sentry.CaptureException(err)
+			}
 		case <-s.shutdownCh:
 			break Loop
 		}
 	}
 }
 
+// originServerTSBackfillBatchSize is the number of events BackfillOriginServerTS updates at a time.
+const originServerTSBackfillBatchSize = 1000
+
+// BackfillOriginServerTS sets the origin_server_ts column of events which were stored before the
+// column existed. Events are updated in small batches so that the events table is never locked for
+// long, and their JSON is parsed here rather than in postgres, which rejects some valid events as
+// jsonb. Events without an origin_server_ts keep 0. Blocks until every event has been checked or
+// the storage is torn down, so should be run in its own goroutine.
+func (s *Storage) BackfillOriginServerTS() {
+	var afterNID int64
+	updated := 0
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		default:
+		}
+		events, err := s.EventsTable.SelectUnsetOriginServerTS(afterNID, originServerTSBackfillBatchSize)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to select events to backfill origin_server_ts")
+			sentry.CaptureException(err)
+			return
+		}
+		if len(events) == 0 {
+			break
+		}
+		nids := make([]int64, 0, len(events))
+		timestamps := make([]int64, 0, len(events))
+		for _, ev := range events {
+			afterNID = ev.NID
+			ts := gjson.GetBytes(ev.JSON, "origin_server_ts")
+			if ts.Type != gjson.Number || ts.Int() <= 0 {
+				continue
+			}
+			nids = append(nids, ev.NID)
+			timestamps = append(timestamps, ts.Int())
+		}
+		if len(nids) == 0 {
+			continue
+		}
+		if err = s.EventsTable.UpdateOriginServerTS(nids, timestamps); err != nil {
+			logger.Warn().Err(err).Msg("failed to backfill origin_server_ts")
+			sentry.CaptureException(err)
+			return
+		}
+		updated += len(nids)
+	}
+	if updated > 0 {
+		logger.Info().Int("events", updated).Msg("backfilled origin_server_ts")
+	}
+}
+
 func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	roomToNID = make(map[string]int64)
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
@@ -1137,6 +1567,18 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 	return roomToNID, err
 }
 
+// LatestActivityBefore returns when each room was last active at or before the timestamp `ts`, as
+// the origin_server_ts of its latest timeline event at or before `ts`. Rooms which were not active
+// by then are not in the map. Events stored before origin_server_ts was tracked are not counted
+// until BackfillOriginServerTS has set it.
+func (s *Storage) LatestActivityBefore(roomIDs []string, ts int64) (roomToActivity map[string]int64, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		roomToActivity, err = s.EventsTable.SelectLatestActivityBefore(txn, roomIDs, ts)
+		return err
+	})
+	return
+}
+
 // Returns a map from joined room IDs to EventMetadata, which is nil iff a non-nil error
 // is returned.
 func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
@@ -1194,6 +1636,7 @@ func (s *Storage) Teardown() {
 		close(s.shutdownCh)
 	}
 
+	s.Accumulator.metrics.Teardown()
 	err := s.Accumulator.db.Close()
 	if err != nil {
 		panic("Storage.Teardown: " + err.Error())
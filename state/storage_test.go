@@ -915,6 +915,48 @@ func TestStorage_FetchMemberships(t *testing.T) {
 	assertValue(t, "joins", leaves, []string{"@chris:test", "@david:test", "@glory:test", "@helen:test"})
 }
 
+func TestStorage_UsersSharingEncryptedRooms(t *testing.T) {
+	assertNoError(t, cleanDB(t))
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	encryption := map[string]any{"algorithm": "m.megolm.v1.aes-sha2"}
+	rooms := map[string][]json.RawMessage{
+		// alice shares this encrypted room with brian but chris has left
+		"!encrypted": {
+			testutils.NewStateEvent(t, "m.room.create", "", "@alice:test", map[string]any{}),
+			testutils.NewStateEvent(t, "m.room.encryption", "", "@alice:test", encryption),
+			testutils.NewStateEvent(t, "m.room.member", "@alice:test", "@alice:test", map[string]any{"membership": "join"}),
+			testutils.NewStateEvent(t, "m.room.member", "@brian:test", "@brian:test", map[string]any{"membership": "join"}),
+			testutils.NewStateEvent(t, "m.room.member", "@chris:test", "@chris:test", map[string]any{"membership": "leave"}),
+		},
+		// alice shares this room with david, but it is not encrypted
+		"!unencrypted": {
+			testutils.NewStateEvent(t, "m.room.create", "", "@alice:test", map[string]any{}),
+			testutils.NewStateEvent(t, "m.room.member", "@alice:test", "@alice:test", map[string]any{"membership": "join"}),
+			testutils.NewStateEvent(t, "m.room.member", "@david:test", "@david:test", map[string]any{"membership": "join"}),
+		},
+		// alice was only invited to this encrypted room with erika
+		"!invited": {
+			testutils.NewStateEvent(t, "m.room.create", "", "@erika:test", map[string]any{}),
+			testutils.NewStateEvent(t, "m.room.encryption", "", "@erika:test", encryption),
+			testutils.NewStateEvent(t, "m.room.member", "@erika:test", "@erika:test", map[string]any{"membership": "join"}),
+			testutils.NewStateEvent(t, "m.room.member", "@alice:test", "@erika:test", map[string]any{"membership": "invite"}),
+		},
+	}
+	for roomID, events := range rooms {
+		err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
+			_, err = store.Accumulator.Initialise(roomID, events)
+			return err
+		})
+		assertNoError(t, err)
+	}
+
+	sharing, err := store.UsersSharingEncryptedRooms("@alice:test", []string{"@brian:test", "@chris:test", "@david:test", "@erika:test"})
+	assertNoError(t, err)
+	assertValue(t, "sharing", sharing, map[string]bool{"@brian:test": true})
+}
+
 type persistOpts struct {
 	withInitialEvents bool
 	numTimelineEvents int
@@ -977,7 +1019,7 @@ func mustNotError(t *testing.T, err error) {
 
 func TestRemoveInaccessibleStateSnapshots(t *testing.T) {
 	store := NewStorage(postgresConnectionString)
-	store.MaxTimelineLimit = 50 // we nuke if we have >50+1 snapshots
+	store.SetMaxTimelineLimit(50) // we nuke if we have >50+1 snapshots
 
 	roomOnlyMessages := "!TestRemoveInaccessibleStateSnapshots_roomOnlyMessages:localhost"
 	mustPersistEvents(t, roomOnlyMessages, store, persistOpts{
@@ -1086,11 +1128,7 @@ func createInitialEvents(t *testing.T, creator string) []json.RawMessage {
 func cleanDB(t *testing.T) error {
 	// make a fresh DB which is unpolluted from other tests
 	db, close := connectToDB(t)
-	_, err := db.Exec(`
-	DROP TABLE IF EXISTS syncv3_rooms;
-	DROP TABLE IF EXISTS syncv3_invites;
-	DROP TABLE IF EXISTS syncv3_snapshots;
-	DROP TABLE IF EXISTS syncv3_spaces;`)
+	_, err := db.Exec(`TRUNCATE syncv3_rooms, syncv3_invites, syncv3_snapshots, syncv3_spaces`)
 	close()
 	return err
 }
@@ -1136,3 +1174,151 @@ func verifyRange(t *testing.T, result map[string][2]int64, roomID string, wantRa
 		t.Errorf("%s range got %v want %v", roomID, gotRange, wantRange)
 	}
 }
+
+func TestStorageCountUnread(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice:TestStorageCountUnread"
+	bob := "@bob:TestStorageCountUnread"
+	roomID := "!TestStorageCountUnread"
+	_, err := store.Accumulator.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+	accumulate := func(events ...json.RawMessage) {
+		t.Helper()
+		err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+			_, err := store.Accumulator.Accumulate(txn, alice, roomID, sync2.TimelineResponse{Events: events})
+			return err
+		})
+		assertNoError(t, err)
+	}
+	assertUnread := func(userID string, want int) {
+		t.Helper()
+		got, err := store.CountUnread(userID, roomID)
+		assertNoError(t, err)
+		if got != want {
+			t.Errorf("CountUnread(%s): got %d want %d", userID, got, want)
+		}
+	}
+
+	one := testutils.NewMessageEvent(t, bob, "one")
+	accumulate(
+		testutils.NewMessageEvent(t, bob, "before"),
+		testutils.NewMessageEvent(t, alice, "read"),
+		one,
+		testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"msgtype": "m.notice", "body": "not counted"}),
+		testutils.NewEvent(t, "m.reaction", bob, map[string]interface{}{"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$x", "key": "a"}}),
+		testutils.NewMessageEvent(t, bob, "two"),
+	)
+	// alice has no receipt, but her own message marks everything before it as read
+	assertUnread(alice, 2)
+	assertUnread(bob, 0)
+
+	// a private receipt marks everything up to the event as read
+	_, err = store.ReceiptTable.Insert(roomID, json.RawMessage(fmt.Sprintf(`{"type":"m.receipt","content":{"%s":{"m.read.private":{"%s":{"ts":1}}}}}`,
+		gjson.GetBytes(one, "event_id").Str, alice)))
+	assertNoError(t, err)
+	assertUnread(alice, 1)
+
+	accumulate(testutils.NewMessageEvent(t, alice, "three"))
+	assertUnread(alice, 0)
+	assertUnread(bob, 1)
+}
+
+func TestStorageMembershipHistory(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageMembershipHistory:localhost"
+	alice := "@alice_TestStorageMembershipHistory:localhost"
+	bob := "@bob_TestStorageMembershipHistory:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewJoinEvent(t, bob),
+			testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "leave"}),
+			testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+
+	history, err := store.MembershipHistory(roomID, bob)
+	if err != nil {
+		t.Fatalf("MembershipHistory: %s", err)
+	}
+	if history.CurrentSnapshotID == 0 {
+		t.Fatalf("MembershipHistory: missing current snapshot")
+	}
+	if len(history.Events) != 2 {
+		t.Fatalf("MembershipHistory: got %d events want 2", len(history.Events))
+	}
+	join, leave := history.Events[0], history.Events[1]
+	if join.Membership != "join" || leave.Membership != "leave" {
+		t.Errorf("MembershipHistory: got memberships %s, %s want join, leave", join.Membership, leave.Membership)
+	}
+	if join.IsState || join.NID >= leave.NID {
+		t.Errorf("MembershipHistory: join event %+v is not a timeline event before %+v", join, leave)
+	}
+	if join.InCurrentState || !leave.InCurrentState {
+		t.Errorf("MembershipHistory: got in_current_state %v, %v want false, true", join.InCurrentState, leave.InCurrentState)
+	}
+	if len(join.Snapshots) != 1 || join.Snapshots[0] != leave.BeforeStateSnapshotID {
+		t.Errorf("MembershipHistory: got join snapshots %v want [%d]", join.Snapshots, leave.BeforeStateSnapshotID)
+	}
+}
+
+// Test that events stored before origin_server_ts was tracked are backfilled from their JSON,
+// including events which postgres can't parse as jsonb.
+func TestStorageBackfillOriginServerTS(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageBackfillOriginServerTS:localhost"
+	err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		_, err := store.EventsTable.Insert(txn, []Event{
+			{ID: "$1-TestStorageBackfillOriginServerTS", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"origin_server_ts":100}`)},
+			// jsonb rejects \u0000 escapes
+			{ID: "$2-TestStorageBackfillOriginServerTS", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"origin_server_ts":200,"content":{"body":"\u0000"}}`)},
+			{ID: "$3-TestStorageBackfillOriginServerTS", Type: "m.room.message", RoomID: roomID, JSON: []byte(`{"content":{}}`)},
+		}, false)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to insert events: %s", err)
+	}
+	// pretend the events were stored before the column existed
+	if _, err = store.DB.Exec(`UPDATE syncv3_events SET origin_server_ts = 0 WHERE room_id = $1`, roomID); err != nil {
+		t.Fatalf("failed to reset origin_server_ts: %s", err)
+	}
+
+	store.BackfillOriginServerTS()
+
+	var rows []struct {
+		EventID        string `db:"event_id"`
+		OriginServerTS int64  `db:"origin_server_ts"`
+	}
+	if err = store.DB.Select(&rows, `SELECT event_id, origin_server_ts FROM syncv3_events WHERE room_id = $1`, roomID); err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	got := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		got[row.EventID] = row.OriginServerTS
+	}
+	want := map[string]int64{
+		"$1-TestStorageBackfillOriginServerTS": 100,
+		"$2-TestStorageBackfillOriginServerTS": 200,
+		"$3-TestStorageBackfillOriginServerTS": 0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("origin_server_ts after backfill: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// ThreadUnreadTable stores per-thread unread counts per-user (MSC3773). Only threads with a non-zero
+// count are stored.
+type ThreadUnreadTable struct {
+	db *sqlx.DB
+}
+
+func NewThreadUnreadTable(db *sqlx.DB) *ThreadUnreadTable {
+	return &ThreadUnreadTable{db}
+}
+
+type threadUnreadRow struct {
+	RoomID            string `db:"room_id"`
+	ThreadID          string `db:"thread_id"`
+	NotificationCount int    `db:"notification_count"`
+	HighlightCount    int    `db:"highlight_count"`
+}
+
+// SelectAllForUser returns the thread counts for every room with an unread thread, keyed by room
+// ID then thread ID.
+func (t *ThreadUnreadTable) SelectAllForUser(userID string) (map[string]map[string]internal.ThreadUnreadCounts, error) {
+	var rows []threadUnreadRow
+	err := t.db.Select(&rows,
+		`SELECT room_id, thread_id, notification_count, highlight_count FROM syncv3_unread_threads WHERE user_id=$1`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]internal.ThreadUnreadCounts)
+	for _, row := range rows {
+		if result[row.RoomID] == nil {
+			result[row.RoomID] = make(map[string]internal.ThreadUnreadCounts)
+		}
+		result[row.RoomID][row.ThreadID] = internal.ThreadUnreadCounts{
+			HighlightCount:    row.HighlightCount,
+			NotificationCount: row.NotificationCount,
+		}
+	}
+	return result, nil
+}
+
+// UpdateThreadUnreadCounters replaces the thread counts for this user in this room. Threads missing
+// from the map, or with zero counts, are removed. Returns true if the stored counts changed.
+func (t *ThreadUnreadTable) UpdateThreadUnreadCounters(userID, roomID string, threads map[string]internal.ThreadUnreadCounts) (changed bool, err error) {
+	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		var rows []threadUnreadRow
+		err := txn.Select(&rows,
+			`SELECT room_id, thread_id, notification_count, highlight_count FROM syncv3_unread_threads
+			WHERE user_id=$1 AND room_id=$2 FOR UPDATE`, userID, roomID,
+		)
+		if err != nil {
+			return err
+		}
+		numNonZero := 0
+		for _, counts := range threads {
+			if counts != (internal.ThreadUnreadCounts{}) {
+				numNonZero++
+			}
+		}
+		if numNonZero == len(rows) {
+			same := true
+			for _, row := range rows {
+				counts := threads[row.ThreadID]
+				if counts.HighlightCount != row.HighlightCount || counts.NotificationCount != row.NotificationCount {
+					same = false
+					break
+				}
+			}
+			if same {
+				return nil
+			}
+		}
+		changed = true
+		_, err = txn.Exec(`DELETE FROM syncv3_unread_threads WHERE user_id=$1 AND room_id=$2`, userID, roomID)
+		if err != nil {
+			return err
+		}
+		for threadID, counts := range threads {
+			if counts == (internal.ThreadUnreadCounts{}) {
+				continue
+			}
+			_, err = txn.Exec(
+				`INSERT INTO syncv3_unread_threads(user_id, room_id, thread_id, notification_count, highlight_count)
+				VALUES($1, $2, $3, $4, $5)`, userID, roomID, threadID, counts.NotificationCount, counts.HighlightCount,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return changed, nil
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestThreadUnreadTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewThreadUnreadTable(db)
+	userID := "@TestThreadUnreadTable:localhost"
+	roomA := "!TestThreadUnreadTableA:localhost"
+	roomB := "!TestThreadUnreadTableB:localhost"
+
+	update := func(roomID string, threads map[string]internal.ThreadUnreadCounts, wantChanged bool) {
+		t.Helper()
+		changed, err := table.UpdateThreadUnreadCounters(userID, roomID, threads)
+		assertNoError(t, err)
+		if changed != wantChanged {
+			t.Errorf("UpdateThreadUnreadCounters(%s, %v): got changed=%v want %v", roomID, threads, changed, wantChanged)
+		}
+	}
+	assertThreads := func(want map[string]map[string]internal.ThreadUnreadCounts) {
+		t.Helper()
+		got, err := table.SelectAllForUser(userID)
+		assertNoError(t, err)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SelectAllForUser: got %v want %v", got, want)
+		}
+	}
+
+	update(roomA, map[string]internal.ThreadUnreadCounts{
+		"$root1": {NotificationCount: 2},
+		"$root2": {NotificationCount: 1, HighlightCount: 1},
+		"$root3": {},
+	}, true)
+	update(roomB, map[string]internal.ThreadUnreadCounts{
+		"$root4": {NotificationCount: 5},
+	}, true)
+	assertThreads(map[string]map[string]internal.ThreadUnreadCounts{
+		roomA: {
+			"$root1": {NotificationCount: 2},
+			"$root2": {NotificationCount: 1, HighlightCount: 1},
+		},
+		roomB: {
+			"$root4": {NotificationCount: 5},
+		},
+	})
+
+	// the same counts change nothing, whether or not zero counts are included
+	update(roomA, map[string]internal.ThreadUnreadCounts{
+		"$root1": {NotificationCount: 2},
+		"$root2": {NotificationCount: 1, HighlightCount: 1},
+	}, false)
+
+	// threads missing from the map are cleared
+	update(roomA, map[string]internal.ThreadUnreadCounts{
+		"$root2": {NotificationCount: 3, HighlightCount: 1},
+	}, true)
+	update(roomB, map[string]internal.ThreadUnreadCounts{}, true)
+	assertThreads(map[string]map[string]internal.ThreadUnreadCounts{
+		roomA: {
+			"$root2": {NotificationCount: 3, HighlightCount: 1},
+		},
+	})
+	update(roomB, nil, false)
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -16,9 +17,26 @@ const (
 	ActionCancel  = 2
 )
 
+// ToDeviceQuota limits how many to-device messages are queued for each device, so that devices
+// which never sync again do not fill the database. When a device is over its quota, its oldest
+// messages are dropped. Each limit is disabled if 0.
+type ToDeviceQuota struct {
+	// MaxMessages is the most messages queued for a device.
+	MaxMessages int
+	// MaxBytes is the most bytes of messages queued for a device.
+	MaxBytes int64
+	// MaxAge drops messages which were received from the homeserver longer ago than this.
+	MaxAge time.Duration
+}
+
+func (q ToDeviceQuota) enabled() bool {
+	return q.MaxMessages > 0 || q.MaxBytes > 0 || q.MaxAge > 0
+}
+
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	quota ToDeviceQuota
 }
 
 type ToDeviceRow struct {
@@ -30,6 +48,9 @@ type ToDeviceRow struct {
 	Sender    string  `db:"sender"`
 	UniqueKey *string `db:"unique_key"`
 	Action    int     `db:"action"`
+	// ReceivedAt is when the proxy received the message from the homeserver, in unix milliseconds,
+	// or 0 for messages stored before this was recorded.
+	ReceivedAt int64 `db:"received_at"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -42,31 +63,12 @@ func (c ToDeviceRowChunker) Subslice(i, j int) sqlutil.Chunker {
 }
 
 func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_to_device_messages_seq;
-	CREATE TABLE IF NOT EXISTS syncv3_to_device_messages (
-		position BIGINT NOT NULL PRIMARY KEY DEFAULT nextval('syncv3_to_device_messages_seq'),
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		event_type TEXT NOT NULL,
-		sender TEXT NOT NULL,
-		message TEXT NOT NULL,
-		-- nullable as these fields are not on all to-device events
-		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
-	);
-	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		unack_pos BIGINT NOT NULL
-	);
-	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
-	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
-	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
-	`)
-	return &ToDeviceTable{db}
+	return &ToDeviceTable{db: db}
+}
+
+// SetQuota configures the quota which EnforceQuota applies.
+func (t *ToDeviceTable) SetQuota(quota ToDeviceQuota) {
+	t.quota = quota
 }
 
 func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) error {
@@ -94,17 +96,26 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) erro
 // Returns the fetches messages ordered by ascending position, as well as the position of the last to-device message
 // fetched.
 func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (msgs []json.RawMessage, upTo int64, err error) {
+	msgs, _, upTo, err = t.MessagesWithReceivedAt(userID, deviceID, from, limit)
+	return
+}
+
+// MessagesWithReceivedAt is like Messages, but also returns when each message was received from the
+// homeserver, in unix milliseconds. Messages stored before this was recorded have a time of 0.
+func (t *ToDeviceTable) MessagesWithReceivedAt(userID, deviceID string, from, limit int64) (msgs []json.RawMessage, receivedAt []int64, upTo int64, err error) {
 	upTo = from
 	var rows []ToDeviceRow
 	err = t.db.Select(&rows,
-		`SELECT position, message FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position > $3 ORDER BY position ASC LIMIT $4`,
+		`SELECT position, message, received_at FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position > $3 ORDER BY position ASC LIMIT $4`,
 		userID, deviceID, from, limit,
 	)
 	if len(rows) == 0 {
 		return
 	}
 	msgs = make([]json.RawMessage, len(rows))
+	receivedAt = make([]int64, len(rows))
 	for i := range rows {
+		receivedAt[i] = rows[i].ReceivedAt
 		msgs[i] = json.RawMessage(rows[i].Message)
 		m := gjson.ParseBytes(msgs[i])
 		msgId := m.Get(`content.org\.matrix\.msgid`).Str
@@ -118,6 +129,7 @@ func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (ms
 
 func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawMessage) (pos int64, err error) {
 	var lastPos int64
+	receivedAt := time.Now().UnixMilli()
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
 		var unackPos int64
 		err = txn.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID).Scan(&unackPos)
@@ -135,11 +147,12 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 		for i := range msgs {
 			m := gjson.ParseBytes(msgs[i])
 			rows[i] = ToDeviceRow{
-				UserID:   userID,
-				DeviceID: deviceID,
-				Message:  string(msgs[i]),
-				Type:     m.Get("type").Str,
-				Sender:   m.Get("sender").Str,
+				UserID:     userID,
+				DeviceID:   deviceID,
+				Message:    string(msgs[i]),
+				Type:       m.Get("type").Str,
+				Sender:     m.Get("sender").Str,
+				ReceivedAt: receivedAt,
 			}
 			msgId := m.Get(`content.org\.matrix\.msgid`).Str
 			if msgId != "" {
@@ -201,10 +214,10 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(8, MaxPostgresParameters, ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
-			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
-        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
+			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key, received_at)
+        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key, :received_at) RETURNING position`, chunk)
 			if err != nil {
 				return err
 			}
@@ -220,3 +233,111 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 	})
 	return lastPos, err
 }
+
+// EnforceQuota drops the oldest messages queued for this device until it is within the quota
+// configured with SetQuota. Returns the number of messages dropped which had not been sent to the
+// device yet. These are remembered until TakeDropped is called, so that the device can be told
+// that it missed messages.
+func (t *ToDeviceTable) EnforceQuota(userID, deviceID string, now time.Time) (dropped int64, err error) {
+	quota := t.quota
+	if !quota.enabled() {
+		return 0, nil
+	}
+	var cutoff int64
+	if quota.MaxAge > 0 {
+		cutoff = now.Add(-quota.MaxAge).UnixMilli()
+	}
+	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		// rank the device's messages from newest to oldest, with the running total of their size
+		err = txn.QueryRow(`
+		WITH ranked AS (
+			SELECT position, received_at,
+			  ROW_NUMBER() OVER (ORDER BY position DESC) AS row_num,
+			  SUM(octet_length(message)) OVER (ORDER BY position DESC) AS total_bytes
+			FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2
+		), deleted AS (
+			DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position IN (
+				SELECT position FROM ranked
+				WHERE ($3 > 0 AND row_num > $3) OR ($4 > 0 AND total_bytes > $4) OR ($5 > 0 AND received_at > 0 AND received_at < $5)
+			) RETURNING position
+		)
+		SELECT COUNT(*) FROM deleted
+		WHERE position > COALESCE((SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id = $1 AND device_id = $2), 0)`,
+			userID, deviceID, quota.MaxMessages, quota.MaxBytes, cutoff,
+		).Scan(&dropped)
+		if err != nil {
+			return fmt.Errorf("failed to drop to-device messages over quota: %s", err)
+		}
+		if dropped == 0 {
+			return nil
+		}
+		_, err = txn.Exec(`INSERT INTO syncv3_to_device_ack_pos(user_id, device_id, unack_pos, dropped) VALUES($1,$2,0,$3)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET dropped = syncv3_to_device_ack_pos.dropped + excluded.dropped`,
+			userID, deviceID, dropped)
+		return err
+	})
+	return dropped, err
+}
+
+// TakeDropped returns the number of undelivered messages EnforceQuota has dropped for this device
+// since TakeDropped was last called.
+func (t *ToDeviceTable) TakeDropped(userID, deviceID string) (dropped int64, err error) {
+	err = t.db.QueryRow(`
+	WITH old AS (
+		SELECT dropped FROM syncv3_to_device_ack_pos WHERE user_id = $1 AND device_id = $2 AND dropped > 0 FOR UPDATE
+	)
+	UPDATE syncv3_to_device_ack_pos SET dropped = 0 FROM old
+	WHERE user_id = $1 AND device_id = $2 RETURNING old.dropped`, userID, deviceID).Scan(&dropped)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return dropped, err
+}
+
+// ToDeviceQueueStats describes the to-device messages which are waiting to be sent to devices.
+type ToDeviceQueueStats struct {
+	// Devices is the number of devices with at least one undelivered message.
+	Devices int
+	// MaxDepth is the most undelivered messages queued for a single device.
+	MaxDepth int64
+	// OldestReceivedAt is when the oldest undelivered message was received, in unix milliseconds,
+	// or 0 if there are no undelivered messages with a known receipt time.
+	OldestReceivedAt int64
+}
+
+// QueueStats returns statistics about the messages queued for these devices which have not been
+// sent to the device yet. userIDs and deviceIDs are parallel slices.
+func (t *ToDeviceTable) QueueStats(userIDs, deviceIDs []string) (stats ToDeviceQueueStats, err error) {
+	if len(userIDs) == 0 {
+		return
+	}
+	var queues []struct {
+		Depth            int64 `db:"depth"`
+		OldestReceivedAt int64 `db:"oldest_received_at"`
+	}
+	err = t.db.Select(&queues, `
+	WITH devices AS (
+		SELECT * FROM unnest($1::TEXT[], $2::TEXT[]) AS d(user_id, device_id)
+	)
+	SELECT COUNT(*) AS depth, COALESCE(MIN(NULLIF(m.received_at, 0)), 0) AS oldest_received_at
+	FROM devices
+	JOIN syncv3_to_device_messages m ON m.user_id = devices.user_id AND m.device_id = devices.device_id
+	LEFT JOIN syncv3_to_device_ack_pos a ON a.user_id = devices.user_id AND a.device_id = devices.device_id
+	WHERE m.position > COALESCE(a.unack_pos, 0)
+	GROUP BY devices.user_id, devices.device_id`,
+		pq.StringArray(userIDs), pq.StringArray(deviceIDs),
+	)
+	if err != nil {
+		return
+	}
+	stats.Devices = len(queues)
+	for _, q := range queues {
+		if q.Depth > stats.MaxDepth {
+			stats.MaxDepth = q.Depth
+		}
+		if q.OldestReceivedAt != 0 && (stats.OldestReceivedAt == 0 || q.OldestReceivedAt < stats.OldestReceivedAt) {
+			stats.OldestReceivedAt = q.OldestReceivedAt
+		}
+	}
+	return
+}
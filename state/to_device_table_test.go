@@ -3,7 +3,9 @@ package state
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -339,3 +341,108 @@ func newRoomKeyEvent(t *testing.T, action, reqID, reqDeviceID string, body map[s
 	}
 	return json.RawMessage(b)
 }
+
+func TestToDeviceTableQueueStats(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	sender := "@TestToDeviceTableQueueStats:localhost"
+	msg := json.RawMessage(`{"sender":"@bob:localhost","type":"something","content":{}}`)
+	before := time.Now().UnixMilli()
+	_, err := table.InsertMessages(sender, "A", []json.RawMessage{msg, msg, msg})
+	assertNoError(t, err)
+	posB, err := table.InsertMessages(sender, "B", []json.RawMessage{msg})
+	assertNoError(t, err)
+
+	_, receivedAt, _, err := table.MessagesWithReceivedAt(sender, "A", 0, 10)
+	assertNoError(t, err)
+	if len(receivedAt) != 3 || receivedAt[0] < before || receivedAt[0] > time.Now().UnixMilli() {
+		t.Fatalf("MessagesWithReceivedAt: got receipt times %v, want 3 times after %d", receivedAt, before)
+	}
+
+	// B has been sent its message, and C is not a connected device
+	assertNoError(t, table.SetUnackedPosition(sender, "B", posB))
+	_, err = table.InsertMessages(sender, "C", []json.RawMessage{msg, msg, msg, msg})
+	assertNoError(t, err)
+	stats, err := table.QueueStats([]string{sender, sender}, []string{"A", "B"})
+	assertNoError(t, err)
+	if stats.Devices != 1 || stats.MaxDepth != 3 || stats.OldestReceivedAt != receivedAt[0] {
+		t.Errorf("QueueStats: got %+v want 1 device with 3 messages received at %d", stats, receivedAt[0])
+	}
+
+	stats, err = table.QueueStats(nil, nil)
+	assertNoError(t, err)
+	if stats != (ToDeviceQueueStats{}) {
+		t.Errorf("QueueStats with no devices: got %+v want nothing", stats)
+	}
+}
+
+func TestToDeviceTableEnforceQuota(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	user := "@TestToDeviceTableEnforceQuota:localhost"
+	msg := func(i int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"sender":"@bob:localhost","type":"something","content":{"i":%d}}`, i))
+	}
+	var msgs []json.RawMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, msg(i))
+	}
+	pos, err := table.InsertMessages(user, "A", msgs)
+	assertNoError(t, err)
+	// the first 2 messages have been sent to the device, so dropping them does not lose anything
+	assertNoError(t, table.SetUnackedPosition(user, "A", pos-3))
+
+	// no quota, nothing is dropped
+	dropped, err := table.EnforceQuota(user, "A", time.Now())
+	assertNoError(t, err)
+	if dropped != 0 {
+		t.Fatalf("EnforceQuota without a quota: dropped %d want 0", dropped)
+	}
+
+	table.SetQuota(ToDeviceQuota{MaxMessages: 2})
+	dropped, err = table.EnforceQuota(user, "A", time.Now())
+	assertNoError(t, err)
+	if dropped != 1 {
+		t.Fatalf("EnforceQuota: dropped %d undelivered messages want 1", dropped)
+	}
+	got, _, err := table.Messages(user, "A", 0, 10)
+	assertNoError(t, err)
+	if len(got) != 2 || !bytes.Equal(got[0], msgs[3]) || !bytes.Equal(got[1], msgs[4]) {
+		t.Fatalf("Messages: got %v want the 2 newest messages", got)
+	}
+
+	// the bytes quota only has room for the newest message
+	table.SetQuota(ToDeviceQuota{MaxBytes: int64(len(msgs[4]) + 1)})
+	dropped, err = table.EnforceQuota(user, "A", time.Now())
+	assertNoError(t, err)
+	if dropped != 1 {
+		t.Fatalf("EnforceQuota with max bytes: dropped %d want 1", dropped)
+	}
+
+	// every message is too old
+	table.SetQuota(ToDeviceQuota{MaxAge: time.Hour})
+	dropped, err = table.EnforceQuota(user, "A", time.Now().Add(2*time.Hour))
+	assertNoError(t, err)
+	if dropped != 1 {
+		t.Fatalf("EnforceQuota with max age: dropped %d want 1", dropped)
+	}
+
+	// the drops are reported once
+	dropped, err = table.TakeDropped(user, "A")
+	assertNoError(t, err)
+	if dropped != 3 {
+		t.Errorf("TakeDropped: got %d want 3", dropped)
+	}
+	dropped, err = table.TakeDropped(user, "A")
+	assertNoError(t, err)
+	if dropped != 0 {
+		t.Errorf("TakeDropped again: got %d want 0", dropped)
+	}
+	dropped, err = table.TakeDropped(user, "UNKNOWN")
+	assertNoError(t, err)
+	if dropped != 0 {
+		t.Errorf("TakeDropped for unknown device: got %d want 0", dropped)
+	}
+}
@@ -20,20 +20,11 @@ type TransactionsTable struct {
 }
 
 func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_txns (
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		event_id TEXT NOT NULL,
-		txn_id TEXT NOT NULL,
-		ts BIGINT NOT NULL,
-		UNIQUE(user_id, device_id, event_id)
-	);
-	`)
 	return &TransactionsTable{db}
 }
 
+// Insert stores the transaction IDs of events sent by this device. Events which already have a
+// transaction ID keep it, as it may have been registered by the client before its poller saw it.
 func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[string]string) error {
 	ts := time.Now()
 	rows := make([]txnRow, 0, len(eventIDToTxnID))
@@ -48,7 +39,8 @@ func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[s
 	}
 	result, err := t.db.NamedQuery(`
 		INSERT INTO syncv3_txns (user_id, device_id, event_id, txn_id, ts)
-        VALUES (:user_id, :device_id, :event_id, :txn_id, :ts)`, rows)
+        VALUES (:user_id, :device_id, :event_id, :txn_id, :ts)
+		ON CONFLICT (user_id, device_id, event_id) DO NOTHING`, rows)
 	if err == nil {
 		result.Close()
 	}
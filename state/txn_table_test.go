@@ -60,6 +60,20 @@ func TestTransactionTable(t *testing.T) {
 		eventB: txnIDB,
 	})
 
+	// inserting an event again keeps its first txn ID, without failing the rest of the insert
+	eventC := "$C"
+	err = table.Insert(userID, deviceID, map[string]string{
+		eventA: "txn_A_again",
+		eventC: "txn_C",
+	})
+	assertNoError(t, err)
+	gotTxns, err = table.Select(userID, deviceID, []string{eventA, eventC})
+	assertNoError(t, err)
+	assertTxns(t, gotTxns, map[string]string{
+		eventA: txnIDA,
+		eventC: "txn_C",
+	})
+
 	// different user select
 	gotTxns, err = table.Select("@another", "another_device", []string{eventA, eventB})
 	assertNoError(t, err)
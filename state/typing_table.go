@@ -2,9 +2,12 @@ package state
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 // TypingTable stores who is currently typing
@@ -15,15 +18,6 @@ type TypingTable struct {
 }
 
 func NewTypingTable(db *sqlx.DB) *TypingTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_typing_seq;
-	CREATE TABLE IF NOT EXISTS syncv3_typing (
-		stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_typing_seq'),
-		room_id TEXT NOT NULL PRIMARY KEY,
-		user_ids TEXT[] NOT NULL
-	);
-	`)
 	return &TypingTable{db}
 }
 
@@ -38,26 +32,35 @@ func (t *TypingTable) SelectHighestID() (id int64, err error) {
 	return
 }
 
+// SetTyping stores who is typing in the room. They stop counting as typing after internal.TypingTTL,
+// in case the homeserver never sends the cleared typing notification.
 func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64, err error) {
 	if userIDs == nil {
 		userIDs = []string{}
 	}
+	expiresTS := time.Now().Add(internal.TypingTTL).UnixMilli()
 	err = t.db.QueryRow(`
-		INSERT INTO syncv3_typing(room_id, user_ids) VALUES($1, $2)
-		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`,
-		roomID, pq.Array(userIDs),
+		INSERT INTO syncv3_typing(room_id, user_ids, expires_ts) VALUES($1, $2, $3)
+		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, expires_ts = $3, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`,
+		roomID, pq.Array(userIDs), expiresTS,
 	).Scan(&position)
 	return position, err
 }
 
+// Typing returns who is typing in the room, if it changed within the stream positions. Nobody is
+// typing if the typing users have expired.
 func (t *TypingTable) Typing(roomID string, fromStreamIDExcl, toStreamIDIncl int64) (userIDs []string, latest int64, err error) {
 	var userIDsArray pq.StringArray
+	var expiresTS int64
 	err = t.db.QueryRow(
-		`SELECT stream_id, user_ids FROM syncv3_typing WHERE room_id=$1 AND stream_id > $2 AND stream_id <= $3`,
+		`SELECT stream_id, user_ids, expires_ts FROM syncv3_typing WHERE room_id=$1 AND stream_id > $2 AND stream_id <= $3`,
 		roomID, fromStreamIDExcl, toStreamIDIncl,
-	).Scan(&latest, &userIDsArray)
+	).Scan(&latest, &userIDsArray, &expiresTS)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
+	if len(userIDsArray) > 0 && time.Now().UnixMilli() > expiresTS {
+		userIDsArray = []string{}
+	}
 	return userIDsArray, latest, err
 }
@@ -49,4 +49,16 @@ func TestTypingTable(t *testing.T) {
 	if highest != lastStreamID {
 		t.Fatalf("SelectHighestID: got %d want %d", highest, lastStreamID)
 	}
+
+	// nobody is typing once the typing users expire
+	userIDs = []string{"@alice:localhost"}
+	setAndCheck()
+	db.MustExec(`UPDATE syncv3_typing SET expires_ts = 1 WHERE room_id = $1`, roomID)
+	gotUserIDs, gotStreamID, err := table.Typing(roomID, lastStreamID-1, lastStreamID)
+	if err != nil {
+		t.Fatalf("failed to Typing: %s", err)
+	}
+	if len(gotUserIDs) != 0 || gotStreamID != lastStreamID {
+		t.Errorf("Typing after expiry: got %v at %d want nobody at %d", gotUserIDs, gotStreamID, lastStreamID)
+	}
 }
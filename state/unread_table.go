@@ -1,6 +1,8 @@
 package state
 
 import (
+	"database/sql"
+
 	"github.com/jmoiron/sqlx"
 )
 
@@ -10,23 +12,15 @@ type UnreadTable struct {
 }
 
 func NewUnreadTable(db *sqlx.DB) *UnreadTable {
-	// make sure tables are made
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_unread (
-		room_id TEXT NOT NULL,
-		user_id TEXT NOT NULL,
-		notification_count BIGINT NOT NULL DEFAULT 0,
-		highlight_count BIGINT NOT NULL DEFAULT 0,
-		unread_count BIGINT NOT NULL DEFAULT 0,
-		UNIQUE(user_id, room_id)
-	);
-	`)
 	return &UnreadTable{db}
 }
 
+// SelectAllNonZeroCountsForUser calls the callback with the counts of every room where any of the
+// user's counts are non-zero. The unread count is the only count in rooms which don't notify,
+// and it is moved by the user's public and private read receipts alike.
 func (t *UnreadTable) SelectAllNonZeroCountsForUser(userID string, callback func(roomID string, highlightCount, notificationCount, unreadCount int)) error {
 	rows, err := t.db.Query(
-		`SELECT room_id, notification_count, highlight_count, unread_count FROM syncv3_unread WHERE user_id=$1 AND (notification_count > 0 OR highlight_count > 0)`,
+		`SELECT room_id, notification_count, highlight_count, unread_count FROM syncv3_unread WHERE user_id=$1 AND (notification_count > 0 OR highlight_count > 0 OR unread_count > 0)`,
 		userID,
 	)
 	if err != nil {
@@ -37,7 +31,7 @@ func (t *UnreadTable) SelectAllNonZeroCountsForUser(userID string, callback func
 		var roomID string
 		var highlightCount int
 		var notifCount int
-        var unreadCount int
+		var unreadCount int
 		if err := rows.Scan(&roomID, &notifCount, &highlightCount, &unreadCount); err != nil {
 			return err
 		}
@@ -53,6 +47,17 @@ func (t *UnreadTable) SelectUnreadCounters(userID, roomID string) (highlightCoun
 	return
 }
 
+// SelectUnreadCount returns the user's MSC2654 unread count in the room, or 0 if it has none.
+func (t *UnreadTable) SelectUnreadCount(userID, roomID string) (unreadCount int, err error) {
+	err = t.db.QueryRow(
+		`SELECT unread_count FROM syncv3_unread WHERE user_id=$1 AND room_id=$2`, userID, roomID,
+	).Scan(&unreadCount)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount, unreadCount *int) error {
 	var err error
 	if highlightCount != nil && notificationCount != nil {
@@ -74,10 +79,8 @@ func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount
 			roomID, userID, *notificationCount,
 		)
 	}
-    if unreadCount != nil {
-        // TODO we're ignoring error here right now, there's probably a better way
-        // without making above if-else construct exponentially large
-		_, _ = t.db.Exec(
+	if err == nil && unreadCount != nil {
+		_, err = t.db.Exec(
 			`INSERT INTO syncv3_unread(room_id, user_id, unread_count) VALUES($1, $2, $3)
 		ON CONFLICT (room_id, user_id) DO UPDATE SET unread_count = $3`,
 			roomID, userID, *unreadCount,
@@ -12,27 +12,32 @@ func TestUnreadTable(t *testing.T) {
 	roomA := "!TestUnreadTableA:localhost"
 	roomB := "!TestUnreadTableB:localhost"
 	roomC := "!TestUnreadTableC:localhost"
+	roomD := "!TestUnreadTableD:localhost"
 
 	two := 2
 	one := 1
 	zero := 0
 
 	// try all kinds of insertions
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &two, &one)) // both
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, &two, nil))  // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, nil, &two))  // one
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &two, &one, nil)) // both
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, &two, nil, nil))  // one
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, nil, &two, nil))  // one
 	assertUnread(t, table, userID, roomA, 2, 1)
 	assertUnread(t, table, userID, roomB, 2, 0)
 	assertUnread(t, table, userID, roomC, 0, 2)
 
 	// try all kinds of updates
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &zero, nil))   // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, nil, &two))    // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, &zero, &zero)) // both
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &zero, nil, nil))   // one
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, nil, &two, nil))    // one
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, &zero, &zero, nil)) // both
 	assertUnread(t, table, userID, roomA, 0, 1)
 	assertUnread(t, table, userID, roomB, 2, 2)
 	assertUnread(t, table, userID, roomC, 0, 0)
 
+	// a room which only has unread messages, e.g because it is muted
+	assertNoError(t, table.UpdateUnreadCounters(userID, roomD, &zero, &zero, &two))
+	assertUnread(t, table, userID, roomD, 0, 0)
+
 	wantHighlights := map[string]int{
 		roomB: 2,
 	}
@@ -40,7 +45,10 @@ func TestUnreadTable(t *testing.T) {
 		roomA: 1,
 		roomB: 2,
 	}
-	assertNoError(t, table.SelectAllNonZeroCountsForUser(userID, func(gotRoomID string, gotHighlight int, gotNotif int) {
+	wantUnreads := map[string]int{
+		roomD: 2,
+	}
+	assertNoError(t, table.SelectAllNonZeroCountsForUser(userID, func(gotRoomID string, gotHighlight, gotNotif, gotUnread int) {
 		wantHighlight := wantHighlights[gotRoomID]
 		if wantHighlight != gotHighlight {
 			t.Errorf("SelectAllNonZeroCountsForUser for %v got %d highlights, want %d", gotRoomID, gotHighlight, wantHighlight)
@@ -49,8 +57,13 @@ func TestUnreadTable(t *testing.T) {
 		if wantNotif != gotNotif {
 			t.Errorf("SelectAllNonZeroCountsForUser for %v got %d notifs, want %d", gotRoomID, gotNotif, wantNotif)
 		}
+		wantUnread := wantUnreads[gotRoomID]
+		if wantUnread != gotUnread {
+			t.Errorf("SelectAllNonZeroCountsForUser for %v got %d unreads, want %d", gotRoomID, gotUnread, wantUnread)
+		}
 		delete(wantHighlights, gotRoomID)
 		delete(wantNotifs, gotRoomID)
+		delete(wantUnreads, gotRoomID)
 	}))
 	if len(wantHighlights) != 0 {
 		t.Errorf("SelectAllNonZeroCountsForUser missed highlight rooms: %+v", wantHighlights)
@@ -58,6 +71,9 @@ func TestUnreadTable(t *testing.T) {
 	if len(wantNotifs) != 0 {
 		t.Errorf("SelectAllNonZeroCountsForUser missed notif rooms: %+v", wantNotifs)
 	}
+	if len(wantUnreads) != 0 {
+		t.Errorf("SelectAllNonZeroCountsForUser missed unread rooms: %+v", wantUnreads)
+	}
 }
 
 func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif int) {
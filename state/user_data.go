@@ -0,0 +1,111 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// userDataTables are the tables which hold data about a user in a user_id column, with the
+// columns to export from each. Binary columns holding JSON are decoded, so the export is readable.
+// Device data is stored as CBOR so is exported separately.
+var userDataTables = []struct {
+	name    string
+	columns string
+}{
+	{"syncv3_account_data", "room_id, type, convert_from(data, 'UTF8')::json AS data"},
+	{"syncv3_invites", "room_id, convert_from(invite_state, 'UTF8')::json AS invite_state"},
+	{"syncv3_to_device_messages", "position, device_id, event_type, sender, message::json AS message, received_at"},
+	{"syncv3_to_device_ack_pos", "device_id, unack_pos"},
+	{"syncv3_device_list_updates", "device_id, target_user_id, target_state, bucket"},
+	{"syncv3_receipts", "room_id, thread_id, event_id, ts"},
+	{"syncv3_receipts_private", "room_id, thread_id, event_id, ts"},
+	{"syncv3_unread", "room_id, notification_count, highlight_count, unread_count"},
+	{"syncv3_unread_threads", "room_id, thread_id, notification_count, highlight_count"},
+	{"syncv3_txns", "device_id, event_id, txn_id, ts"},
+	{"syncv3_presence", "presence, status_msg, currently_active, last_active_ts"},
+	{"syncv3_conn_requests", "device_id, conn_id, convert_from(request, 'UTF8')::json AS request, updated_at"},
+	{"syncv3_forgotten_rooms", "room_id, forgotten_nid"},
+	{"syncv3_retired_invites", "room_id, retired_ts, created_at"},
+}
+
+// forgottenRoomTables are the tables whose rows about a user in a room are deleted when the user
+// forgets the room. Public receipts are seen by the other members, so are kept.
+var forgottenRoomTables = []string{
+	"syncv3_invites",
+	"syncv3_receipts_private",
+	"syncv3_unread",
+	"syncv3_unread_threads",
+}
+
+// ForgetRoom hides a room the user has left from them, by deleting their invite, private receipts
+// and notification counts for the room and remembering that they forgot it. See
+// ForgottenRoomsTable.
+func (s *Storage) ForgetRoom(userID, roomID string) error {
+	return sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		for _, table := range forgottenRoomTables {
+			if _, err := txn.Exec(`DELETE FROM `+table+` WHERE user_id = $1 AND room_id = $2`, userID, roomID); err != nil {
+				return fmt.Errorf("ForgetRoom: failed to delete from %s: %w", table, err)
+			}
+		}
+		return s.ForgottenRoomsTable.Insert(txn, userID, roomID)
+	})
+}
+
+// ExportUser returns every row the state tables hold about a user, by table name. Events the
+// user sent are room data shared with the other members, so are not included.
+func (s *Storage) ExportUser(userID string) (map[string][]json.RawMessage, error) {
+	export := make(map[string][]json.RawMessage)
+	for _, table := range userDataTables {
+		rows := []json.RawMessage{}
+		err := s.DB.Select(&rows, fmt.Sprintf(
+			`SELECT row_to_json(x) FROM (SELECT %s FROM %s WHERE user_id = $1 ORDER BY 1) x`, table.columns, table.name,
+		), userID)
+		if err != nil {
+			return nil, fmt.Errorf("ExportUser: failed to select from %s: %w", table.name, err)
+		}
+		export[table.name] = rows
+	}
+	var deviceIDs []string
+	err := s.DB.Select(&deviceIDs, `SELECT device_id FROM syncv3_device_data WHERE user_id = $1 ORDER BY device_id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ExportUser: failed to select device data: %w", err)
+	}
+	export["syncv3_device_data"] = []json.RawMessage{}
+	for _, deviceID := range deviceIDs {
+		data, err := s.DeviceDataTable.Select(userID, deviceID, false)
+		if err != nil {
+			return nil, fmt.Errorf("ExportUser: failed to select device data for %s: %w", deviceID, err)
+		}
+		if data == nil {
+			continue // deleted since we listed the devices
+		}
+		row, err := json.Marshal(struct {
+			DeviceID         string         `json:"device_id"`
+			OTKCounts        map[string]int `json:"otk_counts"`
+			FallbackKeyTypes []string       `json:"fallback_key_types"`
+		}{deviceID, data.OTKCounts, data.FallbackKeyTypes})
+		if err != nil {
+			return nil, err
+		}
+		export["syncv3_device_data"] = append(export["syncv3_device_data"], row)
+	}
+	return export, nil
+}
+
+// EraseUser deletes every row the state tables hold about a user, which ExportUser would
+// return.
+func (s *Storage) EraseUser(txn *sqlx.Tx, userID string) error {
+	for _, table := range userDataTables {
+		if _, err := txn.Exec(`DELETE FROM `+table.name+` WHERE user_id = $1`, userID); err != nil {
+			return fmt.Errorf("EraseUser: failed to delete from %s: %w", table.name, err)
+		}
+	}
+	if _, err := txn.Exec(`DELETE FROM syncv3_device_data WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("EraseUser: failed to delete from syncv3_device_data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestExportAndEraseUser(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := NewStorageWithDB(db, false)
+	alice := "@TestExportAndEraseUser_alice:localhost"
+	bob := "@TestExportAndEraseUser_bob:localhost"
+	roomID := "!TestExportAndEraseUser:localhost"
+	for _, userID := range []string{alice, bob} {
+		_, err := store.InsertAccountData(userID, roomID, []json.RawMessage{
+			[]byte(`{"type":"m.fully_read","content":{"event_id":"$a"}}`),
+		})
+		if err != nil {
+			t.Fatalf("InsertAccountData: %s", err)
+		}
+		one := 1
+		if err = store.UnreadTable.UpdateUnreadCounters(userID, roomID, &one, &one, &one); err != nil {
+			t.Fatalf("UpdateUnreadCounters: %s", err)
+		}
+		if _, err = store.ToDeviceTable.InsertMessages(userID, "DEVICE", []json.RawMessage{
+			[]byte(`{"type":"m.room_key_request","sender":"@x:localhost","content":{"action":"cancel","request_id":"1","requesting_device_id":"X"}}`),
+		}); err != nil {
+			t.Fatalf("InsertMessages: %s", err)
+		}
+	}
+
+	export, err := store.ExportUser(alice)
+	if err != nil {
+		t.Fatalf("ExportUser: %s", err)
+	}
+	for _, table := range []string{"syncv3_account_data", "syncv3_unread", "syncv3_to_device_messages"} {
+		if len(export[table]) != 1 {
+			t.Errorf("ExportUser: got %d rows in %s want 1: %v", len(export[table]), table, export[table])
+		}
+	}
+	var accountData struct {
+		RoomID string `json:"room_id"`
+		Data   struct {
+			Type string `json:"type"`
+		} `json:"data"`
+	}
+	if err = json.Unmarshal(export["syncv3_account_data"][0], &accountData); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if accountData.RoomID != roomID || accountData.Data.Type != "m.fully_read" {
+		t.Errorf("ExportUser: got account data %s", export["syncv3_account_data"][0])
+	}
+	if rows := export["syncv3_receipts"]; rows == nil || len(rows) != 0 {
+		t.Errorf("ExportUser: got %v receipts want an empty list", rows)
+	}
+
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return store.EraseUser(txn, alice)
+	})
+	if err != nil {
+		t.Fatalf("EraseUser: %s", err)
+	}
+	export, err = store.ExportUser(alice)
+	if err != nil {
+		t.Fatalf("ExportUser: %s", err)
+	}
+	for table, rows := range export {
+		if len(rows) != 0 {
+			t.Errorf("ExportUser after EraseUser: got %d rows in %s", len(rows), table)
+		}
+	}
+	// other users are untouched
+	export, err = store.ExportUser(bob)
+	if err != nil {
+		t.Fatalf("ExportUser: %s", err)
+	}
+	for _, table := range []string{"syncv3_account_data", "syncv3_unread", "syncv3_to_device_messages"} {
+		if len(export[table]) != 1 {
+			t.Errorf("ExportUser(bob): got %d rows in %s want 1", len(export[table]), table)
+		}
+	}
+}
+
+func TestForgetRoom(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := NewStorageWithDB(db, false)
+	alice := "@TestForgetRoom_alice:localhost"
+	bob := "@TestForgetRoom_bob:localhost"
+	roomID := "!TestForgetRoom:localhost"
+	_, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "leave"}),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	one := 1
+	for _, userID := range []string{alice, bob} {
+		if err = store.UnreadTable.UpdateUnreadCounters(userID, roomID, &one, &one, &one); err != nil {
+			t.Fatalf("UpdateUnreadCounters: %s", err)
+		}
+	}
+
+	forgotten, err := store.ForgottenRoomsTable.IsForgotten(bob, roomID)
+	assertNoError(t, err)
+	if forgotten {
+		t.Fatalf("IsForgotten before ForgetRoom: got true")
+	}
+	assertNoError(t, store.ForgetRoom(bob, roomID))
+	forgotten, err = store.ForgottenRoomsTable.IsForgotten(bob, roomID)
+	assertNoError(t, err)
+	if !forgotten {
+		t.Fatalf("IsForgotten after ForgetRoom: got false")
+	}
+	export, err := store.ExportUser(bob)
+	assertNoError(t, err)
+	if len(export["syncv3_unread"]) != 0 || len(export["syncv3_forgotten_rooms"]) != 1 {
+		t.Errorf("ExportUser after ForgetRoom: got %v", export)
+	}
+	// other users are untouched
+	export, err = store.ExportUser(alice)
+	assertNoError(t, err)
+	if len(export["syncv3_unread"]) != 1 {
+		t.Errorf("ExportUser(alice): got %d unread rows want 1", len(export["syncv3_unread"]))
+	}
+
+	// rejoining the room un-forgets it
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewJoinEvent(t, bob),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	forgotten, err = store.ForgottenRoomsTable.IsForgotten(bob, roomID)
+	assertNoError(t, err)
+	if forgotten {
+		t.Fatalf("IsForgotten after rejoining: got true")
+	}
+}
@@ -0,0 +1,288 @@
+package sync2
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitBreakerConfig configures when pollers stop polling an upstream homeserver which is failing.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed polls, across all pollers, which trips
+	// the breaker. If 0, the breaker is disabled.
+	FailureThreshold int
+	// Cooldown is how long the breaker waits before letting a single probe poll through. It doubles
+	// every time the probe fails, up to MaxCooldown.
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+}
+
+// DefaultCircuitBreakerConfig trips after 20 consecutive failures and probes every 5s-1m.
+var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+	FailureThreshold: 20,
+	Cooldown:         5 * time.Second,
+	MaxCooldown:      time.Minute,
+}
+
+// UpstreamStatus is whether the upstream homeserver is reachable, according to the circuit breaker.
+type UpstreamStatus struct {
+	// ServerName is the server name of the homeserver's users.
+	ServerName string
+	Available  bool
+	// UnavailableSince is when the breaker tripped, or the zero time if Available.
+	UnavailableSince time.Time
+}
+
+// CircuitBreakers keeps a CircuitBreaker for each upstream homeserver, by the server name of its
+// users, so that one homeserver failing doesn't pause polling for the users of the others.
+type CircuitBreakers struct {
+	cfg           CircuitBreakerConfig
+	mu            *sync.Mutex
+	breakers      map[string]*CircuitBreaker
+	onStateChange func(status UpstreamStatus)
+	openGauge     *prometheus.GaugeVec
+	tripsCounter  *prometheus.CounterVec
+}
+
+// NewCircuitBreakers makes a set of closed breakers. Returns nil if the breakers are disabled,
+// which is safe to use and allows every poll.
+func NewCircuitBreakers(cfg CircuitBreakerConfig, enablePrometheus bool) *CircuitBreakers {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	b := &CircuitBreakers{
+		cfg:      cfg,
+		mu:       &sync.Mutex{},
+		breakers: make(map[string]*CircuitBreaker),
+	}
+	if enablePrometheus {
+		b.openGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "upstream_circuit_open",
+			Help:      "Set to 1 when polling is paused because the upstream homeserver keeps failing.",
+		}, []string{"server"})
+		prometheus.MustRegister(b.openGauge)
+		b.tripsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "upstream_circuit_trips_total",
+			Help:      "The number of times polling was paused because the upstream homeserver kept failing.",
+		}, []string{"server"})
+		prometheus.MustRegister(b.tripsCounter)
+	}
+	return b
+}
+
+// OnStateChange sets a function which is called whenever any breaker trips or closes. Only applies
+// to breakers made after this call.
+func (b *CircuitBreakers) OnStateChange(fn func(status UpstreamStatus)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onStateChange = fn
+}
+
+// For returns the breaker for the homeserver of users with this server name, making it if needed.
+func (b *CircuitBreakers) For(serverName string) *CircuitBreaker {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	breaker, ok := b.breakers[serverName]
+	if ok {
+		return breaker
+	}
+	breaker = NewCircuitBreaker(b.cfg)
+	breaker.serverName = serverName
+	breaker.onStateChange = b.onStateChange
+	if b.openGauge != nil {
+		breaker.openGauge = b.openGauge.WithLabelValues(serverName)
+		breaker.tripsCounter = b.tripsCounter.WithLabelValues(serverName)
+	}
+	b.breakers[serverName] = breaker
+	return breaker
+}
+
+// Teardown unregisters metrics. Useful in tests.
+func (b *CircuitBreakers) Teardown() {
+	if b == nil || b.openGauge == nil {
+		return
+	}
+	prometheus.Unregister(b.openGauge)
+	prometheus.Unregister(b.tripsCounter)
+}
+
+// CircuitBreaker is shared by every poller for an upstream homeserver. When polls keep failing,
+// the breaker trips and pollers with existing data stop polling, rather than all retrying at once
+// against a server which is already struggling. After a cooldown a single poller is allowed
+// through as a probe: if it succeeds the breaker closes, otherwise the cooldown is extended.
+//
+// Polls for devices without any stored data are always allowed through, as a client is waiting
+// on them and there is nothing else to serve it.
+type CircuitBreaker struct {
+	cfg           CircuitBreakerConfig
+	serverName    string
+	mu            *sync.Mutex
+	notifyMu      *sync.Mutex
+	failures      int
+	openedAt      time.Time // zero if the breaker is closed
+	openUntil     time.Time
+	cooldown      time.Duration
+	probing       bool
+	onStateChange func(status UpstreamStatus)
+	openGauge     prometheus.Gauge
+	tripsCounter  prometheus.Counter
+	now           func() time.Time
+}
+
+// NewCircuitBreaker makes a closed breaker. Returns nil if the breaker is disabled, which is safe
+// to use and allows every poll.
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	if cfg.MaxCooldown < cfg.Cooldown {
+		cfg.MaxCooldown = cfg.Cooldown
+	}
+	b := &CircuitBreaker{
+		cfg:      cfg,
+		mu:       &sync.Mutex{},
+		notifyMu: &sync.Mutex{},
+		now:      time.Now,
+	}
+	return b
+}
+
+// OnStateChange sets a function which is called whenever the breaker trips or closes. It is not
+// called with the breaker's lock held, but calls are never concurrent.
+func (b *CircuitBreaker) OnStateChange(fn func(status UpstreamStatus)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onStateChange = fn
+}
+
+// Status returns whether the upstream is currently considered available.
+func (b *CircuitBreaker) Status() UpstreamStatus {
+	if b == nil {
+		return UpstreamStatus{Available: true}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status()
+}
+
+func (b *CircuitBreaker) status() UpstreamStatus {
+	return UpstreamStatus{
+		ServerName:       b.serverName,
+		Available:        b.openedAt.IsZero(),
+		UnavailableSince: b.openedAt,
+	}
+}
+
+// Allow returns whether a poll may be made now. Essential polls are always allowed. If probe is
+// true, the caller must call Record or Cancel, as no other probes are allowed until then.
+func (b *CircuitBreaker) Allow(essential bool) (allowed, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true, false
+	}
+	if !b.probing && !b.now().Before(b.openUntil) {
+		b.probing = true
+		return true, true
+	}
+	return essential, false
+}
+
+// Cancel a poll which was allowed by Allow but never made, so another poller can probe.
+func (b *CircuitBreaker) Cancel(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Record the outcome of a poll which was allowed by Allow. Only failures which suggest the
+// upstream is unhealthy should be recorded as failures, not e.g expired access tokens.
+func (b *CircuitBreaker) Record(probe, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	changed := false
+	if probe {
+		b.probing = false
+	}
+	if !failed {
+		b.failures = 0
+		if !b.openedAt.IsZero() {
+			logger.Info().Str("server", b.serverName).Dur("unavailable_for", b.now().Sub(b.openedAt)).Msg("CircuitBreaker: upstream has recovered, resuming polling")
+			b.openedAt = time.Time{}
+			changed = true
+		}
+	} else {
+		b.failures++
+		if probe {
+			b.cooldown *= 2
+			if b.cooldown > b.cfg.MaxCooldown {
+				b.cooldown = b.cfg.MaxCooldown
+			}
+			b.openUntil = b.now().Add(b.cooldown)
+			logger.Warn().Str("server", b.serverName).Dur("cooldown", b.cooldown).Msg("CircuitBreaker: probe failed")
+		} else if b.openedAt.IsZero() && b.failures >= b.cfg.FailureThreshold {
+			b.openedAt = b.now()
+			b.cooldown = b.cfg.Cooldown
+			b.openUntil = b.openedAt.Add(b.cooldown)
+			changed = true
+			if b.tripsCounter != nil {
+				b.tripsCounter.Inc()
+			}
+			logger.Warn().Str("server", b.serverName).Int("failures", b.failures).Dur("cooldown", b.cooldown).Msg(
+				"CircuitBreaker: upstream keeps failing, pausing polling",
+			)
+		}
+	}
+	b.mu.Unlock()
+	if changed {
+		b.notify()
+	}
+}
+
+// notify reports the latest status, so if two changes race the last call always sees the final state.
+func (b *CircuitBreaker) notify() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	b.mu.Lock()
+	status := b.status()
+	fn := b.onStateChange
+	b.mu.Unlock()
+	if b.openGauge != nil {
+		if status.Available {
+			b.openGauge.Set(0)
+		} else {
+			b.openGauge.Set(1)
+		}
+	}
+	if fn != nil {
+		fn(status)
+	}
+}
+
+// isUpstreamFailure returns true if a failed poll suggests the upstream is unhealthy, rather than
+// there being a problem with this particular request.
+func isUpstreamFailure(statusCode int) bool {
+	return statusCode == 0 || statusCode == 429 || statusCode >= 500
+}
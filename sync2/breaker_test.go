@@ -0,0 +1,203 @@
+package sync2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 3,
+		Cooldown:         time.Second,
+		MaxCooldown:      3 * time.Second,
+	})
+	b.now = func() time.Time { return now }
+	var statuses []UpstreamStatus
+	b.OnStateChange(func(status UpstreamStatus) {
+		statuses = append(statuses, status)
+	})
+	assertAllow := func(essential, wantAllowed, wantProbe bool) {
+		t.Helper()
+		allowed, probe := b.Allow(essential)
+		if allowed != wantAllowed || probe != wantProbe {
+			t.Fatalf("Allow(essential=%v): got allowed=%v probe=%v want %v %v", essential, allowed, probe, wantAllowed, wantProbe)
+		}
+	}
+
+	// a success resets the count of consecutive failures
+	b.Record(false, true)
+	b.Record(false, true)
+	b.Record(false, false)
+	b.Record(false, true)
+	b.Record(false, true)
+	assertAllow(false, true, false)
+	if len(statuses) != 0 {
+		t.Fatalf("breaker tripped before the threshold: %+v", statuses)
+	}
+
+	b.Record(false, true)
+	if len(statuses) != 1 || statuses[0].Available || !statuses[0].UnavailableSince.Equal(now) {
+		t.Fatalf("breaker did not trip: %+v", statuses)
+	}
+	assertAllow(false, false, false)
+	assertAllow(true, true, false) // essential polls are still allowed
+
+	// after the cooldown, exactly one probe is allowed through
+	now = now.Add(time.Second)
+	assertAllow(false, true, true)
+	assertAllow(false, false, false)
+	// the probe fails, so the cooldown doubles
+	b.Record(true, true)
+	now = now.Add(time.Second)
+	assertAllow(false, false, false)
+	now = now.Add(time.Second)
+	assertAllow(false, true, true)
+	b.Record(true, true)
+	// the cooldown is capped
+	now = now.Add(3 * time.Second)
+	assertAllow(false, true, true)
+	// a cancelled probe lets another poller probe
+	b.Cancel(true)
+	assertAllow(false, true, true)
+	if len(statuses) != 1 {
+		t.Fatalf("breaker changed state while open: %+v", statuses)
+	}
+
+	b.Record(true, false)
+	if len(statuses) != 2 || !statuses[1].Available || !statuses[1].UnavailableSince.IsZero() {
+		t.Fatalf("breaker did not close: %+v", statuses)
+	}
+	assertAllow(false, true, false)
+	if !b.Status().Available {
+		t.Fatalf("Status: got unavailable, want available")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerConfig{})
+	if b != nil {
+		t.Fatalf("NewCircuitBreaker: got a breaker, want nil when disabled")
+	}
+	for i := 0; i < 100; i++ {
+		b.Record(false, true)
+	}
+	if allowed, _ := b.Allow(false); !allowed || !b.Status().Available {
+		t.Fatalf("nil breaker blocked a poll")
+	}
+}
+
+func TestCircuitBreakersPerServer(t *testing.T) {
+	breakers := NewCircuitBreakers(CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Hour}, false)
+	var statuses []UpstreamStatus
+	breakers.OnStateChange(func(status UpstreamStatus) {
+		statuses = append(statuses, status)
+	})
+	hsA := breakers.For("a.localhost")
+	hsB := breakers.For("b.localhost")
+	if breakers.For("a.localhost") != hsA {
+		t.Fatalf("For: got a new breaker for the same server")
+	}
+	// failures on one homeserver don't count towards another's threshold
+	hsA.Record(false, true)
+	hsB.Record(false, true)
+	if len(statuses) != 0 {
+		t.Fatalf("breaker tripped before the threshold: %+v", statuses)
+	}
+	hsA.Record(false, true)
+	if len(statuses) != 1 || statuses[0].Available || statuses[0].ServerName != "a.localhost" {
+		t.Fatalf("got %+v want a.localhost to be unavailable", statuses)
+	}
+	if allowed, _ := hsB.Allow(false); !allowed || !hsB.Status().Available {
+		t.Fatalf("b.localhost was paused when a.localhost tripped")
+	}
+
+	var disabled *CircuitBreakers
+	if b := disabled.For("a.localhost"); b != nil {
+		t.Fatalf("For: got a breaker from disabled breakers")
+	}
+}
+
+// Test that pollers which already have data stop polling when the breaker is open, but initial
+// syncs continue as there is nothing to serve the client instead.
+func TestPollerPausesWhenBreakerOpen(t *testing.T) {
+	numPolls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numPolls++
+		return nil, 502, fmt.Errorf("bad gateway")
+	})
+	var slept time.Duration
+	setTimeSleepDelay(time.Microsecond, func(d time.Duration) {
+		slept = d
+	})
+	defer setTimeSleepDelay(0)
+
+	b := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Hour})
+	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: "PAUSED"}, "token", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.breaker = b
+	ctx := context.Background()
+
+	s := &pollLoopState{firstTime: true, since: "existing_since"}
+	if err := poller.poll(ctx, s); err != nil {
+		t.Fatalf("poll: %s", err)
+	}
+	if numPolls != 1 || b.Status().Available {
+		t.Fatalf("got %d polls and available=%v, want 1 poll to trip the breaker", numPolls, b.Status().Available)
+	}
+	failCount := s.failCount
+	if err := poller.poll(ctx, s); err != nil {
+		t.Fatalf("poll: %s", err)
+	}
+	if numPolls != 1 {
+		t.Errorf("got %d polls, want 1 as the breaker is open", numPolls)
+	}
+	if slept != breakerPauseInterval || s.failCount != failCount {
+		t.Errorf("paused poll: got sleep %v failCount %d, want %v %d", slept, s.failCount, breakerPauseInterval, failCount)
+	}
+
+	s = &pollLoopState{firstTime: true}
+	if err := poller.poll(ctx, s); err != nil {
+		t.Fatalf("poll: %s", err)
+	}
+	if numPolls != 2 {
+		t.Errorf("got %d polls, want 2 as initial syncs are always allowed", numPolls)
+	}
+}
+
+// Test that EnsurePolling doesn't block devices with stored data when the breaker is open.
+func TestPollerMapEnsurePollingServesStaleWhenBreakerOpen(t *testing.T) {
+	setTimeSleepDelay(time.Millisecond)
+	defer setTimeSleepDelay(0)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 0, fmt.Errorf("connection refused")
+	})
+	var gotStatus []UpstreamStatus
+	accumulator.onUpstreamStatus = func(ctx context.Context, status UpstreamStatus) {
+		gotStatus = append(gotStatus, status)
+	}
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(accumulator)
+	breakers := NewCircuitBreakers(CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Hour}, false)
+	pm.SetCircuitBreakers(breakers)
+	defer pm.Terminate()
+	breakers.For("localhost").Record(false, true)
+	if len(gotStatus) != 1 || gotStatus[0].Available || gotStatus[0].ServerName != "localhost" {
+		t.Fatalf("OnUpstreamStatus: got %+v want the upstream to be unavailable", gotStatus)
+	}
+
+	ensurePollingUnblocked := make(chan struct{})
+	go func() {
+		pm.EnsurePolling(PollerID{UserID: "@alice:localhost", DeviceID: "STALE"}, "access_token", "existing_since", false, zerolog.New(os.Stderr))
+		close(ensurePollingUnblocked)
+	}()
+	select {
+	case <-ensurePollingUnblocked:
+	case <-time.After(time.Second):
+		t.Fatalf("EnsurePolling blocked for a device with stored data")
+	}
+}
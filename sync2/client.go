@@ -20,6 +20,20 @@ const AccountDataGlobalRoom = ""
 var ProxyVersion = ""
 var HTTP401 error = fmt.Errorf("HTTP 401")
 
+// UnknownTokenError is returned by DoSyncV2 when the homeserver rejects the access token with
+// M_UNKNOWN_TOKEN. A soft logout means the device still exists and can log in again, whereas a
+// hard logout means the device is gone.
+type UnknownTokenError struct {
+	SoftLogout bool
+}
+
+func (e *UnknownTokenError) Error() string {
+	if e.SoftLogout {
+		return "DoSyncV2: access token rejected: soft logout"
+	}
+	return "DoSyncV2: access token rejected: device logged out"
+}
+
 type Client interface {
 	// Versions fetches and parses the list of Matrix versions that the homeserver
 	// advertises itself as supporting.
@@ -28,7 +42,21 @@ type Client interface {
 	// endpoint. The response must contain a device ID (meaning that we assume the
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
-	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error)
+	// RoomSummary fetches a summary of a room the user may not be joined to, using MSC3266.
+	// `via` are servers which may know about the room, if the upstream isn't in it.
+	RoomSummary(ctx context.Context, accessToken, roomID string, via []string) (*internal.RoomSummary, error)
+	// Messages fetches up to limit timeline events before the `from` pagination token, using the
+	// CSAPI /messages endpoint.
+	Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error)
+}
+
+// MessagesResponse is a page of /messages, paginating backwards.
+type MessagesResponse struct {
+	// Chunk is in reverse chronological order, so the most recent event is first.
+	Chunk []json.RawMessage `json:"chunk"`
+	// End is the token to paginate further back from, or empty if there are no earlier events.
+	End string `json:"end"`
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -37,6 +65,16 @@ type HTTPClient struct {
 	Client            *http.Client
 	LongTimeoutClient *http.Client
 	DestinationServer string
+	// Quirks of the destination server which change how /sync requests are made.
+	Quirks Quirks
+	// Presence requests presence events from the destination server, for the presence extension.
+	// Off by default as presence makes up a large part of most sync responses.
+	Presence bool
+	// ThreadNotifications requests per-thread notification counts (MSC3773) from the destination
+	// server. The room's unread_notifications then only count events in the main timeline.
+	ThreadNotifications bool
+	// Filter configures the timeline limits and membership options of /sync requests.
+	Filter SyncFilter
 }
 
 func NewHTTPClient(shortTimeout, longTimeout time.Duration, destHomeServer string) *HTTPClient {
@@ -86,6 +124,34 @@ func (v *HTTPClient) Versions(ctx context.Context) ([]string, error) {
 	return parsedRes.Result, nil
 }
 
+// ServerVersion returns the name and version of the homeserver implementation, using the
+// federation version endpoint. This endpoint is often not exposed on the client API listener,
+// in which case an error is returned.
+func (v *HTTPClient) ServerVersion(ctx context.Context) (name, version string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/federation/v1/version", nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("/version returned HTTP %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", "", err
+	}
+	server := gjson.GetBytes(body, "server")
+	if !server.Get("name").Exists() {
+		return "", "", fmt.Errorf("/version response has no server name")
+	}
+	return server.Get("name").Str, server.Get("version").Str, nil
+}
+
 // Return sync2.HTTP401 if this request returns 401
 func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
@@ -113,10 +179,73 @@ func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, st
 	return response.Get("user_id").Str, response.Get("device_id").Str, nil
 }
 
+// RoomSummary fetches an MSC3266 room summary. Returns sync2.HTTP401 if the request returns 401.
+func (v *HTTPClient) RoomSummary(ctx context.Context, accessToken, roomID string, via []string) (*internal.RoomSummary, error) {
+	summaryURL := v.DestinationServer + "/_matrix/client/unstable/im.nheko.summary/summary/" + url.PathEscape(roomID)
+	if len(via) > 0 {
+		summaryURL += "?" + url.Values{"via": via}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", summaryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 401 {
+			return nil, HTTP401
+		}
+		return nil, fmt.Errorf("/summary returned HTTP %d", res.StatusCode)
+	}
+	var summary internal.RoomSummary
+	if err := json.NewDecoder(res.Body).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("/summary response body decode JSON failed: %w", err)
+	}
+	return &summary, nil
+}
+
+// Messages paginates backwards through a room's timeline. Returns sync2.HTTP401 if the request returns 401.
+func (v *HTTPClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	qps := url.Values{
+		"dir":   []string{"b"},
+		"from":  []string{from},
+		"limit": []string{fmt.Sprintf("%d", limit)},
+	}
+	messagesURL := v.DestinationServer + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/messages?" + qps.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", messagesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 401 {
+			return nil, HTTP401
+		}
+		return nil, fmt.Errorf("/messages returned HTTP %d", res.StatusCode)
+	}
+	var messages MessagesResponse
+	if err := json.NewDecoder(res.Body).Decode(&messages); err != nil {
+		return nil, fmt.Errorf("/messages response body decode JSON failed: %w", err)
+	}
+	return &messages, nil
+}
+
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
-func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
-	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly)
+// Set excludeEphemeral=true to filter out typing notifications and receipts.
+func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
+	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly, excludeEphemeral)
 	req, err := http.NewRequestWithContext(ctx, "GET", syncURL, nil)
 	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
@@ -138,13 +267,25 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 		if err := json.NewDecoder(res.Body).Decode(&svr); err != nil {
 			return nil, 0, fmt.Errorf("DoSyncV2: response body decode JSON failed: %w", err)
 		}
+		if v.ThreadNotifications {
+			svr.Rooms.normaliseThreadNotifications()
+		}
 		return &svr, 200, nil
+	case 401:
+		var body struct {
+			ErrCode    string `json:"errcode"`
+			SoftLogout bool   `json:"soft_logout"`
+		}
+		if json.NewDecoder(res.Body).Decode(&body) == nil && body.ErrCode == "M_UNKNOWN_TOKEN" {
+			return nil, 401, &UnknownTokenError{SoftLogout: body.SoftLogout}
+		}
+		return nil, 401, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	default:
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
 }
 
-func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
+func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly, excludeEphemeral bool) string {
 	qps := "?"
 	if isFirst { // first time polling for v2-sync in this process
 		qps += "timeout=0"
@@ -158,18 +299,26 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	// Set presence to offline, this potentially reduces CPU load on upstream homeservers
 	qps += "&set_presence=offline"
 
-	// To reduce the likelihood of a gappy v2 sync, ask for a large timeline by default.
-	// Synapse's default is 10; 50 is the maximum allowed, by my reading of
-	// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
-	// NB: this is a stopgap to reduce the likelihood of hitting
-	// https://github.com/matrix-org/sliding-sync/issues/18
-	timelineLimit := 50
-	if since == "" {
-		// First time the poller has sync v2-ed for this user
-		timelineLimit = 1
+	if v.Quirks.NoInlineFilters {
+		return v.DestinationServer + "/_matrix/client/r0/sync" + qps
 	}
+
 	room := map[string]interface{}{}
-	room["timeline"] = map[string]interface{}{"limit": timelineLimit}
+	timeline := map[string]interface{}{"limit": v.Filter.timelineLimit(since)}
+	if v.ThreadNotifications {
+		timeline["unread_thread_notifications"] = true
+	}
+	room["timeline"] = timeline
+	if v.Filter.LazyLoadMembers {
+		room["state"] = map[string]interface{}{"lazy_load_members": true}
+	}
+	if v.Filter.IncludeLeave {
+		room["include_leave"] = true
+	}
+	if excludeEphemeral {
+		// no clients want typing notifications or receipts for this device
+		room["ephemeral"] = map[string]interface{}{"not_types": []string{"*"}}
+	}
 
 	if toDeviceOnly {
 		// no rooms match this filter, so we get everything but room data
@@ -177,8 +326,10 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	}
 	filter := map[string]interface{}{
 		"room": room,
-		// filter out all presence events (remove this once/if the proxy handles presence)
-		"presence": map[string]interface{}{"not_types": []string{"*"}},
+	}
+	if !v.Presence || toDeviceOnly {
+		// filter out all presence events
+		filter["presence"] = map[string]interface{}{"not_types": []string{"*"}}
 	}
 	filterJSON, _ := json.Marshal(filter)
 	qps += "&filter=" + url.QueryEscape(string(filterJSON))
@@ -208,6 +359,22 @@ type SyncRoomsResponse struct {
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 }
 
+// normaliseThreadNotifications gives every joined room with notification counts a thread map.
+// Servers omit unread_thread_notifications when no thread has unread events, which must clear any
+// thread counts seen before, whereas a nil map means the server sent no thread counts at all.
+func (r *SyncRoomsResponse) normaliseThreadNotifications() {
+	for roomID, room := range r.Join {
+		if room.UnreadThreadNotifications != nil {
+			continue
+		}
+		if room.UnreadNotifications.HighlightCount == nil && room.UnreadNotifications.NotificationCount == nil {
+			continue
+		}
+		room.UnreadThreadNotifications = map[string]UnreadNotifications{}
+		r.Join[roomID] = room
+	}
+}
+
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
 type SyncV2JoinResponse struct {
 	State               EventsResponse      `json:"state"`
@@ -216,6 +383,9 @@ type SyncV2JoinResponse struct {
 	AccountData         EventsResponse      `json:"account_data"`
 	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
 	UnreadCount         *int                `json:"org.matrix.msc2654.unread_count,omitempty"`
+	// Per-thread counts keyed by thread root event ID (MSC3773). Only requested if
+	// HTTPClient.ThreadNotifications is set.
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 type UnreadNotifications struct {
@@ -1,8 +1,16 @@
 package sync2
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 func TestSyncURL(t *testing.T) {
@@ -73,9 +81,177 @@ func TestSyncURL(t *testing.T) {
 		},
 	}
 	for i, tc := range testCases {
-		gotURL := client.createSyncURL(tc.since, tc.isFirst, tc.toDeviceOnly)
+		gotURL := client.createSyncURL(tc.since, tc.isFirst, tc.toDeviceOnly, false)
 		if gotURL != tc.wantURL {
 			t.Errorf("Case %d/%d: got %v want %v", i+1, len(testCases), gotURL, tc.wantURL)
 		}
 	}
+
+	// presence is only requested for full polls when enabled
+	client.Presence = true
+	gotURL := client.createSyncURL("112233", false, false, false)
+	wantURL := wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50}}}`)
+	if gotURL != wantURL {
+		t.Errorf("Presence: got %v want %v", gotURL, wantURL)
+	}
+	gotURL = client.createSyncURL("112233", false, true, false)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`)
+	if gotURL != wantURL {
+		t.Errorf("Presence to-device only: got %v want %v", gotURL, wantURL)
+	}
+
+	// thread notifications are requested in the timeline filter
+	client.Presence = false
+	client.ThreadNotifications = true
+	gotURL = client.createSyncURL("112233", false, false, false)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50,"unread_thread_notifications":true}}}`)
+	if gotURL != wantURL {
+		t.Errorf("ThreadNotifications: got %v want %v", gotURL, wantURL)
+	}
+
+	// ephemeral events are filtered out when no client wants them
+	client.ThreadNotifications = false
+	gotURL = client.createSyncURL("112233", false, false, true)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"ephemeral":{"not_types":["*"]},"timeline":{"limit":50}}}`)
+	if gotURL != wantURL {
+		t.Errorf("excludeEphemeral: got %v want %v", gotURL, wantURL)
+	}
+
+	// servers which don't support inline filters get no filter at all
+	client.Quirks.NoInlineFilters = true
+	gotURL = client.createSyncURL("112233", false, true, false)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline`
+	if gotURL != wantURL {
+		t.Errorf("NoInlineFilters: got %v want %v", gotURL, wantURL)
+	}
+}
+
+func TestRoomSummary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		wantPath := "/_matrix/client/unstable/im.nheko.summary/summary/!room:remote"
+		if req.URL.Path != wantPath || req.URL.Query().Get("via") != "remote" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"room_id":"!room:remote","name":"Room","topic":"Topic","num_joined_members":42,"membership":"invite"}`))
+	}))
+	defer srv.Close()
+	client := HTTPClient{
+		Client:            srv.Client(),
+		DestinationServer: srv.URL,
+	}
+	ctx := context.Background()
+	summary, err := client.RoomSummary(ctx, "token", "!room:remote", []string{"remote"})
+	if err != nil {
+		t.Fatalf("RoomSummary: %s", err)
+	}
+	want := internal.RoomSummary{RoomID: "!room:remote", Name: "Room", Topic: "Topic", NumJoinedMembers: 42}
+	if *summary != want {
+		t.Errorf("RoomSummary: got %+v want %+v", *summary, want)
+	}
+	if _, err = client.RoomSummary(ctx, "wrong_token", "!room:remote", []string{"remote"}); err != HTTP401 {
+		t.Errorf("RoomSummary with a bad token: got %v want HTTP401", err)
+	}
+	if _, err = client.RoomSummary(ctx, "token", "!room:remote", nil); err == nil {
+		t.Errorf("RoomSummary returned no error for a 404")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		qps := req.URL.Query()
+		if req.URL.EscapedPath() != "/_matrix/client/v3/rooms/%21room:localhost/messages" || qps.Get("dir") != "b" || qps.Get("from") != "t10" || qps.Get("limit") != "2" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"chunk":[{"event_id":"$b"},{"event_id":"$a"}],"start":"t10","end":"t8"}`))
+	}))
+	defer srv.Close()
+	client := HTTPClient{
+		Client:            srv.Client(),
+		DestinationServer: srv.URL,
+	}
+	ctx := context.Background()
+	res, err := client.Messages(ctx, "token", "!room:localhost", "t10", 2)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(res.Chunk) != 2 || res.End != "t8" {
+		t.Errorf("Messages: got %+v", res)
+	}
+	if _, err = client.Messages(ctx, "wrong_token", "!room:localhost", "t10", 2); err != HTTP401 {
+		t.Errorf("Messages with a bad token: got %v want HTTP401", err)
+	}
+	if _, err = client.Messages(ctx, "token", "!room:localhost", "t9", 2); err == nil {
+		t.Errorf("Messages returned no error for a 400")
+	}
+}
+
+func TestDoSyncV2UnknownToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+		switch req.Header.Get("Authorization") {
+		case "Bearer soft":
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"expired","soft_logout":true}`))
+		case "Bearer hard":
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"logged out"}`))
+		default:
+			w.Write([]byte(`{"errcode":"M_MISSING_TOKEN"}`))
+		}
+	}))
+	defer srv.Close()
+	client := HTTPClient{
+		Client:            srv.Client(),
+		DestinationServer: srv.URL,
+	}
+	testCases := []struct {
+		token string
+		want  *UnknownTokenError
+	}{
+		{token: "soft", want: &UnknownTokenError{SoftLogout: true}},
+		{token: "hard", want: &UnknownTokenError{SoftLogout: false}},
+		{token: "other", want: nil},
+	}
+	for _, tc := range testCases {
+		_, code, err := client.DoSyncV2(context.Background(), tc.token, "", false, false, false)
+		if code != 401 || err == nil {
+			t.Fatalf("%s: got code %d err %v, want a 401 error", tc.token, code, err)
+		}
+		var got *UnknownTokenError
+		errors.As(err, &got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.token, got, tc.want)
+		}
+	}
+}
+
+func TestNormaliseThreadNotifications(t *testing.T) {
+	var res SyncResponse
+	err := json.Unmarshal([]byte(`{"rooms":{"join":{
+		"!read:localhost":{"unread_notifications":{"highlight_count":0,"notification_count":0}},
+		"!unread:localhost":{"unread_notifications":{"notification_count":1},"unread_thread_notifications":{"$root":{"notification_count":2}}},
+		"!nocounts:localhost":{}
+	}}}`), &res)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	res.Rooms.normaliseThreadNotifications()
+	if threads := res.Rooms.Join["!read:localhost"].UnreadThreadNotifications; threads == nil || len(threads) != 0 {
+		t.Errorf("room without unread threads: got %v want an empty map", threads)
+	}
+	threads := res.Rooms.Join["!unread:localhost"].UnreadThreadNotifications
+	if len(threads) != 1 || threads["$root"].NotificationCount == nil || *threads["$root"].NotificationCount != 2 {
+		t.Errorf("room with unread threads: got %v", threads)
+	}
+	if threads := res.Rooms.Join["!nocounts:localhost"].UnreadThreadNotifications; threads != nil {
+		t.Errorf("room without counts: got %v want nil", threads)
+	}
 }
@@ -2,7 +2,7 @@ package sync2
 
 import (
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"time"
 )
 
@@ -10,6 +10,9 @@ type Device struct {
 	UserID   string `db:"user_id"`
 	DeviceID string `db:"device_id"`
 	Since    string `db:"since"`
+	// SoftLogoutTS is the unix millis at which the device's token was rejected with a soft
+	// logout, or 0 if it has been polled since.
+	SoftLogoutTS int64 `db:"soft_logout_ts"`
 }
 
 // DevicesTable remembers syncv2 since positions per-device
@@ -18,35 +21,88 @@ type DevicesTable struct {
 }
 
 func NewDevicesTable(db *sqlx.DB) *DevicesTable {
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_sync2_devices (
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		since TEXT NOT NULL
-	);`)
-
 	return &DevicesTable{
 		db: db,
 	}
 }
 
 // InsertDevice creates a new devices row with a blank since token if no such row
-// exists. Otherwise, it does nothing.
+// exists. Otherwise, it does nothing. New devices count as having just been polled, so they
+// are not considered stale before their first poll.
 func (t *DevicesTable) InsertDevice(txn *sqlx.Tx, userID, deviceID string) error {
 	_, err := txn.Exec(
-		` INSERT INTO syncv3_sync2_devices(user_id, device_id, since) VALUES($1,$2,$3)
+		` INSERT INTO syncv3_sync2_devices(user_id, device_id, since, last_poll_ts) VALUES($1,$2,$3,$4)
 		ON CONFLICT (user_id, device_id) DO NOTHING`,
-		userID, deviceID, "",
+		userID, deviceID, "", time.Now().UnixMilli(),
 	)
 	return err
 }
 
+// UpdateDeviceSince stores the since token from a successful poll. This clears any soft logout,
+// as the device must have logged in again.
 func (t *DevicesTable) UpdateDeviceSince(userID, deviceID, since string) error {
-	_, err := t.db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE user_id = $2 AND device_id = $3`, since, userID, deviceID)
+	_, err := t.db.Exec(
+		`UPDATE syncv3_sync2_devices SET since = $1, last_poll_ts = $2, soft_logout_ts = 0 WHERE user_id = $3 AND device_id = $4`,
+		since, time.Now().UnixMilli(), userID, deviceID,
+	)
 	return err
 }
 
+// SelectSince returns the since token stored for this device, which is empty if the device has
+// not completed a poll. Returns sql.ErrNoRows if the device does not exist.
+func (t *DevicesTable) SelectSince(userID, deviceID string) (since string, err error) {
+	err = t.db.QueryRow(
+		`SELECT since FROM syncv3_sync2_devices WHERE user_id = $1 AND device_id = $2`, userID, deviceID,
+	).Scan(&since)
+	return
+}
+
+// ResetSince forgets the since token for this device, so its next poll is an initial sync.
+// Returns false if the device does not exist.
+func (t *DevicesTable) ResetSince(userID, deviceID string) (bool, error) {
+	res, err := t.db.Exec(
+		`UPDATE syncv3_sync2_devices SET since = '' WHERE user_id = $1 AND device_id = $2`, userID, deviceID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkSoftLogout records that the device's token was rejected with a soft logout. The since token
+// is kept, so that polling resumes where it left off when the device logs in again.
+func (t *DevicesTable) MarkSoftLogout(userID, deviceID string) error {
+	_, err := t.db.Exec(
+		`UPDATE syncv3_sync2_devices SET soft_logout_ts = $1 WHERE user_id = $2 AND device_id = $3`,
+		time.Now().UnixMilli(), userID, deviceID,
+	)
+	return err
+}
+
+// DeleteDevice deletes the device and all of its tokens, for devices which have been logged out.
+func (t *DevicesTable) DeleteDevice(txn *sqlx.Tx, userID, deviceID string) error {
+	_, err := txn.Exec(`DELETE FROM syncv3_sync2_devices WHERE user_id = $1 AND device_id = $2`, userID, deviceID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(`DELETE FROM syncv3_sync2_tokens WHERE user_id = $1 AND device_id = $2`, userID, deviceID)
+	return err
+}
+
+// DevicesForUser returns all devices for this user which the proxy knows about, in device ID order.
+func (t *DevicesTable) DevicesForUser(userID string) (devices []Device, err error) {
+	err = t.db.Select(&devices, `SELECT user_id, device_id, since, soft_logout_ts FROM syncv3_sync2_devices WHERE user_id = $1 ORDER BY device_id`, userID)
+	return
+}
+
+// DevicesForUsers returns all devices for these users which the proxy knows about, in user ID then
+// device ID order.
+func (t *DevicesTable) DevicesForUsers(userIDs []string) (devices []Device, err error) {
+	err = t.db.Select(&devices, `SELECT user_id, device_id, since, soft_logout_ts FROM syncv3_sync2_devices WHERE user_id = ANY($1) ORDER BY user_id, device_id`, pq.StringArray(userIDs))
+	return
+}
+
 // FindOldDevices fetches the user_id and device_id of all devices which haven't /synced
 // for at least as long as the given inactivityPeriod. Such devices are returned in
 // no particular order.
@@ -65,3 +121,59 @@ func (t *DevicesTable) FindOldDevices(inactivityPeriod time.Duration) (devices [
 	)
 	return
 }
+
+// staleDeviceCondition matches devices in syncv3_sync2_devices AS d which have not been polled
+// since $1, and have no tokens used since $2.
+const staleDeviceCondition = `d.last_poll_ts < $1 AND NOT EXISTS (
+	SELECT 1 FROM syncv3_sync2_tokens t WHERE t.user_id = d.user_id AND t.device_id = d.device_id AND t.last_seen >= $2
+)`
+
+// FindStaleDevices returns up to limit devices which have not been successfully polled since
+// the cutoff, and whose tokens have not been used since the cutoff either. Devices are returned
+// in (user_id, device_id) order, starting after the given device, so callers can page through
+// every stale device.
+func (t *DevicesTable) FindStaleDevices(cutoff time.Time, after Device, limit int) (devices []Device, err error) {
+	err = t.db.Select(&devices, `
+		SELECT user_id, device_id FROM syncv3_sync2_devices d
+		WHERE (user_id, device_id) > ($3, $4) AND `+staleDeviceCondition+`
+		ORDER BY user_id, device_id LIMIT $5`,
+		cutoff.UnixMilli(), cutoff, after.UserID, after.DeviceID, limit,
+	)
+	return
+}
+
+// DeleteStaleDevices deletes these devices and their tokens, if they are still stale as of the
+// cutoff. Devices which were polled or logged into since they were found are kept. Returns the
+// devices which were deleted.
+func (t *DevicesTable) DeleteStaleDevices(txn *sqlx.Tx, devices []Device, cutoff time.Time) (deleted []Device, err error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	userIDs := make([]string, len(devices))
+	deviceIDs := make([]string, len(devices))
+	for i := range devices {
+		userIDs[i] = devices[i].UserID
+		deviceIDs[i] = devices[i].DeviceID
+	}
+	err = txn.Select(&deleted, `
+		DELETE FROM syncv3_sync2_devices d USING unnest($3::text[], $4::text[]) AS x(user_id, device_id)
+		WHERE d.user_id = x.user_id AND d.device_id = x.device_id AND `+staleDeviceCondition+`
+		RETURNING d.user_id, d.device_id`,
+		cutoff.UnixMilli(), cutoff, pq.StringArray(userIDs), pq.StringArray(deviceIDs),
+	)
+	if err != nil || len(deleted) == 0 {
+		return nil, err
+	}
+	userIDs = userIDs[:0]
+	deviceIDs = deviceIDs[:0]
+	for i := range deleted {
+		userIDs = append(userIDs, deleted[i].UserID)
+		deviceIDs = append(deviceIDs, deleted[i].DeviceID)
+	}
+	_, err = txn.Exec(`
+		DELETE FROM syncv3_sync2_tokens t USING unnest($1::text[], $2::text[]) AS x(user_id, device_id)
+		WHERE t.user_id = x.user_id AND t.device_id = x.device_id`,
+		pq.StringArray(userIDs), pq.StringArray(deviceIDs),
+	)
+	return deleted, err
+}
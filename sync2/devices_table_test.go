@@ -1,6 +1,7 @@
 package sync2
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
@@ -16,7 +17,7 @@ import (
 var postgresConnectionString = "user=xxxxx dbname=syncv3_test sslmode=disable"
 
 func TestMain(m *testing.M) {
-	postgresConnectionString = testutils.PrepareDBConnectionString()
+	postgresConnectionString = testutils.PrepareDBWithSchema()
 	exitCode := m.Run()
 	os.Exit(exitCode)
 }
@@ -94,6 +95,17 @@ func TestDevicesTableSinceColumn(t *testing.T) {
 		t.Fatalf("Failed to GetTokenAndSince: %s", err)
 	}
 	assertEqual(t, since, sinceValue, "Device.Since mismatch")
+
+	t.Log("The since value can be selected without a token.")
+	since, err = devices.SelectSince(alice, aliceDevice)
+	if err != nil {
+		t.Fatalf("Failed to SelectSince: %s", err)
+	}
+	assertEqual(t, since, sinceValue, "SelectSince mismatch")
+	_, err = devices.SelectSince(alice, "unknown_device")
+	if err != sql.ErrNoRows {
+		t.Errorf("SelectSince for an unknown device: got %v want sql.ErrNoRows", err)
+	}
 }
 
 func TestTokenForEachDevice(t *testing.T) {
@@ -252,3 +264,262 @@ func TestDevicesTable_FindOldDevices(t *testing.T) {
 		t.Errorf("Got %+v, but expected %v+", oldDevices, expectedDevices)
 	}
 }
+
+func TestDevicesTable_DevicesForUser(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	devices := NewDevicesTable(db)
+
+	alice := "@alice_DevicesForUser:localhost"
+	bob := "@bob_DevicesForUser:localhost"
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, d := range []Device{{UserID: alice, DeviceID: "phone"}, {UserID: alice, DeviceID: "laptop"}, {UserID: bob, DeviceID: "phone"}} {
+			if err := devices.InsertDevice(txn, d.UserID, d.DeviceID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to insert devices: %s", err)
+	}
+	if err = devices.UpdateDeviceSince(alice, "phone", "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+
+	got, err := devices.DevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	want := []Device{
+		{UserID: alice, DeviceID: "laptop", Since: ""},
+		{UserID: alice, DeviceID: "phone", Since: "s1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DevicesForUser: got %+v want %+v", got, want)
+	}
+
+	got, err = devices.DevicesForUser("@nobody:localhost")
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("DevicesForUser: got %+v for unknown user, want none", got)
+	}
+}
+
+func TestDevicesTable_StaleDevices(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	devices := NewDevicesTable(db)
+
+	alice := "@alice_StaleDevices:localhost"
+	bob := "@bob_StaleDevices:localhost"
+	day := 24 * time.Hour
+	tcs := []struct {
+		device   Device
+		pollAge  time.Duration
+		tokenAge time.Duration // 0 for no token
+	}{
+		{device: Device{UserID: alice, DeviceID: "old_no_token"}, pollAge: 10 * day},
+		{device: Device{UserID: alice, DeviceID: "old_old_token"}, pollAge: 10 * day, tokenAge: 9 * day},
+		{device: Device{UserID: alice, DeviceID: "old_recent_token"}, pollAge: 10 * day, tokenAge: time.Hour},
+		{device: Device{UserID: alice, DeviceID: "recent_poll"}, pollAge: time.Hour, tokenAge: 9 * day},
+		{device: Device{UserID: bob, DeviceID: "old_old_token"}, pollAge: 10 * day, tokenAge: 9 * day},
+	}
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for i, tc := range tcs {
+			if err := devices.InsertDevice(txn, tc.device.UserID, tc.device.DeviceID); err != nil {
+				return err
+			}
+			_, err := txn.Exec(`UPDATE syncv3_sync2_devices SET last_poll_ts = $1 WHERE user_id = $2 AND device_id = $3`,
+				time.Now().Add(-tc.pollAge).UnixMilli(), tc.device.UserID, tc.device.DeviceID)
+			if err != nil {
+				return err
+			}
+			if tc.tokenAge > 0 {
+				if _, err = tokens.Insert(txn, fmt.Sprintf("stale-token-%d", i), tc.device.UserID, tc.device.DeviceID, time.Now().Add(-tc.tokenAge)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to insert devices: %s", err)
+	}
+
+	cutoff := time.Now().Add(-7 * day)
+	findStale := func(limit int) []Device {
+		t.Helper()
+		var result []Device
+		var after Device
+		for {
+			found, err := devices.FindStaleDevices(cutoff, after, limit)
+			if err != nil {
+				t.Fatalf("FindStaleDevices: %s", err)
+			}
+			if len(found) == 0 {
+				return result
+			}
+			after = found[len(found)-1]
+			for _, d := range found {
+				// ignore devices from other tests
+				if d.UserID == alice || d.UserID == bob {
+					result = append(result, d)
+				}
+			}
+		}
+	}
+	want := []Device{
+		{UserID: alice, DeviceID: "old_no_token"},
+		{UserID: alice, DeviceID: "old_old_token"},
+		{UserID: bob, DeviceID: "old_old_token"},
+	}
+	if got := findStale(1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FindStaleDevices: got %+v want %+v", got, want)
+	}
+
+	// bob's device is polled after it was found, so it must not be deleted
+	if err = devices.UpdateDeviceSince(bob, "old_old_token", "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+	var deleted []Device
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		deleted, err = devices.DeleteStaleDevices(txn, want, cutoff)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteStaleDevices: %s", err)
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].DeviceID < deleted[j].DeviceID
+	})
+	if !reflect.DeepEqual(deleted, want[:2]) {
+		t.Errorf("DeleteStaleDevices: got %+v want %+v", deleted, want[:2])
+	}
+	if got := findStale(100); len(got) != 0 {
+		t.Errorf("FindStaleDevices after deleting: got %+v want none", got)
+	}
+	var numTokens int
+	if err = db.QueryRow(`SELECT count(*) FROM syncv3_sync2_tokens WHERE user_id = $1 AND device_id = 'old_old_token'`, alice).Scan(&numTokens); err != nil {
+		t.Fatalf("failed to count tokens: %s", err)
+	}
+	if numTokens != 0 {
+		t.Errorf("got %d tokens for a deleted device, want 0", numTokens)
+	}
+	remaining, err := devices.DevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("DevicesForUser: got %+v want old_recent_token and recent_poll", remaining)
+	}
+}
+
+func TestTokensTable_LatestTokenForDevice(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	devices := NewDevicesTable(db)
+
+	alice := "@alice_LatestTokenForDevice:localhost"
+	aliceDevice := "alice_phone"
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		if _, err = tokens.Insert(txn, "alice_old_LatestTokenForDevice", alice, aliceDevice, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		if _, err = tokens.Insert(txn, "alice_new_LatestTokenForDevice", alice, aliceDevice, time.Now()); err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		if err = devices.InsertDevice(txn, alice, aliceDevice); err != nil {
+			t.Fatalf("Failed to Insert device: %s", err)
+		}
+		return nil
+	})
+	if err := devices.UpdateDeviceSince(alice, aliceDevice, "s-1"); err != nil {
+		t.Fatalf("Failed to update since: %s", err)
+	}
+
+	token, err := tokens.LatestTokenForDevice(alice, aliceDevice)
+	if err != nil {
+		t.Fatalf("LatestTokenForDevice: %s", err)
+	}
+	assertEqual(t, token.AccessToken, "alice_new_LatestTokenForDevice", "Token.AccessToken mismatch")
+	assertEqual(t, token.AccessTokenHash, hashToken("alice_new_LatestTokenForDevice"), "Token.AccessTokenHash mismatch")
+	assertEqual(t, token.Since, "s-1", "Device.Since mismatch")
+
+	if _, err = tokens.LatestTokenForDevice(alice, "unknown_device"); err != sql.ErrNoRows {
+		t.Fatalf("LatestTokenForDevice: got %v for an unknown device, want sql.ErrNoRows", err)
+	}
+
+	t.Log("Resetting the since token means the next poll is an initial sync.")
+	exists, err := devices.ResetSince(alice, aliceDevice)
+	if err != nil || !exists {
+		t.Fatalf("ResetSince: got %v, %v want true, nil", exists, err)
+	}
+	token, err = tokens.LatestTokenForDevice(alice, aliceDevice)
+	if err != nil {
+		t.Fatalf("LatestTokenForDevice: %s", err)
+	}
+	assertEqual(t, token.Since, "", "Device.Since mismatch after ResetSince")
+	exists, err = devices.ResetSince(alice, "unknown_device")
+	if err != nil || exists {
+		t.Fatalf("ResetSince: got %v, %v for an unknown device, want false, nil", exists, err)
+	}
+}
+
+func TestDevicesTable_SoftLogout(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	devices := NewDevicesTable(db)
+	NewTokensTable(db, "my_secret")
+
+	alice := "@alice_SoftLogout:localhost"
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return devices.InsertDevice(txn, alice, "phone")
+	})
+	if err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	if err = devices.UpdateDeviceSince(alice, "phone", "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+
+	// a soft logout keeps the since token
+	if err = devices.MarkSoftLogout(alice, "phone"); err != nil {
+		t.Fatalf("MarkSoftLogout: %s", err)
+	}
+	got, err := devices.DevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	if len(got) != 1 || got[0].Since != "s1" || got[0].SoftLogoutTS == 0 {
+		t.Errorf("after MarkSoftLogout: got %+v, want since s1 and a soft logout", got)
+	}
+
+	// polling again clears the soft logout
+	if err = devices.UpdateDeviceSince(alice, "phone", "s2"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+	got, err = devices.DevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("DevicesForUser: %s", err)
+	}
+	want := []Device{{UserID: alice, DeviceID: "phone", Since: "s2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after UpdateDeviceSince: got %+v want %+v", got, want)
+	}
+
+	// a hard logout deletes the device
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return devices.DeleteDevice(txn, alice, "phone")
+	})
+	if err != nil {
+		t.Fatalf("DeleteDevice: %s", err)
+	}
+	if _, err = devices.SelectSince(alice, "phone"); err != sql.ErrNoRows {
+		t.Errorf("SelectSince after DeleteDevice: got %v want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,85 @@
+package sync2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultInitialTimelineLimit is the timeline limit of a device's first poll. Only the latest
+	// event is needed to sort rooms, and larger timelines make initial syncs of big accounts slow.
+	defaultInitialTimelineLimit = 1
+	// defaultTimelineLimit is the timeline limit of every other poll. To reduce the likelihood of
+	// a gappy v2 sync, ask for a large timeline. Synapse's default is 10; 50 is the maximum allowed,
+	// by my reading of
+	// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
+	// NB: this is a stopgap to reduce the likelihood of hitting
+	// https://github.com/matrix-org/sliding-sync/issues/18
+	defaultTimelineLimit = 50
+)
+
+// SyncFilter configures the room filter pollers send to the upstream homeserver, trading the time
+// taken by a device's first poll against how complete the proxy's copy of each room is. The zero
+// value uses the defaults.
+type SyncFilter struct {
+	// InitialTimelineLimit is the timeline limit of a device's first poll, which has no since token.
+	InitialTimelineLimit int
+	// TimelineLimit is the timeline limit of every other poll.
+	TimelineLimit int
+	// LazyLoadMembers only requests the member events of timeline senders. Polls are smaller, but
+	// the proxy then doesn't know every member of rooms, so joined counts and heroes can be wrong.
+	LazyLoadMembers bool
+	// IncludeLeave requests rooms the user has left, including those left before the first poll.
+	IncludeLeave bool
+}
+
+// ParseSyncFilter parses a comma separated list of filter options e.g
+// "initial_timeline_limit=10,timeline_limit=30,lazy_load_members". Options which are not listed
+// keep their default.
+func ParseSyncFilter(spec string) (SyncFilter, error) {
+	var f SyncFilter
+	for _, option := range strings.Split(spec, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(option, "=")
+		switch name {
+		case "initial_timeline_limit", "timeline_limit":
+			limit, err := strconv.Atoi(value)
+			if !hasValue || err != nil || limit < 1 {
+				return SyncFilter{}, fmt.Errorf("'%s' must be a positive number e.g %s=10", name, name)
+			}
+			if name == "initial_timeline_limit" {
+				f.InitialTimelineLimit = limit
+			} else {
+				f.TimelineLimit = limit
+			}
+		case "lazy_load_members":
+			f.LazyLoadMembers = true
+		case "include_leave":
+			f.IncludeLeave = true
+		default:
+			return SyncFilter{}, fmt.Errorf(
+				"unknown filter option '%s', valid options are initial_timeline_limit, timeline_limit, lazy_load_members and include_leave", name,
+			)
+		}
+	}
+	return f, nil
+}
+
+// timelineLimit returns the timeline limit for a poll, which is the first for the device if it
+// has no since token.
+func (f SyncFilter) timelineLimit(since string) int {
+	if since == "" {
+		if f.InitialTimelineLimit > 0 {
+			return f.InitialTimelineLimit
+		}
+		return defaultInitialTimelineLimit
+	}
+	if f.TimelineLimit > 0 {
+		return f.TimelineLimit
+	}
+	return defaultTimelineLimit
+}
@@ -0,0 +1,56 @@
+package sync2
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseSyncFilter(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		want    SyncFilter
+		wantErr bool
+	}{
+		{spec: "", want: SyncFilter{}},
+		{spec: "initial_timeline_limit=10", want: SyncFilter{InitialTimelineLimit: 10}},
+		{
+			spec: " timeline_limit=30 , lazy_load_members,include_leave",
+			want: SyncFilter{TimelineLimit: 30, LazyLoadMembers: true, IncludeLeave: true},
+		},
+		{spec: "timeline_limit=0", wantErr: true},
+		{spec: "timeline_limit=many", wantErr: true},
+		{spec: "initial_timeline_limit", wantErr: true},
+		{spec: "not_an_option", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseSyncFilter(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseSyncFilter(%q): got err %v want err %v", tc.spec, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ParseSyncFilter(%q): got %+v want %+v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestSyncURLWithFilter(t *testing.T) {
+	baseURL := "https://atreus.gow"
+	wantBaseURL := baseURL + "/_matrix/client/r0/sync"
+	client := HTTPClient{
+		DestinationServer: baseURL,
+		Filter:            SyncFilter{InitialTimelineLimit: 10, LazyLoadMembers: true, IncludeLeave: true},
+	}
+	gotURL := client.createSyncURL("", true, false, false)
+	wantURL := wantBaseURL + `?timeout=0&set_presence=offline&filter=` +
+		url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"include_leave":true,"state":{"lazy_load_members":true},"timeline":{"limit":10}}}`)
+	if gotURL != wantURL {
+		t.Errorf("initial poll: got %v want %v", gotURL, wantURL)
+	}
+	// the timeline limit of later polls keeps its default
+	gotURL = client.createSyncURL("112233", false, false, false)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` +
+		url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"include_leave":true,"state":{"lazy_load_members":true},"timeline":{"limit":50}}}`)
+	if gotURL != wantURL {
+		t.Errorf("later poll: got %v want %v", gotURL, wantURL)
+	}
+}
@@ -2,11 +2,12 @@ package handler2
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -19,15 +20,15 @@ import (
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModulePoller)
+
+// DefaultPollerExpiry is how long a device can go without using the proxy before its poller is
+// expired, unless changed with SetPollerExpiry.
+const DefaultPollerExpiry = 30 * 24 * time.Hour
 
 // Handler is responsible for starting v2 pollers at startup;
 // processing v2 data (as a sync2.V2DataReceiver) and publishing updates (pubsub.Payload to V2Listeners);
@@ -40,22 +41,57 @@ type Handler struct {
 	v3Sub   *pubsub.V3Sub
 	// user_id|room_id|event_type => fnv_hash(last_event_bytes)
 	accountDataMap *sync.Map
-	unreadMap      map[string]struct {
-		Highlight int
-		Notif     int
-		Unread    int
-	}
+	// room_id+user_id => the last unread counts seen from the homeserver. Guarded by unreadMu.
+	unreadMap map[string]unreadCounts
+	// room_id+user_id => rooms which had a gappy poll, so their stored unread counts may have
+	// drifted. Guarded by unreadMu.
+	unreadGaps            map[string]unreadGap
+	unreadMu              *sync.Mutex
+	unreadReconcileTicker *time.Ticker
 	// room_id -> PollerID, stores which Poller is allowed to update typing notifications
 	typingHandler map[string]sync2.PollerID
 	typingMu      *sync.Mutex
-	PendingTxnIDs *sync2.PendingTransactionIDs
+	// room_id -> rooms whose typing notifications are being debounced. Guarded by typingMu.
+	typingThrottles map[string]*typingThrottle
+	typingDebounce  time.Duration
+	PendingTxnIDs   *sync2.PendingTransactionIDs
 
 	deviceDataTicker   *sync2.DeviceDataTicker
 	pollerExpiryTicker *time.Ticker
 	e2eeWorkerPool     *internal.WorkerPool
 
-	numPollers prometheus.Gauge
-	subSystem  string
+	// pollerExpiry is how long a device can go without using the proxy before its poller is
+	// expired, as a time.Duration. Atomic as it can be changed by a config reload.
+	pollerExpiry atomic.Int64
+
+	accountDataQuotas AccountDataQuotas
+
+	// user_id -> *internal.PushRules, parsed from their m.push_rules account data
+	pushRules      *sync.Map
+	pushRuleCounts bool
+	// unreadCounts calculates MSC2654 unread counts in the proxy
+	unreadCounts bool
+
+	// room_id -> users whose invite is waiting on a room summary being fetched. Guarded by roomSummaryMu.
+	roomSummaryWaiters map[string][]string
+	roomSummaryMu      *sync.Mutex
+	roomSummaryTTL     time.Duration
+
+	staleDeviceCleanup StaleDeviceCleanup
+	staleDeviceTicker  *time.Ticker
+
+	pollerStartup PollerStartup
+	startup       startupProgress
+	// the fraction of pollers which can be failing before PollerHealth is unhealthy
+	maxFailingPollers float64
+
+	numPollers          prometheus.Gauge
+	accountDataRejected *prometheus.CounterVec
+	toDeviceDropped     prometheus.Counter
+	staleDevices        prometheus.Gauge
+	staleDevicesRemoved prometheus.Counter
+	startupPollers      *prometheus.GaugeVec
+	subSystem           string
 }
 
 func NewHandler(
@@ -63,22 +99,26 @@ func NewHandler(
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, deviceDataUpdateDuration time.Duration,
 ) (*Handler, error) {
 	h := &Handler{
-		pMap:      pMap,
-		v2Store:   v2Store,
-		Store:     store,
-		subSystem: "poller",
-		unreadMap: make(map[string]struct {
-			Highlight int
-			Notif     int
-            Unread    int
-		}),
+		pMap:             pMap,
+		v2Store:          v2Store,
+		Store:            store,
+		subSystem:        "poller",
+		unreadMap:        make(map[string]unreadCounts),
+		unreadGaps:       make(map[string]unreadGap),
+		unreadMu:         &sync.Mutex{},
 		accountDataMap:   &sync.Map{},
+		pushRules:        &sync.Map{},
 		typingMu:         &sync.Mutex{},
 		typingHandler:    make(map[string]sync2.PollerID),
+		typingThrottles:  make(map[string]*typingThrottle),
 		PendingTxnIDs:    sync2.NewPendingTransactionIDs(pMap.DeviceIDs),
 		deviceDataTicker: sync2.NewDeviceDataTicker(deviceDataUpdateDuration),
 		e2eeWorkerPool:   internal.NewWorkerPool(500), // TODO: assign as fraction of db max conns, not hardcoded
+
+		roomSummaryWaiters: make(map[string][]string),
+		roomSummaryMu:      &sync.Mutex{},
 	}
+	h.SetPollerExpiry(DefaultPollerExpiry)
 
 	if enablePrometheus {
 		h.addPrometheusMetrics()
@@ -107,9 +147,17 @@ func (h *Handler) Listen() {
 	go h.deviceDataTicker.Run()
 }
 
+// Shutdown stops polling for a graceful shutdown, storing every poller's latest since token so
+// that polling resumes from where it left off after a restart.
+func (h *Handler) Shutdown() {
+	stored := h.pMap.Shutdown()
+	logger.Info().Int("since_tokens", stored).Msg("stopped pollers")
+}
+
 func (h *Handler) Teardown() {
 	// stop polling and tear down DB conns
 	h.v3Sub.Teardown()
+	h.stopTypingThrottles()
 	h.v2Pub.Close()
 	h.Store.Teardown()
 	h.v2Store.Teardown()
@@ -118,64 +166,28 @@ func (h *Handler) Teardown() {
 	if h.pollerExpiryTicker != nil {
 		h.pollerExpiryTicker.Stop()
 	}
+	if h.unreadReconcileTicker != nil {
+		h.unreadReconcileTicker.Stop()
+	}
+	if h.staleDeviceTicker != nil {
+		h.staleDeviceTicker.Stop()
+	}
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
-}
-
-func (h *Handler) StartV2Pollers() {
-	tokens, err := h.v2Store.TokensTable.TokenForEachDevice(nil)
-	if err != nil {
-		logger.Err(err).Msg("StartV2Pollers: failed to query tokens")
-		sentry.CaptureException(err)
-		return
+	if h.accountDataRejected != nil {
+		prometheus.Unregister(h.accountDataRejected)
 	}
-	// how many concurrent pollers to make at startup.
-	// Too high and this will flood the upstream server with sync requests at startup.
-	// Too low and this will take ages for the v2 pollers to startup.
-	numWorkers := 16
-	numFails := 0
-	ch := make(chan sync2.TokenForPoller, len(tokens))
-	for _, t := range tokens {
-		// if we fail to decrypt the access token, skip it.
-		if t.AccessToken == "" {
-			numFails++
-			continue
-		}
-		ch <- t
+	if h.toDeviceDropped != nil {
+		prometheus.Unregister(h.toDeviceDropped)
 	}
-	close(ch)
-	logger.Info().Int("num_devices", len(tokens)).Int("num_fail_decrypt", numFails).Msg("StartV2Pollers")
-	var wg sync.WaitGroup
-	wg.Add(numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		go func() {
-			defer wg.Done()
-			for t := range ch {
-				pid := sync2.PollerID{
-					UserID:   t.UserID,
-					DeviceID: t.DeviceID,
-				}
-				_, err = h.pMap.EnsurePolling(
-					pid, t.AccessToken, t.Since, true,
-					logger.With().Str("user_id", t.UserID).Str("device_id", t.DeviceID).Logger(),
-				)
-				if err != nil {
-					logger.Err(err).Str("user_id", t.UserID).Str("device_id", t.DeviceID).Msg("Failed to start poller")
-				} else {
-					h.updateMetrics()
-				}
-				h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
-					UserID:   t.UserID,
-					DeviceID: t.DeviceID,
-					Success:  err == nil,
-				})
-			}
-		}()
+	if h.staleDevices != nil {
+		prometheus.Unregister(h.staleDevices)
+		prometheus.Unregister(h.staleDevicesRemoved)
+	}
+	if h.startupPollers != nil {
+		prometheus.Unregister(h.startupPollers)
 	}
-	wg.Wait()
-	logger.Info().Msg("StartV2Pollers finished")
-	h.startPollerExpiryTicker()
 }
 
 func (h *Handler) updateMetrics() {
@@ -186,7 +198,13 @@ func (h *Handler) updateMetrics() {
 }
 
 func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
-	// Check if this device is handling any typing notifications, of so, remove it
+	h.releaseTyping(pollerID)
+	h.updateMetrics()
+}
+
+// releaseTyping removes this device from handling typing notifications for any rooms, so another
+// device in the room can take over.
+func (h *Handler) releaseTyping(pollerID sync2.PollerID) {
 	h.typingMu.Lock()
 	defer h.typingMu.Unlock()
 	for roomID, devID := range h.typingHandler {
@@ -194,7 +212,17 @@ func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
 			delete(h.typingHandler, roomID)
 		}
 	}
-	h.updateMetrics()
+}
+
+func (h *Handler) OnUpstreamStatus(ctx context.Context, status sync2.UpstreamStatus) {
+	var since int64
+	if !status.Available {
+		since = status.UnavailableSince.UnixMilli()
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UpstreamStatus{
+		ServerName:       status.ServerName,
+		UnavailableSince: since,
+	})
 }
 
 func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
@@ -210,6 +238,35 @@ func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, d
 	})
 }
 
+// OnLoggedOut is called when the upstream rejects a token with M_UNKNOWN_TOKEN. On a soft logout
+// only the token is deleted: the device keeps its since token, so when it logs in again with a new
+// token its poller resumes incrementally. Otherwise the device is gone, so everything stored for
+// it is deleted.
+func (h *Handler) OnLoggedOut(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	var err error
+	if softLogout {
+		err = h.v2Store.TokensTable.Delete(accessTokenHash)
+		if err == nil {
+			err = h.v2Store.DevicesTable.MarkSoftLogout(userID, deviceID)
+		}
+	} else {
+		err = sqlutil.WithTransaction(h.v2Store.DB, func(txn *sqlx.Tx) error {
+			if err := h.v2Store.DevicesTable.DeleteDevice(txn, userID, deviceID); err != nil {
+				return err
+			}
+			return h.Store.RemoveDevices(txn, []string{userID}, []string{deviceID})
+		})
+	}
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Bool("soft_logout", softLogout).Msg("V2: failed to log out device")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
+		UserID:   userID,
+		DeviceID: deviceID,
+	})
+}
+
 func (h *Handler) addPrometheusMetrics() {
 	h.numPollers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "sliding_sync",
@@ -218,6 +275,22 @@ func (h *Handler) addPrometheusMetrics() {
 		Help:      "Number of active sync v2 pollers.",
 	})
 	prometheus.MustRegister(h.numPollers)
+	h.accountDataRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "account_data_rejected_total",
+		Help:      "Number of account data events dropped for exceeding a quota.",
+	}, []string{"reason", "type"})
+	prometheus.MustRegister(h.accountDataRejected)
+	h.toDeviceDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "to_device_dropped_total",
+		Help:      "Number of undelivered to-device messages dropped for exceeding a device's to-device quota.",
+	})
+	prometheus.MustRegister(h.toDeviceDropped)
+	h.addStaleDeviceMetrics()
+	h.addStartupMetrics()
 }
 
 // Emits nothing as no downstream components need it.
@@ -230,6 +303,8 @@ func (h *Handler) UpdateDeviceSince(ctx context.Context, userID, deviceID, since
 }
 
 func (h *Handler) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) (retErr error) {
+	ctx, span := internal.StartSpan(ctx, "OnE2EEData")
+	defer span.End()
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.e2eeWorkerPool.Queue(func() {
@@ -260,6 +335,11 @@ func (h *Handler) OnBulkDeviceDataUpdate(payload *pubsub.V2DeviceData) {
 }
 
 func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline sync2.TimelineResponse) error {
+	ctx, span := internal.StartSpan(ctx, "Accumulate")
+	defer span.End()
+	if timeline.Limited {
+		h.markUnreadGap(userID, roomID)
+	}
 	// Remember any transaction IDs that may be unique to this user
 	eventIDsWithTxns := make([]string, 0, len(timeline.Events))     // in timeline order
 	eventIDToTxnID := make(map[string]string, len(timeline.Events)) // event_id -> txn_id
@@ -309,6 +389,10 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		})
 	}
 
+	for _, leftUserID := range accResult.LeftEncryptedRoom {
+		h.markDeviceListsLeft(ctx, roomID, leftUserID)
+	}
+
 	// We've updated the database. Now tell any pubsub listeners what we learned.
 	if accResult.NumNew != 0 {
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Accumulate{
@@ -316,6 +400,12 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 			PrevBatch: timeline.PrevBatch,
 			EventNIDs: accResult.TimelineNIDs,
 		})
+		if h.pushRuleCounts {
+			h.countNotifications(ctx, roomID, accResult.TimelineNIDs)
+		}
+		if h.unreadCounts {
+			h.countUnread(ctx, roomID, accResult.TimelineNIDs)
+		}
 	}
 
 	if len(eventIDToTxnID) > 0 || len(eventIDsLackingTxns) > 0 {
@@ -370,7 +460,60 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 	return nil
 }
 
+// markDeviceListsLeft adds the user who left this encrypted room to device_lists.left for the
+// devices of every remaining member who no longer shares an encrypted room with them, and vice
+// versa, so clients stop encrypting for users they can no longer talk to.
+func (h *Handler) markDeviceListsLeft(ctx context.Context, roomID, leftUserID string) {
+	joins, _, _, err := h.Store.FetchMemberships(roomID)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("markDeviceListsLeft: failed to fetch memberships")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(joins) == 0 {
+		return
+	}
+	sharing, err := h.Store.UsersSharingEncryptedRooms(leftUserID, joins)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("user", leftUserID).Msg("markDeviceListsLeft: failed to find shared encrypted rooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	leftLists := make(map[string]int)
+	for _, userID := range joins {
+		if userID != leftUserID && !sharing[userID] {
+			leftLists[userID] = internal.DeviceListLeft
+		}
+	}
+	if len(leftLists) == 0 {
+		return
+	}
+	devices, err := h.v2Store.DevicesTable.DevicesForUsers(append(internal.Keys(leftLists), leftUserID))
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("markDeviceListsLeft: failed to select devices")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	for _, device := range devices {
+		deviceListChanges := map[string]int{leftUserID: internal.DeviceListLeft}
+		if device.UserID == leftUserID {
+			deviceListChanges = leftLists
+		}
+		if err = h.Store.DeviceDataTable.Upsert(device.UserID, device.DeviceID, internal.DeviceKeyData{}, deviceListChanges); err != nil {
+			logger.Err(err).Str("user", device.UserID).Str("device", device.DeviceID).Msg("markDeviceListsLeft: failed to upsert device lists")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		h.deviceDataTicker.Remember(sync2.PollerID{
+			UserID:   device.UserID,
+			DeviceID: device.DeviceID,
+		})
+	}
+}
+
 func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.RawMessage) error {
+	ctx, span := internal.StartSpan(ctx, "Initialise")
+	defer span.End()
 	for i := range state { // Delete MSC4115 field as it isn't accurate when we reuse the same event for >1 user
 		state[i], _ = sjson.DeleteBytes(state[i], "unsigned.membership")
 		// escape .'s in the key name
@@ -411,10 +554,7 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 
 	// we don't persist this for long term storage as typing notifs are inherently ephemeral.
 	// So rather than maintaining them forever, they will naturally expire when we terminate.
-	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Typing{
-		RoomID:         roomID,
-		EphemeralEvent: ephEvent,
-	})
+	h.notifyTyping(roomID, ephEvent)
 }
 
 func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
@@ -433,15 +573,56 @@ func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType st
 		RoomID:   roomID,
 		Receipts: newReceipts,
 	})
+	if h.unreadCounts {
+		h.recountUnread(ctx, roomID, newReceipts)
+	}
+}
+
+func (h *Handler) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	now := time.Now()
+	presences := make([]internal.Presence, 0, len(events))
+	for _, ev := range events {
+		p, ok := internal.PresenceFromEvent(ev, now)
+		if !ok {
+			continue
+		}
+		presences = append(presences, p)
+	}
+	// only changes are sent on, as every poller sees the same presence
+	changed, err := h.Store.PresenceTable.Upsert(presences)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Int("presences", len(presences)).Msg("failed to store presence")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Presence{
+		Presence: changed,
+	})
 }
 
 func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
+	ctx, span := internal.StartSpan(ctx, "AddToDeviceMessages")
+	defer span.End()
 	_, err := h.Store.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Int("msgs", len(msgs)).Msg("V2: failed to store to-device messages")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	dropped, err := h.Store.ToDeviceTable.EnforceQuota(userID, deviceID, time.Now())
+	if err != nil {
+		// the messages were stored, so the device should still be told about them
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("V2: failed to enforce to-device quota")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	} else if dropped > 0 {
+		logger.Warn().Str("user", userID).Str("device", deviceID).Int64("dropped", dropped).Msg("V2: dropped to-device messages over quota")
+		if h.toDeviceDropped != nil {
+			h.toDeviceDropped.Add(float64(dropped))
+		}
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2DeviceMessages{
 		UserID:   userID,
 		DeviceID: deviceID,
@@ -450,10 +631,13 @@ func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID stri
 }
 
 func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount, unreadCount *int) {
+	ctx, span := internal.StartSpan(ctx, "UpdateUnreadCounts")
+	defer span.End()
 	// only touch the DB and notify if they have changed. sync v2 will alwyas include the counts
 	// even if they haven't changed :(
+	// The exception is after a gappy poll: the counts are then authoritative, and are written and
+	// sent to the user caches even if they are the same as the last counts we saw.
 	key := roomID + userID
-	entry, ok := h.unreadMap[key]
 	hc := 0
 	if highlightCount != nil {
 		hc = *highlightCount
@@ -462,38 +646,167 @@ func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string,
 	if notifCount != nil {
 		nc = *notifCount
 	}
-    uc := 0
+	uc := 0
 	if unreadCount != nil {
 		uc = *unreadCount
 	}
-	if ok && entry.Highlight == hc && entry.Notif == nc && entry.Unread == uc {
+	counts := unreadCounts{Highlight: hc, Notif: nc, Unread: uc}
+
+	// unreadMu only guards the maps, so pollers for other rooms aren't blocked on our DB write.
+	h.unreadMu.Lock()
+	entry, ok := h.unreadMap[key]
+	_, gappy := h.unreadGaps[key]
+	if ok && !gappy && entry == counts {
+		h.unreadMu.Unlock()
 		return // dupe
 	}
-	h.unreadMap[key] = struct {
-		Highlight int
-		Notif     int
-        Unread    int
-	}{
-		Highlight: hc,
-		Notif:     nc,
-        Unread:    uc,
-	}
+	h.unreadMap[key] = counts
+	h.unreadMu.Unlock()
 
 	err := h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount, unreadCount)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
+	h.unreadMu.Lock()
+	if h.unreadMap[key] != counts {
+		// another poller for this user updated the counts whilst we were writing, so the writes
+		// may have landed out of order. Let ReconcileUnreadCounts write the latest counts.
+		if _, exists := h.unreadGaps[key]; !exists {
+			h.unreadGaps[key] = unreadGap{userID: userID, roomID: roomID, since: time.Now()}
+		}
+	} else if err != nil {
+		// forget the counts so the next poll retries the write rather than treating it as a dupe
+		delete(h.unreadMap, key)
+	} else {
+		delete(h.unreadGaps, key)
+	}
+	h.unreadMu.Unlock()
+
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
 		RoomID:            roomID,
 		UserID:            userID,
 		HighlightCount:    highlightCount,
 		NotificationCount: notifCount,
-        UnreadCount:       unreadCount,
+		UnreadCount:       unreadCount,
+	})
+}
+
+func (h *Handler) UpdateThreadUnreadCounts(ctx context.Context, roomID, userID string, threads map[string]internal.ThreadUnreadCounts) {
+	// sync v2 includes the thread counts whenever the room is in the response, so only notify
+	// if they have changed.
+	changed, err := h.Store.ThreadUnreadTable.UpdateThreadUnreadCounters(userID, roomID, threads)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update thread unread counters")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if !changed {
+		return
+	}
+	nonZero := make(map[string]internal.ThreadUnreadCounts, len(threads))
+	for threadID, counts := range threads {
+		if counts != (internal.ThreadUnreadCounts{}) {
+			nonZero[threadID] = counts
+		}
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ThreadUnreadCounts{
+		UserID:  userID,
+		RoomID:  roomID,
+		Threads: nonZero,
 	})
 }
 
+// unreadCounts are the last unread counts the homeserver sent for a user in a room.
+type unreadCounts struct {
+	Highlight int
+	Notif     int
+	Unread    int
+}
+
+// unreadGap is a room which had a gappy poll, so its unread counts may have drifted from the
+// homeserver's.
+type unreadGap struct {
+	userID string
+	roomID string
+	since  time.Time
+}
+
+func (h *Handler) markUnreadGap(userID, roomID string) {
+	h.unreadMu.Lock()
+	defer h.unreadMu.Unlock()
+	key := roomID + userID
+	if _, exists := h.unreadGaps[key]; !exists {
+		h.unreadGaps[key] = unreadGap{userID: userID, roomID: roomID, since: time.Now()}
+	}
+}
+
+// ReconcileUnreadCounts checks the unread counts of rooms which had a gappy poll more than
+// `minAge` ago and have not had authoritative counts from the homeserver since. Stored counts
+// which differ from the last counts the homeserver sent are rewritten, and the stored counts
+// are sent to the user caches in case they missed an update.
+func (h *Handler) ReconcileUnreadCounts(ctx context.Context, minAge time.Duration) {
+	// snapshot the gaps to reconcile, so unreadMu isn't held whilst we hit the DB
+	type gapToReconcile struct {
+		key      string
+		gap      unreadGap
+		entry    unreadCounts
+		hasEntry bool
+	}
+	var gaps []gapToReconcile
+	h.unreadMu.Lock()
+	for key, gap := range h.unreadGaps {
+		if time.Since(gap.since) < minAge {
+			continue
+		}
+		entry, ok := h.unreadMap[key]
+		gaps = append(gaps, gapToReconcile{key: key, gap: gap, entry: entry, hasEntry: ok})
+	}
+	h.unreadMu.Unlock()
+
+	numFixed := 0
+	for _, g := range gaps {
+		hc, nc, err := h.Store.UnreadTable.SelectUnreadCounters(g.gap.userID, g.gap.roomID)
+		if err != nil && err != sql.ErrNoRows {
+			logger.Err(err).Str("user", g.gap.userID).Str("room", g.gap.roomID).Msg("ReconcileUnreadCounts: failed to select unread counters")
+			continue // try again next time
+		}
+		if g.hasEntry && (g.entry.Highlight != hc || g.entry.Notif != nc) {
+			hc, nc = g.entry.Highlight, g.entry.Notif
+			if err = h.Store.UnreadTable.UpdateUnreadCounters(g.gap.userID, g.gap.roomID, &hc, &nc, nil); err != nil {
+				logger.Err(err).Str("user", g.gap.userID).Str("room", g.gap.roomID).Msg("ReconcileUnreadCounts: failed to update unread counters")
+				continue
+			}
+			numFixed++
+		}
+		h.unreadMu.Lock()
+		entry, ok := h.unreadMap[g.key]
+		if ok != g.hasEntry || entry != g.entry {
+			// a poller sent new counts whilst we were reconciling, and our write may have
+			// clobbered theirs: check again next time.
+			if _, exists := h.unreadGaps[g.key]; !exists {
+				h.unreadGaps[g.key] = g.gap
+			}
+			h.unreadMu.Unlock()
+			continue
+		}
+		delete(h.unreadGaps, g.key)
+		h.unreadMu.Unlock()
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
+			RoomID:            g.gap.roomID,
+			UserID:            g.gap.userID,
+			HighlightCount:    &hc,
+			NotificationCount: &nc,
+		})
+	}
+	if numFixed > 0 {
+		logger.Info().Int("rooms", numFixed).Msg("ReconcileUnreadCounts: corrected drifted unread counts")
+	}
+}
+
 func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) error {
+	ctx, span := internal.StartSpan(ctx, "OnAccountData")
+	defer span.End()
 	// duplicate suppression for multiple devices on the same account.
 	// We suppress by remembering the last bytes for a given account data, and if they match we ignore.
 	dedupedEvents := make([]json.RawMessage, 0, len(events))
@@ -511,6 +824,7 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 		dedupedEvents = append(dedupedEvents, events[i])
 		h.accountDataMap.Store(key, thisHash)
 	}
+	dedupedEvents = h.applyAccountDataQuotas(userID, roomID, dedupedEvents)
 	if len(dedupedEvents) == 0 {
 		return nil
 	}
@@ -521,6 +835,7 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 		sentry.CaptureException(err)
 		return err
 	}
+	h.forgetPushRules(userID, roomID, dedupedEvents)
 	var types []string
 	for _, d := range data {
 		types = append(types, d.Type)
@@ -534,7 +849,18 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 }
 
 func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
-	err := h.Store.InvitesTable.InsertInvite(userID, roomID, inviteState)
+	ctx, span := internal.StartSpan(ctx, "OnInvite")
+	defer span.End()
+	// another device's poller may have already seen this invite be rejected or accepted
+	retired, err := h.Store.InvitesTable.IsRetired(userID, roomID, inviteTimestamp(userID, inviteState), time.Now())
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to check for retired invite")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	} else if retired {
+		logger.Debug().Str("user", userID).Str("room", roomID).Msg("ignoring stale invite which has been retired")
+		return nil
+	}
+	err = h.Store.InvitesTable.InsertInvite(userID, roomID, inviteState)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -544,12 +870,38 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 		UserID: userID,
 		RoomID: roomID,
 	})
+	h.maybeFetchRoomSummary(userID, roomID, inviteState)
 	return nil
 }
 
+// inviteTimestamp returns the origin_server_ts of the user's invite event in the invite state, or
+// 0 if it is not there.
+func inviteTimestamp(userID string, inviteState []json.RawMessage) int64 {
+	for _, ev := range inviteState {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == "m.room.member" && parsed.Get("state_key").Str == userID {
+			return parsed.Get("origin_server_ts").Int()
+		}
+	}
+	return 0
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
-	// remove any invites for this user if they are rejecting an invite
-	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
+	ctx, span := internal.StartSpan(ctx, "OnLeftRoom")
+	defer span.End()
+	// rooms stay in the leave section of an initial sync which includes left rooms until they are
+	// forgotten on the homeserver, so don't bring back a room the user forgot in the proxy
+	forgotten, err := h.Store.ForgottenRoomsTable.IsForgotten(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to check if room is forgotten")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	} else if forgotten {
+		logger.Trace().Str("user", userID).Str("room", roomID).Msg("ignoring leave for forgotten room")
+		return nil
+	}
+	// remove any invites for this user if they are rejecting an invite, and stop pollers for the
+	// user's other devices from storing it again
+	err = h.Store.InvitesTable.RetireInvite(userID, roomID, gjson.GetBytes(leaveEv, "origin_server_ts").Int())
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -604,6 +956,32 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	}()
 }
 
+// OnEphemeralDemand updates whether the poller for this device fetches typing notifications and
+// receipts, depending on whether any of its clients want them.
+func (h *Handler) OnEphemeralDemand(p *pubsub.V3EphemeralDemand) {
+	pid := sync2.PollerID{
+		UserID:   p.UserID,
+		DeviceID: p.DeviceID,
+	}
+	h.pMap.SetEphemeralWanted(pid, p.Wanted)
+	if !p.Wanted {
+		// this poller won't see typing notifications any more
+		h.releaseTyping(pid)
+	}
+}
+
+func (h *Handler) startUnreadReconcileTicker() {
+	if h.unreadReconcileTicker != nil {
+		return
+	}
+	h.unreadReconcileTicker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.unreadReconcileTicker.C {
+			h.ReconcileUnreadCounts(context.Background(), time.Minute)
+		}
+	}()
+}
+
 func (h *Handler) startPollerExpiryTicker() {
 	if h.pollerExpiryTicker != nil {
 		return
@@ -616,12 +994,28 @@ func (h *Handler) startPollerExpiryTicker() {
 	}()
 }
 
+// PollerStatuses returns the status of every poller for this user.
+func (h *Handler) PollerStatuses(userID string) []sync2.PollerStatus {
+	return h.pMap.PollerStatuses(userID)
+}
+
+// DeviceSince returns the stored since token for this device, which its poller resumes from.
+func (h *Handler) DeviceSince(userID, deviceID string) (string, error) {
+	return h.v2Store.DeviceSince(userID, deviceID)
+}
+
+// SetPollerExpiry changes how long a device can go without making a sliding sync query before its
+// poller is expired. Defaults to DefaultPollerExpiry. Safe to call while pollers are running.
+func (h *Handler) SetPollerExpiry(expiry time.Duration) {
+	h.pollerExpiry.Store(int64(expiry))
+}
+
 // ExpireOldPollers looks for pollers whose devices have not made a sliding sync query
-// in the last 30 days, and asks the poller map to expire their corresponding pollers.
+// within the poller expiry, and asks the poller map to expire their corresponding pollers.
 // This function does not normally need to be called manually (StartV2Pollers queues it
 // up to run hourly); we expose it publicly only for testing purposes.
 func (h *Handler) ExpireOldPollers() {
-	devices, err := h.v2Store.DevicesTable.FindOldDevices(30 * 24 * time.Hour)
+	devices, err := h.v2Store.DevicesTable.FindOldDevices(time.Duration(h.pollerExpiry.Load()))
 	if err != nil {
 		logger.Err(err).Msg("Error fetching old devices")
 		sentry.CaptureException(err)
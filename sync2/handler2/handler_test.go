@@ -2,14 +2,19 @@ package handler2_test
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 
 	"github.com/matrix-org/sliding-sync/pubsub"
@@ -18,12 +23,13 @@ import (
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
 )
 
 var postgresURI string
 
 func TestMain(m *testing.M) {
-	postgresURI = testutils.PrepareDBConnectionString()
+	postgresURI = testutils.PrepareDBWithSchema()
 	exitCode := m.Run()
 	os.Exit(exitCode)
 }
@@ -36,7 +42,14 @@ type pollInfo struct {
 }
 
 type mockPollerMap struct {
-	calls []pollInfo
+	calls       []pollInfo
+	roomSummary func(userID, roomID string, via []string) (*internal.RoomSummary, error)
+	deviceIDs   map[string][]string
+	terminated  []sync2.PollerID
+	statuses    []sync2.PollerStatus
+	// ensurePolling, if set, is called by EnsurePolling, which fails if it returns an error.
+	ensurePolling func(pid sync2.PollerID) error
+	mu            sync.Mutex
 }
 
 func (p *mockPollerMap) NumPollers() int {
@@ -44,25 +57,57 @@ func (p *mockPollerMap) NumPollers() int {
 }
 func (p *mockPollerMap) Terminate() {}
 
+func (p *mockPollerMap) Shutdown() int { return 0 }
+
 func (p *mockPollerMap) DeviceIDs(userID string) []string {
-	return nil
+	return p.deviceIDs[userID]
 }
 
 func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) TerminatePoller(pid sync2.PollerID) bool {
+	for _, deviceID := range p.deviceIDs[pid.UserID] {
+		if deviceID == pid.DeviceID {
+			p.terminated = append(p.terminated, pid)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *mockPollerMap) SetEphemeralWanted(pid sync2.PollerID, wanted bool) {}
+
+func (p *mockPollerMap) PollerStatuses(userID string) []sync2.PollerStatus {
+	return p.statuses
+}
+
+func (p *mockPollerMap) RoomSummary(ctx context.Context, userID, roomID string, via []string) (*internal.RoomSummary, error) {
+	if p.roomSummary == nil {
+		return nil, fmt.Errorf("no room summary")
+	}
+	return p.roomSummary(userID, roomID, via)
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
+	p.mu.Lock()
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
 		accessToken: accessToken,
 		v2since:     v2since,
 		isStartup:   isStartup,
 	})
+	p.mu.Unlock()
+	if p.ensurePolling != nil {
+		return false, p.ensurePolling(pid)
+	}
 	return false, nil
 }
 
 func (p *mockPollerMap) assertCallExists(t *testing.T, pi pollInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	for _, c := range p.calls {
 		if reflect.DeepEqual(pi, c) {
 			return
@@ -86,8 +131,8 @@ func newMockPub() *mockPub {
 
 // Notify chanName that there is a new payload p. Return an error if we failed to send the notification.
 func (p *mockPub) Notify(chanName string, payload pubsub.Payload) error {
-	p.calls = append(p.calls, payload)
 	p.mu.Lock()
+	p.calls = append(p.calls, payload)
 	for _, ch := range p.waiters[payload.Type()] {
 		close(ch)
 	}
@@ -227,3 +272,828 @@ func TestSetTypingConcurrently(t *testing.T) {
 		t.Fatalf("expected only one call to notify, got %d", gotCalls)
 	}
 }
+
+// Test that typing changes within the debounce window are coalesced into the latest one.
+func TestSetTypingDebounce(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	pub := newMockPub()
+	sub := &mockSub{}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	assertNoError(t, err)
+	h.SetTypingDebounce(200 * time.Millisecond)
+	ctx := context.Background()
+	pollerID := sync2.PollerID{UserID: "@alice", DeviceID: "aliceDevice"}
+	roomID := "!typing-debounce:localhost"
+	typingType := pubsub.V2Typing{}
+
+	typingCalls := func() (calls []*pubsub.V2Typing) {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		for _, p := range pub.calls {
+			if typing, ok := p.(*pubsub.V2Typing); ok && typing.RoomID == roomID {
+				calls = append(calls, typing)
+			}
+		}
+		return calls
+	}
+
+	// the first change is sent immediately, the rest are held back
+	ch := pub.WaitForPayloadType(typingType.Type())
+	h.SetTyping(ctx, pollerID, roomID, json.RawMessage(`{"content":{"user_ids":["@alice:localhost"]}}`))
+	pub.DoWait(t, "didn't see V2Typing", ch, false)
+	h.SetTyping(ctx, pollerID, roomID, json.RawMessage(`{"content":{"user_ids":[]}}`))
+	h.SetTyping(ctx, pollerID, roomID, json.RawMessage(`{"content":{"user_ids":["@bob:localhost"]}}`))
+	if calls := typingCalls(); len(calls) != 1 {
+		t.Fatalf("got %d V2Typing payloads before the window ended, want 1", len(calls))
+	}
+
+	// the latest change is sent when the window ends
+	ch = pub.WaitForPayloadType(typingType.Type())
+	pub.DoWait(t, "didn't see coalesced V2Typing", ch, false)
+	calls := typingCalls()
+	if len(calls) != 2 {
+		t.Fatalf("got %d V2Typing payloads after the window ended, want 2", len(calls))
+	}
+	if got := string(calls[1].EphemeralEvent); got != `{"content":{"user_ids":["@bob:localhost"]}}` {
+		t.Errorf("coalesced V2Typing: got %s want the latest typing event", got)
+	}
+
+	// nothing more is sent once the room is quiet
+	ch = pub.WaitForPayloadType(typingType.Type())
+	pub.DoWait(t, "saw unexpected V2Typing", ch, true)
+}
+
+func TestHandlerReconcileUnreadCounts(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pub := newMockPub()
+	h, err := handler2.NewHandler(&mockPollerMap{}, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	roomID := "!TestHandlerReconcileUnreadCounts:localhost"
+	one, two := 1, 2
+
+	numUnreadPayloads := func() (n int, last *pubsub.V2UnreadCounts) {
+		for _, p := range pub.calls {
+			if uc, ok := p.(*pubsub.V2UnreadCounts); ok {
+				n++
+				last = uc
+			}
+		}
+		return
+	}
+	gappyPoll := func() {
+		// the room doesn't exist so accumulating fails, but the gap is still recorded
+		_ = h.Accumulate(ctx, alice, "ALICE", roomID, sync2.TimelineResponse{Limited: true})
+	}
+
+	h.UpdateUnreadCounts(ctx, roomID, alice, &one, &two, nil)
+	h.UpdateUnreadCounts(ctx, roomID, alice, &one, &two, nil)
+	if n, _ := numUnreadPayloads(); n != 1 {
+		t.Fatalf("got %d unread count payloads, want 1 as duplicates are suppressed", n)
+	}
+
+	// after a gappy poll, the same counts are treated as authoritative
+	gappyPoll()
+	h.UpdateUnreadCounts(ctx, roomID, alice, &one, &two, nil)
+	if n, _ := numUnreadPayloads(); n != 2 {
+		t.Fatalf("got %d unread count payloads, want 2 after a gappy poll", n)
+	}
+
+	// the stored counts drift, and the homeserver hasn't sent counts since the gap
+	five := 5
+	assertNoError(t, store.UnreadTable.UpdateUnreadCounters(alice, roomID, &five, &five, nil))
+	gappyPoll()
+	h.ReconcileUnreadCounts(ctx, time.Hour) // too soon
+	if n, _ := numUnreadPayloads(); n != 2 {
+		t.Fatalf("got %d unread count payloads, want 2 before the gap is old enough", n)
+	}
+	h.ReconcileUnreadCounts(ctx, 0)
+	n, last := numUnreadPayloads()
+	if n != 3 {
+		t.Fatalf("got %d unread count payloads, want 3 after reconciling", n)
+	}
+	if *last.HighlightCount != one || *last.NotificationCount != two {
+		t.Errorf("reconciled counts: got highlight=%d notif=%d want %d %d", *last.HighlightCount, *last.NotificationCount, one, two)
+	}
+	gotHighlight, gotNotif, err := store.UnreadTable.SelectUnreadCounters(alice, roomID)
+	assertNoError(t, err)
+	if gotHighlight != one || gotNotif != two {
+		t.Errorf("stored counts: got highlight=%d notif=%d want %d %d", gotHighlight, gotNotif, one, two)
+	}
+
+	// the gap has been reconciled, so there is nothing more to do
+	h.ReconcileUnreadCounts(ctx, 0)
+	if n, _ := numUnreadPayloads(); n != 3 {
+		t.Errorf("got %d unread count payloads, want 3 as the gap was already reconciled", n)
+	}
+}
+
+// blockingUnreadPub blocks notifying unread counts for blockRoomID until unblock is closed.
+type blockingUnreadPub struct {
+	*mockPub
+	blockRoomID string
+	unblock     chan struct{}
+}
+
+func (p *blockingUnreadPub) Notify(chanName string, payload pubsub.Payload) error {
+	if uc, ok := payload.(*pubsub.V2UnreadCounts); ok && uc.RoomID == p.blockRoomID {
+		<-p.unblock
+	}
+	return p.mockPub.Notify(chanName, payload)
+}
+
+// Test that pollers updating unread counts concurrently don't block each other, and that the
+// stored counts end up as the latest counts from the homeserver.
+func TestHandlerUpdateUnreadCountsConcurrently(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	slowRoomID := "!TestHandlerUpdateUnreadCountsConcurrently-slow:localhost"
+	roomID := "!TestHandlerUpdateUnreadCountsConcurrently:localhost"
+	pub := &blockingUnreadPub{mockPub: newMockPub(), blockRoomID: slowRoomID, unblock: make(chan struct{})}
+	h, err := handler2.NewHandler(&mockPollerMap{}, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	ctx := context.Background()
+	alice := "@alice:localhost"
+
+	// the first poller is stuck notifying, which must not stop the second poller
+	one := 1
+	slowDone := make(chan struct{})
+	go func() {
+		h.UpdateUnreadCounts(ctx, slowRoomID, alice, &one, &one, nil)
+		close(slowDone)
+	}()
+	fastDone := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond) // let the first poller get stuck
+		h.UpdateUnreadCounts(ctx, roomID, alice, &one, &one, nil)
+		close(fastDone)
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second):
+		t.Fatalf("UpdateUnreadCounts was blocked by another poller notifying")
+	}
+	close(pub.unblock)
+	<-slowDone
+
+	// both pollers race to write counts for the same room, and then the homeserver settles
+	var wg sync.WaitGroup
+	for poller := 0; poller < 2; poller++ {
+		wg.Add(1)
+		go func(poller int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				hc, nc := poller, i
+				h.UpdateUnreadCounts(ctx, roomID, alice, &hc, &nc, nil)
+			}
+		}(poller)
+	}
+	wg.Wait()
+	three, four := 3, 4
+	h.UpdateUnreadCounts(ctx, roomID, alice, &three, &four, nil)
+	h.UpdateUnreadCounts(ctx, roomID, alice, &three, &four, nil)
+	h.ReconcileUnreadCounts(ctx, 0)
+	gotHighlight, gotNotif, err := store.UnreadTable.SelectUnreadCounters(alice, roomID)
+	assertNoError(t, err)
+	if gotHighlight != three || gotNotif != four {
+		t.Errorf("stored counts: got highlight=%d notif=%d want %d %d", gotHighlight, gotNotif, three, four)
+	}
+}
+
+func TestHandlerPushRuleCounts(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pub := newMockPub()
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	// charlie has no poller, so their counts aren't maintained by the proxy
+	pMap := &mockPollerMap{deviceIDs: map[string][]string{alice: {"ALICE"}, bob: {"BOB"}}}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	h.SetPushRuleCounts(true)
+	ctx := context.Background()
+	roomID := "!TestHandlerPushRuleCounts:localhost"
+
+	pushRules := json.RawMessage(`{"type":"m.push_rules","content":{"global":{
+		"override": [{"rule_id": ".m.rule.contains_display_name", "default": true, "enabled": true,
+			"conditions": [{"kind": "contains_display_name"}], "actions": ["notify", {"set_tweak": "highlight"}]}],
+		"underride": [{"rule_id": ".m.rule.message", "default": true, "enabled": true,
+			"conditions": [{"kind": "event_match", "key": "type", "pattern": "m.room.message"}], "actions": ["notify"]}]
+	}}}`)
+	for _, userID := range []string{alice, bob, charlie} {
+		assertNoError(t, h.OnAccountData(ctx, userID, state.AccountDataGlobalRoom, []json.RawMessage{pushRules}))
+	}
+	assertNoError(t, h.Initialise(ctx, roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{"membership": "join", "displayname": "Bob"}),
+		testutils.NewJoinEvent(t, charlie),
+	}))
+
+	assertCounts := func(userID string, wantHighlight, wantNotif int) {
+		t.Helper()
+		gotHighlight, gotNotif, err := store.UnreadTable.SelectUnreadCounters(userID, roomID)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatalf("SelectUnreadCounters: %s", err)
+		}
+		if gotHighlight != wantHighlight || gotNotif != wantNotif {
+			t.Errorf("%s: got highlight=%d notif=%d want %d %d", userID, gotHighlight, gotNotif, wantHighlight, wantNotif)
+		}
+	}
+
+	// alice's poller sees charlie's messages first, which are counted for bob straight away
+	assertNoError(t, h.Accumulate(ctx, alice, "ALICE", roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{"body": "hello"}),
+			testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{"body": "hello bob"}),
+		},
+	}))
+	assertCounts(alice, 0, 2)
+	assertCounts(bob, 1, 2)
+	assertCounts(charlie, 0, 0)
+
+	// bob's poller sees the same events, which aren't counted again
+	assertNoError(t, h.Accumulate(ctx, bob, "BOB", roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{"body": "hello"}),
+		},
+	}))
+	assertCounts(bob, 1, 3)
+
+	// sending a message reads the room
+	assertNoError(t, h.Accumulate(ctx, bob, "BOB", roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "hi"}),
+			testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "yo"}),
+		},
+	}))
+	assertCounts(alice, 0, 0)
+	assertCounts(bob, 0, 1)
+
+	// the homeserver's counts replace the proxy's, even if they are the same as its last counts
+	zero := 0
+	h.UpdateUnreadCounts(ctx, roomID, bob, &zero, &zero, nil)
+	assertNoError(t, h.Accumulate(ctx, alice, "ALICE", roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{"body": "again"}),
+		},
+	}))
+	assertCounts(bob, 0, 1)
+	h.UpdateUnreadCounts(ctx, roomID, bob, &zero, &zero, nil)
+	assertCounts(bob, 0, 0)
+}
+
+// Test that counting notifications for one room doesn't block pollers updating counts for others.
+func TestHandlerPushRuleCountsDoesNotBlock(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	slowRoomID := "!TestHandlerPushRuleCountsDoesNotBlock-slow:localhost"
+	roomID := "!TestHandlerPushRuleCountsDoesNotBlock:localhost"
+	pub := &blockingUnreadPub{mockPub: newMockPub(), blockRoomID: slowRoomID, unblock: make(chan struct{})}
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	pMap := &mockPollerMap{deviceIDs: map[string][]string{alice: {"ALICE"}, bob: {"BOB"}}}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	h.SetPushRuleCounts(true)
+	ctx := context.Background()
+
+	pushRules := json.RawMessage(`{"type":"m.push_rules","content":{"global":{
+		"underride": [{"rule_id": ".m.rule.message", "default": true, "enabled": true,
+			"conditions": [{"kind": "event_match", "key": "type", "pattern": "m.room.message"}], "actions": ["notify"]}]
+	}}}`)
+	assertNoError(t, h.OnAccountData(ctx, bob, state.AccountDataGlobalRoom, []json.RawMessage{pushRules}))
+	assertNoError(t, h.Initialise(ctx, slowRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	}))
+
+	// alice's poller is stuck notifying bob's new counts, which must not stop bob's poller
+	slowDone := make(chan struct{})
+	go func() {
+		h.Accumulate(ctx, alice, "ALICE", slowRoomID, sync2.TimelineResponse{
+			Events: []json.RawMessage{
+				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hello"}),
+			},
+		})
+		close(slowDone)
+	}()
+	fastDone := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond) // let the first poller get stuck
+		one := 1
+		h.UpdateUnreadCounts(ctx, roomID, bob, &one, &one, nil)
+		close(fastDone)
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second):
+		t.Fatalf("UpdateUnreadCounts was blocked by another poller counting notifications")
+	}
+	close(pub.unblock)
+	<-slowDone
+	gotHighlight, gotNotif, err := store.UnreadTable.SelectUnreadCounters(bob, slowRoomID)
+	assertNoError(t, err)
+	if gotHighlight != 0 || gotNotif != 1 {
+		t.Errorf("stored counts: got highlight=%d notif=%d want 0 1", gotHighlight, gotNotif)
+	}
+}
+
+func TestHandlerPollerHealth(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	h, err := handler2.NewHandler(pMap, v2Store, store, newMockPub(), &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+
+	health := h.PollerHealth()
+	if !health.Healthy || health.Total != 0 || len(health.Pollers) != 0 {
+		t.Fatalf("PollerHealth with no pollers: got %+v want healthy", health)
+	}
+
+	lastPoll := time.Now().Add(-time.Minute).UnixMilli()
+	pMap.statuses = []sync2.PollerStatus{
+		{UserID: "@bob:localhost", DeviceID: "BOB", LastPollTS: lastPoll, ConsecutiveFailures: 2, BackoffMs: 3000},
+		{UserID: "@alice:localhost", DeviceID: "ALICE", LastPollTS: lastPoll},
+		{UserID: "@alice:localhost", DeviceID: "ALICE2"},
+		{UserID: "@charlie:localhost", DeviceID: "CHARLIE", Terminated: true, ConsecutiveFailures: 5},
+	}
+	health = h.PollerHealth()
+	if !health.Healthy || health.Total != 3 || health.Failing != 1 || health.MaxFailing != handler2.DefaultMaxFailingPollers {
+		t.Fatalf("PollerHealth: got %+v want 1 of 3 pollers failing", health)
+	}
+	var gotDevices []string
+	for _, p := range health.Pollers {
+		gotDevices = append(gotDevices, p.DeviceID)
+	}
+	if want := []string{"ALICE", "ALICE2", "BOB"}; !reflect.DeepEqual(gotDevices, want) {
+		t.Errorf("PollerHealth: got pollers %v want %v", gotDevices, want)
+	}
+	if since := health.Pollers[0].SinceLastPollMs; since == nil || *since < time.Minute.Milliseconds() {
+		t.Errorf("PollerHealth: got since_last_poll_ms %v want at least a minute", since)
+	}
+	if health.Pollers[1].SinceLastPollMs != nil {
+		t.Errorf("PollerHealth: got since_last_poll_ms %v for a poller without an initial sync", *health.Pollers[1].SinceLastPollMs)
+	}
+	if health.Pollers[0].Failing || !health.Pollers[2].Failing {
+		t.Errorf("PollerHealth: got %+v want only BOB failing", health.Pollers)
+	}
+
+	// a third of the pollers failing is too many
+	h.SetMaxFailingPollers(0.25)
+	if health = h.PollerHealth(); health.Healthy {
+		t.Errorf("PollerHealth: got healthy with %d of %d failing and max %v", health.Failing, health.Total, health.MaxFailing)
+	}
+}
+
+func TestParseAccountDataQuotas(t *testing.T) {
+	q, err := handler2.ParseAccountDataQuotas("1000", "64, m.direct=2048,com.example.big=0")
+	assertNoError(t, err)
+	want := handler2.AccountDataQuotas{
+		MaxUserBytes:        1000,
+		MaxEventBytes:       64,
+		MaxEventBytesByType: map[string]int{"m.direct": 2048, "com.example.big": 0},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("ParseAccountDataQuotas: got %+v want %+v", q, want)
+	}
+	q, err = handler2.ParseAccountDataQuotas("", "")
+	assertNoError(t, err)
+	if !reflect.DeepEqual(q, handler2.AccountDataQuotas{}) {
+		t.Errorf("ParseAccountDataQuotas: got %+v want no quotas", q)
+	}
+	for _, invalid := range [][2]string{{"lots", ""}, {"-1", ""}, {"", "m.direct=big"}, {"", "-5"}} {
+		if _, err := handler2.ParseAccountDataQuotas(invalid[0], invalid[1]); err == nil {
+			t.Errorf("ParseAccountDataQuotas(%q, %q) succeeded, want an error", invalid[0], invalid[1])
+		}
+	}
+}
+
+func TestHandlerAccountDataQuotas(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	h, err := handler2.NewHandler(&mockPollerMap{}, v2Store, store, newMockPub(), &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	h.SetAccountDataQuotas(handler2.AccountDataQuotas{
+		MaxUserBytes:        100,
+		MaxEventBytes:       40,
+		MaxEventBytesByType: map[string]int{"m.direct": 80},
+	})
+	ctx := context.Background()
+	alice := "@alice_TestHandlerAccountDataQuotas:localhost"
+	storedTypes := func() []string {
+		t.Helper()
+		datas, err := store.AccountDatas(alice)
+		assertNoError(t, err)
+		var types []string
+		for _, d := range datas {
+			types = append(types, d.Type)
+		}
+		sort.Strings(types)
+		return types
+	}
+
+	assertNoError(t, h.OnAccountData(ctx, alice, sync2.AccountDataGlobalRoom, []json.RawMessage{
+		json.RawMessage(`{"type":"a","content":{}}`),                                         // 25 bytes
+		json.RawMessage(`{"type":"too_big","content":{"foo":"bar","baz":"quux"}}`),           // over the event quota
+		json.RawMessage(`{"type":"m.direct","content":{"@bob:localhost":["!a:localhost"]}}`), // per-type quota
+	}))
+	if got, want := storedTypes(), []string{"a", "m.direct"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stored account data: got %v want %v", got, want)
+	}
+	// 25 + 65 bytes are used, so this doesn't fit in the user quota
+	assertNoError(t, h.OnAccountData(ctx, alice, sync2.AccountDataGlobalRoom, []json.RawMessage{
+		json.RawMessage(`{"type":"b","content":{}}`),
+	}))
+	if got, want := storedTypes(), []string{"a", "m.direct"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stored account data: got %v want %v", got, want)
+	}
+	// but replacing an existing event with a smaller one is fine
+	assertNoError(t, h.OnAccountData(ctx, alice, sync2.AccountDataGlobalRoom, []json.RawMessage{
+		json.RawMessage(`{"type":"m.direct","content":{}}`),
+		json.RawMessage(`{"type":"b","content":{}}`),
+	}))
+	if got, want := storedTypes(), []string{"a", "b", "m.direct"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stored account data: got %v want %v", got, want)
+	}
+}
+
+func TestHandlerFetchesRoomSummaryForInvites(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	var numFetches atomic.Int32
+	release := make(chan struct{})
+	pMap := &mockPollerMap{
+		roomSummary: func(userID, roomID string, via []string) (*internal.RoomSummary, error) {
+			numFetches.Add(1)
+			if !reflect.DeepEqual(via, []string{"remote"}) {
+				t.Errorf("RoomSummary: got via %v want [remote]", via)
+			}
+			<-release
+			return &internal.RoomSummary{RoomID: roomID, Topic: "topic", NumJoinedMembers: 5}, nil
+		},
+	}
+	pub := newMockPub()
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	h.SetRoomSummaryTTL(time.Hour)
+	ctx := context.Background()
+	unknownRoomID := "!unknown_TestHandlerFetchesRoomSummaryForInvites:remote"
+	knownRoomID := "!known_TestHandlerFetchesRoomSummaryForInvites:remote"
+	_, err = store.Initialise(knownRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", "@creator:remote", map[string]interface{}{"creator": "@creator:remote"}),
+		testutils.NewJoinEvent(t, "@creator:remote"),
+	})
+	assertNoError(t, err)
+	invite := func(userID, roomID string) {
+		t.Helper()
+		assertNoError(t, h.OnInvite(ctx, userID, roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.member", userID, "@inviter:remote", map[string]interface{}{"membership": "invite"}),
+		}))
+	}
+
+	// many invites to an unknown room only fetch the summary once
+	invite("@alice:localhost", unknownRoomID)
+	invite("@bob:localhost", unknownRoomID)
+	invitesNotified := pub.WaitForPayloadType((&pubsub.V2InviteRoom{}).Type())
+	close(release)
+	pub.DoWait(t, "invite wasn't re-notified after fetching the room summary", invitesNotified, false)
+	summaries, err := store.RoomSummariesTable.Select([]string{unknownRoomID})
+	assertNoError(t, err)
+	if summaries[unknownRoomID].NumJoinedMembers != 5 || summaries[unknownRoomID].Topic != "topic" {
+		t.Errorf("stored room summary: got %+v", summaries[unknownRoomID])
+	}
+
+	// the summary is fresh so isn't fetched again, and summaries aren't fetched for known rooms
+	invite("@charlie:localhost", unknownRoomID)
+	invite("@alice:localhost", knownRoomID)
+	time.Sleep(10 * time.Millisecond)
+	if n := numFetches.Load(); n != 1 {
+		t.Errorf("got %d room summary fetches, want 1", n)
+	}
+}
+
+func TestHandlerRemoveStaleDevices(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	alice := "@alice_TestHandlerRemoveStaleDevices:localhost"
+	pMap := &mockPollerMap{deviceIDs: map[string][]string{alice: {"POLLING"}}}
+	pub := newMockPub()
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+
+	deviceIDs := []string{"STALE", "POLLING", "RECENT"}
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		for _, deviceID := range deviceIDs {
+			if err := v2Store.DevicesTable.InsertDevice(txn, alice, deviceID); err != nil {
+				return err
+			}
+		}
+		_, err := txn.Exec(`UPDATE syncv3_sync2_devices SET last_poll_ts = $1 WHERE user_id = $2 AND device_id != 'RECENT'`,
+			time.Now().Add(-48*time.Hour).UnixMilli(), alice)
+		return err
+	})
+	assertNoError(t, err)
+	for _, deviceID := range deviceIDs {
+		_, err = store.ToDeviceTable.InsertMessages(alice, deviceID, []json.RawMessage{
+			json.RawMessage(`{"type":"m.room_key_request","sender":"@bob:localhost","content":{}}`),
+		})
+		assertNoError(t, err)
+	}
+	assertDevices := func(want []string) {
+		t.Helper()
+		devices, err := v2Store.DevicesTable.DevicesForUser(alice)
+		assertNoError(t, err)
+		var got []string
+		for _, d := range devices {
+			got = append(got, d.DeviceID)
+			msgs, _, err := store.ToDeviceTable.Messages(alice, d.DeviceID, 0, 10)
+			assertNoError(t, err)
+			if len(msgs) != 1 {
+				t.Errorf("device %s: got %d to-device messages want 1", d.DeviceID, len(msgs))
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("devices: got %v want %v", got, want)
+		}
+	}
+
+	// disabled by default
+	if n := h.RemoveStaleDevices(); n != 0 {
+		t.Fatalf("RemoveStaleDevices: got %d with no TTL, want 0", n)
+	}
+	h.SetStaleDeviceCleanup(handler2.StaleDeviceCleanup{TTL: 24 * time.Hour, DryRun: true})
+	if n := h.RemoveStaleDevices(); n < 1 {
+		t.Fatalf("RemoveStaleDevices: got %d in dry run, want at least 1", n)
+	}
+	assertDevices([]string{"POLLING", "RECENT", "STALE"})
+
+	h.SetStaleDeviceCleanup(handler2.StaleDeviceCleanup{TTL: 24 * time.Hour})
+	ch := pub.WaitForPayloadType((&pubsub.V2ExpiredToken{}).Type())
+	h.RemoveStaleDevices()
+	pub.DoWait(t, "didn't see V2ExpiredToken", ch, false)
+	assertDevices([]string{"POLLING", "RECENT"})
+	msgs, _, err := store.ToDeviceTable.Messages(alice, "STALE", 0, 10)
+	assertNoError(t, err)
+	if len(msgs) != 0 {
+		t.Errorf("got %d to-device messages for a removed device, want 0", len(msgs))
+	}
+}
+
+func TestHandlerStopAndResetPollers(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	alice := "@alice_TestHandlerStopAndResetPollers:localhost"
+	pMap := &mockPollerMap{deviceIDs: map[string][]string{alice: {"POLLING"}}}
+	pub := newMockPub()
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		for _, deviceID := range []string{"POLLING", "IDLE"} {
+			if err := v2Store.DevicesTable.InsertDevice(txn, alice, deviceID); err != nil {
+				return err
+			}
+			if _, err := v2Store.TokensTable.Insert(txn, "token_"+deviceID+"_TestHandlerStopAndResetPollers", alice, deviceID, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assertNoError(t, err)
+	for _, deviceID := range []string{"POLLING", "IDLE"} {
+		assertNoError(t, v2Store.DevicesTable.UpdateDeviceSince(alice, deviceID, "s-"+deviceID))
+	}
+
+	if h.StopPoller(alice, "IDLE") {
+		t.Errorf("StopPoller: stopped a device without a poller")
+	}
+	ch := pub.WaitForPayloadType((&pubsub.V2PollerStopped{}).Type())
+	if !h.StopPoller(alice, "POLLING") {
+		t.Errorf("StopPoller: did not stop a running poller")
+	}
+	pub.DoWait(t, "didn't see V2PollerStopped", ch, false)
+
+	// reset without restarting waits for the device's next request
+	assertNoError(t, h.ResetDeviceSince(alice, "IDLE", false))
+	token, err := v2Store.TokensTable.LatestTokenForDevice(alice, "IDLE")
+	assertNoError(t, err)
+	if token.Since != "" {
+		t.Errorf("ResetDeviceSince: since token is %q want empty", token.Since)
+	}
+
+	// reset and restart does an initial sync now
+	ch = pub.WaitForPayloadType((&pubsub.V2InitialSyncComplete{}).Type())
+	assertNoError(t, h.ResetDeviceSince(alice, "POLLING", true))
+	pub.DoWait(t, "didn't see V2InitialSyncComplete", ch, false)
+	pMap.assertCallExists(t, pollInfo{
+		pid:         sync2.PollerID{UserID: alice, DeviceID: "POLLING"},
+		accessToken: "token_POLLING_TestHandlerStopAndResetPollers",
+		v2since:     "",
+		isStartup:   false,
+	})
+
+	if err = h.ResetDeviceSince(alice, "UNKNOWN", true); err != sql.ErrNoRows {
+		t.Errorf("ResetDeviceSince: got %v for an unknown device, want sql.ErrNoRows", err)
+	}
+}
+
+func TestHandlerStartV2PollersConcurrency(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	alice := "@alice_TestHandlerStartV2PollersConcurrency:localhost"
+	var running, maxRunning atomic.Int32
+	pMap := &mockPollerMap{
+		ensurePolling: func(pid sync2.PollerID) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				max := maxRunning.Load()
+				if n <= max || maxRunning.CompareAndSwap(max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if pid.UserID == alice && pid.DeviceID == "FAILS" {
+				return fmt.Errorf("failed to start poller")
+			}
+			return nil
+		},
+	}
+	h, err := handler2.NewHandler(pMap, v2Store, store, newMockPub(), &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	h.SetPollerStartup(handler2.PollerStartup{Concurrency: 2, Jitter: time.Millisecond})
+	deviceIDs := []string{"A", "B", "C", "D", "FAILS"}
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		for _, deviceID := range deviceIDs {
+			if err := v2Store.DevicesTable.InsertDevice(txn, alice, deviceID); err != nil {
+				return err
+			}
+			if _, err := v2Store.TokensTable.Insert(txn, "token_"+deviceID+"_TestHandlerStartV2PollersConcurrency", alice, deviceID, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assertNoError(t, err)
+
+	if progress := h.StartupProgress(); progress != (handler2.StartupProgress{}) {
+		t.Errorf("StartupProgress before StartV2Pollers: got %+v", progress)
+	}
+	h.StartV2Pollers()
+
+	// other tests store tokens too, so only check the counts add up
+	progress := h.StartupProgress()
+	if !progress.Done {
+		t.Errorf("StartupProgress: not done after StartV2Pollers returned")
+	}
+	if progress.Total < len(deviceIDs) || progress.Synced+progress.Failed != progress.Total {
+		t.Errorf("StartupProgress: got %+v for at least %d devices", progress, len(deviceIDs))
+	}
+	if progress.Failed < 1 {
+		t.Errorf("StartupProgress: got %d failed, want at least 1", progress.Failed)
+	}
+	if maxRunning.Load() > 2 {
+		t.Errorf("StartV2Pollers: polled %d devices at once, want at most 2", maxRunning.Load())
+	}
+	for _, deviceID := range deviceIDs {
+		pMap.assertCallExists(t, pollInfo{
+			pid:         sync2.PollerID{UserID: alice, DeviceID: deviceID},
+			accessToken: "token_" + deviceID + "_TestHandlerStartV2PollersConcurrency",
+			isStartup:   true,
+		})
+	}
+}
+
+// cannedSyncClient returns the given /sync responses in order, standing in for a homeserver
+// whilst a session is recorded.
+type cannedSyncClient struct {
+	sync2.Client
+	responses []*sync2.SyncResponse
+}
+
+func (c *cannedSyncClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*sync2.SyncResponse, int, error) {
+	res := c.responses[0]
+	c.responses = c.responses[1:]
+	return res, 200, nil
+}
+
+// Test that a recorded session replayed with a ReplayClient goes through a real poller into the
+// store, so recordings reproduce the state the proxy saw without a homeserver.
+func TestHandlerReplaysRecordingThroughPoller(t *testing.T) {
+	alice := "@alice_TestHandlerReplaysRecordingThroughPoller:localhost"
+	deviceID := "ALICE"
+	token := "aliceToken_TestHandlerReplaysRecordingThroughPoller"
+	roomID := "!TestHandlerReplaysRecordingThroughPoller:localhost"
+	firstMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "first secret"})
+	secondMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "second secret"})
+
+	// record a session: an initial sync, then a live event
+	dir := t.TempDir()
+	recorder, err := sync2.NewRecordingClient(&cannedSyncClient{
+		responses: []*sync2.SyncResponse{
+			{
+				NextBatch: "1",
+				Rooms: sync2.SyncRoomsResponse{
+					Join: map[string]sync2.SyncV2JoinResponse{
+						roomID: {
+							State: sync2.EventsResponse{
+								Events: []json.RawMessage{
+									testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+									testutils.NewJoinEvent(t, alice),
+								},
+							},
+							Timeline: sync2.TimelineResponse{
+								Events: []json.RawMessage{firstMsg},
+							},
+						},
+					},
+				},
+			},
+			{
+				NextBatch: "2",
+				Rooms: sync2.SyncRoomsResponse{
+					Join: map[string]sync2.SyncV2JoinResponse{
+						roomID: {
+							Timeline: sync2.TimelineResponse{
+								Events: []json.RawMessage{secondMsg},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, dir)
+	assertNoError(t, err)
+	_, _, err = recorder.DoSyncV2(context.Background(), token, "", true, false, false)
+	assertNoError(t, err)
+	_, _, err = recorder.DoSyncV2(context.Background(), token, "1", false, false, false)
+	assertNoError(t, err)
+	recordings, err := sync2.LoadRecordings(dir)
+	assertNoError(t, err)
+	if len(recordings) != 1 {
+		t.Fatalf("got recordings for %d tokens, want 1", len(recordings))
+	}
+
+	// replay it through a real poller
+	replay := sync2.NewReplayClient()
+	for _, recs := range recordings {
+		replay.AddRecordings(alice, deviceID, token, recs)
+	}
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := sync2.NewPollerMap(replay, false)
+	pub := newMockPub()
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	pMap.SetCallbacks(h)
+	defer h.Teardown()
+
+	var tok *sync2.Token
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		if err := v2Store.DevicesTable.InsertDevice(txn, alice, deviceID); err != nil {
+			return err
+		}
+		tok, err = v2Store.TokensTable.Insert(txn, token, alice, deviceID, time.Now())
+		return err
+	})
+	assertNoError(t, err)
+	h.EnsurePolling(&pubsub.V3EnsurePolling{
+		UserID:          alice,
+		DeviceID:        deviceID,
+		AccessTokenHash: tok.AccessTokenHash,
+	})
+	select {
+	case <-replay.Exhausted(token):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the poller to replay the recording")
+	}
+
+	// the store has the room, with the recorded timeline minus its message contents
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+	joined, err := store.JoinedRoomsAfterPosition(alice, latestNID)
+	assertNoError(t, err)
+	if _, ok := joined[roomID]; !ok {
+		t.Fatalf("JoinedRoomsAfterPosition: %s not in %v", roomID, joined)
+	}
+	latest, err := store.LatestEventsInRooms(alice, []string{roomID}, latestNID, 2)
+	assertNoError(t, err)
+	if latest[roomID] == nil || len(latest[roomID].Timeline) != 2 {
+		t.Fatalf("LatestEventsInRooms: got %+v, want 2 events", latest[roomID])
+	}
+	for i, want := range []json.RawMessage{firstMsg, secondMsg} {
+		got := latest[roomID].Timeline[i]
+		if gjson.GetBytes(got, "event_id").Str != gjson.GetBytes(want, "event_id").Str {
+			t.Errorf("timeline[%d]: got %s want %s", i, got, want)
+		}
+		if body := gjson.GetBytes(got, "content.body").Str; body != "<redacted>" {
+			t.Errorf("timeline[%d]: body was not sanitised: %s", i, body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package handler2
+
+import (
+	"sort"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// DefaultMaxFailingPollers is the fraction of pollers which can be failing before PollerHealth
+// reports the pollers as unhealthy, unless changed with SetMaxFailingPollers.
+const DefaultMaxFailingPollers = 0.5
+
+// PollerHealth is the health of every active poller.
+type PollerHealth struct {
+	// Healthy is false if more than MaxFailing of the pollers are failing.
+	Healthy    bool    `json:"healthy"`
+	Total      int     `json:"total"`
+	Failing    int     `json:"failing"`
+	MaxFailing float64 `json:"max_failing"`
+	// Pollers are sorted by user then device.
+	Pollers []PollerHealthStatus `json:"pollers"`
+}
+
+// PollerHealthStatus is the status of a poller and how stale its data is.
+type PollerHealthStatus struct {
+	sync2.PollerStatus
+	// SinceLastPollMs is how many milliseconds ago the last successful poll was, or nil if the
+	// initial sync has not completed.
+	SinceLastPollMs *int64 `json:"since_last_poll_ms"`
+	// Failing is true if the last poll failed, or the poller is waiting for the homeserver to recover.
+	Failing bool `json:"failing"`
+}
+
+// SetMaxFailingPollers sets the fraction of pollers, between 0 and 1, which can be failing before
+// PollerHealth reports the pollers as unhealthy. If 0, uses DefaultMaxFailingPollers.
+func (h *Handler) SetMaxFailingPollers(fraction float64) {
+	h.maxFailingPollers = fraction
+}
+
+// PollerHealth returns the health of every poller which has not been terminated.
+func (h *Handler) PollerHealth() PollerHealth {
+	maxFailing := h.maxFailingPollers
+	if maxFailing <= 0 {
+		maxFailing = DefaultMaxFailingPollers
+	}
+	health := PollerHealth{
+		MaxFailing: maxFailing,
+		Pollers:    []PollerHealthStatus{},
+	}
+	now := time.Now().UnixMilli()
+	for _, status := range h.pMap.PollerStatuses("") {
+		if status.Terminated {
+			continue
+		}
+		pollerHealth := PollerHealthStatus{
+			PollerStatus: status,
+			Failing:      status.ConsecutiveFailures > 0 || status.BackoffMs > 0,
+		}
+		if status.LastPollTS > 0 {
+			sinceLastPoll := now - status.LastPollTS
+			pollerHealth.SinceLastPollMs = &sinceLastPoll
+		}
+		if pollerHealth.Failing {
+			health.Failing++
+		}
+		health.Pollers = append(health.Pollers, pollerHealth)
+	}
+	sort.Slice(health.Pollers, func(i, j int) bool {
+		if health.Pollers[i].UserID != health.Pollers[j].UserID {
+			return health.Pollers[i].UserID < health.Pollers[j].UserID
+		}
+		return health.Pollers[i].DeviceID < health.Pollers[j].DeviceID
+	})
+	health.Total = len(health.Pollers)
+	health.Healthy = health.Total == 0 || float64(health.Failing)/float64(health.Total) <= maxFailing
+	return health
+}
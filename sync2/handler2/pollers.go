@@ -0,0 +1,69 @@
+package handler2
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// StopPoller stops the poller for this device without expiring its access token. The device's
+// next request starts a new poller, which carries on from the stored since token. Returns false
+// if the device has no running poller.
+func (h *Handler) StopPoller(userID, deviceID string) bool {
+	if !h.pMap.TerminatePoller(sync2.PollerID{UserID: userID, DeviceID: deviceID}) {
+		return false
+	}
+	logger.Info().Str("user", userID).Str("device", deviceID).Msg("admin: stopped poller")
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2PollerStopped{
+		UserID:   userID,
+		DeviceID: deviceID,
+	})
+	return true
+}
+
+// ResetDeviceSince stops the poller for this device and forgets its since token, so that its next
+// poll is an initial sync. If restart is true, a new poller is started straight away with the
+// device's most recently used token, otherwise one is started by the device's next request.
+// Returns sql.ErrNoRows if the device is not known.
+//
+// A poller which is part way through processing a response when it is stopped may store its since
+// token again, in which case the reset has no effect on the next poller.
+func (h *Handler) ResetDeviceSince(userID, deviceID string, restart bool) error {
+	pid := sync2.PollerID{UserID: userID, DeviceID: deviceID}
+	h.pMap.TerminatePoller(pid)
+	exists, err := h.v2Store.DevicesTable.ResetSince(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	log := logger.With().Str("user_id", userID).Str("device_id", deviceID).Logger()
+	log.Info().Bool("restart", restart).Msg("admin: reset since token")
+	if !restart {
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2PollerStopped{
+			UserID:   userID,
+			DeviceID: deviceID,
+		})
+		return nil
+	}
+	token, err := h.v2Store.TokensTable.LatestTokenForDevice(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	// an initial sync can take minutes, so don't block the caller
+	go func() {
+		_, err := h.pMap.EnsurePolling(pid, token.AccessToken, "", false, log)
+		if err != nil {
+			log.Err(err).Msg("Failed to restart poller")
+		}
+		h.updateMetrics()
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
+			UserID:   userID,
+			DeviceID: deviceID,
+			Success:  err == nil,
+		})
+	}()
+	return nil
+}
@@ -0,0 +1,219 @@
+package handler2
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/tidwall/gjson"
+)
+
+// SetPushRuleCounts enables counting notifications and highlights in the proxy. New events are
+// evaluated against the push rules of every joined member the proxy is polling for, so their counts
+// are updated as soon as any poller sees an event, rather than waiting for each member's own poller
+// to return the room. This keeps counts fresh for members whose polls are slow or gappy. Counts
+// from sync v2 still replace the proxy's counts whenever they arrive. Must be called before
+// polling starts.
+func (h *Handler) SetPushRuleCounts(enabled bool) {
+	h.pushRuleCounts = enabled
+}
+
+// pushRuleCountDelta is how a user's counts in a room change after some new events.
+type pushRuleCountDelta struct {
+	highlight int
+	notif     int
+	// reset is true if the user sent one of the events, which marks the room as read up to it
+	reset bool
+}
+
+// pushRulesForUser returns the user's parsed push rules, which are cached until their
+// m.push_rules account data changes. Returns nil if the user has no push rules.
+func (h *Handler) pushRulesForUser(userID string) *internal.PushRules {
+	if rules, ok := h.pushRules.Load(userID); ok {
+		return rules.(*internal.PushRules)
+	}
+	data, err := h.Store.AccountData(userID, state.AccountDataGlobalRoom, []string{"m.push_rules"})
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("failed to load push rules")
+		return nil
+	}
+	var rules *internal.PushRules
+	if len(data) > 0 {
+		rules = internal.ParsePushRules(json.RawMessage(gjson.GetBytes(data[0].Data, "content").Raw))
+	}
+	h.pushRules.Store(userID, rules)
+	return rules
+}
+
+// forgetPushRules drops the cached push rules of a user if these account data events change them.
+func (h *Handler) forgetPushRules(userID, roomID string, events []json.RawMessage) {
+	if roomID != state.AccountDataGlobalRoom {
+		return
+	}
+	for _, ev := range events {
+		if gjson.GetBytes(ev, "type").Str == "m.push_rules" {
+			h.pushRules.Delete(userID)
+			return
+		}
+	}
+}
+
+// countNotifications updates the unread counts of the room's joined members for these new events,
+// according to each member's push rules.
+func (h *Handler) countNotifications(ctx context.Context, roomID string, eventNIDs []int64) {
+	ctx, span := internal.StartSpan(ctx, "countNotifications")
+	defer span.End()
+	joins, _, _, err := h.Store.FetchMemberships(roomID)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("countNotifications: failed to fetch memberships")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	// only users with pollers have push rules and counts stored in the proxy
+	memberRules := make(map[string]*internal.PushRules)
+	for _, userID := range joins {
+		if len(h.pMap.DeviceIDs(userID)) == 0 {
+			continue
+		}
+		if rules := h.pushRulesForUser(userID); rules != nil {
+			memberRules[userID] = rules
+		}
+	}
+	if len(memberRules) == 0 {
+		return
+	}
+	events, err := h.Store.EventNIDs(eventNIDs)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("countNotifications: failed to load events")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+
+	// load the display names of the members, and the power levels for @room notifications
+	userIDs := make([]string, 0, len(memberRules))
+	for userID := range memberRules {
+		userIDs = append(userIDs, userID)
+	}
+	var latestNID int64
+	for _, nid := range eventNIDs {
+		if nid > latestNID {
+			latestNID = nid
+		}
+	}
+	roomState, err := h.Store.RoomStateAfterEventPosition(ctx, []string{roomID}, latestNID, map[string][]string{
+		"m.room.member":       userIDs,
+		"m.room.power_levels": {""},
+	})
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("countNotifications: failed to load room state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	displayNames := make(map[string]string, len(userIDs))
+	var powerLevels gjson.Result
+	for _, ev := range roomState[roomID] {
+		switch ev.Type {
+		case "m.room.member":
+			displayNames[ev.StateKey] = gjson.GetBytes(ev.JSON, "content.displayname").Str
+		case "m.room.power_levels":
+			powerLevels = gjson.GetBytes(ev.JSON, "content")
+		}
+	}
+	notificationPowerLevels := make(map[string]int)
+	powerLevels.Get("notifications").ForEach(func(key, value gjson.Result) bool {
+		notificationPowerLevels[key.Str] = int(value.Int())
+		return true
+	})
+
+	deltas := make(map[string]pushRuleCountDelta, len(memberRules))
+	for _, ev := range events {
+		sender := gjson.GetBytes(ev, "sender").Str
+		pctx := internal.PushRuleContext{
+			RoomID:                  roomID,
+			MemberCount:             len(joins),
+			SenderPowerLevel:        userPowerLevel(powerLevels, sender),
+			NotificationPowerLevels: notificationPowerLevels,
+		}
+		for userID, rules := range memberRules {
+			if sender == userID {
+				deltas[userID] = pushRuleCountDelta{reset: true}
+				continue
+			}
+			pctx.DisplayName = displayNames[userID]
+			notify, highlight := rules.Evaluate(ev, pctx)
+			if !notify {
+				continue
+			}
+			delta := deltas[userID]
+			delta.notif++
+			if highlight {
+				delta.highlight++
+			}
+			deltas[userID] = delta
+		}
+	}
+
+	for userID, delta := range deltas {
+		// unreadMu only guards the maps, so pollers for other rooms aren't blocked on our DB writes.
+		key := roomID + userID
+		h.unreadMu.Lock()
+		entry, hadEntry := h.unreadMap[key]
+		h.unreadMu.Unlock()
+
+		hc, nc, err := h.Store.UnreadTable.SelectUnreadCounters(userID, roomID)
+		if err != nil && err != sql.ErrNoRows {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("countNotifications: failed to select unread counters")
+			continue
+		}
+		newHC, newNC := hc+delta.highlight, nc+delta.notif
+		if delta.reset {
+			newHC, newNC = delta.highlight, delta.notif
+		}
+		if newHC == hc && newNC == nc {
+			continue
+		}
+		if err = h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, &newHC, &newNC, nil); err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("countNotifications: failed to update unread counters")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		h.unreadMu.Lock()
+		latest, hasEntry := h.unreadMap[key]
+		if hasEntry != hadEntry || latest != entry {
+			// the homeserver sent counts whilst we were writing, which our write may have
+			// clobbered. Let ReconcileUnreadCounts write them back.
+			if _, exists := h.unreadGaps[key]; !exists {
+				h.unreadGaps[key] = unreadGap{userID: userID, roomID: roomID, since: time.Now()}
+			}
+		} else {
+			// the stored counts no longer match the homeserver's last counts, so its next counts
+			// must be written even if they are the same as its last ones
+			delete(h.unreadMap, key)
+		}
+		h.unreadMu.Unlock()
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
+			RoomID:            roomID,
+			UserID:            userID,
+			HighlightCount:    &newHC,
+			NotificationCount: &newNC,
+		})
+	}
+}
+
+// userPowerLevel returns the power level of the user from m.room.power_levels content.
+func userPowerLevel(powerLevels gjson.Result, userID string) int {
+	if !powerLevels.Exists() {
+		// without power levels the room creator has 100, but they are rarely missing
+		return 0
+	}
+	for key, value := range powerLevels.Get("users").Map() {
+		if key == userID {
+			return int(value.Int())
+		}
+	}
+	return int(powerLevels.Get("users_default").Int())
+}
@@ -0,0 +1,124 @@
+package handler2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// AccountDataQuotas limit how much account data is stored for each user, as bridges can write
+// megabytes of custom account data. Events which would exceed a quota are dropped, so clients
+// never see them. Zero values are unlimited.
+type AccountDataQuotas struct {
+	// MaxUserBytes is the most account data a user can have stored, across all rooms and types.
+	MaxUserBytes int64
+	// MaxEventBytes is the largest an account data event can be.
+	MaxEventBytes int
+	// MaxEventBytesByType overrides MaxEventBytes for specific event types.
+	MaxEventBytesByType map[string]int
+}
+
+// ParseAccountDataQuotas parses the quota on each user's total account data in bytes, and the
+// quota on each account data event in bytes. The event quota is a comma separated list of a
+// default and per-type overrides e.g "65536,m.direct=1048576". Empty strings are unlimited.
+func ParseAccountDataQuotas(maxUserBytes, maxEventBytes string) (q AccountDataQuotas, err error) {
+	if maxUserBytes != "" {
+		q.MaxUserBytes, err = strconv.ParseInt(maxUserBytes, 10, 64)
+		if err != nil || q.MaxUserBytes < 0 {
+			return q, fmt.Errorf("invalid user quota '%s'", maxUserBytes)
+		}
+	}
+	for _, entry := range strings.Split(maxEventBytes, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		evType, size, hasType := strings.Cut(entry, "=")
+		if !hasType {
+			size = evType
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid event quota '%s'", entry)
+		}
+		if !hasType {
+			q.MaxEventBytes = n
+			continue
+		}
+		if q.MaxEventBytesByType == nil {
+			q.MaxEventBytesByType = make(map[string]int)
+		}
+		q.MaxEventBytesByType[strings.TrimSpace(evType)] = n
+	}
+	return q, nil
+}
+
+func (q AccountDataQuotas) isUnlimited() bool {
+	return q.MaxUserBytes == 0 && q.MaxEventBytes == 0 && len(q.MaxEventBytesByType) == 0
+}
+
+func (q AccountDataQuotas) maxEventBytes(evType string) int {
+	if n, ok := q.MaxEventBytesByType[evType]; ok {
+		return n
+	}
+	return q.MaxEventBytes
+}
+
+// SetAccountDataQuotas sets the quotas which are applied to account data before it is stored.
+// Must be called before polling starts.
+func (h *Handler) SetAccountDataQuotas(q AccountDataQuotas) {
+	h.accountDataQuotas = q
+}
+
+// applyAccountDataQuotas returns the events which can be stored without exceeding a quota.
+func (h *Handler) applyAccountDataQuotas(userID, roomID string, events []json.RawMessage) []json.RawMessage {
+	q := h.accountDataQuotas
+	if q.isUnlimited() {
+		return events
+	}
+	accepted := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		evType := gjson.GetBytes(ev, "type").Str
+		if max := q.maxEventBytes(evType); max > 0 && len(ev) > max {
+			h.rejectAccountData(userID, roomID, evType, len(ev), "event_quota")
+			continue
+		}
+		accepted = append(accepted, ev)
+	}
+	if q.MaxUserBytes == 0 || len(accepted) == 0 {
+		return accepted
+	}
+	// the new events replace any existing events of the same type in this room
+	types := make([]string, len(accepted))
+	for i := range accepted {
+		types[i] = gjson.GetBytes(accepted[i], "type").Str
+	}
+	used, err := h.Store.AccountDataSizeForUser(userID, roomID, types)
+	if err != nil {
+		// don't drop account data just because we couldn't check the quota
+		logger.Err(err).Str("user", userID).Msg("failed to check account data quota")
+		return accepted
+	}
+	withinQuota := accepted[:0]
+	for i, ev := range accepted {
+		if used+int64(len(ev)) > q.MaxUserBytes {
+			h.rejectAccountData(userID, roomID, types[i], len(ev), "user_quota")
+			continue
+		}
+		used += int64(len(ev))
+		withinQuota = append(withinQuota, ev)
+	}
+	return withinQuota
+}
+
+func (h *Handler) rejectAccountData(userID, roomID, evType string, size int, reason string) {
+	logger.Warn().Str("user", userID).Str("room", roomID).Str("type", evType).Int("bytes", size).Str("reason", reason).Msg(
+		"dropping account data which exceeds quota",
+	)
+	if h.accountDataRejected != nil {
+		h.accountDataRejected.WithLabelValues(reason, evType).Inc()
+	}
+}
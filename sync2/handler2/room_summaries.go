@@ -0,0 +1,107 @@
+package handler2
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/tidwall/gjson"
+)
+
+// roomSummaryTimeout is how long to wait for the upstream to return a room summary.
+var roomSummaryTimeout = 30 * time.Second
+
+// SetRoomSummaryTTL enables fetching MSC3266 room summaries for invites to rooms the proxy knows
+// nothing about. Summaries are refetched on new invites once they are older than ttl. If ttl is 0,
+// summaries are never fetched. Must be called before polling starts.
+func (h *Handler) SetRoomSummaryTTL(ttl time.Duration) {
+	h.roomSummaryTTL = ttl
+}
+
+// maybeFetchRoomSummary fetches a summary for this room in the background if the proxy has no state
+// for it and hasn't fetched a summary recently. Users are notified of their invite again once the
+// summary is stored, so they see the enriched invite.
+func (h *Handler) maybeFetchRoomSummary(userID, roomID string, inviteState []json.RawMessage) {
+	if h.roomSummaryTTL == 0 {
+		return
+	}
+	known, err := h.Store.IsRoomKnown(roomID)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("failed to check if room is known")
+		return
+	}
+	if known {
+		return
+	}
+	cached, err := h.Store.RoomSummariesTable.Select([]string{roomID})
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("failed to select room summary")
+		return
+	}
+	if summary, ok := cached[roomID]; ok && time.Since(summary.FetchedAt) < h.roomSummaryTTL {
+		return
+	}
+
+	// only fetch once for many invites to the same room, but tell everyone who was invited
+	h.roomSummaryMu.Lock()
+	waiters, inflight := h.roomSummaryWaiters[roomID]
+	h.roomSummaryWaiters[roomID] = append(waiters, userID)
+	h.roomSummaryMu.Unlock()
+	if inflight {
+		return
+	}
+	go h.fetchRoomSummary(userID, roomID, inviterServers(userID, inviteState))
+}
+
+func (h *Handler) fetchRoomSummary(userID, roomID string, via []string) {
+	defer internal.ReportPanicsToSentry()
+	ctx, cancel := context.WithTimeout(context.Background(), roomSummaryTimeout)
+	summary, err := h.pMap.RoomSummary(ctx, userID, roomID, via)
+	cancel()
+
+	h.roomSummaryMu.Lock()
+	waiters := h.roomSummaryWaiters[roomID]
+	delete(h.roomSummaryWaiters, roomID)
+	h.roomSummaryMu.Unlock()
+
+	if err != nil {
+		logger.Warn().Err(err).Str("user", userID).Str("room", roomID).Msg("failed to fetch room summary")
+		return
+	}
+	if err = h.Store.RoomSummariesTable.Upsert(roomID, *summary, time.Now()); err != nil {
+		logger.Err(err).Str("room", roomID).Msg("failed to store room summary")
+		sentry.CaptureException(err)
+		return
+	}
+	notified := make(map[string]struct{}, len(waiters))
+	for _, waiter := range waiters {
+		if _, ok := notified[waiter]; ok {
+			continue
+		}
+		notified[waiter] = struct{}{}
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InviteRoom{
+			UserID: waiter,
+			RoomID: roomID,
+		})
+	}
+}
+
+// inviterServers returns the server of whoever invited this user, as they must be in the room.
+func inviterServers(userID string, inviteState []json.RawMessage) []string {
+	for _, ev := range inviteState {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" || parsed.Get("state_key").Str != userID {
+			continue
+		}
+		_, server, ok := strings.Cut(parsed.Get("sender").Str, ":")
+		if !ok {
+			return nil
+		}
+		return []string{server}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package handler2
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staleDeviceBatchSize is how many stale devices are removed in each transaction.
+const staleDeviceBatchSize = 500
+
+// StaleDeviceCleanup configures removing devices which have not been polled for a long time,
+// along with their tokens, to-device messages, device data and connections. Without this,
+// devices of users who stopped using the proxy are stored forever.
+type StaleDeviceCleanup struct {
+	// TTL is how long a device can go without a successful poll, and without its tokens being
+	// used, before it is removed. Disabled if 0.
+	TTL time.Duration
+	// DryRun logs and counts stale devices without removing them.
+	DryRun bool
+}
+
+// SetStaleDeviceCleanup configures the stale device cleanup, which runs hourly once pollers
+// have started. Must be called before StartV2Pollers.
+func (h *Handler) SetStaleDeviceCleanup(cfg StaleDeviceCleanup) {
+	h.staleDeviceCleanup = cfg
+}
+
+func (h *Handler) startStaleDeviceTicker() {
+	if h.staleDeviceTicker != nil || h.staleDeviceCleanup.TTL == 0 {
+		return
+	}
+	h.staleDeviceTicker = time.NewTicker(time.Hour)
+	go func() {
+		for range h.staleDeviceTicker.C {
+			h.RemoveStaleDevices()
+		}
+	}()
+}
+
+// RemoveStaleDevices removes every device which has not been polled within the TTL, or only
+// counts them in dry run mode. Devices with a running poller are never removed. Returns the
+// number of stale devices. This function does not normally need to be called manually
+// (StartV2Pollers queues it up to run hourly); we expose it publicly only for testing purposes.
+func (h *Handler) RemoveStaleDevices() int {
+	cfg := h.staleDeviceCleanup
+	if cfg.TTL == 0 {
+		return 0
+	}
+	cutoff := time.Now().Add(-cfg.TTL)
+	numStale := 0
+	var after sync2.Device
+	for {
+		devices, err := h.v2Store.DevicesTable.FindStaleDevices(cutoff, after, staleDeviceBatchSize)
+		if err != nil {
+			logger.Err(err).Msg("failed to find stale devices")
+			sentry.CaptureException(err)
+			break
+		}
+		if len(devices) == 0 {
+			break
+		}
+		after = devices[len(devices)-1]
+		devices = h.withoutActivePollers(devices)
+		if cfg.DryRun {
+			for _, d := range devices {
+				logger.Info().Str("user", d.UserID).Str("device", d.DeviceID).Msg("dry run: would remove stale device")
+			}
+			numStale += len(devices)
+			continue
+		}
+		removed, err := h.removeStaleDevices(devices, cutoff)
+		if err != nil {
+			logger.Err(err).Int("devices", len(devices)).Msg("failed to remove stale devices")
+			sentry.CaptureException(err)
+			break
+		}
+		numStale += len(removed)
+		if h.staleDevicesRemoved != nil {
+			h.staleDevicesRemoved.Add(float64(len(removed)))
+		}
+		// close any connections for these devices, as if their tokens had expired
+		for _, d := range removed {
+			h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
+				UserID:   d.UserID,
+				DeviceID: d.DeviceID,
+			})
+		}
+	}
+	if h.staleDevices != nil {
+		h.staleDevices.Set(float64(numStale))
+	}
+	if numStale > 0 {
+		logger.Info().Int("devices", numStale).Bool("dry_run", cfg.DryRun).Dur("ttl", cfg.TTL).Msg("stale device cleanup")
+	}
+	return numStale
+}
+
+// withoutActivePollers filters out devices which are being polled, as they must not be removed
+// even if their since token hasn't been stored recently.
+func (h *Handler) withoutActivePollers(devices []sync2.Device) []sync2.Device {
+	polled := make(map[string]map[string]bool)
+	result := devices[:0:0]
+	for _, d := range devices {
+		if _, ok := polled[d.UserID]; !ok {
+			polled[d.UserID] = make(map[string]bool)
+			for _, deviceID := range h.pMap.DeviceIDs(d.UserID) {
+				polled[d.UserID][deviceID] = true
+			}
+		}
+		if !polled[d.UserID][d.DeviceID] {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func (h *Handler) removeStaleDevices(devices []sync2.Device, cutoff time.Time) (removed []sync2.Device, err error) {
+	err = sqlutil.WithTransaction(h.v2Store.DB, func(txn *sqlx.Tx) error {
+		removed, err = h.v2Store.DevicesTable.DeleteStaleDevices(txn, devices, cutoff)
+		if err != nil || len(removed) == 0 {
+			return err
+		}
+		userIDs := make([]string, len(removed))
+		deviceIDs := make([]string, len(removed))
+		for i := range removed {
+			userIDs[i] = removed[i].UserID
+			deviceIDs[i] = removed[i].DeviceID
+		}
+		return h.Store.RemoveDevices(txn, userIDs, deviceIDs)
+	})
+	return
+}
+
+func (h *Handler) addStaleDeviceMetrics() {
+	h.staleDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "stale_devices",
+		Help:      "Number of stale devices found by the last stale device cleanup, including in dry run mode.",
+	})
+	prometheus.MustRegister(h.staleDevices)
+	h.staleDevicesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "stale_devices_removed_total",
+		Help:      "Number of stale devices removed by the stale device cleanup.",
+	})
+	prometheus.MustRegister(h.staleDevicesRemoved)
+}
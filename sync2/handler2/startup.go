@@ -0,0 +1,170 @@
+package handler2
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultStartupConcurrency is how many pollers StartV2Pollers starts at once, unless changed
+// with SetPollerStartup.
+const DefaultStartupConcurrency = 16
+
+// startupLogInterval is how many pollers are started between progress logs.
+const startupLogInterval = 1000
+
+// PollerStartup configures how StartV2Pollers starts a poller for every stored device. Too many
+// at once floods the homeserver with sync requests; too few and it takes ages for every device
+// to be polled again.
+type PollerStartup struct {
+	// Concurrency is how many pollers do their first poll at once. If 0, uses
+	// DefaultStartupConcurrency.
+	Concurrency int
+	// Jitter is the longest each poller waits, picked at random, before its first poll, to spread
+	// the requests out. Disabled if 0.
+	Jitter time.Duration
+}
+
+// StartupProgress is how far StartV2Pollers has got.
+type StartupProgress struct {
+	// Total is the number of devices with a token, or 0 if StartV2Pollers hasn't started.
+	Total int `json:"total"`
+	// Synced is the number of pollers which have completed their first poll.
+	Synced int `json:"synced"`
+	// Failed is the number of devices whose poller could not be started, including those whose
+	// token could not be decrypted.
+	Failed int `json:"failed"`
+	// Done is true once every device has been tried.
+	Done bool `json:"done"`
+}
+
+// startupProgress counts the pollers started by StartV2Pollers.
+type startupProgress struct {
+	total  atomic.Int64
+	synced atomic.Int64
+	failed atomic.Int64
+	done   atomic.Bool
+}
+
+// SetPollerStartup configures how pollers are started. Must be called before StartV2Pollers.
+func (h *Handler) SetPollerStartup(cfg PollerStartup) {
+	h.pollerStartup = cfg
+}
+
+// StartupProgress returns how many of the stored devices have been polled since startup.
+func (h *Handler) StartupProgress() StartupProgress {
+	return StartupProgress{
+		Total:  int(h.startup.total.Load()),
+		Synced: int(h.startup.synced.Load()),
+		Failed: int(h.startup.failed.Load()),
+		Done:   h.startup.done.Load(),
+	}
+}
+
+// StartV2Pollers starts a poller for every device with a stored token, a few at a time, then
+// starts the periodic jobs which need pollers to be running. Blocks until every poller has done
+// its first poll.
+func (h *Handler) StartV2Pollers() {
+	tokens, err := h.v2Store.TokensTable.TokenForEachDevice(nil)
+	if err != nil {
+		logger.Err(err).Msg("StartV2Pollers: failed to query tokens")
+		sentry.CaptureException(err)
+		return
+	}
+	numWorkers := h.pollerStartup.Concurrency
+	if numWorkers <= 0 {
+		numWorkers = DefaultStartupConcurrency
+	}
+	h.startup.total.Store(int64(len(tokens)))
+	h.updateStartupMetrics()
+	numFails := 0
+	ch := make(chan sync2.TokenForPoller, len(tokens))
+	for _, t := range tokens {
+		// if we fail to decrypt the access token, skip it.
+		if t.AccessToken == "" {
+			numFails++
+			continue
+		}
+		ch <- t
+	}
+	close(ch)
+	h.startup.failed.Add(int64(numFails))
+	logger.Info().Int("num_devices", len(tokens)).Int("num_fail_decrypt", numFails).Int("concurrency", numWorkers).
+		Dur("jitter", h.pollerStartup.Jitter).Msg("StartV2Pollers")
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				h.startPoller(t)
+			}
+		}()
+	}
+	wg.Wait()
+	h.startup.done.Store(true)
+	h.updateStartupMetrics()
+	progress := h.StartupProgress()
+	logger.Info().Int("synced", progress.Synced).Int("failed", progress.Failed).Msg("StartV2Pollers finished")
+	h.startPollerExpiryTicker()
+	h.startUnreadReconcileTicker()
+	h.startStaleDeviceTicker()
+}
+
+// startPoller starts polling for one device at startup, waiting for its first poll.
+func (h *Handler) startPoller(t sync2.TokenForPoller) {
+	if h.pollerStartup.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(h.pollerStartup.Jitter))))
+	}
+	pid := sync2.PollerID{
+		UserID:   t.UserID,
+		DeviceID: t.DeviceID,
+	}
+	_, err := h.pMap.EnsurePolling(
+		pid, t.AccessToken, t.Since, true,
+		logger.With().Str("user_id", t.UserID).Str("device_id", t.DeviceID).Logger(),
+	)
+	if err != nil {
+		logger.Err(err).Str("user_id", t.UserID).Str("device_id", t.DeviceID).Msg("Failed to start poller")
+		h.startup.failed.Add(1)
+	} else {
+		h.startup.synced.Add(1)
+		h.updateMetrics()
+	}
+	h.updateStartupMetrics()
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
+		UserID:   t.UserID,
+		DeviceID: t.DeviceID,
+		Success:  err == nil,
+	})
+	if progress := h.StartupProgress(); (progress.Synced+progress.Failed)%startupLogInterval == 0 {
+		logger.Info().Int("total", progress.Total).Int("synced", progress.Synced).Int("failed", progress.Failed).
+			Msg("StartV2Pollers progress")
+	}
+}
+
+func (h *Handler) addStartupMetrics() {
+	h.startupPollers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "startup_pollers",
+		Help:      "Number of stored devices by whether their poller has done its first poll since startup.",
+	}, []string{"status"})
+	prometheus.MustRegister(h.startupPollers)
+}
+
+func (h *Handler) updateStartupMetrics() {
+	if h.startupPollers == nil {
+		return
+	}
+	progress := h.StartupProgress()
+	h.startupPollers.WithLabelValues("pending").Set(float64(progress.Total - progress.Synced - progress.Failed))
+	h.startupPollers.WithLabelValues("synced").Set(float64(progress.Synced))
+	h.startupPollers.WithLabelValues("failed").Set(float64(progress.Failed))
+}
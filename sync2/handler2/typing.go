@@ -0,0 +1,81 @@
+package handler2
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+// typingThrottle tracks a room whose typing notifications are being throttled.
+type typingThrottle struct {
+	timer *time.Timer
+	// pending is the latest typing event seen since the last one was sent, or nil
+	pending json.RawMessage
+}
+
+// SetTypingDebounce limits how often typing notifications are sent on for each room, so busy rooms
+// where users start and stop typing rapidly don't wake every connection in them each time. The
+// first change in a room is sent immediately, then changes within the window are coalesced into
+// the latest one, which is sent when the window ends. If window is 0, every change is sent
+// immediately. Must be called before polling starts.
+func (h *Handler) SetTypingDebounce(window time.Duration) {
+	h.typingDebounce = window
+}
+
+// notifyTyping sends the typing event on, subject to the typing debounce window. Must hold typingMu.
+func (h *Handler) notifyTyping(roomID string, ephEvent json.RawMessage) {
+	if h.typingDebounce <= 0 {
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Typing{
+			RoomID:         roomID,
+			EphemeralEvent: ephEvent,
+		})
+		return
+	}
+	if throttle, ok := h.typingThrottles[roomID]; ok {
+		// sent recently, so wait for the window to end
+		throttle.pending = ephEvent
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Typing{
+		RoomID:         roomID,
+		EphemeralEvent: ephEvent,
+	})
+	h.typingThrottles[roomID] = &typingThrottle{
+		timer: time.AfterFunc(h.typingDebounce, func() {
+			h.flushTyping(roomID)
+		}),
+	}
+}
+
+// flushTyping sends the latest typing event for a room at the end of its debounce window, and
+// starts another window if one was sent.
+func (h *Handler) flushTyping(roomID string) {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	throttle, ok := h.typingThrottles[roomID]
+	if !ok {
+		return
+	}
+	if throttle.pending == nil {
+		// nothing changed in the window, so the next change can be sent straight away
+		delete(h.typingThrottles, roomID)
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Typing{
+		RoomID:         roomID,
+		EphemeralEvent: throttle.pending,
+	})
+	throttle.pending = nil
+	throttle.timer.Reset(h.typingDebounce)
+}
+
+// stopTypingThrottles stops every debounce window, dropping any pending typing events.
+func (h *Handler) stopTypingThrottles() {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	for roomID, throttle := range h.typingThrottles {
+		throttle.timer.Stop()
+		delete(h.typingThrottles, roomID)
+	}
+}
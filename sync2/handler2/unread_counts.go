@@ -0,0 +1,148 @@
+package handler2
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/tidwall/gjson"
+)
+
+// SetUnreadCounts enables calculating MSC2654 unread counts in the proxy, for homeservers which
+// don't send them. A member's count goes up for each new event which counts as unread, and is
+// recalculated from the room's timeline when their read receipt moves. Only members the proxy is
+// polling for are counted. Counts from sync v2 still replace the proxy's counts whenever they
+// arrive. Must be called before polling starts.
+func (h *Handler) SetUnreadCounts(enabled bool) {
+	h.unreadCounts = enabled
+}
+
+// pollingJoinedMembers returns the joined members of the room which the proxy is polling for.
+func (h *Handler) pollingJoinedMembers(roomID string) ([]string, error) {
+	joins, _, _, err := h.Store.FetchMemberships(roomID)
+	if err != nil {
+		return nil, err
+	}
+	polling := joins[:0]
+	for _, userID := range joins {
+		if len(h.pMap.DeviceIDs(userID)) > 0 {
+			polling = append(polling, userID)
+		}
+	}
+	return polling, nil
+}
+
+// countUnread updates the unread counts of the room's joined members for these new events.
+func (h *Handler) countUnread(ctx context.Context, roomID string, eventNIDs []int64) {
+	ctx, span := internal.StartSpan(ctx, "countUnread")
+	defer span.End()
+	members, err := h.pollingJoinedMembers(roomID)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("countUnread: failed to fetch memberships")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(members) == 0 {
+		return
+	}
+	events, err := h.Store.EventNIDs(eventNIDs)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Msg("countUnread: failed to load events")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	type unreadDelta struct {
+		unread int
+		// reset is true if the user sent one of the events, which marks the room as read up to it
+		reset bool
+	}
+	deltas := make(map[string]unreadDelta, len(members))
+	for _, ev := range events {
+		evJSON := gjson.ParseBytes(ev)
+		sender := evJSON.Get("sender").Str
+		countsAsUnread := internal.CountsAsUnread(evJSON)
+		for _, userID := range members {
+			if sender == userID {
+				deltas[userID] = unreadDelta{reset: true}
+				continue
+			}
+			if countsAsUnread {
+				delta := deltas[userID]
+				delta.unread++
+				deltas[userID] = delta
+			}
+		}
+	}
+
+	h.unreadMu.Lock()
+	defer h.unreadMu.Unlock()
+	for userID, delta := range deltas {
+		if delta.unread == 0 && !delta.reset {
+			continue
+		}
+		uc, err := h.Store.UnreadTable.SelectUnreadCount(userID, roomID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("countUnread: failed to select unread count")
+			continue
+		}
+		newUC := uc + delta.unread
+		if delta.reset {
+			newUC = delta.unread
+		}
+		h.setUnreadCount(ctx, userID, roomID, uc, newUC)
+	}
+}
+
+// recountUnread recalculates the unread counts of the users whose read receipts moved.
+func (h *Handler) recountUnread(ctx context.Context, roomID string, receipts []internal.Receipt) {
+	userIDs := make(map[string]struct{})
+	for _, r := range receipts {
+		if r.ThreadID != "" && r.ThreadID != "main" {
+			continue
+		}
+		if len(h.pMap.DeviceIDs(r.UserID)) == 0 {
+			continue
+		}
+		userIDs[r.UserID] = struct{}{}
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+	h.unreadMu.Lock()
+	defer h.unreadMu.Unlock()
+	for userID := range userIDs {
+		uc, err := h.Store.UnreadTable.SelectUnreadCount(userID, roomID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("recountUnread: failed to select unread count")
+			continue
+		}
+		newUC, err := h.Store.CountUnread(userID, roomID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("recountUnread: failed to count unread events")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		h.setUnreadCount(ctx, userID, roomID, uc, newUC)
+	}
+}
+
+// setUnreadCount stores the user's new unread count and sends it to the user caches, if it has
+// changed. Must hold unreadMu.
+func (h *Handler) setUnreadCount(ctx context.Context, userID, roomID string, oldCount, newCount int) {
+	if oldCount == newCount {
+		return
+	}
+	if err := h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, nil, nil, &newCount); err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread count")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	// the stored count no longer matches the homeserver's last count, so its next counts must be
+	// written even if they are the same as its last ones
+	delete(h.unreadMap, roomID+userID)
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
+		RoomID:      roomID,
+		UserID:      userID,
+		UnreadCount: &newCount,
+	})
+}
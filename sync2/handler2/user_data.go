@@ -0,0 +1,85 @@
+package handler2
+
+import (
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// ExportUser returns every row the proxy stores about a user, by table name, for data export
+// requests.
+func (h *Handler) ExportUser(userID string) (map[string][]json.RawMessage, error) {
+	export, err := h.Store.ExportUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	v2Export, err := h.v2Store.ExportUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for table, rows := range v2Export {
+		export[table] = rows
+	}
+	return export, nil
+}
+
+// EraseUser stops all of the user's pollers and deletes every row the proxy stores about the
+// user, which ExportUser would return. The user's connections are closed as if their tokens had
+// expired. Returns the number of devices which were erased.
+//
+// A request made with one of the user's access tokens after this stores the token again, as if
+// the user had logged in for the first time.
+func (h *Handler) EraseUser(userID string) (int, error) {
+	devices, err := h.v2Store.DevicesTable.DevicesForUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	deviceIDs := make(map[string]struct{}, len(devices))
+	for _, d := range devices {
+		deviceIDs[d.DeviceID] = struct{}{}
+	}
+	for _, p := range h.pMap.PollerStatuses(userID) {
+		deviceIDs[p.DeviceID] = struct{}{}
+	}
+	// stop the pollers first so they don't store anything more about the user
+	pids := make([]sync2.PollerID, 0, len(deviceIDs))
+	for deviceID := range deviceIDs {
+		pids = append(pids, sync2.PollerID{UserID: userID, DeviceID: deviceID})
+	}
+	h.pMap.ExpirePollers(pids)
+
+	err = sqlutil.WithTransaction(h.v2Store.DB, func(txn *sqlx.Tx) error {
+		if err := h.v2Store.EraseUser(txn, userID); err != nil {
+			return err
+		}
+		return h.Store.EraseUser(txn, userID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for deviceID := range deviceIDs {
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
+			UserID:   userID,
+			DeviceID: deviceID,
+		})
+	}
+	return len(deviceIDs), nil
+}
+
+// ForgetRoom hides a room from a user who has left it: their notification counts, private receipts
+// and invite for the room are deleted, and the room is not shown to them again until they rejoin
+// or are invited again. Homeservers do not tell the proxy when users forget rooms, so this is
+// called by the admin API.
+func (h *Handler) ForgetRoom(userID, roomID string) error {
+	if err := h.Store.ForgetRoom(userID, roomID); err != nil {
+		return err
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ForgetRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"runtime/debug"
 	"sync"
 	"sync/atomic"
@@ -25,6 +26,9 @@ type PollerID struct {
 	DeviceID string
 }
 
+// how long pollers wait before checking the circuit breaker again, when it is open
+var breakerPauseInterval = time.Second
+
 // alias time.Sleep/time.Since so tests can monkey patch it out
 var timeSleep = time.Sleep
 var timeSince = time.Since
@@ -47,11 +51,17 @@ type V2DataReceiver interface {
 	SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
 	// Sent when there is a new receipt
 	OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	// Sent when there are presence events in the v2 response. Like typing and receipts, presence
+	// is ephemeral so cannot stop the since token advancing.
+	OnPresence(ctx context.Context, userID string, events []json.RawMessage)
 	// AddToDeviceMessages adds this chunk of to_device messages. Preserve the ordering.
 	// Return an error to stop the since token advancing.
 	AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
 	// UpdateUnreadCounts sets the highlight_count and notification_count for this user in this room.
 	UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount, unreadCount *int)
+	// UpdateThreadUnreadCounts replaces the per-thread counts for this user in this room. Threads
+	// missing from the map have no unread notifications.
+	UpdateThreadUnreadCounts(ctx context.Context, roomID, userID string, threads map[string]internal.ThreadUnreadCounts)
 	// Set the latest account data for this user.
 	// Return an error to stop the since token advancing.
 	OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) error // ping update with types? Can you race when re-querying?
@@ -65,8 +75,13 @@ type V2DataReceiver interface {
 	OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	// Sent when the poll loop terminates
 	OnTerminated(ctx context.Context, pollerID PollerID)
-	// Sent when the token gets a 401 response
+	// Sent when the token gets a 401 or 403 response, or fails too many times
 	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the token is rejected with M_UNKNOWN_TOKEN. If softLogout is set, the device can
+	// log in again with a new token, so its since token should be kept.
+	OnLoggedOut(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
+	// Sent when the circuit breaker trips or closes
+	OnUpstreamStatus(ctx context.Context, status UpstreamStatus)
 }
 
 type IPollerMap interface {
@@ -77,16 +92,58 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// TerminatePoller terminates the poller for this device without expiring its access token.
+	// Returns false if there was no running poller.
+	TerminatePoller(pid PollerID) bool
+	// PollerStatuses returns a snapshot of every poller for this user, or every user if empty, for debugging.
+	PollerStatuses(userID string) []PollerStatus
+	// RoomSummary fetches a summary of a room from the upstream, on behalf of this user.
+	RoomSummary(ctx context.Context, userID, roomID string, via []string) (*internal.RoomSummary, error)
+	// Shutdown stops every poller and stores their latest since tokens. Returns the number of
+	// since tokens stored.
+	Shutdown() int
+	// SetEphemeralWanted records whether any client of this device wants typing notifications or
+	// receipts. Only has an effect if SetEphemeralOnDemand is enabled.
+	SetEphemeralWanted(pid PollerID, wanted bool)
+}
+
+// PollerStatus is a point-in-time snapshot of a poller.
+type PollerStatus struct {
+	UserID              string `json:"user_id"`
+	DeviceID            string `json:"device_id"`
+	InitialToDeviceOnly bool   `json:"initial_to_device_only"`
+	Terminated          bool   `json:"terminated"`
+	// ExcludesEphemeral is true if the poller is filtering out typing notifications and receipts
+	// because no client of this device wants them.
+	ExcludesEphemeral bool `json:"excludes_ephemeral"`
+	// LastPollTS is the unix timestamp in milliseconds of the last successfully processed
+	// poll, or 0 if the initial sync has not completed.
+	LastPollTS int64 `json:"last_poll_ts"`
+	// ConsecutiveFailures is how many polls in a row have failed since the last successful one.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// BackoffMs is how long in milliseconds the poller is waiting before its next poll, or 0 if
+	// it is polling.
+	BackoffMs int64 `json:"backoff_ms"`
 }
 
 // PollerMap is a map of device ID to Poller
 type PollerMap struct {
-	v2Client                    Client
-	callbacks                   V2DataReceiver
-	pollerMu                    *sync.Mutex
-	Pollers                     map[PollerID]*poller
-	executor                    chan func()
+	v2Client          Client
+	callbacks         V2DataReceiver
+	quirks            Quirks
+	serverQuirks      map[string]Quirks
+	breakers          *CircuitBreakers
+	retryPolicy       RetryPolicy
+	ephemeralOnDemand bool
+	ephemeralWanted   map[PollerID]bool // guarded by pollerMu
+	pollerMu          *sync.Mutex
+	Pollers           map[PollerID]*poller
+	// executors run callbacks for rooms, with each room always using the same executor so that
+	// its callbacks are run in order.
+	executors                   []chan func()
 	executorRunning             bool
+	accumulateConcurrency       int
+	roomAccumulateHistogram     prometheus.Histogram
 	processHistogramVec         *prometheus.HistogramVec
 	timelineSizeHistogramVec    *prometheus.HistogramVec
 	gappyStateSizeVec           *prometheus.HistogramVec
@@ -120,10 +177,11 @@ type PollerMap struct {
 // NOT to-device messages,or since tokens.
 func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 	pm := &PollerMap{
-		v2Client: v2Client,
-		pollerMu: &sync.Mutex{},
-		Pollers:  make(map[PollerID]*poller),
-		executor: make(chan func(), 0),
+		v2Client:    v2Client,
+		retryPolicy: DefaultRetryPolicy,
+		pollerMu:    &sync.Mutex{},
+		Pollers:     make(map[PollerID]*poller),
+		executors:   []chan func(){make(chan func(), 0)},
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -164,6 +222,14 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Help:      "Number of sync v2 requests that have yet to return a response.",
 		})
 		prometheus.MustRegister(pm.numOutstandingSyncReqsGauge)
+		pm.roomAccumulateHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "room_accumulate_duration_secs",
+			Help:      "Time taken to accumulate the timeline of one room in a sync v2 response.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		})
+		prometheus.MustRegister(pm.roomAccumulateHistogram)
 	}
 	return pm
 }
@@ -172,6 +238,112 @@ func (h *PollerMap) SetCallbacks(callbacks V2DataReceiver) {
 	h.callbacks = callbacks
 }
 
+// SetQuirks sets the quirks of the upstream homeserver. Only applies to pollers created after
+// this call, so should be called before any polling starts.
+func (h *PollerMap) SetQuirks(quirks Quirks) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	h.quirks = quirks
+}
+
+// SetServerQuirks sets the quirks of the homeserver for users on this server name, overriding
+// SetQuirks, for when requests are routed to several homeservers with a RoutingClient. Only
+// applies to pollers created after this call, so should be called before any polling starts.
+func (h *PollerMap) SetServerQuirks(serverName string, quirks Quirks) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	if h.serverQuirks == nil {
+		h.serverQuirks = make(map[string]Quirks)
+	}
+	h.serverQuirks[serverName] = quirks
+}
+
+// quirksFor returns the quirks of this user's homeserver. Must be called with pollerMu held.
+func (h *PollerMap) quirksFor(userID string) Quirks {
+	if quirks, ok := h.serverQuirks[UserServerName(userID)]; ok {
+		return quirks
+	}
+	return h.quirks
+}
+
+// SetCircuitBreakers sets the breakers shared by all pollers, one for each homeserver. Only applies
+// to pollers created after this call, so should be called before any polling starts. Nil breakers
+// never trip.
+func (h *PollerMap) SetCircuitBreakers(breakers *CircuitBreakers) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	h.breakers = breakers
+	breakers.OnStateChange(func(status UpstreamStatus) {
+		h.OnUpstreamStatus(context.Background(), status)
+	})
+}
+
+// SetEphemeralOnDemand makes pollers filter out typing notifications and receipts unless a client
+// of their device wants them, per SetEphemeralWanted. Only applies to pollers created after this
+// call, so should be called before any polling starts.
+func (h *PollerMap) SetEphemeralOnDemand(enabled bool) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	h.ephemeralOnDemand = enabled
+}
+
+// SetEphemeralWanted records whether any client of this device wants typing notifications or
+// receipts, updating the filter of its poller from the next poll onwards. The demand is remembered
+// for pollers which have not been made yet.
+func (h *PollerMap) SetEphemeralWanted(pid PollerID, wanted bool) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	if !h.ephemeralOnDemand {
+		return
+	}
+	if wanted {
+		if h.ephemeralWanted == nil {
+			h.ephemeralWanted = make(map[PollerID]bool)
+		}
+		h.ephemeralWanted[pid] = true
+	} else {
+		delete(h.ephemeralWanted, pid)
+	}
+	if p, ok := h.Pollers[pid]; ok {
+		p.excludeEphemeral.Store(!wanted)
+	}
+}
+
+// SetAccumulateConcurrency lets pollers process up to n rooms from the same sync v2 response at once,
+// rather than one at a time. Callbacks for the same room are still run in order, whichever poller
+// they come from. Must be called before any polling starts.
+func (h *PollerMap) SetAccumulateConcurrency(n int) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	h.accumulateConcurrency = n
+	h.executors = make([]chan func(), n)
+	for i := range h.executors {
+		h.executors[i] = make(chan func(), 0)
+	}
+}
+
+// executorFor returns the executor which runs callbacks for this room, or this user for callbacks
+// which aren't about a room.
+func (h *PollerMap) executorFor(key string) chan func() {
+	if len(h.executors) == 1 {
+		return h.executors[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return h.executors[hash.Sum32()%uint32(len(h.executors))]
+}
+
+// SetRetryPolicy sets how pollers back off after failed polls. Only applies to pollers created
+// after this call, so should be called before any polling starts.
+func (h *PollerMap) SetRetryPolicy(rp RetryPolicy) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	h.retryPolicy = rp
+}
+
 // Terminate all pollers. Useful in tests.
 func (h *PollerMap) Terminate() {
 	h.pollerMu.Lock()
@@ -179,6 +351,7 @@ func (h *PollerMap) Terminate() {
 	for _, p := range h.Pollers {
 		p.Terminate()
 	}
+	h.breakers.Teardown()
 	if h.processHistogramVec != nil {
 		prometheus.Unregister(h.processHistogramVec)
 	}
@@ -194,7 +367,12 @@ func (h *PollerMap) Terminate() {
 	if h.numOutstandingSyncReqsGauge != nil {
 		prometheus.Unregister(h.numOutstandingSyncReqsGauge)
 	}
-	close(h.executor)
+	if h.roomAccumulateHistogram != nil {
+		prometheus.Unregister(h.roomAccumulateHistogram)
+	}
+	for _, executor := range h.executors {
+		close(executor)
+	}
 }
 
 func (h *PollerMap) NumPollers() (count int) {
@@ -208,6 +386,27 @@ func (h *PollerMap) NumPollers() (count int) {
 	return
 }
 
+// Shutdown stops every poller after its current poll, and stores the latest since token of each
+// poller which has not been stored yet, so that they resume from where they left off after a
+// restart rather than reprocessing up to a minute of responses. Returns the number of since tokens
+// stored.
+func (h *PollerMap) Shutdown() int {
+	h.pollerMu.Lock()
+	pollers := make([]*poller, 0, len(h.Pollers))
+	for _, p := range h.Pollers {
+		p.Terminate()
+		pollers = append(pollers, p)
+	}
+	h.pollerMu.Unlock()
+	stored := 0
+	for _, p := range pollers {
+		if p.storeUnstoredSince(context.Background()) {
+			stored++
+		}
+	}
+	return stored
+}
+
 // DeviceIDs returns the slice of all devices currently being polled for by this user.
 // The return value is brand-new and is fully owned by the caller.
 func (h *PollerMap) DeviceIDs(userID string) []string {
@@ -222,6 +421,47 @@ func (h *PollerMap) DeviceIDs(userID string) []string {
 	return devices
 }
 
+// PollerStatuses returns the status of all pollers for this user, or for every user if userID is
+// empty, including terminated pollers which have not yet been removed.
+func (h *PollerMap) PollerStatuses(userID string) []PollerStatus {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	var statuses []PollerStatus
+	for _, p := range h.Pollers {
+		if userID != "" && p.userID != userID {
+			continue
+		}
+		statuses = append(statuses, PollerStatus{
+			UserID:              p.userID,
+			DeviceID:            p.deviceID,
+			InitialToDeviceOnly: p.initialToDeviceOnly,
+			Terminated:          p.terminated.Load(),
+			ExcludesEphemeral:   p.excludeEphemeral.Load(),
+			LastPollTS:          p.lastPolled.Load(),
+			ConsecutiveFailures: int(p.failures.Load()),
+			BackoffMs:           time.Duration(p.backoff.Load()).Milliseconds(),
+		})
+	}
+	return statuses
+}
+
+// RoomSummary fetches a room summary using the access token of any of this user's pollers.
+func (h *PollerMap) RoomSummary(ctx context.Context, userID, roomID string, via []string) (*internal.RoomSummary, error) {
+	h.pollerMu.Lock()
+	var accessToken string
+	for _, p := range h.Pollers {
+		if !p.terminated.Load() && p.userID == userID {
+			accessToken = p.accessToken
+			break
+		}
+	}
+	h.pollerMu.Unlock()
+	if accessToken == "" {
+		return nil, fmt.Errorf("RoomSummary: no pollers for user %s", userID)
+	}
+	return h.v2Client.RoomSummary(ctx, accessToken, roomID, via)
+}
+
 func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	h.pollerMu.Lock()
 	numTerminated := 0
@@ -246,6 +486,19 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	return numTerminated
 }
 
+// TerminatePoller terminates the poller for this device. Unlike ExpirePollers, the access token is
+// kept so the poller can be started again.
+func (h *PollerMap) TerminatePoller(pid PollerID) bool {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[pid]
+	h.pollerMu.Unlock()
+	if !ok || p.terminated.Load() {
+		return false
+	}
+	p.Terminate()
+	return true
+}
+
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
 // Blocks until at least 1 sync is done if and only if the poller was just created.
 // This ensures that calls to the database will return data.
@@ -257,9 +510,15 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	h.pollerMu.Lock()
 	if !h.executorRunning {
 		h.executorRunning = true
-		go h.execute()
+		for _, executor := range h.executors {
+			go h.execute(executor)
+		}
 	}
 	poller, ok := h.Pollers[pid]
+	breaker := h.breakers.For(UserServerName(pid.UserID))
+	// If the upstream is down, don't make clients wait for a poll which is unlikely to succeed
+	// when we already have data for this device: serve what we have instead.
+	serveStale := v2since != "" && !breaker.Status().Available
 	// a poller exists and hasn't been terminated so we don't need to do anything
 	if ok && !poller.terminated.Load() {
 		if poller.accessToken != accessToken {
@@ -268,7 +527,9 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 		h.pollerMu.Unlock()
 		// this existing poller may not have completed the initial sync yet, so we need to make sure
 		// it has before we return.
-		poller.WaitUntilInitialSync()
+		if !serveStale {
+			poller.WaitUntilInitialSync()
+		}
 		return false, nil
 	}
 	// check if we need to wait at all: we don't need to if this user is already syncing on a different device
@@ -288,17 +549,27 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 
 	// replace the poller. If we don't need to wait, then we just want to nab to-device events initially.
 	// We don't do that on startup though as we cannot be sure that other pollers will not be using expired tokens.
-	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup)
+	// If the server can't filter out rooms, there is nothing to gain over a normal initial sync.
+	quirks := h.quirksFor(pid.UserID)
+	toDeviceOnly := !needToWait && !isStartup && !quirks.IgnoresRoomFilter && !quirks.NoInlineFilters
+	poller = newPoller(pid, accessToken, h.v2Client, h, logger, toDeviceOnly)
+	poller.quirks = quirks
+	poller.breaker = breaker
+	poller.retryPolicy = h.retryPolicy
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
 	poller.numOutstandingSyncReqs = h.numOutstandingSyncReqsGauge
 	poller.totalNumPolls = h.totalNumPollsCounter
+	poller.accumulateConcurrency = h.accumulateConcurrency
+	poller.excludeEphemeral.Store(h.ephemeralOnDemand && !h.ephemeralWanted[pid])
 	go poller.Poll(v2since)
 	h.Pollers[pid] = poller
 
 	h.pollerMu.Unlock()
-	if needToWait {
+	if needToWait && serveStale {
+		logger.Warn().Str("user", poller.userID).Msg("upstream is unavailable; not waiting for this device to do an initial sync")
+	} else if needToWait {
 		poller.WaitUntilInitialSync()
 	} else {
 		logger.Info().Str("user", poller.userID).Msg("a poller exists for this user; not waiting for this device to do an initial sync")
@@ -309,8 +580,8 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	return true, nil
 }
 
-func (h *PollerMap) execute() {
-	for fn := range h.executor {
+func (h *PollerMap) execute(executor chan func()) {
+	for fn := range executor {
 		fn()
 	}
 }
@@ -321,8 +592,12 @@ func (h *PollerMap) UpdateDeviceSince(ctx context.Context, userID, deviceID, sin
 func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
+		start := time.Now()
 		err = h.callbacks.Accumulate(ctx, userID, deviceID, roomID, timeline)
+		if h.roomAccumulateHistogram != nil {
+			h.roomAccumulateHistogram.Observe(time.Since(start).Seconds())
+		}
 		wg.Done()
 	}
 	wg.Wait()
@@ -331,7 +606,7 @@ func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID str
 func (h *PollerMap) Initialise(ctx context.Context, roomID string, state []json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		err = h.callbacks.Initialise(ctx, roomID, state)
 		wg.Done()
 	}
@@ -341,7 +616,7 @@ func (h *PollerMap) Initialise(ctx context.Context, roomID string, state []json.
 func (h *PollerMap) SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		h.callbacks.SetTyping(ctx, pollerID, roomID, ephEvent)
 		wg.Done()
 	}
@@ -350,7 +625,7 @@ func (h *PollerMap) SetTyping(ctx context.Context, pollerID PollerID, roomID str
 func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		err = h.callbacks.OnInvite(ctx, userID, roomID, inviteState)
 		wg.Done()
 	}
@@ -361,7 +636,7 @@ func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteS
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		err = h.callbacks.OnLeftRoom(ctx, userID, roomID, leaveEvent)
 		wg.Done()
 	}
@@ -383,20 +658,38 @@ func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID,
 	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
 
+func (h *PollerMap) OnLoggedOut(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	h.callbacks.OnLoggedOut(ctx, accessTokenHash, userID, deviceID, softLogout)
+}
+
+func (h *PollerMap) OnUpstreamStatus(ctx context.Context, status UpstreamStatus) {
+	h.callbacks.OnUpstreamStatus(ctx, status)
+}
+
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount, unreadCount *int) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		h.callbacks.UpdateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount, unreadCount)
 		wg.Done()
 	}
 	wg.Wait()
 }
 
+func (h *PollerMap) UpdateThreadUnreadCounts(ctx context.Context, roomID, userID string, threads map[string]internal.ThreadUnreadCounts) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executorFor(roomID) <- func() {
+		h.callbacks.UpdateThreadUnreadCounts(ctx, roomID, userID, threads)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		err = h.callbacks.OnAccountData(ctx, userID, roomID, events)
 		wg.Done()
 	}
@@ -407,13 +700,23 @@ func (h *PollerMap) OnAccountData(ctx context.Context, userID, roomID string, ev
 func (h *PollerMap) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(roomID) <- func() {
 		h.callbacks.OnReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 		wg.Done()
 	}
 	wg.Wait()
 }
 
+func (h *PollerMap) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executorFor(userID) <- func() {
+		h.callbacks.OnPresence(ctx, userID, events)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
 	// This is device-scoped data and will never race with another poller. Therefore we
 	// do not need to queue this up in the executor. However: the poller does need to
@@ -432,6 +735,13 @@ type poller struct {
 	logger      zerolog.Logger
 
 	initialToDeviceOnly bool
+	// excludeEphemeral is set when no client of this device wants typing notifications or receipts
+	excludeEphemeral *atomic.Bool
+	quirks           Quirks
+	breaker          *CircuitBreaker
+	retryPolicy      RetryPolicy
+	// the number of joined rooms in a response to process at once
+	accumulateConcurrency int
 
 	// E2EE fields: we keep them so we only send callbacks on deltas not all the time
 	fallbackKeyTypes []string
@@ -440,6 +750,16 @@ type poller struct {
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
 	wg         *sync.WaitGroup
+	// unix millis of the last successfully processed poll, read by PollerStatuses
+	lastPolled *atomic.Int64
+	// the number of polls which have failed in a row, and the duration being waited before the
+	// next poll, read by PollerStatuses
+	failures *atomic.Int64
+	backoff  *atomic.Int64
+	// sinceMu guards storing since tokens. unstoredSince is the latest since token if it has
+	// not been stored yet, for Shutdown to store.
+	sinceMu       sync.Mutex
+	unstoredSince string
 
 	// stats about poll response data, for logging purposes
 	lastLogged              time.Time
@@ -471,9 +791,14 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
+		excludeEphemeral:    &atomic.Bool{},
+		lastPolled:          &atomic.Int64{},
+		failures:            &atomic.Int64{},
+		backoff:             &atomic.Int64{},
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
+		retryPolicy:         DefaultRetryPolicy,
 	}
 }
 
@@ -506,6 +831,9 @@ func (p *poller) Poll(since string) {
 		scope.SetUser(sentry.User{Username: p.userID, ID: p.deviceID})
 	})
 	ctx := sentry.SetHubOnContext(context.Background(), hub)
+	// tag every span of this poller with its device, so slow polls can be traced per user
+	ctx = internal.SetAttributeOnContext(ctx, internal.OTLPTagUserID, p.userID)
+	ctx = internal.SetAttributeOnContext(ctx, internal.OTLPTagDeviceID, p.deviceID)
 
 	p.logger.Info().Str("since", since).Msg("Poller: v2 poll loop started")
 	defer func() {
@@ -531,6 +859,7 @@ func (p *poller) Poll(since string) {
 		ctx, task := internal.StartTask(ctx, "Poll")
 		err := p.poll(ctx, &state)
 		task.End()
+		p.failures.Store(int64(state.failCount))
 		if err != nil {
 			break
 		}
@@ -547,26 +876,37 @@ func (p *poller) Poll(since string) {
 // s (which is assumed to be non-nil). Returns a non-nil error iff the poller loop
 // should halt.
 func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
+	// Initial syncs are essential as there is no stored data to serve the client instead.
+	allowed, probe := p.breaker.Allow(s.since == "")
+	if !allowed {
+		p.backoff.Store(int64(breakerPauseInterval))
+		timeSleep(breakerPauseInterval)
+		return nil
+	}
 	if p.totalNumPolls != nil {
 		p.totalNumPolls.Inc()
 	}
 	if s.failCount > 0 {
 		if s.failCount > 1000 {
-			// 3s * 1000 = 3000s = 50 minutes
+			p.breaker.Cancel(probe)
+			// with the default policy this is hours of failures: mostly 30s waits, shortened by up to 20%
 			errMsg := "poller: access token has failed >1000 times to /sync, terminating loop"
 			p.logger.Warn().Msg(errMsg)
 			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
-		// don't backoff when doing v2 syncs because the response is only in the cache for a short
+		// the policy caps the backoff because the v2 response is only in the cache for a short
 		// period of time (on massive accounts on matrix.org) such that if you wait 2,4,8min between
 		// requests it might force the server to do the work all over again :(
-		waitTime := 3 * time.Second
+		waitTime := p.retryPolicy.Backoff(s.failCount)
 		p.logger.Warn().Str("duration", waitTime.String()).Int("fail-count", s.failCount).Msg("Poller: waiting before next poll")
+		p.backoff.Store(int64(waitTime))
 		timeSleep(waitTime)
 	}
+	p.backoff.Store(0)
 	if p.terminated.Load() {
+		p.breaker.Cancel(probe)
 		return fmt.Errorf("poller terminated")
 	}
 	start := time.Now()
@@ -574,11 +914,12 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
 	}
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly, p.excludeEphemeral.Load())
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Dec()
 	}
 	region.End()
+	p.breaker.Record(probe, err != nil && isUpstreamFailure(statusCode))
 	p.trackRequestDuration(timeSince(start), s.since == "", s.firstTime)
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
@@ -592,8 +933,14 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			return nil
 		} else {
 			errMsg := "poller: access token has been invalidated, terminating loop"
-			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			var tokenErr *UnknownTokenError
+			if errors.As(err, &tokenErr) {
+				p.logger.Warn().Bool("soft_logout", tokenErr.SoftLogout).Msg(errMsg)
+				p.receiver.OnLoggedOut(ctx, hashToken(p.accessToken), p.userID, p.deviceID, tokenErr.SoftLogout)
+			} else {
+				p.logger.Warn().Msg(errMsg)
+				p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			}
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -637,18 +984,25 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		s.failCount += 1
 		return nil
 	}
+	p.parsePresence(ctx, resp)
 
 	wasInitial := s.since == ""
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
 	// Persist the since token if it either was more than one minute ago since we
-	// last stored it OR the response contains to-device messages
-	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
-		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
+	// last stored it OR the response contains to-device messages OR we are shutting down, as
+	// Shutdown may have already stored the previous since token
+	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 || p.terminated.Load() {
+		p.storeSince(ctx, s.since)
 		s.lastStoredSince = time.Now()
+	} else {
+		p.sinceMu.Lock()
+		p.unstoredSince = s.since
+		p.sinceMu.Unlock()
 	}
 
+	p.lastPolled.Store(time.Now().UnixMilli())
 	if s.firstTime {
 		s.firstTime = false
 		p.wg.Done()
@@ -658,6 +1012,27 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	return nil
 }
 
+// storeSince stores the since token of a successful poll.
+func (p *poller) storeSince(ctx context.Context, since string) {
+	p.sinceMu.Lock()
+	defer p.sinceMu.Unlock()
+	p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, since)
+	p.unstoredSince = ""
+}
+
+// storeUnstoredSince stores the latest since token if it has not been stored yet. Returns true
+// if it was stored.
+func (p *poller) storeUnstoredSince(ctx context.Context) bool {
+	p.sinceMu.Lock()
+	defer p.sinceMu.Unlock()
+	if p.unstoredSince == "" {
+		return false
+	}
+	p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, p.unstoredSince)
+	p.unstoredSince = ""
+	return true
+}
+
 func (p *poller) trackRequestDuration(dur time.Duration, isInitial, isFirst bool) {
 	if p.pollHistogramVec == nil {
 		return
@@ -781,6 +1156,15 @@ func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse)
 	return p.receiver.OnAccountData(ctx, p.userID, AccountDataGlobalRoom, res.AccountData.Events)
 }
 
+func (p *poller) parsePresence(ctx context.Context, res *SyncResponse) {
+	if len(res.Presence.Events) == 0 {
+		return
+	}
+	ctx, task := internal.StartTask(ctx, "parsePresence")
+	defer task.End()
+	p.receiver.OnPresence(ctx, p.userID, res.Presence.Events)
+}
+
 func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) error {
 	ctx, task := internal.StartTask(ctx, "parseRoomsResponse")
 	defer task.End()
@@ -793,100 +1177,51 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 	// NOT RETRY THE SYNC REQUEST, meaning if we didn't process all the rooms we would lose data.
 	// Currently, Accumulate/Initialise can return DataErrors when a new room is seen without a
 	// create event.
-	// NOTE: we process rooms non-deterministically (ranging over keys in a map).
+	// NOTE: we process rooms non-deterministically (ranging over keys in a map), and joined rooms
+	// concurrently if accumulateConcurrency > 1.
 	var lastErrs []error
-	for roomID, roomData := range res.Rooms.Join {
-		if len(roomData.State.Events) > 0 {
-			stateCalls++
-			if roomData.Timeline.Limited {
-				p.trackGappyStateSize(len(roomData.State.Events))
-			}
-			err := p.receiver.Initialise(ctx, roomID, roomData.State.Events)
-			if err != nil {
-				_, ok := err.(*internal.DataError)
-				if ok {
-					// This typically happens when we are missing an m.room.create event.
-					// Synapse may sometimes send the m.room.create event erroneously in the timeline,
-					// so check if that is the case here. See https://github.com/matrix-org/complement/pull/690
-					var createEvent json.RawMessage
-					for i, ev := range roomData.Timeline.Events {
-						evv := gjson.ParseBytes(ev)
-						if evv.Get("type").Str == "m.room.create" && evv.Get("state_key").Exists() && evv.Get("state_key").Str == "" {
-							createEvent = roomData.Timeline.Events[i]
-							// remove the create event from the timeline so we don't double process it
-							roomData.Timeline.Events = append(roomData.Timeline.Events[:i], roomData.Timeline.Events[i+1:]...)
-							break
-						}
-					}
-					if createEvent != nil {
-						roomData.State.Events = slices.Insert(roomData.State.Events, 0, createEvent)
-						// retry the processing of the room state
-						err = p.receiver.Initialise(ctx, roomID, roomData.State.Events)
-						if err == nil {
-							const warnMsg = "parseRoomsResponse: m.room.create event was found in the timeline not state, info after moving create event"
-							logger.Warn().Str("user_id", p.userID).Str("room_id", roomID).Int(
-								"timeline", len(roomData.Timeline.Events),
-							).Int("state", len(roomData.State.Events)).Msg(warnMsg)
-							hub := internal.GetSentryHubFromContextOrDefault(ctx)
-							hub.WithScope(func(scope *sentry.Scope) {
-								scope.SetContext(internal.SentryCtxKey, map[string]interface{}{
-									"room_id":  roomID,
-									"timeline": len(roomData.Timeline.Events),
-									"state":    len(roomData.State.Events),
-								})
-								hub.CaptureMessage(warnMsg)
-							})
-						}
-					}
-				}
-				// either err isn't a data error OR we retried Initialise and it still returned an error
-				// either way, give up.
-				if err != nil {
-					lastErrs = append(lastErrs, fmt.Errorf("Initialise[%s]: %w", roomID, err))
-					continue
-				}
-			}
-		}
-		// process typing/receipts before events so we seed the caches correctly for when we return the room
-		for _, ephEvent := range roomData.Ephemeral.Events {
-			ephEventType := gjson.GetBytes(ephEvent, "type").Str
-			switch ephEventType {
-			case "m.typing":
-				typingCalls++
-				p.receiver.SetTyping(ctx, PollerID{UserID: p.userID, DeviceID: p.deviceID}, roomID, ephEvent)
-			case "m.receipt":
-				receiptCalls++
-				p.receiver.OnReceipt(ctx, p.userID, roomID, ephEventType, ephEvent)
-			}
-		}
-
-		// process account data
-		if len(roomData.AccountData.Events) > 0 {
-			err := p.receiver.OnAccountData(ctx, p.userID, roomID, roomData.AccountData.Events)
-			if err != nil {
-				lastErrs = append(lastErrs, fmt.Errorf("OnAccountData[%s]: %w", roomID, err))
-				continue
-			}
-		}
-		if len(roomData.Timeline.Events) > 0 {
-			timelineCalls++
-			p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
-
-			err := p.receiver.Accumulate(ctx, p.userID, p.deviceID, roomID, roomData.Timeline)
-			if err != nil {
-				lastErrs = append(lastErrs, fmt.Errorf("Accumulate[%s]: %w", roomID, err))
-				continue
-			}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var panicked interface{}
+	record := func(stats joinedRoomStats, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		stateCalls += stats.state
+		timelineCalls += stats.timeline
+		typingCalls += stats.typing
+		receiptCalls += stats.receipts
+		if err != nil {
+			lastErrs = append(lastErrs, err)
 		}
-
-		// process unread counts AFTER events so global caches have been updated by the time this metadata is added.
-		// Previously we did this BEFORE events so we atomically showed the event and the unread count in one go, but
-		// this could cause clients to de-sync: see TestUnreadCountMisordering integration test.
-		if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil || roomData.UnreadCount != nil {
-			p.receiver.UpdateUnreadCounts(ctx, roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount, roomData.UnreadCount)
+	}
+	concurrency := make(chan struct{}, p.accumulateConcurrency)
+	for roomID, roomData := range res.Rooms.Join {
+		if p.accumulateConcurrency <= 1 {
+			record(p.parseJoinedRoom(ctx, roomID, roomData))
+			continue
 		}
+		concurrency <- struct{}{}
+		wg.Add(1)
+		go func(roomID string, roomData SyncV2JoinResponse) {
+			defer func() {
+				// re-panic on the poller's goroutine, which recovers from panics
+				if r := recover(); r != nil {
+					mu.Lock()
+					panicked = r
+					mu.Unlock()
+				}
+				<-concurrency
+				wg.Done()
+			}()
+			record(p.parseJoinedRoom(ctx, roomID, roomData))
+		}(roomID, roomData)
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
 	}
 	for roomID, roomData := range res.Rooms.Leave {
+		p.quirks.applyToLeave(&roomData)
 		if len(roomData.Timeline.Events) > 0 {
 			p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
 			err := p.receiver.Accumulate(ctx, p.userID, p.deviceID, roomID, roomData.Timeline)
@@ -914,6 +1249,7 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 		}
 	}
 	for roomID, roomData := range res.Rooms.Invite {
+		p.quirks.applyToInvite(&roomData)
 		err := p.receiver.OnInvite(ctx, p.userID, roomID, roomData.InviteState.Events)
 		if err != nil {
 			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
@@ -954,6 +1290,122 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 	return errors.Join(lastErrs...)
 }
 
+// joinedRoomStats counts the callbacks made for a joined room, for logging purposes.
+type joinedRoomStats struct {
+	state    int
+	timeline int
+	typing   int
+	receipts int
+}
+
+// parseJoinedRoom processes one joined room in a sync v2 response. Its callbacks are made in order,
+// but may run concurrently with those of other rooms.
+func (p *poller) parseJoinedRoom(ctx context.Context, roomID string, roomData SyncV2JoinResponse) (stats joinedRoomStats, err error) {
+	p.quirks.applyTo(&roomData)
+	if len(roomData.State.Events) > 0 {
+		stats.state++
+		if roomData.Timeline.Limited {
+			p.trackGappyStateSize(len(roomData.State.Events))
+		}
+		err := p.receiver.Initialise(ctx, roomID, roomData.State.Events)
+		if err != nil {
+			_, ok := err.(*internal.DataError)
+			if ok {
+				// This typically happens when we are missing an m.room.create event.
+				// Synapse may sometimes send the m.room.create event erroneously in the timeline,
+				// so check if that is the case here. See https://github.com/matrix-org/complement/pull/690
+				var createEvent json.RawMessage
+				for i, ev := range roomData.Timeline.Events {
+					evv := gjson.ParseBytes(ev)
+					if evv.Get("type").Str == "m.room.create" && evv.Get("state_key").Exists() && evv.Get("state_key").Str == "" {
+						createEvent = roomData.Timeline.Events[i]
+						// remove the create event from the timeline so we don't double process it
+						roomData.Timeline.Events = append(roomData.Timeline.Events[:i], roomData.Timeline.Events[i+1:]...)
+						break
+					}
+				}
+				if createEvent != nil {
+					roomData.State.Events = slices.Insert(roomData.State.Events, 0, createEvent)
+					// retry the processing of the room state
+					err = p.receiver.Initialise(ctx, roomID, roomData.State.Events)
+					if err == nil {
+						const warnMsg = "parseRoomsResponse: m.room.create event was found in the timeline not state, info after moving create event"
+						logger.Warn().Str("user_id", p.userID).Str("room_id", roomID).Int(
+							"timeline", len(roomData.Timeline.Events),
+						).Int("state", len(roomData.State.Events)).Msg(warnMsg)
+						hub := internal.GetSentryHubFromContextOrDefault(ctx)
+						hub.WithScope(func(scope *sentry.Scope) {
+							scope.SetContext(internal.SentryCtxKey, map[string]interface{}{
+								"room_id":  roomID,
+								"timeline": len(roomData.Timeline.Events),
+								"state":    len(roomData.State.Events),
+							})
+							hub.CaptureMessage(warnMsg)
+						})
+					}
+				}
+			}
+			// either err isn't a data error OR we retried Initialise and it still returned an error
+			// either way, give up.
+			if err != nil {
+				return stats, fmt.Errorf("Initialise[%s]: %w", roomID, err)
+			}
+		}
+	}
+	// process typing/receipts before events so we seed the caches correctly for when we return the room
+	for _, ephEvent := range roomData.Ephemeral.Events {
+		ephEventType := gjson.GetBytes(ephEvent, "type").Str
+		switch ephEventType {
+		case "m.typing":
+			stats.typing++
+			p.receiver.SetTyping(ctx, PollerID{UserID: p.userID, DeviceID: p.deviceID}, roomID, ephEvent)
+		case "m.receipt":
+			stats.receipts++
+			p.receiver.OnReceipt(ctx, p.userID, roomID, ephEventType, ephEvent)
+		}
+	}
+
+	// process account data
+	if len(roomData.AccountData.Events) > 0 {
+		err := p.receiver.OnAccountData(ctx, p.userID, roomID, roomData.AccountData.Events)
+		if err != nil {
+			return stats, fmt.Errorf("OnAccountData[%s]: %w", roomID, err)
+		}
+	}
+	if len(roomData.Timeline.Events) > 0 {
+		stats.timeline++
+		p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
+
+		err := p.receiver.Accumulate(ctx, p.userID, p.deviceID, roomID, roomData.Timeline)
+		if err != nil {
+			return stats, fmt.Errorf("Accumulate[%s]: %w", roomID, err)
+		}
+	}
+
+	// process unread counts AFTER events so global caches have been updated by the time this metadata is added.
+	// Previously we did this BEFORE events so we atomically showed the event and the unread count in one go, but
+	// this could cause clients to de-sync: see TestUnreadCountMisordering integration test.
+	if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil || roomData.UnreadCount != nil {
+		p.receiver.UpdateUnreadCounts(ctx, roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount, roomData.UnreadCount)
+	}
+	if roomData.UnreadThreadNotifications != nil {
+		threads := make(map[string]internal.ThreadUnreadCounts, len(roomData.UnreadThreadNotifications))
+		for threadID, counts := range roomData.UnreadThreadNotifications {
+			var tc internal.ThreadUnreadCounts
+			if counts.HighlightCount != nil {
+				tc.HighlightCount = *counts.HighlightCount
+			}
+			if counts.NotificationCount != nil {
+				tc.NotificationCount = *counts.NotificationCount
+			}
+			threads[threadID] = tc
+		}
+		p.receiver.UpdateThreadUnreadCounts(ctx, roomID, p.userID, threads)
+	}
+
+	return stats, nil
+}
+
 func (p *poller) maybeLogStats(force bool) {
 	if !force && timeSince(p.lastLogged) < logInterval {
 		// only log at most once every logInterval
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"testing"
@@ -338,6 +340,109 @@ func TestPollerMap_ExpirePollers(t *testing.T) {
 	}
 }
 
+func TestPollerMap_PollerStatuses(t *testing.T) {
+	receiver, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return &SyncResponse{NextBatch: "batchy-mc-batchface"}, 200, nil
+	})
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+
+	if statuses := pm.PollerStatuses("alice"); len(statuses) != 0 {
+		t.Fatalf("PollerStatuses: got %+v want none", statuses)
+	}
+	// the first device waits for the initial sync, the second device only fetches to-device
+	// messages initially as alice is already being polled for.
+	for _, pid := range []PollerID{{"alice", "a_device1"}, {"alice", "a_device2"}, {"bob", "b_device"}} {
+		if _, err := pm.EnsurePolling(pid, pid.DeviceID+"_token", "", false, logger); err != nil {
+			t.Fatalf("EnsurePolling(%v): %s", pid, err)
+		}
+	}
+	pm.ExpirePollers([]PollerID{{"alice", "a_device2"}})
+
+	statuses := pm.PollerStatuses("alice")
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DeviceID < statuses[j].DeviceID
+	})
+	if len(statuses) != 2 {
+		t.Fatalf("PollerStatuses: got %+v want 2 statuses", statuses)
+	}
+	if statuses[0].DeviceID != "a_device1" || statuses[0].Terminated || statuses[0].InitialToDeviceOnly {
+		t.Errorf("PollerStatuses: got %+v for first device", statuses[0])
+	}
+	if statuses[0].LastPollTS == 0 {
+		t.Errorf("PollerStatuses: first device has done an initial sync but LastPollTS is 0")
+	}
+	if statuses[1].DeviceID != "a_device2" || !statuses[1].Terminated || !statuses[1].InitialToDeviceOnly {
+		t.Errorf("PollerStatuses: got %+v for second device", statuses[1])
+	}
+}
+
+// Check that Shutdown stops pollers and stores since tokens which were not stored yet.
+func TestPollerMapShutdown(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	longPolling := make(chan struct{})
+	unblock := make(chan struct{})
+	receiver, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		switch since {
+		case "":
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case "1":
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		default:
+			close(longPolling)
+			<-unblock
+			return &SyncResponse{NextBatch: "3"}, 200, nil
+		}
+	})
+	receiver.updateSinceCalled = make(chan struct{}, 10)
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+	if _, err := pm.EnsurePolling(pid, "token", "", false, logger); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	select {
+	case <-longPolling:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not poll with the second since token")
+	}
+	sinceFor := func() string {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return receiver.pollerIDToSince[pid]
+	}
+	// the first since token is stored straight away, the second only after a minute
+	if got := sinceFor(); got != "1" {
+		t.Fatalf("stored since token: got %s want 1", got)
+	}
+
+	if stored := pm.Shutdown(); stored != 1 {
+		t.Errorf("Shutdown: stored %d since tokens, want 1", stored)
+	}
+	if got := sinceFor(); got != "2" {
+		t.Errorf("Shutdown: stored since token: got %s want 2", got)
+	}
+	if pm.NumPollers() != 0 {
+		t.Errorf("Shutdown: pollers were not terminated")
+	}
+	if stored := pm.Shutdown(); stored != 0 {
+		t.Errorf("Shutdown again: stored %d since tokens, want 0", stored)
+	}
+
+	// a poll which finishes after shutting down is discarded, so the stored since token is still right
+	for len(receiver.updateSinceCalled) > 0 {
+		<-receiver.updateSinceCalled
+	}
+	close(unblock)
+	select {
+	case <-receiver.updateSinceCalled:
+		t.Errorf("poll after Shutdown stored a since token")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := sinceFor(); got != "2" {
+		t.Errorf("stored since token: got %s want 2", got)
+	}
+}
+
 // Check that a call to Poll starts polling and accumulating, and terminates on 401s.
 func TestPollerPollFromNothing(t *testing.T) {
 	nextSince := "next"
@@ -395,6 +500,65 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that a token rejected with M_UNKNOWN_TOKEN logs the device out, rather than expiring the
+// token, and that soft logouts are reported as such.
+func TestPollerLogsOutOnUnknownToken(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	for _, softLogout := range []bool{true, false} {
+		accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+			return nil, 401, &UnknownTokenError{SoftLogout: softLogout}
+		})
+		var loggedOut []bool
+		accumulator.overrideDataReceiver.onLoggedOut = func(ctx context.Context, accessTokenHash, userID, deviceID string, soft bool) {
+			if userID != pid.UserID || deviceID != pid.DeviceID {
+				t.Errorf("OnLoggedOut: got %s %s want %s %s", userID, deviceID, pid.UserID, pid.DeviceID)
+			}
+			loggedOut = append(loggedOut, soft)
+		}
+		accumulator.overrideDataReceiver.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+			t.Errorf("OnExpiredToken called for a logged out device")
+		}
+		poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+		poller.Poll("s1")
+		if !reflect.DeepEqual(loggedOut, []bool{softLogout}) {
+			t.Errorf("OnLoggedOut: got calls %v want [%v]", loggedOut, softLogout)
+		}
+		if !poller.terminated.Load() {
+			t.Errorf("poller was not terminated")
+		}
+	}
+}
+
+// Check that presence events in the v2 response are passed to the receiver.
+func TestPollerPollPresence(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	presenceEvents := []json.RawMessage{
+		json.RawMessage(`{"type":"m.presence","sender":"@bob:localhost","content":{"presence":"online"}}`),
+	}
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since == "" {
+			resp := &SyncResponse{NextBatch: "next"}
+			resp.Presence.Events = presenceEvents
+			return resp, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	var gotUserID string
+	var gotEvents []json.RawMessage
+	accumulator.overrideDataReceiver.onPresence = func(ctx context.Context, userID string, events []json.RawMessage) {
+		gotUserID = userID
+		gotEvents = events
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.Poll("")
+	if gotUserID != pid.UserID {
+		t.Errorf("OnPresence: got user %q want %q", gotUserID, pid.UserID)
+	}
+	if len(gotEvents) != 1 || string(gotEvents[0]) != string(presenceEvents[0]) {
+		t.Errorf("OnPresence: got events %v want %v", gotEvents, presenceEvents)
+	}
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
@@ -651,17 +815,17 @@ func TestPollerBackoff(t *testing.T) {
 		{
 			code:    500,
 			err:     fmt.Errorf("internal server error"),
-			backoff: 3 * time.Second,
+			backoff: 6 * time.Second,
 		},
 		{
 			code:    502,
 			err:     fmt.Errorf("bad gateway error"),
-			backoff: 3 * time.Second,
+			backoff: 10 * time.Second,
 		},
 		{
 			code:    404,
 			err:     fmt.Errorf("not found"),
-			backoff: 3 * time.Second,
+			backoff: 10 * time.Second,
 		},
 	}
 	errorResponsesIndex := 0
@@ -686,6 +850,7 @@ func TestPollerBackoff(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	poller := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: deviceID}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.retryPolicy = RetryPolicy{InitialBackoff: 3 * time.Second, MaxBackoff: 10 * time.Second}
 	go func() {
 		defer wg.Done()
 		poller.Poll("some_since_value")
@@ -705,6 +870,45 @@ func TestPollerBackoff(t *testing.T) {
 	}
 }
 
+// Test that the poller reports its consecutive failures and backoff while it is failing, and clears
+// them once a poll succeeds.
+func TestPollerStatusFailures(t *testing.T) {
+	numPolls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numPolls++
+		switch numPolls {
+		case 1, 2:
+			return nil, 502, fmt.Errorf("bad gateway error")
+		case 3:
+			return &SyncResponse{NextBatch: "next"}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	p := newPoller(PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	var gotFailures []int64
+	setTimeSleepDelay(time.Millisecond, func(d time.Duration) {
+		if got := time.Duration(p.backoff.Load()); got != d {
+			t.Errorf("backoff while sleeping: got %v want %v", got, d)
+		}
+		gotFailures = append(gotFailures, p.failures.Load())
+	})
+	defer func() { // reset the value and the check after the test runs, as later pollers also sleep
+		setTimeSleepDelay(0, nil)
+	}()
+	p.Poll("some_since_value")
+
+	if want := []int64{1, 2}; !reflect.DeepEqual(gotFailures, want) {
+		t.Errorf("failures while backing off: got %v want %v", gotFailures, want)
+	}
+	// the 401 terminates the poller without counting as a failure to retry
+	if failures := p.failures.Load(); failures != 0 {
+		t.Errorf("failures after a successful poll: got %d want 0", failures)
+	}
+	if backoff := p.backoff.Load(); backoff != 0 {
+		t.Errorf("backoff after a successful poll: got %v want 0", time.Duration(backoff))
+	}
+}
+
 // Regression test to make sure that if you start polling with an invalid token, we do end up unblocking WaitUntilInitialSync
 // and don't end up blocking forever.
 func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
@@ -1262,15 +1466,25 @@ func waitForInitialSync(t *testing.T, poller *poller) {
 }
 
 type mockClient struct {
-	fn func(authHeader, since string) (*SyncResponse, int, error)
+	fn        func(authHeader, since string) (*SyncResponse, int, error)
+	summaryFn func(authHeader, roomID string, via []string) (*internal.RoomSummary, error)
 }
 
 func (c *mockClient) Versions(ctx context.Context) ([]string, error) {
 	return []string{"v1.1"}, nil
 }
-func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
 	return c.fn(authHeader, since)
 }
+func (c *mockClient) RoomSummary(ctx context.Context, authHeader, roomID string, via []string) (*internal.RoomSummary, error) {
+	if c.summaryFn == nil {
+		return nil, fmt.Errorf("no room summary for %s", roomID)
+	}
+	return c.summaryFn(authHeader, roomID, via)
+}
+func (c *mockClient) Messages(ctx context.Context, authHeader, roomID, from string, limit int) (*MessagesResponse, error) {
+	return nil, fmt.Errorf("no messages for %s", roomID)
+}
 func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
 	return "@alice:localhost", "device_123", nil
 }
@@ -1312,19 +1526,23 @@ func (s *mockDataReceiver) UpdateDeviceSince(ctx context.Context, userID, device
 }
 
 type overrideDataReceiver struct {
-	accumulate          func(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) error
-	initialise          func(ctx context.Context, roomID string, state []json.RawMessage) error
-	setTyping           func(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
-	updateDeviceSince   func(ctx context.Context, userID, deviceID, since string)
-	addToDeviceMessages func(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
-	updateUnreadCounts  func(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
-	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
-	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
-	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
-	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
-	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
-	onTerminated        func(ctx context.Context, pollerID PollerID)
-	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	accumulate               func(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) error
+	initialise               func(ctx context.Context, roomID string, state []json.RawMessage) error
+	setTyping                func(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
+	updateDeviceSince        func(ctx context.Context, userID, deviceID, since string)
+	addToDeviceMessages      func(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
+	updateUnreadCounts       func(ctx context.Context, roomID, userID string, highlightCount, notifCount, unreadCount *int)
+	updateThreadUnreadCounts func(ctx context.Context, roomID, userID string, threads map[string]internal.ThreadUnreadCounts)
+	onAccountData            func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
+	onReceipt                func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	onPresence               func(ctx context.Context, userID string, events []json.RawMessage)
+	onInvite                 func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
+	onLeftRoom               func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
+	onE2EEData               func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
+	onTerminated             func(ctx context.Context, pollerID PollerID)
+	onExpiredToken           func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onLoggedOut              func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
+	onUpstreamStatus         func(ctx context.Context, status UpstreamStatus)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) error {
@@ -1357,11 +1575,17 @@ func (s *overrideDataReceiver) AddToDeviceMessages(ctx context.Context, userID,
 	}
 	return s.addToDeviceMessages(ctx, userID, deviceID, msgs)
 }
-func (s *overrideDataReceiver) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+func (s *overrideDataReceiver) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount, unreadCount *int) {
 	if s.updateUnreadCounts == nil {
 		return
 	}
-	s.updateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
+	s.updateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount, unreadCount)
+}
+func (s *overrideDataReceiver) UpdateThreadUnreadCounts(ctx context.Context, roomID, userID string, threads map[string]internal.ThreadUnreadCounts) {
+	if s.updateThreadUnreadCounts == nil {
+		return
+	}
+	s.updateThreadUnreadCounts(ctx, roomID, userID, threads)
 }
 func (s *overrideDataReceiver) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) error {
 	if s.onAccountData == nil {
@@ -1375,6 +1599,12 @@ func (s *overrideDataReceiver) OnReceipt(ctx context.Context, userID, roomID, ep
 	}
 	s.onReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 }
+func (s *overrideDataReceiver) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	if s.onPresence == nil {
+		return
+	}
+	s.onPresence(ctx, userID, events)
+}
 func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
 	if s.onInvite == nil {
 		return nil
@@ -1405,6 +1635,19 @@ func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHa
 	}
 	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
+func (s *overrideDataReceiver) OnLoggedOut(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	if s.onLoggedOut == nil {
+		return
+	}
+	s.onLoggedOut(ctx, accessTokenHash, userID, deviceID, softLogout)
+}
+
+func (s *overrideDataReceiver) OnUpstreamStatus(ctx context.Context, status UpstreamStatus) {
+	if s.onUpstreamStatus == nil {
+		return
+	}
+	s.onUpstreamStatus(ctx, status)
+}
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
 	client := &mockClient{
@@ -1419,3 +1662,50 @@ func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error
 	}
 	return accumulator, client
 }
+
+// Test that joined rooms are all processed when processed concurrently, and that errors are still
+// returned.
+func TestPollerAccumulatesRoomsConcurrently(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerAccumulatesRoomsConcurrently:localhost", DeviceID: "FOOBAR"}
+	failRoomID := "!fail:localhost"
+	var mu sync.Mutex
+	accumulated := make(map[string]bool)
+	receiver := &overrideDataReceiver{
+		accumulate: func(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) error {
+			mu.Lock()
+			defer mu.Unlock()
+			accumulated[roomID] = true
+			if roomID == failRoomID {
+				return fmt.Errorf("this is a test")
+			}
+			return nil
+		},
+	}
+	poller := newPoller(pid, "Authorization: hello world", &mockClient{}, receiver, zerolog.New(os.Stderr), false)
+	poller.accumulateConcurrency = 4
+	res := &SyncResponse{
+		Rooms: SyncRoomsResponse{
+			Join: map[string]SyncV2JoinResponse{},
+		},
+	}
+	for i := 0; i < 20; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		if i == 0 {
+			roomID = failRoomID
+		}
+		res.Rooms.Join[roomID] = SyncV2JoinResponse{
+			Timeline: TimelineResponse{
+				Events: []json.RawMessage{
+					[]byte(`{"type":"m.room.message","content":{},"sender":"@alice:localhost","event_id":"$` + roomID + `"}`),
+				},
+			},
+		}
+	}
+	err := poller.parseRoomsResponse(context.Background(), res)
+	if err == nil {
+		t.Errorf("parseRoomsResponse: want error, got nil")
+	}
+	if len(accumulated) != len(res.Rooms.Join) {
+		t.Errorf("accumulated %d rooms, want %d", len(accumulated), len(res.Rooms.Join))
+	}
+}
@@ -0,0 +1,178 @@
+package sync2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Quirks describe the ways an upstream homeserver deviates from the behaviour the proxy was
+// written against, which is Synapse's. They are detected from the server software at startup
+// and can be overridden by the operator.
+//
+// There are no quirks for token formats: since, next_batch and prev_batch tokens are opaque to
+// the proxy, which stores them and sends them back unchanged, so servers may format them however
+// they like. A server which omits next_batch is not supported.
+type Quirks struct {
+	// IgnoresRoomFilter is set if `rooms: []` in a /sync filter is ignored, so to-device only
+	// polls return all room data anyway. Pollers for new devices do a normal initial sync instead.
+	IgnoresRoomFilter bool
+	// NoInlineFilters is set if the server rejects or ignores JSON filters in the `filter` query
+	// parameter. Pollers make /sync requests without a filter.
+	NoInlineFilters bool
+	// StateOverlapsTimeline is set if events in the timeline are also included in the state
+	// block. The state block must be the state before the timeline, so pollers remove them.
+	StateOverlapsTimeline bool
+	// DuplicateEvents is set if the same event can appear more than once in a timeline. Pollers
+	// remove the duplicates, rather than the accumulator warning about them.
+	DuplicateEvents bool
+}
+
+// quirkNames maps the names used in overrides to the quirk they toggle.
+var quirkNames = map[string]func(q *Quirks) *bool{
+	"ignores_room_filter":     func(q *Quirks) *bool { return &q.IgnoresRoomFilter },
+	"no_inline_filters":       func(q *Quirks) *bool { return &q.NoInlineFilters },
+	"state_overlaps_timeline": func(q *Quirks) *bool { return &q.StateOverlapsTimeline },
+	"duplicate_events":        func(q *Quirks) *bool { return &q.DuplicateEvents },
+}
+
+// QuirksForServer returns the known quirks for a homeserver implementation, as reported by the
+// federation version endpoint. Unknown implementations are assumed to behave like Synapse.
+func QuirksForServer(name string) Quirks {
+	switch strings.ToLower(name) {
+	case "conduit", "conduwuit", "grapevine":
+		return Quirks{
+			IgnoresRoomFilter:     true,
+			StateOverlapsTimeline: true,
+			DuplicateEvents:       true,
+		}
+	case "dendrite":
+		return Quirks{
+			DuplicateEvents: true,
+		}
+	}
+	return Quirks{}
+}
+
+// ParseQuirks applies a comma separated list of overrides to `base` e.g
+// "state_overlaps_timeline,-ignores_room_filter". A leading '-' disables the quirk. The special
+// value "none" disables all quirks, including those which were detected.
+func ParseQuirks(spec string, base Quirks) (Quirks, error) {
+	q := base
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "none" {
+			q = Quirks{}
+			continue
+		}
+		enable := !strings.HasPrefix(name, "-")
+		field, ok := quirkNames[strings.TrimPrefix(name, "-")]
+		if !ok {
+			return base, fmt.Errorf("unknown quirk '%s', valid quirks are %s", name, strings.Join(quirkList(), ", "))
+		}
+		*field(&q) = enable
+	}
+	return q, nil
+}
+
+// Names returns the names of the enabled quirks, sorted.
+func (q Quirks) Names() []string {
+	names := []string{}
+	for _, name := range quirkList() {
+		if *quirkNames[name](&q) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func quirkList() []string {
+	names := make([]string, 0, len(quirkNames))
+	for name := range quirkNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyTo modifies a joined room in a sync response to undo the quirks. Must be called before the
+// state block is used to Initialise the room.
+func (q Quirks) applyTo(room *SyncV2JoinResponse) {
+	room.State.Events, room.Timeline.Events = q.applyToEvents(room.State.Events, room.Timeline.Events)
+}
+
+// applyToLeave modifies a left room in a sync response to undo the quirks.
+func (q Quirks) applyToLeave(room *SyncV2LeaveResponse) {
+	room.State.Events, room.Timeline.Events = q.applyToEvents(room.State.Events, room.Timeline.Events)
+}
+
+// applyToInvite modifies an invited room in a sync response to undo the quirks. Stripped state
+// events have no event ID, so duplicates are found by their type and state key.
+func (q Quirks) applyToInvite(room *SyncV2InviteResponse) {
+	if q.DuplicateEvents {
+		room.InviteState.Events = dedupeByStateKey(room.InviteState.Events)
+	}
+}
+
+func (q Quirks) applyToEvents(state, timeline []json.RawMessage) ([]json.RawMessage, []json.RawMessage) {
+	if q.DuplicateEvents {
+		timeline = dedupeByEventID(timeline, nil)
+		state = dedupeByEventID(state, nil)
+	}
+	if q.StateOverlapsTimeline && len(state) > 0 {
+		inTimeline := make(map[string]struct{}, len(timeline))
+		for _, ev := range timeline {
+			inTimeline[gjson.GetBytes(ev, "event_id").Str] = struct{}{}
+		}
+		state = dedupeByEventID(state, inTimeline)
+	}
+	return state, timeline
+}
+
+// dedupeByEventID returns the events with duplicate event IDs, and event IDs in `exclude`,
+// removed. Events without an event ID are kept. Always returns a new slice.
+func dedupeByEventID(events []json.RawMessage, exclude map[string]struct{}) []json.RawMessage {
+	seen := make(map[string]struct{}, len(events))
+	result := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		eventID := gjson.GetBytes(ev, "event_id").Str
+		if eventID != "" {
+			if _, ok := exclude[eventID]; ok {
+				continue
+			}
+			if _, ok := seen[eventID]; ok {
+				continue
+			}
+			seen[eventID] = struct{}{}
+		}
+		result = append(result, ev)
+	}
+	return result
+}
+
+// dedupeByStateKey returns the state events with all but the first event for each (type, state
+// key) tuple removed. Events without a type are kept. Always returns a new slice.
+func dedupeByStateKey(events []json.RawMessage) []json.RawMessage {
+	seen := make(map[[2]string]struct{}, len(events))
+	result := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		if !parsed.Get("type").Exists() {
+			result = append(result, ev)
+			continue
+		}
+		key := [2]string{parsed.Get("type").Str, parsed.Get("state_key").Str}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, ev)
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package sync2
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuirks(t *testing.T) {
+	conduit := QuirksForServer("Conduit")
+	testCases := []struct {
+		spec    string
+		base    Quirks
+		want    Quirks
+		wantErr bool
+	}{
+		{spec: "", base: conduit, want: conduit},
+		{spec: "no_inline_filters", want: Quirks{NoInlineFilters: true}},
+		{spec: " duplicate_events , state_overlaps_timeline", want: Quirks{DuplicateEvents: true, StateOverlapsTimeline: true}},
+		{
+			spec: "-ignores_room_filter,no_inline_filters",
+			base: conduit,
+			want: Quirks{StateOverlapsTimeline: true, DuplicateEvents: true, NoInlineFilters: true},
+		},
+		{spec: "none", base: conduit, want: Quirks{}},
+		{spec: "none,duplicate_events", base: conduit, want: Quirks{DuplicateEvents: true}},
+		{spec: "not_a_quirk", base: conduit, want: conduit, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseQuirks(tc.spec, tc.base)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseQuirks(%q): got err %v want err %v", tc.spec, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ParseQuirks(%q): got %+v want %+v", tc.spec, got, tc.want)
+		}
+	}
+	if names := conduit.Names(); !reflect.DeepEqual(names, []string{"duplicate_events", "ignores_room_filter", "state_overlaps_timeline"}) {
+		t.Errorf("Names: got %v", names)
+	}
+	if names := QuirksForServer("Synapse").Names(); len(names) != 0 {
+		t.Errorf("Synapse should have no quirks, got %v", names)
+	}
+}
+
+func TestQuirksApplyTo(t *testing.T) {
+	create := json.RawMessage(`{"event_id":"$create","type":"m.room.create","state_key":""}`)
+	name := json.RawMessage(`{"event_id":"$name","type":"m.room.name","state_key":"","content":{"name":"a"}}`)
+	msg := json.RawMessage(`{"event_id":"$msg","type":"m.room.message","content":{"body":"hi"}}`)
+	newRoom := func() SyncV2JoinResponse {
+		return SyncV2JoinResponse{
+			State:    EventsResponse{Events: []json.RawMessage{create, name}},
+			Timeline: TimelineResponse{Events: []json.RawMessage{name, msg, msg}},
+		}
+	}
+
+	room := newRoom()
+	Quirks{}.applyTo(&room)
+	if !reflect.DeepEqual(room, newRoom()) {
+		t.Errorf("no quirks: room was modified: %+v", room)
+	}
+
+	room = newRoom()
+	Quirks{DuplicateEvents: true}.applyTo(&room)
+	assertEventIDs(t, "duplicate_events state", room.State.Events, "$create", "$name")
+	assertEventIDs(t, "duplicate_events timeline", room.Timeline.Events, "$name", "$msg")
+
+	room = newRoom()
+	Quirks{StateOverlapsTimeline: true}.applyTo(&room)
+	assertEventIDs(t, "state_overlaps_timeline state", room.State.Events, "$create")
+	assertEventIDs(t, "state_overlaps_timeline timeline", room.Timeline.Events, "$name", "$msg", "$msg")
+
+	// left rooms are normalised in the same way
+	var left SyncV2LeaveResponse
+	left.State.Events = []json.RawMessage{create, name}
+	left.Timeline.Events = []json.RawMessage{name, msg, msg}
+	Quirks{DuplicateEvents: true, StateOverlapsTimeline: true}.applyToLeave(&left)
+	assertEventIDs(t, "leave state", left.State.Events, "$create")
+	assertEventIDs(t, "leave timeline", left.Timeline.Events, "$name", "$msg")
+
+	// invite state is stripped of event IDs, so duplicates are found by type and state key
+	strippedName := json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"a"}}`)
+	strippedMember := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"invite"}}`)
+	newInvite := func() SyncV2InviteResponse {
+		return SyncV2InviteResponse{
+			InviteState: EventsResponse{Events: []json.RawMessage{strippedName, strippedMember, strippedName}},
+		}
+	}
+	invite := newInvite()
+	Quirks{}.applyToInvite(&invite)
+	if !reflect.DeepEqual(invite, newInvite()) {
+		t.Errorf("no quirks: invite was modified: %+v", invite)
+	}
+	Quirks{DuplicateEvents: true}.applyToInvite(&invite)
+	if want := []json.RawMessage{strippedName, strippedMember}; !reflect.DeepEqual(invite.InviteState.Events, want) {
+		t.Errorf("duplicate_events invite state: got %s want %s", invite.InviteState.Events, want)
+	}
+}
+
+func assertEventIDs(t *testing.T, msg string, events []json.RawMessage, wantIDs ...string) {
+	t.Helper()
+	var gotIDs []string
+	for _, ev := range events {
+		var e struct {
+			EventID string `json:"event_id"`
+		}
+		if err := json.Unmarshal(ev, &e); err != nil {
+			t.Fatalf("%s: failed to unmarshal event: %s", msg, err)
+		}
+		gotIDs = append(gotIDs, e.EventID)
+	}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("%s: got %v want %v", msg, gotIDs, wantIDs)
+	}
+}
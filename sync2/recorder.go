@@ -0,0 +1,311 @@
+package sync2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// RecordedSync is a single upstream /sync request and its response, as captured by a
+// RecordingClient. Access tokens are never recorded: requests are identified by the
+// hash of the token which made them.
+type RecordedSync struct {
+	TokenHash    string        `json:"token_hash"`
+	Since        string        `json:"since"`
+	IsFirst      bool          `json:"is_first"`
+	ToDeviceOnly bool          `json:"to_device_only"`
+	StatusCode   int           `json:"status_code"`
+	Response     *SyncResponse `json:"response,omitempty"`
+	Timestamp    int64         `json:"ts"`
+}
+
+// redactedContentKeys are content keys which may contain message contents or key material.
+// They are replaced when sanitising recorded responses.
+var redactedContentKeys = []string{"body", "formatted_body", "ciphertext", "session_key", "url", "file"}
+
+// sanitisedAccountDataTypes are the global account data types whose contents are kept
+// when sanitising. All other global account data has its content removed, as it may
+// contain secrets (e.g SSSS) which should never leave the server.
+var sanitisedAccountDataTypes = map[string]bool{
+	"m.direct":            true,
+	"m.ignored_user_list": true,
+	"m.push_rules":        true,
+}
+
+// RecordingClient wraps a Client and appends every upstream /sync response it sees to
+// a per-token JSON lines file in a directory. Responses are sanitised before being
+// written so recordings can be shared in bug reports. Recordings can be fed back into
+// the proxy using a ReplayClient.
+type RecordingClient struct {
+	Client
+	dir string
+	mu  *sync.Mutex
+}
+
+// NewRecordingClient wraps `client` so that /sync responses are recorded in `dir`,
+// creating the directory if it does not exist.
+func NewRecordingClient(client Client, dir string) (*RecordingClient, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("NewRecordingClient: failed to create %s: %w", dir, err)
+	}
+	return &RecordingClient{
+		Client: client,
+		dir:    dir,
+		mu:     &sync.Mutex{},
+	}, nil
+}
+
+func (c *RecordingClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
+	res, statusCode, err := c.Client.DoSyncV2(ctx, accessToken, since, isFirst, toDeviceOnly, excludeEphemeral)
+	if statusCode == 0 {
+		// network error or similar: nothing came back from upstream so there is nothing to replay
+		return res, statusCode, err
+	}
+	rec := RecordedSync{
+		TokenHash:    hashToken(accessToken),
+		Since:        since,
+		IsFirst:      isFirst,
+		ToDeviceOnly: toDeviceOnly,
+		StatusCode:   statusCode,
+		Response:     SanitiseSyncResponse(res),
+		Timestamp:    time.Now().UnixMilli(),
+	}
+	if recErr := c.record(rec); recErr != nil {
+		logger.Warn().Err(recErr).Msg("RecordingClient: failed to record /sync response")
+	}
+	return res, statusCode, err
+}
+
+func (c *RecordingClient) record(rec RecordedSync) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(c.dir, rec.TokenHash[:16]+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// SanitiseSyncResponse returns a copy of the response with message contents, to-device
+// payloads and private account data removed. The structure of the response (room IDs,
+// event IDs, senders, state keys) is preserved so that it still exercises the same code paths.
+func SanitiseSyncResponse(res *SyncResponse) *SyncResponse {
+	if res == nil {
+		return nil
+	}
+	// round-trip via JSON to get a deep copy
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil
+	}
+	var out SyncResponse
+	if err = json.Unmarshal(b, &out); err != nil {
+		return nil
+	}
+	out.AccountData.Events = sanitiseAccountData(out.AccountData.Events)
+	for i := range out.ToDevice.Events {
+		out.ToDevice.Events[i], _ = sjson.SetRawBytes(out.ToDevice.Events[i], "content", []byte("{}"))
+	}
+	for roomID, room := range out.Rooms.Join {
+		sanitiseEvents(room.State.Events)
+		sanitiseEvents(room.Timeline.Events)
+		out.Rooms.Join[roomID] = room
+	}
+	for roomID, room := range out.Rooms.Invite {
+		sanitiseEvents(room.InviteState.Events)
+		out.Rooms.Invite[roomID] = room
+	}
+	for roomID, room := range out.Rooms.Leave {
+		sanitiseEvents(room.State.Events)
+		sanitiseEvents(room.Timeline.Events)
+		out.Rooms.Leave[roomID] = room
+	}
+	return &out
+}
+
+func sanitiseEvents(events []json.RawMessage) {
+	for i := range events {
+		content := gjson.GetBytes(events[i], "content")
+		if !content.IsObject() {
+			continue
+		}
+		for _, key := range redactedContentKeys {
+			if content.Get(key).Exists() {
+				events[i], _ = sjson.SetBytes(events[i], "content."+key, "<redacted>")
+			}
+		}
+	}
+}
+
+func sanitiseAccountData(events []json.RawMessage) []json.RawMessage {
+	for i := range events {
+		if sanitisedAccountDataTypes[gjson.GetBytes(events[i], "type").Str] {
+			continue
+		}
+		events[i], _ = sjson.SetRawBytes(events[i], "content", []byte("{}"))
+	}
+	return events
+}
+
+// LoadRecordings reads all recordings in a directory written by a RecordingClient.
+// Returns a map of token hash prefix (the file name) to recordings in the order they
+// were made.
+func LoadRecordings(dir string) (map[string][]RecordedSync, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	result := make(map[string][]RecordedSync, len(files))
+	for _, file := range files {
+		recs, err := LoadRecordingFile(file)
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSuffix(filepath.Base(file), ".jsonl")] = recs
+	}
+	return result, nil
+}
+
+// LoadRecordingFile reads a single recording file written by a RecordingClient.
+func LoadRecordingFile(path string) ([]RecordedSync, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []RecordedSync
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024) // sync responses can be huge
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec RecordedSync
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// ReplayClient is a Client which returns recorded /sync responses rather than talking
+// to a homeserver. Recordings are assigned to arbitrary access tokens, which makes it
+// possible to feed production traffic back through the poller pipeline deterministically.
+type ReplayClient struct {
+	// ExhaustedWait is how long DoSyncV2 blocks once all recordings for a token have been
+	// returned, before returning an empty response. Defaults to 1s.
+	ExhaustedWait time.Duration
+
+	mu        *sync.Mutex
+	users     map[string][2]string // token -> [user_id, device_id]
+	queues    map[string][]RecordedSync
+	exhausted map[string]chan struct{}
+}
+
+func NewReplayClient() *ReplayClient {
+	return &ReplayClient{
+		ExhaustedWait: time.Second,
+		mu:            &sync.Mutex{},
+		users:         make(map[string][2]string),
+		queues:        make(map[string][]RecordedSync),
+		exhausted:     make(map[string]chan struct{}),
+	}
+}
+
+// AddRecordings makes `recs` be returned, in order, to /sync requests made with `accessToken`.
+func (c *ReplayClient) AddRecordings(userID, deviceID, accessToken string, recs []RecordedSync) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[accessToken] = [2]string{userID, deviceID}
+	c.queues[accessToken] = append(c.queues[accessToken], recs...)
+	if _, ok := c.exhausted[accessToken]; !ok {
+		c.exhausted[accessToken] = make(chan struct{})
+	}
+}
+
+// Exhausted returns a channel which is closed when the poller for this token asks for
+// more data after all recordings have been returned, meaning the last recording has been
+// fully processed.
+func (c *ReplayClient) Exhausted(accessToken string) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.exhausted[accessToken]
+	if !ok {
+		ch = make(chan struct{})
+		c.exhausted[accessToken] = ch
+	}
+	return ch
+}
+
+func (c *ReplayClient) Versions(ctx context.Context) ([]string, error) {
+	return []string{"v1.1"}, nil
+}
+
+func (c *ReplayClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.users[accessToken]
+	if !ok {
+		return "", "", HTTP401
+	}
+	return user[0], user[1], nil
+}
+
+// RoomSummary always fails, as room summaries are not recorded.
+func (c *ReplayClient) RoomSummary(ctx context.Context, accessToken, roomID string, via []string) (*internal.RoomSummary, error) {
+	return nil, fmt.Errorf("ReplayClient: room summaries are not recorded")
+}
+
+// Messages always fails, as /messages is not recorded.
+func (c *ReplayClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	return nil, fmt.Errorf("ReplayClient: /messages is not recorded")
+}
+
+func (c *ReplayClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
+	c.mu.Lock()
+	if _, ok := c.users[accessToken]; !ok {
+		c.mu.Unlock()
+		return nil, 401, fmt.Errorf("ReplayClient: unknown access token")
+	}
+	queue := c.queues[accessToken]
+	if len(queue) > 0 {
+		rec := queue[0]
+		c.queues[accessToken] = queue[1:]
+		c.mu.Unlock()
+		if rec.StatusCode != 200 {
+			return nil, rec.StatusCode, fmt.Errorf("ReplayClient: recorded response returned HTTP %d", rec.StatusCode)
+		}
+		return rec.Response, rec.StatusCode, nil
+	}
+	exhausted := c.exhausted[accessToken]
+	select {
+	case <-exhausted:
+	default:
+		close(exhausted)
+	}
+	c.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(c.ExhaustedWait):
+	}
+	return &SyncResponse{NextBatch: since}, 200, nil
+}
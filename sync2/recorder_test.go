@@ -0,0 +1,130 @@
+package sync2
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRecordingClientSanitisesAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	responses := []*SyncResponse{
+		{
+			NextBatch: "1",
+			AccountData: EventsResponse{
+				Events: []json.RawMessage{
+					json.RawMessage(`{"type":"m.direct","content":{"@bob:localhost":["!a:localhost"]}}`),
+					json.RawMessage(`{"type":"m.secret_storage.default_key","content":{"key":"secret"}}`),
+				},
+			},
+			ToDevice: EventsResponse{
+				Events: []json.RawMessage{
+					json.RawMessage(`{"type":"m.room_key","sender":"@bob:localhost","content":{"session_key":"secret"}}`),
+				},
+			},
+			Rooms: SyncRoomsResponse{
+				Join: map[string]SyncV2JoinResponse{
+					"!a:localhost": {
+						Timeline: TimelineResponse{
+							Events: []json.RawMessage{
+								json.RawMessage(`{"type":"m.room.message","event_id":"$a","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello world"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			NextBatch: "2",
+		},
+	}
+	i := 0
+	inner := &mockClient{fn: func(authHeader, since string) (*SyncResponse, int, error) {
+		res := responses[i]
+		i++
+		return res, 200, nil
+	}}
+	client, err := NewRecordingClient(inner, dir)
+	if err != nil {
+		t.Fatalf("NewRecordingClient: %s", err)
+	}
+	ctx := context.Background()
+	for range responses {
+		if _, _, err = client.DoSyncV2(ctx, "ALICE_TOKEN", "", false, false, false); err != nil {
+			t.Fatalf("DoSyncV2: %s", err)
+		}
+	}
+	// the original response must not be modified
+	if gjson.GetBytes(responses[0].ToDevice.Events[0], "content.session_key").Str != "secret" {
+		t.Errorf("recording modified the original response")
+	}
+
+	recordings, err := LoadRecordings(dir)
+	if err != nil {
+		t.Fatalf("LoadRecordings: %s", err)
+	}
+	if len(recordings) != 1 {
+		t.Fatalf("got %d recording files, want 1", len(recordings))
+	}
+	recs := recordings[hashToken("ALICE_TOKEN")[:16]]
+	if len(recs) != 2 {
+		t.Fatalf("got %d recordings, want 2", len(recs))
+	}
+	if recs[0].TokenHash != hashToken("ALICE_TOKEN") {
+		t.Errorf("got token hash %s want %s", recs[0].TokenHash, hashToken("ALICE_TOKEN"))
+	}
+	rec := recs[0].Response
+	if got := gjson.GetBytes(rec.Rooms.Join["!a:localhost"].Timeline.Events[0], "content.body").Str; got != "<redacted>" {
+		t.Errorf("message body was not redacted, got %s", got)
+	}
+	if got := gjson.GetBytes(rec.Rooms.Join["!a:localhost"].Timeline.Events[0], "content.msgtype").Str; got != "m.text" {
+		t.Errorf("msgtype was redacted, got %s", got)
+	}
+	if got := gjson.GetBytes(rec.ToDevice.Events[0], "content").Raw; got != "{}" {
+		t.Errorf("to-device content was not removed, got %s", got)
+	}
+	if got := gjson.GetBytes(rec.AccountData.Events[0], "content.@bob:localhost").Exists(); !got {
+		t.Errorf("m.direct content was removed")
+	}
+	if got := gjson.GetBytes(rec.AccountData.Events[1], "content").Raw; got != "{}" {
+		t.Errorf("secret account data was not removed, got %s", got)
+	}
+
+	// now replay the recordings
+	replay := NewReplayClient()
+	replay.ExhaustedWait = time.Millisecond
+	replay.AddRecordings("@alice:localhost", "DEVICE", "REPLAY_TOKEN", recs)
+	userID, deviceID, err := replay.WhoAmI(ctx, "REPLAY_TOKEN")
+	if err != nil || userID != "@alice:localhost" || deviceID != "DEVICE" {
+		t.Fatalf("WhoAmI: got %s %s %v", userID, deviceID, err)
+	}
+	if _, code, _ := replay.DoSyncV2(ctx, "UNKNOWN_TOKEN", "", false, false, false); code != 401 {
+		t.Errorf("unknown token: got HTTP %d want 401", code)
+	}
+	for _, wantNextBatch := range []string{"1", "2"} {
+		res, code, err := replay.DoSyncV2(ctx, "REPLAY_TOKEN", "", false, false, false)
+		if err != nil || code != 200 {
+			t.Fatalf("DoSyncV2: got HTTP %d err %v", code, err)
+		}
+		if res.NextBatch != wantNextBatch {
+			t.Errorf("got next_batch %s want %s", res.NextBatch, wantNextBatch)
+		}
+	}
+	select {
+	case <-replay.Exhausted("REPLAY_TOKEN"):
+		t.Fatalf("replay exhausted before the last recording was processed")
+	default:
+	}
+	res, _, _ := replay.DoSyncV2(ctx, "REPLAY_TOKEN", "2", false, false, false)
+	if res.NextBatch != "2" {
+		t.Errorf("exhausted replay: got next_batch %s want 2", res.NextBatch)
+	}
+	select {
+	case <-replay.Exhausted("REPLAY_TOKEN"):
+	default:
+		t.Fatalf("replay not marked as exhausted")
+	}
+}
@@ -0,0 +1,50 @@
+package sync2
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultRetryPolicy is how pollers back off when no policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 3 * time.Second,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.2,
+}
+
+// RetryPolicy decides how long a poller waits before polling again after failures. The wait
+// doubles on every failure in a row, up to MaxBackoff. Some of the wait is removed at random so
+// that pollers which failed at the same time, e.g because the homeserver restarted, don't all
+// retry at the same time.
+type RetryPolicy struct {
+	// InitialBackoff is how long to wait after the first failure.
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest wait between polls. Keep this modest: on large accounts the
+	// homeserver only caches the sync response for a short time, so waiting minutes between
+	// requests can force it to do all the work again.
+	MaxBackoff time.Duration
+	// Jitter is the largest fraction of the wait, between 0 and 1, which is removed at random.
+	Jitter float64
+}
+
+// Backoff returns how long to wait after this many failures in a row.
+func (rp RetryPolicy) Backoff(failCount int) time.Duration {
+	if failCount <= 0 || rp.InitialBackoff <= 0 {
+		return 0
+	}
+	d := rp.InitialBackoff
+	for i := 1; i < failCount && (rp.MaxBackoff <= 0 || d < rp.MaxBackoff); i++ {
+		d *= 2
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if rp.Jitter > 0 {
+		jitter := rp.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
@@ -0,0 +1,28 @@
+package sync2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	rp := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for failCount, w := range want {
+		if got := rp.Backoff(failCount); got != w {
+			t.Errorf("Backoff(%d): got %v want %v", failCount, got, w)
+		}
+	}
+	// large fail counts must not overflow
+	if got := rp.Backoff(1000); got != 5*time.Second {
+		t.Errorf("Backoff(1000): got %v want %v", got, 5*time.Second)
+	}
+
+	rp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := rp.Backoff(4)
+		if got > 5*time.Second || got < 2500*time.Millisecond {
+			t.Fatalf("Backoff(4) with jitter: got %v want between 2.5s and 5s", got)
+		}
+	}
+}
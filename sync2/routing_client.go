@@ -0,0 +1,217 @@
+package sync2
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// ParseHomeservers parses a comma separated list of server names and the homeserver URL to
+// send their users' requests to e.g "example.org=https://matrix.example.org,example.com=/run/hs.sock".
+func ParseHomeservers(spec string) (map[string]string, error) {
+	homeservers := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		serverName, destination, ok := strings.Cut(entry, "=")
+		serverName = strings.TrimSpace(serverName)
+		destination = strings.TrimSpace(destination)
+		if !ok || serverName == "" || destination == "" {
+			return nil, fmt.Errorf("'%s' is not of the form server_name=url", entry)
+		}
+		if _, exists := homeservers[serverName]; exists {
+			return nil, fmt.Errorf("server name '%s' is listed twice", serverName)
+		}
+		homeservers[serverName] = destination
+	}
+	if len(homeservers) == 0 {
+		return nil, fmt.Errorf("no homeservers listed")
+	}
+	return homeservers, nil
+}
+
+// RoutingClient sends each request to one of several homeservers, picked by the server name in
+// the user ID which owns the access token. This lets one proxy serve the users of several small
+// homeservers, sharing a database.
+//
+// The owner of a stored token is looked up in token storage. The owner of a new token is found by
+// asking each homeserver in turn who owns it, so every homeserver may see access tokens belonging
+// to the users of the others: only route to homeservers run by the same operator.
+type RoutingClient struct {
+	clients map[string]Client
+	// serverNames is the order new tokens are tried in.
+	serverNames []string
+	// userForToken returns the user ID of a stored access token, or sql.ErrNoRows.
+	userForToken func(accessToken string) (userID string, err error)
+
+	mu           sync.Mutex
+	tokenServers map[string]string // access token -> server name
+}
+
+// NewRoutingClient makes a client which routes requests to these clients, by server name.
+func NewRoutingClient(clients map[string]Client) *RoutingClient {
+	c := &RoutingClient{
+		clients:      clients,
+		tokenServers: make(map[string]string),
+	}
+	for serverName := range clients {
+		c.serverNames = append(c.serverNames, serverName)
+	}
+	sort.Strings(c.serverNames)
+	return c
+}
+
+// SetTokenLookup sets how the user ID of a stored access token is found, so that tokens stored
+// before a restart are routed without asking every homeserver. Must be called before any requests
+// are made.
+func (c *RoutingClient) SetTokenLookup(userForToken func(accessToken string) (userID string, err error)) {
+	c.userForToken = userForToken
+}
+
+// Versions returns the Matrix versions which every homeserver supports.
+func (c *RoutingClient) Versions(ctx context.Context) ([]string, error) {
+	var common map[string]bool
+	for _, serverName := range c.serverNames {
+		versions, err := c.clients[serverName].Versions(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", serverName, err)
+		}
+		supported := make(map[string]bool, len(versions))
+		for _, v := range versions {
+			if common == nil || common[v] {
+				supported[v] = true
+			}
+		}
+		common = supported
+	}
+	result := make([]string, 0, len(common))
+	for v := range common {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// WhoAmI asks the homeserver which owns this access token who it belongs to. If the owner is not
+// known, each homeserver is asked in turn until one recognises the token. Returns HTTP401 if none
+// of them do.
+func (c *RoutingClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	if client, err := c.clientForToken(accessToken); err == nil {
+		userID, deviceID, err := client.WhoAmI(ctx, accessToken)
+		if err == HTTP401 {
+			c.forget(accessToken)
+		}
+		return userID, deviceID, err
+	}
+	var lastErr error = HTTP401
+	for _, serverName := range c.serverNames {
+		userID, deviceID, err := c.clients[serverName].WhoAmI(ctx, accessToken)
+		if err == HTTP401 {
+			continue
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", serverName, err)
+			continue
+		}
+		// don't let a homeserver claim users of another
+		if UserServerName(userID) != serverName {
+			return "", "", fmt.Errorf("%s: /whoami returned user %s of another server", serverName, userID)
+		}
+		c.mu.Lock()
+		c.tokenServers[accessToken] = serverName
+		c.mu.Unlock()
+		return userID, deviceID, nil
+	}
+	return "", "", lastErr
+}
+
+func (c *RoutingClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
+	client, err := c.clientForToken(accessToken)
+	if err != nil {
+		if err == HTTP401 {
+			return nil, 401, err
+		}
+		return nil, 0, err
+	}
+	res, statusCode, err := client.DoSyncV2(ctx, accessToken, since, isFirst, toDeviceOnly, excludeEphemeral)
+	if statusCode == 401 {
+		c.forget(accessToken)
+	}
+	return res, statusCode, err
+}
+
+func (c *RoutingClient) RoomSummary(ctx context.Context, accessToken, roomID string, via []string) (*internal.RoomSummary, error) {
+	client, err := c.clientForToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := client.RoomSummary(ctx, accessToken, roomID, via)
+	if err == HTTP401 {
+		c.forget(accessToken)
+	}
+	return summary, err
+}
+
+func (c *RoutingClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	client, err := c.clientForToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := client.Messages(ctx, accessToken, roomID, from, limit)
+	if err == HTTP401 {
+		c.forget(accessToken)
+	}
+	return messages, err
+}
+
+// clientForToken returns the client for the homeserver of the user who owns this token. Returns
+// HTTP401 if the token is not known.
+func (c *RoutingClient) clientForToken(accessToken string) (Client, error) {
+	c.mu.Lock()
+	serverName, ok := c.tokenServers[accessToken]
+	c.mu.Unlock()
+	if ok {
+		return c.clients[serverName], nil
+	}
+	if c.userForToken == nil {
+		return nil, HTTP401
+	}
+	userID, err := c.userForToken(accessToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, HTTP401
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up access token: %w", err)
+	}
+	serverName = UserServerName(userID)
+	client, ok := c.clients[serverName]
+	if !ok {
+		return nil, fmt.Errorf("no homeserver configured for %s", userID)
+	}
+	c.mu.Lock()
+	c.tokenServers[accessToken] = serverName
+	c.mu.Unlock()
+	return client, nil
+}
+
+// forget removes an access token which its homeserver no longer recognises.
+func (c *RoutingClient) forget(accessToken string) {
+	c.mu.Lock()
+	delete(c.tokenServers, accessToken)
+	c.mu.Unlock()
+}
+
+// UserServerName returns the server name part of a user ID e.g "example.org:8448" for
+// "@alice:example.org:8448".
+func UserServerName(userID string) string {
+	_, serverName, _ := strings.Cut(userID, ":")
+	return serverName
+}
@@ -0,0 +1,124 @@
+package sync2
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// homeserverClient is a fake homeserver which knows the access tokens of some users.
+type homeserverClient struct {
+	users    map[string]string // access token -> user ID
+	versions []string
+	synced   []string // access tokens
+}
+
+func (c *homeserverClient) Versions(ctx context.Context) ([]string, error) {
+	return c.versions, nil
+}
+func (c *homeserverClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	userID, ok := c.users[accessToken]
+	if !ok {
+		return "", "", HTTP401
+	}
+	return userID, "DEVICE", nil
+}
+func (c *homeserverClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly, excludeEphemeral bool) (*SyncResponse, int, error) {
+	if _, ok := c.users[accessToken]; !ok {
+		return nil, 401, fmt.Errorf("DoSyncV2: response returned 401")
+	}
+	c.synced = append(c.synced, accessToken)
+	return &SyncResponse{}, 200, nil
+}
+func (c *homeserverClient) RoomSummary(ctx context.Context, accessToken, roomID string, via []string) (*internal.RoomSummary, error) {
+	return nil, fmt.Errorf("no room summary for %s", roomID)
+}
+func (c *homeserverClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	return nil, fmt.Errorf("no messages for %s", roomID)
+}
+
+func TestParseHomeservers(t *testing.T) {
+	got, err := ParseHomeservers(" a.example=https://hs.a.example , b.example:8448=/run/b.sock,")
+	if err != nil {
+		t.Fatalf("ParseHomeservers: %s", err)
+	}
+	want := map[string]string{"a.example": "https://hs.a.example", "b.example:8448": "/run/b.sock"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseHomeservers: got %v want %v", got, want)
+	}
+	for _, spec := range []string{"", "a.example", "=https://hs.a.example", "a.example=", "a.example=x,a.example=y"} {
+		if _, err = ParseHomeservers(spec); err == nil {
+			t.Errorf("ParseHomeservers(%q): got no error", spec)
+		}
+	}
+}
+
+func TestRoutingClient(t *testing.T) {
+	ctx := context.Background()
+	a := &homeserverClient{
+		users:    map[string]string{"alice_token": "@alice:a.example", "liar_token": "@mallory:b.example"},
+		versions: []string{"v1.1", "v1.2"},
+	}
+	b := &homeserverClient{
+		users:    map[string]string{"bob_token": "@bob:b.example", "stored_token": "@stored:b.example"},
+		versions: []string{"v1.2", "v1.3"},
+	}
+	c := NewRoutingClient(map[string]Client{"a.example": a, "b.example": b})
+	c.SetTokenLookup(func(accessToken string) (string, error) {
+		switch accessToken {
+		case "stored_token":
+			return "@stored:b.example", nil
+		case "elsewhere_token":
+			return "@eve:c.example", nil
+		}
+		return "", sql.ErrNoRows
+	})
+
+	versions, err := c.Versions(ctx)
+	if err != nil || !reflect.DeepEqual(versions, []string{"v1.2"}) {
+		t.Errorf("Versions: got %v %v want only the common version", versions, err)
+	}
+
+	// new tokens are identified by asking each homeserver
+	for token, wantUserID := range map[string]string{"alice_token": "@alice:a.example", "bob_token": "@bob:b.example"} {
+		userID, _, err := c.WhoAmI(ctx, token)
+		if err != nil || userID != wantUserID {
+			t.Errorf("WhoAmI(%s): got %s %v want %s", token, userID, err, wantUserID)
+		}
+	}
+	if _, _, err = c.WhoAmI(ctx, "unknown_token"); err != HTTP401 {
+		t.Errorf("WhoAmI(unknown_token): got %v want HTTP401", err)
+	}
+	if _, _, err = c.WhoAmI(ctx, "liar_token"); err == nil {
+		t.Errorf("WhoAmI(liar_token): a homeserver claimed a user of another server")
+	}
+
+	// requests go to the token owner's homeserver, found from /whoami or the stored token
+	for _, token := range []string{"alice_token", "bob_token", "stored_token"} {
+		if _, code, err := c.DoSyncV2(ctx, token, "", false, false, false); code != 200 || err != nil {
+			t.Errorf("DoSyncV2(%s): got %d %v", token, code, err)
+		}
+	}
+	if !reflect.DeepEqual(a.synced, []string{"alice_token"}) || !reflect.DeepEqual(b.synced, []string{"bob_token", "stored_token"}) {
+		t.Errorf("DoSyncV2: got syncs a=%v b=%v", a.synced, b.synced)
+	}
+	if _, code, err := c.DoSyncV2(ctx, "unknown_token", "", false, false, false); code != 401 || err != HTTP401 {
+		t.Errorf("DoSyncV2(unknown_token): got %d %v want 401", code, err)
+	}
+	if _, code, err := c.DoSyncV2(ctx, "elsewhere_token", "", false, false, false); code == 200 || err == nil {
+		t.Errorf("DoSyncV2(elsewhere_token): got %d %v want an error for an unrouted server", code, err)
+	}
+
+	// tokens which are no longer recognised are forgotten
+	delete(a.users, "alice_token")
+	if _, code, _ := c.DoSyncV2(ctx, "alice_token", "", false, false, false); code != 401 {
+		t.Errorf("DoSyncV2(expired alice_token): got %d want 401", code)
+	}
+	if _, err = c.clientForToken("alice_token"); err != HTTP401 {
+		t.Errorf("expired token was not forgotten: got %v", err)
+	}
+}
@@ -1,17 +1,15 @@
 package sync2
 
 import (
-	"os"
+	"encoding/json"
+	"fmt"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
-	"github.com/rs/zerolog"
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModulePoller)
 
 type Storage struct {
 	DevicesTable *DevicesTable
@@ -37,6 +35,42 @@ func NewStoreWithDB(db *sqlx.DB, secret string) *Storage {
 	}
 }
 
+// DeviceSince returns the since token the device's poller will resume from. An empty token means
+// the next poll is an initial sync. Returns sql.ErrNoRows if the proxy does not know the device.
+func (s *Storage) DeviceSince(userID, deviceID string) (string, error) {
+	return s.DevicesTable.SelectSince(userID, deviceID)
+}
+
+// ExportUser returns the user's devices and tokens, by table name. Access tokens are not exported,
+// only which device they belong to and when they were last used.
+func (s *Storage) ExportUser(userID string) (map[string][]json.RawMessage, error) {
+	export := make(map[string][]json.RawMessage)
+	for table, columns := range map[string]string{
+		"syncv3_sync2_devices": "device_id, since, last_poll_ts",
+		"syncv3_sync2_tokens":  "device_id, last_seen",
+	} {
+		rows := []json.RawMessage{}
+		err := s.DB.Select(&rows, fmt.Sprintf(
+			`SELECT row_to_json(x) FROM (SELECT %s FROM %s WHERE user_id = $1 ORDER BY 1, 2) x`, columns, table,
+		), userID)
+		if err != nil {
+			return nil, fmt.Errorf("ExportUser: failed to select from %s: %w", table, err)
+		}
+		export[table] = rows
+	}
+	return export, nil
+}
+
+// EraseUser deletes all of the user's devices and tokens.
+func (s *Storage) EraseUser(txn *sqlx.Tx, userID string) error {
+	for _, table := range []string{"syncv3_sync2_devices", "syncv3_sync2_tokens"} {
+		if _, err := txn.Exec(`DELETE FROM `+table+` WHERE user_id = $1`, userID); err != nil {
+			return fmt.Errorf("EraseUser: failed to delete from %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
 func (s *Storage) Teardown() {
 	err := s.DB.Close()
 	if err != nil {
@@ -31,27 +31,32 @@ type TokensTable struct {
 	// https://cheatsheetseries.owasp.org/cheatsheets/Cryptographic_Storage_Cheat_Sheet.html#separation-of-keys-and-data
 	// We cannot use bcrypt/scrypt as we need the plaintext to do sync requests!
 	key256 []byte
+	// oldKeys are derived from retired secrets. They are only used to decrypt tokens which were
+	// encrypted before the secret was rotated, until Reencrypt has re-encrypted them with key256.
+	oldKeys [][]byte
 }
 
-// NewTokensTable creates the syncv3_sync2_tokens table if it does not already exist.
+// NewTokensTable returns a TokensTable which encrypts access tokens with the secret.
 func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
-		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
-		token_encrypted TEXT NOT NULL,
-		-- TODO: FK constraints to devices table?
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
-	);`)
+	return &TokensTable{
+		db:     db,
+		key256: deriveKey(secret),
+	}
+}
 
-	// derive the key from the secret
+// deriveKey derives an AES-256 key from a secret.
+func deriveKey(secret string) []byte {
 	hash := sha256.New()
 	hash.Write([]byte(secret))
+	return hash.Sum(nil)
+}
 
-	return &TokensTable{
-		db:     db,
-		key256: hash.Sum(nil),
+// SetOldSecrets sets the secrets which were previously used to encrypt tokens. Tokens are only
+// ever encrypted with the current secret, but can be decrypted with any of them.
+func (t *TokensTable) SetOldSecrets(secrets []string) {
+	t.oldKeys = nil
+	for _, secret := range secrets {
+		t.oldKeys = append(t.oldKeys, deriveKey(secret))
 	}
 }
 
@@ -71,12 +76,24 @@ func (t *TokensTable) encrypt(token string) string {
 	return hex.EncodeToString(nonce) + " " + hex.EncodeToString(gcm.Seal(nil, nonce, []byte(token), nil))
 }
 func (t *TokensTable) decrypt(nonceAndEncToken string) (string, error) {
-	return decrypt(nonceAndEncToken, t.key256)
+	token, err := decrypt(nonceAndEncToken, t.key256)
+	if err == nil {
+		return token, nil
+	}
+	for _, key := range t.oldKeys {
+		if token, oldErr := decrypt(nonceAndEncToken, key); oldErr == nil {
+			return token, nil
+		}
+	}
+	return "", err
 }
 
 // Pulled out to a free function to use in the device ID migration.
 func decrypt(nonceAndEncToken string, key []byte) (string, error) {
 	segs := strings.Split(nonceAndEncToken, " ")
+	if len(segs) != 2 {
+		return "", fmt.Errorf("decrypt: malformed token")
+	}
 	nonce := segs[0]
 	nonceBytes, err := hex.DecodeString(nonce)
 	if err != nil {
@@ -170,6 +187,29 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 	return
 }
 
+// LatestTokenForDevice loads the most recently used token for this device, along with the
+// device's since token. Errors with sql.ErrNoRows if the device has no tokens.
+func (t *TokensTable) LatestTokenForDevice(userID, deviceID string) (*TokenForPoller, error) {
+	token := TokenForPoller{Token: &Token{}}
+	err := t.db.Get(
+		&token,
+		`SELECT token_encrypted, user_id, device_id, last_seen, since
+		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
+		WHERE user_id = $1 AND device_id = $2
+		ORDER BY last_seen DESC LIMIT 1`,
+		userID, deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessToken, err = t.decrypt(token.AccessTokenEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessTokenHash = hashToken(token.AccessToken)
+	return &token, nil
+}
+
 // Insert a new token into the table.
 func (t *TokensTable) Insert(txn *sqlx.Tx, plaintextToken, userID, deviceID string, lastSeen time.Time) (*Token, error) {
 	hashedToken := hashToken(plaintextToken)
@@ -238,6 +278,57 @@ func (t *TokensTable) GetTokenAndSince(userID, deviceID, tokenHash string) (acce
 	return
 }
 
+// ReencryptResult is the outcome of TokensTable.Reencrypt.
+type ReencryptResult struct {
+	// Reencrypted is the number of tokens which were encrypted with an old secret.
+	Reencrypted int
+	// Undecryptable is the number of tokens which could not be decrypted with any secret. Their
+	// devices will not be polled until the client uses the token again.
+	Undecryptable int
+}
+
+// Reencrypt re-encrypts every token which was encrypted with an old secret with the current secret,
+// batchSize tokens at a time, so that the old secrets can be retired. Tokens are updated one by one
+// and only if they were not changed in the meantime, so this is safe to run whilst the proxy is
+// serving requests.
+func (t *TokensTable) Reencrypt(batchSize int) (res ReencryptResult, err error) {
+	after := ""
+	for {
+		var rows []struct {
+			TokenHash      string `db:"token_hash"`
+			TokenEncrypted string `db:"token_encrypted"`
+		}
+		err = t.db.Select(
+			&rows,
+			`SELECT token_hash, token_encrypted FROM syncv3_sync2_tokens
+			WHERE token_hash > $1 ORDER BY token_hash LIMIT $2`,
+			after, batchSize,
+		)
+		if err != nil || len(rows) == 0 {
+			return
+		}
+		after = rows[len(rows)-1].TokenHash
+		for _, row := range rows {
+			if _, currentErr := decrypt(row.TokenEncrypted, t.key256); currentErr == nil {
+				continue // already encrypted with the current secret
+			}
+			accessToken, decryptErr := t.decrypt(row.TokenEncrypted)
+			if decryptErr != nil {
+				res.Undecryptable++
+				continue
+			}
+			_, err = t.db.Exec(
+				`UPDATE syncv3_sync2_tokens SET token_encrypted = $1 WHERE token_hash = $2 AND token_encrypted = $3`,
+				t.encrypt(accessToken), row.TokenHash, row.TokenEncrypted,
+			)
+			if err != nil {
+				return res, fmt.Errorf("Reencrypt: failed to update token: %w", err)
+			}
+			res.Reencrypted++
+		}
+	}
+}
+
 // Delete looks up a token by its hash and deletes the row. If no token exists with the
 // given hash, a warning is logged but no error is returned.
 func (t *TokensTable) Delete(accessTokenHash string) error {
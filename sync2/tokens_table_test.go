@@ -132,6 +132,61 @@ func TestDeletingTokens(t *testing.T) {
 	}
 }
 
+func TestReencryptTokens(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	oldTokens := NewTokensTable(db, "old_secret")
+	accessToken := "TestReencryptTokens"
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		_, err := oldTokens.Insert(txn, accessToken, "@alice:localhost", "device", time.Now())
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to Insert token: %s", err)
+	}
+	selectEncrypted := func() string {
+		var encToken string
+		if err := db.Get(&encToken, `SELECT token_encrypted FROM syncv3_sync2_tokens WHERE token_hash=$1`, hashToken(accessToken)); err != nil {
+			t.Fatalf("Failed to select token: %s", err)
+		}
+		return encToken
+	}
+
+	t.Log("Rotate the secret. The token should only be decryptable whilst the old secret is known.")
+	newTokens := NewTokensTable(db, "new_secret")
+	if _, err = newTokens.decrypt(selectEncrypted()); err == nil {
+		t.Fatalf("decrypted token encrypted with an old secret without knowing the old secret")
+	}
+	newTokens.SetOldSecrets([]string{"older_secret", "old_secret"})
+	got, err := newTokens.decrypt(selectEncrypted())
+	if err != nil {
+		t.Fatalf("Failed to decrypt token with old secret: %s", err)
+	}
+	assertEqual(t, got, accessToken, "decrypted token mismatch")
+
+	t.Log("Re-encrypt the tokens. The token should now be decryptable with only the new secret.")
+	res, err := newTokens.Reencrypt(1)
+	if err != nil {
+		t.Fatalf("Reencrypt: %s", err)
+	}
+	if res.Reencrypted == 0 {
+		t.Fatalf("Reencrypt: no tokens were re-encrypted")
+	}
+	newTokens.SetOldSecrets(nil)
+	got, err = newTokens.decrypt(selectEncrypted())
+	if err != nil {
+		t.Fatalf("Failed to decrypt re-encrypted token: %s", err)
+	}
+	assertEqual(t, got, accessToken, "decrypted token mismatch")
+
+	t.Log("Re-encrypting again should be a no-op.")
+	encToken := selectEncrypted()
+	if _, err = newTokens.Reencrypt(100); err != nil {
+		t.Fatalf("Reencrypt: %s", err)
+	}
+	assertEqual(t, selectEncrypted(), encToken, "token re-encrypted twice")
+}
+
 func assertEqualTokens(t *testing.T, table *TokensTable, got *Token, accessToken, userID, deviceID string, lastSeen time.Time) {
 	t.Helper()
 	assertEqual(t, got.AccessToken, accessToken, "Token.AccessToken mismatch")
@@ -3,13 +3,12 @@ package caches
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
@@ -55,10 +54,7 @@ type EventData struct {
 	ForceInitial bool
 }
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleCaches)
 
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
@@ -74,16 +70,28 @@ type GlobalCache struct {
 	// hence you must lock this with `mu` before r/w
 	roomIDToMetadata   map[string]*internal.RoomMetadata
 	roomIDToMetadataMu *sync.RWMutex
+	// the number of times each room was invalidated, so connections' RoomStateCaches don't serve
+	// state from before e.g a state redaction, which doesn't make a new snapshot. Guarded by
+	// roomIDToMetadataMu.
+	roomIDToInvalidations map[string]int64
+
+	// profiles fill in heroes without a profile in their room
+	profiles *ProfileCache
 
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
+
+	// rooms from StartupLazy whose metadata has not been loaded yet
+	hydration *hydration
 }
 
 func NewGlobalCache(store *state.Storage) *GlobalCache {
 	return &GlobalCache{
-		roomIDToMetadataMu: &sync.RWMutex{},
-		store:              store,
-		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+		roomIDToMetadataMu:    &sync.RWMutex{},
+		store:                 store,
+		roomIDToMetadata:      make(map[string]*internal.RoomMetadata),
+		roomIDToInvalidations: make(map[string]int64),
+		profiles:              NewProfileCache(),
 	}
 }
 
@@ -94,6 +102,7 @@ func (c *GlobalCache) OnRegistered(_ context.Context) error {
 // LoadRooms loads the current room metadata for the given room IDs. Races unless you call this in a dispatcher loop.
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[string]*internal.RoomMetadata {
+	c.hydrate(ctx, roomIDs)
 	c.roomIDToMetadataMu.RLock()
 	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
@@ -108,6 +117,13 @@ func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[stri
 // and returns rooms in a map. The output map is non-nil and contains exactly the same
 // set of keys as the input map. The values in the input map are completely ignored.
 func (c *GlobalCache) LoadRoomsFromMap(ctx context.Context, joinTimingsByRoomID map[string]internal.EventMetadata) map[string]*internal.RoomMetadata {
+	if c.hydration.pending() {
+		roomIDs := make([]string, 0, len(joinTimingsByRoomID))
+		for roomID := range joinTimingsByRoomID {
+			roomIDs = append(roomIDs, roomID)
+		}
+		c.hydrate(ctx, roomIDs)
+	}
 	c.roomIDToMetadataMu.RLock()
 	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(joinTimingsByRoomID))
@@ -127,7 +143,57 @@ func (c *GlobalCache) copyRoom(roomID string) *internal.RoomMetadata {
 		logger.Warn().Str("room", roomID).Msg("GlobalCache.LoadRoom: no metadata for this room, returning stub")
 		return internal.NewRoomMetadata(roomID)
 	}
-	return sr.DeepCopy()
+	metadata := sr.DeepCopy()
+	c.profiles.FillHeroes(metadata.Heroes)
+	return metadata
+}
+
+// KnownRoom returns a copy of the metadata of a room the proxy has stored events for, or nil if it
+// has none, e.g because the room is only known from an invite.
+func (c *GlobalCache) KnownRoom(roomID string) *internal.RoomMetadata {
+	c.hydrate(context.Background(), []string{roomID})
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	metadata := c.roomIDToMetadata[roomID]
+	if metadata == nil || len(metadata.LatestEventsByType) == 0 {
+		return nil
+	}
+	return metadata.DeepCopy()
+}
+
+// LoadStrippedState loads the state events of the given types with an empty state key in the room
+// at loadPosition, stripped down to their type, state_key, sender and content like invite_state.
+func (c *GlobalCache) LoadStrippedState(ctx context.Context, roomID string, loadPosition int64, evTypes []string) []json.RawMessage {
+	if c.store == nil || len(evTypes) == 0 {
+		return nil
+	}
+	ctx, span := internal.StartSpan(ctx, "LoadStrippedState")
+	defer span.End()
+	query := make(map[string][]string, len(evTypes))
+	for _, evType := range evTypes {
+		query[evType] = []string{""}
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, query)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Int64("pos", loadPosition).Msg("failed to load stripped state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	var stripped []json.RawMessage
+	for _, ev := range roomIDToStateEvents[roomID] {
+		parsed := gjson.ParseBytes(ev.JSON)
+		strippedEvent, err := json.Marshal(map[string]interface{}{
+			"type":      ev.Type,
+			"state_key": ev.StateKey,
+			"sender":    parsed.Get("sender").Str,
+			"content":   json.RawMessage(parsed.Get("content").Raw),
+		})
+		if err != nil {
+			continue
+		}
+		stripped = append(stripped, strippedEvent)
+	}
+	return stripped
 }
 
 // LoadJoinedRooms loads all current joined room metadata for the user given, together
@@ -146,6 +212,8 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 	if c.LoadJoinedRoomsOverride != nil {
 		return c.LoadJoinedRoomsOverride(userID)
 	}
+	ctx, span := internal.StartSpan(ctx, "LoadJoinedRooms")
+	defer span.End()
 	initialLoadPosition, err := c.store.LatestEventNID()
 	if err != nil {
 		return 0, nil, nil, nil, err
@@ -172,6 +240,8 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 }
 
 func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
+	ctx, span := internal.StartSpan(ctx, "LoadStateEvent")
+	defer span.End()
 	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, map[string][]string{
 		evType: {stateKey},
 	})
@@ -187,21 +257,67 @@ func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPos
 	return nil
 }
 
-// TODO: remove? Doesn't touch global cache fields
-func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
+// LoadActivityBefore returns the origin_server_ts of the latest timeline event at or before `ts` in
+// each of the rooms. Rooms which were not active by then are not in the map.
+func (c *GlobalCache) LoadActivityBefore(ctx context.Context, roomIDs []string, ts int64) map[string]int64 {
+	if c.store == nil || len(roomIDs) == 0 {
+		return nil
+	}
+	_, span := internal.StartSpan(ctx, "LoadActivityBefore")
+	defer span.End()
+	roomToActivity, err := c.store.LatestActivityBefore(roomIDs, ts)
+	if err != nil {
+		logger.Err(err).Int("num_rooms", len(roomIDs)).Int64("ts", ts).Msg("failed to load activity before timestamp")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	return roomToActivity
+}
+
+// LoadRoomState loads the required state of these rooms after loadPosition. If stateCache is not
+// nil, state which was loaded for the same filter at the same snapshot is served from it, and
+// newly loaded state is added to it.
+func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string, stateCache *RoomStateCache) map[string][]json.RawMessage {
 	if c.store == nil {
 		return nil
 	}
 	if requiredStateMap.Empty() {
 		return nil
 	}
-	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
-	if err != nil {
-		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		return nil
+	query := requiredStateMap.QueryStateMap()
+	roomIDToStateEvents := make(map[string][]state.Event, len(roomIDs))
+	loadRoomIDs := roomIDs
+	var filterKey string
+	var versions map[string]roomStateVersion
+	if stateCache != nil {
+		filterKey = stateFilterKey(query)
+		versions = c.roomStateVersions(roomIDs, loadPosition)
+		loadRoomIDs = make([]string, 0, len(roomIDs))
+		for _, roomID := range roomIDs {
+			if version, ok := versions[roomID]; ok {
+				if events, ok := stateCache.get(roomID, filterKey, version); ok {
+					roomIDToStateEvents[roomID] = events
+					continue
+				}
+			}
+			loadRoomIDs = append(loadRoomIDs, roomID)
+		}
 	}
+	if len(loadRoomIDs) > 0 {
+		loaded, err := c.store.RoomStateAfterEventPosition(ctx, loadRoomIDs, loadPosition, query)
+		if err != nil {
+			logger.Err(err).Strs("rooms", loadRoomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return nil
+		}
+		for roomID, stateEvents := range loaded {
+			roomIDToStateEvents[roomID] = stateEvents
+			if version, ok := versions[roomID]; ok {
+				stateCache.put(roomID, filterKey, version, stateEvents)
+			}
+		}
+	}
+	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
 	for roomID, stateEvents := range roomIDToStateEvents {
 		var result []json.RawMessage
 		for _, ev := range stateEvents {
@@ -218,10 +334,35 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 		}
 		resultMap[roomID] = result
 	}
-	// TODO: cache?
 	return resultMap
 }
 
+// roomStateVersions returns the versions of these rooms' state after loadPosition, or nil if they
+// can't be loaded.
+func (c *GlobalCache) roomStateVersions(roomIDs []string, loadPosition int64) map[string]roomStateVersion {
+	// Read the invalidation counts first: if a room is invalidated while its state is loaded, the
+	// state is cached under the old count and so is never served.
+	invalidations := make(map[string]int64, len(roomIDs))
+	c.roomIDToMetadataMu.RLock()
+	for _, roomID := range roomIDs {
+		invalidations[roomID] = c.roomIDToInvalidations[roomID]
+	}
+	c.roomIDToMetadataMu.RUnlock()
+	snapshotIDs, err := c.store.StateSnapshotIDsAtPosition(roomIDs, loadPosition)
+	if err != nil {
+		logger.Warn().Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load state snapshot IDs, not using the room state cache")
+		return nil
+	}
+	versions := make(map[string]roomStateVersion, len(snapshotIDs))
+	for roomID, snapshotID := range snapshotIDs {
+		versions[roomID] = roomStateVersion{
+			snapshotID:    snapshotID,
+			invalidations: invalidations[roomID],
+		}
+	}
+	return versions
+}
+
 // Startup will populate the cache with the provided metadata.
 // Must be called prior to starting any v2 pollers else this operation can race. Consider:
 //   - V2 poll loop started early
@@ -250,6 +391,7 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		internal.Assert("room ID is set", metadata.RoomID != "", debugContext)
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1, debugContext)
 		c.roomIDToMetadata[roomID] = &metadata
+		c.profiles.OnHeroes(metadata.Heroes)
 	}
 	return nil
 }
@@ -260,6 +402,7 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 
 func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	evType := gjson.ParseBytes(ephEvent).Get("type").Str
+	c.hydrate(ctx, []string{roomID})
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
 	metadata := c.roomIDToMetadata[roomID]
@@ -270,6 +413,7 @@ func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEv
 	switch evType {
 	case "m.typing":
 		metadata.TypingEvent = ephEvent
+		metadata.TypingTS = time.Now().UnixMilli()
 	}
 	c.roomIDToMetadata[roomID] = metadata
 }
@@ -278,10 +422,15 @@ func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	// nothing to do but we need it because the Dispatcher demands it.
 }
 
+func (c *GlobalCache) OnPresence(ctx context.Context, presence internal.Presence, roomIDs []string) {
+	// nothing to do but we need it because the Dispatcher demands it.
+}
+
 func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
 	// update global state
+	c.hydrate(ctx, []string{ed.RoomID})
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
 	metadata := c.roomIDToMetadata[ed.RoomID]
@@ -314,6 +463,14 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.CanonicalAlias = ed.Content.Get("alias").Str
 		}
+	case "m.room.join_rules":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.JoinRule = ed.Content.Get("join_rule").Str
+		}
+	case "m.room.history_visibility":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.HistoryVisibility = ed.Content.Get("history_visibility").Str
+		}
 	case "m.room.create":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			roomType := ed.Content.Get("type")
@@ -338,6 +495,7 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil {
 			membership := ed.Content.Get("membership").Str
 			eventJSON := gjson.ParseBytes(ed.Event)
+			c.profiles.OnMemberEvent(*ed.StateKey, eventJSON, ed.Timestamp)
 			if internal.IsMembershipChange(eventJSON) {
 				metadata.JoinCount = ed.JoinCount
 				metadata.InviteCount = ed.InviteCount
@@ -378,8 +536,11 @@ func (c *GlobalCache) OnNewEvent(
 }
 
 func (c *GlobalCache) OnInvalidateRoom(ctx context.Context, roomID string) {
+	c.hydrate(ctx, []string{roomID})
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
+	// the room's state may have changed without a new snapshot, so state cached for it is stale
+	c.roomIDToInvalidations[roomID]++
 
 	metadata, ok := c.roomIDToMetadata[roomID]
 	if !ok {
@@ -11,6 +11,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 func TestGlobalCacheLoadState(t *testing.T) {
@@ -217,20 +218,76 @@ func TestGlobalCacheLoadState(t *testing.T) {
 			rs := sync3.RoomSubscription{
 				RequiredState: tc.requiredState,
 			}
-			gotMap := globalCache.LoadRoomState(ctx, roomIDs, latest, rs.RequiredStateMap(tc.me), tc.roomToUsersInTimeline)
-			for _, roomID := range roomIDs {
-				got := gotMap[roomID]
-				wantEvents := tc.wantEvents[roomID]
-				if len(got) != len(wantEvents) {
-					t.Errorf("LoadState %d for rooms %v required_state %v got %d events want %d.", latest, roomIDs, tc.requiredState, len(got), len(wantEvents))
-					continue
-				}
-				for i := range wantEvents {
-					if !bytes.Equal(got[i], wantEvents[i]) {
-						t.Errorf("LoadState %d for input %v at pos %d:\ngot  %s\nwant %s", latest, tc.requiredState, i, string(got[i]), string(wantEvents[i]))
+			// the second load with the cache is served from it, so must match as well
+			stateCache := caches.NewRoomStateCache(caches.DefaultMaxRoomStateViews)
+			for _, cache := range []*caches.RoomStateCache{nil, stateCache, stateCache} {
+				gotMap := globalCache.LoadRoomState(ctx, roomIDs, latest, rs.RequiredStateMap(tc.me), tc.roomToUsersInTimeline, cache)
+				for _, roomID := range roomIDs {
+					got := gotMap[roomID]
+					wantEvents := tc.wantEvents[roomID]
+					if len(got) != len(wantEvents) {
+						t.Errorf("LoadState %d for rooms %v required_state %v got %d events want %d.", latest, roomIDs, tc.requiredState, len(got), len(wantEvents))
+						continue
+					}
+					for i := range wantEvents {
+						if !bytes.Equal(got[i], wantEvents[i]) {
+							t.Errorf("LoadState %d for input %v at pos %d:\ngot  %s\nwant %s", latest, tc.requiredState, i, string(got[i]), string(wantEvents[i]))
+						}
 					}
 				}
 			}
 		})
 	}
 }
+
+// Test that state redactions, which don't make a new state snapshot, aren't hidden by the room
+// state cache once the room is invalidated.
+func TestGlobalCacheLoadStateAfterInvalidation(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	roomID := "!TestGlobalCacheLoadStateAfterInvalidation:localhost"
+	alice := "@alice:localhost"
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "The Room Name"})
+	_, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		nameEvent,
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	stateCache := caches.NewRoomStateCache(caches.DefaultMaxRoomStateViews)
+	rs := sync3.RoomSubscription{
+		RequiredState: [][2]string{{"m.room.name", ""}},
+	}
+	loadName := func() string {
+		t.Helper()
+		pos, err := store.LatestEventNID()
+		if err != nil {
+			t.Fatalf("LatestEventNID: %s", err)
+		}
+		got := globalCache.LoadRoomState(ctx, []string{roomID}, pos, rs.RequiredStateMap(alice), nil, stateCache)[roomID]
+		if len(got) != 1 {
+			t.Fatalf("LoadRoomState: got %d events want 1", len(got))
+		}
+		return gjson.GetBytes(got[0], "content.name").Str
+	}
+	if name := loadName(); name != "The Room Name" {
+		t.Fatalf("got name %q want %q", name, "The Room Name")
+	}
+
+	result, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{"redacts": gjson.GetBytes(nameEvent, "event_id").Str}),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	if !result.IncludesStateRedaction {
+		t.Fatalf("Accumulate: IncludesStateRedaction was not set")
+	}
+	globalCache.OnInvalidateRoom(ctx, roomID)
+	if name := loadName(); name != "" {
+		t.Errorf("got name %q after the name was redacted", name)
+	}
+}
@@ -0,0 +1,160 @@
+package caches
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// hydrationBatchSize is how many rooms the background hydrator loads metadata for at once.
+const hydrationBatchSize = 500
+
+// HydrationProgress is how far the global cache is through loading room metadata after
+// StartupLazy.
+type HydrationProgress struct {
+	// Lazy is true if the cache was started with StartupLazy. If false, the metadata of every
+	// room was loaded before the proxy started serving requests.
+	Lazy bool `json:"lazy"`
+	// Total is the number of rooms whose metadata was not loaded at startup.
+	Total int `json:"total"`
+	// Hydrated is the number of those rooms whose metadata has since been loaded.
+	Hydrated int `json:"hydrated"`
+	// Done is true once the metadata of every room has been loaded.
+	Done bool `json:"done"`
+}
+
+// hydration tracks the rooms whose metadata has not been loaded since StartupLazy.
+type hydration struct {
+	// mu serialises loading metadata, so a room is never loaded twice and updates to a room wait
+	// for it to load. Must be acquired before roomIDToMetadataMu.
+	mu         sync.Mutex
+	unhydrated map[string]struct{}
+	remaining  atomic.Int64
+	total      int
+	// load fills in the metadata of the given rooms, see state.Storage.MetadataForRooms
+	load func(roomIDs []string, result map[string]internal.RoomMetadata) error
+}
+
+// pending returns true if there are rooms whose metadata has not been loaded yet.
+func (h *hydration) pending() bool {
+	return h != nil && h.remaining.Load() > 0
+}
+
+// StartupLazy is like Startup, except the metadata only needs the join counts and heroes from
+// state.Storage.LazyGlobalSnapshot. The rest of the metadata of the unhydrated rooms is loaded
+// the first time each room is used, and in the background until every room has been loaded. This
+// lets the proxy serve requests much sooner after starting on large databases.
+func (c *GlobalCache) StartupLazy(roomIDToMetadata map[string]internal.RoomMetadata, unhydratedRoomIDs []string) {
+	c.startupLazy(roomIDToMetadata, unhydratedRoomIDs, c.store.MetadataForRooms)
+	go c.hydrateAll(context.Background(), unhydratedRoomIDs)
+}
+
+func (c *GlobalCache) startupLazy(
+	roomIDToMetadata map[string]internal.RoomMetadata, unhydratedRoomIDs []string,
+	load func(roomIDs []string, result map[string]internal.RoomMetadata) error,
+) {
+	c.roomIDToMetadataMu.Lock()
+	defer c.roomIDToMetadataMu.Unlock()
+	for roomID := range roomIDToMetadata {
+		metadata := roomIDToMetadata[roomID]
+		internal.Assert("room ID is set", metadata.RoomID != "", map[string]interface{}{
+			"room_id": roomID,
+		})
+		c.roomIDToMetadata[roomID] = &metadata
+		c.profiles.OnHeroes(metadata.Heroes)
+	}
+	h := &hydration{
+		unhydrated: make(map[string]struct{}, len(unhydratedRoomIDs)),
+		load:       load,
+	}
+	for _, roomID := range unhydratedRoomIDs {
+		h.unhydrated[roomID] = struct{}{}
+	}
+	h.total = len(h.unhydrated)
+	h.remaining.Store(int64(h.total))
+	c.hydration = h
+}
+
+// HydrationProgress returns how many rooms have had their metadata loaded since StartupLazy.
+func (c *GlobalCache) HydrationProgress() HydrationProgress {
+	h := c.hydration
+	if h == nil {
+		return HydrationProgress{Done: true}
+	}
+	remaining := int(h.remaining.Load())
+	return HydrationProgress{
+		Lazy:     true,
+		Total:    h.total,
+		Hydrated: h.total - remaining,
+		Done:     remaining == 0,
+	}
+}
+
+// hydrateAll loads the metadata of every room in batches. Rooms which fail to load are retried
+// the next time they are used.
+func (c *GlobalCache) hydrateAll(ctx context.Context, roomIDs []string) {
+	start := time.Now()
+	for i := 0; i < len(roomIDs); i += hydrationBatchSize {
+		end := i + hydrationBatchSize
+		if end > len(roomIDs) {
+			end = len(roomIDs)
+		}
+		c.hydrate(ctx, roomIDs[i:end])
+	}
+	progress := c.HydrationProgress()
+	logger.Info().Int("rooms", progress.Total).Int("hydrated", progress.Hydrated).Str("took", time.Since(start).String()).Msg(
+		"finished loading room metadata",
+	)
+}
+
+// hydrate loads the metadata of any of the rooms which have not been loaded since StartupLazy.
+// Must be called before acquiring roomIDToMetadataMu, by everything which reads or writes the
+// metadata of these rooms.
+func (c *GlobalCache) hydrate(ctx context.Context, roomIDs []string) {
+	h := c.hydration
+	if !h.pending() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var toLoad []string
+	for _, roomID := range roomIDs {
+		if _, ok := h.unhydrated[roomID]; ok {
+			toLoad = append(toLoad, roomID)
+		}
+	}
+	if len(toLoad) == 0 {
+		return
+	}
+	_, span := internal.StartSpan(ctx, "hydrate")
+	defer span.End()
+
+	// nothing else writes to these rooms while we hold h.mu, so the metadata can be loaded
+	// without holding roomIDToMetadataMu
+	result := make(map[string]internal.RoomMetadata, len(toLoad))
+	c.roomIDToMetadataMu.RLock()
+	for _, roomID := range toLoad {
+		if metadata := c.roomIDToMetadata[roomID]; metadata != nil {
+			result[roomID] = *metadata.DeepCopy()
+		}
+	}
+	c.roomIDToMetadataMu.RUnlock()
+	if err := h.load(toLoad, result); err != nil {
+		logger.Err(err).Int("num_rooms", len(toLoad)).Msg("failed to load room metadata")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+
+	c.roomIDToMetadataMu.Lock()
+	for _, roomID := range toLoad {
+		if metadata, ok := result[roomID]; ok {
+			c.roomIDToMetadata[roomID] = &metadata
+		}
+		delete(h.unhydrated, roomID)
+	}
+	c.roomIDToMetadataMu.Unlock()
+	h.remaining.Add(-int64(len(toLoad)))
+}
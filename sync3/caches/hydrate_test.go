@@ -0,0 +1,77 @@
+package caches_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestGlobalCacheStartupLazy(t *testing.T) {
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice:TestGlobalCacheStartupLazy"
+	bob := "@bob:TestGlobalCacheStartupLazy"
+	roomIDs := []string{"!a:TestGlobalCacheStartupLazy", "!b:TestGlobalCacheStartupLazy"}
+	for _, roomID := range roomIDs {
+		_, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewJoinEvent(t, bob),
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Name of " + roomID}),
+		}})
+		if err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+
+	snapshot, err := store.LazyGlobalSnapshot()
+	if err != nil {
+		t.Fatalf("LazyGlobalSnapshot: %s", err)
+	}
+	for _, roomID := range roomIDs {
+		metadata := snapshot.GlobalMetadata[roomID]
+		if metadata.JoinCount != 2 {
+			t.Errorf("%s: got join count %d, want 2", roomID, metadata.JoinCount)
+		}
+		if metadata.NameEvent != "" {
+			t.Errorf("%s: lazy snapshot loaded name %q", roomID, metadata.NameEvent)
+		}
+	}
+
+	globalCache := caches.NewGlobalCache(store)
+	globalCache.StartupLazy(snapshot.GlobalMetadata, snapshot.UnhydratedRoomIDs)
+	progress := globalCache.HydrationProgress()
+	if !progress.Lazy || progress.Total != len(snapshot.UnhydratedRoomIDs) {
+		t.Errorf("got progress %+v, want lazy with %d rooms", progress, len(snapshot.UnhydratedRoomIDs))
+	}
+
+	// the room is loaded on first use even if the background hydration hasn't got to it yet
+	rooms := globalCache.LoadRooms(context.Background(), roomIDs[1])
+	if got, want := rooms[roomIDs[1]].NameEvent, "Name of "+roomIDs[1]; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if got := rooms[roomIDs[1]].JoinCount; got != 2 {
+		t.Errorf("hydrating lost the join count: got %d, want 2", got)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !globalCache.HydrationProgress().Done {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for hydration, progress %+v", globalCache.HydrationProgress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress = globalCache.HydrationProgress()
+	if progress.Hydrated != progress.Total {
+		t.Errorf("got progress %+v, want every room hydrated", progress)
+	}
+	if got, want := globalCache.KnownRoom(roomIDs[0]).NameEvent, "Name of "+roomIDs[0]; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package caches
+
+import (
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+// ProfileCache remembers the display name and avatar of every user from their most recent member
+// event in any room. Heroes whose member event in a room has no profile, e.g because it was
+// redacted, are filled in from here so the room still gets a sensible name.
+//
+// Profiles are tracked with the origin_server_ts of the member event they came from, so an older
+// member event (e.g from a gappy sync or room invalidation) never replaces a newer profile.
+type ProfileCache struct {
+	mu       *sync.RWMutex
+	profiles map[string]cachedProfile
+}
+
+type cachedProfile struct {
+	name   string
+	avatar string
+	// ts is the origin_server_ts of the member event which set this profile, or 0 if it was
+	// loaded from room metadata and the event is unknown.
+	ts uint64
+}
+
+func NewProfileCache() *ProfileCache {
+	return &ProfileCache{
+		mu:       &sync.RWMutex{},
+		profiles: make(map[string]cachedProfile),
+	}
+}
+
+// OnMemberEvent updates the user's profile from a join or invite member event. Redacted events
+// have no profile, so are ignored rather than clearing the cached profile.
+func (c *ProfileCache) OnMemberEvent(userID string, event gjson.Result, ts uint64) {
+	membership := event.Get("content.membership").Str
+	if membership != "join" && membership != "invite" {
+		return
+	}
+	if event.Get("unsigned.redacted_because").Exists() {
+		return
+	}
+	c.set(userID, cachedProfile{
+		name:   event.Get("content.displayname").Str,
+		avatar: event.Get("content.avatar_url").Str,
+		ts:     ts,
+	})
+}
+
+// OnHeroes remembers the profiles of heroes loaded from the database, if they aren't known already.
+func (c *ProfileCache) OnHeroes(heroes []internal.Hero) {
+	for _, h := range heroes {
+		if h.Name == "" && h.Avatar == "" {
+			continue
+		}
+		c.set(h.ID, cachedProfile{name: h.Name, avatar: h.Avatar})
+	}
+}
+
+func (c *ProfileCache) set(userID string, p cachedProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing, ok := c.profiles[userID]
+	if ok && existing.ts > p.ts {
+		return // stale
+	}
+	c.profiles[userID] = p
+}
+
+// Profile returns the cached display name and avatar for this user.
+func (c *ProfileCache) Profile(userID string) (name, avatar string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.profiles[userID]
+	return p.name, p.avatar, ok
+}
+
+// FillHeroes sets the name and avatar of heroes which have neither, from their cached profile.
+// Modifies the slice in place.
+func (c *ProfileCache) FillHeroes(heroes []internal.Hero) {
+	for i := range heroes {
+		if heroes[i].Name != "" || heroes[i].Avatar != "" {
+			continue
+		}
+		name, avatar, ok := c.Profile(heroes[i].ID)
+		if !ok {
+			continue
+		}
+		heroes[i].Name = name
+		heroes[i].Avatar = avatar
+	}
+}
@@ -0,0 +1,124 @@
+package caches_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func memberEvent(userID, membership, displayname string, redacted bool) gjson.Result {
+	ev := map[string]interface{}{
+		"type":      "m.room.member",
+		"state_key": userID,
+		"content": map[string]interface{}{
+			"membership":  membership,
+			"displayname": displayname,
+		},
+	}
+	if redacted {
+		ev["content"] = map[string]interface{}{"membership": membership}
+		ev["unsigned"] = map[string]interface{}{"redacted_because": map[string]interface{}{}}
+	}
+	b, _ := json.Marshal(ev)
+	return gjson.ParseBytes(b)
+}
+
+func TestProfileCache(t *testing.T) {
+	alice := "@alice:localhost"
+	c := caches.NewProfileCache()
+	assertName := func(msg, userID, wantName string, wantOK bool) {
+		t.Helper()
+		name, _, ok := c.Profile(userID)
+		if name != wantName || ok != wantOK {
+			t.Errorf("%s: got name=%q ok=%v want %q %v", msg, name, ok, wantName, wantOK)
+		}
+	}
+	assertName("unknown user", alice, "", false)
+
+	c.OnMemberEvent(alice, memberEvent(alice, "join", "Alice", false), 100)
+	assertName("after join", alice, "Alice", true)
+
+	c.OnMemberEvent(alice, memberEvent(alice, "join", "Older Alice", false), 50)
+	assertName("after older join", alice, "Alice", true)
+
+	c.OnMemberEvent(alice, memberEvent(alice, "join", "", true), 200)
+	assertName("after redacted join", alice, "Alice", true)
+
+	c.OnMemberEvent(alice, memberEvent(alice, "leave", "", false), 300)
+	assertName("after leave", alice, "Alice", true)
+
+	c.OnMemberEvent(alice, memberEvent(alice, "invite", "Newer Alice", false), 400)
+	assertName("after newer invite", alice, "Newer Alice", true)
+
+	// heroes from the database never replace profiles from member events
+	c.OnHeroes([]internal.Hero{{ID: alice, Name: "Stored Alice"}, {ID: "@bob:localhost", Name: "Bob"}})
+	assertName("after heroes", alice, "Newer Alice", true)
+	assertName("hero without member event", "@bob:localhost", "Bob", true)
+
+	heroes := []internal.Hero{
+		{ID: alice},
+		{ID: "@bob:localhost", Name: "Bobby"},
+		{ID: "@charlie:localhost"},
+	}
+	c.FillHeroes(heroes)
+	want := []internal.Hero{
+		{ID: alice, Name: "Newer Alice"},
+		{ID: "@bob:localhost", Name: "Bobby"},
+		{ID: "@charlie:localhost"},
+	}
+	for i := range want {
+		if heroes[i] != want[i] {
+			t.Errorf("FillHeroes[%d]: got %+v want %+v", i, heroes[i], want[i])
+		}
+	}
+}
+
+// Test that rooms whose hero's member event was redacted still get a calculated name.
+func TestGlobalCacheFillsHeroesFromProfiles(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	dmRoomID := "!dm:localhost"
+	otherRoomID := "!other:localhost"
+	gc := caches.NewGlobalCache(nil)
+	err := gc.Startup(map[string]internal.RoomMetadata{
+		dmRoomID: {
+			RoomID:               dmRoomID,
+			JoinCount:            2,
+			Heroes:               []internal.Hero{{ID: alice, Name: "Alice"}, {ID: bob}}, // bob's member event was redacted
+			LastMessageTimestamp: 1000,
+			LatestEventsByType:   map[string]internal.EventMetadata{},
+			ChildSpaceRooms:      map[string]struct{}{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	metadata := gc.LoadRooms(ctx, dmRoomID)[dmRoomID]
+	metadata.RemoveHero(alice)
+	if name, _ := internal.CalculateRoomName(metadata, 5); name != bob {
+		t.Errorf("room name before bob's profile is known: got %q want %q", name, bob)
+	}
+
+	// bob joins another room with a profile
+	stateKey := bob
+	ev := memberEvent(bob, "join", "Bob", false)
+	gc.OnNewEvent(ctx, &caches.EventData{
+		Event:     json.RawMessage(ev.Raw),
+		RoomID:    otherRoomID,
+		EventType: "m.room.member",
+		StateKey:  &stateKey,
+		Content:   ev.Get("content"),
+		Timestamp: 2000,
+		JoinCount: 1,
+	})
+	metadata = gc.LoadRooms(ctx, dmRoomID)[dmRoomID]
+	metadata.RemoveHero(alice)
+	if name, _ := internal.CalculateRoomName(metadata, 5); name != "Bob" {
+		t.Errorf("room name after bob's profile is known: got %q want Bob", name)
+	}
+}
@@ -0,0 +1,129 @@
+package caches
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// DefaultMaxRoomStateViews is the number of room state views a RoomStateCache holds.
+const DefaultMaxRoomStateViews = 20
+
+// roomStateVersion identifies the room state a view was loaded from.
+type roomStateVersion struct {
+	snapshotID int64
+	// invalidations is the number of times the room was invalidated, e.g by a state redaction,
+	// which changes the state without making a new snapshot.
+	invalidations int64
+}
+
+type roomStateView struct {
+	version roomStateVersion
+	events  []state.Event
+	// lastUsed orders views for eviction
+	lastUsed uint64
+}
+
+// RoomStateCache memoises the room state which GlobalCache.LoadRoomState loads for a single
+// connection, keyed on the room, the state version and the required_state filter. Clients often
+// repeat the same room subscription, and loading `["*","*"]` for a big room loads its entire state
+// snapshot, so this serves repeated loads from memory until the room's state changes. A new
+// state version for a room replaces the room's view for that filter.
+//
+// This is not thread-safe: it must only be used by the connection's goroutine.
+type RoomStateCache struct {
+	maxViews int
+	// room ID -> filter key -> view
+	views    map[string]map[string]*roomStateView
+	numViews int
+	clock    uint64
+}
+
+func NewRoomStateCache(maxViews int) *RoomStateCache {
+	return &RoomStateCache{
+		maxViews: maxViews,
+		views:    make(map[string]map[string]*roomStateView),
+	}
+}
+
+// stateFilterKey returns a key for the state query made for a required_state filter.
+func stateFilterKey(query map[string][]string) string {
+	// json.Marshal sorts map keys, so the same query always has the same key
+	b, _ := json.Marshal(query)
+	h := fnv.New64a()
+	h.Write(b)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// get returns the state loaded for this room and filter, if it was loaded at this version.
+func (c *RoomStateCache) get(roomID, filterKey string, version roomStateVersion) ([]state.Event, bool) {
+	view := c.views[roomID][filterKey]
+	if view == nil || view.version != version {
+		return nil, false
+	}
+	c.clock++
+	view.lastUsed = c.clock
+	return view.events, true
+}
+
+// put remembers the state loaded for this room and filter at this version, replacing any state
+// from an older version. The least recently used view is evicted if the cache is full.
+func (c *RoomStateCache) put(roomID, filterKey string, version roomStateVersion, events []state.Event) {
+	c.clock++
+	filters := c.views[roomID]
+	if filters == nil {
+		filters = make(map[string]*roomStateView)
+		c.views[roomID] = filters
+	}
+	if view := filters[filterKey]; view != nil {
+		view.version = version
+		view.events = events
+		view.lastUsed = c.clock
+		return
+	}
+	if c.numViews >= c.maxViews {
+		c.evictOldest()
+		// the room's filters may have been evicted
+		if c.views[roomID] == nil {
+			c.views[roomID] = filters
+		}
+	}
+	filters[filterKey] = &roomStateView{
+		version:  version,
+		events:   events,
+		lastUsed: c.clock,
+	}
+	c.numViews++
+}
+
+func (c *RoomStateCache) evictOldest() {
+	var oldestRoomID, oldestFilterKey string
+	var oldest *roomStateView
+	for roomID, filters := range c.views {
+		for filterKey, view := range filters {
+			if oldest == nil || view.lastUsed < oldest.lastUsed {
+				oldestRoomID, oldestFilterKey, oldest = roomID, filterKey, view
+			}
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(c.views[oldestRoomID], oldestFilterKey)
+	if len(c.views[oldestRoomID]) == 0 {
+		delete(c.views, oldestRoomID)
+	}
+	c.numViews--
+}
+
+// Invalidate forgets all state loaded for this room, e.g. because its state has changed so the
+// views will never be used again.
+func (c *RoomStateCache) Invalidate(roomID string) {
+	if c == nil {
+		return
+	}
+	c.numViews -= len(c.views[roomID])
+	delete(c.views, roomID)
+}
@@ -0,0 +1,66 @@
+package caches
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+func TestRoomStateCache(t *testing.T) {
+	c := NewRoomStateCache(2)
+	all := stateFilterKey(map[string][]string{})
+	names := stateFilterKey(map[string][]string{"m.room.name": {""}})
+	if all == names {
+		t.Fatalf("different filters have the same key %s", all)
+	}
+	events := []state.Event{{Type: "m.room.name", StateKey: ""}}
+	v1 := roomStateVersion{snapshotID: 1}
+	v2 := roomStateVersion{snapshotID: 2}
+
+	c.put("!a", all, v1, events)
+	if _, ok := c.get("!a", all, v2); ok {
+		t.Errorf("got state for a newer snapshot")
+	}
+	if _, ok := c.get("!a", names, v1); ok {
+		t.Errorf("got state for a different filter")
+	}
+	if got, ok := c.get("!a", all, v1); !ok || len(got) != 1 {
+		t.Errorf("get: got %v %v want the cached events", got, ok)
+	}
+
+	// the room was invalidated without a new snapshot
+	if _, ok := c.get("!a", all, roomStateVersion{snapshotID: 1, invalidations: 1}); ok {
+		t.Errorf("got state from before the room was invalidated")
+	}
+
+	// a new snapshot replaces the view
+	c.put("!a", all, v2, nil)
+	if _, ok := c.get("!a", all, v1); ok {
+		t.Errorf("got state for a replaced snapshot")
+	}
+	if c.numViews != 1 {
+		t.Errorf("numViews: got %d want 1", c.numViews)
+	}
+
+	// the least recently used view is evicted
+	c.put("!b", all, v1, events)
+	c.get("!a", all, v2)
+	c.put("!c", names, v1, events)
+	if _, ok := c.get("!b", all, v1); ok {
+		t.Errorf("least recently used view was not evicted")
+	}
+	if _, ok := c.get("!a", all, v2); !ok {
+		t.Errorf("recently used view was evicted")
+	}
+	if _, ok := c.get("!c", names, v1); !ok {
+		t.Errorf("new view was not added")
+	}
+
+	c.Invalidate("!a")
+	if _, ok := c.get("!a", all, v2); ok {
+		t.Errorf("got state for an invalidated room")
+	}
+	if c.numViews != 1 {
+		t.Errorf("numViews: got %d want 1", c.numViews)
+	}
+}
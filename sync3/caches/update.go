@@ -70,6 +70,17 @@ func (u *UnreadCountUpdate) Type() string {
 	return fmt.Sprintf("UnreadCountUpdate[%s]", u.RoomID())
 }
 
+// ThreadUnreadCountUpdate represents a change in the per-thread notification counts of a room.
+// Threads contains only the threads whose counts changed; threads which have been read have zero counts.
+type ThreadUnreadCountUpdate struct {
+	RoomUpdate
+	Threads map[string]internal.ThreadUnreadCounts
+}
+
+func (u *ThreadUnreadCountUpdate) Type() string {
+	return fmt.Sprintf("ThreadUnreadCountUpdate[%s]", u.RoomID())
+}
+
 // AccountDataUpdate represents the (global) `account_data` section of a v2 sync response.
 type AccountDataUpdate struct {
 	AccountData []state.AccountData
@@ -106,3 +117,15 @@ type DeviceEventsUpdate struct {
 func (u DeviceEventsUpdate) Type() string {
 	return "DeviceEventsUpdate"
 }
+
+// PresenceUpdate is a change in the presence of a user who shares a room with this user.
+type PresenceUpdate struct {
+	Presence internal.Presence
+	// RoomIDs are the rooms the user with this presence is joined to. Connections only see the
+	// presence if one of these rooms is in scope.
+	RoomIDs []string
+}
+
+func (u *PresenceUpdate) Type() string {
+	return fmt.Sprintf("PresenceUpdate[%s] %s", u.Presence.UserID, u.Presence.Presence)
+}
@@ -45,7 +45,10 @@ type UserRoomData struct {
 	NotificationCount int
 	HighlightCount    int
 	UnreadCount       int
-	Invite            *InviteData
+	// ThreadUnreadCounts are the counts of each thread with unread notifications (MSC3773), keyed by
+	// thread root event ID. The map is replaced rather than modified when the counts change.
+	ThreadUnreadCounts map[string]internal.ThreadUnreadCounts
+	Invite             *InviteData
 
 	// TODO: should CanonicalisedName really be in RoomConMetadata? It's only set in SetRoom AFAICS
 	CanonicalisedName string // stripped leading symbols like #, all in lower case
@@ -61,7 +64,7 @@ type UserRoomData struct {
 
 	// Spaces is the set of room IDs of spaces that this room is part of.
 	Spaces map[string]struct{}
-	// Map of tag to order float.
+	// Map of tag to order float. Tags without an order have an order of 1.
 	// See https://spec.matrix.org/latest/client-server-api/#room-tagging
 	Tags map[string]float64
 	// JoinTiming tracks our latest join to the room, excluding profile changes.
@@ -85,10 +88,15 @@ type InviteData struct {
 	NameEvent            string // the content of m.room.name, NOT the calculated name
 	AvatarEvent          string // the content of m.room.avatar, NOT the calculated avatar
 	CanonicalAlias       string
+	JoinRule             string
 	LastMessageTimestamp uint64
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	// Summary is the room summary from the upstream, if the proxy knows nothing else about the room.
+	Summary *internal.RoomSummary
+	// JoinCount is the number of joined members if the proxy already knows the room, else 0.
+	JoinCount int
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
@@ -114,6 +122,7 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 					StateKey:      &target,
 					Content:       j.Get("content"),
 					Timestamp:     uint64(ts),
+					Sender:        j.Get("sender").Str,
 					AlwaysProcess: true,
 				}
 				id.IsDM = j.Get("content.is_direct").Bool()
@@ -130,6 +139,8 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			id.AvatarEvent = j.Get("content.url").Str
 		case "m.room.canonical_alias":
 			id.CanonicalAlias = j.Get("content.alias").Str
+		case "m.room.join_rules":
+			id.JoinRule = j.Get("content.join_rule").Str
 		case "m.room.encryption":
 			id.Encrypted = true
 		case "m.room.create":
@@ -163,14 +174,100 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	metadata.NameEvent = i.NameEvent
 	metadata.AvatarEvent = i.AvatarEvent
 	metadata.CanonicalAlias = i.CanonicalAlias
+	metadata.JoinRule = i.JoinRule
 	metadata.InviteCount = 1
 	metadata.JoinCount = 1
 	metadata.LastMessageTimestamp = i.LastMessageTimestamp
 	metadata.Encrypted = i.Encrypted
 	metadata.RoomType = roomType
+	if i.Summary != nil {
+		// invite_state is sent by the inviter's server so takes precedence over the summary
+		if metadata.NameEvent == "" {
+			metadata.NameEvent = i.Summary.Name
+		}
+		if metadata.AvatarEvent == "" {
+			metadata.AvatarEvent = i.Summary.AvatarURL
+		}
+		if metadata.CanonicalAlias == "" {
+			metadata.CanonicalAlias = i.Summary.CanonicalAlias
+		}
+		if metadata.JoinRule == "" {
+			metadata.JoinRule = i.Summary.JoinRule
+		}
+		if metadata.RoomType == nil && i.Summary.RoomType != "" {
+			metadata.RoomType = &i.Summary.RoomType
+		}
+		if i.Summary.NumJoinedMembers > 0 {
+			metadata.JoinCount = i.Summary.NumJoinedMembers
+		}
+	}
+	if i.JoinCount > 0 {
+		metadata.JoinCount = i.JoinCount
+	}
 	return metadata
 }
 
+// Topic returns the room topic from the room summary, if there is one.
+func (i *InviteData) Topic() string {
+	if i.Summary == nil {
+		return ""
+	}
+	return i.Summary.Topic
+}
+
+// enrichedInviteStateTypes are the events which the spec recommends are in invite_state, which are
+// added to invites without them if the proxy already knows the room.
+var enrichedInviteStateTypes = []string{"m.room.name", "m.room.avatar", "m.room.canonical_alias", "m.room.encryption"}
+
+// enrich fills in the invite from the room's metadata if the proxy already knows the room, e.g
+// because other users are joined to it, so clients can show a complete preview of sparse invites.
+// Only the events recommended for invite_state are added, and only if they are missing, so nothing
+// is revealed which the invitee's homeserver wouldn't normally send.
+func (i *InviteData) enrich(ctx context.Context, globalCache *GlobalCache) {
+	metadata := globalCache.KnownRoom(i.roomID)
+	if metadata == nil {
+		return
+	}
+	i.JoinCount = metadata.JoinCount
+	has := make(map[string]bool, len(i.InviteState))
+	for _, ev := range i.InviteState {
+		j := gjson.ParseBytes(ev)
+		if j.Get("state_key").Str == "" {
+			has[j.Get("type").Str] = true
+		}
+	}
+	var missing []string
+	for _, evType := range enrichedInviteStateTypes {
+		if !has[evType] && metadata.LatestEventsByType[evType].NID != 0 {
+			missing = append(missing, evType)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	var loadPosition int64
+	for _, ev := range metadata.LatestEventsByType {
+		if ev.NID > loadPosition {
+			loadPosition = ev.NID
+		}
+	}
+	for _, ev := range globalCache.LoadStrippedState(ctx, i.roomID, loadPosition, missing) {
+		j := gjson.ParseBytes(ev)
+		switch j.Get("type").Str {
+		case "m.room.name":
+			i.NameEvent = j.Get("content.name").Str
+		case "m.room.avatar":
+			i.AvatarEvent = j.Get("content.url").Str
+		case "m.room.canonical_alias":
+			i.CanonicalAlias = j.Get("content.alias").Str
+		case "m.room.encryption":
+			i.Encrypted = true
+		}
+		// copy rather than append to the caller's slice
+		i.InviteState = append(i.InviteState[:len(i.InviteState):len(i.InviteState)], ev)
+	}
+}
+
 type UserCacheListener interface {
 	// Called when there is an update affecting a room e.g new event, unread count update, room account data.
 	// Type-cast to find out what the update is about.
@@ -371,6 +468,18 @@ func (c *UserCache) LoadRooms(roomIDs ...string) map[string]UserRoomData {
 	return result
 }
 
+// AllRooms returns the data for every room in the cache, keyed by room ID. This includes
+// invites and rooms which have been left since the cache was loaded.
+func (c *UserCache) AllRooms() map[string]UserRoomData {
+	c.roomToDataMu.RLock()
+	defer c.roomToDataMu.RUnlock()
+	result := make(map[string]UserRoomData, len(c.roomToData))
+	for roomID, urd := range c.roomToData {
+		result[roomID] = urd
+	}
+	return result
+}
+
 type roomUpdateCache struct {
 	roomID string
 	// globalRoomData is a snapshot of the global metadata for this room immediately
@@ -520,6 +629,13 @@ func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	})
 }
 
+func (c *UserCache) OnPresence(ctx context.Context, presence internal.Presence, roomIDs []string) {
+	c.emitOnUpdate(ctx, &PresenceUpdate{
+		Presence: presence,
+		RoomIDs:  roomIDs,
+	})
+}
+
 func (c *UserCache) emitOnRoomUpdate(ctx context.Context, update RoomUpdate) {
 	c.listenersMu.RLock()
 	var listeners []UserCacheListener
@@ -572,6 +688,35 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
+// OnThreadUnreadCounts replaces the thread counts for this room. Threads missing from the map have
+// no unread notifications.
+func (c *UserCache) OnThreadUnreadCounts(ctx context.Context, roomID string, threads map[string]internal.ThreadUnreadCounts) {
+	data := c.LoadRoomData(roomID)
+	changed := make(map[string]internal.ThreadUnreadCounts)
+	for threadID := range data.ThreadUnreadCounts {
+		if _, exists := threads[threadID]; !exists {
+			changed[threadID] = internal.ThreadUnreadCounts{} // this thread has been read
+		}
+	}
+	for threadID, counts := range threads {
+		if data.ThreadUnreadCounts[threadID] != counts {
+			changed[threadID] = counts
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	data.ThreadUnreadCounts = threads
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = data
+	c.roomToDataMu.Unlock()
+
+	c.emitOnRoomUpdate(ctx, &ThreadUnreadCountUpdate{
+		RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		Threads:    changed,
+	})
+}
+
 func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID string, isDeleted bool, eventData *EventData) {
 	childURD := c.LoadRoomData(childRoomID)
 	if isDeleted {
@@ -622,11 +767,20 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
-func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEvents []json.RawMessage) {
+// OnInvite is called when the user is invited to a room. summary is the room summary fetched from the
+// upstream, or nil if there isn't one.
+func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEvents []json.RawMessage, summary *internal.RoomSummary) {
 	inviteData := NewInviteData(ctx, c.UserID, roomID, inviteStateEvents)
 	if inviteData == nil {
 		return // malformed invite
 	}
+	inviteData.Summary = summary
+	if c.ShouldIgnore(inviteData.InviteEvent.Sender) {
+		// invites from ignored users are never sent to the client
+		logger.Trace().Str("user", c.UserID).Str("room", roomID).Msg("dropping invite from ignored user")
+		return
+	}
+	inviteData.enrich(ctx, c.globalCache)
 
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
@@ -698,6 +852,14 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 	c.emitOnRoomUpdate(ctx, up)
 }
 
+// OnForgetRoom drops everything held about the user in a room they have forgotten. Forgotten rooms
+// have been left, so they are already not in any lists.
+func (c *UserCache) OnForgetRoom(ctx context.Context, roomID string) {
+	c.roomToDataMu.Lock()
+	delete(c.roomToData, roomID)
+	c.roomToDataMu.Unlock()
+}
+
 func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData) {
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
@@ -738,7 +900,12 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				tagUpdates[d.RoomID] = make(map[string]float64)
 			}
 			content.ForEach(func(k, v gjson.Result) bool {
-				tagUpdates[d.RoomID][k.Str] = v.Get("order").Float()
+				// rooms without an order go after rooms with one, and orders are between 0 and 1
+				order := 1.0
+				if o := v.Get("order"); o.Type == gjson.Number {
+					order = o.Float()
+				}
+				tagUpdates[d.RoomID][k.Str] = order
 				return true
 			})
 		case "m.ignored_user_list":
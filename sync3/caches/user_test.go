@@ -7,7 +7,12 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -129,3 +134,229 @@ func convertIDTxnToEventStub(sender string, roomToEventIDs map[string][][2]strin
 	}
 	return result
 }
+
+func TestInviteDataWithSummary(t *testing.T) {
+	alice := "@alice:localhost"
+	roomID := "!remote:example.com"
+	inviteState := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@bob:example.com","content":{"membership":"invite"},"origin_server_ts":123}`),
+		json.RawMessage(`{"type":"m.room.name","state_key":"","sender":"@bob:example.com","content":{"name":"From invite"}}`),
+	}
+	inviteData := caches.NewInviteData(context.Background(), alice, roomID, inviteState)
+	if inviteData == nil {
+		t.Fatalf("NewInviteData returned nil")
+	}
+	metadata := inviteData.RoomMetadata()
+	if metadata.JoinCount != 1 || metadata.AvatarEvent != "" || metadata.JoinRule != "" || inviteData.Topic() != "" {
+		t.Fatalf("invite without summary: got join count %d avatar %q join rule %q topic %q", metadata.JoinCount, metadata.AvatarEvent, metadata.JoinRule, inviteData.Topic())
+	}
+
+	inviteData.Summary = &internal.RoomSummary{
+		RoomID:           roomID,
+		Name:             "From summary",
+		Topic:            "A topic",
+		AvatarURL:        "mxc://example.com/avatar",
+		NumJoinedMembers: 42,
+		JoinRule:         "public",
+	}
+	metadata = inviteData.RoomMetadata()
+	if metadata.NameEvent != "From invite" {
+		t.Errorf("got name %q, want the name from invite_state", metadata.NameEvent)
+	}
+	if metadata.AvatarEvent != "mxc://example.com/avatar" {
+		t.Errorf("got avatar %q, want the avatar from the summary", metadata.AvatarEvent)
+	}
+	if metadata.JoinCount != 42 {
+		t.Errorf("got join count %d want 42", metadata.JoinCount)
+	}
+	if inviteData.Topic() != "A topic" {
+		t.Errorf("got topic %q want 'A topic'", inviteData.Topic())
+	}
+	if metadata.JoinRule != "public" {
+		t.Errorf("got join rule %q, want the join rule from the summary", metadata.JoinRule)
+	}
+
+	// the join rule from invite_state takes precedence over the summary
+	inviteState = append(inviteState, json.RawMessage(`{"type":"m.room.join_rules","state_key":"","sender":"@bob:example.com","content":{"join_rule":"knock"}}`))
+	inviteData = caches.NewInviteData(context.Background(), alice, roomID, inviteState)
+	inviteData.Summary = &internal.RoomSummary{RoomID: roomID, JoinRule: "public"}
+	if metadata = inviteData.RoomMetadata(); metadata.JoinRule != "knock" {
+		t.Errorf("got join rule %q, want the join rule from invite_state", metadata.JoinRule)
+	}
+}
+
+type updateCollector struct {
+	updates []caches.Update
+}
+
+func (c *updateCollector) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	c.updates = append(c.updates, up)
+}
+
+func (c *updateCollector) OnUpdate(ctx context.Context, up caches.Update) {
+	c.updates = append(c.updates, up)
+}
+
+func TestOnThreadUnreadCounts(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!threads:localhost"
+	uc := caches.NewUserCache("@alice:localhost", caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	collector := &updateCollector{}
+	uc.Subsribe(collector)
+
+	assertUpdate := func(wantThreads map[string]internal.ThreadUnreadCounts) {
+		t.Helper()
+		if wantThreads == nil {
+			if len(collector.updates) != 0 {
+				t.Fatalf("got %d updates, want none", len(collector.updates))
+			}
+			return
+		}
+		if len(collector.updates) != 1 {
+			t.Fatalf("got %d updates, want 1", len(collector.updates))
+		}
+		up, ok := collector.updates[0].(*caches.ThreadUnreadCountUpdate)
+		if !ok {
+			t.Fatalf("got update %s, want a ThreadUnreadCountUpdate", collector.updates[0].Type())
+		}
+		if !reflect.DeepEqual(up.Threads, wantThreads) {
+			t.Errorf("got threads %v want %v", up.Threads, wantThreads)
+		}
+		collector.updates = nil
+	}
+
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$root1": {NotificationCount: 1},
+		"$root2": {NotificationCount: 2, HighlightCount: 1},
+	})
+	assertUpdate(map[string]internal.ThreadUnreadCounts{
+		"$root1": {NotificationCount: 1},
+		"$root2": {NotificationCount: 2, HighlightCount: 1},
+	})
+
+	// only changed threads are sent, and read threads are sent with zero counts
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$root2": {NotificationCount: 3, HighlightCount: 1},
+	})
+	assertUpdate(map[string]internal.ThreadUnreadCounts{
+		"$root1": {},
+		"$root2": {NotificationCount: 3, HighlightCount: 1},
+	})
+	if got := uc.LoadRoomData(roomID).ThreadUnreadCounts; len(got) != 1 {
+		t.Errorf("got stored threads %v want only $root2", got)
+	}
+
+	// the same counts send nothing
+	uc.OnThreadUnreadCounts(ctx, roomID, map[string]internal.ThreadUnreadCounts{
+		"$root2": {NotificationCount: 3, HighlightCount: 1},
+	})
+	assertUpdate(nil)
+}
+
+func TestOnInviteFromIgnoredUser(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	uc := caches.NewUserCache(alice, caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	uc.OnAccountData(ctx, []state.AccountData{{
+		UserID: alice,
+		RoomID: state.AccountDataGlobalRoom,
+		Type:   "m.ignored_user_list",
+		Data:   []byte(`{"type":"m.ignored_user_list","content":{"ignored_users":{"@spammer:localhost":{}}}}`),
+	}})
+	collector := &updateCollector{}
+	uc.Subsribe(collector)
+	inviteState := func(sender string) []json.RawMessage {
+		return []json.RawMessage{json.RawMessage(fmt.Sprintf(
+			`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"invite"},"origin_server_ts":123}`, alice, sender,
+		))}
+	}
+
+	uc.OnInvite(ctx, "!spam:localhost", inviteState("@spammer:localhost"), nil)
+	if len(collector.updates) != 0 {
+		t.Errorf("got %d updates for an invite from an ignored user, want none", len(collector.updates))
+	}
+	if uc.LoadRoomData("!spam:localhost").IsInvite {
+		t.Errorf("invite from an ignored user was stored")
+	}
+
+	uc.OnInvite(ctx, "!friend:localhost", inviteState("@bob:localhost"), nil)
+	if len(collector.updates) != 1 {
+		t.Fatalf("got %d updates for an invite, want 1", len(collector.updates))
+	}
+	if _, ok := collector.updates[0].(*caches.InviteUpdate); !ok {
+		t.Errorf("got update %s, want an InviteUpdate", collector.updates[0].Type())
+	}
+	if !uc.LoadRoomData("!friend:localhost").IsInvite {
+		t.Errorf("invite was not stored")
+	}
+}
+
+func TestOnInviteEnrichesInviteState(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	roomID := "!TestOnInviteEnrichesInviteState:localhost"
+	// bob and charlie are in the room, so the proxy knows it
+	_, err := store.Accumulate(bob, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Known name"}),
+		testutils.NewStateEvent(t, "m.room.avatar", "", bob, map[string]interface{}{"url": "mxc://localhost/known"}),
+		testutils.NewStateEvent(t, "m.room.encryption", "", bob, map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}),
+		testutils.NewStateEvent(t, "m.room.history_visibility", "", bob, map[string]interface{}{"history_visibility": "joined"}),
+		testutils.NewJoinEvent(t, charlie),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		t.Fatalf("GlobalSnapshot: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	if err = globalCache.Startup(snapshot.GlobalMetadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+
+	uc := caches.NewUserCache(alice, globalCache, nil, &txnIDFetcher{}, &joinChecker{})
+	collector := &updateCollector{}
+	uc.Subsribe(collector)
+	// the invite has a name, which takes precedence, but nothing else
+	uc.OnInvite(ctx, roomID, []json.RawMessage{
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"invite"},"origin_server_ts":123}`, alice, bob)),
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.name","state_key":"","sender":"%s","content":{"name":"Invite name"}}`, bob)),
+	}, nil)
+	if len(collector.updates) != 1 {
+		t.Fatalf("got %d updates for an invite, want 1", len(collector.updates))
+	}
+	inviteData := uc.LoadRoomData(roomID).Invite
+	gotTypes := make(map[string]int)
+	for _, ev := range inviteData.InviteState {
+		gotTypes[gjson.GetBytes(ev, "type").Str]++
+	}
+	wantTypes := map[string]int{"m.room.member": 1, "m.room.name": 1, "m.room.avatar": 1, "m.room.encryption": 1}
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Errorf("got invite_state types %v want %v", gotTypes, wantTypes)
+	}
+	metadata := inviteData.RoomMetadata()
+	if metadata.NameEvent != "Invite name" {
+		t.Errorf("got name %q, want the name from invite_state", metadata.NameEvent)
+	}
+	if metadata.AvatarEvent != "mxc://localhost/known" || !metadata.Encrypted {
+		t.Errorf("got avatar %q encrypted %v, want them from the known room", metadata.AvatarEvent, metadata.Encrypted)
+	}
+	if metadata.JoinCount != 2 {
+		t.Errorf("got join count %d want 2", metadata.JoinCount)
+	}
+
+	// invites to unknown rooms are left alone
+	uc.OnInvite(ctx, "!unknown:localhost", []json.RawMessage{
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"invite"},"origin_server_ts":123}`, alice, bob)),
+	}, nil)
+	if got := uc.LoadRoomData("!unknown:localhost").Invite; len(got.InviteState) != 1 || got.RoomMetadata().JoinCount != 1 {
+		t.Errorf("invite to an unknown room: got %d invite_state events and join count %d", len(got.InviteState), got.RoomMetadata().JoinCount)
+	}
+}
@@ -2,9 +2,11 @@ package sync3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -16,6 +18,10 @@ import (
 // /sync?pos=5 then /sync?pos=5 over and over. Likewise /sync without a ?pos=.
 var SpamProtectionInterval = 10 * time.Millisecond
 
+// errSupersededRequest is the cause of the context of a request which was cancelled by a newer
+// request on the same connection.
+var errSupersededRequest = errors.New("request was superseded by a newer request on this connection")
+
 type ConnID struct {
 	UserID   string
 	DeviceID string
@@ -59,6 +65,14 @@ type Conn struct {
 	serverResponses []Response
 	lastPos         int64
 
+	// true if the client has opted into strict request validation for this connection
+	strict bool
+
+	createdAt time.Time
+	// lastRequestTS is when the client last made a request on this connection in unix millis, used
+	// to pick which connection to evict when a device or user has too many.
+	lastRequestTS atomic.Int64
+
 	// ensure only 1 incoming request is handled per connection
 	mu                         *sync.Mutex
 	cancelOutstandingRequest   func()
@@ -66,12 +80,25 @@ type Conn struct {
 }
 
 func NewConn(connID ConnID, h ConnHandler) *Conn {
-	return &Conn{
+	c := &Conn{
 		ConnID:                     connID,
 		handler:                    h,
+		createdAt:                  time.Now(),
 		mu:                         &sync.Mutex{},
 		cancelOutstandingRequestMu: &sync.Mutex{},
 	}
+	c.lastRequestTS.Store(c.createdAt.UnixMilli())
+	return c
+}
+
+// CreatedAt returns when this connection was made.
+func (c *Conn) CreatedAt() time.Time {
+	return c.createdAt
+}
+
+// LastRequest returns when the client last made a request on this connection.
+func (c *Conn) LastRequest() time.Time {
+	return time.UnixMilli(c.lastRequestTS.Load())
 }
 
 func (c *Conn) Alive() bool {
@@ -131,10 +158,15 @@ func (c *Conn) isOutstanding(pos int64) bool {
 }
 
 // OnIncomingRequest advances the client's position in the stream, returning the response position and data.
+// Each response echoes the txn_id of the request it was built for. A request which only changes
+// the txn_id is answered by the buffered response with the new txn_id. Other requests which arrive
+// whilst responses are buffered are sent the buffered responses first, with their own txn_ids, so
+// the client has to wait for a later response to see its txn_id echoed.
 // If an error is returned, it will be logged by the caller and transmitted to the
 // client. It will NOT be reported to Sentry---this should happen as close as possible
 // to the creation of the error (or else Sentry cannot provide a meaningful traceback.)
 func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.Time) (resp *Response, herr *internal.HandlerError) {
+	c.lastRequestTS.Store(time.Now().UnixMilli())
 	ctx, span := internal.StartSpan(ctx, "OnIncomingRequest.AcquireMutex")
 	c.cancelOutstandingRequestMu.Lock()
 	if c.cancelOutstandingRequest != nil {
@@ -142,10 +174,12 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	}
 	c.cancelOutstandingRequestMu.Unlock()
 	c.mu.Lock()
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
 
 	c.cancelOutstandingRequestMu.Lock()
-	c.cancelOutstandingRequest = cancel
+	c.cancelOutstandingRequest = func() {
+		cancel(errSupersededRequest)
+	}
 	c.cancelOutstandingRequestMu.Unlock()
 	// it's intentional for the lock to be held whilst inside HandleIncomingRequest
 	// as it guarantees linearisation of data within a single connection
@@ -154,8 +188,33 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 
 	isFirstRequest := req.pos == 0
 	isRetransmit := !isFirstRequest && c.lastClientRequest.pos == req.pos
+	// A request which only changes the txn_id is the same request: the buffered response already
+	// answers it, so it is sent with the new txn_id rather than building another response.
 	isSameRequest := !isFirstRequest && c.lastClientRequest.Same(req)
 
+	// the toggle only sticks once the request which sets it passes validation
+	strict := c.strict
+	if req.Strict != nil {
+		strict = *req.Strict
+	}
+	if strict {
+		if herr := req.ValidateStrict(); herr != nil {
+			return nil, herr
+		}
+	}
+	c.strict = strict
+
+	if isFirstRequest && c.resumableInitial(req) {
+		// the client gave up waiting for the initial response, e.g it timed out whilst we were building
+		// it for a large account. Send the response we built rather than building it all again.
+		logger.Info().Str("conn", c.ConnID.String()).Msg("resuming initial response which the client never received")
+		// the initial response now answers this request, so echo its txn_id, including on retransmits
+		c.serverResponses[0].TxnID = req.TxnID
+		c.lastClientRequest.TxnID = req.TxnID
+		resp := c.serverResponses[0]
+		return &resp, nil
+	}
+
 	// if there is a position and it isn't something we've told the client nor a retransmit, they
 	// are playing games
 	if !isFirstRequest && !isRetransmit && !c.isOutstanding(req.pos) {
@@ -192,17 +251,19 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	if !isFirstRequest {
 		if isRetransmit {
 			// if the request bodies match up then this is a retry, else it could be the client modifying
-			// their filter params, so fallthrough
-			if isSameRequest {
+			// their filter params, so fallthrough. If nothing is buffered, the last response was a
+			// keepalive which kept this pos, so fallthrough to wait for new data.
+			if isSameRequest && nextUnACKedResponse != nil {
 				// this is the 2nd+ time we've seen this request, meaning the client likely retried this
 				// request. Send the response we sent before.
 				logger.Trace().Int64("pos", req.pos).Msg("returning cached response for pos, with delay")
 				// apply a small artificial wait to protect the proxy in case this is caused by a buggy
 				// client sending the same request over and over
 				time.Sleep(SpamProtectionInterval)
+				echoTxnID(nextUnACKedResponse, req)
 				return nextUnACKedResponse, nil
-			} else {
-				logger.Info().Int64("pos", req.pos).Msg("client has resent this pos with different request data")
+			} else if !isSameRequest {
+				logger.Info().Int64("pos", req.pos).Msg("client has resent this pos with different request data or txn_id")
 				// we need to fallthrough to process this request as the client will not resend this request data,
 			}
 		}
@@ -212,6 +273,7 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// invoking the handler.
 	if nextUnACKedResponse != nil {
 		if isSameRequest {
+			echoTxnID(nextUnACKedResponse, req)
 			return nextUnACKedResponse, nil
 		}
 		// we have buffered responses but we cannot return it else we'll ignore the data in this request,
@@ -235,6 +297,15 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// assign the last client request now _after_ we have processed the request so we don't incorrectly
 	// cache errors or panics and result in getting wedged or tightlooping.
 	c.lastClientRequest = *req
+	if req.keepalive && !isFirstRequest && nextUnACKedResponse == nil &&
+		resp.ListOps() == 0 && len(resp.Rooms) == 0 && !resp.Extensions.HasData(false) {
+		// nothing happened before the keepalive, so there is nothing to resend if this response is
+		// lost. Keep the client's pos rather than buffering it, so that the client's next request
+		// with this pos carries on waiting for new data.
+		resp.Pos = fmt.Sprintf("%d", req.pos)
+		resp.TxnID = req.TxnID
+		return resp, nil
+	}
 	// this position is the highest stored pos +1
 	resp.Pos = fmt.Sprintf("%d", c.lastPos+1)
 	resp.TxnID = req.TxnID
@@ -244,11 +315,47 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	if nextUnACKedResponse == nil {
 		nextUnACKedResponse = resp
 	}
+	if isFirstRequest && context.Cause(ctx) == errSupersededRequest {
+		// a retry of this initial request cancelled us whilst we were building the response, and is
+		// waiting to resume it. Only the retry may send it, else the client sees pos 1 twice.
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        errSupersededRequest,
+		}
+	}
 
 	// return the oldest value
 	return nextUnACKedResponse, nil
 }
 
+// echoTxnID makes the buffered response resp answer req, which is the same as the request resp
+// was built for apart from its txn_id.
+func echoTxnID(resp *Response, req *Request) {
+	if req.TxnID != "" {
+		resp.TxnID = req.TxnID
+	}
+}
+
+// ResumableInitial returns true if this connection has built an initial response for the same request
+// which the client never acknowledged, so the client can be sent it rather than making a new
+// connection. Cancels any outstanding request, and waits for it to finish. A cancelled request which
+// was building the initial response still buffers it, so it can be resumed, but does not send it.
+func (c *Conn) ResumableInitial(req *Request) bool {
+	c.cancelOutstandingRequestMu.Lock()
+	if c.cancelOutstandingRequest != nil {
+		c.cancelOutstandingRequest()
+	}
+	c.cancelOutstandingRequestMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumableInitial(req)
+}
+
+// resumableInitial is like ResumableInitial but requires mu to be held.
+func (c *Conn) resumableInitial(req *Request) bool {
+	return c.lastPos == 1 && len(c.serverResponses) == 1 && c.lastClientRequest.pos == 0 && c.lastClientRequest.Same(req)
+}
+
 func (c *Conn) SetCancelCallback(cancel context.CancelFunc) {
 	c.handler.SetCancelCallback(cancel)
 }
@@ -245,6 +245,61 @@ func TestConnErrors(t *testing.T) {
 	}
 }
 
+// Test that strict validation is only applied once the client opts in, and that the
+// toggle persists across requests on the same connection.
+func TestConnStrictMode(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		return &Response{}, nil
+	}})
+	badReq := func(pos int64, strict *bool) *Request {
+		return &Request{
+			pos: pos,
+			Lists: map[string]RequestList{
+				"a": {Sort: []string{"by_magic"}},
+			},
+			Strict: strict,
+		}
+	}
+	goodReq := func(pos int64, strict *bool) *Request {
+		return &Request{
+			pos:    pos,
+			Strict: strict,
+		}
+	}
+	yes := true
+	no := false
+
+	// not strict by default
+	resp, herr := c.OnIncomingRequest(ctx, badReq(0, nil), time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+	// opting in rejects the request
+	_, herr = c.OnIncomingRequest(ctx, badReq(1, &yes), time.Now())
+	if herr == nil || herr.ErrCode != "M_INVALID_PARAM" {
+		t.Fatalf("expected M_INVALID_PARAM, got %v", herr)
+	}
+	// a rejected request doesn't change the toggle
+	resp, herr = c.OnIncomingRequest(ctx, badReq(1, nil), time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	// opting in with a valid request makes the toggle sticky
+	resp, herr = c.OnIncomingRequest(ctx, goodReq(2, &yes), time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 3)
+	_, herr = c.OnIncomingRequest(ctx, badReq(3, nil), time.Now())
+	if herr == nil || herr.ErrCode != "M_INVALID_PARAM" {
+		t.Fatalf("expected M_INVALID_PARAM, got %v", herr)
+	}
+	// and can be turned off again
+	resp, herr = c.OnIncomingRequest(ctx, badReq(3, &no), time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 4)
+}
+
 func TestConnErrorsNoCache(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -373,6 +428,171 @@ func TestConnBufferRememberInflight(t *testing.T) {
 	}
 }
 
+// Test that an initial response which the client never received is resumed rather than rebuilt when
+// the client retries the same initial request.
+func TestConnResumableInitial(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	numBuilds := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		numBuilds++
+		return &Response{
+			Lists: map[string]ResponseList{
+				"a": {
+					Count: numBuilds,
+				},
+			},
+		}, nil
+	}})
+	initialReq := func(txnID string) *Request {
+		return &Request{
+			TxnID: txnID,
+			Lists: map[string]RequestList{
+				"a": {Ranges: SliceRanges{{0, 10}}},
+			},
+		}
+	}
+	// the client times out before it gets this response
+	_, err := c.OnIncomingRequest(ctx, initialReq("1"), time.Now())
+	assertNoError(t, err)
+
+	if !c.ResumableInitial(initialReq("2")) {
+		t.Fatalf("ResumableInitial: got false for the same initial request")
+	}
+	if c.ResumableInitial(&Request{}) {
+		t.Fatalf("ResumableInitial: got true for a different initial request")
+	}
+	resp, err := c.OnIncomingRequest(ctx, initialReq("2"), time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 1)
+	assertInt(t, resp.Lists["a"].Count, 1)
+	assertInt(t, numBuilds, 1)
+	if resp.TxnID != "2" {
+		t.Errorf("resumed initial response: got txn_id %q want 2", resp.TxnID)
+	}
+
+	// once the client has acknowledged the initial response, it can't be resumed
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	if c.ResumableInitial(initialReq("3")) {
+		t.Fatalf("ResumableInitial: got true after the initial response was acknowledged")
+	}
+}
+
+// Test that a retry which arrives whilst the initial response is still being built waits for it and
+// resumes it, and that the cancelled request does not send the response as well.
+func TestConnResumableInitialWhilstBuilding(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	building := make(chan struct{})
+	numBuilds := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		numBuilds++
+		close(building)
+		// the build finishes even though the client gave up on this request
+		<-ctx.Done()
+		return &Response{
+			Lists: map[string]ResponseList{
+				"a": {Count: 1},
+			},
+		}, nil
+	}})
+	initialReq := func(txnID string) *Request {
+		return &Request{
+			TxnID: txnID,
+			Lists: map[string]RequestList{
+				"a": {Ranges: SliceRanges{{0, 10}}},
+			},
+		}
+	}
+	type result struct {
+		resp *Response
+		herr *internal.HandlerError
+	}
+	cancelledResult := make(chan result, 1)
+	go func() {
+		resp, herr := c.OnIncomingRequest(ctx, initialReq("1"), time.Now())
+		cancelledResult <- result{resp, herr}
+	}()
+	<-building
+
+	if !c.ResumableInitial(initialReq("2")) {
+		t.Fatalf("ResumableInitial: got false for the same initial request")
+	}
+	resp, err := c.OnIncomingRequest(ctx, initialReq("2"), time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 1)
+	assertInt(t, numBuilds, 1)
+	if resp.TxnID != "2" {
+		t.Errorf("resumed initial response: got txn_id %q want 2", resp.TxnID)
+	}
+
+	res := <-cancelledResult
+	if res.resp != nil {
+		t.Errorf("cancelled request sent the initial response as well: %+v", res.resp)
+	}
+	if res.herr == nil {
+		t.Errorf("cancelled request returned no error")
+	}
+}
+
+// Test that each response echoes the txn_id of the request it answers, and that a request which
+// only changes the txn_id gets its own response.
+func TestConnTxnID(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{Rooms: map[string]Room{"!a": {Name: "A"}}}, nil
+	}})
+	assertTxnID := func(resp *Response, wantPos int, wantTxnID string) {
+		t.Helper()
+		assertPos(t, resp.Pos, wantPos)
+		if resp.TxnID != wantTxnID {
+			t.Errorf("pos %s: got txn_id %q want %q", resp.Pos, resp.TxnID, wantTxnID)
+		}
+	}
+	resp, err := c.OnIncomingRequest(ctx, &Request{TxnID: "a"}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 1, "a")
+
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "b"}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 2, "b")
+
+	// the client lost the response, so retries the same request
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "b"}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 2, "b")
+
+	// the client retries with a new txn_id: the buffered response answers it
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "c"}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 2, "c")
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 3, "")
+
+	// the client lost that response, and retries with a new txn_id and a new timeline limit: the
+	// buffered response is sent first, then one for it
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 2, TxnID: "d", Lists: map[string]RequestList{
+		"a": {RoomSubscription: RoomSubscription{TimelineLimit: 5}},
+	}}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 3, "")
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 3, Lists: map[string]RequestList{
+		"a": {RoomSubscription: RoomSubscription{TimelineLimit: 5}},
+	}}, time.Now())
+	assertNoError(t, err)
+	assertTxnID(resp, 4, "d")
+}
+
 func assertPos(t *testing.T, pos string, wantPos int) {
 	t.Helper()
 	gotPos, err := strconv.Atoi(pos)
@@ -396,3 +616,55 @@ func assertNoError(t *testing.T, err *internal.HandlerError) {
 		t.Fatalf("got error: %v", err)
 	}
 }
+
+// Test that keepalive responses with no data keep the client's pos, and that the client can then
+// carry on long polling with that pos.
+func TestConnKeepaliveKeepsPos(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	hasData := false
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		callCount += 1
+		if init || hasData {
+			return &Response{Rooms: map[string]Room{"!a": {Name: "A"}}}, nil
+		}
+		return &Response{}, nil
+	}})
+	resp, err := c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 1)
+
+	// nothing happens before the keepalive, twice
+	for i := 0; i < 2; i++ {
+		req := &Request{pos: 1}
+		req.SetKeepalive(true)
+		resp, err = c.OnIncomingRequest(ctx, req, time.Now())
+		assertNoError(t, err)
+		assertPos(t, resp.Pos, 1)
+		assertInt(t, callCount, 2+i)
+	}
+
+	// then something happens
+	hasData = true
+	req := &Request{pos: 1}
+	req.SetKeepalive(true)
+	resp, err = c.OnIncomingRequest(ctx, req, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, len(resp.Rooms), 1)
+
+	// retrying returns the buffered response without invoking the handler
+	resp, err = c.OnIncomingRequest(ctx, req, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, callCount, 4)
+
+	// empty responses which were not cut short by a keepalive still use up a position
+	hasData = false
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 3)
+}
@@ -12,6 +12,34 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// EvictionReason is why a connection was closed by the ConnMap.
+type EvictionReason string
+
+const (
+	// EvictionTimedOut is when a connection was not used for longer than the TTL.
+	EvictionTimedOut EvictionReason = "timed_out"
+	// EvictionBufferFull is when a connection was not used whilst so many updates arrived for it
+	// that its buffer filled up.
+	EvictionBufferFull EvictionReason = "buffer_full"
+	// EvictionReplaced is when a client made a new connection with the same conn_id.
+	EvictionReplaced EvictionReason = "replaced"
+	// EvictionMaxConnsPerDevice and EvictionMaxConnsPerUser are when the least recently used
+	// connection was closed to make room for a new one.
+	EvictionMaxConnsPerDevice EvictionReason = "max_conns_per_device"
+	EvictionMaxConnsPerUser   EvictionReason = "max_conns_per_user"
+	// EvictionTokenExpired is when the access token of a device stopped working.
+	EvictionTokenExpired EvictionReason = "token_expired"
+	// EvictionRoomInvalidated is when the user was in a room whose state was replaced.
+	EvictionRoomInvalidated EvictionReason = "room_invalidated"
+	// EvictionErased is when the user was erased through the admin API.
+	EvictionErased EvictionReason = "erased"
+	// EvictionAdmin is when the connection was closed through the admin API.
+	EvictionAdmin EvictionReason = "admin"
+	// EvictionQueueOverflow is when so many updates were queued for the user between the pollers
+	// and the API that they were dropped, so the user is loaded again from the database.
+	EvictionQueueOverflow EvictionReason = "queue_overflow"
+)
+
 // ConnMap stores a collection of Conns.
 type ConnMap struct {
 	cache *ttlcache.Cache
@@ -20,10 +48,15 @@ type ConnMap struct {
 	userIDToConn map[string][]*Conn
 	connIDToConn map[string]*Conn
 
+	// the most connections each device and user can have at once, or 0 for no limit
+	maxConnsPerDevice int
+	maxConnsPerUser   int
+
 	numConns prometheus.Gauge
 	// counters for reasons why connections have expired
 	expiryTimedOutCounter   prometheus.Counter
 	expiryBufferFullCounter prometheus.Counter
+	evictions               *prometheus.CounterVec
 
 	mu *sync.Mutex
 }
@@ -36,7 +69,7 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 		mu:           &sync.Mutex{},
 	}
 	cm.cache.SetTTL(ttl)
-	cm.cache.SetExpirationCallback(cm.closeConnExpires)
+	cm.cache.SetExpirationReasonCallback(cm.closeConnExpires)
 
 	if enablePrometheus {
 		cm.expiryTimedOutCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -53,6 +86,13 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 			Help:      "Counter of expired API connections due to reaching buffer update limit",
 		})
 		prometheus.MustRegister(cm.expiryBufferFullCounter)
+		cm.evictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "conn_evictions_total",
+			Help:      "Counter of API connections closed by the proxy, by reason.",
+		}, []string{"reason"})
+		prometheus.MustRegister(cm.evictions)
 		cm.numConns = prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "api",
@@ -64,6 +104,21 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 	return cm
 }
 
+// SetTTL sets how long a connection can go without a request before it is closed.
+func (m *ConnMap) SetTTL(ttl time.Duration) {
+	m.cache.SetTTL(ttl)
+}
+
+// SetMaxConns limits how many connections each device and each user can have at once. When a
+// client makes a connection over the limit, the least recently used connection is closed. 0 means
+// no limit.
+func (m *ConnMap) SetMaxConns(perDevice, perUser int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxConnsPerDevice = perDevice
+	m.maxConnsPerUser = perUser
+}
+
 func (m *ConnMap) Teardown() {
 	m.cache.Close()
 
@@ -76,6 +131,9 @@ func (m *ConnMap) Teardown() {
 	if m.expiryTimedOutCounter != nil {
 		prometheus.Unregister(m.expiryTimedOutCounter)
 	}
+	if m.evictions != nil {
+		prometheus.Unregister(m.evictions)
+	}
 }
 
 // UpdateMetrics recalculates the number of active connections. Do this when you think there is a change.
@@ -107,6 +165,45 @@ func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	return conns
 }
 
+// Devices returns the user and device IDs of every device with at least one connection, as
+// parallel slices.
+func (m *ConnMap) Devices() (userIDs, deviceIDs []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, conns := range m.userIDToConn {
+		seen := make(map[string]struct{}, len(conns))
+		for _, conn := range conns {
+			if _, ok := seen[conn.DeviceID]; ok {
+				continue
+			}
+			seen[conn.DeviceID] = struct{}{}
+			userIDs = append(userIDs, userID)
+			deviceIDs = append(deviceIDs, conn.DeviceID)
+		}
+	}
+	return
+}
+
+// ConnsForUser returns all connections for this user, across all devices.
+func (m *ConnMap) ConnsForUser(userID string) []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*Conn, len(m.userIDToConn[userID]))
+	copy(conns, m.userIDToConn[userID])
+	return conns
+}
+
+// AllConns returns every connection.
+func (m *ConnMap) AllConns() []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 // Conn returns a connection with this ConnID. Returns nil if no connection exists.
 func (m *ConnMap) Conn(cid ConnID) *Conn {
 	m.mu.Lock()
@@ -127,10 +224,7 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 	}
 	// e.g buffer exceeded, close it and remove it from the cache
 	logger.Info().Str("conn", cid.String()).Msg("closing connection due to dead connection (buffer full)")
-	m.closeConn(conn)
-	if m.expiryBufferFullCounter != nil {
-		m.expiryBufferFullCounter.Inc()
-	}
+	m.evict(conn, EvictionBufferFull)
 	return nil
 }
 
@@ -150,8 +244,11 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 			time.Sleep(SpamProtectionInterval)
 		}
 		logger.Trace().Str("conn", cid.String()).Bool("spamming", isSpamming).Msg("closing connection due to CreateConn called again")
-		m.closeConn(conn)
+		if m.closeConn(conn) {
+			m.countEviction(EvictionReplaced)
+		}
 	}
+	m.makeRoomForConn(cid)
 	h := newConnHandler()
 	h.SetCancelCallback(cancel)
 	conn = NewConn(cid, h)
@@ -162,19 +259,69 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	return conn
 }
 
+// makeRoomForConn closes the least recently used connections of this device and user until a new
+// connection can be made without going over the limits. Must hold mu.
+func (m *ConnMap) makeRoomForConn(cid ConnID) {
+	if m.maxConnsPerDevice > 0 {
+		for {
+			var deviceConns []*Conn
+			for _, c := range m.userIDToConn[cid.UserID] {
+				if c.DeviceID == cid.DeviceID {
+					deviceConns = append(deviceConns, c)
+				}
+			}
+			if len(deviceConns) < m.maxConnsPerDevice {
+				break
+			}
+			lru := leastRecentlyUsed(deviceConns)
+			logger.Info().Str("conn", lru.String()).Int("max", m.maxConnsPerDevice).Msg("closing connection as the device has too many")
+			m.evict(lru, EvictionMaxConnsPerDevice)
+		}
+	}
+	if m.maxConnsPerUser > 0 {
+		for len(m.userIDToConn[cid.UserID]) >= m.maxConnsPerUser {
+			lru := leastRecentlyUsed(m.userIDToConn[cid.UserID])
+			logger.Info().Str("conn", lru.String()).Int("max", m.maxConnsPerUser).Msg("closing connection as the user has too many")
+			m.evict(lru, EvictionMaxConnsPerUser)
+		}
+	}
+}
+
+func leastRecentlyUsed(conns []*Conn) *Conn {
+	lru := conns[0]
+	for _, c := range conns[1:] {
+		if c.lastRequestTS.Load() < lru.lastRequestTS.Load() {
+			lru = c
+		}
+	}
+	return lru
+}
+
 func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
-	// gather open connections for this user|device
-	connIDs := m.connIDsForDevice(userID, deviceID)
-	for _, cid := range connIDs {
-		err := m.cache.Remove(cid.String()) // this will fire TTL callbacks which calls closeConn
-		if err != nil {
-			logger.Err(err).Str("cid", cid.String()).Msg("CloseConnsForDevice: cid did not exist in ttlcache")
-			internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// evicting conns removes them from this slice, so copy it first
+	for _, conn := range slices.Clone(m.userIDToConn[userID]) {
+		if conn.DeviceID == deviceID {
+			m.evict(conn, EvictionTokenExpired)
 		}
 	}
 }
 
+// CloseConn closes the connection with this ConnID. Returns false if there is no such connection.
+func (m *ConnMap) CloseConn(cid ConnID, reason EvictionReason) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn := m.connIDToConn[cid.String()]
+	if conn == nil {
+		return false
+	}
+	logger.Info().Str("conn", cid.String()).Str("reason", string(reason)).Msg("closing connection due to CloseConn()")
+	m.evict(conn, reason)
+	return true
+}
+
 func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -190,60 +337,102 @@ func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
 
 // CloseConnsForUsers closes all conns for a given slice of users. Returns the number of
 // conns closed.
-func (m *ConnMap) CloseConnsForUsers(userIDs []string) (closed int) {
+func (m *ConnMap) CloseConnsForUsers(userIDs []string, reason EvictionReason) (closed int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for _, userID := range userIDs {
-		conns := m.userIDToConn[userID]
+		// evicting conns removes them from this slice, so copy it first
+		conns := slices.Clone(m.userIDToConn[userID])
 		logger.Trace().Str("user", userID).Int("num_conns", len(conns)).Msg("closing all device connections due to CloseConn()")
 
 		for _, conn := range conns {
-			err := m.cache.Remove(conn.String()) // this will fire TTL callbacks which calls closeConn
-			if err != nil {
-				logger.Err(err).Str("cid", conn.String()).Msg("CloseConnsForDevice: cid did not exist in ttlcache")
-				internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
-			}
+			m.evict(conn, reason)
 		}
 		closed += len(conns)
 	}
 	return closed
 }
 
-func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
+// closeConnExpires is called asynchronously by the ttlcache when a conn is removed from it.
+func (m *ConnMap) closeConnExpires(connID string, reason ttlcache.EvictionReason, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	conn := value.(*Conn)
+	if reason != ttlcache.Expired {
+		// removed by evict, which has already closed it, or the cache was closed
+		m.closeConn(conn)
+		return
+	}
 	logger.Info().Str("conn", connID).Msg("closing connection due to expired TTL in cache")
-	if m.expiryTimedOutCounter != nil {
-		m.expiryTimedOutCounter.Inc()
+	if m.closeConn(conn) {
+		m.countEviction(EvictionTimedOut)
 	}
-	m.closeConn(conn)
 }
 
-// must hold mu
-func (m *ConnMap) closeConn(conn *Conn) {
+// evict closes the connection and removes it from the cache. Must hold mu.
+func (m *ConnMap) evict(conn *Conn, reason EvictionReason) {
+	// the ttlcache calls closeConnExpires in a goroutine, which is a no-op as the conn is closed here
+	err := m.cache.Remove(conn.String())
+	if err != nil && err != ttlcache.ErrNotFound {
+		logger.Err(err).Str("cid", conn.String()).Msg("evict: failed to remove conn from ttlcache")
+		internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+	}
+	if m.closeConn(conn) {
+		m.countEviction(reason)
+	}
+}
+
+func (m *ConnMap) countEviction(reason EvictionReason) {
+	if m.evictions != nil {
+		m.evictions.WithLabelValues(string(reason)).Inc()
+	}
+	switch reason {
+	case EvictionTimedOut:
+		if m.expiryTimedOutCounter != nil {
+			m.expiryTimedOutCounter.Inc()
+		}
+	case EvictionBufferFull:
+		if m.expiryBufferFullCounter != nil {
+			m.expiryBufferFullCounter.Inc()
+		}
+	}
+}
+
+// closeConn removes the conn from the maps and destroys it. Returns false if the conn was already
+// closed, which happens when the ttlcache callback fires for a conn which was closed directly.
+// Must hold mu.
+func (m *ConnMap) closeConn(conn *Conn) bool {
 	if conn == nil {
-		return
+		return false
 	}
 
 	connKey := conn.ConnID.String()
+	// the conn may have been replaced by a new conn with the same ID, which must be left alone
+	if m.connIDToConn[connKey] != conn {
+		return false
+	}
 	logger.Trace().Str("conn", connKey).Msg("closing connection")
 	// remove conn from all the maps
 	delete(m.connIDToConn, connKey)
 	h := conn.handler
 	conns := m.userIDToConn[conn.UserID]
 	for i := 0; i < len(conns); i++ {
-		if conns[i].DeviceID == conn.DeviceID && conns[i].CID == conn.CID {
+		if conns[i] == conn {
 			// delete without preserving order
 			conns[i] = nil // allow GC
 			conns = slices.Delete(conns, i, i+1)
 			i--
 		}
 	}
-	m.userIDToConn[conn.UserID] = conns
+	if len(conns) == 0 {
+		delete(m.userIDToConn, conn.UserID)
+	} else {
+		m.userIDToConn[conn.UserID] = conns
+	}
 	// remove user cache listeners etc
 	h.Destroy()
 	m.updateMetrics(len(m.connIDToConn))
+	return true
 }
 
 func (m *ConnMap) ClearUpdateQueues(userID, roomID string, nid int64) {
@@ -40,6 +40,20 @@ func TestConnMap(t *testing.T) {
 	conns := cm.Conns(cid.UserID, cid.DeviceID)
 	mustEqual(t, len(conns), 1, "Conns length mismatch")
 	mustEqual(t, conns[0], conn, "*Conn wasn't the same when fetched via Conns()[0]")
+
+	// ConnsForUser includes all devices
+	cid2 := ConnID{UserID: alice, DeviceID: "B", CID: "room-list"}
+	conn2 := cm.CreateConn(cid2, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+	conns = cm.ConnsForUser(alice)
+	mustEqual(t, len(conns), 2, "ConnsForUser length mismatch")
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].DeviceID < conns[j].DeviceID
+	})
+	mustEqual(t, conns[0], conn, "ConnsForUser()[0] mismatch")
+	mustEqual(t, conns[1], conn2, "ConnsForUser()[1] mismatch")
+	mustEqual(t, len(cm.ConnsForUser(bob)), 0, "ConnsForUser for unknown user")
 }
 
 func TestConnMap_CloseConnsForDevice(t *testing.T) {
@@ -92,7 +106,7 @@ func TestConnMap_CloseConnsForUser(t *testing.T) {
 		cidToConn[cid] = conn
 	}
 
-	num := cm.CloseConnsForUsers([]string{alice})
+	num := cm.CloseConnsForUsers([]string{alice}, EvictionErased)
 	time.Sleep(100 * time.Millisecond) // some stuff happens asyncly in goroutines
 	mustEqual(t, num, 6, "unexpected number of closed conns")
 
@@ -228,3 +242,103 @@ func (c *mockConnHandler) Alive() bool {
 func (c *mockConnHandler) SetCancelCallback(cancel context.CancelFunc) {
 	c.cancel = cancel
 }
+
+func TestConnMapDevices(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	defer cm.Teardown()
+	for _, cid := range []ConnID{
+		{UserID: alice, DeviceID: "A", CID: "room-list"},
+		{UserID: alice, DeviceID: "A", CID: "encryption"},
+		{UserID: alice, DeviceID: "B", CID: "room-list"},
+		{UserID: bob, DeviceID: "A", CID: "room-list"},
+	} {
+		_, cancel := context.WithCancel(context.Background())
+		cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+	}
+	userIDs, deviceIDs := cm.Devices()
+	var got []string
+	for i := range userIDs {
+		got = append(got, userIDs[i]+"|"+deviceIDs[i])
+	}
+	sort.Strings(got)
+	want := []string{alice + "|A", alice + "|B", bob + "|A"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Devices: got %v want %v", got, want)
+	}
+}
+
+func TestConnMapMaxConns(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	defer cm.Teardown()
+	cm.SetMaxConns(2, 3)
+	create := func(cid ConnID, lastRequest time.Time) *Conn {
+		_, cancel := context.WithCancel(context.Background())
+		conn := cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+		conn.lastRequestTS.Store(lastRequest.UnixMilli())
+		return conn
+	}
+	now := time.Now()
+	cidToConn := map[ConnID]*Conn{}
+	// the device's least recently used conn is evicted, even though it was made last
+	for i, cid := range []ConnID{
+		{UserID: alice, DeviceID: "A", CID: "room-list"},
+		{UserID: alice, DeviceID: "A", CID: "encryption"},
+	} {
+		cidToConn[cid] = create(cid, now.Add(time.Duration(-i)*time.Minute))
+	}
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "notifications"}
+	cidToConn[cid] = create(cid, now)
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid.CID == "encryption"
+	})
+
+	// the user's least recently used conn is evicted, across devices
+	cid = ConnID{UserID: alice, DeviceID: "B", CID: "room-list"}
+	cidToConn[cid] = create(cid, now.Add(-time.Hour))
+	cid = ConnID{UserID: alice, DeviceID: "C", CID: "room-list"}
+	cidToConn[cid] = create(cid, now)
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid.CID == "encryption" || cid.DeviceID == "B"
+	})
+	mustEqual(t, len(cm.ConnsForUser(alice)), 3, "ConnsForUser length")
+
+	// other users aren't affected
+	cid = ConnID{UserID: bob, DeviceID: "A", CID: "room-list"}
+	cidToConn[cid] = create(cid, now)
+	mustEqual(t, len(cm.ConnsForUser(alice)), 3, "ConnsForUser length")
+	mustEqual(t, len(cm.AllConns()), 4, "AllConns length")
+}
+
+func TestConnMapCloseConn(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	defer cm.Teardown()
+	cidToConn := map[ConnID]*Conn{
+		{UserID: alice, DeviceID: "A", CID: "room-list"}:  nil,
+		{UserID: alice, DeviceID: "A", CID: "encryption"}: nil,
+	}
+	for cid := range cidToConn {
+		_, cancel := context.WithCancel(context.Background())
+		cidToConn[cid] = cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+	}
+	closed := ConnID{UserID: alice, DeviceID: "A", CID: "encryption"}
+	mustEqual(t, cm.CloseConn(closed, EvictionAdmin), true, "CloseConn return value")
+	mustEqual(t, cm.CloseConn(closed, EvictionAdmin), false, "CloseConn return value for closed conn")
+	mustEqual(t, cm.Conn(closed) == nil, true, "closed conn can still be fetched")
+
+	// a new conn with the same ID isn't closed when the ttlcache removal callback runs
+	_, cancel := context.WithCancel(context.Background())
+	cidToConn[closed] = cm.CreateConn(closed, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+	time.Sleep(100 * time.Millisecond) // some stuff happens asyncly in goroutines
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return false
+	})
+	mustEqual(t, cm.Conn(closed), cidToConn[closed], "new conn mismatch")
+}
@@ -3,19 +3,14 @@ package sync3
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleConn)
 
 const DispatcherAllUsers = "-"
 
@@ -24,6 +19,7 @@ type Receiver interface {
 	OnNewEvent(ctx context.Context, event *caches.EventData)
 	OnReceipt(ctx context.Context, receipt internal.Receipt)
 	OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage)
+	OnPresence(ctx context.Context, presence internal.Presence, roomIDs []string)
 	// OnRegistered is called after a successful call to Dispatcher.Register
 	OnRegistered(ctx context.Context) error
 }
@@ -266,6 +262,49 @@ func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	}
 }
 
+// OnPresence notifies every user who shares a room with the user whose presence changed, along
+// with the user themselves.
+func (d *Dispatcher) OnPresence(ctx context.Context, presence internal.Presence) {
+	roomIDs := d.jrt.JoinedRoomsForUser(presence.UserID)
+	notifyUserIDs := map[string]struct{}{
+		presence.UserID: {},
+	}
+	for _, roomID := range roomIDs {
+		userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+			return userID != DispatcherAllUsers
+		})
+		for _, userID := range userIDs {
+			notifyUserIDs[userID] = struct{}{}
+		}
+	}
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	// global listeners (invoke before per-user listeners so caches can update)
+	listener := d.userToReceiver[DispatcherAllUsers]
+	if listener != nil {
+		listener.OnPresence(ctx, presence, roomIDs)
+	}
+
+	// poke user caches OnPresence which then pokes ConnState
+	for userID := range notifyUserIDs {
+		l := d.userToReceiver[userID]
+		if l == nil {
+			continue
+		}
+		l.OnPresence(ctx, presence, roomIDs)
+	}
+}
+
+// JoinedUsersForRoom returns the users joined to this room.
+func (d *Dispatcher) JoinedUsersForRoom(roomID string) []string {
+	userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+	return userIDs
+}
+
 func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData, userIDs []string, targetUser string, shouldForceInitial bool, membership string) {
 	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(userIDs), ed.NID, ed.JoinCount)
 	// invoke listeners
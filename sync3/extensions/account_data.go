@@ -3,6 +3,7 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"strconv"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -12,16 +13,51 @@ import (
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// Types and NotTypes restrict which types of account data are sent, and may contain * which
+	// matches any characters. Every type is sent if Types is empty, and NotTypes take priority.
+	Types    []string `json:"types"`
+	NotTypes []string `json:"not_types"`
+	// Since is the next_batch of an earlier connection. A new connection with a since only sends
+	// the global account data which changed after it, rather than all of it.
+	Since string `json:"since"`
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	// nil means they didn't specify this field, so leave it unchanged.
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+	if next.NotTypes != nil {
+		r.NotTypes = next.NotTypes
+	}
+	if next.Since != "" {
+		r.Since = next.Since
+	}
+}
+
+// filter returns the filter to load account data with, or nil to load every type.
+func (r *AccountDataRequest) filter() *state.AccountDataFilter {
+	if len(r.Types) == 0 && len(r.NotTypes) == 0 {
+		return nil
+	}
+	return &state.AccountDataFilter{
+		Types:    r.Types,
+		NotTypes: r.NotTypes,
+	}
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
 	Rooms  map[string][]json.RawMessage `json:"rooms,omitempty"`
+	// NextBatch is the position of the latest global account data sent, for use as a since.
+	NextBatch string `json:"next_batch,omitempty"`
 	// which rooms have had account data loaded from the DB in this response
 	loadedRooms map[string]bool
 }
@@ -41,15 +77,54 @@ func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
 	return j
 }
 
+// latestAccountDataID returns the highest ID of these account data, or 0 if there are none.
+func latestAccountDataID(events []state.AccountData) int64 {
+	var latest int64
+	for i := range events {
+		if events[i].ID > latest {
+			latest = events[i].ID
+		}
+	}
+	return latest
+}
+
+// setNextBatch advances the next_batch to this account data ID, if it is later.
+func (r *AccountDataResponse) setNextBatch(id int64) {
+	current, _ := strconv.ParseInt(r.NextBatch, 10, 64)
+	if id > current {
+		r.NextBatch = strconv.FormatInt(id, 10)
+	}
+}
+
+// filteredAccountEventsAsJSON is like accountEventsAsJSON but only includes the events which
+// pass the filter.
+func filteredAccountEventsAsJSON(events []state.AccountData, filter *state.AccountDataFilter) []json.RawMessage {
+	if filter == nil {
+		return accountEventsAsJSON(events)
+	}
+	var j []json.RawMessage
+	for i := range events {
+		if filter.Include(events[i].Type) {
+			j = append(j, events[i].Data)
+		}
+	}
+	return j
+}
+
 func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	var globalMsgs []json.RawMessage
+	var globalID int64
 	roomToMsgs := map[string][]json.RawMessage{}
+	filter := r.filter()
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = filteredAccountEventsAsJSON(update.AccountData, filter)
+		globalID = latestAccountDataID(update.AccountData)
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if msgs := filteredAccountEventsAsJSON(update.AccountData, filter); len(msgs) > 0 {
+				roomToMsgs[update.RoomID()] = msgs
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -64,7 +139,7 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				// for the same room, we could send dupe room account data if we didn't do this check.
 				return
 			}
-			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			roomAccountData, err := extCtx.Store.FilteredAccountDatas(extCtx.UserID, filter, update.RoomID())
 			if err != nil {
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -85,6 +160,9 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 		}
 	}
 	res.AccountData.Global = append(res.AccountData.Global, globalMsgs...)
+	if len(globalMsgs) > 0 {
+		res.AccountData.setNextBatch(globalID)
+	}
 	for roomID, roomAccountData := range roomToMsgs {
 		res.AccountData.Rooms[roomID] = append(res.AccountData.Rooms[roomID], roomAccountData...)
 		res.AccountData.loadedRooms[roomID] = true
@@ -107,7 +185,7 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 	// room account data needs to be sent every time the user scrolls the list to get new room IDs
 	// TODO: remember which rooms the client has been told about
 	if len(roomIDs) > 0 {
-		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, roomIDs...)
+		roomsAccountData, err := extCtx.Store.FilteredAccountDatas(extCtx.UserID, r.filter(), roomIDs...)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to fetch room account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -119,17 +197,26 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			}
 		}
 	}
-	// global account data is only sent on the first connection, then we live stream
+	// global account data is only sent on the first connection, then we live stream. If the client
+	// has seen account data on an earlier connection, only send what changed since then.
 	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+		var globalAccountData []state.AccountData
+		var err error
+		if since, parseErr := strconv.ParseInt(r.Since, 10, 64); parseErr == nil && since > 0 {
+			globalAccountData, err = extCtx.Store.AccountDataChangedSince(extCtx.UserID, r.filter(), since)
+			extRes.NextBatch = r.Since
+		} else {
+			globalAccountData, err = extCtx.Store.FilteredAccountDatas(extCtx.UserID, r.filter())
+		}
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Global = accountEventsAsJSON(globalAccountData)
+			extRes.setNextBatch(latestAccountDataID(globalAccountData))
 		}
 	}
-	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 {
+	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 || extRes.NextBatch != "" {
 		res.AccountData = extRes
 	}
 }
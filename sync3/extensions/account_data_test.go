@@ -60,9 +60,11 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		AccountData: []state.AccountData{
 			{
 				Data: []byte(`{"global":"bar"}`),
+				ID:   5,
 			},
 			{
 				Data: []byte(`{"global2":"bar2"}`),
+				ID:   7,
 			},
 		},
 	}
@@ -70,9 +72,11 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		AccountData: []state.AccountData{
 			{
 				Data: []byte(`{"global3":"bar3"}`),
+				ID:   9,
 			},
 			{
 				Data: []byte(`{"global4":"bar4"}`),
+				ID:   8,
 			},
 		},
 	}
@@ -111,4 +115,65 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 	if !reflect.DeepEqual(res.AccountData.Global, wantGlobalAccountData) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
+	// next_batch is the latest global account data
+	if res.AccountData.NextBatch != "9" {
+		t.Errorf("next_batch: got %q want 9", res.AccountData.NextBatch)
+	}
+}
+
+// Test that live account data is filtered by type, and the types are sticky.
+func TestLiveAccountDataFilteredByType(t *testing.T) {
+	boolTrue := true
+	var ext AccountDataRequest
+	ext.ApplyDelta(&AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+		Types:    []string{"m.*", "im.vector.setting.breadcrumbs"},
+		NotTypes: []string{"m.push_rules"},
+	})
+	// omitting the types leaves them unchanged
+	ext.ApplyDelta(&AccountDataRequest{})
+	var res Response
+	var extCtx = Context{
+		AllSubscribedRooms: []string{roomA},
+	}
+	global := &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{
+			{Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)},
+			{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules"}`)},
+			{Type: "im.vector.setting.breadcrumbs", Data: []byte(`{"type":"im.vector.setting.breadcrumbs"}`)},
+			{Type: "im.vector.web.settings", Data: []byte(`{"type":"im.vector.web.settings"}`)},
+		},
+	}
+	room := &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+			globalMetadata: &internal.RoomMetadata{
+				RoomID: roomA,
+			},
+		},
+		AccountData: []state.AccountData{
+			{Type: "org.example.custom", Data: []byte(`{"type":"org.example.custom"}`)},
+		},
+	}
+	ext.AppendLive(ctx, &res, extCtx, room)
+	if res.AccountData != nil {
+		t.Fatalf("got account data for an update with only filtered types: %+v", res.AccountData)
+	}
+	ext.AppendLive(ctx, &res, extCtx, global)
+	if res.AccountData == nil {
+		t.Fatalf("Didn't get account data: %v", res)
+	}
+	wantGlobalAccountData := []json.RawMessage{
+		global.AccountData[0].Data, global.AccountData[2].Data,
+	}
+	if !reflect.DeepEqual(res.AccountData.Global, wantGlobalAccountData) {
+		t.Fatalf("got  %s\nwant %s", res.AccountData.Global, wantGlobalAccountData)
+	}
+	if len(res.AccountData.Rooms) != 0 {
+		t.Fatalf("got room account data %s, want none", res.AccountData.Rooms)
+	}
 }
@@ -3,19 +3,14 @@ package extensions
 
 import (
 	"context"
-	"os"
 	"reflect"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleExtensions)
 
 type GenericRequest interface {
 	// Name provides a name to identify the kind of request. At present, it's only
@@ -165,11 +160,13 @@ type Request struct {
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Presence    *PresenceRequest    `json:"presence"`
+	PushRules   *PushRulesRequest   `json:"push_rules"`
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.PushRules,
 	}
 }
 
@@ -180,6 +177,8 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.Presence = fields[5].(*PresenceRequest)
+	r.PushRules = fields[6].(*PushRulesRequest)
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -196,6 +195,12 @@ func (r Request) EnabledExtensions() (exts []GenericRequest) {
 	return
 }
 
+// WantsEphemeral returns true if the typing or receipts extensions are enabled, which need the
+// poller to fetch ephemeral events.
+func (r Request) WantsEphemeral() bool {
+	return (r.Typing != nil && ExtensionEnabled(r.Typing)) || (r.Receipts != nil && ExtensionEnabled(r.Receipts))
+}
+
 // ApplyDelta applies the `next` request as a delta atop the previous Request r, and
 // returns the result as a new Request.
 func (r Request) ApplyDelta(next *Request) Request {
@@ -242,6 +247,12 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.Presence != nil {
+		r.Presence.InterpretAsInitial()
+	}
+	if r.PushRules != nil {
+		r.PushRules.InterpretAsInitial()
+	}
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
@@ -253,11 +264,13 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Presence    *PresenceResponse    `json:"presence,omitempty"`
+	PushRules   *PushRulesResponse   `json:"push_rules,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.PushRules,
 	}
 }
 
@@ -301,6 +314,13 @@ type Context struct {
 	AllLists []string
 	// AllSubscribedRooms is the slice of room IDs provided to the Room Subscription API.
 	AllSubscribedRooms []string
+	// IsJoined returns true if the user is joined to the room. If nil, the user is assumed to be
+	// joined to every room.
+	IsJoined func(roomID string) bool
+	// IsIgnored returns true if the user has ignored the given user. If nil, nobody is ignored.
+	IsIgnored func(userID string) bool
+	// JoinedUsers returns the users joined to the room. If nil, room members are unknown.
+	JoinedUsers func(roomID string) []string
 }
 
 type HandlerInterface interface {
@@ -312,6 +332,8 @@ type Handler struct {
 	Store       *state.Storage
 	E2EEFetcher E2EEFetcher
 	GlobalCache *caches.GlobalCache
+	// ToDeviceMetrics is nil if metrics are disabled.
+	ToDeviceMetrics *ToDeviceMetrics
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
@@ -15,6 +15,7 @@ var (
 	roomA     = "!a:localhost"
 	roomB     = "!b:localhost"
 	roomC     = "!c:localhost"
+	roomD     = "!d:localhost"
 	ctx       = context.Background()
 )
 
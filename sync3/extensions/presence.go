@@ -0,0 +1,110 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type PresenceRequest struct {
+	Core
+}
+
+func (r *PresenceRequest) Name() string {
+	return "PresenceRequest"
+}
+
+// Server response
+type PresenceResponse struct {
+	Events []json.RawMessage `json:"events,omitempty"`
+	// the index in Events of each sender's presence, so later presence for the same user replaces it
+	senders map[string]int
+}
+
+func (r *PresenceResponse) HasData(isInitial bool) bool {
+	return len(r.Events) > 0
+}
+
+func (r *PresenceResponse) add(userID string, ev json.RawMessage) {
+	if i, ok := r.senders[userID]; ok {
+		r.Events[i] = ev
+		return
+	}
+	if r.senders == nil {
+		r.senders = make(map[string]int)
+	}
+	r.senders[userID] = len(r.Events)
+	r.Events = append(r.Events, ev)
+}
+
+func (r *PresenceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.PresenceUpdate)
+	if !ok {
+		return
+	}
+	if extCtx.IsIgnored != nil && extCtx.IsIgnored(update.Presence.UserID) {
+		return
+	}
+	// the user's own presence is always sent, otherwise they must share a room in scope
+	inScope := update.Presence.UserID == extCtx.UserID
+	for _, roomID := range update.RoomIDs {
+		if inScope {
+			break
+		}
+		inScope = r.RoomInScope(roomID, extCtx)
+	}
+	if !inScope {
+		return
+	}
+	if res.Presence == nil {
+		res.Presence = &PresenceResponse{}
+	}
+	res.Presence.add(update.Presence.UserID, update.Presence.Event(time.Now()))
+}
+
+func (r *PresenceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// Only initial syncs get the stored presence of every member of the rooms being returned.
+	// After that, clients only need changes.
+	if !extCtx.IsInitial || extCtx.JoinedUsers == nil {
+		return
+	}
+	seen := map[string]bool{
+		extCtx.UserID: true,
+	}
+	userIDs := []string{extCtx.UserID}
+	for roomID := range extCtx.RoomIDToTimeline {
+		if !r.RoomInScope(roomID, extCtx) {
+			continue
+		}
+		for _, userID := range extCtx.JoinedUsers(roomID) {
+			if seen[userID] || (extCtx.IsIgnored != nil && extCtx.IsIgnored(userID)) {
+				continue
+			}
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	presences, err := extCtx.Store.PresenceTable.Select(userIDs)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to load presence")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(presences) == 0 {
+		return // don't add a presence extension, no data!
+	}
+	now := time.Now()
+	res.Presence = &PresenceResponse{}
+	// in the same order as userIDs, so the response is stable
+	for _, userID := range userIDs {
+		p, ok := presences[userID]
+		if !ok {
+			continue
+		}
+		res.Presence.add(userID, p.Event(now))
+	}
+}
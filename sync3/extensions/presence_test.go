@@ -0,0 +1,61 @@
+package extensions
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// Test that presence updates are scoped to rooms and aggregated per user.
+func TestLivePresence(t *testing.T) {
+	boolTrue := true
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{roomA},
+		},
+	}
+	extCtx := Context{
+		UserID:             "@me:localhost",
+		AllSubscribedRooms: []string{roomA, roomB},
+		IsIgnored: func(userID string) bool {
+			return userID == "@ignored:localhost"
+		},
+	}
+	var res Response
+	updates := []*caches.PresenceUpdate{
+		{Presence: internal.Presence{UserID: "@alice:localhost", Presence: "online"}, RoomIDs: []string{roomA, roomC}},
+		// roomB is subscribed to, but not in scope of the extension
+		{Presence: internal.Presence{UserID: "@bob:localhost", Presence: "online"}, RoomIDs: []string{roomB}},
+		{Presence: internal.Presence{UserID: "@ignored:localhost", Presence: "online"}, RoomIDs: []string{roomA}},
+		// our own presence, in no rooms
+		{Presence: internal.Presence{UserID: "@me:localhost", Presence: "online"}},
+		// replaces alice's earlier presence
+		{Presence: internal.Presence{UserID: "@alice:localhost", Presence: "offline"}, RoomIDs: []string{roomA, roomC}},
+	}
+	for _, up := range updates {
+		ext.AppendLive(ctx, &res, extCtx, up)
+	}
+	if res.Presence == nil {
+		t.Fatalf("presence response is empty")
+	}
+	want := []struct {
+		userID   string
+		presence string
+	}{
+		{"@alice:localhost", "offline"},
+		{"@me:localhost", "online"},
+	}
+	if len(res.Presence.Events) != len(want) {
+		t.Fatalf("got %d events want %d: %v", len(res.Presence.Events), len(want), res.Presence.Events)
+	}
+	for i, w := range want {
+		ev := gjson.ParseBytes(res.Presence.Events[i])
+		if ev.Get("sender").Str != w.userID || ev.Get("content.presence").Str != w.presence || ev.Get("type").Str != "m.presence" {
+			t.Errorf("event %d: got %s want %s %s", i, ev.Raw, w.userID, w.presence)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type PushRulesRequest struct {
+	Core
+	// sent is the JSON array of each kind of push rule last sent on this connection, or nil if the
+	// client has not been sent its push rules since enabling the extension.
+	sent map[string]string
+}
+
+func (r *PushRulesRequest) Name() string {
+	return "PushRulesRequest"
+}
+
+func (r *PushRulesRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	// changes are not tracked whilst the extension is disabled, so send a snapshot if it is
+	// enabled again.
+	if !ExtensionEnabled(r) {
+		r.sent = nil
+	}
+}
+
+// Server response
+type PushRulesResponse struct {
+	// Global contains the user's push rules by kind, like the response to GET /pushrules/. A snapshot
+	// with every kind is sent first, then only the kinds whose rules have changed. Each kind is sent
+	// in full, so it replaces the client's rules of that kind.
+	Global map[string]json.RawMessage `json:"global,omitempty"`
+}
+
+func (r *PushRulesResponse) HasData(isInitial bool) bool {
+	return len(r.Global) > 0
+}
+
+// appendPushRules adds the kinds of push rule in the m.push_rules event which differ from what
+// was last sent to the response.
+func (r *PushRulesRequest) appendPushRules(res *Response, ev json.RawMessage) {
+	global := gjson.GetBytes(ev, "content.global")
+	if !global.IsObject() {
+		return
+	}
+	if r.sent == nil {
+		r.sent = make(map[string]string)
+	}
+	changed := make(map[string]json.RawMessage)
+	seen := make(map[string]bool)
+	global.ForEach(func(kind, rules gjson.Result) bool {
+		seen[kind.Str] = true
+		if sent, ok := r.sent[kind.Str]; !ok || sent != rules.Raw {
+			changed[kind.Str] = json.RawMessage(rules.Raw)
+			r.sent[kind.Str] = rules.Raw
+		}
+		return true
+	})
+	for kind := range r.sent {
+		if !seen[kind] {
+			// every rule of this kind was removed
+			changed[kind] = json.RawMessage(`[]`)
+			delete(r.sent, kind)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if res.PushRules == nil {
+		res.PushRules = &PushRulesResponse{
+			Global: make(map[string]json.RawMessage),
+		}
+	}
+	for kind, rules := range changed {
+		res.PushRules.Global[kind] = rules
+	}
+}
+
+func (r *PushRulesRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.AccountDataUpdate)
+	if !ok {
+		return
+	}
+	for _, ad := range update.AccountData {
+		if ad.Type == "m.push_rules" {
+			r.appendPushRules(res, ad.Data)
+		}
+	}
+}
+
+func (r *PushRulesRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// after the snapshot, changes are live streamed
+	if !extCtx.IsInitial && r.sent != nil {
+		return
+	}
+	r.sent = make(map[string]string)
+	data, err := extCtx.Store.AccountData(extCtx.UserID, state.AccountDataGlobalRoom, []string{"m.push_rules"})
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch push rules")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	r.appendPushRules(res, data[0].Data)
+}
@@ -0,0 +1,91 @@
+package extensions
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Test that only the kinds of push rule which changed are sent after the first push rules.
+func TestLivePushRules(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
+	ext := &PushRulesRequest{
+		Core: Core{Enabled: &boolTrue},
+	}
+	pushRules := func(global string) *caches.AccountDataUpdate {
+		return &caches.AccountDataUpdate{
+			AccountData: []state.AccountData{
+				{Type: "m.direct", Data: []byte(`{"type":"m.direct","content":{}}`)},
+				{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules","content":{"global":` + global + `}}`)},
+			},
+		}
+	}
+	testCases := []struct {
+		name   string
+		update *caches.AccountDataUpdate
+		want   map[string]string
+	}{
+		{
+			name:   "first push rules are sent in full",
+			update: pushRules(`{"override":[{"rule_id":"a"}],"room":[]}`),
+			want:   map[string]string{"override": `[{"rule_id":"a"}]`, "room": `[]`},
+		},
+		{
+			name:   "unchanged kinds are not sent",
+			update: pushRules(`{"override":[{"rule_id":"a"}],"room":[{"rule_id":"!b"}]}`),
+			want:   map[string]string{"room": `[{"rule_id":"!b"}]`},
+		},
+		{
+			name:   "removed kinds are sent empty",
+			update: pushRules(`{"room":[{"rule_id":"!b"}]}`),
+			want:   map[string]string{"override": `[]`},
+		},
+		{
+			name:   "no changes",
+			update: pushRules(`{"room":[{"rule_id":"!b"}]}`),
+		},
+		{
+			name:   "other account data",
+			update: &caches.AccountDataUpdate{AccountData: []state.AccountData{{Type: "m.direct", Data: []byte(`{}`)}}},
+		},
+	}
+	for _, tc := range testCases {
+		var res Response
+		ext.AppendLive(ctx, &res, Context{}, tc.update)
+		if len(tc.want) == 0 {
+			if res.PushRules != nil {
+				t.Errorf("%s: got push rules %v want none", tc.name, res.PushRules.Global)
+			}
+			continue
+		}
+		if res.PushRules == nil {
+			t.Fatalf("%s: got no push rules", tc.name)
+		}
+		assertPushRules(t, tc.name, res.PushRules.Global, tc.want)
+	}
+
+	t.Log("Disabling the extension should send every kind once it is enabled again.")
+	ext.ApplyDelta(&PushRulesRequest{Core: Core{Enabled: &boolFalse}})
+	ext.ApplyDelta(&PushRulesRequest{Core: Core{Enabled: &boolTrue}})
+	var res Response
+	ext.AppendLive(ctx, &res, Context{}, pushRules(`{"room":[{"rule_id":"!b"}]}`))
+	if res.PushRules == nil {
+		t.Fatalf("got no push rules after re-enabling the extension")
+	}
+	assertPushRules(t, "re-enabled", res.PushRules.Global, map[string]string{"room": `[{"rule_id":"!b"}]`})
+}
+
+func assertPushRules(t *testing.T, name string, got map[string]json.RawMessage, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got kinds %v want %v", name, got, want)
+	}
+	for kind, rules := range want {
+		if string(got[kind]) != rules {
+			t.Errorf("%s: %s: got %s want %s", name, kind, got[kind], rules)
+		}
+	}
+}
@@ -31,12 +31,59 @@ func (r *ReceiptsResponse) HasData(isInitial bool) bool {
 	return len(r.Rooms) > 0
 }
 
+// receiptVisibility decides which receipts a user can see. Every receipt sent to a client must
+// be checked by it, whether loaded from the database or live.
+type receiptVisibility struct {
+	userID    string
+	isJoined  func(roomID string) bool
+	isIgnored func(userID string) bool
+}
+
+func newReceiptVisibility(extCtx Context) receiptVisibility {
+	return receiptVisibility{
+		userID:    extCtx.UserID,
+		isJoined:  extCtx.IsJoined,
+		isIgnored: extCtx.IsIgnored,
+	}
+}
+
+// visible returns true if the user can see this receipt:
+//   - private receipts are only visible to the user who sent them.
+//   - receipts are only visible in rooms the user is joined to.
+//   - receipts sent by ignored users are not visible, as with all their events.
+func (v receiptVisibility) visible(r internal.Receipt) bool {
+	if r.IsPrivate && r.UserID != v.userID {
+		return false
+	}
+	if v.isJoined != nil && !v.isJoined(r.RoomID) {
+		return false
+	}
+	if r.UserID != v.userID && v.isIgnored != nil && v.isIgnored(r.UserID) {
+		return false
+	}
+	return true
+}
+
+// filter returns the receipts which are visible, reusing the backing array.
+func (v receiptVisibility) filter(receipts []internal.Receipt) []internal.Receipt {
+	visible := receipts[:0]
+	for _, r := range receipts {
+		if v.visible(r) {
+			visible = append(visible, r)
+		}
+	}
+	return visible
+}
+
 func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	switch update := up.(type) {
 	case *caches.ReceiptUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
 			break
 		}
+		if !newReceiptVisibility(extCtx).visible(update.Receipt) {
+			break
+		}
 
 		// a live receipt event happened, send this back
 		if res.Receipts == nil {
@@ -114,7 +161,9 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		otherReceipts[roomID] = append(otherReceipts[roomID], ownRecs...)
 	}
 
+	visibility := newReceiptVisibility(extCtx)
 	for roomID, receipts := range otherReceipts {
+		receipts = visibility.filter(receipts)
 		if len(receipts) == 0 {
 			continue
 		}
@@ -78,3 +78,115 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+func TestReceiptVisibility(t *testing.T) {
+	alice := "@alice:here"
+	bob := "@bob:here"
+	ignored := "@ignored:here"
+	v := receiptVisibility{
+		userID: alice,
+		isJoined: func(roomID string) bool {
+			return roomID == roomA
+		},
+		isIgnored: func(userID string) bool {
+			return userID == ignored
+		},
+	}
+	testCases := []struct {
+		name        string
+		receipt     internal.Receipt
+		wantVisible bool
+	}{
+		{
+			name:        "public receipt in a joined room",
+			receipt:     internal.Receipt{RoomID: roomA, EventID: "$a", UserID: bob},
+			wantVisible: true,
+		},
+		{
+			name:        "own private receipt",
+			receipt:     internal.Receipt{RoomID: roomA, EventID: "$a", UserID: alice, IsPrivate: true},
+			wantVisible: true,
+		},
+		{
+			name:    "someone else's private receipt",
+			receipt: internal.Receipt{RoomID: roomA, EventID: "$a", UserID: bob, IsPrivate: true},
+		},
+		{
+			name:    "receipt in a room the user is not joined to",
+			receipt: internal.Receipt{RoomID: roomB, EventID: "$b", UserID: bob},
+		},
+		{
+			name:    "own receipt in a room the user is not joined to",
+			receipt: internal.Receipt{RoomID: roomB, EventID: "$b", UserID: alice},
+		},
+		{
+			name:    "receipt from an ignored user",
+			receipt: internal.Receipt{RoomID: roomA, EventID: "$a", UserID: ignored},
+		},
+	}
+	for _, tc := range testCases {
+		if got := v.visible(tc.receipt); got != tc.wantVisible {
+			t.Errorf("%s: got visible=%v want %v", tc.name, got, tc.wantVisible)
+		}
+	}
+
+	receipts := make([]internal.Receipt, 0, len(testCases))
+	for _, tc := range testCases {
+		receipts = append(receipts, tc.receipt)
+	}
+	got := v.filter(receipts)
+	if len(got) != 2 || got[0].UserID != bob || got[1].UserID != alice {
+		t.Errorf("filter: got %+v want the 2 visible receipts", got)
+	}
+
+	// without any checks, only the private receipt rule applies
+	v = receiptVisibility{userID: alice}
+	if !v.visible(internal.Receipt{RoomID: roomB, UserID: ignored}) || v.visible(internal.Receipt{RoomID: roomA, UserID: bob, IsPrivate: true}) {
+		t.Errorf("receiptVisibility without checks: wrong visibility")
+	}
+}
+
+// Test that live receipts are filtered before being sent to the client
+func TestLiveReceiptsVisibility(t *testing.T) {
+	boolTrue := true
+	ext := &ReceiptsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Rooms:   []string{"*"},
+		},
+	}
+	var res Response
+	extCtx := Context{
+		UserID:             "@alice:here",
+		AllSubscribedRooms: []string{roomA, roomB},
+		IsJoined: func(roomID string) bool {
+			return roomID == roomA
+		},
+		IsIgnored: func(userID string) bool {
+			return userID == "@ignored:here"
+		},
+	}
+	for _, r := range []internal.Receipt{
+		{RoomID: roomB, EventID: "$b", UserID: "@bob:here"},
+		{RoomID: roomA, EventID: "$a", UserID: "@bob:here", IsPrivate: true},
+		{RoomID: roomA, EventID: "$a", UserID: "@ignored:here"},
+	} {
+		ext.AppendLive(ctx, &res, extCtx, &caches.ReceiptUpdate{
+			Receipt:    r,
+			RoomUpdate: &dummyRoomUpdate{roomID: r.RoomID},
+		})
+	}
+	if res.Receipts != nil {
+		t.Fatalf("got receipts %+v, want none as none are visible", res.Receipts.Rooms)
+	}
+	visible := internal.Receipt{RoomID: roomA, EventID: "$a", UserID: "@bob:here"}
+	ext.AppendLive(ctx, &res, extCtx, &caches.ReceiptUpdate{
+		Receipt:    visible,
+		RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+	})
+	edu, err := state.PackReceiptsIntoEDU([]internal.Receipt{visible})
+	assertNoError(t, err)
+	if res.Receipts == nil || !reflect.DeepEqual(res.Receipts.Rooms, map[string]json.RawMessage{roomA: edu}) {
+		t.Fatalf("got receipts %+v, want only the visible receipt", res.Receipts)
+	}
+}
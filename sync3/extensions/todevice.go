@@ -41,14 +41,21 @@ func (r *ToDeviceRequest) ApplyDelta(gnext GenericRequest) {
 	}
 }
 
+// ErrCodeToDeviceTruncated is returned in the to-device response when messages for the device
+// were dropped for exceeding its to-device quota before they could be sent.
+const ErrCodeToDeviceTruncated = "M_TO_DEVICE_TRUNCATED"
+
 // Server response
 type ToDeviceResponse struct {
 	NextBatch string            `json:"next_batch"`
 	Events    []json.RawMessage `json:"events,omitempty"`
+	// ErrCode is set if messages were dropped, along with how many
+	ErrCode string `json:"errcode,omitempty"`
+	Dropped int64  `json:"dropped,omitempty"`
 }
 
 func (r *ToDeviceResponse) HasData(isInitial bool) bool {
-	return len(r.Events) > 0
+	return len(r.Events) > 0 || r.ErrCode != ""
 }
 
 func (r *ToDeviceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
@@ -114,7 +121,7 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		)
 	}
 
-	msgs, upTo, err := extCtx.Store.ToDeviceTable.Messages(extCtx.UserID, extCtx.DeviceID, from, int64(r.Limit))
+	msgs, receivedAt, upTo, err := extCtx.Store.ToDeviceTable.MessagesWithReceivedAt(extCtx.UserID, extCtx.DeviceID, from, int64(r.Limit))
 	if err != nil {
 		l.Err(err).Int64("from", from).Msg("cannot query to-device messages")
 		// TODO add context to sentry
@@ -131,9 +138,23 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 	mapMu.Lock()
 	deviceIDToSinceDebugOnly[extCtx.DeviceID] = upTo
 	mapMu.Unlock()
+	if !isFirstRequest && from >= lastSentPos {
+		// only time messages sent for the first time, not ones being sent again because they weren't acked
+		extCtx.ToDeviceMetrics.ObserveDelivery(receivedAt)
+	}
+	dropped, err := extCtx.Store.ToDeviceTable.TakeDropped(extCtx.UserID, extCtx.DeviceID)
+	if err != nil {
+		l.Err(err).Msg("cannot query dropped to-device messages")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
 	// we don't need to aggregate here as we're pulling from the DB and not relying on in-memory structs
 	res.ToDevice = &ToDeviceResponse{
 		NextBatch: fmt.Sprintf("%d", upTo),
 		Events:    msgs,
 	}
+	if dropped > 0 {
+		l.Warn().Int64("dropped", dropped).Msg("telling device that to-device messages were dropped")
+		res.ToDevice.ErrCode = ErrCodeToDeviceTruncated
+		res.ToDevice.Dropped = dropped
+	}
 }
@@ -0,0 +1,95 @@
+package extensions
+
+import (
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ToDeviceMetrics instruments the to-device pipeline from the poller to the client, as E2EE breaks
+// when to-device messages are slow or never delivered. A nil *ToDeviceMetrics records nothing.
+type ToDeviceMetrics struct {
+	deliveryLatency      prometheus.Histogram
+	queuedDevices        prometheus.Gauge
+	maxQueueDepth        prometheus.Gauge
+	oldestUndeliveredAge prometheus.Gauge
+	now                  func() time.Time
+}
+
+func NewToDeviceMetrics() *ToDeviceMetrics {
+	m := &ToDeviceMetrics{
+		deliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "delivery_latency_secs",
+			Help:      "Time in seconds between the proxy receiving a to-device message from the homeserver and first sending it to the client.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+		}),
+		queuedDevices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "queued_devices",
+			Help:      "Number of devices with an active connection which have to-device messages waiting to be sent.",
+		}),
+		maxQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "max_queue_depth",
+			Help:      "The most to-device messages waiting to be sent to a single device with an active connection.",
+		}),
+		oldestUndeliveredAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "oldest_undelivered_age_secs",
+			Help:      "Age in seconds of the oldest to-device message waiting to be sent to a device with an active connection, or 0 if there are none.",
+		}),
+		now: time.Now,
+	}
+	prometheus.MustRegister(m.deliveryLatency, m.queuedDevices, m.maxQueueDepth, m.oldestUndeliveredAge)
+	return m
+}
+
+// ObserveDelivery records the latency of to-device messages which are being sent to the client for
+// the first time. receivedAt is in unix milliseconds, and unknown times of 0 are ignored.
+func (m *ToDeviceMetrics) ObserveDelivery(receivedAt []int64) {
+	if m == nil {
+		return
+	}
+	now := m.now()
+	for _, ts := range receivedAt {
+		if ts == 0 {
+			continue
+		}
+		latency := now.Sub(time.UnixMilli(ts))
+		if latency < 0 {
+			latency = 0
+		}
+		m.deliveryLatency.Observe(latency.Seconds())
+	}
+}
+
+// SetQueueStats records the to-device messages waiting to be sent to connected devices.
+func (m *ToDeviceMetrics) SetQueueStats(stats state.ToDeviceQueueStats) {
+	if m == nil {
+		return
+	}
+	m.queuedDevices.Set(float64(stats.Devices))
+	m.maxQueueDepth.Set(float64(stats.MaxDepth))
+	if stats.OldestReceivedAt == 0 {
+		m.oldestUndeliveredAge.Set(0)
+		return
+	}
+	m.oldestUndeliveredAge.Set(m.now().Sub(time.UnixMilli(stats.OldestReceivedAt)).Seconds())
+}
+
+// Teardown unregisters metrics. Useful in tests.
+func (m *ToDeviceMetrics) Teardown() {
+	if m == nil {
+		return
+	}
+	prometheus.Unregister(m.deliveryLatency)
+	prometheus.Unregister(m.queuedDevices)
+	prometheus.Unregister(m.maxQueueDepth)
+	prometheus.Unregister(m.oldestUndeliveredAge)
+}
@@ -0,0 +1,67 @@
+package extensions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestToDeviceMetrics(t *testing.T) {
+	m := NewToDeviceMetrics()
+	defer m.Teardown()
+	now := time.UnixMilli(1700000000000)
+	m.now = func() time.Time { return now }
+
+	// unknown receipt times are ignored
+	m.ObserveDelivery([]int64{now.Add(-200 * time.Millisecond).UnixMilli(), 0, now.Add(-2 * time.Second).UnixMilli()})
+	want := `
+# HELP sliding_sync_to_device_delivery_latency_secs Time in seconds between the proxy receiving a to-device message from the homeserver and first sending it to the client.
+# TYPE sliding_sync_to_device_delivery_latency_secs histogram
+sliding_sync_to_device_delivery_latency_secs_bucket{le="0.05"} 0
+sliding_sync_to_device_delivery_latency_secs_bucket{le="0.1"} 0
+sliding_sync_to_device_delivery_latency_secs_bucket{le="0.25"} 1
+sliding_sync_to_device_delivery_latency_secs_bucket{le="0.5"} 1
+sliding_sync_to_device_delivery_latency_secs_bucket{le="1"} 1
+sliding_sync_to_device_delivery_latency_secs_bucket{le="2.5"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="5"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="10"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="30"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="60"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="300"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="900"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="3600"} 2
+sliding_sync_to_device_delivery_latency_secs_bucket{le="+Inf"} 2
+sliding_sync_to_device_delivery_latency_secs_sum 2.2
+sliding_sync_to_device_delivery_latency_secs_count 2
+`
+	if err := testutil.CollectAndCompare(m.deliveryLatency, strings.NewReader(want)); err != nil {
+		t.Errorf("delivery latency: %s", err)
+	}
+
+	m.SetQueueStats(state.ToDeviceQueueStats{
+		Devices:          3,
+		MaxDepth:         50,
+		OldestReceivedAt: now.Add(-time.Minute).UnixMilli(),
+	})
+	if got := testutil.ToFloat64(m.queuedDevices); got != 3 {
+		t.Errorf("queued devices: got %v want 3", got)
+	}
+	if got := testutil.ToFloat64(m.maxQueueDepth); got != 50 {
+		t.Errorf("max queue depth: got %v want 50", got)
+	}
+	if got := testutil.ToFloat64(m.oldestUndeliveredAge); got != 60 {
+		t.Errorf("oldest undelivered age: got %v want 60", got)
+	}
+	m.SetQueueStats(state.ToDeviceQueueStats{})
+	if got := testutil.ToFloat64(m.oldestUndeliveredAge); got != 0 {
+		t.Errorf("oldest undelivered age with an empty queue: got %v want 0", got)
+	}
+
+	// a nil ToDeviceMetrics is safe to use
+	var disabled *ToDeviceMetrics
+	disabled.ObserveDelivery([]int64{now.UnixMilli()})
+	disabled.SetQueueStats(state.ToDeviceQueueStats{Devices: 1})
+}
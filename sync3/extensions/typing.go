@@ -3,8 +3,11 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Client created request params
@@ -41,7 +44,7 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 		if _, exists := extCtx.RoomIDToTimeline[update.RoomID()]; !exists {
 			return
 		}
-		ev := update.GlobalRoomMetadata().TypingEvent
+		ev := update.GlobalRoomMetadata().CurrentTypingEvent(time.Now())
 		if ev == nil {
 			return
 		}
@@ -62,7 +65,7 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 			Rooms: make(map[string]json.RawMessage),
 		}
 	}
-	res.Typing.Rooms[roomID] = typingEvent
+	res.Typing.Rooms[roomID] = withoutIgnoredUsers(typingEvent, extCtx.IsIgnored)
 }
 
 func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
@@ -73,9 +76,14 @@ func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCt
 		roomIDs = append(roomIDs, roomID)
 	}
 	roomToGlobalMetadata := extCtx.GlobalCache.LoadRooms(ctx, roomIDs...)
+	now := time.Now()
 	for roomID := range extCtx.RoomIDToTimeline {
 		meta := roomToGlobalMetadata[roomID]
-		if meta == nil || meta.TypingEvent == nil {
+		if meta == nil {
+			continue
+		}
+		typingEvent := meta.CurrentTypingEvent(now)
+		if typingEvent == nil {
 			continue
 		}
 
@@ -83,7 +91,7 @@ func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCt
 			continue
 		}
 
-		rooms[roomID] = meta.TypingEvent
+		rooms[roomID] = withoutIgnoredUsers(typingEvent, extCtx.IsIgnored)
 	}
 	if len(rooms) == 0 {
 		return // don't add a typing extension, no data!
@@ -92,3 +100,27 @@ func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCt
 		Rooms: rooms,
 	}
 }
+
+// withoutIgnoredUsers removes ignored users from the user_ids of a typing event. The event is
+// still sent if nobody else is typing, so the client stops showing ignored users as typing.
+func withoutIgnoredUsers(typingEvent json.RawMessage, isIgnored func(userID string) bool) json.RawMessage {
+	if isIgnored == nil {
+		return typingEvent
+	}
+	userIDs := gjson.GetBytes(typingEvent, "content.user_ids").Array()
+	typingUserIDs := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !isIgnored(userID.Str) {
+			typingUserIDs = append(typingUserIDs, userID.Str)
+		}
+	}
+	if len(typingUserIDs) == len(userIDs) {
+		return typingEvent
+	}
+	filtered, err := sjson.SetBytes(typingEvent, "content.user_ids", typingUserIDs)
+	if err != nil {
+		logger.Err(err).Msg("failed to remove ignored users from typing event")
+		return typingEvent
+	}
+	return filtered
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -72,6 +73,7 @@ func TestLiveTypingAggregation(t *testing.T) {
 			globalMetadata: &internal.RoomMetadata{
 				RoomID:      roomC,
 				TypingEvent: json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@doris:localhost"]}}`),
+				TypingTS:    time.Now().UnixMilli(),
 			},
 		},
 		EventData: &caches.EventData{
@@ -89,4 +91,76 @@ func TestLiveTypingAggregation(t *testing.T) {
 	if !reflect.DeepEqual(res.Typing.Rooms, want) {
 		t.Fatalf("got  %s\nwant %s", res.Typing.Rooms, want)
 	}
+
+	// typing members which are older than the TTL are not included
+	eventD1 := &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomD,
+			globalMetadata: &internal.RoomMetadata{
+				RoomID:      roomD,
+				TypingEvent: json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@eve:localhost"]}}`),
+				TypingTS:    time.Now().Add(-internal.TypingTTL - time.Second).UnixMilli(),
+			},
+		},
+		EventData: &caches.EventData{
+			RoomID:    roomD,
+			EventType: "m.room.message",
+			Content:   gjson.Parse(`{"body":"hello world"}`),
+			Timestamp: 123456,
+		},
+	}
+	extCtx.RoomIDToTimeline = map[string][]string{
+		roomD: {"$d"},
+	}
+	ext.AppendLive(ctx, &res, extCtx, eventD1)
+	if !reflect.DeepEqual(res.Typing.Rooms, want) {
+		t.Fatalf("got  %s\nwant %s", res.Typing.Rooms, want)
+	}
+}
+
+func TestLiveTypingIgnoredUsers(t *testing.T) {
+	boolTrue := true
+	ext := &TypingRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	var res Response
+	extCtx := Context{
+		AllSubscribedRooms: []string{roomA, roomB},
+		IsIgnored: func(userID string) bool {
+			return userID == "@ignored:localhost"
+		},
+	}
+	newTypingUpdate := func(roomID, typingEvent string) *caches.TypingUpdate {
+		return &caches.TypingUpdate{
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomID,
+				globalMetadata: &internal.RoomMetadata{
+					RoomID:      roomID,
+					TypingEvent: json.RawMessage(typingEvent),
+				},
+			},
+		}
+	}
+	ext.AppendLive(ctx, &res, extCtx, newTypingUpdate(roomA, `{"type":"m.typing","content":{"user_ids":["@alice:localhost","@ignored:localhost"]}}`))
+	ext.AppendLive(ctx, &res, extCtx, newTypingUpdate(roomB, `{"type":"m.typing","content":{"user_ids":["@ignored:localhost"]}}`))
+	if res.Typing == nil {
+		t.Fatalf("typing response is empty")
+	}
+	want := map[string][]string{
+		roomA: {"@alice:localhost"},
+		roomB: {},
+	}
+	for roomID, wantUserIDs := range want {
+		gotUserIDs := []string{}
+		for _, userID := range gjson.GetBytes(res.Typing.Rooms[roomID], "content.user_ids").Array() {
+			gotUserIDs = append(gotUserIDs, userID.Str)
+		}
+		if !reflect.DeepEqual(gotUserIDs, wantUserIDs) {
+			t.Errorf("%s: got typing users %v want %v", roomID, gotUserIDs, wantUserIDs)
+		}
+	}
 }
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// maxBackfillEvents is the most events fetched to fill a single timeline, matching the most
+// events the proxy loads from the database.
+const maxBackfillEvents = 50
+
+// backfillTimeout bounds how long a request waits for a single /messages call.
+const backfillTimeout = 5 * time.Second
+
+var errBackfillRateLimited = errors.New("backfill rate limited")
+
+// Backfiller fetches timeline events the proxy has not stored, for rooms whose stored timeline is
+// shorter than the client's timeline_limit e.g after a gappy poll.
+type Backfiller interface {
+	// Backfill returns up to limit events before prevBatch in chronological order, along with the
+	// prev_batch token for the earliest returned event.
+	Backfill(ctx context.Context, userID, deviceID, roomID, prevBatch string, limit int) (events []json.RawMessage, nextPrevBatch string, err error)
+}
+
+// messagesBackfiller backfills with /messages, using the device's latest access token so the
+// homeserver applies the user's history visibility.
+type messagesBackfiller struct {
+	client  sync2.Client
+	tokens  *sync2.TokensTable
+	limiter *internal.RateLimiter
+}
+
+func (b *messagesBackfiller) Backfill(ctx context.Context, userID, deviceID, roomID, prevBatch string, limit int) ([]json.RawMessage, string, error) {
+	if !b.limiter.Allow() {
+		return nil, "", errBackfillRateLimited
+	}
+	token, err := b.tokens.LatestTokenForDevice(userID, deviceID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load token: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, backfillTimeout)
+	defer cancel()
+	res, err := b.client.Messages(ctx, token.AccessToken, roomID, prevBatch, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	events := make([]json.RawMessage, 0, len(res.Chunk))
+	for i := len(res.Chunk) - 1; i >= 0; i-- {
+		events = append(events, res.Chunk[i])
+	}
+	return events, res.End, nil
+}
+
+// SetBackfillRate enables backfilling short timelines with /messages, making at most this many
+// calls a second across all connections. Disabled if 0. Must be called before serving requests.
+func (h *SyncLiveHandler) SetBackfillRate(perSecond float64) {
+	if perSecond <= 0 {
+		h.backfiller = nil
+		return
+	}
+	h.backfiller = &messagesBackfiller{
+		client:  h.V2,
+		tokens:  h.V2Store.TokensTable,
+		limiter: internal.NewRateLimiter(perSecond, int(math.Ceil(perSecond))),
+	}
+}
+
+// backfillTimelines prepends events from the homeserver to timelines with fewer than limit events,
+// which are not at the start of the room. Timelines are left as they are if backfilling fails.
+func (s *ConnState) backfillTimelines(ctx context.Context, timelines map[string]state.LatestEvents, limit int) {
+	if limit > maxBackfillEvents {
+		limit = maxBackfillEvents
+	}
+	for roomID, latest := range timelines {
+		missing := limit - len(latest.Timeline)
+		if missing <= 0 || latest.PrevBatch == "" || len(latest.Timeline) == 0 {
+			continue
+		}
+		first := gjson.ParseBytes(latest.Timeline[0])
+		if first.Get("type").Str == "m.room.create" && first.Get("state_key").Str == "" {
+			continue // there is nothing before the create event
+		}
+		events, prevBatch, err := s.backfiller.Backfill(ctx, s.userID, s.deviceID, roomID, latest.PrevBatch, missing)
+		if errors.Is(err, errBackfillRateLimited) {
+			logger.Debug().Str("user", s.userID).Str("room", roomID).Msg("backfill rate limited, returning stored timeline")
+			return
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("user", s.userID).Str("room", roomID).Msg("failed to backfill timeline")
+			continue
+		}
+		// the stored prev_batch can be from an event after the earliest stored event, so skip
+		// anything the timeline already has.
+		known := make(map[string]struct{}, len(latest.Timeline))
+		for _, ev := range latest.Timeline {
+			known[gjson.GetBytes(ev, "event_id").Str] = struct{}{}
+		}
+		backfilled := make([]json.RawMessage, 0, len(events)+len(latest.Timeline))
+		for _, ev := range events {
+			if _, ok := known[gjson.GetBytes(ev, "event_id").Str]; !ok {
+				backfilled = append(backfilled, ev)
+			}
+		}
+		if len(backfilled) == 0 {
+			continue
+		}
+		latest.Timeline = append(backfilled, latest.Timeline...)
+		latest.PrevBatch = prevBatch
+		timelines[roomID] = latest
+	}
+}
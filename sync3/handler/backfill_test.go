@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+type mockBackfiller struct {
+	calls  []string
+	events map[string][]json.RawMessage
+	err    error
+}
+
+func (b *mockBackfiller) Backfill(ctx context.Context, userID, deviceID, roomID, prevBatch string, limit int) ([]json.RawMessage, string, error) {
+	b.calls = append(b.calls, fmt.Sprintf("%s %s %d", roomID, prevBatch, limit))
+	if b.err != nil {
+		return nil, "", b.err
+	}
+	events := b.events[roomID]
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, "earlier_" + roomID, nil
+}
+
+func eventIDs(timeline []json.RawMessage) []string {
+	ids := make([]string, len(timeline))
+	for i := range timeline {
+		ids[i] = gjson.GetBytes(timeline[i], "event_id").Str
+	}
+	return ids
+}
+
+func TestBackfillTimelines(t *testing.T) {
+	ev := func(id string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"event_id":"%s","type":"m.room.message","content":{}}`, id))
+	}
+	backfiller := &mockBackfiller{
+		events: map[string][]json.RawMessage{
+			// $c overlaps the stored timeline, as the stored prev_batch is after it
+			"!gappy": {ev("$a"), ev("$b"), ev("$c")},
+		},
+	}
+	cs := &ConnState{userID: "@alice:localhost", deviceID: "DEVICE", backfiller: backfiller}
+	timelines := map[string]state.LatestEvents{
+		"!gappy": {Timeline: []json.RawMessage{ev("$c"), ev("$d")}, PrevBatch: "stored"},
+		"!full":  {Timeline: []json.RawMessage{ev("$e"), ev("$f"), ev("$g"), ev("$h"), ev("$i")}, PrevBatch: "stored"},
+		"!new": {Timeline: []json.RawMessage{
+			json.RawMessage(`{"event_id":"$create","type":"m.room.create","state_key":"","content":{}}`),
+		}, PrevBatch: "stored"},
+		"!no_token": {Timeline: []json.RawMessage{ev("$j")}},
+	}
+	cs.backfillTimelines(context.Background(), timelines, 5)
+
+	if want := []string{"!gappy stored 3"}; !reflect.DeepEqual(backfiller.calls, want) {
+		t.Errorf("calls: got %v want %v", backfiller.calls, want)
+	}
+	if got, want := eventIDs(timelines["!gappy"].Timeline), []string{"$a", "$b", "$c", "$d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gappy timeline: got %v want %v", got, want)
+	}
+	if timelines["!gappy"].PrevBatch != "earlier_!gappy" {
+		t.Errorf("gappy prev_batch: got %s", timelines["!gappy"].PrevBatch)
+	}
+	if got := eventIDs(timelines["!full"].Timeline); len(got) != 5 || timelines["!full"].PrevBatch != "stored" {
+		t.Errorf("full timeline was changed: %v %s", got, timelines["!full"].PrevBatch)
+	}
+
+	// failures return the stored timeline
+	backfiller = &mockBackfiller{err: errBackfillRateLimited}
+	cs.backfiller = backfiller
+	timelines = map[string]state.LatestEvents{
+		"!gappy": {Timeline: []json.RawMessage{ev("$c"), ev("$d")}, PrevBatch: "stored"},
+	}
+	cs.backfillTimelines(context.Background(), timelines, 5)
+	if got := eventIDs(timelines["!gappy"].Timeline); len(got) != 2 || timelines["!gappy"].PrevBatch != "stored" {
+		t.Errorf("rate limited timeline was changed: %v %s", got, timelines["!gappy"].PrevBatch)
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"time"
@@ -11,10 +12,12 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tidwall/gjson"
+	"golang.org/x/exp/slices"
 )
 
 type JoinChecker interface {
 	IsUserJoined(userID, roomID string) bool
+	JoinedUsersForRoom(roomID string) []string
 }
 
 // ConnState tracks all high-level connection state for this connection, like the combined request
@@ -50,8 +53,27 @@ type ConnState struct {
 	userCache   *caches.UserCache
 	userCacheID int
 	lazyCache   *LazyCache
+	// roomStateCache memoises required_state loaded for this connection
+	roomStateCache *caches.RoomStateCache
 
 	joinChecker JoinChecker
+	// backfiller fills short timelines from the homeserver, or is nil if backfilling is disabled.
+	backfiller Backfiller
+	// defaultBumpEventTypes are the bump_event_types of new lists which don't set them.
+	defaultBumpEventTypes []string
+	// persistRequest stores the muxed request whenever it changes, so the connection can be
+	// rehydrated after a restart, or is nil if connections aren't persisted.
+	persistRequest func(req json.RawMessage)
+	// persistedRequest is the last request passed to persistRequest
+	persistedRequest json.RawMessage
+	// onEphemeralDemand is called when the typing and receipts extensions are first enabled or
+	// last disabled on this connection, or is nil if pollers always fetch ephemeral events.
+	onEphemeralDemand func(wanted bool)
+	// wantsEphemeral is the last value passed to onEphemeralDemand
+	wantsEphemeral bool
+
+	// true if the client has sent room_hashes on this connection
+	useRoomHashes bool
 
 	extensionsHandler   extensions.HandlerInterface
 	setupHistogramVec   *prometheus.HistogramVec
@@ -75,6 +97,7 @@ func NewConnState(
 		extensionsHandler:   ex,
 		joinChecker:         joinChecker,
 		lazyCache:           NewLazyCache(),
+		roomStateCache:      caches.NewRoomStateCache(caches.DefaultMaxRoomStateViews),
 		setupHistogramVec:   setupHistVec,
 		processHistogramVec: histVec,
 	}
@@ -123,29 +146,13 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		internal.AssertWithContext(ctx, "LoadJoinedRooms returned room with timing info", ok)
 		urd.JoinTiming = timing
 
-		interestedEventTimestampsByList := make(map[string]uint64, len(req.Lists))
-		for listKey, listReq := range req.Lists {
-			interestingActivityTs := metadata.LastMessageTimestamp
-			if len(listReq.BumpEventTypes) > 0 {
-				// Use the global cache to find the timestamp of the latest interesting
-				// event we can see. If there is no such event, fall back to the
-				// LastMessageTimestamp.
-				joinEvent := joinTimings[metadata.RoomID]
-				interestingActivityTs = joinEvent.Timestamp
-				for _, eventType := range listReq.BumpEventTypes {
-					timing := metadata.LatestEventsByType[eventType]
-					// we found a later event which we are authorised to see, use it instead
-					if joinEvent.NID < timing.NID && interestingActivityTs < timing.Timestamp {
-						interestingActivityTs = timing.Timestamp
-					}
-				}
-			}
-			interestedEventTimestampsByList[listKey] = interestingActivityTs
-		}
 		rooms[i] = sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  urd,
-			LastInterestedEventTimestamps: interestedEventTimestampsByList,
+			LastInterestedEventTimestamps: make(map[string]uint64, len(req.Lists)),
+		}
+		for listKey, listReq := range req.Lists {
+			rooms[i].LastInterestedEventTimestamps[listKey] = rooms[i].InterestedEventTimestamp(listReq.BumpEventTypes)
 		}
 		i++
 	}
@@ -172,10 +179,10 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	req = s.withDefaultBumpEventTypes(req)
 	if s.anchorLoadPosition <= 0 {
-		// load() needs no ctx so drop it
-		_, region := internal.StartSpan(ctx, "load")
-		err := s.load(ctx, req)
+		loadCtx, region := internal.StartSpan(ctx, "load")
+		err := s.load(loadCtx, req)
 		if err != nil {
 			// in practice this means DB hit failures. If we try again later maybe it'll work, and we will because
 			// anchorLoadPosition is unset.
@@ -188,6 +195,77 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 	return s.onIncomingRequest(ctx, req, isInitial)
 }
 
+// withDefaultBumpEventTypes returns the request with the server's default bump_event_types set on
+// new lists which don't set their own, and the Wildcard replaced with no bump_event_types, which
+// bumps rooms for every event. The request itself is left alone as the Conn compares it to the
+// next request to spot retransmits.
+func (s *ConnState) withDefaultBumpEventTypes(req *sync3.Request) *sync3.Request {
+	var lists map[string]sync3.RequestList
+	for listKey, list := range req.Lists {
+		if list.Deleted {
+			continue
+		}
+		bumpEventTypes := list.BumpEventTypes
+		if bumpEventTypes == nil {
+			if s.muxedReq != nil && s.muxedReq.Lists[listKey].BumpEventTypes != nil {
+				// sticky, so the list keeps the bump_event_types it already has
+				continue
+			}
+			bumpEventTypes = s.defaultBumpEventTypes
+		}
+		for _, evType := range bumpEventTypes {
+			if evType == sync3.Wildcard {
+				bumpEventTypes = []string{}
+				break
+			}
+		}
+		if bumpEventTypes == nil {
+			continue
+		}
+		if lists == nil {
+			lists = make(map[string]sync3.RequestList, len(req.Lists))
+			for k, l := range req.Lists {
+				lists[k] = l
+			}
+		}
+		list.BumpEventTypes = bumpEventTypes
+		lists[listKey] = list
+	}
+	if lists == nil {
+		return req
+	}
+	withDefaults := *req
+	withDefaults.Lists = lists
+	return &withDefaults
+}
+
+// maybePersistRequest stores the muxed request if it has changed since it was last stored.
+func (s *ConnState) maybePersistRequest() {
+	if s.persistRequest == nil {
+		return
+	}
+	reqJSON, err := json.Marshal(s.muxedReq)
+	if err != nil || bytes.Equal(reqJSON, s.persistedRequest) {
+		return
+	}
+	s.persistedRequest = reqJSON
+	s.persistRequest(reqJSON)
+}
+
+// maybeReportEphemeralDemand tells the poller whether this connection wants typing notifications
+// or receipts, if that has changed.
+func (s *ConnState) maybeReportEphemeralDemand() {
+	if s.onEphemeralDemand == nil || s.muxedReq == nil {
+		return
+	}
+	wanted := s.muxedReq.Extensions.WantsEphemeral()
+	if wanted == s.wantsEphemeral {
+		return
+	}
+	s.wantsEphemeral = wanted
+	s.onEphemeralDemand(wanted)
+}
+
 // onIncomingRequest is a callback which fires when the client makes a request to the server. Whilst each request may
 // be on their own goroutine, the requests are linearised for us by Conn so it is safe to modify ConnState without
 // additional locking mechanisms.
@@ -196,6 +274,8 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	// ApplyDelta works fine if s.muxedReq is nil
 	var delta *sync3.RequestDelta
 	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	s.maybePersistRequest()
+	s.maybeReportEphemeralDemand()
 	internal.Logf(reqCtx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -234,6 +314,9 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		RoomIDsToLists:     s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
 		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
 		AllLists:           s.muxedReq.ListKeys(),
+		IsJoined:           s.isJoined,
+		IsIgnored:          s.userCache.ShouldIgnore,
+		JoinedUsers:        s.joinChecker.JoinedUsersForRoom,
 	})
 	region.End()
 
@@ -251,6 +334,8 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	s.live.liveUpdate(updateCtx, req, s.muxedReq.Extensions, isInitial, response)
 	region.End()
 
+	responseCtx, region := internal.StartSpan(reqCtx, "buildResponse")
+	defer region.End()
 	// counts are AFTER events are applied, hence after liveUpdate
 	for listKey := range response.Lists {
 		l := response.Lists[listKey]
@@ -261,15 +346,50 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	// Add membership events for users sending typing notifications. We do this after live update
 	// and initial room loading code so we LL room members in all cases.
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
-		s.lazyLoadTypingMembers(reqCtx, response)
+		s.lazyLoadTypingMembers(responseCtx, response)
+	}
+
+	// Hash rooms last, once nothing else will modify them.
+	if req.RoomHashes != nil {
+		s.useRoomHashes = true
+	}
+	if s.useRoomHashes {
+		applyRoomHashes(response, req.RoomHashes)
 	}
 	return response, nil
 }
 
+// applyRoomHashes sets the hash of every initial room payload in the response. Payloads which
+// match a hash the client already holds are replaced with a stub marked as unchanged, so clients
+// which reconnect after M_UNKNOWN_POS only download the rooms which have changed.
+func applyRoomHashes(response *sync3.Response, clientHashes map[string]string) {
+	for roomID, room := range response.Rooms {
+		if !room.Initial {
+			// deltas can't be compared to a cached payload
+			continue
+		}
+		hash := room.ContentHash()
+		if clientHashes[roomID] == hash {
+			room = sync3.Room{
+				Initial:   true,
+				Unchanged: true,
+			}
+		}
+		room.Hash = hash
+		response.Rooms[roomID] = room
+	}
+}
+
 func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
-	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	resolveCtx, resolveSpan := internal.StartSpan(ctx, "resolveList")
+	if prevReqList == nil {
+		// a new list, so work out which activity it sorts rooms by before they are sorted
+		s.lists.SetInterestedEventTimestamps(listKey, nextReqList.BumpEventTypes)
+	}
+	roomList, overwritten := s.lists.AssignList(resolveCtx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	resolveSpan.End()
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
@@ -309,6 +429,10 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 
 	sortChanged := prevReqList.SortOrderChanged(nextReqList)
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
+	if prevReqList != nil && !sortChanged && !filtersChanged {
+		// rooms age out of active_within_ms without any new events, so check them on every request
+		responseOperations = append(responseOperations, s.removeExpiredRooms(ctx, builder, prevReqList, nextReqList, roomList)...)
+	}
 	if sortChanged || filtersChanged {
 		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
 		if prevReqList != nil {
@@ -327,15 +451,18 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 				})
 			}
 		}
+		resolveCtx, resolveSpan := internal.StartSpan(ctx, "resolveList")
 		if filtersChanged {
 			// we need to re-create the list as the rooms may have completely changed
-			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+			roomList, _ = s.lists.AssignList(resolveCtx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
 		}
+		s.loadActivityBefore(resolveCtx, roomList, nextReqList)
 		// resort as either we changed the sort order or we added/removed a bunch of rooms
 		if err := roomList.Sort(nextReqList.Sort); err != nil {
 			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
+		resolveSpan.End()
 		addedRanges = nextReqList.Ranges
 		removedRanges = nil
 	}
@@ -423,6 +550,33 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	}
 }
 
+// removeExpiredRooms removes rooms which are no longer active within the list's active_within_ms
+// from the list, returning DELETE/INSERT ops relative to the window the client had before this request.
+func (s *ConnState) removeExpiredRooms(ctx context.Context, builder *RoomsBuilder, prevReqList, nextReqList *sync3.RequestList, roomList *sync3.FilteredSortableRooms) []sync3.ResponseOp {
+	expired := roomList.ExpiredRoomIDs()
+	if len(expired) == 0 {
+		return nil
+	}
+	internal.Logf(ctx, "connstate", "removing %d rooms which are no longer active", len(expired))
+	if nextReqList.ShouldGetAllRooms() {
+		// as with live updates, rooms are removed without any ops
+		for _, roomID := range expired {
+			roomList.Remove(roomID)
+		}
+		return nil
+	}
+	var ops []sync3.ResponseOp
+	for _, roomID := range expired {
+		roomOps, subs := sync3.CalculateListOps(ctx, prevReqList, roomList, roomID, sync3.ListOpDel)
+		ops = append(ops, roomOps...)
+		if len(subs) > 0 { // rooms which moved into the window
+			subID := builder.AddSubscription(nextReqList.RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, subs)
+		}
+	}
+	return ops
+}
+
 func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas map[string]sync3.RequestListDelta) map[string]sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "buildListSubscriptions")
 	defer span.End()
@@ -440,6 +594,22 @@ func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBu
 	return result
 }
 
+// loadActivityBefore loads when each room in the list was last active at or before the list's
+// activity_before_ts, if the list is sorted by it.
+func (s *ConnState) loadActivityBefore(ctx context.Context, roomList *sync3.FilteredSortableRooms, reqList *sync3.RequestList) {
+	for _, sortBy := range reqList.Sort {
+		if sortBy != sync3.SortByActivityBeforeTS {
+			continue
+		}
+		var activity map[string]int64
+		if reqList.ActivityBeforeTS > 0 {
+			activity = s.globalCache.LoadActivityBefore(ctx, roomList.RoomIDs(), reqList.ActivityBeforeTS)
+		}
+		roomList.SetActivityBefore(reqList.ActivityBeforeTS, activity)
+		return
+	}
+}
+
 func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBuilder, subs, unsubs []string) {
 	ctx, span := internal.StartSpan(ctx, "buildRoomSubscriptions")
 	defer span.End()
@@ -566,6 +736,9 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
 	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
 	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	if s.backfiller != nil {
+		s.backfillTimelines(ctx, timelines, int(roomSub.TimelineLimit))
+	}
 
 	// 1. Prepare lazy loading data structures, txn IDs.
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
@@ -611,13 +784,15 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// by reusing the same global load position anchor here, we can be sure that the state returned here
 	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
 	// the events table itself, so whatever position is picked based on this anchor is immutable.
-	roomIDToState := s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
+	roomIDToState := s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline, s.roomStateCache)
 	if roomIDToState == nil { // e.g no required_state
 		roomIDToState = make(map[string][]json.RawMessage)
 	}
 
 	// 3. Build sync3.Room structs to return to clients.
 	rooms := make(map[string]sync3.Room, len(roomIDs))
+	// room ID -> heroes whose member events are sent with the room's name
+	roomToHeroes := make(map[string][]string)
 	for _, roomID := range roomIDs {
 		userRoomData, ok := userRoomDatas[roomID]
 		if !ok {
@@ -625,6 +800,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		}
 		metadata := roomMetadatas[roomID]
 		var inviteState []json.RawMessage
+		var topic string
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
@@ -632,6 +808,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+			topic = userRoomData.Invite.Topic()
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
@@ -675,6 +852,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
 		room := sync3.Room{
 			Name:              roomName,
+			Topic:             topic,
 			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
 			NotificationCount: int64(userRoomData.NotificationCount),
 			HighlightCount:    int64(userRoomData.HighlightCount),
@@ -684,6 +862,8 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			InviteState:       inviteState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
+			JoinRule:          metadata.JoinRule,
+			HistoryVisibility: metadata.HistoryVisibility,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      &metadata.InviteCount,
 			PrevBatch:         timelines[roomID].PrevBatch,
@@ -691,13 +871,60 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		}
 		if roomSub.IncludeHeroes() && calculated {
 			room.Heroes = metadata.Heroes
+			if !userRoomData.IsInvite {
+				for _, hero := range metadata.Heroes {
+					roomToHeroes[roomID] = append(roomToHeroes[roomID], hero.ID)
+				}
+			}
+		}
+		if len(userRoomData.ThreadUnreadCounts) > 0 {
+			room.ThreadUnreadNotifications = userRoomData.ThreadUnreadCounts
 		}
 		rooms[roomID] = room
 	}
+	s.addHeroMemberEvents(ctx, rooms, roomToHeroes)
 
 	return rooms
 }
 
+// addHeroMemberEvents adds the member events of the heroes of rooms without a name to their
+// required_state, if they aren't there already, so clients can show the heroes' profiles
+// without requesting every member event.
+func (s *ConnState) addHeroMemberEvents(ctx context.Context, rooms map[string]sync3.Room, roomToHeroes map[string][]string) {
+	if len(roomToHeroes) == 0 {
+		return
+	}
+	heroSet := make(map[string]struct{})
+	for _, heroes := range roomToHeroes {
+		for _, hero := range heroes {
+			heroSet[hero] = struct{}{}
+		}
+	}
+	rsm := internal.NewRequiredStateMap(nil, nil, map[string][]string{
+		"m.room.member": internal.Keys(heroSet),
+	}, false, false)
+	roomIDToState := s.globalCache.LoadRoomState(ctx, internal.Keys(roomToHeroes), s.anchorLoadPosition, rsm, nil, nil)
+	for roomID, heroes := range roomToHeroes {
+		room := rooms[roomID]
+		sent := make(map[string]bool, len(room.RequiredState))
+		for _, ev := range room.RequiredState {
+			parsed := gjson.ParseBytes(ev)
+			if parsed.Get("type").Str == "m.room.member" {
+				sent[parsed.Get("state_key").Str] = true
+			}
+		}
+		for _, ev := range roomIDToState[roomID] {
+			stateKey := gjson.GetBytes(ev, "state_key").Str
+			if sent[stateKey] || !slices.Contains(heroes, stateKey) {
+				continue
+			}
+			sent[stateKey] = true
+			room.RequiredState = append(room.RequiredState, ev)
+		}
+		rooms[roomID] = room
+	}
+}
+
 func (s *ConnState) trackSetupDuration(ctx context.Context, dur time.Duration, isInitial bool) {
 	internal.SetRequestContextSetupDuration(ctx, dur)
 	if s.setupHistogramVec == nil {
@@ -725,6 +952,10 @@ func (s *ConnState) trackProcessDuration(ctx context.Context, dur time.Duration,
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
 	s.userCache.Unsubscribe(s.userCacheID)
+	if s.onEphemeralDemand != nil && s.wantsEphemeral {
+		s.wantsEphemeral = false
+		s.onEphemeralDemand(false)
+	}
 	logger.Debug().Str("user_id", s.userID).Str("device_id", s.deviceID).Msg("cancelling any in-flight requests")
 	if s.cancelLatestReq != nil {
 		s.cancelLatestReq()
@@ -735,6 +966,10 @@ func (s *ConnState) Alive() bool {
 	return !s.live.bufferFull
 }
 
+func (s *ConnState) isJoined(roomID string) bool {
+	return s.joinChecker.IsUserJoined(s.userID, roomID)
+}
+
 func (s *ConnState) UserID() string {
 	return s.userID
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 // the amount of time to try to insert into a full buffer before giving up.
@@ -111,7 +112,11 @@ func (s *connStateLive) liveUpdate(
 
 	internal.SetConnBufferInfo(ctx, startBufferSize, len(s.updates), cap(s.updates))
 
-	// TODO: op consolidation
+	// rooms which moved several times only need to be moved once
+	for listKey, list := range response.Lists {
+		list.Ops = sync3.CompactListOps(list.Ops)
+		response.Lists[listKey] = list
+	}
 }
 
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
@@ -127,6 +132,8 @@ func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update,
 		RoomIDsToLists:     roomIDsToLists,
 		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
 		AllLists:           s.muxedReq.ListKeys(),
+		IsJoined:           s.isJoined,
+		IsIgnored:          s.userCache.ShouldIgnore,
 	})
 }
 
@@ -157,6 +164,10 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				Msg("ignoring event update")
 			return false
 		}
+		// the room has a new state snapshot, so state loaded for it before won't be used again
+		if roomEventUpdate.EventData.StateKey != nil {
+			s.roomStateCache.Invalidate(roomEventUpdate.RoomID())
+		}
 	}
 
 	// for initial rooms e.g a room comes into the window or a subscription now exists
@@ -249,6 +260,16 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				}
 				r.Timeline = append(r.Timeline, roomIDtoTimeline[roomEventUpdate.RoomID()]...)
 				roomID := roomEventUpdate.RoomID()
+				ed := roomEventUpdate.EventData
+				if ed.EventType == "m.room.member" && ed.StateKey != nil && !r.Initial && s.shouldIncludeMembershipChanges(roomID) {
+					r.AddMembershipChange(
+						*ed.StateKey, ed.Content.Get("membership").Str,
+						gjson.GetBytes(ed.Event, "unsigned.prev_content.membership").Str,
+					)
+				}
+				if ed.StateKey != nil && s.shouldIncludeStateAfter(roomID, ed.EventType, *ed.StateKey) {
+					r.SetStateAfter(ed.Event)
+				}
 				sender := roomEventUpdate.EventData.Sender
 				if s.lazyCache.IsLazyLoading(roomID) && !s.lazyCache.IsSet(roomID, sender) {
 					// load the state event
@@ -270,6 +291,12 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		// there's no guarantees that the room will be in the response if say the event caused it to move
 		// off a list.
 		thisRoom, exists := response.Rooms[roomUpdate.RoomID()]
+		if inviteUpdate, ok := up.(*caches.InviteUpdate); ok && !exists && hasUpdates &&
+			(delta.RoomNameChanged || delta.RoomAvatarChanged || delta.JoinCountChanged || delta.RoomInfoChanged) {
+			// the invite we already sent has been enriched e.g by a room summary, so send the changes.
+			thisRoom = sync3.Room{Topic: inviteUpdate.InviteData.Topic()}
+			exists = true
+		}
 		if exists {
 			if delta.RoomNameChanged {
 				metadata := roomUpdate.GlobalRoomMetadata()
@@ -287,6 +314,10 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				metadata.RemoveHero(s.userID)
 				thisRoom.AvatarChange = sync3.NewAvatarChange(internal.CalculateAvatar(metadata, roomUpdate.UserRoomMetadata().IsDM))
 			}
+			if delta.RoomInfoChanged {
+				thisRoom.JoinRule = roomUpdate.GlobalRoomMetadata().JoinRule
+				thisRoom.HistoryVisibility = roomUpdate.GlobalRoomMetadata().HistoryVisibility
+			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = &roomUpdate.GlobalRoomMetadata().InviteCount
 			}
@@ -306,6 +337,19 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			thisRoom.UnreadCount = int64(roomUpdate.UserRoomMetadata().UnreadCount)
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
+		if threadUpdate, ok := up.(*caches.ThreadUnreadCountUpdate); ok && s.lists.ReadOnlyRoom(roomUpdate.RoomID()) != nil {
+			// like the room's counts, thread counts are silent so the room may not be in the response yet.
+			// Copy the threads as an initial room shares its map with the user cache.
+			threads := make(map[string]internal.ThreadUnreadCounts, len(thisRoom.ThreadUnreadNotifications)+len(threadUpdate.Threads))
+			for threadID, counts := range thisRoom.ThreadUnreadNotifications {
+				threads[threadID] = counts
+			}
+			for threadID, counts := range threadUpdate.Threads {
+				threads[threadID] = counts
+			}
+			thisRoom.ThreadUnreadNotifications = threads
+			response.Rooms[roomUpdate.RoomID()] = thisRoom
+		}
 	}
 	return hasUpdates
 }
@@ -463,16 +507,38 @@ func (s *connStateLive) resort(
 // shouldIncludeHeroes returns whether the given roomID is in a list or direct
 // subscription which should return heroes.
 func (s *connStateLive) shouldIncludeHeroes(roomID string) bool {
-	if s.roomSubscriptions[roomID].IncludeHeroes() {
+	return s.anySubscriptionFor(roomID, sync3.RoomSubscription.IncludeHeroes)
+}
+
+// shouldIncludeMembershipChanges returns whether the given roomID is in a list or
+// direct subscription which should return membership_changes.
+func (s *connStateLive) shouldIncludeMembershipChanges(roomID string) bool {
+	return s.anySubscriptionFor(roomID, sync3.RoomSubscription.IncludeMembershipChanges)
+}
+
+// shouldIncludeStateAfter returns whether the given state event should be added to state_after,
+// because it is in a subscription with use_state_after whose required_state matches it.
+func (s *connStateLive) shouldIncludeStateAfter(roomID, evType, stateKey string) bool {
+	return s.anySubscriptionFor(roomID, func(rs sync3.RoomSubscription) bool {
+		if !rs.UseStateAfter() {
+			return false
+		}
+		rsm := rs.RequiredStateMap(s.userID)
+		return rsm.Include(evType, stateKey) || (evType == "m.room.member" && rsm.IsLazyLoading())
+	})
+}
+
+// anySubscriptionFor returns whether the given roomID is in a list or direct
+// subscription for which fn returns true.
+func (s *connStateLive) anySubscriptionFor(roomID string, fn func(sync3.RoomSubscription) bool) bool {
+	if fn(s.roomSubscriptions[roomID]) {
 		return true
 	}
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	for _, listKey := range roomIDsToLists[roomID] {
-		// check if this list should include heroes
-		if !s.muxedReq.Lists[listKey].IncludeHeroes() {
-			continue
+		if fn(s.muxedReq.Lists[listKey].RoomSubscription) {
+			return true
 		}
-		return true
 	}
 	return false
 }
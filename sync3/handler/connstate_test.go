@@ -16,6 +16,10 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type joinChecker struct{}
@@ -48,6 +52,10 @@ func (t *NopJoinTracker) IsUserJoined(userID, roomID string) bool {
 	return true
 }
 
+func (t *NopJoinTracker) JoinedUsersForRoom(roomID string) []string {
+	return nil
+}
+
 type NopTransactionFetcher struct{}
 
 func (t *NopTransactionFetcher) TransactionIDForEvents(userID, deviceID string, eventIDs []string) (eventIDToTxnID map[string]string) {
@@ -521,6 +529,159 @@ func TestBumpToOutsideRange(t *testing.T) {
 	}
 }
 
+// Test that rooms which stop being active within active_within_ms are deleted from the list on the
+// next request, even though there are no new events in them.
+func TestConnStateActiveWithinExpires(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateActiveWithinExpires_alice:localhost"
+	deviceID := "yep"
+	activeWithin := time.Minute
+	now := time.Now()
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(now))
+	// B drops out of the window shortly after the first request
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(now.Add(-activeWithin+200*time.Millisecond)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 2, Timestamp: 2},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+			Filters: &sync3.RequestFilters{ActiveWithinMs: activeWithin.Milliseconds()},
+		}},
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomA.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+
+	// time moves past B's window without any new events
+	time.Sleep(300 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res, err = cs.OnIncomingRequest(ctx, ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 1,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(1),
+					},
+				},
+			},
+		},
+	})
+}
+
+// Test that the spans for resolving lists and building the response nest under the request's span.
+func TestConnStateSpansNest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prevProvider)
+
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSpansNest_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(time.Now()))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, "d", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	ctx, task := internal.StartTask(context.Background(), "request")
+	_, err := cs.OnIncomingRequest(ctx, ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{{0, 9}}),
+		}},
+	}, false, time.Now())
+	task.End()
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	wantParents := map[string]string{
+		"load":                   "request",
+		"buildListSubscriptions": "request",
+		"onIncomingListRequest":  "buildListSubscriptions",
+		"resolveList":            "onIncomingListRequest",
+		"buildRooms":             "request",
+		"buildResponse":          "request",
+	}
+	for name, parentName := range wantParents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no span %s", name)
+			continue
+		}
+		parent, ok := spans[parentName]
+		if !ok {
+			t.Fatalf("no span %s", parentName)
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %s: got parent %s want %s", name, span.Parent().SpanID(), parentName)
+		}
+	}
+}
+
 // Test that room subscriptions can be made and that events are pushed for them.
 func TestConnStateRoomSubscriptions(t *testing.T) {
 	ConnID := sync3.ConnID{
@@ -806,3 +967,292 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+// Test that live membership events are summarised in membership_changes only for rooms which asked for it.
+func TestConnStateMembershipChanges(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMembershipChanges_alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	timestampNow := spec.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(timestampNow-1000))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, "yep", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	includeChanges := true
+	req := &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 1, MembershipChanges: &includeChanges},
+			roomB.RoomID: {TimelineLimit: 1},
+		},
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	nid := int64(2)
+	for _, roomID := range []string{roomA.RoomID, roomB.RoomID} {
+		for _, ev := range []json.RawMessage{
+			testutils.NewJoinEvent(t, bob),
+			testutils.NewJoinEvent(t, charlie),
+			testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+				"membership":  "join",
+				"displayname": "Bob",
+			}, testutils.WithUnsigned(map[string]interface{}{
+				"prev_content": map[string]interface{}{"membership": "join"},
+			})),
+			testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+				"membership": "leave",
+			}, testutils.WithUnsigned(map[string]interface{}{
+				"prev_content": map[string]interface{}{"membership": "join"},
+			})),
+		} {
+			dispatcher.OnNewEvent(context.Background(), roomID, ev, nid)
+			nid++
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := &sync3.MembershipChanges{
+		Joined: sync3.MembershipChange{Count: 2, UserIDs: []string{bob, charlie}},
+		Left:   sync3.MembershipChange{Count: 1, UserIDs: []string{bob}},
+	}
+	if got := res.Rooms[roomA.RoomID]; len(got.Timeline) != 4 || !reflect.DeepEqual(got.MembershipChanges, want) {
+		t.Errorf("room A: got %d timeline events and membership changes %+v, want 4 and %+v", len(got.Timeline), got.MembershipChanges, want)
+	}
+	if got := res.Rooms[roomB.RoomID]; len(got.Timeline) != 4 || got.MembershipChanges != nil {
+		t.Errorf("room B: got %d timeline events and membership changes %+v, want 4 and none", len(got.Timeline), got.MembershipChanges)
+	}
+}
+
+// Test that clients which send room_hashes after reconnecting don't get sent rooms they already have.
+func TestConnStateRoomHashes(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRoomHashes_alice:localhost"
+	timestampNow := spec.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(timestampNow-1000))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	newConnState := func() *ConnState {
+		return NewConnState(userID, "yep", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	}
+	subs := map[string]sync3.RoomSubscription{
+		roomA.RoomID: {TimelineLimit: 1},
+		roomB.RoomID: {TimelineLimit: 1},
+	}
+
+	// rooms aren't hashed unless the client asks
+	res, err := newConnState().OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: subs,
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Rooms[roomA.RoomID].Hash != "" {
+		t.Fatalf("got a room hash without sending room_hashes")
+	}
+
+	res, err = newConnState().OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: subs,
+		RoomHashes:        map[string]string{},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	hashA := res.Rooms[roomA.RoomID].Hash
+	hashB := res.Rooms[roomB.RoomID].Hash
+	if hashA == "" || hashB == "" || hashA == hashB {
+		t.Fatalf("got room hashes %q %q, want two different hashes", hashA, hashB)
+	}
+
+	// the connection expires, and room B changes
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, testutils.NewStateEvent(t, "m.room.name", "", "@bob:localhost", map[string]interface{}{"name": "Renamed"}), 2)
+	res, err = newConnState().OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: subs,
+		RoomHashes: map[string]string{
+			roomA.RoomID: hashA,
+			roomB.RoomID: hashB,
+		},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	gotA := res.Rooms[roomA.RoomID]
+	if !gotA.Unchanged || gotA.Hash != hashA || len(gotA.Timeline) != 0 {
+		t.Errorf("room A: got %+v want an unchanged stub with hash %s", gotA, hashA)
+	}
+	gotB := res.Rooms[roomB.RoomID]
+	if gotB.Unchanged || gotB.Hash == hashB || gotB.Name != "Renamed" {
+		t.Errorf("room B: got %+v want a new payload", gotB)
+	}
+}
+
+// Test that state changes are delivered in state_after for subscriptions which ask for it.
+func TestConnStateStateAfter(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateStateAfter_alice:localhost"
+	bob := "@bob:localhost"
+	timestampNow := spec.Timestamp(1632131678061)
+	roomA := newRoomMetadata("!a:localhost", timestampNow)
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(timestampNow-1000))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 1, Timestamp: 1},
+				roomB.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, "yep", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	useStateAfter := true
+	req := &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.name", ""}},
+				StateAfter:    &useStateAfter,
+			},
+			roomB.RoomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.name", ""}},
+			},
+		},
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	nid := int64(2)
+	for _, roomID := range []string{roomA.RoomID, roomB.RoomID} {
+		for _, ev := range []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "First"}),
+			testutils.NewJoinEvent(t, bob), // not in required_state
+			testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Second"}),
+		} {
+			dispatcher.OnNewEvent(context.Background(), roomID, ev, nid)
+			nid++
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	gotA := res.Rooms[roomA.RoomID]
+	if len(gotA.Timeline) != 3 || len(gotA.StateAfter) != 1 || gjson.GetBytes(gotA.StateAfter[0], "content.name").Str != "Second" {
+		t.Errorf("room A: got %d timeline events and state_after %v, want 3 and the second name", len(gotA.Timeline), gotA.StateAfter)
+	}
+	gotB := res.Rooms[roomB.RoomID]
+	if len(gotB.Timeline) != 3 || gotB.StateAfter != nil {
+		t.Errorf("room B: got %d timeline events and state_after %v, want 3 and none", len(gotB.Timeline), gotB.StateAfter)
+	}
+}
+
+func TestConnStateDefaultBumpEventTypes(t *testing.T) {
+	defaults := []string{"m.room.message", "m.room.encrypted"}
+	cs := &ConnState{defaultBumpEventTypes: defaults}
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"default":  {},
+			"messages": {BumpEventTypes: []string{"m.room.message"}},
+			"all":      {BumpEventTypes: []string{sync3.Wildcard}},
+		},
+	}
+	got := cs.withDefaultBumpEventTypes(req)
+	if req.Lists["default"].BumpEventTypes != nil {
+		t.Errorf("client request was modified: %v", req.Lists["default"].BumpEventTypes)
+	}
+	wantBumpEventTypes := map[string][]string{
+		"default":  defaults,
+		"messages": {"m.room.message"},
+		"all":      {},
+	}
+	for listKey, want := range wantBumpEventTypes {
+		if !reflect.DeepEqual(got.Lists[listKey].BumpEventTypes, want) {
+			t.Errorf("list %s: got bump_event_types %v want %v", listKey, got.Lists[listKey].BumpEventTypes, want)
+		}
+	}
+
+	// existing lists keep their bump_event_types when the client doesn't send them again
+	cs.muxedReq, _ = cs.muxedReq.ApplyDelta(got)
+	got = cs.withDefaultBumpEventTypes(&sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"all": {Ranges: sync3.SliceRanges{{0, 10}}},
+		},
+	})
+	if got.Lists["all"].BumpEventTypes != nil {
+		t.Errorf("list all: got bump_event_types %v want them left to the existing list", got.Lists["all"].BumpEventTypes)
+	}
+	cs.muxedReq, _ = cs.muxedReq.ApplyDelta(got)
+	if !reflect.DeepEqual(cs.muxedReq.Lists["all"].BumpEventTypes, []string{}) {
+		t.Errorf("list all: got muxed bump_event_types %v want []", cs.muxedReq.Lists["all"].BumpEventTypes)
+	}
+}
@@ -36,6 +36,10 @@ type EnsurePoller struct {
 	notifier     pubsub.Notifier
 	// the total number of outstanding ensurepolling requests.
 	numPendingEnsurePolling prometheus.Gauge
+
+	// ephemeralDemand is the set of connections for each device which want typing notifications or
+	// receipts. Guarded by mu.
+	ephemeralDemand map[sync2.PollerID]map[*ConnState]struct{}
 }
 
 func NewEnsurePoller(notifier pubsub.Notifier, enablePrometheus bool) *EnsurePoller {
@@ -183,6 +187,54 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	// by signalling via the expired flag.
 }
 
+// OnPollerStopped forgets that the poller for this device did an initial sync, so the next
+// request from the device starts a new poller. Requests already waiting for a poller are left
+// waiting, as a new poller is already on its way.
+func (p *EnsurePoller) OnPollerStopped(payload *pubsub.V2PollerStopped) {
+	pid := sync2.PollerID{UserID: payload.UserID, DeviceID: payload.DeviceID}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, exists := p.pendingPolls[pid]
+	if !exists || !pending.done {
+		return
+	}
+	delete(p.pendingPolls, pid)
+}
+
+// SetEphemeralDemand records whether this connection wants typing notifications or receipts, and
+// tells the poller for the device when the first connection starts or the last connection stops
+// wanting them.
+func (p *EnsurePoller) SetEphemeralDemand(pid sync2.PollerID, cs *ConnState, wanted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ephemeralDemand == nil {
+		p.ephemeralDemand = make(map[sync2.PollerID]map[*ConnState]struct{})
+	}
+	conns := p.ephemeralDemand[pid]
+	wasWanted := len(conns) > 0
+	if wanted {
+		if conns == nil {
+			conns = make(map[*ConnState]struct{})
+			p.ephemeralDemand[pid] = conns
+		}
+		conns[cs] = struct{}{}
+	} else {
+		delete(conns, cs)
+		if len(conns) == 0 {
+			delete(p.ephemeralDemand, pid)
+		}
+	}
+	if wasWanted == (len(conns) > 0) {
+		return
+	}
+	// notify whilst holding mu so the poller sees changes in order
+	p.notifier.Notify(p.chanName, &pubsub.V3EphemeralDemand{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Wanted:   !wasWanted,
+	})
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 	if p.numPendingEnsurePolling != nil {
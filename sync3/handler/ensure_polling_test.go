@@ -200,3 +200,74 @@ func assertVal(t *testing.T, got, want interface{}) {
 		t.Fatalf("assertVal: got %v want %v", got, want)
 	}
 }
+
+// Check that stopping a poller means the next request asks for a new poller.
+func TestEnsurePollerRestartsStoppedPollers(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	ctx := context.Background()
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}
+	ep := NewEnsurePoller(n, false)
+
+	// the poller started without us asking e.g at startup
+	ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Success:  true,
+	})
+	if ep.EnsurePolling(ctx, pid, "tokenHash") {
+		t.Fatalf("EnsurePolling said token was expired when it wasn't")
+	}
+	n.MustHaveNoSentPayloads(t)
+
+	ep.OnPollerStopped(&pubsub.V2PollerStopped{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+	})
+	finished := make(chan bool)
+	go func() {
+		_ = ep.EnsurePolling(ctx, pid, "tokenHash")
+		close(finished)
+	}()
+	p := n.WaitForNextPayload(t, time.Second)
+	if _, ok := p.(*pubsub.V3EnsurePolling); !ok {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+	ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Success:  true,
+	})
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatalf("EnsurePolling didn't unblock after response was sent")
+	}
+}
+
+// check that pollers are only told when the first conn wants ephemeral events and when the last
+// conn stops wanting them
+func TestEnsurePollerEphemeralDemand(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}
+	ep := NewEnsurePoller(n, false)
+	connA := &ConnState{}
+	connB := &ConnState{}
+
+	ep.SetEphemeralDemand(pid, connA, true)
+	want := &pubsub.V3EphemeralDemand{UserID: pid.UserID, DeviceID: pid.DeviceID, Wanted: true}
+	if got := n.WaitForNextPayload(t, time.Second); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	ep.SetEphemeralDemand(pid, connB, true)
+	ep.SetEphemeralDemand(pid, connA, false)
+	n.MustHaveNoSentPayloads(t)
+
+	ep.SetEphemeralDemand(pid, connB, false)
+	want = &pubsub.V3EphemeralDemand{UserID: pid.UserID, DeviceID: pid.DeviceID, Wanted: false}
+	if got := n.WaitForNextPayload(t, time.Second); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	// conns which never wanted them don't tell the poller anything
+	ep.SetEphemeralDemand(pid, connA, false)
+	n.MustHaveNoSentPayloads(t)
+}
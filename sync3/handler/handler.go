@@ -2,13 +2,14 @@ package handler
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"reflect"
 	"strconv"
 	"sync"
@@ -34,10 +35,7 @@ import (
 
 const DefaultSessionID = "default"
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleConn)
 
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
@@ -59,33 +57,72 @@ type SyncLiveHandler struct {
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	// maxTimeoutMSecs is the longest a request can wait for new data. Longer timeouts are clamped.
+	maxTimeoutMSecs int
+	// keepaliveMSecs is the longest a request waits before an empty keepalive response is sent, or 0.
+	keepaliveMSecs int
+	// backfiller fills short timelines from the homeserver, or is nil if backfilling is disabled.
+	backfiller Backfiller
+	// upstreamUnavailableSince is when the pollers' circuit breaker tripped in unix millis, by the
+	// server name of the homeserver. Servers which are available are missing.
+	upstreamUnavailableSince *sync.Map
+	// defaultBumpEventTypes are the bump_event_types of lists which don't set them, or nil.
+	defaultBumpEventTypes []string
+	// webSockets enables serving requests over a WebSocket at sync3.WebSocketSyncPath.
+	webSockets bool
+	// webSocketOrigins are the origins browsers may open WebSockets from, or "*" for any.
+	webSocketOrigins []string
+	// persistConns stores the sticky request of every connection, so they survive restarts.
+	persistConns bool
+	// ephemeralOnDemand tells pollers whether any connection for their device wants typing
+	// notifications or receipts, so they can stop fetching them.
+	ephemeralOnDemand bool
+	// requestLimiter limits how often each device can make requests, or is nil if disabled.
+	requestLimiter *requestLimiter
+	// connTTL is how long a connection can go without a request before it is expired.
+	connTTL time.Duration
+	// startedAt is when the handler was created. Stored connections from before then can be rehydrated.
+	startedAt time.Time
+	// draining is closed by Drain, to end long polls and reject new requests.
+	draining  chan struct{}
+	drainOnce sync.Once
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
 	slowReqs     prometheus.Counter
+	// rateLimitedReqs is the number of requests rejected by the requestLimiter.
+	rateLimitedReqs prometheus.Counter
 	// destroyedConns is the number of connections that have been destoryed after
-	// a room invalidation payload.
-	// TODO: could make this a CounterVec labelled by reason, to track expiry due
-	//       to update buffer filling, expiry due to inactivity, etc.
+	// a room invalidation payload. The ConnMap counts every closed connection by reason.
 	destroyedConns prometheus.Counter
+	// toDeviceQueueTicker periodically updates the to-device queue metrics, if metrics are enabled.
+	toDeviceQueueTicker *time.Ticker
 }
 
 func NewSync3Handler(
 	store *state.Storage, storev2 *sync2.Storage, v2Client sync2.Client, secret string,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, maxPendingEventUpdates int,
-	maxTransactionIDDelay time.Duration,
+	maxTransactionIDDelay time.Duration, maxTimeout time.Duration,
 ) (*SyncLiveHandler, error) {
 	logger.Info().Msg("creating handler")
 	sh := &SyncLiveHandler{
-		V2:                     v2Client,
-		Storage:                store,
-		V2Store:                storev2,
-		ConnMap:                sync3.NewConnMap(enablePrometheus, 30*time.Minute),
-		userCaches:             &sync.Map{},
-		Dispatcher:             sync3.NewDispatcher(),
-		GlobalCache:            caches.NewGlobalCache(store),
-		maxPendingEventUpdates: maxPendingEventUpdates,
-		maxTransactionIDDelay:  maxTransactionIDDelay,
+		V2:                       v2Client,
+		Storage:                  store,
+		V2Store:                  storev2,
+		ConnMap:                  sync3.NewConnMap(enablePrometheus, connExpiry),
+		userCaches:               &sync.Map{},
+		Dispatcher:               sync3.NewDispatcher(),
+		GlobalCache:              caches.NewGlobalCache(store),
+		maxPendingEventUpdates:   maxPendingEventUpdates,
+		maxTransactionIDDelay:    maxTransactionIDDelay,
+		maxTimeoutMSecs:          int(maxTimeout.Milliseconds()),
+		connTTL:                  connExpiry,
+		upstreamUnavailableSince: &sync.Map{},
+		draining:                 make(chan struct{}),
+		startedAt:                time.Now(),
+	}
+	if sh.maxTimeoutMSecs <= 0 {
+		sh.maxTimeoutMSecs = sync3.DefaultMaxTimeoutMSecs
 	}
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
@@ -110,12 +147,64 @@ func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
 		return fmt.Errorf("failed to load sync3.Dispatcher: %s", err)
 	}
 	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
+	if len(storeSnapshot.UnhydratedRoomIDs) > 0 {
+		// from state.Storage.LazyGlobalSnapshot
+		h.GlobalCache.StartupLazy(storeSnapshot.GlobalMetadata, storeSnapshot.UnhydratedRoomIDs)
+		return nil
+	}
 	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
 		return fmt.Errorf("failed to populate global cache: %s", err)
 	}
 	return nil
 }
 
+// SetKeepaliveInterval sets the longest time a request waits for new data before an empty response
+// marked as a keepalive is sent, for load balancers which kill idle HTTP responses. Disabled if 0.
+// Must be called before serving requests.
+func (h *SyncLiveHandler) SetKeepaliveInterval(d time.Duration) {
+	h.keepaliveMSecs = int(d.Milliseconds())
+}
+
+// SetEphemeralOnDemand makes connections tell the pollers for their device when they enable or
+// disable the typing and receipts extensions. Must be called before serving requests.
+func (h *SyncLiveHandler) SetEphemeralOnDemand(enabled bool) {
+	h.ephemeralOnDemand = enabled
+}
+
+// SetDefaultBumpEventTypes sets the bump_event_types of lists which don't set their own, so that e.g
+// reactions don't bump rooms by default. Clients can still bump rooms for every event with the
+// wildcard "*". Disabled if empty. Must be called before serving requests.
+func (h *SyncLiveHandler) SetDefaultBumpEventTypes(bumpEventTypes []string) {
+	h.defaultBumpEventTypes = bumpEventTypes
+}
+
+// Drain stops serving sync requests, for a graceful shutdown. Requests which are waiting for new
+// data return straight away, marked as a keepalive so the client comes straight back, and new
+// requests are rejected with a retriable 503. Safe to call more than once.
+func (h *SyncLiveHandler) Drain() {
+	h.drainOnce.Do(func() {
+		close(h.draining)
+	})
+}
+
+// IsDraining returns true once Drain has been called.
+func (h *SyncLiveHandler) IsDraining() bool {
+	select {
+	case <-h.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainingError is returned to requests made while draining, which the client should retry.
+func drainingError() *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        fmt.Errorf("server is shutting down"),
+	}
+}
+
 // Listen starts all consumers
 func (h *SyncLiveHandler) Listen() {
 	go func() {
@@ -126,6 +215,28 @@ func (h *SyncLiveHandler) Listen() {
 			sentry.CaptureException(err)
 		}
 	}()
+	if h.Extensions.ToDeviceMetrics != nil && h.toDeviceQueueTicker == nil {
+		h.toDeviceQueueTicker = time.NewTicker(30 * time.Second)
+		go func() {
+			for range h.toDeviceQueueTicker.C {
+				h.UpdateToDeviceQueueMetrics()
+			}
+		}()
+	}
+}
+
+// UpdateToDeviceQueueMetrics records how many to-device messages are waiting to be sent to devices
+// with an active connection. Devices without a connection are ignored, as they may never come back
+// to collect their messages. This function does not normally need to be called manually (Listen
+// runs it every 30s if metrics are enabled); we expose it publicly only for testing purposes.
+func (h *SyncLiveHandler) UpdateToDeviceQueueMetrics() {
+	userIDs, deviceIDs := h.ConnMap.Devices()
+	stats, err := h.Storage.ToDeviceTable.QueueStats(userIDs, deviceIDs)
+	if err != nil {
+		logger.Err(err).Msg("failed to load to-device queue stats")
+		return
+	}
+	h.Extensions.ToDeviceMetrics.SetQueueStats(stats)
 }
 
 // used in tests to close postgres connections
@@ -135,6 +246,10 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.EnsurePoller.Teardown()
 	h.ConnMap.Teardown()
+	if h.toDeviceQueueTicker != nil {
+		h.toDeviceQueueTicker.Stop()
+	}
+	h.Extensions.ToDeviceMetrics.Teardown()
 	if h.setupHistVec != nil {
 		prometheus.Unregister(h.setupHistVec)
 	}
@@ -147,6 +262,9 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.rateLimitedReqs != nil {
+		prometheus.Unregister(h.rateLimitedReqs)
+	}
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -176,14 +294,26 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "destroyed_conns",
 		Help:      "Counter of conns that were destroyed.",
 	})
+	h.rateLimitedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "rate_limited_requests",
+		Help:      "Counter of requests rejected because the device made too many requests.",
+	})
 
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
 	prometheus.MustRegister(h.destroyedConns)
+	prometheus.MustRegister(h.rateLimitedReqs)
+	h.Extensions.ToDeviceMetrics = extensions.NewToDeviceMetrics()
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == sync3.WebSocketSyncPath {
+		h.serveWebSocket(w, req)
+		return
+	}
 	if req.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -197,7 +327,13 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				Err:        err,
 			}
 		}
-		if herr.ErrCode != "M_UNKNOWN_POS" {
+		if herr.StatusCode == http.StatusServiceUnavailable {
+			// we are shutting down, so the client should retry against another instance
+			w.Header().Set("Retry-After", "1")
+		} else if herr.StatusCode == http.StatusTooManyRequests {
+			// the client is already being told to back off, so don't hold the request open
+			w.Header().Set("Retry-After", retryAfterHeader(herr.RetryAfter))
+		} else if herr.ErrCode != "M_UNKNOWN_POS" {
 			// artificially wait a bit before sending back the error
 			// this guards against tightlooping when the client hammers the server with invalid requests,
 			// but not for M_UNKNOWN_POS which we expect to send back after expiring a client's connection.
@@ -221,6 +357,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			internal.DecorateLogger(req.Context(), log.Warn()).Dur("duration", dur).Msg("slow request")
 		}
 	}()
+	if h.IsDraining() {
+		return drainingError()
+	}
 	var requestBody sync3.Request
 	if req.ContentLength != 0 {
 		defer req.Body.Close()
@@ -231,13 +370,14 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 				Err:        err,
 			}
 		}
-		if err := requestBody.Validate(); err != nil {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        err,
-			}
+		if herr := requestBody.Validate(); herr != nil {
+			return herr
 		}
 	}
+	simplified := req.URL.Path == sync3.SimplifiedSyncPath
+	if simplified {
+		requestBody.Simplify()
+	}
 	if requestBody.ConnID != "" {
 		req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagConnID, requestBody.ConnID))
 	}
@@ -248,14 +388,6 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
-	}
 
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
@@ -267,31 +399,48 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 
 	cancelCtx, cancel := context.WithCancel(req.Context())
 	req = req.WithContext(cancelCtx)
-	req, conn, herr := h.setupConnection(req, cancel, &requestBody, req.URL.Query().Get("pos") != "")
+	go func() {
+		// end the request early if we start draining. The request context is cancelled when
+		// the request finishes, so this doesn't leak.
+		select {
+		case <-h.draining:
+			cancel()
+		case <-cancelCtx.Done():
+		}
+	}()
+	req, conn, rehydrated, herr := h.setupConnection(req, cancel, &requestBody, req.URL.Query().Get("pos") != "")
+	if herr != nil && h.IsDraining() && cancelCtx.Err() != nil {
+		// we cancelled the request before it had a connection
+		herr = drainingError()
+	}
 	if herr != nil {
 		logErrorOrWarning("failed to get or create Conn", herr)
 		return herr
 	}
+	h.registerTransactionIDs(req.Context(), conn.UserID, conn.DeviceID, requestBody.TransactionIDs)
 	// set pos and timeout if specified
 	cpos, herr := parseIntFromQuery(req.URL, "pos")
 	if herr != nil {
 		return herr
 	}
-	requestBody.SetPos(cpos)
-	log := hlog.FromRequest(req).With().Str("user", conn.UserID).Int64("pos", cpos).Logger()
-
-	var timeout int
-	if req.URL.Query().Get("timeout") == "" {
-		timeout = sync3.DefaultTimeoutMSecs
+	if rehydrated {
+		// the connection is new to us, so this is its first request
+		requestBody.SetPos(0)
 	} else {
-		timeout64, herr := parseIntFromQuery(req.URL, "timeout")
-		if herr != nil {
-			return herr
-		}
-		timeout = int(timeout64)
+		requestBody.SetPos(cpos)
 	}
+	log := hlog.FromRequest(req).With().Str("user", conn.UserID).Int64("pos", cpos).Logger()
 
+	timeout, herr := parseTimeout(req.URL, h.maxTimeoutMSecs)
+	if herr != nil {
+		return herr
+	}
+	keepalive := h.keepaliveMSecs > 0 && timeout > h.keepaliveMSecs
+	if keepalive {
+		timeout = h.keepaliveMSecs
+	}
 	requestBody.SetTimeoutMSecs(timeout)
+	requestBody.SetKeepalive(keepalive)
 	log.Trace().Int("timeout", timeout).Msg("recv")
 
 	resp, herr := conn.OnIncomingRequest(req.Context(), &requestBody, start)
@@ -318,9 +467,32 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		numChangedDevices, numLeftDevices, requestBody.ConnID, len(requestBody.Lists), len(requestBody.RoomSubscriptions), len(requestBody.UnsubscribeRooms),
 	)
 
+	if since, ok := h.upstreamUnavailableSince.Load(sync2.UserServerName(conn.UserID)); ok {
+		resp.UpstreamUnavailableSince = since.(int64)
+	}
+	if (keepalive || h.IsDraining()) && resp.ListOps() == 0 && len(resp.Rooms) == 0 && !resp.Extensions.HasData(false) {
+		// we cut the long poll short, so tell the client to come straight back
+		resp.Keepalive = true
+	}
+	if simplified {
+		resp = resp.Simplified()
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		herr = &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+		logErrorOrWarning("failed to JSON-encode result", herr)
+		return herr
+	}
+	body = append(body, '\n')
+	// the ETag lets clients check that a response is the one they expect, e.g when retrying
+	w.Header().Set("ETag", responseETag(body))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if _, err := w.Write(body); err != nil {
 		herr = &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -335,7 +507,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			herr.StatusCode = 499
 		}
 
-		logErrorOrWarning("failed to JSON-encode result", herr)
+		logErrorOrWarning("failed to write result", herr)
 		return herr
 	}
 	return nil
@@ -344,7 +516,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 // setupConnection associates this request with an existing connection or makes a new connection.
 // It also sets a v2 sync poll loop going if one didn't exist already for this user.
 // When this function returns, the connection is alive and active.
-func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, containsPos bool) (*http.Request, *sync3.Conn, *internal.HandlerError) {
+func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, containsPos bool) (*http.Request, *sync3.Conn, bool, *internal.HandlerError) {
 	ctx, task := internal.StartTask(req.Context(), "setupConnection")
 	req = req.WithContext(ctx)
 	defer task.End()
@@ -353,7 +525,7 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	accessToken, err := internal.ExtractAccessToken(req)
 	if err != nil || accessToken == "" {
 		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get access token from request")
-		return req, nil, &internal.HandlerError{
+		return req, nil, false, &internal.HandlerError{
 			StatusCode: http.StatusUnauthorized,
 			Err:        err,
 		}
@@ -361,18 +533,20 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 
 	// Try to lookup a record of this token
 	var token *sync2.Token
+	_, span := internal.StartSpan(req.Context(), "lookupToken")
 	token, err = h.V2Store.TokensTable.Token(accessToken)
+	span.End()
 	if err != nil {
 		if err == sql.ErrNoRows {
 			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
 			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
 			if herr != nil {
-				return req, nil, herr
+				return req, nil, false, herr
 			}
 			token = newToken
 		} else {
 			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
-			return req, nil, &internal.HandlerError{
+			return req, nil, false, &internal.HandlerError{
 				StatusCode: http.StatusInternalServerError,
 				Err:        err,
 			}
@@ -388,6 +562,16 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
 	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	if h.requestLimiter != nil {
+		if herr := h.requestLimiter.allow(token.UserID, token.DeviceID); herr != nil {
+			if h.rateLimitedReqs != nil {
+				h.rateLimitedReqs.Inc()
+			}
+			log.Warn().Dur("retry_after", herr.RetryAfter).Msg("rate limited request")
+			return req, nil, false, herr
+		}
+	}
+
 	// Record the fact that we've recieved a request from this token
 	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
@@ -401,16 +585,23 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 		CID:      syncReq.ConnID,
 	}
 	// client thinks they have a connection
+	rehydrated := false
 	if containsPos {
 		// Lookup the connection
+		_, span = internal.StartSpan(req.Context(), "lookupConn")
 		conn = h.ConnMap.Conn(connID)
+		span.End()
 		if conn != nil {
 			conn.SetCancelCallback(cancel)
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
-			return req, conn, nil
+			return req, conn, false, nil
 		}
-		// conn doesn't exist, we probably nuked it.
-		return req, nil, internal.ExpiredSessionError()
+		// conn doesn't exist, we probably nuked it, unless we restarted since.
+		if !h.rehydrateConnRequest(connID, syncReq) {
+			return req, nil, false, internal.ExpiredSessionError()
+		}
+		rehydrated = true
+		log.Info().Msg("rehydrating connection from its stored request")
 	}
 
 	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
@@ -419,7 +610,7 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	if expiredToken {
 		log.Error().Msg("EnsurePolling failed, returning 401")
 		// Assumption: the only way that EnsurePolling fails is if the access token is invalid.
-		return req, nil, &internal.HandlerError{
+		return req, nil, false, &internal.HandlerError{
 			StatusCode: http.StatusUnauthorized,
 			ErrCode:    "M_UNKNOWN_TOKEN",
 			Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
@@ -430,21 +621,32 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// We'll be quicker next time as the poller will already exist.
 	if req.Context().Err() != nil {
 		log.Warn().Msg("client gave up, not creating connection")
-		return req, nil, &internal.HandlerError{
+		return req, nil, false, &internal.HandlerError{
 			StatusCode: 400,
 			Err:        req.Context().Err(),
 		}
 	}
 
-	userCache, err := h.userCache(token.UserID)
+	userCacheCtx, span := internal.StartSpan(req.Context(), "loadUserCache")
+	userCache, err := h.userCache(userCacheCtx, token.UserID)
+	span.End()
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to load user cache")
-		return req, nil, &internal.HandlerError{
+		return req, nil, false, &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
 		}
 	}
 
+	// the client may be retrying an initial request which it gave up on whilst we were building the
+	// response, in which case the connection already has the response waiting.
+	conn = h.ConnMap.Conn(connID)
+	if conn != nil && conn.ResumableInitial(syncReq) {
+		conn.SetCancelCallback(cancel)
+		log.Info().Msg("resuming initial sync on existing connection")
+		return req, conn, false, nil
+	}
+
 	// once we have the conn, make sure our metrics are correct
 	defer h.ConnMap.UpdateMetrics()
 
@@ -454,10 +656,23 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
 	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs.backfiller = h.backfiller
+		cs.defaultBumpEventTypes = h.defaultBumpEventTypes
+		if h.persistConns {
+			cs.persistRequest = func(req json.RawMessage) {
+				h.persistConnRequest(connID, req)
+			}
+		}
+		if h.ephemeralOnDemand {
+			cs.onEphemeralDemand = func(wanted bool) {
+				h.EnsurePoller.SetEphemeralDemand(pid, cs, wanted)
+			}
+		}
+		return cs
 	})
 	log.Info().Msg("created new connection")
-	return req, conn, nil
+	return req, conn, rehydrated, nil
 }
 
 func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
@@ -511,6 +726,23 @@ func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 	return nil
 }
 
+// EvictUser forgets everything held in memory about this user and closes all of their
+// connections, so that nothing is served from data which has been erased from the database.
+// Returns the number of connections closed.
+func (h *SyncLiveHandler) EvictUser(userID string) int {
+	return h.evictUser(userID, sync3.EvictionErased)
+}
+
+func (h *SyncLiveHandler) evictUser(userID string, reason sync3.EvictionReason) int {
+	h.Dispatcher.UnregisterBulk([]string{userID})
+	h.userCaches.Delete(userID)
+	closed := h.ConnMap.CloseConnsForUsers([]string{userID}, reason)
+	if h.destroyedConns != nil {
+		h.destroyedConns.Add(float64(closed))
+	}
+	return closed
+}
+
 // userCache fetches an existing caches.UserCache for this user if one exists. If not,
 // it
 //   - creates a blank caches.UserCache struct,
@@ -522,7 +754,7 @@ func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 // TODO: the calls to uc.OnBlahBlah etc can be moved into NewUserCache, now that the
 //
 //	UserCache holds a reference to the storage layer.
-func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
+func (h *SyncLiveHandler) userCache(ctx context.Context, userID string) (*caches.UserCache, error) {
 	// bail if we already have a cache
 	c, ok := h.userCaches.Load(userID)
 	if ok {
@@ -531,18 +763,25 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
 	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount, unreadCount int) {
-		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount, &unreadCount)
+		uc.OnUnreadCounts(ctx, roomID, &highlightCount, &notificationCount, &unreadCount)
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load unread counts: %s", err)
 	}
+	threadCounts, err := h.Storage.ThreadUnreadTable.SelectAllForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load thread unread counts: %s", err)
+	}
+	for roomID, threads := range threadCounts {
+		uc.OnThreadUnreadCounts(ctx, roomID, threads)
+	}
 	// select the DM account data event and set DM room status
 	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load direct message status for rooms: %s", err)
 	}
 	if len(directEvent) == 1 {
-		uc.OnAccountData(context.Background(), []state.AccountData{directEvent[0]})
+		uc.OnAccountData(ctx, []state.AccountData{directEvent[0]})
 	}
 
 	// select the ignored users account data event and set ignored user list
@@ -551,7 +790,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		return nil, fmt.Errorf("failed to load ignored user list for user %s: %w", userID, err)
 	}
 	if len(ignoreEvent) == 1 {
-		uc.OnAccountData(context.Background(), []state.AccountData{ignoreEvent[0]})
+		uc.OnAccountData(ctx, []state.AccountData{ignoreEvent[0]})
 	}
 
 	// select all room tag account data and set it
@@ -560,7 +799,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		return nil, fmt.Errorf("failed to load room tags %s", err)
 	}
 	if len(tagEvents) > 0 {
-		uc.OnAccountData(context.Background(), tagEvents)
+		uc.OnAccountData(ctx, tagEvents)
 	}
 
 	// select outstanding invites
@@ -568,8 +807,16 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load outstanding invites for user: %s", err)
 	}
+	summaries, err := h.Storage.RoomSummariesTable.Select(internal.Keys(invites))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load room summaries for invites: %s", err)
+	}
 	for roomID, inviteState := range invites {
-		uc.OnInvite(context.Background(), roomID, inviteState)
+		var summary *internal.RoomSummary
+		if s, ok := summaries[roomID]; ok {
+			summary = &s.RoomSummary
+		}
+		uc.OnInvite(ctx, roomID, inviteState, summary)
 	}
 
 	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
@@ -577,7 +824,7 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
 	uc = actualUC.(*caches.UserCache)
 	if !loaded { // we actually inserted the cache, so register with the dispatcher.
-		if err = h.Dispatcher.Register(context.Background(), userID, uc); err != nil {
+		if err = h.Dispatcher.Register(ctx, userID, uc); err != nil {
 			h.Dispatcher.Unregister(userID)
 			h.userCaches.Delete(userID)
 			return nil, fmt.Errorf("failed to register user cache with dispatcher: %s", err)
@@ -702,6 +949,16 @@ func (h *SyncLiveHandler) OnUnreadCounts(p *pubsub.V2UnreadCounts) {
 	userCache.(*caches.UserCache).OnUnreadCounts(ctx, p.RoomID, p.HighlightCount, p.NotificationCount, p.UnreadCount)
 }
 
+func (h *SyncLiveHandler) OnThreadUnreadCounts(p *pubsub.V2ThreadUnreadCounts) {
+	ctx, task := internal.StartTask(context.Background(), "OnThreadUnreadCounts")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	userCache.(*caches.UserCache).OnThreadUnreadCounts(ctx, p.RoomID, p.Threads)
+}
+
 // push device data updates on waiting conns (otk counts, device list changes)
 func (h *SyncLiveHandler) OnDeviceData(p *pubsub.V2DeviceData) {
 	ctx, task := internal.StartTask(context.Background(), "OnDeviceData")
@@ -740,7 +997,18 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
-	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
+	if inviteState == nil {
+		return // the invite was retired since this notification was sent
+	}
+	var summary *internal.RoomSummary
+	summaries, err := h.Storage.RoomSummariesTable.Select([]string{p.RoomID})
+	if err != nil {
+		// the invite is still usable without a summary
+		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get room summary")
+	} else if s, ok := summaries[p.RoomID]; ok {
+		summary = &s.RoomSummary
+	}
+	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState, summary)
 }
 
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
@@ -753,6 +1021,16 @@ func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	userCache.(*caches.UserCache).OnLeftRoom(ctx, p.RoomID, p.LeaveEvent)
 }
 
+func (h *SyncLiveHandler) OnForgetRoom(p *pubsub.V2ForgetRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnForgetRoom")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	userCache.(*caches.UserCache).OnForgetRoom(ctx, p.RoomID)
+}
+
 func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 	ctx, task := internal.StartTask(context.Background(), "OnReceipt")
 	defer task.End()
@@ -785,6 +1063,14 @@ func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 	}
 }
 
+func (h *SyncLiveHandler) OnPresence(p *pubsub.V2Presence) {
+	ctx, task := internal.StartTask(context.Background(), "OnPresence")
+	defer task.End()
+	for _, presence := range p.Presence {
+		h.Dispatcher.OnPresence(ctx, presence)
+	}
+}
+
 func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
 	ctx, task := internal.StartTask(context.Background(), "OnTyping")
 	defer task.End()
@@ -816,11 +1102,37 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
 	h.EnsurePoller.OnExpiredToken(p)
 	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
+	if h.persistConns {
+		if err := h.Storage.ConnRequestsTable.DeleteDevice(p.UserID, p.DeviceID); err != nil {
+			logger.Err(err).Str("user", p.UserID).Str("device", p.DeviceID).Msg("failed to delete connection requests")
+		}
+	}
+}
+
+func (h *SyncLiveHandler) OnPollerStopped(p *pubsub.V2PollerStopped) {
+	h.EnsurePoller.OnPollerStopped(p)
+}
+
+func (h *SyncLiveHandler) OnUpstreamStatus(p *pubsub.V2UpstreamStatus) {
+	if p.UnavailableSince == 0 {
+		h.upstreamUnavailableSince.Delete(p.ServerName)
+		return
+	}
+	h.upstreamUnavailableSince.Store(p.ServerName, p.UnavailableSince)
+}
+
+// OnResyncUser is called when updates for the user were dropped because too many were queued for
+// them. The user's cache and connections are dropped, so that they are loaded again from the
+// database which has every update.
+func (h *SyncLiveHandler) OnResyncUser(p *pubsub.V2ResyncUser) {
+	closed := h.evictUser(p.UserID, sync3.EvictionQueueOverflow)
+	logger.Warn().Str("user", p.UserID).Int("closed_conns", closed).Msg("resyncing user after their queued updates were dropped")
 }
 
 func (h *SyncLiveHandler) OnStateRedaction(p *pubsub.V2StateRedaction) {
 	// We only need to reload the global metadata here: mercifully, there isn't anything
-	// in the user cache that needs to be reloaded after state gets redacted.
+	// in the user cache that needs to be reloaded after state gets redacted. This also
+	// stops connections serving the unredacted state from their RoomStateCache.
 	ctx, task := internal.StartTask(context.Background(), "OnStateRedaction")
 	defer task.End()
 	h.GlobalCache.OnInvalidateRoom(ctx, p.RoomID)
@@ -866,7 +1178,7 @@ func (h *SyncLiveHandler) OnInvalidateRoom(p *pubsub.V2InvalidateRoom) {
 
 	// 4. Destroy involved users' connections.
 	// Since creating a conn creates a user cache, it is safe to loop over
-	destroyed := h.ConnMap.CloseConnsForUsers(unregistered)
+	destroyed := h.ConnMap.CloseConnsForUsers(unregistered, sync3.EvictionRoomInvalidated)
 	if h.destroyedConns != nil {
 		h.destroyedConns.Add(float64(destroyed))
 	}
@@ -876,6 +1188,32 @@ func (h *SyncLiveHandler) OnInvalidateRoom(p *pubsub.V2InvalidateRoom) {
 		Int("del_user_caches", len(unregistered)).Int("conns_destroyed", destroyed).Msg("OnInvalidateRoom")
 }
 
+// responseETag returns a strong ETag for a response body, which is a hash of its content.
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+}
+
+// parseTimeout returns the `timeout` query parameter in milliseconds, clamped to maxMSecs.
+// Returns sync3.DefaultTimeoutMSecs if there is no timeout parameter.
+func parseTimeout(u *url.URL, maxMSecs int) (int, *internal.HandlerError) {
+	timeout := int64(sync3.DefaultTimeoutMSecs)
+	if u.Query().Get("timeout") != "" {
+		var herr *internal.HandlerError
+		timeout, herr = parseIntFromQuery(u, "timeout")
+		if herr != nil {
+			return 0, herr
+		}
+		if timeout < 0 {
+			return 0, internal.InvalidParamError("timeout", "must not be negative: %d", timeout)
+		}
+	}
+	if timeout > int64(maxMSecs) {
+		timeout = int64(maxMSecs)
+	}
+	return int(timeout), nil
+}
+
 func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
 	queryPos := u.Query().Get(param)
 	if queryPos != "" {
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestParseTimeout(t *testing.T) {
+	const maxMSecs = 60 * 1000
+	testCases := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{query: "", want: sync3.DefaultTimeoutMSecs},
+		{query: "timeout=0", want: 0},
+		{query: "timeout=30000", want: 30000},
+		{query: "timeout=60000", want: maxMSecs},
+		{query: "timeout=3600000", want: maxMSecs},
+		{query: "timeout=-1", wantErr: true},
+		{query: "timeout=soon", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, herr := parseTimeout(&url.URL{RawQuery: tc.query}, maxMSecs)
+		if tc.wantErr {
+			if herr == nil || herr.StatusCode != 400 {
+				t.Errorf("%q: got %v want a 400 error", tc.query, herr)
+			}
+			continue
+		}
+		if herr != nil {
+			t.Errorf("%q: got error %v", tc.query, herr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got timeout %d want %d", tc.query, got, tc.want)
+		}
+	}
+	// the default timeout is also clamped
+	if got, _ := parseTimeout(&url.URL{}, 1000); got != 1000 {
+		t.Errorf("default timeout with a 1s max: got %d want 1000", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ps := pubsub.NewPubSub(10)
+	h, err := NewSync3Handler(nil, nil, nil, "secret", ps, ps, false, 100, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("NewSync3Handler: %s", err)
+	}
+	if h.IsDraining() {
+		t.Fatalf("handler is draining before Drain was called")
+	}
+	h.Drain()
+	h.Drain() // safe to call twice
+	if !h.IsDraining() {
+		t.Fatalf("handler is not draining after Drain was called")
+	}
+
+	// new requests are rejected without a delay, so clients can retry elsewhere
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/_matrix/client/unstable/org.matrix.msc3575/sync", strings.NewReader(`{}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q want 1", got)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("rejecting the request took %v", time.Since(start))
+	}
+}
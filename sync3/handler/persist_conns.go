@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// connExpiry is how long a connection can go without a request before it is expired, unless
+// changed with SetConnLimits.
+const connExpiry = 30 * time.Minute
+
+// SetConnLimits sets how long a connection can go without a request before it is expired, and
+// how many connections each device and user can have at once. When a client makes a connection
+// over a limit, its least recently used connection is closed. A ttl of 0 uses the default of 30
+// minutes and limits of 0 mean no limit. Must be called before SetPersistConns and serving requests.
+func (h *SyncLiveHandler) SetConnLimits(ttl time.Duration, maxPerDevice, maxPerUser int) {
+	if ttl <= 0 {
+		ttl = connExpiry
+	}
+	h.connTTL = ttl
+	h.ConnMap.SetTTL(ttl)
+	h.ConnMap.SetMaxConns(maxPerDevice, maxPerUser)
+}
+
+// SetPersistConns enables storing the sticky request of every connection, so that clients which
+// reconnect with a ?pos= after the proxy restarts carry on with their lists, room subscriptions
+// and extensions rather than being sent M_UNKNOWN_POS. The first response after a restart is
+// built as for a new connection. Must be called before serving requests.
+func (h *SyncLiveHandler) SetPersistConns(enabled bool) {
+	h.persistConns = enabled
+	if !enabled {
+		return
+	}
+	// requests older than this are for connections which would have expired anyway
+	deleted, err := h.Storage.ConnRequestsTable.DeleteOlderThan(time.Now().Add(-h.connTTL))
+	if err != nil {
+		logger.Err(err).Msg("failed to delete expired connection requests")
+		return
+	}
+	if deleted > 0 {
+		logger.Info().Int64("deleted", deleted).Msg("deleted expired connection requests")
+	}
+}
+
+// persistConnRequest stores the sticky request of this connection.
+func (h *SyncLiveHandler) persistConnRequest(connID sync3.ConnID, req json.RawMessage) {
+	err := h.Storage.ConnRequestsTable.Upsert(connID.UserID, connID.DeviceID, connID.CID, req, time.Now())
+	if err != nil {
+		logger.Err(err).Str("conn", connID.String()).Msg("failed to store connection request")
+	}
+}
+
+// rehydrateConnRequest looks for the stored request of a connection which existed before the proxy
+// started. If there is one, the client's request is applied on top of it so it can be processed
+// as the first request of a new connection. Returns false if the connection can't be rehydrated.
+func (h *SyncLiveHandler) rehydrateConnRequest(connID sync3.ConnID, req *sync3.Request) bool {
+	if !h.persistConns {
+		return false
+	}
+	stored, err := h.Storage.ConnRequestsTable.Select(connID.UserID, connID.DeviceID, connID.CID)
+	if err != nil {
+		logger.Err(err).Str("conn", connID.String()).Msg("failed to load connection request")
+		return false
+	}
+	// connections which went missing since we started were expired or closed on purpose
+	if stored == nil || !stored.UpdatedAt.Before(h.startedAt) || time.Since(stored.UpdatedAt) > h.connTTL {
+		return false
+	}
+	rehydrated, err := applyStoredRequest(stored.Request, req)
+	if err != nil {
+		logger.Warn().Err(err).Str("conn", connID.String()).Msg("failed to parse stored connection request")
+		return false
+	}
+	*req = *rehydrated
+	return true
+}
+
+// applyStoredRequest applies the request on top of a stored sticky request.
+func applyStoredRequest(stored json.RawMessage, req *sync3.Request) (*sync3.Request, error) {
+	var storedReq sync3.Request
+	if err := json.Unmarshal(stored, &storedReq); err != nil {
+		return nil, err
+	}
+	result, _ := storedReq.ApplyDelta(req)
+	// these are not sticky, so only come from this request
+	result.TxnID = req.TxnID
+	result.Strict = req.Strict
+	result.RoomHashes = req.RoomHashes
+	result.TransactionIDs = req.TransactionIDs
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestConnStatePersistsChangedRequests(t *testing.T) {
+	var persisted []json.RawMessage
+	cs := &ConnState{
+		persistRequest: func(req json.RawMessage) {
+			persisted = append(persisted, req)
+		},
+	}
+	apply := func(req *sync3.Request) {
+		cs.muxedReq, _ = cs.muxedReq.ApplyDelta(req)
+		cs.maybePersistRequest()
+	}
+	apply(&sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 10}}},
+		},
+	})
+	if len(persisted) != 1 {
+		t.Fatalf("got %d persisted requests want 1", len(persisted))
+	}
+	// sticky, so nothing has changed
+	apply(&sync3.Request{})
+	if len(persisted) != 1 {
+		t.Fatalf("got %d persisted requests want 1 as the request didn't change", len(persisted))
+	}
+	apply(&sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			"!a:localhost": {TimelineLimit: 5},
+		},
+	})
+	if len(persisted) != 2 {
+		t.Fatalf("got %d persisted requests want 2", len(persisted))
+	}
+	var got sync3.Request
+	if err := json.Unmarshal(persisted[1], &got); err != nil {
+		t.Fatalf("failed to unmarshal persisted request: %s", err)
+	}
+	if len(got.Lists) != 1 || len(got.RoomSubscriptions) != 1 {
+		t.Errorf("persisted request: got %s", persisted[1])
+	}
+}
+
+func TestApplyStoredRequest(t *testing.T) {
+	stored, err := json.Marshal(sync3.Request{
+		ConnID: "conn",
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges:         sync3.SliceRanges{{0, 10}},
+				Sort:           []string{sync3.SortByRecency},
+				BumpEventTypes: []string{},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 5,
+				},
+			},
+		},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			"!a:localhost": {TimelineLimit: 1},
+			"!b:localhost": {TimelineLimit: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %s", err)
+	}
+	got, err := applyStoredRequest(stored, &sync3.Request{
+		TxnID:  "txn",
+		ConnID: "conn",
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 20}}},
+		},
+		UnsubscribeRooms: []string{"!b:localhost"},
+	})
+	if err != nil {
+		t.Fatalf("applyStoredRequest: %s", err)
+	}
+	if got.TxnID != "txn" || got.ConnID != "conn" {
+		t.Errorf("got txn_id=%q conn_id=%q", got.TxnID, got.ConnID)
+	}
+	list := got.Lists["a"]
+	if !reflect.DeepEqual(list.Ranges, sync3.SliceRanges{{0, 20}}) || list.TimelineLimit != 5 {
+		t.Errorf("list a: got ranges %v timeline_limit %d", list.Ranges, list.TimelineLimit)
+	}
+	// every event still bumps rooms, rather than the server's default applying
+	if list.BumpEventTypes == nil || len(list.BumpEventTypes) != 0 {
+		t.Errorf("list a: got bump_event_types %v want []", list.BumpEventTypes)
+	}
+	if _, ok := got.RoomSubscriptions["!a:localhost"]; !ok || len(got.RoomSubscriptions) != 1 {
+		t.Errorf("got room subscriptions %v want only !a:localhost", got.RoomSubscriptions)
+	}
+
+	if _, err = applyStoredRequest(json.RawMessage(`not json`), &sync3.Request{}); err == nil {
+		t.Errorf("applyStoredRequest: want an error for an invalid stored request")
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// DefaultRequestBurst is the number of requests each device can make at once when rate limiting is
+// enabled without a burst.
+const DefaultRequestBurst = 10
+
+// requestLimiter limits how often each device can make sync requests, so that a misbehaving client
+// e.g one tightlooping on M_UNKNOWN_POS can't overload the proxy.
+type requestLimiter struct {
+	perSecond float64
+	burst     int
+	// idleExpiry is how long until an unused device's bucket is full again, after which it is
+	// the same as a new bucket and can be removed.
+	idleExpiry time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	devices   map[sync2.PollerID]*deviceLimiter
+	lastSweep time.Time
+}
+
+type deviceLimiter struct {
+	*internal.RateLimiter
+	lastUsed time.Time
+}
+
+func newRequestLimiter(perSecond float64, burst int) *requestLimiter {
+	if burst <= 0 {
+		burst = DefaultRequestBurst
+	}
+	return &requestLimiter{
+		perSecond:  perSecond,
+		burst:      burst,
+		idleExpiry: time.Duration(float64(burst) / perSecond * float64(time.Second)),
+		now:        time.Now,
+		devices:    make(map[sync2.PollerID]*deviceLimiter),
+	}
+}
+
+// allow returns nil and uses up one of the device's requests if it has any left, else returns a
+// 429 error saying when it can retry.
+func (l *requestLimiter) allow(userID, deviceID string) *internal.HandlerError {
+	l.mu.Lock()
+	now := l.now()
+	l.maybeSweep(now)
+	pid := sync2.PollerID{UserID: userID, DeviceID: deviceID}
+	dl := l.devices[pid]
+	if dl == nil {
+		dl = &deviceLimiter{RateLimiter: internal.NewRateLimiter(l.perSecond, l.burst)}
+		l.devices[pid] = dl
+	}
+	dl.lastUsed = now
+	l.mu.Unlock()
+
+	ok, retryAfter := dl.Reserve()
+	if ok {
+		return nil
+	}
+	return &internal.HandlerError{
+		StatusCode: http.StatusTooManyRequests,
+		ErrCode:    "M_LIMIT_EXCEEDED",
+		Err:        fmt.Errorf("too many requests from this device"),
+		RetryAfter: retryAfter,
+	}
+}
+
+// maybeSweep removes the buckets of devices which haven't made a request for long enough that
+// their bucket is full, at most once per idleExpiry. Must hold mu.
+func (l *requestLimiter) maybeSweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleExpiry {
+		return
+	}
+	l.lastSweep = now
+	for pid, dl := range l.devices {
+		if now.Sub(dl.lastUsed) >= l.idleExpiry {
+			delete(l.devices, pid)
+		}
+	}
+}
+
+// retryAfterHeader returns the value of the Retry-After header for this wait, in whole seconds.
+func retryAfterHeader(retryAfter time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+}
+
+// SetRequestRateLimit limits each device to perSecond sync requests a second, allowing bursts of up
+// to burst requests. If burst is 0, uses DefaultRequestBurst. Disabled if perSecond is 0. Must be
+// called before serving requests.
+func (h *SyncLiveHandler) SetRequestRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		h.requestLimiter = nil
+		return
+	}
+	h.requestLimiter = newRequestLimiter(perSecond, burst)
+}
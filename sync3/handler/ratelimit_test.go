@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(0.1, 2)
+	for i := 0; i < 2; i++ {
+		if herr := l.allow("@alice:localhost", "A"); herr != nil {
+			t.Fatalf("request %d: rate limited within the burst: %s", i, herr)
+		}
+	}
+	herr := l.allow("@alice:localhost", "A")
+	if herr == nil {
+		t.Fatalf("allowed a request over the burst")
+	}
+	if herr.StatusCode != http.StatusTooManyRequests || herr.ErrCode != "M_LIMIT_EXCEEDED" {
+		t.Errorf("got HTTP %d %s, want HTTP 429 M_LIMIT_EXCEEDED", herr.StatusCode, herr.ErrCode)
+	}
+	if herr.RetryAfter <= 9*time.Second || herr.RetryAfter > 10*time.Second {
+		t.Errorf("got retry after %v, want just under 10s", herr.RetryAfter)
+	}
+	var body struct {
+		RetryAfterMS int64 `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal(herr.JSON(), &body); err != nil {
+		t.Fatalf("failed to unmarshal error: %s", err)
+	}
+	if body.RetryAfterMS != herr.RetryAfter.Milliseconds() {
+		t.Errorf("got retry_after_ms %d, want %d", body.RetryAfterMS, herr.RetryAfter.Milliseconds())
+	}
+	if got := retryAfterHeader(herr.RetryAfter); got != "10" {
+		t.Errorf("got Retry-After %s, want 10", got)
+	}
+
+	// other devices have their own buckets
+	if herr := l.allow("@alice:localhost", "B"); herr != nil {
+		t.Errorf("rate limited another device: %s", herr)
+	}
+	if herr := l.allow("@bob:localhost", "A"); herr != nil {
+		t.Errorf("rate limited another user: %s", herr)
+	}
+}
+
+func TestRequestLimiterSweepsIdleDevices(t *testing.T) {
+	now := time.Now()
+	l := newRequestLimiter(1, 5)
+	l.now = func() time.Time { return now }
+	l.allow("@alice:localhost", "A")
+	now = now.Add(4 * time.Second)
+	l.allow("@bob:localhost", "B")
+	if len(l.devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(l.devices))
+	}
+	// alice's bucket has been full for long enough to be forgotten, but bob's hasn't
+	now = now.Add(2 * time.Second)
+	l.allow("@charlie:localhost", "C")
+	if _, ok := l.devices[sync2.PollerID{UserID: "@alice:localhost", DeviceID: "A"}]; ok {
+		t.Errorf("idle device was not swept")
+	}
+	if _, ok := l.devices[sync2.PollerID{UserID: "@bob:localhost", DeviceID: "B"}]; !ok {
+		t.Errorf("recently used device was swept")
+	}
+}
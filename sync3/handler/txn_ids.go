@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// registerTransactionIDs stores the transaction IDs which the client sent events with, so those
+// events include unsigned.transaction_id for this device even if its poller never sees them with
+// one, e.g when they arrive down another user's poller first. Events which are being held back
+// waiting for a transaction ID are released to the user's connections.
+func (h *SyncLiveHandler) registerTransactionIDs(ctx context.Context, userID, deviceID string, eventIDToTxnID map[string]string) {
+	if len(eventIDToTxnID) == 0 {
+		return
+	}
+	ctx, span := internal.StartSpan(ctx, "registerTransactionIDs")
+	defer span.End()
+	if err := h.Storage.TransactionsTable.Insert(userID, deviceID, eventIDToTxnID); err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Int("num_txns", len(eventIDToTxnID)).Msg("failed to register txn IDs")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	eventIDs := make([]string, 0, len(eventIDToTxnID))
+	for eventID := range eventIDToTxnID {
+		eventIDs = append(eventIDs, eventID)
+	}
+	// events the proxy hasn't seen yet will be annotated when they arrive
+	events, err := h.Storage.EventsTable.SelectStrippedEventsByIDs(nil, false, eventIDs)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to select events for registered txn IDs")
+		return
+	}
+	for _, ev := range events {
+		h.ConnMap.ClearUpdateQueues(userID, ev.RoomID, ev.NID)
+	}
+}
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
+)
+
+// wsClientMessage is sent by the client over a WebSocket. Every message acknowledges the responses
+// the client has processed, and may change the request.
+type wsClientMessage struct {
+	// Pos is the position of the latest response the client has processed, or empty if it has
+	// processed none. The server waits for each response to be acknowledged before sending another,
+	// so it can be resent if the client reconnects.
+	Pos string `json:"pos,omitempty"`
+	// Request is a sliding sync request body, with the usual sticky semantics. If empty, the
+	// message only acknowledges a response.
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// wsPollFunc long polls for the next response as if the client had sent the request body with
+// ?pos= over HTTP.
+type wsPollFunc func(ctx context.Context, pos string, body []byte) (json.RawMessage, *internal.HandlerError)
+
+type wsPollResult struct {
+	res  json.RawMessage
+	herr *internal.HandlerError
+}
+
+// SetWebSockets enables serving sync requests over a WebSocket at sync3.WebSocketSyncPath. Must be
+// called before serving requests.
+func (h *SyncLiveHandler) SetWebSockets(enabled bool) {
+	h.webSockets = enabled
+}
+
+// SetWebSocketOrigins sets the origins browsers may open WebSockets from, as scheme://host[:port],
+// or "*" for any origin. Browsers send the page's Origin on every WebSocket, so this stops other
+// sites from opening a WebSocket with a token they've obtained. Clients which don't send an Origin
+// are always allowed. Must be called before serving requests.
+func (h *SyncLiveHandler) SetWebSocketOrigins(origins []string) {
+	h.webSocketOrigins = origins
+}
+
+// ParseWebSocketOrigins parses a comma-separated list of origins for SetWebSocketOrigins.
+func ParseWebSocketOrigins(spec string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(spec, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+				return nil, fmt.Errorf("%q is not an origin like https://example.com", origin)
+			}
+			origin = u.Scheme + "://" + u.Host
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// webSocketOriginAllowed returns true if a WebSocket may be opened from the Origin of req.
+func (h *SyncLiveHandler) webSocketOriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.webSocketOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebSocket upgrades the request to a WebSocket and pushes responses to the client as they
+// are ready. Each response is produced by the same connection state machine as HTTP requests, so
+// clients can reconnect, or fall back to HTTP, by sending the position they last processed.
+func (h *SyncLiveHandler) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	if !h.webSockets {
+		herr := &internal.HandlerError{
+			StatusCode: http.StatusNotFound,
+			ErrCode:    "M_UNRECOGNIZED",
+			Err:        fmt.Errorf("WebSockets are not enabled"),
+		}
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		herr := &internal.HandlerError{
+			StatusCode: http.StatusBadRequest,
+			ErrCode:    "M_UNRECOGNIZED",
+			Err:        fmt.Errorf("not a WebSocket upgrade request"),
+		}
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	if !h.webSocketOriginAllowed(req) {
+		herr := &internal.HandlerError{
+			StatusCode: http.StatusForbidden,
+			ErrCode:    "M_FORBIDDEN",
+			Err:        fmt.Errorf("WebSockets are not allowed from origin %s", req.Header.Get("Origin")),
+		}
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	// browsers cannot set headers on WebSockets, so also allow the token as a query parameter. It
+	// is only read from the upgrade request, and never from messages sent over the socket.
+	accessToken, _ := internal.ExtractAccessToken(req)
+	if accessToken == "" {
+		accessToken = req.URL.Query().Get("access_token")
+	}
+	if accessToken == "" {
+		herr := &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			ErrCode:    "M_MISSING_TOKEN",
+			Err:        fmt.Errorf("missing access token"),
+		}
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	poll := func(ctx context.Context, pos string, body []byte) (json.RawMessage, *internal.HandlerError) {
+		return h.pollForWebSocket(ctx, req, accessToken, pos, body)
+	}
+	// Handshake is set as the Origin has already been checked against webSocketOrigins, which the
+	// default handshake doesn't know about, and it rejects clients which don't send an Origin.
+	websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			go func() {
+				// close the socket if we start draining, so the client reconnects elsewhere
+				select {
+				case <-h.draining:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			runWebSocketSession(ctx, ws, poll)
+		},
+	}.ServeHTTP(w, req)
+}
+
+// pollForWebSocket serves a request body as if it had been sent over HTTP, returning the response body.
+func (h *SyncLiveHandler) pollForWebSocket(ctx context.Context, wsReq *http.Request, accessToken, pos string, body []byte) (json.RawMessage, *internal.HandlerError) {
+	query := url.Values{}
+	if pos != "" {
+		query.Set("pos", pos)
+	}
+	query.Set("timeout", strconv.Itoa(h.maxTimeoutMSecs))
+	req, err := http.NewRequestWithContext(ctx, "POST", wsReq.URL.Path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	req.RemoteAddr = wsReq.RemoteAddr
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w := &bufferedResponseWriter{header: make(http.Header)}
+	if err = h.serve(w, req); err != nil {
+		herr, ok := err.(*internal.HandlerError)
+		if !ok {
+			herr = &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		return nil, herr
+	}
+	return bytes.TrimSpace(w.body.Bytes()), nil
+}
+
+// runWebSocketSession reads client messages and sends the response to each poll, until the socket
+// or ctx is closed. Only one poll runs at a time, once the client has acknowledged the previous
+// response. A new request cancels the poll in progress, whose response is still sent as the
+// connection state has moved on, and is polled for once that response is acknowledged.
+func runWebSocketSession(ctx context.Context, ws *websocket.Conn, poll wsPollFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs := make(chan wsClientMessage)
+	go func() {
+		defer cancel()
+		for {
+			var msg wsClientMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var acked, sent string
+	// body is the next request body to send, or nil if the client hasn't changed its request
+	var body []byte
+	// emptyBody keeps the client's conn_id when its request hasn't changed
+	emptyBody := []byte(`{}`)
+	onMessage := func(msg wsClientMessage) {
+		if msg.Pos != "" {
+			acked = msg.Pos
+		}
+		if len(msg.Request) > 0 {
+			body = msg.Request
+			if connID := gjson.GetBytes(body, "conn_id").Str; connID != "" {
+				emptyBody, _ = json.Marshal(map[string]string{"conn_id": connID})
+			} else {
+				emptyBody = []byte(`{}`)
+			}
+		}
+	}
+	// the first message starts the session, and may resume a connection from an earlier session
+	select {
+	case msg := <-msgs:
+		onMessage(msg)
+		sent = acked
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		// wait for the client to process the last response
+		for acked != sent {
+			select {
+			case msg := <-msgs:
+				onMessage(msg)
+			case <-ctx.Done():
+				return
+			}
+		}
+		reqBody := body
+		if reqBody == nil {
+			reqBody = emptyBody
+		}
+		body = nil
+		pollCtx, cancelPoll := context.WithCancel(ctx)
+		done := make(chan wsPollResult, 1)
+		go func(pos string) {
+			res, herr := poll(pollCtx, pos, reqBody)
+			done <- wsPollResult{res: res, herr: herr}
+		}(acked)
+		var result wsPollResult
+	waitForPoll:
+		for {
+			select {
+			case result = <-done:
+				break waitForPoll
+			case msg := <-msgs:
+				onMessage(msg)
+				if body != nil {
+					cancelPoll()
+				}
+			case <-ctx.Done():
+				cancelPoll()
+				return
+			}
+		}
+		cancelPoll()
+		if result.herr != nil {
+			if body != nil {
+				// we cancelled this poll for the client's new request, which is sent next
+				continue
+			}
+			logger.Warn().Err(result.herr).Msg("closing WebSocket after failed sync request")
+			websocket.Message.Send(ws, string(result.herr.JSON()))
+			return
+		}
+		if err := websocket.Message.Send(ws, string(result.res)); err != nil {
+			return
+		}
+		sent = gjson.GetBytes(result.res, "pos").Str
+	}
+}
+
+// bufferedResponseWriter is a http.ResponseWriter which keeps the response body.
+type bufferedResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"golang.org/x/net/websocket"
+)
+
+type wsPoll struct {
+	pos  string
+	body string
+	// cancelled is closed if the poll's context is cancelled
+	cancelled chan struct{}
+}
+
+// fakeWebSocketPoller records each poll, and responds with the next position when told to.
+type fakeWebSocketPoller struct {
+	polls     chan wsPoll
+	responses chan *internal.HandlerError
+	nextPos   int
+}
+
+func newFakeWebSocketPoller() *fakeWebSocketPoller {
+	return &fakeWebSocketPoller{
+		polls:     make(chan wsPoll, 10),
+		responses: make(chan *internal.HandlerError, 10),
+	}
+}
+
+func (p *fakeWebSocketPoller) poll(ctx context.Context, pos string, body []byte) (json.RawMessage, *internal.HandlerError) {
+	cancelled := make(chan struct{})
+	p.polls <- wsPoll{pos: pos, body: string(body), cancelled: cancelled}
+	select {
+	case herr := <-p.responses:
+		if herr != nil {
+			return nil, herr
+		}
+	case <-ctx.Done():
+		close(cancelled)
+	}
+	p.nextPos++
+	return json.RawMessage(fmt.Sprintf(`{"pos":"%d"}`, p.nextPos)), nil
+}
+
+func dialWebSocketSession(t *testing.T, poll wsPollFunc) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		runWebSocketSession(context.Background(), ws, poll)
+	}))
+	t.Cleanup(srv.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func mustSendWebSocket(t *testing.T, ws *websocket.Conn, msg string) {
+	t.Helper()
+	if err := websocket.Message.Send(ws, msg); err != nil {
+		t.Fatalf("failed to send %s: %s", msg, err)
+	}
+}
+
+func mustReceiveWebSocket(t *testing.T, ws *websocket.Conn, want string) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var got string
+	if err := websocket.Message.Receive(ws, &got); err != nil {
+		t.Fatalf("failed to receive %s: %s", want, err)
+	}
+	if got != want {
+		t.Fatalf("received %s, want %s", got, want)
+	}
+}
+
+func mustPoll(t *testing.T, p *fakeWebSocketPoller, wantPos, wantBody string) wsPoll {
+	t.Helper()
+	select {
+	case poll := <-p.polls:
+		if poll.pos != wantPos || poll.body != wantBody {
+			t.Fatalf("polled pos=%q body=%s, want pos=%q body=%s", poll.pos, poll.body, wantPos, wantBody)
+		}
+		return poll
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for poll pos=%q", wantPos)
+	}
+	return wsPoll{}
+}
+
+func mustNotPoll(t *testing.T, p *fakeWebSocketPoller) {
+	t.Helper()
+	select {
+	case poll := <-p.polls:
+		t.Fatalf("unexpected poll pos=%q body=%s", poll.pos, poll.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebSocketSessionWaitsForAcks(t *testing.T) {
+	p := newFakeWebSocketPoller()
+	ws := dialWebSocketSession(t, p.poll)
+
+	mustSendWebSocket(t, ws, `{"request":{"conn_id":"a","lists":{}}}`)
+	mustPoll(t, p, "", `{"conn_id":"a","lists":{}}`)
+	p.responses <- nil
+	mustReceiveWebSocket(t, ws, `{"pos":"1"}`)
+
+	// the next response isn't sent until the client has processed this one
+	mustNotPoll(t, p)
+	mustSendWebSocket(t, ws, `{"pos":"1"}`)
+	// the request is sticky, so only the conn_id is sent
+	mustPoll(t, p, "1", `{"conn_id":"a"}`)
+	p.responses <- nil
+	mustReceiveWebSocket(t, ws, `{"pos":"2"}`)
+}
+
+func TestWebSocketSessionNewRequestCancelsPoll(t *testing.T) {
+	p := newFakeWebSocketPoller()
+	ws := dialWebSocketSession(t, p.poll)
+
+	mustSendWebSocket(t, ws, `{"request":{"lists":{}}}`)
+	mustPoll(t, p, "", `{"lists":{}}`)
+	p.responses <- nil
+	mustReceiveWebSocket(t, ws, `{"pos":"1"}`)
+	mustSendWebSocket(t, ws, `{"pos":"1"}`)
+	waiting := mustPoll(t, p, "1", `{}`)
+
+	// changing the request ends the long poll, but its response is still sent
+	mustSendWebSocket(t, ws, `{"pos":"1","request":{"room_subscriptions":{}}}`)
+	select {
+	case <-waiting.cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("poll was not cancelled by the new request")
+	}
+	mustReceiveWebSocket(t, ws, `{"pos":"2"}`)
+	mustNotPoll(t, p)
+	mustSendWebSocket(t, ws, `{"pos":"2"}`)
+	mustPoll(t, p, "2", `{"room_subscriptions":{}}`)
+}
+
+func TestWebSocketSessionResumes(t *testing.T) {
+	p := newFakeWebSocketPoller()
+	p.nextPos = 5
+	ws := dialWebSocketSession(t, p.poll)
+
+	// a reconnecting client carries on from the last response it processed
+	mustSendWebSocket(t, ws, `{"pos":"5"}`)
+	mustPoll(t, p, "5", `{}`)
+	p.responses <- nil
+	mustReceiveWebSocket(t, ws, `{"pos":"6"}`)
+}
+
+func TestWebSocketSessionClosesOnError(t *testing.T) {
+	p := newFakeWebSocketPoller()
+	ws := dialWebSocketSession(t, p.poll)
+
+	mustSendWebSocket(t, ws, `{"pos":"9"}`)
+	mustPoll(t, p, "9", `{}`)
+	herr := internal.ExpiredSessionError()
+	p.responses <- herr
+	mustReceiveWebSocket(t, ws, string(herr.JSON()))
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.Message.Receive(ws, &msg); err == nil {
+		t.Fatalf("received %s after an error, want the socket to be closed", msg)
+	}
+}
+
+func TestServeWebSocketRejectsRequests(t *testing.T) {
+	testCases := []struct {
+		name       string
+		enabled    bool
+		origins    []string
+		header     http.Header
+		query      string
+		wantStatus int
+	}{
+		{name: "disabled", enabled: false, header: http.Header{"Upgrade": {"websocket"}}, wantStatus: http.StatusNotFound},
+		{name: "not an upgrade", enabled: true, query: "?access_token=foo", wantStatus: http.StatusBadRequest},
+		{name: "no access token", enabled: true, header: http.Header{"Upgrade": {"websocket"}}, wantStatus: http.StatusUnauthorized},
+		{
+			name:    "no allowed origins",
+			enabled: true,
+			header: http.Header{
+				"Upgrade":       {"websocket"},
+				"Origin":        {"https://evil.example"},
+				"Authorization": {"Bearer foo"},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:    "origin not allowed",
+			enabled: true,
+			origins: []string{"https://app.example"},
+			header: http.Header{
+				"Upgrade": {"websocket"},
+				"Origin":  {"https://evil.example"},
+			},
+			query:      "?access_token=foo",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		h := &SyncLiveHandler{}
+		h.SetWebSockets(tc.enabled)
+		h.SetWebSocketOrigins(tc.origins)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", sync3.WebSocketSyncPath+tc.query, nil)
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		h.ServeHTTP(w, req)
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d want %d", tc.name, w.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestWebSocketOriginAllowed(t *testing.T) {
+	testCases := []struct {
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{origins: nil, origin: "", want: true},
+		{origins: nil, origin: "https://app.example", want: false},
+		{origins: []string{"https://app.example"}, origin: "https://app.example", want: true},
+		{origins: []string{"https://app.example"}, origin: "HTTPS://APP.EXAMPLE", want: true},
+		{origins: []string{"https://app.example"}, origin: "http://app.example", want: false},
+		{origins: []string{"https://app.example"}, origin: "https://app.example:8443", want: false},
+		{origins: []string{"*"}, origin: "https://anything.example", want: true},
+	}
+	for _, tc := range testCases {
+		h := &SyncLiveHandler{}
+		h.SetWebSocketOrigins(tc.origins)
+		req := httptest.NewRequest("GET", sync3.WebSocketSyncPath, nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if got := h.webSocketOriginAllowed(req); got != tc.want {
+			t.Errorf("origins %v: origin %q got allowed=%v want %v", tc.origins, tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestParseWebSocketOrigins(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "*", want: []string{"*"}},
+		{spec: "https://app.example, http://localhost:8080/", want: []string{"https://app.example", "http://localhost:8080"}},
+		{spec: "app.example", wantErr: true},
+		{spec: "https://app.example/path", wantErr: true},
+		{spec: "ftp://app.example", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseWebSocketOrigins(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got err %v, want err: %v", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%q: got %v want %v", tc.spec, got, tc.want)
+		}
+	}
+}
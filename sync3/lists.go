@@ -34,6 +34,7 @@ type RoomListDelta struct {
 type RoomDelta struct {
 	RoomNameChanged          bool
 	RoomAvatarChanged        bool
+	RoomInfoChanged          bool
 	JoinCountChanged         bool
 	InviteCountChanged       bool
 	NotificationCountChanged bool
@@ -72,6 +73,7 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
+		delta.RoomInfoChanged = !existing.SameRoomInfo(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
 			roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
@@ -230,6 +232,20 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 
 // Assign a new list at the given key. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
 // list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
+// SetInterestedEventTimestamps sets the LastInterestedEventTimestamps of a list which has just been
+// added, for rooms which are not yet in it, based on the list's bump event types.
+func (s *InternalRequestLists) SetInterestedEventTimestamps(listKey string, bumpEventTypes []string) {
+	for _, r := range s.allRooms {
+		if _, ok := r.LastInterestedEventTimestamps[listKey]; ok {
+			continue
+		}
+		if r.LastInterestedEventTimestamps == nil {
+			r.LastInterestedEventTimestamps = make(map[string]uint64)
+		}
+		r.LastInterestedEventTimestamps[listKey] = r.InterestedEventTimestamp(bumpEventTypes)
+	}
+}
+
 func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
 	if shouldOverwrite == DoNotOverwrite {
 		_, exists := s.lists[listKey]
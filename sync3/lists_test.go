@@ -49,3 +49,57 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		})
 	}
 }
+
+func TestSetRoomInfoChanged(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	room := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:            "!info:localhost",
+			JoinRule:          "invite",
+			HistoryVisibility: "shared",
+		},
+	}
+	list.SetRoom(room)
+	if delta := list.SetRoom(room); delta.RoomInfoChanged {
+		t.Errorf("SetRoom with the same join rule: got RoomInfoChanged")
+	}
+	room.JoinRule = "public"
+	if delta := list.SetRoom(room); !delta.RoomInfoChanged {
+		t.Errorf("SetRoom with a new join rule: did not get RoomInfoChanged")
+	}
+	room.HistoryVisibility = "world_readable"
+	if delta := list.SetRoom(room); !delta.RoomInfoChanged {
+		t.Errorf("SetRoom with a new history visibility: did not get RoomInfoChanged")
+	}
+}
+
+func TestSetInterestedEventTimestamps(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	newRoom := func(roomID string, lastMessageTS, messageTS uint64) sync3.RoomConnMetadata {
+		metadata := internal.NewRoomMetadata(roomID)
+		metadata.LastMessageTimestamp = lastMessageTS
+		metadata.LatestEventsByType["m.room.message"] = internal.EventMetadata{NID: 10, Timestamp: messageTS}
+		metadata.LatestEventsByType["m.reaction"] = internal.EventMetadata{NID: 11, Timestamp: lastMessageTS}
+		return sync3.RoomConnMetadata{
+			RoomMetadata: *metadata,
+			UserRoomData: caches.UserRoomData{
+				JoinTiming: internal.EventMetadata{NID: 1, Timestamp: 100},
+			},
+			LastInterestedEventTimestamps: map[string]uint64{},
+		}
+	}
+	// !a has the latest reaction but !b has the latest message
+	list.SetRoom(newRoom("!a", 5000, 1000))
+	list.SetRoom(newRoom("!b", 4000, 2000))
+
+	list.SetInterestedEventTimestamps("messages", []string{"m.room.message"})
+	list.SetInterestedEventTimestamps("all", nil)
+	messages, _ := list.AssignList(context.Background(), "messages", nil, []string{sync3.SortByRecency}, sync3.Overwrite)
+	all, _ := list.AssignList(context.Background(), "all", nil, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if got := messages.RoomIDs(); got[0] != "!b" || got[1] != "!a" {
+		t.Errorf("messages list got %v want [!b !a]", got)
+	}
+	if got := all.RoomIDs(); got[0] != "!a" || got[1] != "!b" {
+		t.Errorf("all list got %v want [!a !b]", got)
+	}
+}
@@ -9,6 +9,8 @@ type List interface {
 	IndexOf(roomID string) (int, bool)
 	Len() int64
 	Sort(sortBy []string) error
+	// SortRoom moves a room to its sorted position, assuming the rest of the list is sorted.
+	SortRoom(roomID string, sortBy []string) error
 	Add(roomID string) bool
 	Remove(roomID string) int
 	Get(index int) string
@@ -48,7 +50,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		wasInsideRange = false // can't be inside the range if this is a new room
 		list.Add(roomID)
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.SortRoom(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -66,7 +68,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		}
 	case ListOpChange:
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.SortRoom(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -140,3 +142,42 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 	}
 	return
 }
+
+// CompactListOps merges the ops of a list which were calculated for several updates in the same
+// response. When a room is moved by a DELETE/INSERT pair and the next pair DELETEs it again from
+// where it was just INSERTed, the two moves are equivalent to one move from the first DELETE
+// index to the second INSERT index. This means a busy room which moves several times in the
+// same response only costs one pair of ops, rather than a pair for every update.
+func CompactListOps(ops []ResponseOp) []ResponseOp {
+	if len(ops) < 4 {
+		return ops
+	}
+	compacted := make([]ResponseOp, 0, len(ops))
+	for i := 0; i < len(ops); i++ {
+		n := len(compacted)
+		if n >= 2 && i+1 < len(ops) {
+			prevDel := singleOp(compacted[n-2], OpDelete)
+			prevIns := singleOp(compacted[n-1], OpInsert)
+			del := singleOp(ops[i], OpDelete)
+			ins := singleOp(ops[i+1], OpInsert)
+			if prevDel != nil && prevIns != nil && del != nil && ins != nil && *prevIns.Index == *del.Index {
+				// the room inserted by the previous pair is removed again, so insert this pair's
+				// room in its place
+				compacted[n-1] = ins
+				i++
+				continue
+			}
+		}
+		compacted = append(compacted, ops[i])
+	}
+	return compacted
+}
+
+// singleOp returns the op if it is a single op of this kind with an index, else nil.
+func singleOp(op ResponseOp, kind string) *ResponseOpSingle {
+	single, ok := op.(*ResponseOpSingle)
+	if !ok || single.Operation != kind || single.Index == nil {
+		return nil
+	}
+	return single
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/sliding-sync/testutils"
@@ -746,6 +747,129 @@ func TestCalculateListOpsTortureMultipleWindowsMove(t *testing.T) {
 	}
 }
 
+func TestCompactListOps(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ops     []ResponseOp
+		wantOps []ResponseOp
+	}{
+		{
+			name: "single move is unchanged",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "d"},
+			},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "d"},
+			},
+		},
+		{
+			name: "room bumped several times",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(300)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(0)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(0)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+			},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(300)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+			},
+		},
+		{
+			name: "different rooms are not merged",
+			ops: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(5)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(7)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "b"},
+			},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(5)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "a"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(7)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "b"},
+			},
+		},
+		{
+			name: "range ops are left alone",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 2}, RoomIDs: []string{"a", "b", "c"}},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "c"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(0)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(1), RoomID: "c"},
+			},
+			wantOps: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 2}, RoomIDs: []string{"a", "b", "c"}},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(1), RoomID: "c"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		assertEqualOps(t, tc.name, CompactListOps(tc.ops), tc.wantOps)
+	}
+}
+
+// Test that compacted ops leave the client with the same window as the ops they replace.
+func TestCompactListOpsTorture(t *testing.T) {
+	rand.Seed(42)
+	ranges := SliceRanges{{0, 9}}
+	for i := 0; i < 1000; i++ {
+		list := make([]string, 20)
+		for j := range list {
+			list[j] = string(rune('a' + j))
+		}
+		window := append([]string{}, list[:10]...)
+		sl := newStringList(list)
+		var ops []ResponseOp
+		for j := 0; j < 5; j++ {
+			after, roomID, _, _ := testutils.MoveRandomElement(sl.roomIDs)
+			sl.sortedRoomIDs = after
+			moveOps, _ := CalculateListOps(context.Background(), &RequestList{Ranges: ranges}, sl, roomID, ListOpChange)
+			ops = append(ops, moveOps...)
+		}
+		want := applySingleOps(t, window, ops)
+		got := applySingleOps(t, window, CompactListOps(ops))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("compacted ops %v gave window %v, want %v from ops %v", jsonOps(t, CompactListOps(ops)), got, want, jsonOps(t, ops))
+		}
+		if !reflect.DeepEqual(want, sl.roomIDs[:10]) {
+			t.Fatalf("ops gave window %v, want %v", want, sl.roomIDs[:10])
+		}
+	}
+}
+
+// applySingleOps applies DELETE and INSERT ops to a copy of a client's window.
+func applySingleOps(t *testing.T, window []string, ops []ResponseOp) []string {
+	t.Helper()
+	result := append([]string{}, window...)
+	for _, op := range ops {
+		single := op.(*ResponseOpSingle)
+		i := *single.Index
+		switch single.Operation {
+		case OpDelete:
+			result = append(result[:i], result[i+1:]...)
+		case OpInsert:
+			result = append(result[:i], append([]string{single.RoomID}, result[i:]...)...)
+		}
+	}
+	return result
+}
+
+func jsonOps(t *testing.T, ops []ResponseOp) string {
+	t.Helper()
+	b, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatalf("failed to marshal ops: %s", err)
+	}
+	return string(b)
+}
+
 func assertSingleOp(t *testing.T, op ResponseOp, opName string, index int, optRoomID string) {
 	t.Helper()
 	singleOp, ok := op.(*ResponseOpSingle)
@@ -808,6 +932,9 @@ func (s *stringList) Sort(sortBy []string) error {
 	}
 	return nil
 }
+func (s *stringList) SortRoom(roomID string, sortBy []string) error {
+	return s.Sort(sortBy)
+}
 func (s *stringList) Add(roomID string) bool {
 	_, ok := s.roomIDToIndex[roomID]
 	if ok {
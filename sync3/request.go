@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -16,7 +17,10 @@ var (
 	SortByNotificationLevel = "by_notification_level"
 	SortByNotificationCount = "by_notification_count" // deprecated
 	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByPinned            = "by_pinned"
+	SortByTagOrder          = "by_tag_order"
+	SortByActivityBeforeTS  = "by_activity_before_ts"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel, SortByPinned, SortByTagOrder, SortByActivityBeforeTS}
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
@@ -24,8 +28,22 @@ var (
 
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+	// DefaultMaxTimeoutMSecs is the longest a client can ask to wait for new data, unless the
+	// server is configured otherwise.
+	DefaultMaxTimeoutMSecs = 5 * 60 * 1000 // 5m
 )
 
+// SimplifiedSyncPath serves simplified sliding sync (MSC4186), where clients sort rooms themselves
+// by bump_stamp rather than following list operations.
+const SimplifiedSyncPath = "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync"
+
+// MaxTransactionIDs is the most transaction IDs a client can register in one request.
+const MaxTransactionIDs = 100
+
+// WebSocketSyncPath serves sliding sync over a WebSocket, which pushes each response as soon as it
+// is ready rather than waiting for the client to long poll.
+const WebSocketSyncPath = "/_matrix/client/unstable/org.matrix.msc3575/sync/ws"
+
 type Request struct {
 	TxnID             string                      `json:"txn_id"`
 	ConnID            string                      `json:"conn_id"`
@@ -33,22 +51,141 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// Strict enables strict validation for this connection. Once a request setting it passes
+	// validation, it applies to all subsequent requests on the connection until it is explicitly
+	// set to false.
+	Strict *bool `json:"strict,omitempty"`
+	// RoomHashes are the hashes of the initial room payloads which the client already holds, keyed
+	// by room ID. Usually sent on the first request of a new connection, e.g after M_UNKNOWN_POS.
+	// Sending room_hashes, even if empty, enables room hashes for the rest of the connection.
+	RoomHashes map[string]string `json:"room_hashes,omitempty"`
+	// TransactionIDs are the transaction IDs of events which this device recently sent, keyed by
+	// event ID, so the events include unsigned.transaction_id for this device even if its poller
+	// never sees them with one. Not sticky.
+	TransactionIDs map[string]string `json:"transaction_ids,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
 	timeoutMSecs int
+	// keepalive is true if the timeout was shortened to send a keepalive response, see SetKeepalive.
+	keepalive bool
 }
 
-func (r *Request) Validate() error {
+// Validate checks the request for values which can never be processed. The returned error
+// names the offending field.
+func (r *Request) Validate() *internal.HandlerError {
 	if len(r.ConnID) > 16 {
-		return fmt.Errorf("conn_id is too long: %d > 16", len(r.ConnID))
+		return internal.InvalidParamError("conn_id", "too long: %d > 16", len(r.ConnID))
 	}
 	if len(r.TxnID) > 64 {
-		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
+		return internal.InvalidParamError("txn_id", "too long: %d > 64", len(r.TxnID))
+	}
+	if len(r.TransactionIDs) > MaxTransactionIDs {
+		return internal.InvalidParamError("transaction_ids", "too many: %d > %d", len(r.TransactionIDs), MaxTransactionIDs)
+	}
+	for eventID, txnID := range r.TransactionIDs {
+		if !strings.HasPrefix(eventID, "$") {
+			return internal.InvalidParamError("transaction_ids", "invalid event ID %q", eventID)
+		}
+		if txnID == "" || len(txnID) > 255 {
+			return internal.InvalidParamError(fmt.Sprintf("transaction_ids[%s]", eventID), "must be between 1 and 255 bytes")
+		}
+	}
+	for listKey, l := range r.Lists {
+		if l.Ranges != nil && !l.Ranges.Valid() {
+			return internal.InvalidParamError(fmt.Sprintf("lists[%s].ranges", listKey), "invalid ranges %v", l.Ranges)
+		}
+		if herr := validateBumpEventTypes(fmt.Sprintf("lists[%s].bump_event_types", listKey), l.BumpEventTypes); herr != nil {
+			return herr
+		}
 	}
 	return nil
 }
 
+// ValidateStrict checks the request for values which would otherwise be silently ignored,
+// such as unknown sort keys or conflicting parameters. It is only called for connections
+// which have opted into strict mode. The returned error names the offending field.
+func (r *Request) ValidateStrict() *internal.HandlerError {
+	for listKey, l := range r.Lists {
+		field := fmt.Sprintf("lists[%s]", listKey)
+		for _, sortKey := range l.Sort {
+			if !isKnownSortKey(sortKey) {
+				return internal.InvalidParamError(field+".sort", "unknown sort key '%s'", sortKey)
+			}
+		}
+		if l.TimelineLimit < 0 {
+			return internal.InvalidParamError(field+".timeline_limit", "must not be negative: %d", l.TimelineLimit)
+		}
+		if l.Deleted && (l.Ranges != nil || l.Sort != nil || l.Filters != nil || l.RequiredState != nil || l.TimelineLimit != 0) {
+			return internal.InvalidParamError(field+".deleted", "deleted lists cannot also set list parameters")
+		}
+		if l.Filters != nil && l.Filters.ActiveWithinMs < 0 {
+			return internal.InvalidParamError(field+".filters.active_within_ms", "must not be negative: %d", l.Filters.ActiveWithinMs)
+		}
+		if l.Filters != nil && (l.Filters.SpacesDepth < 0 || l.Filters.SpacesDepth > MaxSpacesDepth) {
+			return internal.InvalidParamError(field+".filters.spaces_depth", "must be between 0 and %d: %d", MaxSpacesDepth, l.Filters.SpacesDepth)
+		}
+		if herr := l.RoomSubscription.validateRequiredState(field + ".required_state"); herr != nil {
+			return herr
+		}
+	}
+	for roomID, sub := range r.RoomSubscriptions {
+		field := fmt.Sprintf("room_subscriptions[%s]", roomID)
+		if sub.TimelineLimit < 0 {
+			return internal.InvalidParamError(field+".timeline_limit", "must not be negative: %d", sub.TimelineLimit)
+		}
+		if herr := sub.validateRequiredState(field + ".required_state"); herr != nil {
+			return herr
+		}
+	}
+	for _, roomID := range r.UnsubscribeRooms {
+		if _, ok := r.RoomSubscriptions[roomID]; ok {
+			return internal.InvalidParamError("unsubscribe_rooms", "room %s is also in room_subscriptions", roomID)
+		}
+	}
+	return nil
+}
+
+// validateBumpEventTypes checks each bump event type is an event type, or the Wildcard which bumps
+// rooms for every event.
+func validateBumpEventTypes(field string, bumpEventTypes []string) *internal.HandlerError {
+	for i, evType := range bumpEventTypes {
+		if evType == "" {
+			return internal.InvalidParamError(fmt.Sprintf("%s[%d]", field, i), "missing event type")
+		}
+		if evType != Wildcard && strings.Contains(evType, Wildcard) {
+			return internal.InvalidParamError(fmt.Sprintf("%s[%d]", field, i), "unknown wildcard '%s', only '%s' is supported", evType, Wildcard)
+		}
+	}
+	return nil
+}
+
+// ParseBumpEventTypes parses a comma separated list of event types e.g "m.room.message,m.room.encrypted",
+// as used for a server's default bump_event_types.
+func ParseBumpEventTypes(spec string) ([]string, error) {
+	var bumpEventTypes []string
+	for _, evType := range strings.Split(spec, ",") {
+		evType = strings.TrimSpace(evType)
+		if evType == "" {
+			continue
+		}
+		bumpEventTypes = append(bumpEventTypes, evType)
+	}
+	if herr := validateBumpEventTypes("bump_event_types", bumpEventTypes); herr != nil {
+		return nil, herr
+	}
+	return bumpEventTypes, nil
+}
+
+func isKnownSortKey(sortKey string) bool {
+	for _, s := range SortBy {
+		if s == sortKey {
+			return true
+		}
+	}
+	return false
+}
+
 type RequestList struct {
 	RoomSubscription
 	Ranges          SliceRanges     `json:"ranges"`
@@ -57,6 +194,19 @@ type RequestList struct {
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
 	BumpEventTypes  []string        `json:"bump_event_types"`
+	// ActivityBeforeTS is the timestamp in milliseconds which SortByActivityBeforeTS sorts by
+	// activity at or before. If 0, sorts by the latest activity.
+	ActivityBeforeTS int64 `json:"activity_before_ts,omitempty"`
+}
+
+// Simplify converts a simplified sliding sync (MSC4186) request into an equivalent sliding sync
+// request. Simplified lists have no sort, as clients sort rooms themselves, so they are always
+// sorted by recency to send the most recently active rooms first.
+func (r *Request) Simplify() {
+	for listKey, l := range r.Lists {
+		l.Sort = []string{SortByRecency}
+		r.Lists[listKey] = l
+	}
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
@@ -65,10 +215,12 @@ func (rl *RequestList) ShouldGetAllRooms() bool {
 
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
+	var prevActivityBeforeTS int64
 	if rl != nil {
 		prevLen = len(rl.Sort)
+		prevActivityBeforeTS = rl.ActivityBeforeTS
 	}
-	if prevLen != len(next.Sort) {
+	if prevLen != len(next.Sort) || prevActivityBeforeTS != next.ActivityBeforeTS {
 		return true
 	}
 	for i := range rl.Sort {
@@ -270,6 +422,13 @@ func (r *Request) SetTimeoutMSecs(timeout int) {
 	r.timeoutMSecs = timeout
 }
 
+// SetKeepalive marks the timeout as shortened to send a keepalive response before the client's
+// timeout. If nothing happens before then, the response keeps the request's pos rather than using
+// up a new position.
+func (r *Request) SetKeepalive(keepalive bool) {
+	r.keepalive = keepalive
+}
+
 // Same determines if the given request would produce the same output as the other
 // if given the same input data.
 func (r *Request) Same(other *Request) bool {
@@ -279,6 +438,8 @@ func (r *Request) Same(other *Request) bool {
 	otherCopy := *other
 	rCopy.TxnID = ""
 	otherCopy.TxnID = ""
+	rCopy.TransactionIDs = nil
+	otherCopy.TransactionIDs = nil
 	serialised, err := json.Marshal(rCopy)
 	if err != nil {
 		return false
@@ -394,23 +555,38 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if bumpEventTypes == nil {
 			bumpEventTypes = existingList.BumpEventTypes
 		}
+		activityBeforeTS := nextList.ActivityBeforeTS
+		if activityBeforeTS == 0 {
+			activityBeforeTS = existingList.ActivityBeforeTS
+		}
 		heroes := nextList.Heroes
 		if heroes == nil {
 			heroes = existingList.Heroes
 		}
+		membershipChanges := nextList.MembershipChanges
+		if membershipChanges == nil {
+			membershipChanges = existingList.MembershipChanges
+		}
+		stateAfter := nextList.StateAfter
+		if stateAfter == nil {
+			stateAfter = existingList.StateAfter
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
-				RequiredState:   reqState,
-				TimelineLimit:   timelineLimit,
-				IncludeOldRooms: includeOldRooms,
-				Heroes:          heroes,
+				RequiredState:     reqState,
+				TimelineLimit:     timelineLimit,
+				IncludeOldRooms:   includeOldRooms,
+				Heroes:            heroes,
+				MembershipChanges: membershipChanges,
+				StateAfter:        stateAfter,
 			},
-			Ranges:          rooms,
-			Sort:            sort,
-			Filters:         filters,
-			SlowGetAllRooms: slowGetAllRooms,
-			BumpEventTypes:  bumpEventTypes,
+			Ranges:           rooms,
+			Sort:             sort,
+			Filters:          filters,
+			SlowGetAllRooms:  slowGetAllRooms,
+			BumpEventTypes:   bumpEventTypes,
+			ActivityBeforeTS: activityBeforeTS,
 		}
 	}
 	result.Lists = calculatedLists
@@ -485,17 +661,28 @@ func (r *Request) ListKeys() []string {
 	return listKeys
 }
 
+// MaxSpacesDepth is the most levels of sub-spaces the spaces filter looks through.
+const MaxSpacesDepth = 10
+
 type RequestFilters struct {
-	Spaces         []string  `json:"spaces"`
+	Spaces []string `json:"spaces"`
+	// SpacesDepth is how many levels of sub-spaces below Spaces to include rooms from, up to
+	// MaxSpacesDepth. 0 only includes the direct children of Spaces. Sub-spaces are only seen
+	// through if the user is in them.
+	SpacesDepth    int       `json:"spaces_depth"`
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
-	RoomNameFilter string    `json:"room_name_like"`
+	RoomNameFilter string    `json:"room_name_like"` // see roomNameMatches
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	// ActiveWithinMs, if positive, only includes rooms whose last message is newer than this many
+	// milliseconds ago. Rooms are checked when they are added to the list or updated, and on every
+	// request, so a room which becomes dormant is deleted from the list on the client's next request.
+	ActiveWithinMs int64 `json:"active_within_ms"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
@@ -522,10 +709,15 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
-	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+	if rf.ActiveWithinMs > 0 && int64(r.LastMessageTimestamp) < time.Now().UnixMilli()-rf.ActiveWithinMs {
 		return false
 	}
+	if rf.RoomNameFilter != "" {
+		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+		if !roomNameMatches(roomName, rf.RoomNameFilter) {
+			return false
+		}
+	}
 	if len(rf.NotTags) > 0 {
 		for _, t := range rf.NotTags {
 			if _, ok := r.Tags[t]; ok {
@@ -560,16 +752,65 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 				return true
 			}
 		}
+		if rf.SpacesDepth > 0 {
+			return inSubSpace(r.RoomID, rf.Spaces, rf.SpacesDepth, finder)
+		}
 		return false
 	}
 	return true
 }
 
+// inSubSpace returns true if the room is a child of a sub-space of one of the spaces, looking up to
+// depth levels of sub-spaces below them. Spaces which are children of each other are only visited once.
+func inSubSpace(roomID string, spaces []string, depth int, finder RoomFinder) bool {
+	if depth > MaxSpacesDepth {
+		depth = MaxSpacesDepth
+	}
+	visited := make(map[string]struct{}, len(spaces))
+	for _, spaceID := range spaces {
+		visited[spaceID] = struct{}{}
+	}
+	if _, ok := visited[roomID]; ok {
+		// a cycle of sub-spaces doesn't put the spaces in their own list
+		return false
+	}
+	level := spaces
+	for i := 0; i < depth && len(level) > 0; i++ {
+		var nextLevel []string
+		for _, spaceID := range level {
+			space := finder.ReadOnlyRoom(spaceID)
+			if space == nil {
+				continue
+			}
+			for childID := range space.ChildSpaceRooms {
+				if _, ok := visited[childID]; ok {
+					continue
+				}
+				visited[childID] = struct{}{}
+				child := finder.ReadOnlyRoom(childID)
+				if child == nil || !child.IsSpace() {
+					continue
+				}
+				if _, ok := child.ChildSpaceRooms[roomID]; ok {
+					return true
+				}
+				nextLevel = append(nextLevel, childID)
+			}
+		}
+		level = nextLevel
+	}
+	return false
+}
+
 type RoomSubscription struct {
-	RequiredState   [][2]string       `json:"required_state"`
-	TimelineLimit   int64             `json:"timeline_limit"`
-	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
-	Heroes          *bool             `json:"include_heroes"`
+	RequiredState     [][2]string       `json:"required_state"`
+	TimelineLimit     int64             `json:"timeline_limit"`
+	IncludeOldRooms   *RoomSubscription `json:"include_old_rooms"`
+	Heroes            *bool             `json:"include_heroes"`
+	MembershipChanges *bool             `json:"include_membership_changes"`
+	// StateAfter delivers live state changes in state_after (MSC4222), rather than clients having
+	// to work out the room state from the state events in the timeline.
+	StateAfter *bool `json:"use_state_after"`
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -584,6 +825,15 @@ func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
 	return false
 }
 
+func (rs RoomSubscription) validateRequiredState(field string) *internal.HandlerError {
+	for i, tuple := range rs.RequiredState {
+		if tuple[0] == "" {
+			return internal.InvalidParamError(fmt.Sprintf("%s[%d]", field, i), "missing event type")
+		}
+	}
+	return nil
+}
+
 func (rs RoomSubscription) LazyLoadMembers() bool {
 	for _, tuple := range rs.RequiredState {
 		if tuple[0] == "m.room.member" && tuple[1] == StateKeyLazy {
@@ -597,6 +847,14 @@ func (rs RoomSubscription) IncludeHeroes() bool {
 	return rs.Heroes != nil && *rs.Heroes
 }
 
+func (rs RoomSubscription) IncludeMembershipChanges() bool {
+	return rs.MembershipChanges != nil && *rs.MembershipChanges
+}
+
+func (rs RoomSubscription) UseStateAfter() bool {
+	return rs.StateAfter != nil && *rs.StateAfter
+}
+
 // Combine this subcription with another, returning a union of both as a copy.
 func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 	return rs.combineRecursive(other, true)
@@ -675,6 +933,18 @@ func (rs RoomSubscription) RequiredStateMap(userID string) *internal.RequiredSta
 	)
 }
 
+// roomNameMatches returns true if every whitespace-separated term in `like` appears in the room
+// name, ignoring case. Terms can match in any order, so "bob alice" matches "Alice, Bob and 2 others".
+func roomNameMatches(roomName, like string) bool {
+	roomName = strings.ToLower(roomName)
+	for _, term := range strings.Fields(strings.ToLower(like)) {
+		if !strings.Contains(roomName, term) {
+			return false
+		}
+	}
+	return true
+}
+
 // helper to find `null` or literal string matches
 func nullableStringExists(arr []*string, input *string) bool {
 	if len(arr) == 0 {
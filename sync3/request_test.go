@@ -6,6 +6,10 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 func TestRoomSubscriptionUnion(t *testing.T) {
@@ -1030,6 +1034,17 @@ func TestSame(t *testing.T) {
 			},
 			expectSame: true,
 		},
+		// Requests only differing in registered transaction IDs are the same.
+		{
+			a: Request{
+				TxnID:          "txn1",
+				TransactionIDs: map[string]string{"$a": "m1"},
+			},
+			b: Request{
+				TxnID: "txn2",
+			},
+			expectSame: true,
+		},
 		// Requests only differing in some other field ConnID are NOT the same.
 		// TODO: would be better to change a more important field like lists rather than
 		// ConnID.
@@ -1131,3 +1146,367 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestValidate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		req       Request
+		wantParam string
+	}{
+		{
+			name: "empty request",
+			req:  Request{},
+		},
+		{
+			name:      "long conn_id",
+			req:       Request{ConnID: "this-conn-id-is-too-long"},
+			wantParam: "conn_id",
+		},
+		{
+			name: "bad range",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Ranges: SliceRanges{{10, 0}}},
+				},
+			},
+			wantParam: "lists[a].ranges",
+		},
+		{
+			name: "unknown sort key is allowed when not strict",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Sort: []string{"by_magic"}},
+				},
+			},
+		},
+		{
+			name: "bump event types",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {BumpEventTypes: []string{"m.room.message", "m.room.encrypted"}},
+					"b": {BumpEventTypes: []string{Wildcard}},
+				},
+			},
+		},
+		{
+			name: "empty bump event type",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {BumpEventTypes: []string{"m.room.message", ""}},
+				},
+			},
+			wantParam: "lists[a].bump_event_types[1]",
+		},
+		{
+			name: "unknown bump event type wildcard",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {BumpEventTypes: []string{"m.room.*"}},
+				},
+			},
+			wantParam: "lists[a].bump_event_types[0]",
+		},
+		{
+			name: "transaction IDs",
+			req: Request{
+				TransactionIDs: map[string]string{"$a": "m1", "$b": "m2"},
+			},
+		},
+		{
+			name: "transaction ID for a bad event ID",
+			req: Request{
+				TransactionIDs: map[string]string{"a": "m1"},
+			},
+			wantParam: "transaction_ids",
+		},
+		{
+			name: "empty transaction ID",
+			req: Request{
+				TransactionIDs: map[string]string{"$a": ""},
+			},
+			wantParam: "transaction_ids[$a]",
+		},
+	}
+	for _, tc := range testCases {
+		herr := tc.req.Validate()
+		assertInvalidParam(t, tc.name, herr, tc.wantParam)
+	}
+}
+
+func TestParseBumpEventTypes(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "m.room.message", want: []string{"m.room.message"}},
+		{spec: " m.room.message, m.room.encrypted,", want: []string{"m.room.message", "m.room.encrypted"}},
+		{spec: "*", want: []string{"*"}},
+		{spec: "m.room.message,m.call.*", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseBumpEventTypes(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v want an error", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got error %s", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestRequestValidateStrict(t *testing.T) {
+	testCases := []struct {
+		name      string
+		req       Request
+		wantParam string
+	}{
+		{
+			name: "valid request",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {
+						Ranges: SliceRanges{{0, 10}},
+						Sort:   []string{SortByRecency, SortByName},
+						RoomSubscription: RoomSubscription{
+							TimelineLimit: 5,
+							RequiredState: [][2]string{{"m.room.name", ""}},
+						},
+					},
+				},
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a": {TimelineLimit: 1},
+				},
+				UnsubscribeRooms: []string{"!b"},
+			},
+		},
+		{
+			name: "unknown sort key",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Sort: []string{SortByRecency, "by_magic"}},
+				},
+			},
+			wantParam: "lists[a].sort",
+		},
+		{
+			name: "negative timeline limit",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a": {TimelineLimit: -1},
+				},
+			},
+			wantParam: "room_subscriptions[!a].timeline_limit",
+		},
+		{
+			name: "deleted list with params",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Deleted: true, Ranges: SliceRanges{{0, 10}}},
+				},
+			},
+			wantParam: "lists[a].deleted",
+		},
+		{
+			name: "missing event type in required_state",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {
+						RoomSubscription: RoomSubscription{
+							RequiredState: [][2]string{{"m.room.name", ""}, {"", "foo"}},
+						},
+					},
+				},
+			},
+			wantParam: "lists[a].required_state[1]",
+		},
+		{
+			name: "negative active_within_ms",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Filters: &RequestFilters{ActiveWithinMs: -1}},
+				},
+			},
+			wantParam: "lists[a].filters.active_within_ms",
+		},
+		{
+			name: "spaces_depth too deep",
+			req: Request{
+				Lists: map[string]RequestList{
+					"a": {Filters: &RequestFilters{Spaces: []string{"!space"}, SpacesDepth: MaxSpacesDepth + 1}},
+				},
+			},
+			wantParam: "lists[a].filters.spaces_depth",
+		},
+		{
+			name: "subscribe and unsubscribe",
+			req: Request{
+				RoomSubscriptions: map[string]RoomSubscription{
+					"!a": {TimelineLimit: 1},
+				},
+				UnsubscribeRooms: []string{"!a"},
+			},
+			wantParam: "unsubscribe_rooms",
+		},
+	}
+	for _, tc := range testCases {
+		herr := tc.req.ValidateStrict()
+		assertInvalidParam(t, tc.name, herr, tc.wantParam)
+	}
+}
+
+func assertInvalidParam(t *testing.T, name string, herr *internal.HandlerError, wantParam string) {
+	t.Helper()
+	if wantParam == "" {
+		if herr != nil {
+			t.Errorf("%s: got error %v, want none", name, herr)
+		}
+		return
+	}
+	if herr == nil {
+		t.Errorf("%s: got no error, want error for %s", name, wantParam)
+		return
+	}
+	if herr.StatusCode != 400 || herr.ErrCode != "M_INVALID_PARAM" {
+		t.Errorf("%s: got %d %s, want 400 M_INVALID_PARAM", name, herr.StatusCode, herr.ErrCode)
+	}
+	if herr.Param != wantParam {
+		t.Errorf("%s: got param %s want %s", name, herr.Param, wantParam)
+	}
+}
+
+func TestRoomNameMatches(t *testing.T) {
+	testCases := []struct {
+		roomName string
+		like     string
+		want     bool
+	}{
+		{roomName: "Pineapple", like: "app", want: true},
+		{roomName: "Pineapple", like: "PINE", want: true},
+		{roomName: "Pineapple", like: "pear", want: false},
+		{roomName: "Alice, Bob and 2 others", like: "bob alice", want: true},
+		{roomName: "Alice, Bob and 2 others", like: "  alice   bob ", want: true},
+		{roomName: "Alice, Bob and 2 others", like: "alice charlie", want: false},
+		{roomName: "Ärger im Büro", like: "büro ärger", want: true},
+		{roomName: "anything", like: " ", want: true},
+	}
+	for _, tc := range testCases {
+		if got := roomNameMatches(tc.roomName, tc.like); got != tc.want {
+			t.Errorf("roomNameMatches(%q, %q): got %v want %v", tc.roomName, tc.like, got, tc.want)
+		}
+	}
+}
+
+func TestRequestFiltersActiveWithin(t *testing.T) {
+	now := uint64(time.Now().UnixMilli())
+	rooms := []*RoomConnMetadata{
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!recent", LastMessageTimestamp: now - 1000}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!lastweek", LastMessageTimestamp: now - 7*24*3600*1000}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!ancient", LastMessageTimestamp: 1}},
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		activeWithinMs int64
+		want           []string
+	}{
+		{activeWithinMs: 0, want: []string{"!recent", "!lastweek", "!ancient"}},
+		{activeWithinMs: 60 * 1000, want: []string{"!recent"}},
+		{activeWithinMs: 30 * 24 * 3600 * 1000, want: []string{"!recent", "!lastweek"}},
+	}
+	for _, tc := range testCases {
+		filter := &RequestFilters{ActiveWithinMs: tc.activeWithinMs}
+		var got []string
+		for _, r := range rooms {
+			if filter.Include(r, f) {
+				got = append(got, r.RoomID)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("active_within_ms=%d: got %v want %v", tc.activeWithinMs, got, tc.want)
+		}
+	}
+}
+
+func TestRequestFiltersSpacesDepth(t *testing.T) {
+	spaceType := "m.space"
+	// room makes a room which is in the parent spaces and has the children as m.space.child rooms
+	room := func(roomID string, isSpace bool, parents []string, children ...string) *RoomConnMetadata {
+		r := &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:          roomID,
+				ChildSpaceRooms: make(map[string]struct{}),
+			},
+			UserRoomData: caches.UserRoomData{
+				Spaces: make(map[string]struct{}),
+			},
+		}
+		if isSpace {
+			r.RoomType = &spaceType
+		}
+		for _, parent := range parents {
+			r.UserRoomData.Spaces[parent] = struct{}{}
+		}
+		for _, child := range children {
+			r.ChildSpaceRooms[child] = struct{}{}
+		}
+		return r
+	}
+	// !work contains !team, which contains !project, which contains !work again
+	rooms := []*RoomConnMetadata{
+		room("!work", true, []string{"!project"}, "!team", "!general"),
+		room("!team", true, []string{"!work"}, "!project", "!standup"),
+		room("!project", true, []string{"!team"}, "!work", "!tasks"),
+		room("!general", false, []string{"!work"}),
+		room("!standup", false, []string{"!team"}),
+		room("!tasks", false, []string{"!project"}),
+		room("!other", false, nil),
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		depth int
+		want  []string
+	}{
+		{depth: 0, want: []string{"!team", "!general"}},
+		{depth: 1, want: []string{"!team", "!project", "!general", "!standup"}},
+		{depth: 2, want: []string{"!team", "!project", "!general", "!standup", "!tasks"}},
+		{depth: MaxSpacesDepth + 5, want: []string{"!team", "!project", "!general", "!standup", "!tasks"}},
+	}
+	for _, tc := range testCases {
+		filter := &RequestFilters{Spaces: []string{"!work"}, SpacesDepth: tc.depth}
+		var got []string
+		for _, r := range rooms {
+			if filter.Include(r, f) {
+				got = append(got, r.RoomID)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("spaces_depth=%d: got %v want %v", tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestRequestSimplify(t *testing.T) {
+	req := Request{
+		Lists: map[string]RequestList{
+			"a": {Ranges: SliceRanges{{0, 10}}},
+			"b": {Ranges: SliceRanges{{0, 5}}, Sort: []string{SortByName}},
+		},
+	}
+	req.Simplify()
+	for listKey, l := range req.Lists {
+		if !reflect.DeepEqual(l.Sort, []string{SortByRecency}) {
+			t.Errorf("list %s: got sort %v want [%s]", listKey, l.Sort, SortByRecency)
+		}
+	}
+	if !reflect.DeepEqual(req.Lists["a"].Ranges, SliceRanges{{0, 10}}) {
+		t.Errorf("Simplify changed ranges: %v", req.Lists["a"].Ranges)
+	}
+}
@@ -23,6 +23,15 @@ type Response struct {
 
 	Pos   string `json:"pos"`
 	TxnID string `json:"txn_id,omitempty"`
+
+	// UpstreamUnavailableSince is set to the unix timestamp in milliseconds when the proxy stopped
+	// being able to sync with the homeserver. The response is from stored data, which may be stale.
+	UpstreamUnavailableSince int64 `json:"upstream_unavailable_since,omitempty"`
+
+	// Keepalive is set on empty responses which were returned before the client's timeout, so that
+	// intermediaries which kill idle HTTP responses don't kill the long poll. Clients should
+	// immediately make the next request.
+	Keepalive bool `json:"keepalive,omitempty"`
 }
 
 type ResponseList struct {
@@ -45,6 +54,24 @@ func (r *Response) ListOps() int {
 	return num
 }
 
+// Simplified returns this response as a simplified sliding sync (MSC4186) response. Lists only
+// have a count, and rooms have a bump_stamp instead of a timestamp, which clients sort by. The
+// response is copied, as connections keep their last response to answer retries.
+func (r *Response) Simplified() *Response {
+	simplified := *r
+	simplified.Lists = make(map[string]ResponseList, len(r.Lists))
+	for listKey, l := range r.Lists {
+		simplified.Lists[listKey] = ResponseList{Count: l.Count}
+	}
+	simplified.Rooms = make(map[string]Room, len(r.Rooms))
+	for roomID, room := range r.Rooms {
+		room.BumpStamp = room.Timestamp
+		room.Timestamp = 0
+		simplified.Rooms[roomID] = room
+	}
+	return &simplified
+}
+
 func (r *Response) RoomIDsToTimelineEventIDs() map[string][]string {
 	includedRoomIDs := make(map[string][]string)
 	for roomID := range r.Rooms {
@@ -67,8 +94,9 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 		} `json:"lists"`
 		Extensions extensions.Response `json:"extensions"`
 
-		Pos   string `json:"pos"`
-		TxnID string `json:"txn_id,omitempty"`
+		Pos       string `json:"pos"`
+		TxnID     string `json:"txn_id,omitempty"`
+		Keepalive bool   `json:"keepalive,omitempty"`
 	}{}
 	if err := json.Unmarshal(b, &temporary); err != nil {
 		return err
@@ -76,6 +104,7 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	r.Rooms = temporary.Rooms
 	r.Pos = temporary.Pos
 	r.TxnID = temporary.TxnID
+	r.Keepalive = temporary.Keepalive
 	r.Extensions = temporary.Extensions
 	r.Lists = make(map[string]ResponseList, len(temporary.Lists))
 
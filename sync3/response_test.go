@@ -0,0 +1,52 @@
+package sync3
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestResponseSimplified(t *testing.T) {
+	index := 0
+	resp := &Response{
+		Lists: map[string]ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []ResponseOp{
+					&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!a:localhost", "!b:localhost"}},
+					&ResponseOpSingle{Operation: OpInsert, Index: &index, RoomID: "!a:localhost"},
+				},
+			},
+		},
+		Rooms: map[string]Room{
+			"!a:localhost": {Name: "A", Timestamp: 1700000000000, Initial: true},
+			"!b:localhost": {Name: "B"},
+		},
+		Pos: "5",
+	}
+	simplified := resp.Simplified()
+	b, err := json.Marshal(simplified)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	body := gjson.ParseBytes(b)
+	if body.Get("lists.a.ops").Exists() || body.Get("lists.a.count").Int() != 3 {
+		t.Errorf("lists: got %s", body.Get("lists").Raw)
+	}
+	roomA := body.Get(`rooms.!a:localhost`)
+	if roomA.Get("bump_stamp").Int() != 1700000000000 || roomA.Get("timestamp").Exists() || !roomA.Get("initial").Bool() {
+		t.Errorf("room A: got %s", roomA.Raw)
+	}
+	if body.Get(`rooms.!b:localhost.bump_stamp`).Exists() {
+		t.Errorf("room B: got %s", body.Get(`rooms.!b:localhost`).Raw)
+	}
+	if body.Get("pos").Str != "5" {
+		t.Errorf("pos: got %s", body.Get("pos").Raw)
+	}
+
+	// the original response is kept for retries, so must be unchanged
+	if len(resp.Lists["a"].Ops) != 2 || resp.Rooms["!a:localhost"].Timestamp != 1700000000000 || resp.Rooms["!a:localhost"].BumpStamp != 0 {
+		t.Errorf("Simplified modified the original response: %+v", resp)
+	}
+}
@@ -1,15 +1,19 @@
 package sync3
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 type Room struct {
 	Name              string            `json:"name,omitempty"`
+	Topic             string            `json:"topic,omitempty"`
 	AvatarChange      AvatarChange      `json:"avatar,omitempty"`
 	Heroes            []internal.Hero   `json:"heroes,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
@@ -20,11 +24,114 @@ type Room struct {
 	UnreadCount       int64             `json:"org.matrix.msc2654.unread_count,omitempty"`
 	Initial           bool              `json:"initial,omitempty"`
 	IsDM              bool              `json:"is_dm,omitempty"`
+	JoinRule          string            `json:"join_rule,omitempty"`
+	HistoryVisibility string            `json:"history_visibility,omitempty"`
 	JoinedCount       int               `json:"joined_count,omitempty"`
 	InvitedCount      *int              `json:"invited_count,omitempty"`
 	PrevBatch         string            `json:"prev_batch,omitempty"`
 	NumLive           int               `json:"num_live,omitempty"`
 	Timestamp         uint64            `json:"timestamp,omitempty"`
+	// BumpStamp replaces Timestamp in simplified sliding sync responses.
+	BumpStamp         uint64             `json:"bump_stamp,omitempty"`
+	MembershipChanges *MembershipChanges `json:"membership_changes,omitempty"`
+	// StateAfter is the state which changed during the timeline, at its value after the last timeline
+	// event, for subscriptions with use_state_after (MSC4222). Clients should apply it on top of
+	// required_state rather than using the state events in the timeline.
+	StateAfter []json.RawMessage `json:"state_after,omitempty"`
+	// ThreadUnreadNotifications are the counts of threads with unread notifications, keyed by thread
+	// root event ID (MSC3773). In live updates, threads which have been read have zero counts.
+	ThreadUnreadNotifications map[string]internal.ThreadUnreadCounts `json:"unread_thread_notifications,omitempty"`
+	// Hash is the ContentHash of an initial room payload, for connections which use room hashes.
+	Hash string `json:"hash,omitempty"`
+	// Unchanged is set instead of the room's data when the client already holds an initial
+	// payload with this Hash, so should use its cached copy.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// ContentHash returns a hash of this room's payload, ignoring Hash and Unchanged. Identical
+// payloads always have the same hash.
+func (r Room) ContentHash() string {
+	r.Hash = ""
+	r.Unchanged = false
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// MaxMembershipChangeUserIDs is the most user IDs included for each kind of membership change.
+const MaxMembershipChangeUserIDs = 5
+
+// MembershipChanges summarises the joins, leaves and invites in a room since the connection's
+// last position, so clients can show e.g "3 people joined" without requesting member state.
+type MembershipChanges struct {
+	Joined  MembershipChange `json:"joined"`
+	Left    MembershipChange `json:"left"`
+	Invited MembershipChange `json:"invited"`
+}
+
+// MembershipChange is the number of changes of one kind, plus some of the users involved.
+type MembershipChange struct {
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids,omitempty"`
+}
+
+func (c *MembershipChange) add(userID string) {
+	c.Count++
+	if len(c.UserIDs) >= MaxMembershipChangeUserIDs {
+		return
+	}
+	for _, u := range c.UserIDs {
+		if u == userID {
+			return
+		}
+	}
+	c.UserIDs = append(c.UserIDs, userID)
+}
+
+// AddMembershipChange records a membership transition in this room's membership_changes. Profile
+// changes and other transitions which aren't a join, leave or invite are ignored. prevMembership
+// is empty if it is unknown.
+func (r *Room) AddMembershipChange(userID, membership, prevMembership string) {
+	if membership == prevMembership {
+		return
+	}
+	switch membership {
+	case "join", "invite":
+	case "leave", "ban":
+		// rejected or retracted invites aren't people leaving the room
+		if prevMembership != "" && prevMembership != "join" {
+			return
+		}
+	default:
+		return
+	}
+	if r.MembershipChanges == nil {
+		r.MembershipChanges = &MembershipChanges{}
+	}
+	switch membership {
+	case "join":
+		r.MembershipChanges.Joined.add(userID)
+	case "invite":
+		r.MembershipChanges.Invited.add(userID)
+	default:
+		r.MembershipChanges.Left.add(userID)
+	}
+}
+
+// SetStateAfter adds a state event to state_after, replacing any earlier event with the same type
+// and state key.
+func (r *Room) SetStateAfter(event json.RawMessage) {
+	parsed := gjson.ParseBytes(event)
+	evType := parsed.Get("type").Str
+	stateKey := parsed.Get("state_key").Str
+	for i := range r.StateAfter {
+		existing := gjson.ParseBytes(r.StateAfter[i])
+		if existing.Get("type").Str == evType && existing.Get("state_key").Str == stateKey {
+			r.StateAfter[i] = event
+			return
+		}
+	}
+	r.StateAfter = append(r.StateAfter, event)
 }
 
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
@@ -88,6 +195,24 @@ func sameHeroAvatars(a, b []internal.Hero) bool {
 	return true
 }
 
+// InterestedEventTimestamp returns the origin_server_ts of the latest event since the user's join
+// with one of the bump event types, or the join if there is no such event. Returns the
+// LastMessageTimestamp if every event is interesting, or for invites as the user can't see any events.
+func (r *RoomConnMetadata) InterestedEventTimestamp(bumpEventTypes []string) uint64 {
+	if len(bumpEventTypes) == 0 || r.IsInvite {
+		return r.LastMessageTimestamp
+	}
+	ts := r.JoinTiming.Timestamp
+	for _, eventType := range bumpEventTypes {
+		timing := r.LatestEventsByType[eventType]
+		// we found a later event which we are authorised to see, use it instead
+		if r.JoinTiming.NID < timing.NID && ts < timing.Timestamp {
+			ts = timing.Timestamp
+		}
+	}
+	return ts
+}
+
 func (r *RoomConnMetadata) GetLastInterestedEventTimestamp(listKey string) uint64 {
 	ts, ok := r.LastInterestedEventTimestamps[listKey]
 	if ok {
@@ -96,9 +221,9 @@ func (r *RoomConnMetadata) GetLastInterestedEventTimestamp(listKey string) uint6
 	// SetRoom is responsible for maintaining LastInterestedEventTimestamps.
 	// However, if a brand-new list appears we don't call SetRoom until we have
 	// some RoomEventUpdates to process. We need to ensure we hand back a sensible
-	// timestamp. So: use the (current) LastMessageTimestamp as a fallback.
-	// TODO: if we had access to the request's bump event types, we could lookup the
-	//       a timestamp by event type from the global metadata (c.f. ConnState.load).
+	// timestamp. So: use the (current) LastMessageTimestamp as a fallback. New lists
+	// with bump event types are given the right timestamps with
+	// InternalRequestLists.SetInterestedEventTimestamps before they are sorted.
 	ts = r.LastMessageTimestamp
 	// Write this value into the map. If we don't and only uninteresting events
 	// arrive after, the fallback value will have jumped ahead despite nothing of
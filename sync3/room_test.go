@@ -72,3 +72,75 @@ func TestAvatarChangeMarshalling(t *testing.T) {
 		})
 	}
 }
+
+func TestRoomAddMembershipChange(t *testing.T) {
+	var r Room
+	r.AddMembershipChange("@bob:localhost", "leave", "invite") // rejected invite
+	r.AddMembershipChange("@bob:localhost", "knock", "")       // not summarised
+	r.AddMembershipChange("@alice:localhost", "join", "join")  // profile change
+	if r.MembershipChanges != nil {
+		t.Fatalf("got membership changes %+v, want none", r.MembershipChanges)
+	}
+	r.AddMembershipChange("@alice:localhost", "invite", "leave")
+	r.AddMembershipChange("@alice:localhost", "join", "invite")
+	r.AddMembershipChange("@bob:localhost", "join", "")
+	r.AddMembershipChange("@bob:localhost", "leave", "join")
+	r.AddMembershipChange("@bob:localhost", "join", "leave")
+	r.AddMembershipChange("@charlie:localhost", "ban", "")
+	for i := 0; i < MaxMembershipChangeUserIDs+2; i++ {
+		r.AddMembershipChange(fmt.Sprintf("@user%d:localhost", i), "join", "")
+	}
+	want := &MembershipChanges{
+		Joined: MembershipChange{
+			Count:   MaxMembershipChangeUserIDs + 5,
+			UserIDs: []string{"@alice:localhost", "@bob:localhost", "@user0:localhost", "@user1:localhost", "@user2:localhost"},
+		},
+		Left: MembershipChange{
+			Count:   2,
+			UserIDs: []string{"@bob:localhost", "@charlie:localhost"},
+		},
+		Invited: MembershipChange{
+			Count:   1,
+			UserIDs: []string{"@alice:localhost"},
+		},
+	}
+	if !reflect.DeepEqual(r.MembershipChanges, want) {
+		t.Fatalf("got membership changes %+v want %+v", r.MembershipChanges, want)
+	}
+}
+
+func TestRoomContentHash(t *testing.T) {
+	room := Room{
+		Name:     "My Room",
+		Timeline: []json.RawMessage{json.RawMessage(`{"event_id":"$a"}`)},
+		Initial:  true,
+	}
+	hash := room.ContentHash()
+	if hash == "" {
+		t.Fatalf("ContentHash: got empty hash")
+	}
+	withHash := room
+	withHash.Hash = hash
+	withHash.Unchanged = true
+	if got := withHash.ContentHash(); got != hash {
+		t.Errorf("ContentHash depends on Hash and Unchanged: got %s want %s", got, hash)
+	}
+	changed := room
+	changed.Timeline = []json.RawMessage{json.RawMessage(`{"event_id":"$b"}`)}
+	if got := changed.ContentHash(); got == hash {
+		t.Errorf("ContentHash: got the same hash for a different timeline")
+	}
+}
+
+func TestRoomSetStateAfter(t *testing.T) {
+	var r Room
+	r.SetStateAfter(json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"A"}}`))
+	r.SetStateAfter(json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","content":{"membership":"join"}}`))
+	r.SetStateAfter(json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"B"}}`))
+	if len(r.StateAfter) != 2 {
+		t.Fatalf("got %d state_after events, want 2", len(r.StateAfter))
+	}
+	if name := gjson.GetBytes(r.StateAfter[0], "content.name").Str; name != "B" {
+		t.Errorf("got room name %q want the latest name B", name)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/matrix-org/sliding-sync/internal"
 )
 
+// PinnedTag is the room tag which pins rooms to the top of lists sorted by SortByPinned.
+const PinnedTag = "m.favourite"
+
 type RoomFinder interface {
 	ReadOnlyRoom(roomID string) *RoomConnMetadata
 }
@@ -18,6 +21,13 @@ type SortableRooms struct {
 	listKey       string
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	// sortTags are the tags whose order SortByTagOrder sorts by: the list's filters.tags.
+	sortTags []string
+	// activityBeforeTS and activityAt are what SortByActivityBeforeTS sorts by: the list's
+	// activity_before_ts, and the latest activity at or before it in each room. Set by
+	// SetActivityBefore.
+	activityBeforeTS int64
+	activityAt       map[string]int64
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
@@ -86,7 +96,80 @@ func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 	}
 }
 
+// SetActivityBefore sets the timestamp SortByActivityBeforeTS sorts by, and when each room was last
+// active at or before it, by room ID. Rooms missing from `activity` were not active by then.
+func (s *SortableRooms) SetActivityBefore(ts int64, activity map[string]int64) {
+	s.activityBeforeTS = ts
+	s.activityAt = activity
+}
+
 func (s *SortableRooms) Sort(sortBy []string) error {
+	cmp, err := s.comparator(sortBy)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(s.roomIDs, func(i, j int) bool {
+		return cmp(i, j) == 1
+	})
+	for i := range s.roomIDs {
+		s.roomIDToIndex[s.roomIDs[i]] = i
+	}
+
+	return nil
+}
+
+// SortRoom moves a room which was just added or changed to where Sort would put it, assuming the
+// rest of the list is sorted. This only compares the room against O(log n) other rooms rather than
+// sorting the whole list, which matters for sorts like SortByNotificationLevel where every read
+// receipt or notification moves a room.
+func (s *SortableRooms) SortRoom(roomID string, sortBy []string) error {
+	fromIndex, ok := s.roomIDToIndex[roomID]
+	if !ok {
+		return nil
+	}
+	cmp, err := s.comparator(sortBy)
+	if err != nil {
+		return err
+	}
+	// move the room to the end, so the comparators can compare it against the other rooms by index
+	last := len(s.roomIDs) - 1
+	copy(s.roomIDs[fromIndex:], s.roomIDs[fromIndex+1:])
+	s.roomIDs[last] = roomID
+	// the other rooms are sorted, so those which sort before the room come first, then those
+	// which are equal to it, then those which sort after it.
+	lo := sort.Search(last, func(k int) bool {
+		return cmp(k, last) != 1
+	})
+	hi := lo + sort.Search(last-lo, func(k int) bool {
+		return cmp(last, lo+k) == 1
+	})
+	// like Sort, keep the room in the same order relative to the rooms which are equal to it
+	toIndex := fromIndex
+	if toIndex < lo {
+		toIndex = lo
+	} else if toIndex > hi {
+		toIndex = hi
+	}
+	copy(s.roomIDs[toIndex+1:], s.roomIDs[toIndex:last])
+	s.roomIDs[toIndex] = roomID
+	updateFrom := toIndex
+	if fromIndex < updateFrom {
+		updateFrom = fromIndex
+	}
+	for i := updateFrom; i < len(s.roomIDs); i++ {
+		s.roomIDToIndex[s.roomIDs[i]] = i
+	}
+	if (toIndex > 0 && cmp(toIndex, toIndex-1) == 1) || (toIndex < last && cmp(toIndex+1, toIndex) == 1) {
+		// the rest of the list wasn't sorted after all
+		return s.Sort(sortBy)
+	}
+	return nil
+}
+
+// comparator returns a function which compares the rooms at two indexes by each of the sort
+// orders in turn, returning +1 if the room at i comes first, -1 if the room at j does, or 0 if
+// they are equal.
+func (s *SortableRooms) comparator(sortBy []string) (func(i, j int) int, error) {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
 	comparators := []func(i, j int) int{}
@@ -102,28 +185,26 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 			comparators = append(comparators, s.comparatorSortByRecency)
 		case SortByNotificationLevel:
 			comparators = append(comparators, s.comparatorSortByNotificationLevel)
+		case SortByPinned:
+			comparators = append(comparators, s.comparatorSortByPinned)
+		case SortByTagOrder:
+			comparators = append(comparators, s.comparatorSortByTagOrder)
+		case SortByActivityBeforeTS:
+			comparators = append(comparators, s.comparatorSortByActivityBeforeTS)
 		default:
-			return fmt.Errorf("unknown sort order: %s", sort)
+			return nil, fmt.Errorf("unknown sort order: %s", sort)
 		}
 	}
-	sort.SliceStable(s.roomIDs, func(i, j int) bool {
+	return func(i, j int) int {
 		for _, fn := range comparators {
-			val := fn(i, j)
-			if val == 1 {
-				return true
-			} else if val == -1 {
-				return false
+			if val := fn(i, j); val != 0 {
+				return val
 			}
 			// continue to next comparator as these are equal
 		}
 		// the two items are identical
-		return false
-	})
-	for i := range s.roomIDs {
-		s.roomIDToIndex[s.roomIDs[i]] = i
-	}
-
-	return nil
+		return 0
+	}, nil
 }
 
 // Comparator functions: -1 = false, +1 = true, 0 = match
@@ -213,6 +294,88 @@ func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
 	return -1
 }
 
+// comparatorSortByPinned holds rooms tagged as m.favourite above all other rooms, in the order
+// given by the tag. Rooms which are not pinned are left to the next comparator.
+func (s *SortableRooms) comparatorSortByPinned(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	orderRi, pinnedRi := ri.Tags[PinnedTag]
+	orderRj, pinnedRj := rj.Tags[PinnedTag]
+	if pinnedRi != pinnedRj {
+		if pinnedRi {
+			return 1
+		}
+		return -1
+	}
+	if !pinnedRi || orderRi == orderRj {
+		return 0
+	}
+	if orderRi < orderRj {
+		return 1
+	}
+	return -1
+}
+
+// comparatorSortByTagOrder holds rooms with one of the list's filter tags above all other rooms,
+// in the order given by the tags. A room with several of the tags uses the lowest order. Rooms
+// without the tags, or all rooms if the list filters no tags, are left to the next comparator.
+func (s *SortableRooms) comparatorSortByTagOrder(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	orderRi, taggedRi := s.tagOrder(ri)
+	orderRj, taggedRj := s.tagOrder(rj)
+	if taggedRi != taggedRj {
+		if taggedRi {
+			return 1
+		}
+		return -1
+	}
+	if !taggedRi || orderRi == orderRj {
+		return 0
+	}
+	if orderRi < orderRj {
+		return 1
+	}
+	return -1
+}
+
+// tagOrder returns the lowest order of the sortTags on this room, and false if it has none of them.
+func (s *SortableRooms) tagOrder(r *RoomConnMetadata) (order float64, tagged bool) {
+	for _, tag := range s.sortTags {
+		tagOrder, ok := r.Tags[tag]
+		if ok && (!tagged || tagOrder < order) {
+			order = tagOrder
+			tagged = true
+		}
+	}
+	return
+}
+
+// comparatorSortByActivityBeforeTS holds the most recently active rooms at or before the list's
+// activity_before_ts first, then rooms which were not active by then.
+func (s *SortableRooms) comparatorSortByActivityBeforeTS(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	tsRi := s.activityBefore(ri)
+	tsRj := s.activityBefore(rj)
+	if tsRi == tsRj {
+		return 0
+	}
+	if tsRi > tsRj {
+		return 1
+	}
+	return -1
+}
+
+// activityBefore returns when the room was last active at or before activityBeforeTS, or 0 if it
+// wasn't active by then.
+func (s *SortableRooms) activityBefore(r *RoomConnMetadata) int64 {
+	activity := s.activityAt[r.RoomID]
+	// activityAt was loaded when the list was sorted, so may miss events and rooms seen since.
+	lastMessage := int64(r.LastMessageTimestamp)
+	if s.activityBeforeTS == 0 || (lastMessage <= s.activityBeforeTS && lastMessage > activity) {
+		return lastMessage
+	}
+	return activity
+}
+
 // FilteredSortableRooms is SortableRooms but where rooms are filtered before being added to the list.
 // Updates to room metadata may result in rooms being added/removed.
 type FilteredSortableRooms struct {
@@ -231,12 +394,30 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
+	sr := NewSortableRooms(finder, listKey, filteredRooms)
+	sr.sortTags = filter.Tags
 	return &FilteredSortableRooms{
-		SortableRooms: NewSortableRooms(finder, listKey, filteredRooms),
+		SortableRooms: sr,
 		filter:        filter,
 	}
 }
 
+// ExpiredRoomIDs returns the rooms in the list which are no longer active within the filter's
+// active_within_ms. Filters are otherwise only checked when a room is added or updated, which
+// never happens for a room which has gone quiet.
+func (f *FilteredSortableRooms) ExpiredRoomIDs() []string {
+	if f.filter.ActiveWithinMs <= 0 {
+		return nil
+	}
+	var expired []string
+	for _, roomID := range f.roomIDs {
+		if !f.filter.Include(f.finder.ReadOnlyRoom(roomID), f.finder) {
+			expired = append(expired, roomID)
+		}
+	}
+	return expired
+}
+
 func (f *FilteredSortableRooms) Add(roomID string) bool {
 	r := f.finder.ReadOnlyRoom(roomID)
 	if !f.filter.Include(r, f.finder) {
@@ -1,6 +1,8 @@
 package sync3
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
@@ -387,3 +389,157 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestSortByPinned(t *testing.T) {
+	const listKey = "my_list"
+	newRoom := func(roomID string, ts uint64, tags map[string]float64) *RoomConnMetadata {
+		return &RoomConnMetadata{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomID},
+			UserRoomData:                  caches.UserRoomData{Tags: tags},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: ts},
+		}
+	}
+	rooms := []*RoomConnMetadata{
+		newRoom("!recent", 900, nil),
+		newRoom("!pinned-second", 100, map[string]float64{PinnedTag: 0.5}),
+		newRoom("!lowpriority", 800, map[string]float64{"m.lowpriority": 0.1}),
+		newRoom("!pinned-first", 200, map[string]float64{PinnedTag: 0.2}),
+		newRoom("!pinned-no-order", 300, map[string]float64{PinnedTag: 1}),
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	if err := sr.Sort([]string{SortByPinned, SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!pinned-first", "!pinned-second", "!pinned-no-order", "!recent", "!lowpriority"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("Sort: got %v want %v", sr.roomIDs, want)
+	}
+}
+
+func TestSortByTagOrder(t *testing.T) {
+	const listKey = "my_list"
+	newRoom := func(roomID string, ts uint64, tags map[string]float64) *RoomConnMetadata {
+		return &RoomConnMetadata{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomID},
+			UserRoomData:                  caches.UserRoomData{Tags: tags},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: ts},
+		}
+	}
+	rooms := []*RoomConnMetadata{
+		newRoom("!untagged", 900, nil),
+		newRoom("!low-second", 100, map[string]float64{"m.lowpriority": 0.5}),
+		newRoom("!favourite", 800, map[string]float64{PinnedTag: 0.1}),
+		newRoom("!work-first", 200, map[string]float64{"u.work": 0.2, "m.lowpriority": 0.9}),
+		newRoom("!low-no-order", 300, map[string]float64{"m.lowpriority": 1}),
+		newRoom("!low-no-order-recent", 400, map[string]float64{"m.lowpriority": 1}),
+	}
+	f := newFinder(rooms)
+
+	// the list only includes rooms with its tags, sorted by their order
+	sr := NewFilteredSortableRooms(f, listKey, f.roomIDs, &RequestFilters{Tags: []string{"m.lowpriority", "u.work"}})
+	if err := sr.Sort([]string{SortByTagOrder, SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!work-first", "!low-second", "!low-no-order-recent", "!low-no-order"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("Sort with tag filter: got %v want %v", sr.roomIDs, want)
+	}
+
+	// without tag filters, the order is left to the next comparator
+	sr = NewFilteredSortableRooms(f, listKey, f.roomIDs, nil)
+	if err := sr.Sort([]string{SortByTagOrder, SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want = []string{"!untagged", "!favourite", "!low-no-order-recent", "!low-no-order", "!work-first", "!low-second"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("Sort without tag filter: got %v want %v", sr.roomIDs, want)
+	}
+}
+
+func TestSortByActivityBeforeTS(t *testing.T) {
+	newRoom := func(roomID string, lastMessage uint64) *RoomConnMetadata {
+		return &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomID, LastMessageTimestamp: lastMessage},
+		}
+	}
+	rooms := []*RoomConnMetadata{
+		newRoom("!active-after", 5000),
+		newRoom("!active-before", 900),
+		newRoom("!never-active", 0),
+		newRoom("!active-both", 6000),
+		newRoom("!unloaded", 950),
+	}
+	f := newFinder(rooms)
+
+	// without a timestamp, sorts by the latest activity
+	sr := NewSortableRooms(f, "my_list", f.roomIDs)
+	if err := sr.Sort([]string{SortByActivityBeforeTS}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!active-both", "!active-after", "!unloaded", "!active-before", "!never-active"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("Sort without timestamp: got %v want %v", sr.roomIDs, want)
+	}
+
+	// with a timestamp, sorts by the activity at or before it. Rooms missing from the loaded
+	// activity fall back to their last message if it is before the timestamp.
+	sr.SetActivityBefore(1000, map[string]int64{
+		"!active-after":  100,
+		"!active-before": 900,
+		"!active-both":   800,
+	})
+	if err := sr.Sort([]string{SortByActivityBeforeTS}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want = []string{"!unloaded", "!active-before", "!active-both", "!active-after", "!never-active"}
+	if !reflect.DeepEqual(sr.roomIDs, want) {
+		t.Errorf("Sort with timestamp: got %v want %v", sr.roomIDs, want)
+	}
+}
+
+// Test that moving a single changed room gives the same order as sorting the whole list.
+func TestSortRoom(t *testing.T) {
+	const listKey = "my_list"
+	rng := rand.New(rand.NewSource(42))
+	randomise := func(r *RoomConnMetadata) {
+		r.HighlightCount = rng.Intn(3) / 2
+		r.NotificationCount = rng.Intn(3)
+		r.Encrypted = rng.Intn(2) == 0
+		r.LastInterestedEventTimestamps = map[string]uint64{listKey: uint64(rng.Intn(10))}
+	}
+	var rooms []*RoomConnMetadata
+	for i := 0; i < 50; i++ {
+		r := &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{RoomID: fmt.Sprintf("!%d:localhost", i)},
+		}
+		randomise(r)
+		rooms = append(rooms, r)
+	}
+	f := newFinder(rooms)
+	sortBy := []string{SortByNotificationLevel, SortByRecency}
+	incremental := NewSortableRooms(f, listKey, f.roomIDs)
+	if err := incremental.Sort(sortBy); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	for i := 0; i < 500; i++ {
+		changed := rooms[rng.Intn(len(rooms))]
+		randomise(changed)
+		// sorting the whole list from the same starting order is what SortRoom should match
+		full := NewSortableRooms(f, listKey, incremental.RoomIDs())
+		if err := full.Sort(sortBy); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if err := incremental.SortRoom(changed.RoomID, sortBy); err != nil {
+			t.Fatalf("SortRoom: %s", err)
+		}
+		if !reflect.DeepEqual(incremental.RoomIDs(), full.RoomIDs()) {
+			t.Fatalf("change %d to %s: SortRoom got %v, Sort got %v", i, changed.RoomID, incremental.RoomIDs(), full.RoomIDs())
+		}
+		for index, roomID := range full.RoomIDs() {
+			if got, _ := incremental.IndexOf(roomID); got != index {
+				t.Fatalf("change %d: IndexOf(%s) got %d want %d", i, roomID, got, index)
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package slidingsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// schemaNameRegex matches the names which can be used as a postgres schema without quoting.
+var schemaNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Tenant is one homeserver served by a multi-tenant proxy. Requests are routed to a tenant by
+// their Host header, and every tenant has its own pollers, caches and storage, so nothing is
+// shared between tenants except the process.
+type Tenant struct {
+	// Name identifies the tenant in metrics, and is the default DB schema.
+	Name string `json:"name"`
+	// Hosts are the hostnames clients use to reach this tenant. Ports are ignored.
+	Hosts []string `json:"hosts"`
+	// Server is the upstream homeserver, like SYNCV3_SERVER.
+	Server string `json:"server"`
+	// Secret encrypts this tenant's access tokens, like SYNCV3_SECRET.
+	Secret string `json:"secret"`
+	// OldSecrets are secrets which this tenant's access tokens were previously encrypted with, like
+	// SYNCV3_OLD_SECRETS.
+	OldSecrets []string `json:"old_secrets,omitempty"`
+	// DB is the postgres connection string. Defaults to the proxy's database.
+	DB string `json:"db,omitempty"`
+	// DBReplica is a read-only replica of DB for heavy reads, like SYNCV3_DB_REPLICA, which is not
+	// used by tenants.
+	DBReplica string `json:"db_replica,omitempty"`
+	// Schema is the postgres schema this tenant's data is stored in. Defaults to Name, so tenants
+	// which share a database are isolated from each other. Use "public" to keep the data of an
+	// existing single-tenant deployment.
+	Schema string `json:"schema,omitempty"`
+
+	// Limits for this tenant. Zero values use the proxy-wide limits.
+	MaxLongPollSecs          int    `json:"max_long_poll_secs,omitempty"`
+	MaxDBConns               int    `json:"max_db_conns,omitempty"`
+	AccountDataMaxUserBytes  string `json:"account_data_max_user_bytes,omitempty"`
+	AccountDataMaxEventBytes string `json:"account_data_max_event_bytes,omitempty"`
+	// CircuitBreakerThreshold is a pointer as 0 disables the circuit breaker.
+	CircuitBreakerThreshold *int `json:"circuit_breaker_threshold,omitempty"`
+}
+
+// Opts returns the options to set up this tenant with, applying its limits to the proxy-wide options.
+func (t Tenant) Opts(base Opts) (Opts, error) {
+	opts := base
+	opts.DBSchema = t.Schema
+	opts.DBReplica = t.DBReplica
+	opts.OldSecrets = t.OldSecrets
+	if t.MaxLongPollSecs > 0 {
+		opts.MaxLongPollTimeout = time.Duration(t.MaxLongPollSecs) * time.Second
+	}
+	if t.MaxDBConns > 0 {
+		opts.DBMaxConns = t.MaxDBConns
+	}
+	if t.AccountDataMaxUserBytes != "" || t.AccountDataMaxEventBytes != "" {
+		q, err := handler2.ParseAccountDataQuotas(t.AccountDataMaxUserBytes, t.AccountDataMaxEventBytes)
+		if err != nil {
+			return opts, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if t.AccountDataMaxUserBytes != "" {
+			opts.AccountDataQuotas.MaxUserBytes = q.MaxUserBytes
+		}
+		if t.AccountDataMaxEventBytes != "" {
+			opts.AccountDataQuotas.MaxEventBytes = q.MaxEventBytes
+			opts.AccountDataQuotas.MaxEventBytesByType = q.MaxEventBytesByType
+		}
+	}
+	if t.CircuitBreakerThreshold != nil {
+		if *t.CircuitBreakerThreshold < 0 {
+			return opts, fmt.Errorf("tenant %s: invalid circuit breaker threshold %d", t.Name, *t.CircuitBreakerThreshold)
+		}
+		opts.CircuitBreaker.FailureThreshold = *t.CircuitBreakerThreshold
+	}
+	return opts, nil
+}
+
+// LoadTenants reads a JSON array of tenants from a file, see ParseTenants.
+func LoadTenants(path, defaultDB string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTenants(data, defaultDB)
+}
+
+// ParseTenants parses and validates a JSON array of tenants, filling in the default DB and schema.
+// Tenants must not share hosts, nor store their data in the same schema of the same database.
+func ParseTenants(data []byte, defaultDB string) ([]Tenant, error) {
+	var tenants []Tenant
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&tenants); err != nil {
+		return nil, fmt.Errorf("invalid tenants: %w", err)
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no tenants configured")
+	}
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	storage := make(map[string]string)
+	for i := range tenants {
+		t := &tenants[i]
+		if !schemaNameRegex.MatchString(t.Name) {
+			return nil, fmt.Errorf("tenant %d: invalid name '%s', must be lowercase letters, digits and underscores", i, t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+		if t.Server == "" || t.Secret == "" {
+			return nil, fmt.Errorf("tenant %s: server and secret must be set", t.Name)
+		}
+		if len(t.Hosts) == 0 {
+			return nil, fmt.Errorf("tenant %s: no hosts", t.Name)
+		}
+		for _, host := range t.Hosts {
+			host = normaliseHost(host)
+			if other, ok := hosts[host]; ok {
+				return nil, fmt.Errorf("tenant %s: host '%s' is already used by tenant %s", t.Name, host, other)
+			}
+			hosts[host] = t.Name
+		}
+		if t.DB == "" {
+			t.DB = defaultDB
+		}
+		if t.DB == "" {
+			return nil, fmt.Errorf("tenant %s: no db, and no default db is set", t.Name)
+		}
+		if t.Schema == "" {
+			t.Schema = t.Name
+		}
+		if !schemaNameRegex.MatchString(t.Schema) {
+			return nil, fmt.Errorf("tenant %s: invalid schema '%s'", t.Name, t.Schema)
+		}
+		key := t.DB + "\x00" + t.Schema
+		if other, ok := storage[key]; ok {
+			return nil, fmt.Errorf("tenant %s: schema '%s' is already used by tenant %s in the same db", t.Name, t.Schema, other)
+		}
+		storage[key] = t.Name
+		if _, err := t.Opts(Opts{}); err != nil {
+			return nil, err
+		}
+	}
+	return tenants, nil
+}
+
+// TenantServer is a tenant which has been set up, see SetupTenant.
+type TenantServer struct {
+	Tenant  Tenant
+	H2      *handler2.Handler
+	Handler http.Handler
+	// Admin is served on the sync API under AdminPrefix, if set.
+	Admin http.Handler
+}
+
+// SetupTenant sets up the proxy for a single tenant. Metrics are labelled with the tenant's name,
+// so every tenant can register the same metrics. Tenants must be set up one at a time.
+func SetupTenant(t Tenant, base Opts) (TenantServer, error) {
+	opts, err := t.Opts(base)
+	if err != nil {
+		return TenantServer{}, err
+	}
+	if opts.AddPrometheusMetrics {
+		reg := prometheus.DefaultRegisterer
+		prometheus.DefaultRegisterer = prometheus.WrapRegistererWith(prometheus.Labels{"tenant": t.Name}, reg)
+		defer func() {
+			prometheus.DefaultRegisterer = reg
+		}()
+	}
+	logger.Info().Str("tenant", t.Name).Str("server", t.Server).Str("schema", t.Schema).Msg("setting up tenant")
+	h2, h3 := Setup(t.Server, t.DB, t.Secret, opts)
+	return TenantServer{Tenant: t, H2: h2, Handler: h3}, nil
+}
+
+// HostRouter routes requests to a handler based on their Host header.
+type HostRouter struct {
+	hosts map[string]http.Handler
+}
+
+func NewHostRouter() *HostRouter {
+	return &HostRouter{hosts: make(map[string]http.Handler)}
+}
+
+// Handle routes requests for any of these hosts to h. Returns an error if a host is already routed.
+func (hr *HostRouter) Handle(hosts []string, h http.Handler) error {
+	for _, host := range hosts {
+		host = normaliseHost(host)
+		if _, exists := hr.hosts[host]; exists {
+			return fmt.Errorf("host '%s' is already routed", host)
+		}
+		hr.hosts[host] = h
+	}
+	return nil
+}
+
+func (hr *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := hr.hosts[normaliseHost(req.Host)]
+	if !ok {
+		herr := internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("unknown host '%s'", req.Host),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// normaliseHost lowercases the host and removes any port and trailing dot.
+func normaliseHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// withSearchPath returns the postgres connection string with the search_path set to the schema,
+// for both URL and key/value connection strings.
+func withSearchPath(postgresURI, schema string) (string, error) {
+	if !schemaNameRegex.MatchString(schema) {
+		return "", fmt.Errorf("invalid schema '%s'", schema)
+	}
+	if strings.HasPrefix(postgresURI, "postgres://") || strings.HasPrefix(postgresURI, "postgresql://") {
+		u, err := url.Parse(postgresURI)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	return strings.TrimSpace(postgresURI) + " search_path=" + schema, nil
+}
@@ -0,0 +1,322 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// Test that the admin user dump includes what the proxy believes about a user's rooms,
+// unread counts, devices, pollers and connections.
+func TestAdminDumpUser(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+
+	roomID := "!admin-dump:localhost"
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					State: sync2.EventsResponse{
+						Events: createRoomState(t, alice, time.Now()),
+					},
+					Timeline: sync2.TimelineResponse{
+						Events: []json.RawMessage{
+							testutils.NewMessageEvent(t, alice, "hello"),
+						},
+					},
+					UnreadNotifications: sync2.UnreadNotifications{
+						NotificationCount: ptr(3),
+						HighlightCount:    ptr(1),
+					},
+				},
+			},
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		ConnID: "admin-dump",
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	})
+
+	admin := syncv3.NewAdminHandler(v3.h2, v3.handler)
+	dumpUser := func(userID string) (int, gjson.Result) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/admin/users/"+url.PathEscape(userID), nil)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code, gjson.ParseBytes(w.Body.Bytes())
+	}
+
+	check := func(field string, got, want interface{}) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s: got %v want %v", field, got, want)
+		}
+	}
+
+	code, dump := dumpUser(alice)
+	if code != http.StatusOK {
+		t.Fatalf("dump user: got HTTP %d want 200: %s", code, dump.Raw)
+	}
+	check("cache_loaded", dump.Get("cache_loaded").Bool(), true)
+	for _, section := range []string{"rooms", "stored_rooms"} {
+		room := dump.Get(section).Map()[roomID]
+		check(section+" joined", room.Get("joined").Bool(), true)
+		check(section+" notification_count", room.Get("notification_count").Int(), int64(3))
+		check(section+" highlight_count", room.Get("highlight_count").Int(), int64(1))
+		if room.Get("join_nid").Int() == 0 {
+			t.Errorf("%s: missing join_nid: %s", section, room.Raw)
+		}
+	}
+	check("num devices", len(dump.Get("devices").Array()), 1)
+	check("num pollers", len(dump.Get("pollers").Array()), 1)
+	check("poller terminated", dump.Get("pollers.0.terminated").Bool(), false)
+	check("num conns", len(dump.Get("conns").Array()), 1)
+	check("conn_id", dump.Get("conns.0.conn_id").Str, "admin-dump")
+
+	t.Log("Users the proxy has never seen have an empty dump.")
+	code, dump = dumpUser(bob)
+	if code != http.StatusOK {
+		t.Fatalf("dump user: got HTTP %d want 200: %s", code, dump.Raw)
+	}
+	check("bob cache_loaded", dump.Get("cache_loaded").Bool(), false)
+	check("bob stored_rooms", len(dump.Get("stored_rooms").Map()), 0)
+	check("bob pollers", len(dump.Get("pollers").Array()), 0)
+
+	t.Log("Invalid user IDs are rejected.")
+	code, _ = dumpUser("not-a-user")
+	check("invalid user ID status", code, http.StatusBadRequest)
+}
+
+// Test that the admin account data usage lists the users with the most account data.
+func TestAdminAccountDataUsage(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+
+	hog := "@account_data_hog:localhost"
+	hogToken := "ACCOUNT_DATA_HOG_TOKEN"
+	v2.AddAccount(t, hog, hogToken)
+	v2.QueueResponse(hog, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "com.example.bridge", map[string]interface{}{
+					"state": strings.Repeat("x", 100000),
+				}),
+			},
+		},
+	})
+	v3.mustDoV3Request(t, hogToken, sync3.Request{})
+
+	admin := syncv3.NewAdminHandler(v3.h2, v3.handler)
+	usage := func(query string) (int, gjson.Result) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/admin/account_data/usage"+query, nil)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code, gjson.ParseBytes(w.Body.Bytes())
+	}
+
+	code, res := usage("?limit=1")
+	if code != http.StatusOK {
+		t.Fatalf("account data usage: got HTTP %d want 200: %s", code, res.Raw)
+	}
+	users := res.Get("users").Array()
+	if len(users) != 1 {
+		t.Fatalf("account data usage: got %d users want 1: %s", len(users), res.Raw)
+	}
+	if users[0].Get("user_id").Str != hog || users[0].Get("bytes").Int() < 100000 || users[0].Get("num_events").Int() != 1 {
+		t.Errorf("account data usage: got %s want %s with 1 event over 100000 bytes", users[0].Raw, hog)
+	}
+
+	code, _ = usage("?limit=0")
+	if code != http.StatusBadRequest {
+		t.Errorf("invalid limit: got HTTP %d want 400", code)
+	}
+}
+
+// Test that the admin API lists pollers, and can stop them and make them initial sync again.
+func TestAdminPollers(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+
+	deviceID := "ADMIN_POLLERS_DEVICE"
+	v2.AddAccountWithDeviceID(alice, deviceID, aliceToken)
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	admin := syncv3.NewAdminHandler(v3.h2, v3.handler)
+	do := func(method, path string) (int, gjson.Result) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code, gjson.ParseBytes(w.Body.Bytes())
+	}
+	pollerPath := "/admin/pollers/" + url.PathEscape(alice) + "/" + deviceID
+
+	code, body := do("GET", "/admin/pollers?user_id="+url.QueryEscape(alice))
+	if code != http.StatusOK {
+		t.Fatalf("list pollers: got HTTP %d want 200: %s", code, body.Raw)
+	}
+	pollers := body.Get("pollers").Array()
+	if len(pollers) != 1 || pollers[0].Get("user_id").Str != alice || pollers[0].Get("device_id").Str != deviceID {
+		t.Fatalf("list pollers: got %s", body.Raw)
+	}
+	code, body = do("GET", "/admin/pollers?user_id="+url.QueryEscape("@nobody:localhost"))
+	if code != http.StatusOK || !body.Get("pollers").IsArray() || len(body.Get("pollers").Array()) != 0 {
+		t.Errorf("list pollers for an unknown user: got HTTP %d %s", code, body.Raw)
+	}
+	code, _ = do("GET", "/admin/pollers?user_id=alice")
+	if code != http.StatusBadRequest {
+		t.Errorf("invalid user_id: got HTTP %d want 400", code)
+	}
+
+	// stopping the poller doesn't expire the token, so the next request starts it again
+	code, body = do("DELETE", pollerPath)
+	if code != http.StatusOK {
+		t.Fatalf("stop poller: got HTTP %d want 200: %s", code, body.Raw)
+	}
+	code, _ = do("DELETE", pollerPath)
+	if code != http.StatusNotFound {
+		t.Errorf("stop stopped poller: got HTTP %d want 404", code)
+	}
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	code, body = do("GET", "/admin/pollers?user_id="+url.QueryEscape(alice))
+	if code != http.StatusOK || len(body.Get("pollers").Array()) != 1 || body.Get("pollers.0.terminated").Bool() {
+		t.Errorf("poller was not restarted: got HTTP %d %s", code, body.Raw)
+	}
+
+	// a resync restarts the poller from no since token
+	var sinces []string
+	var mu sync.Mutex
+	v2.SetCheckRequest(func(token string, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sinces = append(sinces, req.URL.Query().Get("since"))
+	})
+	v2.QueueResponse(alice, sync2.SyncResponse{NextBatch: "after_resync"})
+	code, body = do("POST", pollerPath+"/resync")
+	if code != http.StatusAccepted {
+		t.Fatalf("resync: got HTTP %d want 202: %s", code, body.Raw)
+	}
+	polled := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sinces) > 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); !polled(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("resync: poller did not poll")
+		}
+	}
+	mu.Lock()
+	if sinces[0] != "" {
+		t.Errorf("resync: first poll had since=%q want none", sinces[0])
+	}
+	mu.Unlock()
+
+	code, _ = do("POST", "/admin/pollers/"+url.PathEscape(alice)+"/UNKNOWN/resync")
+	if code != http.StatusNotFound {
+		t.Errorf("resync unknown device: got HTTP %d want 404", code)
+	}
+	code, _ = do("DELETE", pollerPath+"/since")
+	if code != http.StatusOK {
+		t.Errorf("reset since: got HTTP %d want 200", code)
+	}
+}
+
+// Test that the admin API exports everything stored about a user, and erases it.
+func TestAdminExportAndEraseUser(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+
+	userID := "@admin_erase:localhost"
+	token := "ADMIN_ERASE_TOKEN"
+	v2.AddAccount(t, userID, token)
+	v2.QueueResponse(userID, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{
+				testutils.NewAccountData(t, "com.example.erase", map[string]interface{}{"erase": "me"}),
+			},
+		},
+	})
+	v3.mustDoV3Request(t, token, sync3.Request{})
+
+	admin := syncv3.NewAdminHandler(v3.h2, v3.handler)
+	do := func(method, path string) (int, gjson.Result) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code, gjson.ParseBytes(w.Body.Bytes())
+	}
+	userPath := "/admin/users/" + url.PathEscape(userID)
+
+	code, body := do("GET", userPath+"/export")
+	if code != http.StatusOK {
+		t.Fatalf("export: got HTTP %d want 200: %s", code, body.Raw)
+	}
+	for _, table := range []string{"syncv3_sync2_devices", "syncv3_sync2_tokens", "syncv3_account_data"} {
+		if n := len(body.Get("tables." + table).Array()); n != 1 {
+			t.Errorf("export: got %d rows in %s want 1: %s", n, table, body.Raw)
+		}
+	}
+	if got := body.Get("tables.syncv3_account_data.0.data.content.erase").Str; got != "me" {
+		t.Errorf("export: got account data %s", body.Get("tables.syncv3_account_data").Raw)
+	}
+	if strings.Contains(body.Raw, token) {
+		t.Errorf("export includes the access token: %s", body.Raw)
+	}
+
+	code, body = do("DELETE", userPath)
+	if code != http.StatusOK {
+		t.Fatalf("erase: got HTTP %d want 200: %s", code, body.Raw)
+	}
+	if body.Get("devices").Int() != 1 {
+		t.Errorf("erase: got %s want 1 device", body.Raw)
+	}
+	code, body = do("GET", userPath+"/export")
+	if code != http.StatusOK {
+		t.Fatalf("export after erase: got HTTP %d want 200: %s", code, body.Raw)
+	}
+	body.Get("tables").ForEach(func(table, rows gjson.Result) bool {
+		if len(rows.Array()) != 0 {
+			t.Errorf("export after erase: got rows in %s: %s", table.Str, rows.Raw)
+		}
+		return true
+	})
+	if v3.handler.CacheForUser(userID) != nil {
+		t.Errorf("erase: user cache was not evicted")
+	}
+
+	code, _ = do("GET", "/admin/users/alice/export")
+	if code != http.StatusBadRequest {
+		t.Errorf("invalid user ID: got HTTP %d want 400", code)
+	}
+}
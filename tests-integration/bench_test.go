@@ -35,7 +35,7 @@ func benchNumV2Rooms(numRooms int, b *testing.B) {
 	v2 := runTestV2Server(b)
 	v3 := runTestServer(b, v2, pqString)
 	zerolog.SetGlobalLevel(zerolog.Disabled)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	allRooms := make([]roomEvents, numRooms)
 	for i := 0; i < len(allRooms); i++ {
@@ -52,8 +52,8 @@ func benchNumV2Rooms(numRooms int, b *testing.B) {
 			}...),
 		}
 	}
-	v2.addAccount(b, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(b, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
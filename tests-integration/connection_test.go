@@ -24,10 +24,10 @@ func TestMultipleConnsAtStartup(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	var res *sync3.Response
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -50,12 +50,12 @@ func TestMultipleConnsAtStartup(t *testing.T) {
 		}
 	}()
 	// wait until the proxy is waiting on v2. As this is the initial sync, we won't have a conn yet.
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	// interrupt the connection
 	cancel()
 	wg.Wait()
 	// respond to sync v2
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -95,7 +95,7 @@ func TestOutstandingRequestsGetCancelled(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// Rooms A,B gets sent to the client initially, then we will send a 2nd blocking request with a 3s timeout.
 	// During this time, we will send a 3rd request with modified sort operations to ensure that the proxy can
@@ -104,8 +104,8 @@ func TestOutstandingRequestsGetCancelled(t *testing.T) {
 	// failing the test.
 	roomA := "!a:localhost" // name is A, older timestamp
 	roomB := "!b:localhost" // name is B, newer timestamp
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomA,
@@ -202,15 +202,15 @@ func TestConnectionTimeoutNotReset(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// One room gets sent v2 updates, one room does not. Room B gets updates, which, because
 	// we are tracking alphabetically, causes those updates to not trigger a v3 response. This
 	// used to reset the timeout though, so we will check to make sure it doesn't.
 	roomA := "!a:localhost"
 	roomB := "!b:localhost"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomA,
@@ -264,7 +264,7 @@ func TestConnectionTimeoutNotReset(t *testing.T) {
 				break
 			}
 			t.Logf("sending update")
-			v2.queueResponse(alice, sync2.SyncResponse{
+			v2.QueueResponse(alice, sync2.SyncResponse{
 				Rooms: sync2.SyncRoomsResponse{
 					Join: v2JoinTimeline(roomEvents{
 						roomID: roomB,
@@ -292,18 +292,81 @@ func TestConnectionTimeoutNotReset(t *testing.T) {
 	<-done
 }
 
+// Test that long polls are cut short with a keepalive response, so load balancers with short idle
+// timeouts don't kill them, but responses with data are never marked as keepalives.
+func TestConnectionKeepalive(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		KeepaliveInterval: 200 * time.Millisecond,
+	})
+	defer v2.Close()
+	defer v3.close()
+	roomID := "!keepalive:localhost"
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				state:  createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	if res.Keepalive {
+		t.Fatalf("initial response was marked as a keepalive")
+	}
+
+	req.SetTimeoutMSecs(10000)
+	startTime := time.Now()
+	pos := res.Pos
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, pos, req)
+	if dur := time.Since(startTime); dur > 2*time.Second {
+		t.Fatalf("request took %v to complete, expected ~200ms", dur)
+	}
+	if !res.Keepalive {
+		t.Fatalf("empty response after the keepalive interval was not marked as a keepalive")
+	}
+	if res.Pos != pos {
+		t.Fatalf("keepalive response changed the pos from %s to %s", pos, res.Pos)
+	}
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(nil))
+
+	// new data before the keepalive interval is a normal response
+	msg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"})
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{msg},
+			}),
+		},
+	})
+	v2.WaitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Keepalive {
+		t.Fatalf("response with data was marked as a keepalive")
+	}
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{msg})))
+}
+
 // Test that the txn_id is echoed back
 func TestTxnIDEcho(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 	txnID := "hi"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{})
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{})
 
 	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
 		TxnID: txnID,
@@ -349,13 +412,13 @@ func TestTxnIDResponseBuffering(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomA := "!a:localhost"
 	roomB := "!b:localhost"
 	roomC := "!c:localhost"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomA,
@@ -456,15 +519,15 @@ func TestEnsurePollingDoesntQueue(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	// setup code
 	v2 := runTestV2Server(t)
-	v2.timeToWaitForV2Response = 5 * time.Second
+	v2.TimeToWaitForV2Response = 5 * time.Second
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomA := "!a:localhost"
 	roomB := "!b:localhost"
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomB,
@@ -480,7 +543,7 @@ func TestEnsurePollingDoesntQueue(t *testing.T) {
 	// wait until alice makes the v2 /sync request, then start bob's v3 request
 	go func() {
 		t.Logf("waiting for alice's v2 poller to start")
-		v2.waitUntilEmpty(t, alice) // alice's poller is making the v2 request
+		v2.WaitUntilEmpty(t, alice) // alice's poller is making the v2 request
 		t.Logf("alice's v2 poller is waiting, doing bob's v3 request")
 		startTime := time.Now()
 		res := v3.mustDoV3Request(t, bobToken, sync3.Request{ // start bob's v3 request
@@ -507,7 +570,7 @@ func TestEnsurePollingDoesntQueue(t *testing.T) {
 		}))
 		// now send alice's response to unblock her
 		t.Logf("sending alice's v2 response")
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(roomEvents{
 					roomID: roomA,
@@ -543,7 +606,7 @@ func TestEnsurePollingDoesntQueue(t *testing.T) {
 func TestSessionExpiry(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	v3 := runTestServer(t, v2, pqString)
 	roomID := "!doesnt:matter"
 	res1 := v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -572,8 +635,8 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 	maxPendingEventUpdates := 3
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -609,7 +672,7 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 			"body":    fmt.Sprintf("Test %d", i),
 		}, testutils.WithTimestamp(time.Now().Add(time.Duration(i)*time.Second)))
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -617,7 +680,7 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
 	if code != 400 {
@@ -645,7 +708,7 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 func TestExpiredAccessToken(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	v3 := runTestServer(t, v2, pqString)
 	roomID := "!doesnt:matter"
 	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -656,7 +719,7 @@ func TestExpiredAccessToken(t *testing.T) {
 		},
 	})
 	// now expire the token
-	v2.invalidateToken(aliceToken)
+	v2.InvalidateToken(aliceToken)
 	// now do another request, this should 401
 	req := sync3.Request{}
 	req.SetTimeoutMSecs(1)
@@ -669,7 +732,7 @@ func TestExpiredAccessToken(t *testing.T) {
 func TestExpiredAccessTokenMultipleConns(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	v3 := runTestServer(t, v2, pqString)
 	roomID := "!doesnt:matter"
 	resA := v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -689,7 +752,7 @@ func TestExpiredAccessTokenMultipleConns(t *testing.T) {
 		},
 	})
 	// now expire the token
-	v2.invalidateToken(aliceToken)
+	v2.InvalidateToken(aliceToken)
 	// now do another request for each conn, this should 401
 	testCases := []struct {
 		ConnID string
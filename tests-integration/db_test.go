@@ -25,7 +25,7 @@ func TestMaxDBConns(t *testing.T) {
 		DBMaxConns: 1,
 	}
 	v3 := runTestServer(t, v2, pqString, opts)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	testMaxDBConns := func() {
@@ -39,9 +39,9 @@ func TestMaxDBConns(t *testing.T) {
 				userID := fmt.Sprintf("@maxconns_%d:localhost", n)
 				token := fmt.Sprintf("maxconns_%d", n)
 				roomID := fmt.Sprintf("!maxconns_%d", n)
-				v2.addAccount(t, userID, token)
+				v2.AddAccount(t, userID, token)
 				state := createRoomState(t, userID, time.Now())
-				v2.queueResponse(userID, sync2.SyncResponse{
+				v2.QueueResponse(userID, sync2.SyncResponse{
 					Rooms: sync2.SyncRoomsResponse{
 						Join: v2JoinTimeline(roomEvents{
 							roomID: roomID,
@@ -76,7 +76,7 @@ func TestMaxDBConns(t *testing.T) {
 					"msgtype": "m.text",
 					"body":    "drip drip",
 				})
-				v2.queueResponse(userID, sync2.SyncResponse{
+				v2.QueueResponse(userID, sync2.SyncResponse{
 					Rooms: sync2.SyncRoomsResponse{
 						Join: v2JoinTimeline(roomEvents{
 							roomID: roomID,
@@ -87,7 +87,7 @@ func TestMaxDBConns(t *testing.T) {
 					},
 				})
 				t.Logf("user %s has queued the drip", userID)
-				v2.waitUntilEmpty(t, userID)
+				v2.WaitUntilEmpty(t, userID)
 				t.Logf("user %s poller has received the drip", userID)
 				res = v3.mustDoV3RequestWithPos(t, token, res.Pos, sync3.Request{})
 				m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
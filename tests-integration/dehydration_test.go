@@ -0,0 +1,59 @@
+package syncv3
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+)
+
+// Test that MSC3814 dehydrated device requests are passed through to the upstream unmodified, so
+// clients can upload a dehydrated device and fetch its to-device messages via the proxy.
+func TestDehydratedDevicePassthrough(t *testing.T) {
+	eventsPath := syncv3.DehydratedDevicePrefix + "/DEHYDRATED/events"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.Method != "POST" || req.URL.Path != eventsPath || req.Header.Get("Authorization") != "Bearer "+aliceToken {
+			t.Errorf("upstream got %s %s with auth %q", req.Method, req.URL.Path, req.Header.Get("Authorization"))
+		}
+		if string(body) != `{"next_batch":"abc"}` {
+			t.Errorf("upstream got body %s", string(body))
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"events":[],"next_batch":"def"}`))
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(syncv3.NewDehydratedDeviceHandler(upstream.URL))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("POST", proxy.URL+eventsPath, strings.NewReader(`{"next_batch":"abc"}`))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != `{"events":[],"next_batch":"def"}` {
+		t.Fatalf("got HTTP %d %s", res.StatusCode, string(body))
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("upstream CORS header was not removed: %s", got)
+	}
+
+	// the upstream being down is a 502, not a hanging request
+	upstream.Close()
+	res, err = http.Post(proxy.URL+syncv3.DehydratedDevicePrefix, "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got HTTP %d want 502", res.StatusCode)
+	}
+}
@@ -22,7 +22,7 @@ func TestExtensionE2EE(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	// check that OTK counts / fallback key types go through
@@ -31,8 +31,8 @@ func TestExtensionE2EE(t *testing.T) {
 		"signed_curve25519": 100,
 	}
 	fallbackKeyTypes := []string{"signed_curve25519"}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceListsOTKCount:          otkCounts,
 		DeviceUnusedFallbackKeyTypes: fallbackKeyTypes,
 	})
@@ -62,7 +62,7 @@ func TestExtensionE2EE(t *testing.T) {
 
 	// check that OTK counts / fallback key types aren't present afterwards as they haven't changed.
 	// Do this by feeding in a new joined room
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!doesnt-matter",
@@ -71,7 +71,7 @@ func TestExtensionE2EE(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -87,10 +87,10 @@ func TestExtensionE2EE(t *testing.T) {
 		"curve25519":        99,
 		"signed_curve25519": 999,
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceListsOTKCount: otkCounts,
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -103,7 +103,7 @@ func TestExtensionE2EE(t *testing.T) {
 	// check that changed|left get passed to v3
 	wantChanged := []string{"bob"}
 	wantLeft := []string{"charlie"}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceLists: struct {
 			Changed []string `json:"changed,omitempty"`
 			Left    []string `json:"left,omitempty"`
@@ -112,7 +112,7 @@ func TestExtensionE2EE(t *testing.T) {
 			Left:    wantLeft,
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	lastPos := res.Pos
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -147,7 +147,7 @@ func TestExtensionE2EE(t *testing.T) {
 
 	// check that changed|left do *not* persist once consumed (advanced v3 position). This requires
 	// another poke so we don't wait until up to the timeout value in tests
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!doesnt-matter2",
@@ -156,7 +156,7 @@ func TestExtensionE2EE(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -177,10 +177,10 @@ func TestExtensionE2EE(t *testing.T) {
 		"curve25519":        42,
 		"signed_curve25519": 420,
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceListsOTKCount: otkCounts,
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	req := sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -197,7 +197,7 @@ func TestExtensionE2EE(t *testing.T) {
 	}
 
 	// check that if we lose a device list update and restart from nothing, we see the same update
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceLists: struct {
 			Changed []string `json:"changed,omitempty"`
 			Left    []string `json:"left,omitempty"`
@@ -206,7 +206,7 @@ func TestExtensionE2EE(t *testing.T) {
 			Left:    wantLeft,
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -238,7 +238,7 @@ func TestExtensionE2EE(t *testing.T) {
 	m.MatchResponse(t, res, m.MatchDeviceLists(wantChanged, wantLeft))
 
 	// check that empty lists aren't serialised as null
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		DeviceLists: struct {
 			Changed []string `json:"changed,omitempty"`
 			Left    []string `json:"left,omitempty"`
@@ -246,7 +246,7 @@ func TestExtensionE2EE(t *testing.T) {
 			Changed: wantChanged,
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -277,18 +277,18 @@ func TestExtensionToDevice(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	alice := "@TestExtensionToDevice_alice:localhost"
 	aliceToken := "ALICE_BEARER_TOKEN_TestExtensionToDevice"
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	toDeviceMsgs := []json.RawMessage{
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"1"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"2"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"3"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"4"}}`),
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		ToDevice: sync2.EventsResponse{
 			Events: toDeviceMsgs,
 		},
@@ -346,12 +346,12 @@ func TestExtensionToDevice(t *testing.T) {
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"5"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"6"}}`),
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		ToDevice: sync2.EventsResponse{
 			Events: newToDeviceMsgs,
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
 			Ranges: sync3.SliceRanges{
@@ -418,7 +418,7 @@ func TestExtensionToDevice(t *testing.T) {
 	go func() {
 		time.Sleep(500 * time.Millisecond)
 		t.Logf("sending to-device msgs %v", time.Now())
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			ToDevice: sync2.EventsResponse{
 				Events: newToDeviceMsgs,
 			},
@@ -452,18 +452,18 @@ func TestExtensionToDeviceSequence(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	alice := "@TestExtensionToDeviceSequence_alice:localhost"
 	aliceToken := "ALICE_BEARER_TOKEN_TestExtensionToDeviceSequence"
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	toDeviceMsgs := []json.RawMessage{
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"1"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"2"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"3"}}`),
 		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"4"}}`),
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		ToDevice: sync2.EventsResponse{
 			Events: toDeviceMsgs,
 		},
@@ -508,7 +508,7 @@ func TestExtensionAccountData(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	alice := "@alice:localhost"
 	aliceToken := "ALICE_BEARER_TOKEN"
@@ -531,8 +531,8 @@ func TestExtensionAccountData(t *testing.T) {
 		testutils.NewAccountData(t, "im-c", map[string]interface{}{"body": "yep c"}),
 		testutils.NewAccountData(t, "im-also-c", map[string]interface{}{"body": "yep C"}),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		AccountData: sync2.EventsResponse{
 			Events: globalAccountData,
 		},
@@ -629,12 +629,12 @@ func TestExtensionAccountData(t *testing.T) {
 
 	// 2- check global account data updates are proxied through
 	newGlobalEvent := testutils.NewAccountData(t, "new_fun_event", map[string]interface{}{"much": "excite"})
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		AccountData: sync2.EventsResponse{
 			Events: []json.RawMessage{newGlobalEvent},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 	m.MatchResponse(t, res, m.MatchAccountData(
 		[]json.RawMessage{newGlobalEvent},
@@ -659,7 +659,7 @@ func TestExtensionAccountData(t *testing.T) {
 		}},
 	})
 	// bump C to position 0
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomC,
@@ -672,7 +672,7 @@ func TestExtensionAccountData(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	// now we should get room account data for C
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -695,11 +695,11 @@ func TestExtensionLateEnable(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!doesnt-matter2",
@@ -731,13 +731,13 @@ func TestTypingMultiplePoller(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	roomA := "!a:localhost"
 
-	v2.addAccountWithDeviceID(alice, "first", aliceToken)
-	v2.addAccountWithDeviceID(bob, "second", bobToken)
+	v2.AddAccountWithDeviceID(alice, "first", aliceToken)
+	v2.AddAccountWithDeviceID(bob, "second", bobToken)
 
 	// Create the room state and join with Bob
 	roomState := createRoomState(t, alice, time.Now())
@@ -746,7 +746,7 @@ func TestTypingMultiplePoller(t *testing.T) {
 	})
 
 	// Queue the response with Alice typing
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomA: {
@@ -765,7 +765,7 @@ func TestTypingMultiplePoller(t *testing.T) {
 	})
 
 	// Queue another response for Bob with Bob typing.
-	v2.queueResponse(bobToken, sync2.SyncResponse{
+	v2.QueueResponse(bobToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomA: {
@@ -822,7 +822,7 @@ func TestTypingMultiplePoller(t *testing.T) {
 	}
 
 	// Queue the response with Bob typing
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomA: {
@@ -843,7 +843,7 @@ func TestTypingMultiplePoller(t *testing.T) {
 	// Queue another response for Bob with Charlie typing.
 	// Since Alice's poller is in charge of handling typing notifications, this shouldn't
 	// show up on future responses.
-	v2.queueResponse(bobToken, sync2.SyncResponse{
+	v2.QueueResponse(bobToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomA: {
@@ -862,8 +862,8 @@ func TestTypingMultiplePoller(t *testing.T) {
 	})
 
 	// Wait for the queued responses to be processed.
-	v2.waitUntilEmpty(t, aliceToken)
-	v2.waitUntilEmpty(t, bobToken)
+	v2.WaitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, bobToken)
 
 	// Check that only Bob is typing and not Charlie.
 	for _, token := range []string{aliceToken, bobToken} {
@@ -200,7 +200,7 @@ func TestFiltersInvite(t *testing.T) {
 	))
 
 	t.Log("Alice accepts the invite.")
-	rig.V2.queueResponse(alice, sync2.SyncResponse{
+	rig.V2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -521,7 +521,7 @@ func TestFiltersTags(t *testing.T) {
 	})
 
 	// now nuke it by removing the tag
-	rig.V2.queueResponse(alice, sync2.SyncResponse{
+	rig.V2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				fav1RoomID: {
@@ -534,7 +534,7 @@ func TestFiltersTags(t *testing.T) {
 			},
 		},
 	})
-	rig.V2.waitUntilEmpty(t, alice)
+	rig.V2.WaitUntilEmpty(t, alice)
 
 	// we should see DELETEs
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
@@ -578,7 +578,7 @@ func TestFiltersTags(t *testing.T) {
 	)))
 
 	// remove a fav, it should move to the other list
-	rig.V2.queueResponse(alice, sync2.SyncResponse{
+	rig.V2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				fav2RoomID: {
@@ -593,7 +593,7 @@ func TestFiltersTags(t *testing.T) {
 			},
 		},
 	})
-	rig.V2.waitUntilEmpty(t, alice)
+	rig.V2.WaitUntilEmpty(t, alice)
 	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{
 			"fav": {
@@ -16,14 +16,14 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	const nigel = "@nigel:localhost"
 	roomID := "!unimportant"
 
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
 
 	// Bob creates a room. Nigel and Alice join.
 	state := createRoomState(t, bob, time.Now())
@@ -35,7 +35,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 	})
 
 	t.Log("Alice and Bob's pollers sees Alice's join.")
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -45,7 +45,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "alice_sync_1",
 	})
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -85,7 +85,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 	m.MatchResponse(t, bobRes, m.MatchRoomSubscription(roomID, m.MatchRoomTimeline([]json.RawMessage{aliceJoin})))
 
 	t.Log("Alice ignores Nigel.")
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		AccountData: sync2.EventsResponse{
 			Events: []json.RawMessage{
 				testutils.NewAccountData(t, "m.ignored_user_list", map[string]any{
@@ -97,12 +97,12 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "alice_sync_2",
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	t.Log("Bob's poller sees a message from Nigel, then a message from Alice.")
 	nigelMsg := testutils.NewMessageEvent(t, nigel, "naughty nigel")
 	aliceMsg := testutils.NewMessageEvent(t, alice, "angelic alice")
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -111,7 +111,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "bob_sync_2",
 	})
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Bob syncs. He should see both messages.")
 	bobRes = v3.mustDoV3RequestWithPos(t, bobToken, bobRes.Pos, sync3.Request{})
@@ -123,7 +123,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 
 	t.Log("Bob's poller sees Nigel set a custom state event")
 	nigelState := testutils.NewStateEvent(t, "com.example.fruit", "banana", nigel, map[string]any{})
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -132,7 +132,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "bob_sync_3",
 	})
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Alice syncs. She should see Nigel's state event.")
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
@@ -141,7 +141,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 	t.Log("Bob's poller sees Alice send a message.")
 	aliceMsg2 := testutils.NewMessageEvent(t, alice, "angelic alice 2")
 
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -150,7 +150,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "bob_sync_4",
 	})
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Alice syncs, making a new conn with a direct room subscription.")
 	aliceRes = v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -170,7 +170,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 	nigelMsg2 := testutils.NewMessageEvent(t, nigel, "naughty nigel 3")
 	aliceMsg3 := testutils.NewMessageEvent(t, alice, "angelic alice 3")
 
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -179,7 +179,7 @@ func TestIgnoredUsersDuringLiveUpdate(t *testing.T) {
 		},
 		NextBatch: "bob_sync_5",
 	})
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Alice syncs. She should only see her message.")
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
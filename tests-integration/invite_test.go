@@ -16,7 +16,7 @@ func TestStuckInvites(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	preSyncInviteRoomID := "!pre:localhost"
@@ -27,8 +27,8 @@ func TestStuckInvites(t *testing.T) {
 		"membership": "invite",
 	}))
 
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Invite: map[string]sync2.SyncV2InviteResponse{
 				preSyncInviteRoomID: {
@@ -60,7 +60,7 @@ func TestStuckInvites(t *testing.T) {
 	inviteState2 = append(inviteState2, testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{
 		"membership": "invite",
 	}))
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Invite: map[string]sync2.SyncV2InviteResponse{
 				postSyncInviteRoomID: {
@@ -71,7 +71,7 @@ func TestStuckInvites(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{
@@ -96,7 +96,7 @@ func TestStuckInvites(t *testing.T) {
 			"membership": "invite",
 		},
 	}))
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: preSyncInviteRoomID,
@@ -108,7 +108,7 @@ func TestStuckInvites(t *testing.T) {
 				}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// the entries are removed
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
@@ -0,0 +1,60 @@
+package syncv3
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+)
+
+func TestListen(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "syncv3.sock")
+	// a stale socket file from a previous run is replaced
+	if err := os.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatalf("failed to create stale socket file: %s", err)
+	}
+	for _, addr := range []string{socketPath, "127.0.0.1:0"} {
+		listener, err := syncv3.Listen(addr)
+		if err != nil {
+			t.Fatalf("Listen(%s): %s", addr, err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial %s: %s", addr, err)
+		}
+		conn.Close()
+	}
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %s", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0222 {
+		t.Errorf("unix socket has mode %v, want a socket with -w--w--w-", info.Mode())
+	}
+}
+
+// Test that sockets for unauthenticated endpoints can be restricted to the proxy's user.
+func TestListenWithMode(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := syncv3.ListenWithMode(socketPath, 0600)
+	if err != nil {
+		t.Fatalf("ListenWithMode(%s): %s", socketPath, err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %s", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("unix socket has mode %v, want a socket with -rw-------", info.Mode())
+	}
+}
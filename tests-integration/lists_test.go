@@ -73,7 +73,7 @@ func TestUnreadCountMisordering(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// Create 3 rooms with the following order, sorted by notification level
 	// - A [1 unread count] most recent
@@ -115,8 +115,8 @@ func TestUnreadCountMisordering(t *testing.T) {
 			notifCount: &info.notifCount,
 		})
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(re...),
 		},
@@ -135,7 +135,7 @@ func TestUnreadCountMisordering(t *testing.T) {
 	))) // A,B,C SYNC
 
 	// Then send a new event in C -> [A,C,B]   DELETE 2, INSERT 1 C
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomC,
@@ -145,14 +145,14 @@ func TestUnreadCountMisordering(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
 		m.MatchV3DeleteOp(2), m.MatchV3InsertOp(1, roomC),
 	)))
 
 	// Then send unread count in C++ -> [C,A,B] DELETE 1, INSERT 0 C // this might be suppressed
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID:     roomC,
@@ -160,11 +160,11 @@ func TestUnreadCountMisordering(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	// Then send something unrelated which will cause a resort. This will cause a desync in lists between client/server.
 	// This is unrelated because it doesn't affect sort position: B has same timestamp
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomB,
@@ -174,10 +174,10 @@ func TestUnreadCountMisordering(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	// Then send unread count in C-- -> [A,C,B]  <-- this ends up being DEL 0, INS 1 C which is just wrong if we suppressed earlier.
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID:     roomC,
@@ -185,7 +185,7 @@ func TestUnreadCountMisordering(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
@@ -270,12 +270,12 @@ func TestBumpEventTypesOnStartup(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	t.Log("Prepare to tell the proxy about three rooms and events in them.")
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(r1, r2, r3),
 		},
@@ -294,7 +294,7 @@ func TestBumpEventTypesOnStartup(t *testing.T) {
 	})
 
 	// Confirm that the poller polled.
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("The proxy restarts.")
 	v3.restart(t, v2, pqString)
@@ -429,7 +429,7 @@ func testDeleteMSC4115Field(t *testing.T, fieldName string) {
 	if err != nil {
 		t.Fatalf("failed to delete unsigned.membership field")
 	}
-	rig.V2.queueResponse(alice, sync2.SyncResponse{
+	rig.V2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -438,7 +438,7 @@ func testDeleteMSC4115Field(t *testing.T, fieldName string) {
 			}),
 		},
 	})
-	rig.V2.waitUntilEmpty(t, alice)
+	rig.V2.WaitUntilEmpty(t, alice)
 
 	// sending v2 state invalidates the SS connection so start again pre-emptively.
 	res = rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -458,3 +458,62 @@ func testDeleteMSC4115Field(t *testing.T, fieldName string) {
 		},
 	}))
 }
+
+// Test that by_pinned holds m.favourite rooms at the top of the list in tag order, and that
+// removing the tag moves the room back into its recency position.
+func TestListsSortByPinned(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	pinnedFirst := "!TestListsSortByPinned_first:localhost"
+	pinnedSecond := "!TestListsSortByPinned_second:localhost"
+	unpinned := "!TestListsSortByPinned_unpinned:localhost"
+	rig.SetupV2RoomsForUser(t, alice, Flush, map[string]RoomDescriptor{
+		pinnedFirst:  {Tags: map[string]float64{"m.favourite": 0.1}},
+		pinnedSecond: {Tags: map[string]float64{"m.favourite": 0.2}},
+		unpinned:     {},
+	})
+	aliceToken := rig.Token(alice)
+	// make the unpinned room the most recent, then pinnedFirst
+	rig.FlushText(t, alice, pinnedFirst, "first")
+	rig.FlushText(t, alice, unpinned, "unpinned")
+
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Sort:   []string{sync3.SortByPinned, sync3.SortByRecency},
+			},
+		},
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 2, []string{pinnedFirst, pinnedSecond, unpinned}),
+	)))
+
+	// new messages in the unpinned room don't move it above pinned rooms
+	rig.FlushText(t, alice, unpinned, "still unpinned")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops()))
+
+	// unpinning the first room moves it below the more recent unpinned room
+	rig.V2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				pinnedFirst: {
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{
+							testutils.NewAccountData(t, "m.tag", map[string]interface{}{
+								"tags": map[string]interface{}{},
+							}),
+						},
+					},
+				},
+			},
+		},
+	})
+	rig.V2.WaitUntilEmpty(t, alice)
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3DeleteOp(0), m.MatchV3InsertOp(2, pinnedFirst),
+	)))
+}
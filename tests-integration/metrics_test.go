@@ -63,15 +63,15 @@ func TestMetricsNumPollers(t *testing.T) {
 	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
 		AddPrometheusMetrics: true,
 	})
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	metricsServer := runMetricsServer(t)
 	defer metricsServer.Close()
 	metrics := getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "0")
 	// start a poller
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -84,8 +84,8 @@ func TestMetricsNumPollers(t *testing.T) {
 	metrics = getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "1")
 	// start another poller
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -98,7 +98,7 @@ func TestMetricsNumPollers(t *testing.T) {
 	metrics = getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "2")
 	// now invalidate a poller
-	v2.invalidateToken(aliceToken)
+	v2.InvalidateToken(aliceToken)
 	// verify decrease
 	metrics = getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "1")
@@ -112,15 +112,15 @@ func TestMetricsNumConns(t *testing.T) {
 	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
 		AddPrometheusMetrics: true,
 	})
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	metricsServer := runMetricsServer(t)
 	defer metricsServer.Close()
 	metrics := getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "0")
 	// start a poller
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -133,8 +133,8 @@ func TestMetricsNumConns(t *testing.T) {
 	metrics = getMetrics(t, metricsServer)
 	assertMetric(t, metrics, metricKey, "1")
 	// start another poller
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -18,7 +18,7 @@ func TestNotificationsOnTop(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	bob := "@TestNotificationsOnTop_bob:localhost"
 	bingRoomID := "!TestNotificationsOnTop_bing:localhost"
@@ -45,8 +45,8 @@ func TestNotificationsOnTop(t *testing.T) {
 			}...),
 		},
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -73,7 +73,7 @@ func TestNotificationsOnTop(t *testing.T) {
 
 	// send a bing message into the bing room, make sure it comes through and is on top
 	bingEvent := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "BING!"}, testutils.WithTimestamp(latestTimestamp.Add(1*time.Minute)))
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				bingRoomID: {
@@ -89,7 +89,7 @@ func TestNotificationsOnTop(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms)),
 		m.MatchV3Ops(m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, bingRoomID)),
@@ -101,7 +101,7 @@ func TestNotificationsOnTop(t *testing.T) {
 
 	// send a message into the nobing room, it's position must not change due to our sort order
 	noBingEvent := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "no bing"}, testutils.WithTimestamp(latestTimestamp.Add(2*time.Minute)))
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				noBingRoomID: {
@@ -114,7 +114,7 @@ func TestNotificationsOnTop(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, syncRequestBody)
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(len(allRooms))),
 		m.MatchNoV3Ops(),
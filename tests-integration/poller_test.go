@@ -28,11 +28,11 @@ func TestSecondPollerFiltersToDevice(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	deviceAToken := "DEVICE_A_TOKEN"
-	v2.addAccountWithDeviceID(alice, "A", deviceAToken)
-	v2.queueResponse(deviceAToken, sync2.SyncResponse{
+	v2.AddAccountWithDeviceID(alice, "A", deviceAToken)
+	v2.QueueResponse(deviceAToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -45,7 +45,7 @@ func TestSecondPollerFiltersToDevice(t *testing.T) {
 
 	// now sync with device B, and check we send the filter up
 	deviceBToken := "DEVICE_B_TOKEN"
-	v2.addAccountWithDeviceID(alice, "B", deviceBToken)
+	v2.AddAccountWithDeviceID(alice, "B", deviceBToken)
 	var seenInitialRequest atomic.Bool
 	v2.SetCheckRequest(func(token string, req *http.Request) {
 		if token != deviceBToken {
@@ -94,7 +94,7 @@ func TestSecondPollerFiltersToDevice(t *testing.T) {
 	})
 
 	wantMsg := json.RawMessage(`{"type":"f","content":{"f":"b"}}`)
-	v2.queueResponse(deviceBToken, sync2.SyncResponse{
+	v2.QueueResponse(deviceBToken, sync2.SyncResponse{
 		NextBatch: "a",
 		ToDevice: sync2.EventsResponse{
 			Events: []json.RawMessage{
@@ -124,13 +124,13 @@ func TestPollerHandlesUnknownStateEventsOnIncrementalSync(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	t.Log("Alice creates a room.")
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	const roomID = "!unimportant"
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -171,7 +171,7 @@ func TestPollerHandlesUnknownStateEventsOnIncrementalSync(t *testing.T) {
 		},
 	)
 	messageEvent := testutils.NewMessageEvent(t, alice, "hello")
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -187,7 +187,7 @@ func TestPollerHandlesUnknownStateEventsOnIncrementalSync(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Alice incremental sliding syncs.")
 	_, respBytes, statusCode := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
@@ -210,10 +210,10 @@ func TestPollerUpdatesRoomMemberTrackerOnGappySyncStateBlock(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
 	const roomID = "!unimportant"
 
 	t.Log("Alice and Bob's pollers initial sync. Both see the same state: that Alice and Bob share a room.")
@@ -229,10 +229,10 @@ func TestPollerUpdatesRoomMemberTrackerOnGappySyncStateBlock(t *testing.T) {
 		roomID: roomID,
 		events: append(initialTimeline, bobJoin),
 	})
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{Join: initialJoinBlock},
 	})
-	v2.queueResponse(bobToken, sync2.SyncResponse{
+	v2.QueueResponse(bobToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{Join: initialJoinBlock},
 	})
 
@@ -285,7 +285,7 @@ func TestPollerUpdatesRoomMemberTrackerOnGappySyncStateBlock(t *testing.T) {
 		map[string]interface{}{"membership": "leave"},
 	)
 	aliceMessage := testutils.NewMessageEvent(t, alice, "hello")
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -301,7 +301,7 @@ func TestPollerUpdatesRoomMemberTrackerOnGappySyncStateBlock(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Bob makes an incremental sliding sync request.")
 	_, respBytes, statusCode := v3.doV3Request(t, context.Background(), bobToken, bobRes.Pos, sync3.Request{})
@@ -320,19 +320,19 @@ func TestPollerUpdatesRoomMemberTrackerOnGappySyncStateBlock(t *testing.T) {
 }
 
 func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
-	pqString := testutils.PrepareDBConnectionString()
+	pqString := testutils.PrepareDBWithSchema()
 
 	// Start the mock sync v2 server and add a device for alice and for bob.
 	v2 := runTestV2Server(t)
-	defer v2.close()
+	defer v2.Close()
 	const aliceDevice = "alice_phone"
 	const bobDevice = "bob_desktop"
-	v2.addAccountWithDeviceID(alice, aliceDevice, aliceToken)
-	v2.addAccountWithDeviceID(bob, bobDevice, bobToken)
+	v2.AddAccountWithDeviceID(alice, aliceDevice, aliceToken)
+	v2.AddAccountWithDeviceID(bob, bobDevice, bobToken)
 
 	// Queue up a sync v2 response for both Alice and Bob.
-	v2.queueResponse(aliceToken, sync2.SyncResponse{NextBatch: "alice_response_1"})
-	v2.queueResponse(bobToken, sync2.SyncResponse{NextBatch: "bob_response_1"})
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{NextBatch: "alice_response_1"})
+	v2.QueueResponse(bobToken, sync2.SyncResponse{NextBatch: "bob_response_1"})
 
 	// Inject an old token from Alice and a new token from Bob into the DB.
 	v2Store := sync2.NewStore(pqString, os.Getenv("SYNCV3_SECRET"))
@@ -361,16 +361,16 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 	defer v3.close()
 
 	t.Log("Alice's poller should be active.")
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 	t.Log("Bob's poller should be active.")
-	v2.waitUntilEmpty(t, bobToken)
+	v2.WaitUntilEmpty(t, bobToken)
 
 	t.Log("Manually trigger a poller cleanup.")
 	v3.h2.ExpireOldPollers()
 
 	t.Log("Queue up a sync v2 response for both Alice and Bob. Alice's response includes account data.")
 	accdata := testutils.NewAccountData(t, "dummytype", map[string]any{})
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		NextBatch: "alice_response_2",
 		AccountData: sync2.EventsResponse{
 			Events: []json.RawMessage{
@@ -378,18 +378,16 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 			},
 		},
 	})
-	v2.queueResponse(bobToken, sync2.SyncResponse{NextBatch: "bob_response_2"})
+	v2.QueueResponse(bobToken, sync2.SyncResponse{NextBatch: "bob_response_2"})
 
 	t.Log("Wait for Bob's poller to poll")
-	v2.waitUntilEmpty(t, bobToken)
+	v2.WaitUntilEmpty(t, bobToken)
 
 	// Alice's poller has likely already made an HTTP response. But her poller should
 	// have been terminated before the request was received, so its since token
 	// should not have been persisted to the DB.
 	t.Log("Alice's since token in the DB should not have advanced.")
-	// TODO: surprising that there isn't a function to get the since token for a device!
-	var since string
-	err = v2Store.DB.Get(&since, `SELECT since FROM syncv3_sync2_devices WHERE user_id = $1 AND device_id = $2`, alice, aliceDevice)
+	since, err := v3.h2.DeviceSince(alice, aliceDevice)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -398,7 +396,7 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 	}
 
 	t.Log("Requeue the same response for Alice's restarted poller to consume.")
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		NextBatch: "alice_response_2",
 		AccountData: sync2.EventsResponse{
 			Events: []json.RawMessage{
@@ -419,7 +417,7 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 	})
 
 	t.Log("Alice's poller should have been polled.")
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Alice should see her account data")
 	m.MatchResponse(t, res, m.MatchAccountData([]json.RawMessage{accdata}, nil))
@@ -430,11 +428,11 @@ func TestPollersCanBeResumedAfterExpiry(t *testing.T) {
 func TestPollerExpiryEnsurePollingRace(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	defer v2.close()
+	defer v2.Close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
 
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 
 	// Arrange the following:
 	// 1. A request arrives from an unknown token.
@@ -448,7 +446,7 @@ func TestPollerExpiryEnsurePollingRace(t *testing.T) {
 		}
 		// Expire the token before we process the request.
 		t.Log("Alice's token expires.")
-		v2.invalidateTokenImmediately(token)
+		v2.InvalidateTokenImmediately(token)
 	})
 
 	t.Log("Alice makes a sliding sync request with a token that's about to expire.")
@@ -486,11 +484,11 @@ func TestPollerExpiryEnsurePollingRaceDoesntWedge(t *testing.T) {
 	newToken := "NEW_ALICE_TOKEN"
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	defer v2.close()
+	defer v2.Close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
 
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 
 	// Arrange the following:
 	// 1. A request arrives from an unknown token.
@@ -511,7 +509,7 @@ func TestPollerExpiryEnsurePollingRaceDoesntWedge(t *testing.T) {
 		}
 		// Expire the token before we process the request.
 		t.Log("Alice's token expires.")
-		v2.invalidateTokenImmediately(token)
+		v2.InvalidateTokenImmediately(token)
 	})
 
 	t.Log("Alice makes a sliding sync request with a token that's about to expire.")
@@ -520,7 +518,7 @@ func TestPollerExpiryEnsurePollingRaceDoesntWedge(t *testing.T) {
 		t.Fatalf("Should have got 401 http response; got %d\n%s", status, resBytes)
 	}
 	// make a new token and use it
-	v2.addAccount(t, alice, newToken)
+	v2.AddAccount(t, alice, newToken)
 	_, resBytes, status = v3.doV3Request(t, context.Background(), newToken, "", sync3.Request{})
 	if status != http.StatusOK {
 		t.Fatalf("Should have got 200 http response; got %d\n%s", status, resBytes)
@@ -534,14 +532,14 @@ func TestTimelineStopsLoadingWhenMissingPrevious(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	const roomID = "!unimportant"
 
 	t.Log("Alice creates a room.")
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -564,7 +562,7 @@ func TestTimelineStopsLoadingWhenMissingPrevious(t *testing.T) {
 
 	t.Log("Alice's poller receives a gappy sync with a timeline event.")
 	msgAfterGap := testutils.NewMessageEvent(t, alice, "school's out for summer")
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -577,7 +575,7 @@ func TestTimelineStopsLoadingWhenMissingPrevious(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Alice makes a new connection and syncs, requesting the last 10 timeline events.")
 	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
@@ -609,12 +607,12 @@ func TestTimelineStopsLoadingWhenMissingPrevious(t *testing.T) {
 func TestGappyStateDoesNotAccumulateTheStateBlock(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	defer v2.close()
+	defer v2.Close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
 
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
 
 	t.Log("Alice creates a room, sets its name and sends a message.")
 	const roomID = "!unimportant"
@@ -631,7 +629,7 @@ func TestGappyStateDoesNotAccumulateTheStateBlock(t *testing.T) {
 			msg1,
 		),
 	})
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: joinTimeline,
 		},
@@ -665,7 +663,7 @@ func TestGappyStateDoesNotAccumulateTheStateBlock(t *testing.T) {
 
 	msg2 := testutils.NewMessageEvent(t, alice, "Good morning!")
 	msg3 := testutils.NewMessageEvent(t, alice, "That's a nice tnetennba.")
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -681,7 +679,7 @@ func TestGappyStateDoesNotAccumulateTheStateBlock(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Alice syncs. The server should close her long-polling session.")
 	_, respBytes, statusCode := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
@@ -738,8 +736,8 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	// TODO remove this? Otherwise running tests is sloooooow
-	v2.timeToWaitForV2Response /= 20
-	defer v2.close()
+	v2.TimeToWaitForV2Response /= 20
+	defer v2.Close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
 
@@ -810,8 +808,8 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 
 	setup := func(t *testing.T, tc testcase) (publicEvents []json.RawMessage, anaMembership json.RawMessage, anaRes *sync3.Response) {
 		// 1. Register two users Ana and Bert.
-		v2.addAccount(t, tc.ana, tc.anaToken)
-		v2.addAccount(t, tc.bert, tc.bertToken)
+		v2.AddAccount(t, tc.ana, tc.anaToken)
+		v2.AddAccount(t, tc.bert, tc.bertToken)
 
 		// 2. Have Ana create a public room.
 		t.Log("Ana creates a public room.")
@@ -862,7 +860,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 		}
 
 		t.Log("Ana's poller sees the public room for the first time.")
-		v2.queueResponse(tc.anaToken, sync2.SyncResponse{
+		v2.QueueResponse(tc.anaToken, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: map[string]sync2.SyncV2JoinResponse{
 					tc.publicRoomID: {
@@ -917,7 +915,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 			panic(fmt.Errorf("unknown afterMembership %s", tc.afterMembership))
 		}
 
-		v2.queueResponse(tc.anaToken, sync2.SyncResponse{
+		v2.QueueResponse(tc.anaToken, sync2.SyncResponse{
 			NextBatch: "ana2",
 			Rooms: sync2.SyncRoomsResponse{
 				Join: map[string]sync2.SyncV2JoinResponse{
@@ -934,11 +932,11 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 				},
 			},
 		})
-		v2.waitUntilEmpty(t, tc.anaToken)
+		v2.WaitUntilEmpty(t, tc.anaToken)
 
 		if tc.afterMembership == "invite" {
 			t.Log("Bert's poller sees his invite.")
-			v2.queueResponse(tc.bertToken, sync2.SyncResponse{
+			v2.QueueResponse(tc.bertToken, sync2.SyncResponse{
 				Rooms: sync2.SyncRoomsResponse{
 					Invite: map[string]sync2.SyncV2InviteResponse{
 						tc.publicRoomID: {
@@ -977,15 +975,15 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 			publicEvents, anaMembership, anaRes := setup(t, tc)
 			defer func() {
 				// Cleanup these users once we're done with them. This helps stop log spam when debugging.
-				v2.invalidateTokenImmediately(tc.anaToken)
-				v2.invalidateTokenImmediately(tc.bertToken)
+				v2.InvalidateTokenImmediately(tc.anaToken)
+				v2.InvalidateTokenImmediately(tc.bertToken)
 			}()
 
 			// Ensure the proxy considers Bert to already be polling. In particular, if
 			// Bert is initially invited, make sure his poller sees the invite.
 			if tc.beforeMembership == "invite" {
 				t.Log("Bert's poller sees his invite.")
-				v2.queueResponse(tc.bertToken, sync2.SyncResponse{
+				v2.QueueResponse(tc.bertToken, sync2.SyncResponse{
 					Rooms: sync2.SyncRoomsResponse{
 						Invite: map[string]sync2.SyncV2InviteResponse{
 							tc.publicRoomID: {
@@ -999,7 +997,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 				})
 			} else {
 				t.Log("Queue up an empty poller response for Bert.")
-				v2.queueResponse(tc.bertToken, sync2.SyncResponse{
+				v2.QueueResponse(tc.bertToken, sync2.SyncResponse{
 					NextBatch: tc.bert + "_empty_sync",
 				})
 			}
@@ -1058,7 +1056,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 				}
 			} else {
 				t.Log("Queue up an empty poller response for Bert. so the proxy will consider him to be polling.")
-				v2.queueResponse(tc.bertToken, sync2.SyncResponse{
+				v2.QueueResponse(tc.bertToken, sync2.SyncResponse{
 					NextBatch: tc.bert + "_empty_sync",
 				})
 			}
@@ -1116,7 +1114,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 				testutils.NewStateEvent(t, "m.room.member", tc.bert, tc.ana, map[string]any{"membership": "invite"}),
 				bertDMJoin,
 			)
-			v2.queueResponse(tc.anaToken, sync2.SyncResponse{
+			v2.QueueResponse(tc.anaToken, sync2.SyncResponse{
 				NextBatch: "ana3",
 				Rooms: sync2.SyncRoomsResponse{
 					Join: map[string]sync2.SyncV2JoinResponse{
@@ -1129,7 +1127,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 					},
 				},
 			})
-			v2.waitUntilEmpty(t, tc.anaToken)
+			v2.WaitUntilEmpty(t, tc.anaToken)
 
 			t.Log("Bert sliding syncs")
 			bertRes = v3.mustDoV3RequestWithPos(t, tc.bertToken, bertRes.Pos, ssRequest)
@@ -1147,7 +1145,7 @@ func TestClientsSeeMembershipTransitionsInGappyPolls(t *testing.T) {
 func TestTimelineAfterRequestingStateAfterGappyPoll(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
-	defer v2.close()
+	defer v2.Close()
 	v3 := runTestServer(t, v2, pqString)
 	defer v3.close()
 
@@ -1156,7 +1154,7 @@ func TestTimelineAfterRequestingStateAfterGappyPoll(t *testing.T) {
 	bob := "bob"
 	roomID := "!unimportant"
 
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 
 	t.Log("alice creates a public room.")
 	timeline1 := createRoomState(t, alice, time.Now())
@@ -1172,7 +1170,7 @@ func TestTimelineAfterRequestingStateAfterGappyPoll(t *testing.T) {
 		t.Fatal("Initial timeline did not have a membership for Alice")
 	}
 
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
@@ -1215,7 +1213,7 @@ func TestTimelineAfterRequestingStateAfterGappyPoll(t *testing.T) {
 
 	bobMembership := testutils.NewJoinEvent(t, bob)
 
-	v2.queueResponse(aliceToken, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken, sync2.SyncResponse{
 		NextBatch: "alice2",
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
@@ -1232,7 +1230,7 @@ func TestTimelineAfterRequestingStateAfterGappyPoll(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, aliceToken)
+	v2.WaitUntilEmpty(t, aliceToken)
 
 	t.Log("Alice does an incremental sliding sync.")
 	_, respBytes, statusCode := v3.doV3Request(t, context.Background(), aliceToken, aliceRes.Pos, sync3.Request{})
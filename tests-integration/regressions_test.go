@@ -29,7 +29,7 @@ func TestBackfillInviteDoesntCorruptState(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	fedBob := "@bob:over_federation"
@@ -44,8 +44,8 @@ func TestBackfillInviteDoesntCorruptState(t *testing.T) {
 		},
 		state: createRoomState(t, fedBob, time.Now()),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -79,8 +79,8 @@ func TestBackfillInviteDoesntCorruptState(t *testing.T) {
 	)
 
 	// now charlie also joins the room, causing a different response from /sync v2
-	v2.addAccount(t, charlie, charlieToken)
-	v2.queueResponse(charlie, sync2.SyncResponse{
+	v2.AddAccount(t, charlie, charlieToken)
+	v2.QueueResponse(charlie, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: room.roomID,
@@ -118,7 +118,7 @@ func TestMalformedEventsTimeline(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	// unusual events ARE VALID EVENTS and should be sent to the client, but are unusual for some reason.
@@ -142,8 +142,8 @@ func TestMalformedEventsTimeline(t *testing.T) {
 		events: append(unusualEvents, malformedEvents...),
 		state:  createRoomState(t, alice, time.Now()),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -174,7 +174,7 @@ func TestMalformedEventsState(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	// unusual events ARE VALID EVENTS and should be sent to the client, but are unusual for some reason.
@@ -200,8 +200,8 @@ func TestMalformedEventsState(t *testing.T) {
 		// leaving only unusualEvents.
 		state: append(createRoomState(t, alice, time.Now()), append(unusualEvents, malformedEvents...)...),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -243,18 +243,18 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	goodRoom := "!good:localhost"
 	badRoom := "!bad:localhost"
 
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	// we should see the since token increment, if we see repeats it means
 	// we aren't returning DataErrors when we should be.
 	wantSinces := []string{"", "1", "2"}
 	ch := make(chan bool)
-	v2.checkRequest = func(token string, req *http.Request) {
+	v2.SetCheckRequest(func(token string, req *http.Request) {
 		if len(wantSinces) == 0 {
 			return
 		}
@@ -268,10 +268,10 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 		if len(wantSinces) == 0 {
 			close(ch)
 		}
-	}
+	})
 
 	// initial sync, everything fine
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		NextBatch: "1",
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
@@ -303,7 +303,7 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 
 	// now inject a bad room and some extra good event
 	extraGoodEvent := testutils.NewMessageEvent(t, alice, "Extra!", testutils.WithTimestamp(time.Now().Add(time.Second)))
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		NextBatch: "2",
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
@@ -326,7 +326,7 @@ func TestBadCreateInitialiseDoesntWedgePolling(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// we should see the extra good event and not the bad room
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
@@ -357,18 +357,18 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	goodRoom := "!good:localhost"
 	badRoom := "!bad:localhost"
 
-	v2.addAccount(t, alice, aliceToken)
+	v2.AddAccount(t, alice, aliceToken)
 	// we should see the since token increment, if we see repeats it means
 	// we aren't returning DataErrors when we should be.
 	wantSinces := []string{"", "1", "2"}
 	ch := make(chan bool)
-	v2.checkRequest = func(token string, req *http.Request) {
+	v2.SetCheckRequest(func(token string, req *http.Request) {
 		if len(wantSinces) == 0 {
 			return
 		}
@@ -382,10 +382,10 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 		if len(wantSinces) == 0 {
 			close(ch)
 		}
-	}
+	})
 
 	// initial sync, everything fine
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		NextBatch: "1",
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
@@ -424,7 +424,7 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 
 	// now inject a bad room and some to-device events
 	toDeviceEvent := testutils.NewEvent(t, "m.todevice", alice, map[string]interface{}{"body": "testio"})
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		NextBatch: "2",
 		ToDevice: sync2.EventsResponse{
 			Events: []json.RawMessage{toDeviceEvent},
@@ -445,7 +445,7 @@ func TestBadPollDataDoesntDropToDeviceMsgs(t *testing.T) {
 			},
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// we should see the to-device event and not the bad room
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
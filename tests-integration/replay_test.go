@@ -0,0 +1,115 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	slidingsync "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
+)
+
+// Test that upstream traffic recorded by one proxy can be replayed through the pollers of another
+// proxy with an empty database, and that the replaying proxy ends up with the same rooms, minus
+// the message contents which are sanitised out of the recording.
+func TestRecordAndReplay(t *testing.T) {
+	recordDir := t.TempDir()
+	v2 := runTestV2Server(t)
+	defer v2.Close()
+	v3 := runTestServer(t, v2, testutils.PrepareDBConnectionString(), slidingsync.Opts{
+		RecordV2Dir: recordDir,
+	})
+
+	roomID := "!TestRecordAndReplay:localhost"
+	roomName := "Recorded Room"
+	ts := time.Now()
+	firstMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "first secret"}, testutils.WithTimestamp(ts.Add(time.Second)))
+	secondMsg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "second secret"}, testutils.WithTimestamp(ts.Add(2*time.Second)))
+	events := append(createRoomState(t, alice, ts), testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": roomName}, testutils.WithTimestamp(ts)), firstMsg)
+
+	// record a session: an initial sync, then a live event
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: events,
+			}),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 2,
+				},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)), m.MatchRoomSubscription(roomID, m.MatchRoomName(roomName)))
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{secondMsg},
+			}),
+		},
+	})
+	v2.WaitUntilEmpty(t, alice)
+	v3.close()
+
+	recordings, err := sync2.LoadRecordings(recordDir)
+	if err != nil {
+		t.Fatalf("LoadRecordings: %s", err)
+	}
+	if len(recordings) != 1 {
+		t.Fatalf("got recordings for %d tokens, want 1", len(recordings))
+	}
+	var recs []sync2.RecordedSync
+	for _, r := range recordings {
+		recs = r
+	}
+
+	// replay the session into a fresh database through a fresh proxy
+	v2Replay := runTestV2Server(t)
+	defer v2Replay.Close()
+	v3Replay := runTestServer(t, v2Replay, testutils.PrepareDBConnectionString())
+	defer v3Replay.close()
+	v2Replay.AddAccount(t, alice, aliceToken)
+	v2Replay.QueueRecordings(alice, recs)
+	v3Replay.mustDoV3Request(t, aliceToken, req)
+	v2Replay.WaitUntilEmpty(t, alice)
+
+	// a new connection sees the state the recorded session built up
+	res = v3Replay.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)), m.MatchRoomSubscription(
+		roomID, m.MatchRoomName(roomName), m.MatchJoinCount(1), matchReplayedTimeline(firstMsg, secondMsg),
+	))
+}
+
+// matchReplayedTimeline checks that the timeline is made of `want`, with their bodies sanitised.
+func matchReplayedTimeline(want ...json.RawMessage) m.RoomMatcher {
+	return func(r sync3.Room) error {
+		if len(r.Timeline) != len(want) {
+			return fmt.Errorf("timeline length mismatch: got %d want %d", len(r.Timeline), len(want))
+		}
+		for i := range want {
+			gotID := gjson.GetBytes(r.Timeline[i], "event_id").Str
+			wantID := gjson.GetBytes(want[i], "event_id").Str
+			if gotID != wantID {
+				return fmt.Errorf("timeline[%d]: got event %s want %s", i, gotID, wantID)
+			}
+			if body := gjson.GetBytes(r.Timeline[i], "content.body").Str; body != "<redacted>" {
+				return fmt.Errorf("timeline[%d]: body was not sanitised: %s", i, body)
+			}
+		}
+		return nil
+	}
+}
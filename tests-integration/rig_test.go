@@ -9,6 +9,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/v2server"
 )
 
 type FlushEnum int
@@ -19,13 +20,13 @@ var (
 )
 
 type testRig struct {
-	V2     *testV2Server
+	V2     *v2server.Server
 	V3     *testV3Server
 	tokens map[string]string
 }
 
 func (r *testRig) Finish() {
-	r.V2.close()
+	r.V2.Close()
 	r.V3.close()
 }
 
@@ -38,7 +39,7 @@ func (r *testRig) SetupV2RoomsForUser(t *testing.T, v2UserID string, f FlushEnum
 	_, userExists := r.tokens[v2UserID]
 	if !userExists {
 		r.tokens[v2UserID] = "access_token_for_" + v2UserID
-		r.V2.addAccount(t, v2UserID, r.tokens[v2UserID])
+		r.V2.AddAccount(t, v2UserID, r.tokens[v2UserID])
 	}
 	inviteRooms := make(map[string]sync2.SyncV2InviteResponse)
 	joinRooms := make(map[string]sync2.SyncV2JoinResponse)
@@ -144,7 +145,7 @@ func (r *testRig) SetupV2RoomsForUser(t *testing.T, v2UserID string, f FlushEnum
 			t.Fatalf("unknown value for descriptor.MembershipOfSyncer")
 		}
 	}
-	r.V2.queueResponse(v2UserID, sync2.SyncResponse{
+	r.V2.QueueResponse(v2UserID, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Invite: inviteRooms,
 			Join:   joinRooms,
@@ -156,7 +157,7 @@ func (r *testRig) SetupV2RoomsForUser(t *testing.T, v2UserID string, f FlushEnum
 			_ = r.V3.mustDoV3Request(t, r.tokens[v2UserID], sync3.Request{})
 		} else {
 			// there is already a poller running for this user, wait for it to get the data.
-			r.V2.waitUntilEmpty(t, v2UserID)
+			r.V2.WaitUntilEmpty(t, v2UserID)
 		}
 	}
 }
@@ -180,7 +181,7 @@ func (r *testRig) FlushText(t *testing.T, userID, roomID, text string) {
 }
 
 func (r *testRig) FlushEvent(t *testing.T, userID, roomID string, event json.RawMessage) {
-	r.V2.queueResponse(userID, sync2.SyncResponse{
+	r.V2.QueueResponse(userID, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -188,7 +189,7 @@ func (r *testRig) FlushEvent(t *testing.T, userID, roomID string, event json.Raw
 			}),
 		},
 	})
-	r.V2.waitUntilEmpty(t, userID)
+	r.V2.WaitUntilEmpty(t, userID)
 }
 
 func (r *testRig) Room(roomID string) *TestRoom {
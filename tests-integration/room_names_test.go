@@ -18,7 +18,7 @@ func TestRoomNames(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	bob := "@TestRoomNames_bob:localhost"
 	// make 4 rooms, last room is most recent, and send A,B,C into each room
@@ -60,8 +60,8 @@ func TestRoomNames(t *testing.T) {
 			},
 		},
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
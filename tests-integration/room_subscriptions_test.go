@@ -18,15 +18,15 @@ func TestRoomSubscriptionJoinRoomRace(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	raceRoom := roomEvents{
 		roomID: "!race:localhost",
 		events: createRoomState(t, alice, time.Now()),
 	}
 	// add the account and queue a dummy response so there is a poll loop and we can get requests serviced
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: "!unimportant",
@@ -51,12 +51,12 @@ func TestRoomSubscriptionJoinRoomRace(t *testing.T) {
 	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(nil))
 
 	// now the proxy becomes aware of it
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(raceRoom),
 		},
 	})
-	v2.waitUntilEmpty(t, alice) // ensure we have processed it fully so we know it should exist
+	v2.WaitUntilEmpty(t, alice) // ensure we have processed it fully so we know it should exist
 
 	// hit the proxy again with this connection, we should get the data
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
@@ -78,7 +78,7 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomState := createRoomState(t, alice, time.Now())
 	abcInitialEvents := []json.RawMessage{
@@ -90,8 +90,8 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 		roomID: "!room:localhost",
 		events: append(roomState, abcInitialEvents...),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -116,7 +116,7 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 		testutils.NewMessageEvent(t, alice, "D"),
 		testutils.NewMessageEvent(t, alice, "E"),
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: room.roomID,
@@ -124,7 +124,7 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// now add a room sub with timeline limit = 5, we will need to hit the DB to satisfy this.
 	// We might destroy caches in a bad way. We might not return the most recent 5 events.
@@ -148,7 +148,7 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 		testutils.NewMessageEvent(t, alice, "F"),
 		testutils.NewMessageEvent(t, alice, "G"),
 	}
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: room.roomID,
@@ -156,7 +156,7 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// now ask for timeline limit = 3, which may miss events if the caches got corrupted.
 	// Do this on a fresh connection to force loadPos to update.
@@ -173,3 +173,59 @@ func TestRoomSubscriptionMisorderedTimeline(t *testing.T) {
 		},
 	}), m.LogResponse(t))
 }
+
+// Test that include_heroes returns the member events of the heroes of rooms without a name in
+// required_state, so clients can show their profiles without loading every member event.
+func TestRoomSubscriptionIncludeHeroesMemberEvents(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+	bobJoin := testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Bob",
+		"avatar_url":  "mxc://localhost/bob",
+	})
+	namelessRoom := roomEvents{
+		roomID: "!nameless:localhost",
+		events: append(createRoomState(t, alice, time.Now()), bobJoin),
+	}
+	namedRoom := roomEvents{
+		roomID: "!named:localhost",
+		events: append(createRoomState(t, alice, time.Now()), bobJoin,
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Named"}),
+		),
+	}
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(namelessRoom, namedRoom),
+		},
+	})
+	includeHeroes := true
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			namelessRoom.roomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.create", ""}},
+				Heroes:        &includeHeroes,
+			},
+			namedRoom.roomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.create", ""}},
+				Heroes:        &includeHeroes,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		namelessRoom.roomID: {
+			m.MatchRoomName("Bob"),
+			m.MatchRoomRequiredState([]json.RawMessage{namelessRoom.events[0], bobJoin}),
+		},
+		namedRoom.roomID: {
+			m.MatchRoomName("Named"),
+			m.MatchRoomRequiredState([]json.RawMessage{namedRoom.events[0]}),
+		},
+	}))
+}
@@ -0,0 +1,91 @@
+package syncv3
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// Test that simplified sliding sync (MSC4186) returns rooms sorted by recency without list
+// operations, and with a bump_stamp clients can sort by.
+func TestSimplifiedSlidingSync(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.Close()
+	defer v3.close()
+
+	roomA := "!simplified-a:localhost"
+	roomB := "!simplified-b:localhost"
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomA,
+				state:  createRoomState(t, alice, older),
+				events: []json.RawMessage{
+					testutils.NewMessageEvent(t, alice, "older", testutils.WithTimestamp(older)),
+				},
+			}, roomEvents{
+				roomID: roomB,
+				state:  createRoomState(t, alice, newer),
+				events: []json.RawMessage{
+					testutils.NewMessageEvent(t, alice, "newer", testutils.WithTimestamp(newer)),
+				},
+			}),
+		},
+	})
+
+	doSimplified := func(body string) gjson.Result {
+		t.Helper()
+		req, err := http.NewRequest("POST", v3.srv.URL+sync3.SimplifiedSyncPath+"?timeout=20", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		resp, err := v3.srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ReadAll: %s", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("got HTTP %d: %s", resp.StatusCode, string(respBytes))
+		}
+		return gjson.ParseBytes(respBytes)
+	}
+
+	// only the most recent room fits in the range, even though the list asks for a name sort
+	res := doSimplified(`{"lists":{"a":{"ranges":[[0,0]],"sort":["by_name"],"timeline_limit":1}}}`)
+	if res.Get("lists.a.ops").Exists() {
+		t.Errorf("list has ops: %s", res.Get("lists.a").Raw)
+	}
+	if count := res.Get("lists.a.count").Int(); count != 2 {
+		t.Errorf("list count: got %d want 2", count)
+	}
+	rooms := res.Get("rooms").Map()
+	if len(rooms) != 1 {
+		t.Fatalf("got %d rooms want 1: %s", len(rooms), res.Get("rooms").Raw)
+	}
+	room, ok := rooms[roomB]
+	if !ok {
+		t.Fatalf("got rooms %s want %s", res.Get("rooms").Raw, roomB)
+	}
+	if room.Get("bump_stamp").Int() != newer.UnixMilli() || room.Get("timestamp").Exists() {
+		t.Errorf("room %s: got bump_stamp %s timestamp %s", roomB, room.Get("bump_stamp").Raw, room.Get("timestamp").Raw)
+	}
+}
@@ -22,7 +22,7 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, "")
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// make 20 rooms, last room is most recent, and send A,B,C into each room
 	allRooms := make([]roomEvents, 20)
@@ -52,8 +52,8 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 			m.MatchRoomTimelineMostRecent(numTimelineEventsPerRoom, allRooms[i].events),
 		}
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -119,12 +119,12 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "C"}, testutils.WithTimestamp(ts.Add(6*time.Second))),
 			}...),
 		}
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(newRoom),
 			},
 		})
-		v2.waitUntilEmpty(t, alice)
+		v2.WaitUntilEmpty(t, alice)
 		// reuse the position from the room name filter test, we should get this new room
 		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 			Lists: map[string]sync3.RequestList{},
@@ -140,7 +140,7 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 
 	t.Run("live updates just send event", func(t *testing.T) {
 		newEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "D"}, testutils.WithTimestamp(latestTimestamp.Add(6*time.Second)))
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(roomEvents{
 					roomID: allRooms[11].roomID, // 11 to be caught in the room name filter
@@ -148,7 +148,7 @@ func TestSlowGetAllRoomsInitial(t *testing.T) {
 				}),
 			},
 		})
-		v2.waitUntilEmpty(t, alice)
+		v2.WaitUntilEmpty(t, alice)
 		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 			Lists: map[string]sync3.RequestList{},
 		})
@@ -16,11 +16,11 @@ func TestBecomingASpaceDoesntCrash(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!foo:bar"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -38,8 +38,8 @@ func TestBecomingASpaceDoesntCrash(t *testing.T) {
 		"via": []string{"example.com"},
 	})
 	// TODO: we inject bob here because alice's sync stream seems to discard this response post-restart for unknown reasons
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
@@ -27,7 +28,7 @@ func TestTimelines(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	// make 20 rooms, last room is most recent, and send A,B,C into each room
@@ -47,8 +48,8 @@ func TestTimelines(t *testing.T) {
 		}
 	}
 	latestTimestamp := time.Now().Add(10 * time.Hour)
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -82,16 +83,16 @@ func TestTimelines(t *testing.T) {
 			},
 		},
 	}
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 	// add these live events to the global view of the timeline
 	allRooms[0].events = append(allRooms[0].events, liveEvents[0].events...)
 	allRooms[1].events = append(allRooms[1].events, liveEvents[1].events...)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(liveEvents...),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// now we want the new live rooms and then the most recent 2 rooms from before
 	wantRooms = append([]roomEvents{
@@ -107,7 +108,7 @@ func TestTimelinesLiveStream(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, "")
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// make 20 rooms, last room is most recent, and send A,B,C into each room
 	allRooms := make([]roomEvents, 20)
@@ -129,8 +130,8 @@ func TestTimelinesLiveStream(t *testing.T) {
 			latestTimestamp = ts.Add(10 * time.Second)
 		}
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -142,7 +143,7 @@ func TestTimelinesLiveStream(t *testing.T) {
 		latestTimestamp = latestTimestamp.Add(1 * time.Second)
 		ev := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("bump %d", i)}, testutils.WithTimestamp(latestTimestamp))
 		allRooms[i].events = append(allRooms[i].events, ev)
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(roomEvents{
 					roomID: allRooms[i].roomID,
@@ -150,7 +151,7 @@ func TestTimelinesLiveStream(t *testing.T) {
 				}),
 			},
 		})
-		v2.waitUntilEmpty(t, alice)
+		v2.WaitUntilEmpty(t, alice)
 	}
 
 	// most recent 4 rooms
@@ -242,7 +243,7 @@ func TestMultipleWindows(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	// make 20 rooms, first room is most recent, and send A,B,C into each room
@@ -261,8 +262,8 @@ func TestMultipleWindows(t *testing.T) {
 			}...),
 		}
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -294,7 +295,7 @@ func TestMultipleWindows(t *testing.T) {
 		latestTimestamp = latestTimestamp.Add(1 * time.Second)
 		ev := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("bump %d", i)}, testutils.WithTimestamp(latestTimestamp))
 		allRooms[i].events = append(allRooms[i].events, ev)
-		v2.queueResponse(alice, sync2.SyncResponse{
+		v2.QueueResponse(alice, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(roomEvents{
 					roomID: allRooms[i].roomID,
@@ -302,7 +303,7 @@ func TestMultipleWindows(t *testing.T) {
 				}),
 			},
 		})
-		v2.waitUntilEmpty(t, alice)
+		v2.WaitUntilEmpty(t, alice)
 	}
 	bumpRoom(18)
 
@@ -340,11 +341,11 @@ func TestInitialFlag(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -366,7 +367,7 @@ func TestInitialFlag(t *testing.T) {
 		m.MatchV3SyncOp(0, 0, []string{roomID}),
 	)), m.MatchRoomSubscription(roomID, m.MatchRoomInitial(true)))
 	// send an update
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(
 				roomEvents{
@@ -378,7 +379,7 @@ func TestInitialFlag(t *testing.T) {
 			),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -401,13 +402,13 @@ func TestDuplicateEventsInTimeline(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 
 	dupeEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{})
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -446,7 +447,7 @@ func TestTimelineMiddleWindowZeroTimelineLimit(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, "")
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// make 20 rooms, first room is most recent, and send A,B,C into each room
 	allRooms := make([]roomEvents, 20)
@@ -464,8 +465,8 @@ func TestTimelineMiddleWindowZeroTimelineLimit(t *testing.T) {
 			}...),
 		}
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -503,7 +504,7 @@ func TestTimelineMiddleWindowZeroTimelineLimit(t *testing.T) {
 	)))
 
 	// bump room 15 to 2
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: allRooms[15].roomID,
@@ -513,7 +514,7 @@ func TestTimelineMiddleWindowZeroTimelineLimit(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// should see room 4, the server should not panic
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
@@ -544,7 +545,7 @@ func TestHistoryDoesntIncludeState(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 
@@ -560,8 +561,8 @@ func TestHistoryDoesntIncludeState(t *testing.T) {
 		},
 		prevBatch: prevBatch,
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -588,7 +589,7 @@ func TestTimelineTxnID(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 	latestTimestamp := time.Now()
@@ -600,14 +601,14 @@ func TestTimelineTxnID(t *testing.T) {
 			testutils.NewJoinEvent(t, bob),
 		),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
 	})
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -645,7 +646,7 @@ func TestTimelineTxnID(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to delete bytes: %s", err)
 	}
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -653,11 +654,11 @@ func TestTimelineTxnID(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	// now it arrives down Alice's poller, but the event has already been persisted at this point!
 	// We need a txn ID cache to remember it.
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -665,7 +666,7 @@ func TestTimelineTxnID(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	// now Alice syncs, she should see the event with the txn ID
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{
@@ -715,7 +716,7 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 		// meaning that Alice doesn't see her event before the txn ID is known.
 		MaxTransactionIDDelay: 200 * time.Millisecond,
 	})
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 	latestTimestamp := time.Now()
@@ -727,15 +728,15 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 			testutils.NewJoinEvent(t, bob),
 		),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
 		NextBatch: "alice_after_initial_poll",
 	})
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -776,7 +777,7 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 		t.Fatalf("failed to delete bytes: %s", err)
 	}
 
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -785,7 +786,7 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 		},
 	})
 	t.Log("Bob's poller sees the message.")
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Bob makes an incremental sliding sync")
 	bobRes = v3.mustDoV3RequestWithPos(t, bobToken, bobRes.Pos, sync3.Request{})
@@ -800,7 +801,7 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 	m.MatchResponse(t, aliceRes, m.MatchRoomSubscriptionsStrict(nil))
 
 	// Now the message arrives down Alice's poller.
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -809,7 +810,7 @@ func TestTimelineTxnIDBuffersForTxnID(t *testing.T) {
 		},
 	})
 	t.Log("Alice's poller sees the message with transaction_id.")
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	t.Log("Alice makes another incremental sync request.")
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
@@ -837,7 +838,7 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 		// meaning that Alice doesn't see her event before the txn ID is known.
 		MaxTransactionIDDelay: 200 * time.Millisecond,
 	})
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 	latestTimestamp := time.Now()
@@ -849,15 +850,15 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 			testutils.NewJoinEvent(t, bob),
 		),
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.addAccount(t, bob, bobToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
 		NextBatch: "alice_after_initial_poll",
 	})
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(room),
 		},
@@ -891,7 +892,7 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 	t.Log("Alice has sent a message... but it arrives down Bob's poller first, without a transaction_id")
 	newEventNoTxn := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"})
 
-	v2.queueResponse(bob, sync2.SyncResponse{
+	v2.QueueResponse(bob, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -900,7 +901,7 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 		},
 	})
 	t.Log("Bob's poller sees the message.")
-	v2.waitUntilEmpty(t, bob)
+	v2.WaitUntilEmpty(t, bob)
 
 	t.Log("Bob makes an incremental sliding sync")
 	bobRes = v3.mustDoV3RequestWithPos(t, bobToken, bobRes.Pos, sync3.Request{})
@@ -915,7 +916,7 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 	m.MatchResponse(t, aliceRes, m.MatchRoomSubscriptionsStrict(nil))
 
 	// Now the message arrives down Alice's poller.
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -924,7 +925,7 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 		},
 	})
 	t.Log("Alice's poller sees the message without transaction_id.")
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	t.Log("Alice makes another incremental sync request.")
 	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
@@ -935,6 +936,85 @@ func TestTimelineTxnIDRespectsAllClear(t *testing.T) {
 
 }
 
+// Test that a client can register the transaction ID of an event it sent, so it sees the
+// transaction ID when the event only arrives down another user's poller. Registering it also
+// releases the event if it is being held back waiting for a transaction ID.
+func TestTimelineTxnIDRegisteredByClient(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, slidingsync.Opts{
+		// long enough that the event can only be released by registering its txn ID
+		MaxTransactionIDDelay: time.Minute,
+	})
+	defer v2.Close()
+	defer v3.close()
+	roomID := "!a:localhost"
+	room := roomEvents{
+		roomID: roomID,
+		events: append(
+			createRoomState(t, alice, time.Now()),
+			testutils.NewJoinEvent(t, bob),
+		),
+	}
+	v2.AddAccount(t, alice, aliceToken)
+	v2.AddAccount(t, bob, bobToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+		NextBatch: "alice_after_initial_poll",
+	})
+	v2.QueueResponse(bob, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(room),
+		},
+		NextBatch: "bob_after_initial_poll",
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{
+				[2]int64{0, 10},
+			},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 2,
+			},
+		}},
+	}
+	aliceRes := v3.mustDoV3Request(t, aliceToken, req)
+	v3.mustDoV3Request(t, bobToken, req)
+
+	t.Log("Alice sends a message which arrives down Bob's poller without a transaction_id.")
+	txnID := "m1234567890"
+	newEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"})
+	newEventWithTxn, err := sjson.SetBytes(newEvent, "unsigned.transaction_id", txnID)
+	if err != nil {
+		t.Fatalf("failed to set bytes: %s", err)
+	}
+	v2.QueueResponse(bob, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{newEvent},
+			}),
+		},
+	})
+	v2.WaitUntilEmpty(t, bob)
+
+	t.Log("Alice's event is held back waiting for its transaction ID.")
+	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{})
+	m.MatchResponse(t, aliceRes, m.MatchRoomSubscriptionsStrict(nil))
+
+	t.Log("Alice registers the transaction ID, and sees her event with it.")
+	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, sync3.Request{
+		TransactionIDs: map[string]string{
+			gjson.GetBytes(newEvent, "event_id").Str: txnID,
+		},
+	})
+	m.MatchResponse(t, aliceRes, m.MatchRoomSubscription(
+		roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{newEventWithTxn}),
+	))
+}
+
 // Executes a sync v3 request without a ?pos and asserts that the count, rooms and timeline events m.Match the inputs given.
 func testTimelineLoadInitialEvents(v3 *testV3Server, token string, count int, wantRooms []roomEvents, numTimelineEventsPerRoom int) func(t *testing.T) {
 	return func(t *testing.T) {
@@ -979,11 +1059,11 @@ func TestPrevBatchInTimeline(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				prevBatch: "create",
@@ -1013,7 +1093,7 @@ func TestPrevBatchInTimeline(t *testing.T) {
 	), m.MatchRoomSubscription(roomID, m.MatchRoomPrevBatch("")))
 
 	// now make a newer prev_batch and try again
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				prevBatch: "newer",
@@ -1024,7 +1104,7 @@ func TestPrevBatchInTimeline(t *testing.T) {
 			}),
 		},
 	})
-	v2.waitUntilEmpty(t, alice)
+	v2.WaitUntilEmpty(t, alice)
 
 	testCases := []struct {
 		timelineLimit int64
@@ -1073,7 +1153,7 @@ func TestTrickling(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, "")
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	// make 10 rooms, first room is most recent, and send A,B,C into each room
 	allRooms := make([]roomEvents, 10)
@@ -1091,8 +1171,8 @@ func TestTrickling(t *testing.T) {
 			}...),
 		}
 	}
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(allRooms...),
 		},
@@ -1261,12 +1341,12 @@ func TestTrickling(t *testing.T) {
 func TestNumLiveBulk(t *testing.T) {
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, "")
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	roomID := "!bulk:test"
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -1317,7 +1397,7 @@ func TestNumLiveBulk(t *testing.T) {
 			))
 			count++
 		}
-		v2.queueResponse(aliceToken, sync2.SyncResponse{
+		v2.QueueResponse(aliceToken, sync2.SyncResponse{
 			Rooms: sync2.SyncRoomsResponse{
 				Join: v2JoinTimeline(roomEvents{
 					roomID: roomID,
@@ -1325,7 +1405,7 @@ func TestNumLiveBulk(t *testing.T) {
 				}),
 			},
 		})
-		v2.waitUntilEmpty(t, aliceToken)
+		v2.WaitUntilEmpty(t, aliceToken)
 		completeTimeline = append(completeTimeline, timeline...)
 	}
 	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
@@ -1345,7 +1425,7 @@ func TestSensibleLimitToTimelineLimit(t *testing.T) {
 	// setup code
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 	roomID := "!a:localhost"
 
@@ -1357,8 +1437,8 @@ func TestSensibleLimitToTimelineLimit(t *testing.T) {
 		}, testutils.WithTimestamp(time.Now().Add(time.Second)))
 	}
 
-	v2.addAccount(t, alice, aliceToken)
-	v2.queueResponse(alice, sync2.SyncResponse{
+	v2.AddAccount(t, alice, aliceToken)
+	v2.QueueResponse(alice, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -1394,14 +1474,14 @@ func TestSeeCreateEvent(t *testing.T) {
 	}
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	roomID := "!TestSeeCreateEvent:localhost"
 	userID := "@TestSeeCreateEvent:localhost"
 	token := "TestSeeCreateEvent_TOKEN"
-	v2.addAccount(t, userID, token)
-	v2.queueResponse(userID, sync2.SyncResponse{
+	v2.AddAccount(t, userID, token)
+	v2.QueueResponse(userID, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: map[string]sync2.SyncV2JoinResponse{
 				roomID: {
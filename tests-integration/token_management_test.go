@@ -19,18 +19,18 @@ func TestSyncWithNewTokenAfterOldExpires(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	aliceToken1 := "alice_token_1"
 	aliceToken2 := "alice_token_2"
 	roomID := "!room:test"
-	v2.addAccount(t, alice, aliceToken1)
+	v2.AddAccount(t, alice, aliceToken1)
 
 	t.Log("Prepare to tell a poller using aliceToken1 that Alice created a room and that Bob joined it.")
 
 	bobJoin := testutils.NewJoinEvent(t, bob)
-	v2.queueResponse(aliceToken1, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken1, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -69,8 +69,8 @@ func TestSyncWithNewTokenAfterOldExpires(t *testing.T) {
 	})
 
 	t.Log("Alice refreshes her access token. The old one expires.")
-	v2.addAccount(t, alice, aliceToken2)
-	v2.invalidateToken(aliceToken1)
+	v2.AddAccount(t, alice, aliceToken2)
+	v2.InvalidateToken(aliceToken1)
 
 	t.Log("Alice makes an incremental sliding sync with the new token.")
 	_, body, code := v3.doV3Request(t, context.Background(), aliceToken2, res.Pos, sync3.Request{})
@@ -87,7 +87,7 @@ func TestSyncWithNewTokenAfterOldExpires(t *testing.T) {
 
 	t.Log("Prepare to tell a poller using aliceToken2 that Alice created a room and that Bob joined it.")
 	bobMsg := testutils.NewMessageEvent(t, bob, "Hello, world!")
-	v2.queueResponse(aliceToken2, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken2, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -111,18 +111,18 @@ func TestSyncWithNewTokenBeforeOldExpires(t *testing.T) {
 	pqString := testutils.PrepareDBConnectionString()
 	v2 := runTestV2Server(t)
 	v3 := runTestServer(t, v2, pqString)
-	defer v2.close()
+	defer v2.Close()
 	defer v3.close()
 
 	aliceToken1 := "alice_token_1"
 	aliceToken2 := "alice_token_2"
 	roomID := "!room:test"
-	v2.addAccount(t, alice, aliceToken1)
+	v2.AddAccount(t, alice, aliceToken1)
 
 	t.Log("Prepare to tell a poller using aliceToken1 that Alice created a room and that Bob joined it.")
 
 	bobJoin := testutils.NewJoinEvent(t, bob)
-	v2.queueResponse(aliceToken1, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken1, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -161,11 +161,11 @@ func TestSyncWithNewTokenBeforeOldExpires(t *testing.T) {
 	})
 
 	t.Log("Alice refreshes her access token. The old one has yet to expire.")
-	v2.addAccount(t, alice, aliceToken2)
+	v2.AddAccount(t, alice, aliceToken2)
 
 	t.Log("Prepare to tell a poller using aliceToken1 that Alice created a room and that Bob joined it.")
 	bobMsg := testutils.NewMessageEvent(t, bob, "Hello, world!")
-	v2.queueResponse(aliceToken1, sync2.SyncResponse{
+	v2.QueueResponse(aliceToken1, sync2.SyncResponse{
 		Rooms: sync2.SyncRoomsResponse{
 			Join: v2JoinTimeline(roomEvents{
 				roomID: roomID,
@@ -7,7 +7,12 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing/fstest"
 	"time"
+
+	"github.com/pressly/goose/v3"
 )
 
 var Quiet = false
@@ -76,3 +81,36 @@ func PrepareDBConnectionString() (connStr string) {
 	db.Close()
 	return
 }
+
+// PrepareDBWithSchema is like PrepareDBConnectionString, but also creates the proxy's tables by
+// applying the SQL migrations in state/migrations, for tests which use tables directly rather than
+// via slidingsync.Setup. Go migrations are skipped, as they only convert data which a new database
+// doesn't have, and the packages they import can't be imported here. No migrations are recorded,
+// so slidingsync.Migrate still applies every migration to the database.
+func PrepareDBWithSchema() (connStr string) {
+	connStr = PrepareDBConnectionString()
+	_, thisFile, _, _ := runtime.Caller(0)
+	sqlFiles, err := filepath.Glob(filepath.Join(filepath.Dir(thisFile), "..", "state", "migrations", "*.sql"))
+	if err != nil {
+		panic(err)
+	}
+	migrations := fstest.MapFS{}
+	for _, sqlFile := range sqlFiles {
+		data, err := os.ReadFile(sqlFile)
+		if err != nil {
+			panic(err)
+		}
+		migrations[filepath.Base(sqlFile)] = &fstest.MapFile{Data: data}
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	goose.SetBaseFS(migrations)
+	defer goose.SetBaseFS(nil)
+	if err = goose.Up(db, ".", goose.WithNoVersioning()); err != nil {
+		panic(err)
+	}
+	return
+}
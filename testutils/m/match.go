@@ -384,6 +384,51 @@ func MatchDeviceLists(changed, left []string) RespMatcher {
 	}
 }
 
+// MatchNoDeviceLists builds a matcher which asserts that the sync response does not
+// contain any device list changes. A missing E2EE extension is treated as no changes.
+func MatchNoDeviceLists() RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.E2EE == nil || res.Extensions.E2EE.DeviceLists == nil {
+			return nil
+		}
+		return fmt.Errorf(
+			"MatchNoDeviceLists: got changed: %v left: %v",
+			res.Extensions.E2EE.DeviceLists.Changed, res.Extensions.E2EE.DeviceLists.Left,
+		)
+	}
+}
+
+// MatchDeviceListsAnyOrder is like MatchDeviceLists, but ignores the order of the user
+// IDs in the changed and left lists.
+func MatchDeviceListsAnyOrder(changed, left []string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.E2EE == nil {
+			return fmt.Errorf("MatchDeviceListsAnyOrder: no E2EE extension present")
+		}
+		if res.Extensions.E2EE.DeviceLists == nil {
+			return fmt.Errorf("MatchDeviceListsAnyOrder: no device lists present")
+		}
+		if err := equalStringsAnyOrder(res.Extensions.E2EE.DeviceLists.Changed, changed); err != nil {
+			return fmt.Errorf("MatchDeviceListsAnyOrder[changed]: %s", err)
+		}
+		if err := equalStringsAnyOrder(res.Extensions.E2EE.DeviceLists.Left, left); err != nil {
+			return fmt.Errorf("MatchDeviceListsAnyOrder[left]: %s", err)
+		}
+		return nil
+	}
+}
+
+// MatchNoOTKCounts builds a matcher which asserts that the sync response does not
+// contain OTK counts. A missing E2EE extension is treated as having no OTK counts.
+func MatchNoOTKCounts() RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.E2EE == nil || res.Extensions.E2EE.OTKCounts == nil {
+			return nil
+		}
+		return fmt.Errorf("MatchNoOTKCounts: got %v", res.Extensions.E2EE.OTKCounts)
+	}
+}
+
 func MatchToDeviceMessages(wantMsgs []json.RawMessage) RespMatcher {
 	return func(res *sync3.Response) error {
 		if res.Extensions.ToDevice == nil {
@@ -506,6 +551,35 @@ func MatchV3Ops(matchOps ...OpMatcher) ListMatcher {
 	}
 }
 
+// CheckV3OpsSequence asserts that the ops for the list `listKey`, concatenated in order
+// across all the given responses, exactly match `matchOps`. This is useful for asserting
+// that a sequence of updates produces a precise set of operations, regardless of how
+// they were batched into responses. Responses which do not include the list contribute
+// no ops.
+func CheckV3OpsSequence(listKey string, responses []*sync3.Response, matchOps ...OpMatcher) error {
+	var ops []sync3.ResponseOp
+	for _, res := range responses {
+		ops = append(ops, res.Lists[listKey].Ops...)
+	}
+	if len(matchOps) != len(ops) {
+		return fmt.Errorf("CheckV3OpsSequence[%v]: got %d ops want %d", listKey, len(ops), len(matchOps))
+	}
+	for i := range ops {
+		if err := matchOps[i](ops[i]); err != nil {
+			return fmt.Errorf("CheckV3OpsSequence[%v]: op[%d](%s) - %s", listKey, i, ops[i].Op(), err)
+		}
+	}
+	return nil
+}
+
+// MatchV3OpsSequence is like CheckV3OpsSequence but fails the test if the ops do not match.
+func MatchV3OpsSequence(t *testing.T, listKey string, responses []*sync3.Response, matchOps ...OpMatcher) {
+	t.Helper()
+	if err := CheckV3OpsSequence(listKey, responses, matchOps...); err != nil {
+		t.Errorf("%vMatchV3OpsSequence: %s%v", AnsiRedForeground, err, AnsiResetForeground)
+	}
+}
+
 func MatchTyping(roomID string, wantUserIDs []string) RespMatcher {
 	return func(res *sync3.Response) error {
 		if res.Extensions.Typing == nil {
@@ -553,6 +627,35 @@ func MatchNotTyping(roomID string, dontWantUserIDs []string) RespMatcher {
 	}
 }
 
+// MatchNoTypingExtension builds a matcher which asserts that the sync response has no
+// typing extension.
+func MatchNoTypingExtension() RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Typing != nil {
+			return fmt.Errorf("MatchNoTypingExtension: got Typing extension: %+v", res.Extensions.Typing)
+		}
+		return nil
+	}
+}
+
+// MatchTypingRooms builds a matcher which asserts that the typing extension contains
+// typing notifications for exactly the given rooms, in any order.
+func MatchTypingRooms(wantRoomIDs []string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Typing == nil {
+			return fmt.Errorf("MatchTypingRooms: no typing extension")
+		}
+		gotRoomIDs := make([]string, 0, len(res.Extensions.Typing.Rooms))
+		for roomID := range res.Extensions.Typing.Rooms {
+			gotRoomIDs = append(gotRoomIDs, roomID)
+		}
+		if err := equalStringsAnyOrder(gotRoomIDs, wantRoomIDs); err != nil {
+			return fmt.Errorf("MatchTypingRooms: %s", err)
+		}
+		return nil
+	}
+}
+
 type Receipt struct {
 	EventID  string
 	UserID   string
@@ -568,6 +671,28 @@ func sortReceipts(receipts []Receipt) {
 	})
 }
 
+// parseReceipts flattens an m.receipt EDU into a list of receipts.
+func parseReceipts(ev json.RawMessage) (receipts []Receipt) {
+	gjson.ParseBytes(ev).Get("content").ForEach(func(key, value gjson.Result) bool {
+		eventID := key.Str
+		value.ForEach(func(key, value gjson.Result) bool {
+			receiptType := key.Str
+			value.ForEach(func(key, value gjson.Result) bool {
+				receipts = append(receipts, Receipt{
+					EventID:  eventID,
+					UserID:   key.Str,
+					Type:     receiptType,
+					ThreadID: value.Get("thread_id").Str,
+				})
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return receipts
+}
+
 // MatchReceipts builds a matcher which asserts that a sync response has the expected
 // set of read receipts in a given room is the expected set of `wantReceipts`.
 //
@@ -587,27 +712,7 @@ func MatchReceipts(roomID string, wantReceipts []Receipt) RespMatcher {
 			}
 			return fmt.Errorf("MatchReceipts: missing room %s: got %+v", roomID, res.Extensions.Receipts)
 		}
-		var gotReceipts []Receipt
-		ev := res.Extensions.Receipts.Rooms[roomID]
-		gjson.ParseBytes(ev).Get("content").ForEach(func(key, value gjson.Result) bool {
-			eventID := key.Str
-			value.ForEach(func(key, value gjson.Result) bool {
-				receiptType := key.Str
-				value.ForEach(func(key, value gjson.Result) bool {
-					userID := key.Str
-					threadID := value.Get("thread_id").Str
-					gotReceipts = append(gotReceipts, Receipt{
-						EventID:  eventID,
-						UserID:   userID,
-						Type:     receiptType,
-						ThreadID: threadID,
-					})
-					return true
-				})
-				return true
-			})
-			return true
-		})
+		gotReceipts := parseReceipts(res.Extensions.Receipts.Rooms[roomID])
 		sortReceipts(gotReceipts)
 		sortReceipts(wantReceipts)
 		if !reflect.DeepEqual(gotReceipts, wantReceipts) {
@@ -617,6 +722,58 @@ func MatchReceipts(roomID string, wantReceipts []Receipt) RespMatcher {
 	}
 }
 
+// MatchNoReceipts builds a matcher which asserts that the given room has no receipts
+// in the sync response. A missing receipts extension is treated as having no receipts.
+func MatchNoReceipts(roomID string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Receipts == nil {
+			return nil
+		}
+		if ev := res.Extensions.Receipts.Rooms[roomID]; ev != nil {
+			return fmt.Errorf("MatchNoReceipts: got receipts for %s: %s", roomID, string(ev))
+		}
+		return nil
+	}
+}
+
+// MatchReceiptsRooms builds a matcher which asserts that the receipts extension contains
+// receipts for exactly the given rooms, in any order.
+func MatchReceiptsRooms(wantRoomIDs []string) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Receipts == nil {
+			return fmt.Errorf("MatchReceiptsRooms: no receipts extension")
+		}
+		gotRoomIDs := make([]string, 0, len(res.Extensions.Receipts.Rooms))
+		for roomID := range res.Extensions.Receipts.Rooms {
+			gotRoomIDs = append(gotRoomIDs, roomID)
+		}
+		if err := equalStringsAnyOrder(gotRoomIDs, wantRoomIDs); err != nil {
+			return fmt.Errorf("MatchReceiptsRooms: %s", err)
+		}
+		return nil
+	}
+}
+
+// MatchHasReceipt builds a matcher which asserts that the given receipt is present in
+// the given room. Unlike MatchReceipts, other receipts in the room are allowed.
+func MatchHasReceipt(roomID string, want Receipt) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Receipts == nil {
+			return fmt.Errorf("MatchHasReceipt: no receipts extension")
+		}
+		ev := res.Extensions.Receipts.Rooms[roomID]
+		if ev == nil {
+			return fmt.Errorf("MatchHasReceipt: missing room %s", roomID)
+		}
+		for _, got := range parseReceipts(ev) {
+			if got == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("MatchHasReceipt: receipt %+v missing from %s", want, string(ev))
+	}
+}
+
 // MatchAccountData builds a matcher which asserts that the account data in a sync
 // response /exactly/ matches the given `globals` and `rooms`, up to ordering.
 //
@@ -821,3 +978,17 @@ func EqualAnyOrder(got, want []json.RawMessage) error {
 	}
 	return nil
 }
+
+func equalStringsAnyOrder(got, want []string) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("got %v want %v", got, want)
+	}
+	gotSorted := append([]string{}, got...)
+	wantSorted := append([]string{}, want...)
+	sort.Strings(gotSorted)
+	sort.Strings(wantSorted)
+	if !reflect.DeepEqual(gotSorted, wantSorted) {
+		return fmt.Errorf("got %v want %v", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package m
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+func ptr(i int) *int {
+	return &i
+}
+
+func TestCheckV3OpsSequence(t *testing.T) {
+	responses := []*sync3.Response{
+		{
+			Lists: map[string]sync3.ResponseList{
+				"a": {
+					Count: 2,
+					Ops: []sync3.ResponseOp{
+						&sync3.ResponseOpRange{Operation: sync3.OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"!a", "!b"}},
+					},
+				},
+			},
+		},
+		{}, // no lists at all
+		{
+			Lists: map[string]sync3.ResponseList{
+				"a": {
+					Count: 2,
+					Ops: []sync3.ResponseOp{
+						&sync3.ResponseOpSingle{Operation: sync3.OpDelete, Index: ptr(1)},
+						&sync3.ResponseOpSingle{Operation: sync3.OpInsert, Index: ptr(0), RoomID: "!b"},
+					},
+				},
+			},
+		},
+	}
+	err := CheckV3OpsSequence("a", responses,
+		MatchV3SyncOp(0, 1, []string{"!a", "!b"}),
+		MatchV3DeleteOp(1),
+		MatchV3InsertOp(0, "!b"),
+	)
+	if err != nil {
+		t.Errorf("CheckV3OpsSequence: unexpected error: %s", err)
+	}
+	// wrong order
+	err = CheckV3OpsSequence("a", responses,
+		MatchV3SyncOp(0, 1, []string{"!a", "!b"}),
+		MatchV3InsertOp(0, "!b"),
+		MatchV3DeleteOp(1),
+	)
+	if err == nil {
+		t.Errorf("CheckV3OpsSequence: expected error for mismatched order but got none")
+	}
+	// too few matchers
+	err = CheckV3OpsSequence("a", responses, MatchV3SyncOp(0, 1, []string{"!a", "!b"}))
+	if err == nil {
+		t.Errorf("CheckV3OpsSequence: expected error for too few matchers but got none")
+	}
+	// unknown list
+	if err = CheckV3OpsSequence("b", responses); err != nil {
+		t.Errorf("CheckV3OpsSequence: unexpected error for unknown list: %s", err)
+	}
+}
+
+func TestTypingMatchers(t *testing.T) {
+	res := &sync3.Response{
+		Extensions: extensions.Response{
+			Typing: &extensions.TypingResponse{
+				Rooms: map[string]json.RawMessage{
+					"!a": json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost"]}}`),
+					"!b": json.RawMessage(`{"type":"m.typing","content":{"user_ids":[]}}`),
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		name    string
+		matcher RespMatcher
+		wantErr bool
+	}{
+		{"rooms any order", MatchTypingRooms([]string{"!b", "!a"}), false},
+		{"rooms missing one", MatchTypingRooms([]string{"!a"}), true},
+		{"no typing extension", MatchNoTypingExtension(), true},
+	}
+	for _, tc := range testCases {
+		err := tc.matcher(res)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got err %v, want err %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if err := MatchNoTypingExtension()(&sync3.Response{}); err != nil {
+		t.Errorf("MatchNoTypingExtension: unexpected error on empty response: %s", err)
+	}
+}
+
+func TestReceiptsMatchers(t *testing.T) {
+	res := &sync3.Response{
+		Extensions: extensions.Response{
+			Receipts: &extensions.ReceiptsResponse{
+				Rooms: map[string]json.RawMessage{
+					"!a": json.RawMessage(`{"type":"m.receipt","content":{"$event":{"m.read":{"@alice:localhost":{"ts":1},"@bob:localhost":{"ts":2,"thread_id":"$thread"}}}}}`),
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		name    string
+		matcher RespMatcher
+		wantErr bool
+	}{
+		{"has receipt", MatchHasReceipt("!a", Receipt{EventID: "$event", UserID: "@alice:localhost", Type: "m.read"}), false},
+		{"has threaded receipt", MatchHasReceipt("!a", Receipt{EventID: "$event", UserID: "@bob:localhost", Type: "m.read", ThreadID: "$thread"}), false},
+		{"missing receipt", MatchHasReceipt("!a", Receipt{EventID: "$event", UserID: "@charlie:localhost", Type: "m.read"}), true},
+		{"missing room", MatchHasReceipt("!b", Receipt{EventID: "$event", UserID: "@alice:localhost", Type: "m.read"}), true},
+		{"rooms", MatchReceiptsRooms([]string{"!a"}), false},
+		{"rooms mismatch", MatchReceiptsRooms([]string{"!a", "!b"}), true},
+		{"no receipts in other room", MatchNoReceipts("!b"), false},
+		{"no receipts in room with receipts", MatchNoReceipts("!a"), true},
+	}
+	for _, tc := range testCases {
+		err := tc.matcher(res)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got err %v, want err %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestE2EEMatchers(t *testing.T) {
+	res := &sync3.Response{
+		Extensions: extensions.Response{
+			E2EE: &extensions.E2EEResponse{
+				OTKCounts: map[string]int{"signed_curve25519": 5},
+				DeviceLists: &extensions.E2EEDeviceList{
+					Changed: []string{"@bob:localhost", "@alice:localhost"},
+					Left:    []string{},
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		name    string
+		matcher RespMatcher
+		wantErr bool
+	}{
+		{"device lists any order", MatchDeviceListsAnyOrder([]string{"@alice:localhost", "@bob:localhost"}, []string{}), false},
+		{"device lists wrong left", MatchDeviceListsAnyOrder([]string{"@alice:localhost", "@bob:localhost"}, []string{"@charlie:localhost"}), true},
+		{"no device lists", MatchNoDeviceLists(), true},
+		{"no otk counts", MatchNoOTKCounts(), true},
+	}
+	for _, tc := range testCases {
+		err := tc.matcher(res)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got err %v, want err %v", tc.name, err, tc.wantErr)
+		}
+	}
+	empty := &sync3.Response{}
+	if err := MatchNoDeviceLists()(empty); err != nil {
+		t.Errorf("MatchNoDeviceLists: unexpected error on empty response: %s", err)
+	}
+	if err := MatchNoOTKCounts()(empty); err != nil {
+		t.Errorf("MatchNoOTKCounts: unexpected error on empty response: %s", err)
+	}
+}
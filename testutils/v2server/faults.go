@@ -0,0 +1,158 @@
+package v2server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// Fault describes how the server misbehaves when responding to a single /sync request.
+// Faults are queued per user with InjectFaults and consumed one per request, which lets
+// tests exercise poller resilience without bespoke handlers.
+type Fault struct {
+	// Latency delays the response by this long. Applies to all other faults too.
+	Latency time.Duration
+	// StatusCode, if set, makes the server return this HTTP status code with an error body
+	// instead of a sync response. Queued responses are not consumed.
+	StatusCode int
+	// RetryAfter sets the Retry-After header and retry_after_ms field for error responses.
+	RetryAfter time.Duration
+	// Truncated cuts the response body in half, as if the connection was dropped.
+	Truncated bool
+	// Malformed returns a body which is not valid JSON.
+	Malformed bool
+	// DuplicateEvents repeats every state and timeline event in the response.
+	DuplicateEvents bool
+}
+
+// FaultLatency delays the next response by `d`.
+func FaultLatency(d time.Duration) Fault {
+	return Fault{Latency: d}
+}
+
+// FaultRateLimited returns HTTP 429 M_LIMIT_EXCEEDED with the given Retry-After.
+func FaultRateLimited(retryAfter time.Duration) Fault {
+	return Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+// FaultServerErrors returns a burst of `n` faults which each return `statusCode` e.g 502.
+func FaultServerErrors(statusCode, n int) []Fault {
+	faults := make([]Fault, n)
+	for i := range faults {
+		faults[i] = Fault{StatusCode: statusCode}
+	}
+	return faults
+}
+
+// FaultTruncated sends half of the next response body.
+func FaultTruncated() Fault {
+	return Fault{Truncated: true}
+}
+
+// FaultMalformed sends a body which is not JSON instead of the next response.
+func FaultMalformed() Fault {
+	return Fault{Malformed: true}
+}
+
+// FaultDuplicateEvents repeats every event in the next response.
+func FaultDuplicateEvents() Fault {
+	return Fault{DuplicateEvents: true}
+}
+
+// InjectFaults queues faults for the given user ID or access token. Each /sync request made
+// with the token consumes one fault, in the order they were queued. Requests made when no
+// faults are queued behave normally.
+func (s *Server) InjectFaults(userIDOrToken string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := s.resolveToken(userIDOrToken)
+	s.faults[token] = append(s.faults[token], faults...)
+}
+
+// PendingFaults returns the number of faults which have not yet been applied for this user ID
+// or access token.
+func (s *Server) PendingFaults(userIDOrToken string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.faults[s.resolveToken(userIDOrToken)])
+}
+
+func (s *Server) nextFault(token string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	faults := s.faults[token]
+	if len(faults) == 0 {
+		return Fault{}
+	}
+	s.faults[token] = faults[1:]
+	return faults[0]
+}
+
+// apply sleeps for the fault's latency and writes an error response if the fault has a status
+// code. Returns true if a response was written.
+func (f Fault) apply(w http.ResponseWriter, req *http.Request) bool {
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-req.Context().Done():
+			return true
+		}
+	}
+	if f.StatusCode == 0 {
+		return false
+	}
+	errcode := "M_UNKNOWN"
+	if f.StatusCode == http.StatusTooManyRequests {
+		errcode = "M_LIMIT_EXCEEDED"
+	}
+	body := map[string]interface{}{
+		"errcode": errcode,
+		"error":   "injected fault",
+	}
+	if f.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter.Round(time.Second).Seconds())))
+		body["retry_after_ms"] = f.RetryAfter.Milliseconds()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.StatusCode)
+	json.NewEncoder(w).Encode(body)
+	return true
+}
+
+// mangle corrupts a response body according to the fault.
+func (f Fault) mangle(body []byte) []byte {
+	if f.Malformed {
+		return []byte(`{"next_batch": "this is not json`)
+	}
+	if f.Truncated {
+		return body[:len(body)/2]
+	}
+	return body
+}
+
+func duplicateEvents(resp *sync2.SyncResponse) *sync2.SyncResponse {
+	if resp == nil {
+		return nil
+	}
+	dupe := func(events []json.RawMessage) []json.RawMessage {
+		out := make([]json.RawMessage, 0, len(events)*2)
+		for _, ev := range events {
+			out = append(out, ev, ev)
+		}
+		return out
+	}
+	for roomID, room := range resp.Rooms.Join {
+		room.State.Events = dupe(room.State.Events)
+		room.Timeline.Events = dupe(room.Timeline.Events)
+		resp.Rooms.Join[roomID] = room
+	}
+	for roomID, room := range resp.Rooms.Leave {
+		room.State.Events = dupe(room.State.Events)
+		room.Timeline.Events = dupe(room.Timeline.Events)
+		resp.Rooms.Leave[roomID] = room
+	}
+	return resp
+}
@@ -0,0 +1,317 @@
+// Package v2server provides a scriptable fake homeserver which implements enough of the
+// sync v2 API for the proxy to poll it. Tests queue up v2 responses per user or token,
+// point the proxy at Server.URL and then make sliding sync requests to the proxy.
+package v2server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+// Server is a fake stand-in for the v2 sync API provided by a homeserver.
+type Server struct {
+	// TimeToWaitForV2Response is how long a /sync request blocks waiting for a queued
+	// response before returning an empty response. Must be set before any polling starts.
+	TimeToWaitForV2Response time.Duration
+
+	// checkRequest is an arbitrary function which runs after a request has been
+	// received from pollers, but before the response is generated. This allows us to
+	// confirm that the proxy is polling the homeserver's v2 sync endpoint in the
+	// manner that we expect.
+	//
+	// checkRequest is called before we lookup a user for the given token. Tests can
+	// use this to invalidate the token right before a poll is made.
+	checkRequest  func(token string, req *http.Request)
+	mu            *sync.Mutex
+	tokenToUser   map[string]string
+	tokenToDevice map[string]string
+	queues        map[string]chan sync2.SyncResponse
+	waiting       map[string]*sync.Cond // broadcasts when the server is about to read a blocking input
+	srv           *httptest.Server
+	invalidations map[string]func()  // token -> callback
+	faults        map[string][]Fault // token -> faults to apply to the next requests
+}
+
+// SetCheckRequest sets a function which is called for every /sync request made to the
+// server, before the response is generated.
+func (s *Server) SetCheckRequest(fn func(token string, req *http.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkRequest = fn
+}
+
+// AddAccount registers a user with a single device. Most tests only use a single device
+// per user, so this helper picks a device ID for them.
+func (s *Server) AddAccount(t testutils.TestBenchInterface, userID, token string) {
+	// To keep our future selves sane while debugging use a device name that
+	//  - includes the mxid localpart, and
+	//  - includes the test name (to avoid leaking state from previous tests).
+	atLocalPart, _, _ := strings.Cut(userID, ":")
+	deviceID := fmt.Sprintf("%s_%s_device", atLocalPart[1:], t.Name())
+	s.AddAccountWithDeviceID(userID, deviceID, token)
+}
+
+// AddAccountWithDeviceID registers a user's device. Tests that use multiple devices for
+// the same user need to be explicit about the device ID.
+func (s *Server) AddAccountWithDeviceID(userID, deviceID, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenToUser[token] = userID
+	s.tokenToDevice[token] = deviceID
+	s.queues[token] = make(chan sync2.SyncResponse, 100)
+	s.waiting[token] = &sync.Cond{
+		L: &sync.Mutex{},
+	}
+}
+
+// InvalidateTokenImmediately is like InvalidateToken, but doesn't do any waiting.
+func (s *Server) InvalidateTokenImmediately(token string) {
+	s.mu.Lock()
+	delete(s.tokenToUser, token)
+	delete(s.tokenToDevice, token)
+	s.mu.Unlock()
+}
+
+// InvalidateToken removes the token and waits until the proxy sends a request with this
+// token, then 401s it and returns.
+func (s *Server) InvalidateToken(token string) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// add callback and delete the token
+	s.mu.Lock()
+	s.invalidations[token] = func() {
+		wg.Done()
+	}
+	delete(s.tokenToUser, token)
+	delete(s.tokenToDevice, token)
+	s.mu.Unlock()
+
+	// kick over the connection so the next request 401s and wait till we get said request
+	s.srv.CloseClientConnections()
+	wg.Wait()
+
+	// cleanup the callback
+	s.mu.Lock()
+	delete(s.invalidations, token)
+	s.mu.Unlock()
+	// need to wait for the HTTP 401 response to be processed :(
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (s *Server) userID(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenToUser[token]
+}
+
+func (s *Server) deviceID(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenToDevice[token]
+}
+
+// resolveToken returns the token for a user ID or token. Must be called with s.mu held.
+func (s *Server) resolveToken(userIDOrToken string) string {
+	if _, exists := s.queues[userIDOrToken]; exists {
+		return userIDOrToken
+	}
+	// try to find a token for this user
+	for token, userID := range s.tokenToUser {
+		if userIDOrToken == userID {
+			return token
+		}
+	}
+	return userIDOrToken
+}
+
+// QueueResponse queues up a v2 sync response for the given user ID or access token.
+// Responses are returned to pollers in the order they were queued.
+func (s *Server) QueueResponse(userIDOrToken string, resp sync2.SyncResponse) {
+	// ensure we send valid responses
+	for roomID, room := range resp.Rooms.Join {
+		if len(room.State.Events) > 0 && len(room.Timeline.Events) == 0 {
+			panic(fmt.Sprintf("invalid queued v2 response for room %s: no timeline events but %d events in state block", roomID, len(room.State.Events)))
+		}
+	}
+	s.mu.Lock()
+	userIDOrToken = s.resolveToken(userIDOrToken)
+	ch := s.queues[userIDOrToken]
+	s.mu.Unlock()
+	ch <- resp
+	if !testutils.Quiet {
+		log.Printf("v2server: enqueued v2 response for %s (%d join rooms)", userIDOrToken, len(resp.Rooms.Join))
+	}
+}
+
+// QueueRecordings queues up the successful responses from a recording made by a
+// sync2.RecordingClient, so that recorded upstream traffic is fed back through the
+// proxy's poller pipeline. Non-200 recordings are skipped.
+func (s *Server) QueueRecordings(userIDOrToken string, recs []sync2.RecordedSync) {
+	for _, rec := range recs {
+		if rec.StatusCode != 200 || rec.Response == nil {
+			continue
+		}
+		s.QueueResponse(userIDOrToken, *rec.Response)
+	}
+}
+
+// WaitUntilEmpty blocks until the server has sent all queued responses for the given
+// user ID or token, and is waiting for more. This means the proxy has fully processed
+// all previously queued responses.
+func (s *Server) WaitUntilEmpty(t testutils.TestBenchInterface, userIDOrToken string) {
+	t.Helper()
+	s.mu.Lock()
+	userIDOrToken = s.resolveToken(userIDOrToken)
+	cond := s.waiting[userIDOrToken]
+	if cond == nil {
+		t.Fatalf("WaitUntilEmpty: cannot find active Cond for userID or token: %s - aware of %+v", userIDOrToken, s.tokenToUser)
+	}
+	s.mu.Unlock()
+	cond.L.Lock()
+	cond.Wait()
+	cond.L.Unlock()
+}
+
+func (s *Server) nextResponse(userID, token string) *sync2.SyncResponse {
+	s.mu.Lock()
+	ch := s.queues[token]
+	cond := s.waiting[token]
+	s.mu.Unlock()
+	if ch == nil {
+		log.Fatalf("v2server: nextResponse called with %s but there is no chan for this user", userID)
+	}
+	if len(ch) == 0 {
+		// broadcast to tests (WaitUntilEmpty) that we're going to block for new data.
+		// We need to do it like this so we can make sure that the server has fully processed
+		// the previous responses
+		cond.Broadcast()
+	}
+	select {
+	case data, stillOpen := <-ch:
+		if !stillOpen {
+			if !testutils.Quiet {
+				log.Printf("v2server: closing, returning null to %s %s", userID, token)
+			}
+			return nil
+		}
+		if !testutils.Quiet {
+			log.Printf(
+				"v2server: nextResponse %s %s returning data: [invite=%d,join=%d,leave=%d]",
+				userID, token, len(data.Rooms.Invite), len(data.Rooms.Join), len(data.Rooms.Leave),
+			)
+		}
+		return &data
+	case <-time.After(s.TimeToWaitForV2Response):
+		if !testutils.Quiet {
+			log.Printf("v2server: nextResponse %s %s waited >%v for data, returning null", userID, token, s.TimeToWaitForV2Response)
+		}
+		return nil
+	}
+}
+
+// URL returns the base URL of the server, suitable for use as the proxy's destination server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// CloseClientConnections closes all open connections to the server, which kicks pollers
+// into making a new request.
+func (s *Server) CloseClientConnections() {
+	s.srv.CloseClientConnections()
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, ch := range s.queues {
+		close(ch)
+	}
+	s.mu.Unlock()
+	s.srv.Close()
+}
+
+// Run starts a new fake homeserver. Callers must Close it when done.
+func Run(t testutils.TestBenchInterface) *Server {
+	t.Helper()
+	server := &Server{
+		tokenToUser:             make(map[string]string),
+		tokenToDevice:           make(map[string]string),
+		queues:                  make(map[string]chan sync2.SyncResponse),
+		waiting:                 make(map[string]*sync.Cond),
+		invalidations:           make(map[string]func()),
+		faults:                  make(map[string][]Fault),
+		mu:                      &sync.Mutex{},
+		TimeToWaitForV2Response: time.Second,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"versions": ["v1.1"]}`))
+	})
+	r.HandleFunc("/_matrix/client/r0/account/whoami", func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		userID := server.userID(token)
+		deviceID := server.deviceID(token)
+		if userID == "" || deviceID == "" {
+			w.WriteHeader(401)
+			server.mu.Lock()
+			fn := server.invalidations[token]
+			if fn != nil {
+				fn()
+			}
+			server.mu.Unlock()
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`{"user_id":"%s","device_id":"%s"}`, userID, deviceID)))
+	})
+	r.HandleFunc("/_matrix/client/r0/sync", func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		server.mu.Lock()
+		check := server.checkRequest
+		server.mu.Unlock()
+		if check != nil {
+			check(token, req)
+		}
+		userID := server.userID(token)
+		if userID == "" {
+			w.WriteHeader(401)
+			server.mu.Lock()
+			fn := server.invalidations[token]
+			if fn != nil {
+				fn()
+			}
+			server.mu.Unlock()
+			return
+		}
+		fault := server.nextFault(token)
+		if fault.apply(w, req) {
+			return
+		}
+		resp := server.nextResponse(userID, token)
+		if fault.DuplicateEvents {
+			resp = duplicateEvents(resp)
+		}
+		body, err := json.Marshal(resp)
+		if err != nil {
+			w.WriteHeader(500)
+			t.Errorf("failed to marshal response: %s", err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(fault.mangle(body))
+	})
+	server.srv = httptest.NewServer(r)
+	return server
+}
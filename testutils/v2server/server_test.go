@@ -0,0 +1,159 @@
+package v2server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func doSync(t *testing.T, s *Server, token string) (*sync2.SyncResponse, int) {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.URL()+"/_matrix/client/r0/sync", nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to do request: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, res.StatusCode
+	}
+	var syncRes *sync2.SyncResponse
+	if err := json.NewDecoder(res.Body).Decode(&syncRes); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return syncRes, res.StatusCode
+}
+
+func TestServerQueueResponse(t *testing.T) {
+	s := Run(t)
+	defer s.Close()
+	s.TimeToWaitForV2Response /= 20
+	s.AddAccount(t, "@alice:localhost", "ALICE_TOKEN")
+
+	var checkedTokens []string
+	s.SetCheckRequest(func(token string, req *http.Request) {
+		checkedTokens = append(checkedTokens, token)
+	})
+
+	// responses can be queued by user ID
+	s.QueueResponse("@alice:localhost", sync2.SyncResponse{NextBatch: "1"})
+	res, code := doSync(t, s, "ALICE_TOKEN")
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200", code)
+	}
+	if res == nil || res.NextBatch != "1" {
+		t.Fatalf("got %+v want next_batch 1", res)
+	}
+
+	// nothing queued returns null after waiting
+	res, code = doSync(t, s, "ALICE_TOKEN")
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200", code)
+	}
+	if res != nil {
+		t.Fatalf("got %+v want null", res)
+	}
+
+	// unknown tokens are rejected
+	_, code = doSync(t, s, "UNKNOWN_TOKEN")
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401", code)
+	}
+	s.InvalidateTokenImmediately("ALICE_TOKEN")
+	_, code = doSync(t, s, "ALICE_TOKEN")
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401 after invalidation", code)
+	}
+
+	if len(checkedTokens) != 4 {
+		t.Errorf("check request called %d times, want 4", len(checkedTokens))
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := Run(t)
+	defer s.Close()
+	s.TimeToWaitForV2Response /= 20
+	s.AddAccount(t, "@alice:localhost", "ALICE_TOKEN")
+	event := json.RawMessage(`{"type":"m.room.message","event_id":"$a","sender":"@alice:localhost","content":{}}`)
+	s.QueueResponse("@alice:localhost", sync2.SyncResponse{
+		NextBatch: "1",
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				"!a:localhost": {Timeline: sync2.TimelineResponse{Events: []json.RawMessage{event}}},
+			},
+		},
+	})
+	s.InjectFaults("@alice:localhost", FaultRateLimited(2*time.Second))
+	s.InjectFaults("ALICE_TOKEN", FaultServerErrors(502, 2)...)
+	s.InjectFaults("ALICE_TOKEN", FaultLatency(50*time.Millisecond), FaultDuplicateEvents())
+	if got := s.PendingFaults("@alice:localhost"); got != 5 {
+		t.Fatalf("got %d pending faults, want 5", got)
+	}
+
+	req, _ := http.NewRequest("GET", s.URL()+"/_matrix/client/r0/sync", nil)
+	req.Header.Set("Authorization", "Bearer ALICE_TOKEN")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to do request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 429 || res.Header.Get("Retry-After") != "2" {
+		t.Fatalf("got HTTP %d Retry-After %q, want 429 with Retry-After 2", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	for i := 0; i < 2; i++ {
+		if _, code := doSync(t, s, "ALICE_TOKEN"); code != 502 {
+			t.Fatalf("got HTTP %d want 502", code)
+		}
+	}
+	// latency only: the queued response was not consumed by the error responses
+	start := time.Now()
+	syncRes, code := doSync(t, s, "ALICE_TOKEN")
+	if code != 200 || syncRes == nil || syncRes.NextBatch != "1" {
+		t.Fatalf("got HTTP %d %+v, want the queued response", code, syncRes)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("latency was not injected")
+	}
+	if got := len(syncRes.Rooms.Join["!a:localhost"].Timeline.Events); got != 1 {
+		t.Errorf("latency fault modified the response: got %d events", got)
+	}
+
+	s.QueueResponse("ALICE_TOKEN", sync2.SyncResponse{
+		NextBatch: "2",
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				"!a:localhost": {Timeline: sync2.TimelineResponse{Events: []json.RawMessage{event}}},
+			},
+		},
+	})
+	syncRes, _ = doSync(t, s, "ALICE_TOKEN")
+	if got := len(syncRes.Rooms.Join["!a:localhost"].Timeline.Events); got != 2 {
+		t.Errorf("got %d timeline events, want duplicated events", got)
+	}
+	if got := s.PendingFaults("ALICE_TOKEN"); got != 0 {
+		t.Errorf("got %d pending faults, want 0", got)
+	}
+
+	// malformed and truncated bodies don't parse
+	for _, fault := range []Fault{FaultMalformed(), FaultTruncated()} {
+		s.QueueResponse("ALICE_TOKEN", sync2.SyncResponse{NextBatch: "3"})
+		s.InjectFaults("ALICE_TOKEN", fault)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %s", err)
+		}
+		var body sync2.SyncResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err == nil {
+			t.Errorf("fault %+v: body parsed as JSON", fault)
+		}
+		res.Body.Close()
+	}
+}
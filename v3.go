@@ -2,6 +2,7 @@ package slidingsync
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -22,19 +24,18 @@ import (
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
-	"github.com/pressly/goose/v3"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 //go:embed state/migrations/*
 var EmbedMigrations embed.FS
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger(internal.LogModuleDefault)
 var Version string
 
 type Opts struct {
@@ -53,13 +54,169 @@ type Opts struct {
 
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+	// DBReplica, if set, is the connection string of a read-only replica of the database, which
+	// room state, timelines and the startup snapshot are loaded from when it has caught up.
+	DBReplica string
 
 	// HTTPTimeout is used for "normal" HTTP requests
 	HTTPTimeout time.Duration
 	// HTTPLongTimeout is used for initial sync requests
 	HTTPLongTimeout time.Duration
+	// MaxLongPollTimeout is the longest a client can wait for new data, set with the `timeout`
+	// query parameter. Longer timeouts are clamped. If 0, uses sync3.DefaultMaxTimeoutMSecs.
+	MaxLongPollTimeout time.Duration
+
+	// RecordV2Dir, if set, is a directory where sanitised upstream /sync responses are
+	// recorded so they can be replayed later with a sync2.ReplayClient.
+	RecordV2Dir string
+
+	// Quirks overrides the quirks detected for the upstream homeserver, see sync2.ParseQuirks.
+	Quirks string
+
+	// AccountDataQuotas limits how much account data is stored for each user.
+	AccountDataQuotas handler2.AccountDataQuotas
+
+	// CircuitBreaker pauses polling the users of a homeserver when it keeps failing. Disabled if the
+	// FailureThreshold is 0.
+	CircuitBreaker sync2.CircuitBreakerConfig
+	// PollerRetry is how pollers back off after failed polls. Unset backoffs use
+	// sync2.DefaultRetryPolicy.
+	PollerRetry sync2.RetryPolicy
+
+	// InviteSummaryTTL enables fetching room summaries for invites to unknown rooms, refetching
+	// them when they are older than this. Disabled if 0.
+	InviteSummaryTTL time.Duration
+
+	// KeepaliveInterval is the longest a long poll waits before an empty keepalive response is sent,
+	// for load balancers which kill idle HTTP responses. Disabled if 0.
+	KeepaliveInterval time.Duration
+
+	// StaleDeviceCleanup removes devices which have not been polled for a long time. Disabled if
+	// the TTL is 0.
+	StaleDeviceCleanup handler2.StaleDeviceCleanup
+
+	// PollerStartup limits how many pollers are started at once at startup.
+	PollerStartup handler2.PollerStartup
+
+	// Presence requests presence from the upstream homeserver, so it can be served in the presence
+	// extension. Without this, upstream syncs filter out all presence.
+	Presence bool
+
+	// BackfillRate is the most /messages calls a second made to fill timelines which have fewer
+	// stored events than the client's timeline_limit. If 0, timelines are not backfilled.
+	BackfillRate float64
+
+	// ConnTTL is how long a connection can go without a request before it is expired. If 0, uses
+	// 30 minutes.
+	ConnTTL time.Duration
+	// MaxConnsPerDevice and MaxConnsPerUser limit how many connections each device and user can
+	// have at once, closing the least recently used connection to make room for new ones. 0 means
+	// no limit.
+	MaxConnsPerDevice int
+	MaxConnsPerUser   int
+
+	// RequestRateLimit is the most sync requests a second each device can make, allowing bursts of
+	// RequestBurst requests. If 0, requests are not rate limited.
+	RequestRateLimit float64
+	// RequestBurst is the most requests a device can make at once with RequestRateLimit. If 0, uses
+	// handler.DefaultRequestBurst.
+	RequestBurst int
+
+	// ThreadNotifications requests per-thread notification counts (MSC3773) from the upstream
+	// homeserver, so they can be served in room responses.
+	ThreadNotifications bool
+
+	// SyncFilter sets the timeline limits and membership options of upstream syncs. The zero value
+	// uses the defaults.
+	SyncFilter sync2.SyncFilter
+
+	// BumpEventTypes are the bump_event_types of lists which don't set them. If empty, every
+	// event bumps rooms.
+	BumpEventTypes []string
+
+	// WebSockets serves sliding sync over a WebSocket as well as HTTP long polling.
+	WebSockets bool
+	// WebSocketOrigins are the origins browsers may open WebSockets from, or "*" for any. Clients
+	// which don't send an Origin, i.e. everything but browsers, can always connect.
+	WebSocketOrigins []string
+
+	// PushRuleCounts counts notifications and highlights by evaluating users' push rules against
+	// new events, as well as using the counts from the homeserver.
+	PushRuleCounts bool
+
+	// UnreadCounts calculates MSC2654 unread counts in the proxy from read receipts and timelines,
+	// for homeservers which don't send them.
+	UnreadCounts bool
+
+	// EphemeralOnDemand makes pollers filter out typing notifications and receipts unless one of
+	// the connections for their device has enabled the typing or receipts extensions.
+	EphemeralOnDemand bool
+
+	// AccumulateConcurrency is the number of joined rooms from the same sync v2 response which are
+	// processed at once. Each room's data is still processed in order. 0 or 1 processes one room at
+	// a time.
+	AccumulateConcurrency int
+
+	// OldSecrets are secrets which access tokens were previously encrypted with. Tokens encrypted
+	// with them can still be decrypted, and are re-encrypted with the current secret in the background.
+	OldSecrets []string
+
+	// MaxQueuedPerUser is the most payloads about each user queued between the pollers and the API.
+	// When a user's queue is full, their queued payloads are dropped and the user is resynced from
+	// the database. Defaults to 1000. Ignored if TestingSynchronousPubsub is set.
+	MaxQueuedPerUser int
+
+	// PersistConns stores the sticky request of every connection, so clients can carry on with
+	// their connection after a restart.
+	PersistConns bool
+
+	// TypingDebounce coalesces typing notifications in each room which change within this window.
+	// 0 sends every change immediately.
+	TypingDebounce time.Duration
+
+	// MaxFailingPollers is the fraction of pollers which can be failing before the poller health
+	// check fails. 0 uses handler2.DefaultMaxFailingPollers.
+	MaxFailingPollers float64
+
+	// LazyStartup only loads the members of each room at startup, and loads the rest of the room
+	// metadata when each room is first used and in the background, so requests are served sooner.
+	LazyStartup bool
+
+	// StrictValidation rejects events from the upstream which lack fields every event should have,
+	// and quarantines rejected events so they can be listed with the admin API.
+	StrictValidation bool
+
+	// EventRetention prunes old timeline events. Disabled unless a max age or max events is set.
+	EventRetention state.EventRetention
+
+	// ToDeviceQuota drops the oldest to-device messages queued for a device which is over it.
+	// Disabled unless a limit is set.
+	ToDeviceQuota state.ToDeviceQuota
+
+	// Homeservers, if set, maps server names to the homeserver URL to send their users' requests
+	// to, so one proxy can serve several homeservers. Replaces the destination homeserver.
+	Homeservers map[string]string
+
+	// Redis, if set, is the Redis server which the pollers send updates to the sync API through,
+	// instead of in memory, so they can run in separate processes. See Role.
+	Redis string
+	// Role is RolePoller or RoleAPI to run only the pollers or only the sync API, which needs
+	// Redis. If unset, both are run.
+	Role string
+
+	// DBSchema, if set, stores everything in this postgres schema instead of the default one, so
+	// several tenants can share a database. The schema is created if it doesn't exist.
+	DBSchema string
 }
 
+// Roles which a process can run, so the pollers and the sync API can be scaled separately.
+const (
+	// RolePoller runs the pollers, which store the updates from the upstream homeserver.
+	RolePoller = "poller"
+	// RoleAPI serves the sync API, asking the pollers to poll for the devices which use it.
+	RoleAPI = "api"
+)
+
 type server struct {
 	chain []func(next http.Handler) http.Handler
 	final http.Handler
@@ -78,6 +235,7 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if req.Method == "OPTIONS" {
 			w.WriteHeader(200)
 			return
@@ -89,14 +247,45 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 // Setup the proxy
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
 	// Setup shared DB and HTTP client
-	v2Client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
+	var v2Client sync2.Client
+	var quirks sync2.Quirks
+	var routingClient *sync2.RoutingClient
+	httpClients := make(map[string]*sync2.HTTPClient, len(opts.Homeservers))
+	if len(opts.Homeservers) > 0 {
+		clients := make(map[string]sync2.Client, len(opts.Homeservers))
+		for serverName, dest := range opts.Homeservers {
+			httpClients[serverName] = newHTTPClient(dest, opts)
+			clients[serverName] = httpClients[serverName]
+		}
+		routingClient = sync2.NewRoutingClient(clients)
+		v2Client = routingClient
+	} else {
+		httpClient := newHTTPClient(destHomeserver, opts)
+		quirks = httpClient.Quirks
+		v2Client = httpClient
+	}
+	var err error
+	if opts.RecordV2Dir != "" {
+		recordingClient, err := sync2.NewRecordingClient(v2Client, opts.RecordV2Dir)
+		if err != nil {
+			logger.Panic().Err(err).Msg("failed to setup v2 recording")
+		}
+		logger.Warn().Str("dir", opts.RecordV2Dir).Msg("recording upstream /sync responses")
+		v2Client = recordingClient
+	}
 
 	// Sanity check that we can contact the upstream homeserver.
-	_, err := v2Client.Versions(context.Background())
+	_, err = v2Client.Versions(context.Background())
 	if err != nil {
-		logger.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER set correctly?")
+		logger.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER or SYNCV3_HOMESERVERS set correctly?")
 	}
 
+	if opts.DBSchema != "" {
+		postgresURI, err = withSearchPath(postgresURI, opts.DBSchema)
+		if err != nil {
+			logger.Panic().Err(err).Msg("invalid DB schema")
+		}
+	}
 	db, err := sqlx.Open("postgres", postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
@@ -104,24 +293,28 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
 	}
 
-	if opts.DBMaxConns > 0 {
-		// https://github.com/go-sql-driver/mysql#important-settings
-		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
-		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
-		db.SetMaxOpenConns(opts.DBMaxConns)
-		db.SetMaxIdleConns(opts.DBMaxConns)
-	}
-	if opts.DBConnMaxIdleTime > 0 {
-		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	setDBLimits(db, opts)
+	// Automatically execute migrations, which create the tables on a new database
+	if err = prepareDB(db, opts.DBSchema); err != nil {
+		logger.Panic().Err(err).Msg("failed to prepare DB")
 	}
 	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
+	if opts.DBReplica != "" {
+		store.SetReadReplica(openReadReplica(opts))
+	}
+	store.SetEventRetention(opts.EventRetention)
+	store.ToDeviceTable.SetQuota(opts.ToDeviceQuota)
+	store.SetStrictValidation(opts.StrictValidation)
 	storev2 := sync2.NewStoreWithDB(db, secret)
-
-	// Automatically execute migrations
-	goose.SetBaseFS(EmbedMigrations)
-	err = goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
-	if err != nil {
-		logger.Panic().Err(err).Msg("failed to execute migrations")
+	storev2.TokensTable.SetOldSecrets(opts.OldSecrets)
+	if routingClient != nil {
+		routingClient.SetTokenLookup(func(accessToken string) (string, error) {
+			token, err := storev2.TokensTable.Token(accessToken)
+			if err != nil {
+				return "", err
+			}
+			return token.UserID, nil
+		})
 	}
 
 	bufferSize := 50
@@ -133,22 +326,78 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if opts.MaxPendingEventUpdates == 0 {
 		opts.MaxPendingEventUpdates = 2000
 	}
-	pubSub := pubsub.NewPubSub(bufferSize)
+	var pubSub interface {
+		pubsub.Notifier
+		pubsub.Listener
+	}
+	if opts.Redis != "" {
+		// created before loading the global snapshot, so no updates are missed in between
+		pubSub, err = pubsub.NewRedisPubSub(opts.Redis, "syncv3:")
+		if err != nil {
+			logger.Panic().Err(err).Msg("failed to connect to redis")
+		}
+	} else {
+		pubSub = pubsub.NewPubSub(bufferSize)
+	}
+
+	var v2Pub pubsub.Notifier = pubSub
+	if !opts.TestingSynchronousPubsub {
+		if opts.MaxQueuedPerUser == 0 {
+			opts.MaxQueuedPerUser = 1000
+		}
+		v2Pub = pubsub.NewQueuedNotifier(pubSub, pubsub.DefaultMaxQueuedPayloads, opts.MaxQueuedPerUser, opts.AddPrometheusMetrics)
+	}
 
 	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
+	pMap.SetQuirks(quirks)
+	for serverName, httpClient := range httpClients {
+		pMap.SetServerQuirks(serverName, httpClient.Quirks)
+	}
+	pMap.SetCircuitBreakers(sync2.NewCircuitBreakers(opts.CircuitBreaker, opts.AddPrometheusMetrics))
+	retryPolicy := opts.PollerRetry
+	if retryPolicy.InitialBackoff <= 0 {
+		retryPolicy.InitialBackoff = sync2.DefaultRetryPolicy.InitialBackoff
+	}
+	if retryPolicy.MaxBackoff <= 0 {
+		retryPolicy.MaxBackoff = sync2.DefaultRetryPolicy.MaxBackoff
+	}
+	pMap.SetRetryPolicy(retryPolicy)
+	pMap.SetEphemeralOnDemand(opts.EphemeralOnDemand)
+	pMap.SetAccumulateConcurrency(opts.AccumulateConcurrency)
 	// create v2 handler
-	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
+	h2, err := handler2.NewHandler(pMap, storev2, store, v2Pub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
 	if err != nil {
 		panic(err)
 	}
 	pMap.SetCallbacks(h2)
+	h2.SetAccountDataQuotas(opts.AccountDataQuotas)
+	h2.SetRoomSummaryTTL(opts.InviteSummaryTTL)
+	h2.SetStaleDeviceCleanup(opts.StaleDeviceCleanup)
+	h2.SetPollerStartup(opts.PollerStartup)
+	h2.SetPushRuleCounts(opts.PushRuleCounts)
+	h2.SetUnreadCounts(opts.UnreadCounts)
+	h2.SetTypingDebounce(opts.TypingDebounce)
+	h2.SetMaxFailingPollers(opts.MaxFailingPollers)
 
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay, opts.MaxLongPollTimeout)
 	if err != nil {
 		panic(err)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
+	h3.SetKeepaliveInterval(opts.KeepaliveInterval)
+	h3.SetWebSockets(opts.WebSockets)
+	h3.SetWebSocketOrigins(opts.WebSocketOrigins)
+	h3.SetConnLimits(opts.ConnTTL, opts.MaxConnsPerDevice, opts.MaxConnsPerUser)
+	h3.SetPersistConns(opts.PersistConns)
+	h3.SetEphemeralOnDemand(opts.EphemeralOnDemand)
+	h3.SetDefaultBumpEventTypes(opts.BumpEventTypes)
+	h3.SetBackfillRate(opts.BackfillRate)
+	h3.SetRequestRateLimit(opts.RequestRateLimit, opts.RequestBurst)
+	snapshot := store.GlobalSnapshot
+	if opts.LazyStartup {
+		snapshot = store.LazyGlobalSnapshot
+	}
+	storeSnapshot, err := snapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -156,17 +405,216 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
-	h2.Listen()
-	h3.Listen()
+	if opts.Role != RoleAPI {
+		h2.Listen()
+		if len(opts.OldSecrets) > 0 {
+			go reencryptTokens(storev2.TokensTable)
+		}
+	}
+	if opts.Role != RolePoller {
+		h3.Listen()
+	}
 	return h2, h3
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
-	// HTTP path routing
+// reencryptTokens re-encrypts access tokens which were encrypted with an old secret with the current
+// secret, so that the old secrets can be removed from the config once it has finished.
+func reencryptTokens(tokens *sync2.TokensTable) {
+	start := time.Now()
+	res, err := tokens.Reencrypt(1000)
+	if err != nil {
+		logger.Error().Err(err).Int("reencrypted", res.Reencrypted).Msg("failed to re-encrypt access tokens")
+		return
+	}
+	logger.Info().Int("reencrypted", res.Reencrypted).Int("undecryptable", res.Undecryptable).
+		Dur("duration", time.Since(start)).Msg("re-encrypted access tokens with the current secret")
+}
+
+// newHTTPClient makes a client for one upstream homeserver, with its quirks detected.
+func newHTTPClient(destHomeserver string, opts Opts) *sync2.HTTPClient {
+	httpClient := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
+	quirks, err := sync2.ParseQuirks(opts.Quirks, detectQuirks(httpClient))
+	if err != nil {
+		logger.Panic().Err(err).Msg("invalid quirks")
+	}
+	if names := quirks.Names(); len(names) > 0 {
+		logger.Info().Strs("quirks", names).Str("dest", destHomeserver).Msg("enabled homeserver quirks")
+	}
+	httpClient.Quirks = quirks
+	httpClient.Presence = opts.Presence
+	httpClient.ThreadNotifications = opts.ThreadNotifications
+	httpClient.Filter = opts.SyncFilter
+	return httpClient
+}
+
+// detectQuirks returns the known quirks of the upstream homeserver's implementation. If it
+// cannot be identified, it is assumed to have no quirks.
+func detectQuirks(client *sync2.HTTPClient) sync2.Quirks {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	name, version, err := client.ServerVersion(ctx)
+	if err != nil {
+		logger.Info().Err(err).Msg("could not identify upstream homeserver software, assuming no quirks")
+		return sync2.Quirks{}
+	}
+	logger.Info().Str("name", name).Str("version", version).Msg("identified upstream homeserver software")
+	return sync2.QuirksForServer(name)
+}
+
+// ServerConfig configures how the sync API is served.
+type ServerConfig struct {
+	// BindAddrs are the addresses to serve the sync API on. Addresses which start with '/' are
+	// unix sockets, everything else is a TCP host:port.
+	BindAddrs []string
+	// TLSCert and TLSKey, if both set, enable TLS on all TCP addresses. Unix sockets are always
+	// served in plaintext, as they are only reachable by local reverse proxies. The files are
+	// reloaded when they change.
+	TLSCert string
+	TLSKey  string
+	// ACMEDomains, if set, enables TLS on all TCP addresses using certificates from an ACME CA
+	// e.g Let's Encrypt, for these domains. Cannot be used with TLSCert and TLSKey. Certificates
+	// are obtained with the TLS-ALPN-01 challenge, so the proxy must be reachable on port 443.
+	ACMEDomains []string
+	// ACMECacheDir is where ACME account keys and certificates are stored. Required with ACMEDomains.
+	ACMECacheDir string
+	// ACMEEmail is an optional contact address given to the ACME CA.
+	ACMEEmail string
+	// H2C enables cleartext HTTP/2 on listeners without TLS. Only enable this if the proxy is
+	// behind a trusted reverse proxy which speaks h2c, as it bypasses TLS negotiation of HTTP/2.
+	H2C bool
+	// ProxyProtocol enables the HAProxy PROXY protocol on every listener, so the client address
+	// from the load balancer is used in place of the load balancer's address.
+	ProxyProtocol bool
+	// ProxyProtocolTrusted are the networks allowed to send PROXY headers. Connections from other
+	// addresses are served as if ProxyProtocol was disabled. If empty, all connections must send
+	// a header.
+	ProxyProtocolTrusted []*net.IPNet
+
+	// Shutdown, if set, gracefully shuts down the server when it is closed: listeners stop
+	// accepting connections, and the server returns once in-flight requests have finished, waiting
+	// at most shutdownTimeout. Drain the sync handler first so long polls finish straight away.
+	Shutdown <-chan struct{}
+	// Health, if set, is served without authentication on /health, see NewHealthHandler.
+	Health http.Handler
+}
+
+// shutdownTimeout is the longest a graceful shutdown waits for in-flight requests to finish.
+const shutdownTimeout = 30 * time.Second
+
+// http2Server returns the HTTP/2 settings for the sync API. Clients hold a long-poll open for
+// every connection they have, so allow many concurrent streams per TCP connection so they
+// multiplex instead of opening more connections. Request bodies are small, so the upload
+// flow control windows only need to cover a handful of requests in flight.
+func (cfg ServerConfig) http2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         1000,
+		MaxUploadBufferPerStream:     64 << 10,
+		MaxUploadBufferPerConnection: 1 << 20,
+		IdleTimeout:                  2 * time.Minute,
+	}
+}
+
+// tlsConfig returns the TLS config for TCP listeners, or nil if TLS is disabled.
+func (cfg ServerConfig) tlsConfig() (*tls.Config, error) {
+	if len(cfg.ACMEDomains) > 0 {
+		if cfg.TLSCert != "" || cfg.TLSKey != "" {
+			return nil, fmt.Errorf("ACME cannot be used with a TLS certificate and key")
+		}
+		if cfg.ACMECacheDir == "" {
+			return nil, fmt.Errorf("ACME requires a cache directory")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			Email:      cfg.ACMEEmail,
+		}
+		return m.TLSConfig(), nil
+	}
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		reloader, err := internal.NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+	}
+	return nil, nil
+}
+
+// RunSyncV3Server is the main entry point to the server. Blocks until cfg.Shutdown is closed,
+// serving the sync API on every bind address. If admin is not nil, it is served under AdminPrefix and must do its own
+// authentication.
+func RunSyncV3Server(h, admin http.Handler, destV2Server string, cfg ServerConfig) {
+	serveSyncV3(newSyncRouter(h, admin, destV2Server), cfg)
+}
+
+// RunHealthServer serves only cfg.Health on every bind address, for processes which do not serve the
+// sync API. Blocks until cfg.Shutdown is closed.
+func RunHealthServer(cfg ServerConfig) {
+	serveSyncV3(http.NotFoundHandler(), cfg)
+}
+
+// RunMultiTenantSyncV3Server is like RunSyncV3Server but serves several homeservers, routing each
+// request to the tenant for its Host. Blocks until cfg.Shutdown is closed.
+func RunMultiTenantSyncV3Server(tenants []TenantServer, cfg ServerConfig) {
+	hr := NewHostRouter()
+	for _, t := range tenants {
+		if err := hr.Handle(t.Tenant.Hosts, newSyncRouter(t.Handler, t.Admin, t.Tenant.Server)); err != nil {
+			logger.Fatal().Err(err).Str("tenant", t.Tenant.Name).Msg("failed to route tenant")
+		}
+	}
+	serveSyncV3(hr, cfg)
+}
+
+// setDBLimits applies the connection limits in opts to db.
+func setDBLimits(db *sqlx.DB, opts Opts) {
+	if opts.DBMaxConns > 0 {
+		// https://github.com/go-sql-driver/mysql#important-settings
+		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
+		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
+		db.SetMaxOpenConns(opts.DBMaxConns)
+		db.SetMaxIdleConns(opts.DBMaxConns)
+	}
+	if opts.DBConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	}
+}
+
+// openReadReplica opens the read replica in opts, in the same schema and with the same limits as
+// the primary.
+func openReadReplica(opts Opts) *sqlx.DB {
+	replicaURI := opts.DBReplica
+	var err error
+	if opts.DBSchema != "" {
+		replicaURI, err = withSearchPath(replicaURI, opts.DBSchema)
+		if err != nil {
+			logger.Panic().Err(err).Msg("invalid DB schema")
+		}
+	}
+	replica, err := sqlx.Open("postgres", replicaURI)
+	if err != nil {
+		sentry.CaptureException(err)
+		logger.Panic().Err(err).Msg("failed to open SQL DB replica")
+	}
+	setDBLimits(replica, opts)
+	return replica
+}
+
+// newSyncRouter returns the HTTP path routing for a single homeserver.
+func newSyncRouter(h, admin http.Handler, destV2Server string) http.Handler {
 	r := mux.NewRouter()
+	if admin != nil {
+		r.PathPrefix(AdminPrefix + "/admin/").Handler(http.StripPrefix(AdminPrefix, admin))
+		r.PathPrefix(AdminPrefix + "/health/").Handler(http.StripPrefix(AdminPrefix, admin))
+	}
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	r.Handle(sync3.SimplifiedSyncPath, allowCORS(h))
+	r.Handle(sync3.WebSocketSyncPath, h)
+	if destV2Server != "" {
+		// with several homeservers there is no single upstream to pass requests through to
+		r.PathPrefix(DehydratedDevicePrefix).Handler(allowCORS(NewDehydratedDeviceHandler(destV2Server)))
+	}
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`
@@ -185,10 +633,14 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 			http.StripPrefix("/client/", http.FileServer(http.Dir("./client"))),
 		),
 	)
+	return r
+}
 
+func serveSyncV3(final http.Handler, cfg ServerConfig) {
 	srv := &server{
 		chain: []func(next http.Handler) http.Handler{
 			hlog.NewHandler(logger),
+			hlog.RemoteAddrHandler("ip"),
 			func(next http.Handler) http.Handler {
 				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					r = r.WithContext(internal.RequestContext(r.Context()))
@@ -214,47 +666,129 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 					Msg("")
 			}),
 		},
-		final: r,
+		final: final,
+	}
+	if cfg.Health != nil {
+		srv.final = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/health" {
+				cfg.Health.ServeHTTP(w, req)
+				return
+			}
+			final.ServeHTTP(w, req)
+		})
 	}
 
-	// Block forever
-	var err error
-	if internal.IsUnixSocket(bindAddr) {
-		logger.Info().Msgf("listening on unix socket %s", bindAddr)
-		listener := unixSocketListener(bindAddr)
-		err = http.Serve(listener, srv)
-	} else {
-		if tlsCert != "" && tlsKey != "" {
-			logger.Info().Msgf("listening TLS on %s", bindAddr)
-			err = http.ListenAndServeTLS(bindAddr, tlsCert, tlsKey, srv)
+	if len(cfg.BindAddrs) == 0 {
+		logger.Fatal().Msg("no bind addresses configured")
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		sentry.CaptureException(err)
+		logger.Fatal().Err(err).Msg("failed to configure TLS")
+	}
+	listeners := make([]net.Listener, 0, len(cfg.BindAddrs))
+	for _, bindAddr := range cfg.BindAddrs {
+		listener, err := Listen(bindAddr)
+		if err != nil {
+			sentry.CaptureException(err)
+			logger.Fatal().Err(err).Str("addr", bindAddr).Msg("failed to listen")
+		}
+		if cfg.ProxyProtocol {
+			listener = &internal.ProxyProtoListener{
+				Listener:      listener,
+				Trusted:       cfg.ProxyProtocolTrusted,
+				HeaderTimeout: 10 * time.Second,
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// Block until we shut down, or until one of the listeners fails
+	errs := make(chan error, len(listeners))
+	httpSrvs := make([]*http.Server, 0, len(listeners))
+	for _, listener := range listeners {
+		addr := listener.Addr().String()
+		useTLS := tlsConfig != nil && listener.Addr().Network() != "unix"
+		httpSrv := &http.Server{Handler: srv}
+		if useTLS {
+			logger.Info().Msgf("listening TLS on %s", addr)
+			httpSrv.TLSConfig = tlsConfig.Clone()
+			if err := http2.ConfigureServer(httpSrv, cfg.http2Server()); err != nil {
+				sentry.CaptureException(err)
+				logger.Fatal().Err(err).Msg("failed to configure HTTP/2")
+			}
+		} else if cfg.H2C {
+			logger.Info().Msgf("listening on %s (h2c)", addr)
+			httpSrv.Handler = h2c.NewHandler(srv, cfg.http2Server())
 		} else {
-			logger.Info().Msgf("listening on %s", bindAddr)
-			err = http.ListenAndServe(bindAddr, srv)
+			logger.Info().Msgf("listening on %s", addr)
 		}
+		httpSrvs = append(httpSrvs, httpSrv)
+		go func(listener net.Listener) {
+			if useTLS {
+				errs <- httpSrv.ServeTLS(listener, "", "")
+			} else {
+				errs <- httpSrv.Serve(listener)
+			}
+		}(listener)
 	}
-	if err != nil {
+	select {
+	case err = <-errs:
 		sentry.CaptureException(err)
 		// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
 		logger.Fatal().Err(err).Msg("failed to listen and serve")
+	case <-cfg.Shutdown:
+	}
+
+	logger.Info().Msg("shutting down: waiting for in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, httpSrv := range httpSrvs {
+		wg.Add(1)
+		go func(httpSrv *http.Server) {
+			defer wg.Done()
+			if err := httpSrv.Shutdown(ctx); err != nil {
+				logger.Warn().Err(err).Msg("shutting down: gave up waiting for in-flight requests")
+			}
+		}(httpSrv)
+	}
+	wg.Wait()
+}
+
+// Listen returns a listener for a bind address. Addresses which start with '/' are unix
+// sockets, replacing any existing socket file, which any local user can connect to. Everything
+// else is a TCP host:port.
+func Listen(bindAddr string) (net.Listener, error) {
+	// least permissions and work out of box (-w--w--w-)
+	return ListenWithMode(bindAddr, 0222)
+}
+
+// ListenWithMode is like Listen, but unix sockets are created with the given permissions.
+// Unauthenticated endpoints such as the admin API should use 0600, so that only the user
+// running the proxy can connect.
+func ListenWithMode(bindAddr string, mode os.FileMode) (net.Listener, error) {
+	if internal.IsUnixSocket(bindAddr) {
+		return unixSocketListener(bindAddr, mode)
 	}
+	return net.Listen("tcp", bindAddr)
 }
 
-func unixSocketListener(bindAddr string) net.Listener {
+func unixSocketListener(bindAddr string, mode os.FileMode) (net.Listener, error) {
 	err := os.Remove(bindAddr)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		logger.Fatal().Err(err).Msg("failed to remove existing unix socket")
+		return nil, fmt.Errorf("failed to remove existing unix socket: %w", err)
 	}
 	listener, err := net.Listen("unix", bindAddr)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to serve unix socket")
+		return nil, fmt.Errorf("failed to serve unix socket: %w", err)
 	}
-	// least permissions and work out of box (-w--w--w-); could be extracted as
-	// env variable if needed
-	err = os.Chmod(bindAddr, 0222)
+	err = os.Chmod(bindAddr, mode)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to set unix socket permissions")
+		listener.Close()
+		return nil, fmt.Errorf("failed to set unix socket permissions: %w", err)
 	}
-	return listener
+	return listener, nil
 }
 
 type HandlerError struct {